@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// requireAdmin guards control-plane endpoints. When ADMIN_TOKEN is set the
+// caller must send it as a bearer token; otherwise only loopback callers are
+// allowed, which keeps a fresh install safe on a shared LAN.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := r.Method + " " + r.URL.Path
+		if !adminAuthorized(r) {
+			logRequest(r, "[admin] rejected %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			audit.Record("admin", adminActor(r), action, "denied", map[string]any{"request_id": requestID(r)})
+			writeJSONError(w, ErrUnauthorized)
+			return
+		}
+		sw := &auditStatusWriter{ResponseWriter: w, status: http.StatusOK}
+		next(sw, r)
+		result := "ok"
+		if sw.status >= 400 {
+			result = "error"
+		}
+		audit.Record("admin", adminActor(r), action, result, map[string]any{"status": sw.status, "query": r.URL.RawQuery, "request_id": requestID(r)})
+	}
+}
+
+func adminAuthorized(r *http.Request) bool {
+	token := strings.TrimSpace(os.Getenv("ADMIN_TOKEN"))
+	if token == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	}
+
+	got := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[http] encode error: %v", err)
+	}
+}
+
+// writeJSONError writes err's JSON body (see errors.go) with the status of
+// its code, and the request's correlation ID when it has one.
+func writeJSONError(w http.ResponseWriter, err error) {
+	body := errorBody(err)
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		body["request_id"] = id
+	}
+	writeJSON(w, errorKind(err, ErrInternal).Status(), body)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Air quality kinds: PM2.5 and PM10 in µg/m³ and CO2 in ppm. Pi fields
+// named pm2_5 (or pm25), pm10 and co2 get those units by default, e.g.
+//
+//	SENSOR_KINDS=pm25:pm2_5:/localsense/pm25/v1,co2:co2:/localsense/co2/v1
+//
+// Every kind may have a valid range, <KIND>_MIN and <KIND>_MAX in the
+// kind's unit; readings outside it are taken for sensor faults and not
+// sent. Air quality units have defaults covering what low-cost sensors
+// measure, other kinds are unbounded unless configured.
+//
+// PM samples also carry the US EPA AQI (2024 breakpoints) of their
+// concentration with its category. The EPA computes AQI from 24-hour
+// averages; one reading's AQI is indicative only.
+
+// valueRange bounds the readings of a kind; a nil bound is open.
+type valueRange struct {
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+// defaultRanges are the plausible readings for air quality units, min and
+// max.
+var defaultRanges = map[unit][2]float64{
+	unitMicrogramsPerM3: {0, 1000},
+	unitPPM:             {250, 40000},
+}
+
+// loadKindRanges reads <KIND>_MIN and <KIND>_MAX for each kind.
+func loadKindRanges(kinds []sensorKind) []sensorKind {
+	for i := range kinds {
+		prefix := strings.ToUpper(kinds[i].Name) + "_"
+		var r valueRange
+		if def, ok := defaultRanges[kinds[i].Conversion.To]; ok {
+			r.Min, r.Max = &def[0], &def[1]
+		}
+		bound := func(key string, def *float64) *float64 {
+			if getEnvOrDefault(key, "") == "" {
+				return def
+			}
+			v := parseEnvFloat(key, 0)
+			return &v
+		}
+		r.Min = bound(prefix+"MIN", r.Min)
+		r.Max = bound(prefix+"MAX", r.Max)
+		if r.Min != nil || r.Max != nil {
+			kinds[i].Range = &r
+		}
+	}
+	return kinds
+}
+
+// InRange reports whether v is a plausible reading for the kind.
+func (k sensorKind) InRange(v float64) bool {
+	if k.Range == nil {
+		return true
+	}
+	return (k.Range.Min == nil || v >= *k.Range.Min) && (k.Range.Max == nil || v <= *k.Range.Max)
+}
+
+// aqiBreakpoint maps a concentration range onto an AQI range.
+type aqiBreakpoint struct {
+	cLo, cHi float64
+	iLo, iHi float64
+}
+
+var aqiCategories = []string{
+	"good", "moderate", "unhealthy_for_sensitive_groups", "unhealthy", "very_unhealthy", "hazardous",
+}
+
+var (
+	pm25Breakpoints = []aqiBreakpoint{
+		{0.0, 9.0, 0, 50}, {9.1, 35.4, 51, 100}, {35.5, 55.4, 101, 150},
+		{55.5, 125.4, 151, 200}, {125.5, 225.4, 201, 300}, {225.5, 325.4, 301, 500},
+	}
+	pm10Breakpoints = []aqiBreakpoint{
+		{0, 54, 0, 50}, {55, 154, 51, 100}, {155, 254, 101, 150},
+		{255, 354, 151, 200}, {355, 424, 201, 300}, {425, 604, 301, 500},
+	}
+)
+
+// sampleAQI is the AQI of one PM reading.
+type sampleAQI struct {
+	Value     int    `json:"value"`
+	Category  string `json:"category"`
+	Pollutant string `json:"pollutant"`
+}
+
+// aqiPollutant is the EPA pollutant a kind measures, or "".
+func aqiPollutant(kind sensorKind) string {
+	if kind.Conversion.To != unitMicrogramsPerM3 {
+		return ""
+	}
+	switch kind.Field {
+	case "pm2_5", "pm25":
+		return "pm2_5"
+	case "pm10":
+		return "pm10"
+	}
+	return ""
+}
+
+// computeAQI returns the AQI of concentration c for the kind's pollutant;
+// ok is false for kinds without one.
+func computeAQI(kind sensorKind, c float64) (sampleAQI, bool) {
+	var bps []aqiBreakpoint
+	pollutant := aqiPollutant(kind)
+	switch pollutant {
+	case "pm2_5":
+		bps = pm25Breakpoints
+		c = math.Floor(c*10) / 10 // the EPA truncates PM2.5 to 0.1
+	case "pm10":
+		bps = pm10Breakpoints
+		c = math.Floor(c)
+	default:
+		return sampleAQI{}, false
+	}
+	if c < 0 {
+		return sampleAQI{}, false
+	}
+	// Above the top breakpoint the AQI is reported as 500.
+	aqi := sampleAQI{Value: 500, Category: aqiCategories[len(aqiCategories)-1], Pollutant: pollutant}
+	for i, bp := range bps {
+		if c <= bp.cHi {
+			aqi.Value = int(math.Round((bp.iHi-bp.iLo)/(bp.cHi-bp.cLo)*(max(c, bp.cLo)-bp.cLo) + bp.iLo))
+			aqi.Category = aqiCategories[i]
+			break
+		}
+	}
+	return aqi, true
+}
+
+// appendJSON writes a as encoding/json would.
+func (a sampleAQI) appendJSON(dst []byte) []byte {
+	dst = append(dst, `{"value":`...)
+	dst = strconv.AppendInt(dst, int64(a.Value), 10)
+	dst = append(dst, `,"category":`...)
+	dst = appendJSONString(dst, a.Category)
+	dst = append(dst, `,"pollutant":`...)
+	dst = appendJSONString(dst, a.Pollutant)
+	return append(dst, '}')
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// Every ANCHOR_WINDOW_MINUTES the seller seals the samples it produced in
+// that window into a Merkle tree and publishes the root to its stdout topic
+// as a localsenseMerkleAnchor message. The leaves are kept under ANCHOR_DIR
+// so GET /proof?kind=&seq= can later return the path from any sample to an
+// anchored root: a buyer holding the payload line it was sent can prove it
+// belongs to the dataset the seller committed to on HCS.
+//
+// Leaves are sha256(0x00 || payload) over the JSON payload exactly as sent
+// (including the signature when SIGNING_KEY is set, excluding the newline),
+// inner nodes sha256(0x01 || left || right), in production order; an odd node
+// out is promoted to the next level unchanged. Avro frames are not covered.
+//
+// Windows are sealed at their boundary (or by the first sample after it)
+// and when the node shuts down. Leaves of the open window are appended to
+// ANCHOR_DIR/open-<start>.jsonl as they come, so a restart picks the window
+// up where it was. A root that couldn't be published is retried at the
+// next window boundary.
+
+const merkleAnchorType = "localsenseMerkleAnchor"
+
+type merkleLeaf struct {
+	Kind string `json:"kind"`
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// anchorWindow is one sealed window; the leaves are only loaded for proofs.
+type anchorWindow struct {
+	Start     int64                `json:"start"`
+	End       int64                `json:"end"`
+	Root      string               `json:"root"`
+	LeafCount int                  `json:"leaf_count"`
+	Kinds     map[string][2]uint64 `json:"kinds"` // kind -> first and last seq
+	Published bool                 `json:"published"`
+	Error     string               `json:"publish_error,omitempty"`
+	Leaves    []merkleLeaf         `json:"leaves,omitempty"`
+}
+
+func (w anchorWindow) covers(kind string, seq uint64) bool {
+	r, ok := w.Kinds[kind]
+	return ok && seq >= r[0] && seq <= r[1]
+}
+
+var errAnchorPending = errors.New("sample not anchored yet")
+
+type proofStep struct {
+	Hash string `json:"hash"`
+	Side string `json:"side"` // left or right of the running hash
+}
+
+type anchorer struct {
+	dir       string
+	window    time.Duration
+	retention time.Duration
+
+	mu      sync.Mutex
+	start   time.Time
+	leaves  []merkleLeaf
+	open    *os.File       // leaves of the open window, one per line
+	windows []anchorWindow // sealed, oldest first, without leaves
+
+	publishMu sync.Mutex // one publish round at a time
+}
+
+var anchors *anchorer
+
+func loadAnchors() {
+	minutes := parseEnvInt("ANCHOR_WINDOW_MINUTES", 60)
+	if minutes <= 0 {
+		return
+	}
+	a := &anchorer{
+		dir:       getEnvOrDefault("ANCHOR_DIR", "data/anchors"),
+		window:    time.Duration(minutes) * time.Minute,
+		retention: time.Duration(parseEnvInt("ANCHOR_RETENTION_DAYS", 30)) * 24 * time.Hour,
+	}
+	if err := os.MkdirAll(a.dir, 0o755); err != nil {
+		log.Fatalf("anchor: %v", err)
+	}
+	if err := a.loadIndex(); err != nil {
+		log.Fatalf("anchor: %v", err)
+	}
+	if err := a.restoreOpen(time.Now()); err != nil {
+		log.Fatalf("anchor: %v", err)
+	}
+	anchors = a
+	go a.run()
+	log.Printf("Anchor    : every %s, %d window(s) in %s, %d leaves open", a.window, len(a.windows), a.dir, len(a.leaves))
+}
+
+func (a *anchorer) windowPath(start int64) string {
+	return filepath.Join(a.dir, strconv.FormatInt(start, 10)+".json")
+}
+
+func (a *anchorer) openPath(start int64) string {
+	return filepath.Join(a.dir, "open-"+strconv.FormatInt(start, 10)+".jsonl")
+}
+
+// restoreOpen reloads the leaves of windows that were open when the node
+// stopped. The one still running at now is carried on; the rest are sealed
+// and published at the next boundary.
+func (a *anchorer) restoreOpen(now time.Time) error {
+	files, err := filepath.Glob(filepath.Join(a.dir, "open-*.jsonl"))
+	if err != nil {
+		return err
+	}
+	var starts []int64
+	for _, path := range files {
+		name := filepath.Base(path)
+		start, err := strconv.ParseInt(name[len("open-"):len(name)-len(".jsonl")], 10, 64)
+		if err != nil {
+			log.Printf("anchor: skipping %s: %v", path, err)
+			continue
+		}
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	current := now.Truncate(a.window).Unix()
+	for _, start := range starts {
+		if a.sealed(start) {
+			// Sealed just before the node stopped.
+			os.Remove(a.openPath(start))
+			continue
+		}
+		leaves, err := readOpenLeaves(a.openPath(start))
+		if err != nil {
+			return err
+		}
+		a.start, a.leaves = time.Unix(start, 0), leaves
+		if start != current {
+			a.rollLocked(time.Time{})
+			continue
+		}
+		// Rewrite the file so new leaves don't follow a line cut short.
+		os.Remove(a.openPath(start))
+		for _, l := range leaves {
+			a.appendOpenLocked(l)
+		}
+	}
+	return nil
+}
+
+func (a *anchorer) sealed(start int64) bool {
+	for _, w := range a.windows {
+		if w.Start == start {
+			return true
+		}
+	}
+	return false
+}
+
+// readOpenLeaves reads an open window's leaves; a line cut short by a crash
+// ends them.
+func readOpenLeaves(path string) ([]merkleLeaf, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var leaves []merkleLeaf
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var l merkleLeaf
+		if len(line) == 0 || json.Unmarshal(line, &l) != nil {
+			break
+		}
+		leaves = append(leaves, l)
+	}
+	return leaves, nil
+}
+
+// run seals each window at its boundary and retries unpublished roots.
+func (a *anchorer) run() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(a.window).Add(a.window).Sub(now))
+		a.mu.Lock()
+		if now := time.Now(); !a.start.IsZero() && !now.Before(a.start.Add(a.window)) {
+			a.rollLocked(now.Truncate(a.window))
+		}
+		a.mu.Unlock()
+		a.publishPending()
+	}
+}
+
+// Close seals the open window and publishes what is unpublished, for
+// shutdown. A nil anchorer ignores it.
+func (a *anchorer) Close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.rollLocked(time.Time{})
+	a.mu.Unlock()
+	a.publishPending()
+}
+
+func (a *anchorer) loadIndex() error {
+	files, err := filepath.Glob(filepath.Join(a.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		w, err := readAnchorWindow(path)
+		if err != nil {
+			log.Printf("anchor: skipping %s: %v", path, err)
+			continue
+		}
+		w.Leaves = nil
+		a.windows = append(a.windows, w)
+	}
+	sort.Slice(a.windows, func(i, j int) bool { return a.windows[i].Start < a.windows[j].Start })
+	return nil
+}
+
+func readAnchorWindow(path string) (anchorWindow, error) {
+	var w anchorWindow
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return w, err
+	}
+	return w, json.Unmarshal(data, &w)
+}
+
+// Add records a produced sample, sealing the previous window first when now
+// is past its end. A nil anchorer (ANCHOR_WINDOW_MINUTES=0) ignores it.
+func (a *anchorer) Add(kind string, seq uint64, payload []byte, now time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	sealed := false
+	if windowStart := now.Truncate(a.window); !windowStart.Equal(a.start) {
+		sealed = a.rollLocked(windowStart)
+	}
+	leaf := merkleLeaf{Kind: kind, Seq: seq, Hash: hex.EncodeToString(merkleLeafHash(payload))}
+	a.leaves = append(a.leaves, leaf)
+	a.appendOpenLocked(leaf)
+	a.mu.Unlock()
+
+	if sealed {
+		go a.publishPending()
+	}
+}
+
+// appendOpenLocked writes leaf to the open window's file.
+func (a *anchorer) appendOpenLocked(leaf merkleLeaf) {
+	if a.open == nil {
+		f, err := os.OpenFile(a.openPath(a.start.Unix()), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Printf("anchor: open window %d: %v", a.start.Unix(), err)
+			return
+		}
+		a.open = f
+	}
+	data, _ := json.Marshal(leaf)
+	if _, err := a.open.Write(append(data, '\n')); err != nil {
+		log.Printf("anchor: record leaf %s seq %d: %v", leaf.Kind, leaf.Seq, err)
+	}
+}
+
+// rollLocked seals the open window, if it has leaves, and starts the one at
+// start. It reports whether a window was sealed.
+func (a *anchorer) rollLocked(start time.Time) bool {
+	sealed := false
+	if len(a.leaves) > 0 {
+		sealed = true
+		if _, err := a.sealLocked(); err != nil {
+			// Keep the leaves on disk; the next start seals them again.
+			log.Printf("anchor: save window %d: %v", a.start.Unix(), err)
+			sealed = false
+		}
+	}
+	if a.open != nil {
+		a.open.Close()
+		a.open = nil
+	}
+	if sealed || len(a.leaves) == 0 {
+		os.Remove(a.openPath(a.start.Unix()))
+	}
+	a.start, a.leaves = start, nil
+	return sealed
+}
+
+// sealLocked computes the root of the current window and saves it.
+func (a *anchorer) sealLocked() (anchorWindow, error) {
+	hashes := make([][]byte, len(a.leaves))
+	kinds := make(map[string][2]uint64)
+	for i, l := range a.leaves {
+		hashes[i], _ = hex.DecodeString(l.Hash)
+		r, ok := kinds[l.Kind]
+		if !ok {
+			r[0] = l.Seq
+		}
+		r[1] = l.Seq
+		kinds[l.Kind] = r
+	}
+	w := anchorWindow{
+		Start:     a.start.Unix(),
+		End:       a.start.Add(a.window).Unix(),
+		Root:      hex.EncodeToString(merkleRoot(hashes)),
+		LeafCount: len(a.leaves),
+		Kinds:     kinds,
+		Leaves:    a.leaves,
+	}
+	if err := a.save(w); err != nil {
+		return w, err
+	}
+	index := w
+	index.Leaves = nil
+	a.windows = append(a.windows, index)
+	a.pruneLocked()
+	return w, nil
+}
+
+func (a *anchorer) save(w anchorWindow) error {
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	path := a.windowPath(w.Start)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (a *anchorer) pruneLocked() {
+	cutoff := time.Now().Add(-a.retention).Unix()
+	for len(a.windows) > 0 && a.windows[0].End < cutoff {
+		os.Remove(a.windowPath(a.windows[0].Start))
+		a.windows = a.windows[1:]
+	}
+}
+
+// publishPending publishes every sealed window whose root hasn't gone out.
+func (a *anchorer) publishPending() {
+	if !neuronStreamingEnabled() {
+		return
+	}
+	a.publishMu.Lock()
+	defer a.publishMu.Unlock()
+	a.mu.Lock()
+	var pending []int64
+	for _, w := range a.windows {
+		if !w.Published {
+			pending = append(pending, w.Start)
+		}
+	}
+	a.mu.Unlock()
+	for _, start := range pending {
+		w, err := readAnchorWindow(a.windowPath(start))
+		if err != nil {
+			log.Printf("anchor: publish window %d: %v", start, err)
+			continue
+		}
+		a.publish(w)
+	}
+}
+
+// publish sends the window root to HCS and records the outcome on disk. A
+// root queued for an unreachable network counts as published: the queue
+// delivers it.
+func (a *anchorer) publish(w anchorWindow) {
+	msg := map[string]any{
+		"messageType": merkleAnchorType,
+		"seller_id":   sellerCfg.SellerID,
+		"start":       w.Start,
+		"end":         w.End,
+		"root":        w.Root,
+		"leaf_count":  w.LeafCount,
+		"kinds":       w.Kinds,
+	}
+	data, _ := json.Marshal(msg)
+	err := sendToTopic(commonlib.MyStdOut, data, "anchor")
+	if err != nil && !errors.Is(err, errHederaQueued) {
+		log.Printf("anchor: publish window %d: %v, retrying at the next boundary", w.Start, err)
+		w.Error = err.Error()
+	} else {
+		w.Error = ""
+		log.Printf("anchor: published root %.16s for %d samples (%s)", w.Root, w.LeafCount, time.Unix(w.Start, 0).UTC().Format(time.RFC3339))
+		w.Published = true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.save(w); err != nil {
+		log.Printf("anchor: save window %d: %v", w.Start, err)
+	}
+	for i := range a.windows {
+		if a.windows[i].Start == w.Start {
+			a.windows[i].Published, a.windows[i].Error = w.Published, w.Error
+		}
+	}
+}
+
+// Proof returns the sealed window holding kind/seq and the Merkle path from
+// its leaf to the root.
+func (a *anchorer) Proof(kind string, seq uint64) (anchorWindow, merkleLeaf, int, []proofStep, error) {
+	a.mu.Lock()
+	var found *anchorWindow
+	for i := len(a.windows) - 1; i >= 0; i-- {
+		if a.windows[i].covers(kind, seq) {
+			w := a.windows[i]
+			found = &w
+			break
+		}
+	}
+	pending := false
+	for _, l := range a.leaves {
+		pending = pending || (l.Kind == kind && l.Seq == seq)
+	}
+	closes := a.start.Add(a.window)
+	a.mu.Unlock()
+
+	if found == nil {
+		if pending {
+			return anchorWindow{}, merkleLeaf{}, 0, nil, fmt.Errorf("%w: %s seq %d is anchored when the window closes at %s", errAnchorPending, kind, seq, closes.UTC().Format(time.RFC3339))
+		}
+		return anchorWindow{}, merkleLeaf{}, 0, nil, fmt.Errorf("no anchored window holds %s seq %d", kind, seq)
+	}
+	full, err := readAnchorWindow(a.windowPath(found.Start))
+	if err != nil {
+		return anchorWindow{}, merkleLeaf{}, 0, nil, err
+	}
+	hashes := make([][]byte, len(full.Leaves))
+	idx := -1
+	for i, l := range full.Leaves {
+		hashes[i], _ = hex.DecodeString(l.Hash)
+		if l.Kind == kind && l.Seq == seq {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		// The seq range has holes where a payload failed to build.
+		return anchorWindow{}, merkleLeaf{}, 0, nil, fmt.Errorf("%s seq %d was not produced in window %d", kind, seq, found.Start)
+	}
+	leaf := full.Leaves[idx]
+	full.Leaves = nil
+	return full, leaf, idx, merklePath(hashes, idx), nil
+}
+
+func merkleLeafHash(payload []byte) []byte {
+	payload = bytes.TrimRight(payload, "\r\n")
+	sum := sha256.Sum256(append([]byte{0}, payload...))
+	return sum[:]
+}
+
+func merkleNode(left, right []byte) []byte {
+	buf := make([]byte, 0, 1+len(left)+len(right))
+	buf = append(append(append(buf, 1), left...), right...)
+	sum := sha256.Sum256(buf)
+	return sum[:]
+}
+
+// merkleLevels returns every level of the tree, leaves first.
+func merkleLevels(leaves [][]byte) [][][]byte {
+	levels := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+func merkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return nil
+	}
+	levels := merkleLevels(leaves)
+	return levels[len(levels)-1][0]
+}
+
+func merklePath(leaves [][]byte, idx int) []proofStep {
+	var path []proofStep
+	for _, level := range merkleLevels(leaves) {
+		if len(level) == 1 {
+			break
+		}
+		switch {
+		case idx%2 == 1:
+			path = append(path, proofStep{Hash: hex.EncodeToString(level[idx-1]), Side: "left"})
+		case idx+1 < len(level):
+			path = append(path, proofStep{Hash: hex.EncodeToString(level[idx+1]), Side: "right"})
+		}
+		idx /= 2
+	}
+	return path
+}
+
+// GET /proof?seq=[&kind=] returns the Merkle path proving a sample belongs
+// to an anchored window. kind defaults to the first sensor kind.
+func proofHandler(w http.ResponseWriter, r *http.Request) {
+	if anchors == nil {
+		writeJSONError(w, ErrDisabled.With("anchoring disabled (ANCHOR_WINDOW_MINUTES=0)"))
+		return
+	}
+	q := r.URL.Query()
+	seq, err := strconv.ParseUint(q.Get("seq"), 10, 64)
+	if err != nil {
+		writeJSONError(w, ErrBadRequest.With("seq is required"))
+		return
+	}
+	kind := q.Get("kind")
+	if kind == "" {
+		neuron, _ := getNeuronSellerConfig()
+		kind = neuron.Kinds[0].Name
+	}
+
+	win, leaf, idx, path, err := anchors.Proof(kind, seq)
+	if err != nil {
+		kind := ErrNotFound
+		if errors.Is(err, errAnchorPending) {
+			kind = ErrConflict
+		}
+		writeJSONError(w, kind.Wrap(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"kind":       kind,
+		"seq":        seq,
+		"leaf_hash":  leaf.Hash,
+		"leaf_index": idx,
+		"path":       path,
+		"window":     win,
+		"algorithm":  "sha256; leaf = H(0x00 || payload), node = H(0x01 || left || right), odd node promoted",
+	})
+}
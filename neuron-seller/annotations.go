@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Annotations are operator notes on a time range ("sensor cleaned",
+// "construction shading 09:00-11:00") that explain what the readings can't:
+// a step after a cleaning, a dip while a crane stood in front of the
+// sensor. They are ground truth for buyers, so they live next to history
+// (annotations.json in HISTORY_DIR), come with /history responses and
+// evidence bundles that overlap them, and are listed by GET /annotations.
+// Adding or removing one is an admin call and lands in the audit log.
+
+const (
+	maxAnnotations    = 10000
+	maxAnnotationNote = 1024
+)
+
+type annotation struct {
+	ID        string    `json:"id"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Kind      string    `json:"kind,omitempty"` // empty: every kind
+	Note      string    `json:"note"`
+	Author    string    `json:"author,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type annotationStore struct {
+	mu    sync.RWMutex
+	path  string
+	notes []annotation // by From, then ID
+}
+
+// annotations is nil while history is disabled.
+var annotations *annotationStore
+
+func loadAnnotations() {
+	if history == nil {
+		return
+	}
+	s := &annotationStore{path: filepath.Join(history.dir, "annotations.json")}
+	data, err := os.ReadFile(s.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		log.Fatalf("annotations: read %s: %v", s.path, err)
+	default:
+		if err := json.Unmarshal(data, &s.notes); err != nil {
+			log.Fatalf("annotations: parse %s: %v", s.path, err)
+		}
+		log.Printf("Annotate  : %d annotation(s) from %s", len(s.notes), s.path)
+	}
+	annotations = s
+}
+
+// Overlapping returns the annotations touching [from, to) for kind ("" for
+// every kind); annotations without a kind match every kind.
+func (s *annotationStore) Overlapping(from, to time.Time, kind string) []annotation {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []annotation
+	for _, a := range s.notes {
+		if !a.From.Before(to) || !a.To.After(from) {
+			continue
+		}
+		if kind != "" && a.Kind != "" && a.Kind != kind {
+			continue
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+// Add validates a, gives it an ID and stores it.
+func (s *annotationStore) Add(a annotation, now time.Time) (annotation, error) {
+	a.Note = strings.TrimSpace(a.Note)
+	a.Kind = strings.TrimSpace(a.Kind)
+	switch {
+	case a.Note == "":
+		return a, fmt.Errorf("note must not be empty")
+	case len(a.Note) > maxAnnotationNote:
+		return a, fmt.Errorf("note longer than %d bytes", maxAnnotationNote)
+	case a.From.IsZero() || a.To.IsZero():
+		return a, fmt.Errorf("from and to are required")
+	case !a.To.After(a.From):
+		return a, fmt.Errorf("to must be later than from")
+	}
+	if a.Kind != "" {
+		neuron, _ := getNeuronSellerConfig()
+		if _, ok := neuron.ensureDefaults().kindByName(a.Kind); !ok {
+			return a, fmt.Errorf("unknown kind %q", a.Kind)
+		}
+	}
+	a.From, a.To = a.From.UTC(), a.To.UTC()
+	a.ID = newSampleID(now)
+	a.CreatedAt = now.UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.notes) >= maxAnnotations {
+		return a, fmt.Errorf("at most %d annotations", maxAnnotations)
+	}
+	notes := append(slices.Clone(s.notes), a)
+	slices.SortStableFunc(notes, func(x, y annotation) int {
+		if c := x.From.Compare(y.From); c != 0 {
+			return c
+		}
+		return strings.Compare(x.ID, y.ID)
+	})
+	if err := s.save(notes); err != nil {
+		return a, err
+	}
+	s.notes = notes
+	return a, nil
+}
+
+// Remove deletes the annotation with id, reporting whether there was one.
+func (s *annotationStore) Remove(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.notes, func(a annotation) bool { return a.ID == id })
+	if i < 0 {
+		return false, nil
+	}
+	notes := slices.Delete(slices.Clone(s.notes), i, i+1)
+	if err := s.save(notes); err != nil {
+		return false, err
+	}
+	s.notes = notes
+	return true, nil
+}
+
+// save writes notes through a temp file; called with s.mu held.
+func (s *annotationStore) save(notes []annotation) error {
+	data, err := json.MarshalIndent(notes, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("save %s: %w", s.path, err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("save %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// GET /annotations?from=&to=&kind= lists annotations overlapping the range
+// (default: all of them). POST /annotations with {"from", "to", "kind",
+// "note"} adds one and DELETE /annotations?id= removes one; both need the
+// admin token.
+func annotationsHandler(w http.ResponseWriter, r *http.Request) {
+	if annotations == nil {
+		writeJSONError(w, ErrDisabled.With("annotations need history (HISTORY_ENABLE=false)"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		from, err := parseTimeParam(q.Get("from"), time.Unix(0, 0))
+		if err != nil {
+			writeJSONError(w, ErrBadRequest.With("invalid from: "+err.Error()))
+			return
+		}
+		to, err := parseTimeParam(q.Get("to"), time.Now().Add(100*365*24*time.Hour))
+		if err != nil {
+			writeJSONError(w, ErrBadRequest.With("invalid to: "+err.Error()))
+			return
+		}
+		list := annotations.Overlapping(from, to, q.Get("kind"))
+		writeJSON(w, http.StatusOK, map[string]any{"count": len(list), "annotations": list})
+	case http.MethodPost, http.MethodDelete:
+		requireAdmin(adminAnnotationsHandler)(w, r)
+	default:
+		writeJSONError(w, ErrMethodNotAllowed)
+	}
+}
+
+func adminAnnotationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		id := r.URL.Query().Get("id")
+		if !validULID(id) {
+			writeJSONError(w, ErrBadRequest.With("id must be an annotation ID"))
+			return
+		}
+		ok, err := annotations.Remove(id)
+		switch {
+		case err != nil:
+			writeJSONError(w, ErrInternal.Wrap(err))
+		case !ok:
+			writeJSONError(w, ErrNotFound.With("no annotation with id "+id))
+		default:
+			logRequest(r, "[/annotations] %s removed by %s", id, r.RemoteAddr)
+			writeJSON(w, http.StatusOK, map[string]any{"removed": id})
+		}
+		return
+	}
+
+	var a annotation
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		writeJSONError(w, ErrBadRequest.With("invalid JSON body: "+err.Error()))
+		return
+	}
+	a.Author = adminActor(r)
+	a, err := annotations.Add(a, time.Now())
+	if err != nil {
+		writeJSONError(w, ErrBadRequest.Wrap(err))
+		return
+	}
+	logRequest(r, "[/annotations] %s %q on [%s, %s) by %s", a.ID, a.Note,
+		a.From.Format(time.RFC3339), a.To.Format(time.RFC3339), a.Author)
+	writeJSON(w, http.StatusCreated, a)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// Control-plane actions (admin API calls, topic commands and the policy
+// decisions behind them, fleet config pushes, bandwidth suspensions) are
+// appended to AUDIT_LOG_FILE, one JSON entry per line. Each entry carries the
+// hash of the previous one, so editing or dropping a line breaks the chain
+// from there on. With AUDIT_ANCHOR_INTERVAL_MINUTES the head hash is
+// published to the node's stdout topic, which pins the log as of that time.
+
+const auditAnchorType = "localsenseAuditAnchor"
+
+type auditEntry struct {
+	Seq      uint64          `json:"seq"`
+	Time     time.Time       `json:"time"`
+	Source   string          `json:"source"` // admin, command, policy, fleet, bandwidth, trial, audit
+	Actor    string          `json:"actor"`
+	Action   string          `json:"action"`
+	Result   string          `json:"result"`
+	Detail   json.RawMessage `json:"detail,omitempty"`
+	PrevHash string          `json:"prev_hash"`
+	Hash     string          `json:"hash"`
+}
+
+// chainHash is sha256(prev_hash || entry JSON without its hash).
+func (e auditEntry) chainHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(append([]byte(e.PrevHash), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+type auditLog struct {
+	mu         sync.Mutex
+	path       string
+	seq        uint64
+	head       string
+	anchoredAt uint64 // last anchored seq
+}
+
+var audit *auditLog
+
+func loadAuditLog() {
+	if !parseEnvBool("AUDIT_ENABLE", true) {
+		return
+	}
+	a := &auditLog{path: getEnvOrDefault("AUDIT_LOG_FILE", "data/audit.jsonl")}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0o755); err != nil {
+		log.Fatalf("audit: %v", err)
+	}
+	entries, err := a.read(0, "", 0)
+	if err != nil {
+		log.Fatalf("audit: %v", err)
+	}
+	if n := len(entries); n > 0 {
+		a.seq, a.head = entries[n-1].Seq, entries[n-1].Hash
+	}
+	if bad := verifyAuditChain(entries); bad != 0 {
+		log.Printf("Audit     : warning: %s hash chain breaks at seq %d", a.path, bad)
+	}
+	audit = a
+	log.Printf("Audit     : %s (%d entries)", a.path, a.seq)
+
+	if every := parseEnvInt("AUDIT_ANCHOR_INTERVAL_MINUTES", 0); every > 0 {
+		go a.anchorLoop(time.Duration(every) * time.Minute)
+	}
+}
+
+// Record appends an entry; a nil log (AUDIT_ENABLE=false) drops it.
+func (a *auditLog) Record(source, actor, action, result string, detail any) {
+	if a == nil {
+		return
+	}
+	var raw json.RawMessage
+	if detail != nil {
+		// Kept as raw JSON so the hash doesn't depend on how detail
+		// re-encodes after a round trip through the file.
+		var err error
+		if raw, err = json.Marshal(detail); err != nil {
+			log.Printf("audit: marshal %s: %v", action, err)
+			return
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e := auditEntry{
+		Seq:      a.seq + 1,
+		Time:     time.Now().UTC(),
+		Source:   source,
+		Actor:    actor,
+		Action:   action,
+		Result:   result,
+		Detail:   raw,
+		PrevHash: a.head,
+	}
+	e.Hash = e.chainHash()
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("audit: marshal %s: %v", action, err)
+		return
+	}
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	a.seq, a.head = e.Seq, e.Hash
+}
+
+// read returns entries after sinceSeq, optionally of one source, at most
+// limit (0 means no limit).
+func (a *auditLog) read(sinceSeq uint64, source string, limit int) ([]auditEntry, error) {
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []auditEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s: %w", a.path, err)
+		}
+		if e.Seq <= sinceSeq || (source != "" && e.Source != source) {
+			continue
+		}
+		out = append(out, e)
+		if limit > 0 && len(out) >= limit {
+			break
+		}
+	}
+	return out, sc.Err()
+}
+
+// verifyAuditChain returns the seq of the first entry whose hash or link to
+// its predecessor doesn't check out, or 0 when the chain is intact. Entries
+// must be consecutive.
+func verifyAuditChain(entries []auditEntry) uint64 {
+	for i, e := range entries {
+		if e.Hash != e.chainHash() || (i > 0 && e.PrevHash != entries[i-1].Hash) {
+			return e.Seq
+		}
+	}
+	return 0
+}
+
+// Head returns the last seq, its hash and the last anchored seq.
+func (a *auditLog) Head() (seq uint64, hash string, anchored uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.seq, a.head, a.anchoredAt
+}
+
+// anchorLoop publishes the head hash whenever entries were added since the
+// last anchor. Anchors are audited too, so the next anchor covers them.
+func (a *auditLog) anchorLoop(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !neuronStreamingEnabled() {
+			continue
+		}
+		seq, head, anchored := a.Head()
+		if seq == anchored {
+			continue
+		}
+		msg := map[string]any{
+			"messageType": auditAnchorType,
+			"seller_id":   sellerCfg.SellerID,
+			"first_seq":   anchored + 1,
+			"last_seq":    seq,
+			"hash":        head,
+			"time":        time.Now().UTC(),
+		}
+		data, _ := json.Marshal(msg)
+		err := sendToTopic(commonlib.MyStdOut, data, "audit anchor")
+		if err != nil && !errors.Is(err, errHederaQueued) {
+			log.Printf("audit: anchor failed: %v", err)
+			a.Record("audit", "node", "anchor", "error", map[string]any{"last_seq": seq, "error": err.Error()})
+			continue
+		}
+		a.mu.Lock()
+		a.anchoredAt = seq
+		a.mu.Unlock()
+		result := "ok"
+		if err != nil {
+			result = "queued"
+		}
+		a.Record("audit", "node", "anchor", result, map[string]any{"last_seq": seq, "hash": head, "topic": commonlib.MyStdOut.String()})
+	}
+}
+
+// adminActor names the caller of an admin endpoint for the audit log.
+func adminActor(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if os.Getenv("ADMIN_TOKEN") != "" && r.Header.Get("Authorization") != "" {
+		return "token@" + host
+	}
+	return host
+}
+
+// auditStatusWriter captures the status an admin handler replied with.
+type auditStatusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditStatusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush and Unwrap keep /stream working behind withRequestID.
+func (w *auditStatusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *auditStatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// GET /admin/audit?since_seq=&source=&limit= returns entries oldest first
+// (default limit 500, 0 for all) with the chain head and whether the
+// returned run verifies; format=jsonl returns the raw lines instead.
+func adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if audit == nil {
+		writeJSONError(w, ErrDisabled.With("audit log disabled (AUDIT_ENABLE=false)"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSONError(w, ErrMethodNotAllowed.With("use GET"))
+		return
+	}
+	q := r.URL.Query()
+	since, err := strconv.ParseUint(q.Get("since_seq"), 10, 64)
+	if err != nil && q.Get("since_seq") != "" {
+		writeJSONError(w, ErrBadRequest.With("invalid since_seq"))
+		return
+	}
+	limit := 500
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			writeJSONError(w, ErrBadRequest.With("invalid limit"))
+			return
+		}
+	}
+	entries, err := audit.read(since, q.Get("source"), limit)
+	if err != nil {
+		writeJSONError(w, ErrInternal.Wrap(err))
+		return
+	}
+
+	if q.Get("format") == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for _, e := range entries {
+			enc.Encode(e)
+		}
+		return
+	}
+	seq, head, anchored := audit.Head()
+	resp := map[string]any{
+		"entries":      entries,
+		"head_seq":     seq,
+		"head_hash":    head,
+		"anchored_seq": anchored,
+		"chain_ok":     true,
+	}
+	// Filtering by source leaves gaps, so only unfiltered runs verify.
+	if q.Get("source") == "" {
+		if bad := verifyAuditChain(entries); bad != 0 {
+			resp["chain_ok"], resp["chain_break_seq"] = false, bad
+		}
+	} else {
+		delete(resp, "chain_ok")
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
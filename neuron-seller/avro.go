@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// Buyers feeding Kafka/Avro pipelines can ask for codec=avro in their
+// service type options (or set PAYLOAD_CODEC=avro for everyone). Their
+// stream is then a sequence of frames, each a 4-byte big-endian length
+// followed by either a JSON control frame (starts with '{': the schema
+// handshake and the license) or an Avro single-object encoded sample:
+// 0xC3 0x01, the 8-byte little-endian CRC-64-AVRO (Rabin) fingerprint of the
+// writer schema, then the binary record.
+//
+// The schema handshake is sent before the first sample so buyers can
+// register the schema in their registry under its fingerprint; it is also
+// served on GET /schema?format=avro.
+//
+// sig is the last field. When present it is the ed25519 signature over the
+// record bytes preceding it, i.e. the record minus its final 67 bytes
+// (union index, length and the 64 signature bytes).
+
+const (
+	codecJSON = "json"
+	codecAvro = "avro"
+)
+
+// buyerCodec is the codec option of a buyer's service request, or fallback.
+func buyerCodec(info *commonlib.NodeBufferInfo, fallback string) string {
+	if c := requestedServiceOptions(info).Get("codec"); c == codecJSON || c == codecAvro || c == codecCBOR {
+		return c
+	}
+	return fallback
+}
+
+// avroSchema is the writer schema in Parsing Canonical Form, which is what
+// the fingerprint is computed over.
+const avroSchema = `{"name":"io.localsense.Sample","type":"record","fields":[` +
+	`{"name":"schema_id","type":"string"},` +
+	`{"name":"seller_id","type":"string"},` +
+	`{"name":"kind","type":"string"},` +
+	`{"name":"unit","type":"string"},` +
+	`{"name":"seq","type":"long"},` +
+	`{"name":"ts","type":"long"},` +
+	`{"name":"value","type":"double"},` +
+	`{"name":"label","type":"string"},` +
+	`{"name":"lat","type":"double"},` +
+	`{"name":"lon","type":"double"},` +
+	`{"name":"power_mode","type":"string"},` +
+	`{"name":"license_sha256","type":["null","string"]},` +
+	`{"name":"ttl","type":["null","int"]},` +
+	`{"name":"expires_at","type":["null","long"]},` +
+	`{"name":"id","type":["null","string"]},` +
+	`{"name":"sig","type":["null","bytes"]}]}`
+
+const avroFingerprintEmpty uint64 = 0xc15d213aa4d7a795
+
+var avroFingerprintTable = func() (t [256]uint64) {
+	for i := range t {
+		fp := uint64(i)
+		for j := 0; j < 8; j++ {
+			fp = (fp >> 1) ^ (avroFingerprintEmpty & -(fp & 1))
+		}
+		t[i] = fp
+	}
+	return t
+}()
+
+// avroFingerprint is the CRC-64-AVRO Rabin fingerprint from the Avro spec.
+func avroFingerprint(data []byte) uint64 {
+	fp := avroFingerprintEmpty
+	for _, b := range data {
+		fp = (fp >> 8) ^ avroFingerprintTable[byte(fp)^b]
+	}
+	return fp
+}
+
+var avroSchemaFingerprint = avroFingerprint([]byte(avroSchema))
+
+// avroFingerprintHex renders the fingerprint as its little-endian bytes, the
+// same order it appears in every frame.
+func avroFingerprintHex() string {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], avroSchemaFingerprint)
+	return hex.EncodeToString(b[:])
+}
+
+func appendAvroLong(b []byte, n int64) []byte {
+	return binary.AppendUvarint(b, uint64((n<<1)^(n>>63)))
+}
+
+func appendAvroString(b []byte, s string) []byte {
+	return append(appendAvroLong(b, int64(len(s))), s...)
+}
+
+func appendAvroDouble(b []byte, f float64) []byte {
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(f))
+}
+
+// avroPayload encodes one sample as an Avro single-object.
+func avroPayload(kind sensorKind, id string, seq uint64, ts int64, value float64) []byte {
+	return avroPayloadAt(kind, id, seq, ts, value, currentLocation())
+}
+
+// avroPayloadAt is avroPayload with the location given, for privacy
+// tiers.
+func avroPayloadAt(kind sensorKind, id string, seq uint64, ts int64, value float64, loc siteLocation) []byte {
+	b := make([]byte, 0, 256)
+	b = append(b, 0xC3, 0x01)
+	b = binary.LittleEndian.AppendUint64(b, avroSchemaFingerprint)
+	body := len(b)
+
+	b = appendAvroString(b, payloadSchemaID())
+	b = appendAvroString(b, sellerCfg.SellerID)
+	b = appendAvroString(b, kind.Name)
+	b = appendAvroString(b, string(kind.Conversion.To))
+	b = appendAvroLong(b, int64(seq))
+	b = appendAvroLong(b, ts)
+	b = appendAvroDouble(b, value)
+	b = appendAvroString(b, loc.Label)
+	b = appendAvroDouble(b, loc.Lat)
+	b = appendAvroDouble(b, loc.Lon)
+	b = appendAvroString(b, string(power.Mode()))
+	if hash := licenseHash(); hash != "" {
+		b = appendAvroString(appendAvroLong(b, 1), hash)
+	} else {
+		b = appendAvroLong(b, 0)
+	}
+	if expiresAt := sampleExpiry(kind, ts); expiresAt > 0 {
+		b = appendAvroLong(appendAvroLong(b, 1), int64(kind.TTLSeconds))
+		b = appendAvroLong(appendAvroLong(b, 1), expiresAt)
+	} else {
+		b = appendAvroLong(b, 0)
+		b = appendAvroLong(b, 0)
+	}
+	if id != "" {
+		b = appendAvroString(appendAvroLong(b, 1), id)
+	} else {
+		b = appendAvroLong(b, 0)
+	}
+
+	if signer == nil {
+		return appendAvroLong(b, 0)
+	}
+	sig := ed25519.Sign(signer.key, b[body:])
+	b = appendAvroLong(b, 1)
+	b = appendAvroLong(b, int64(len(sig)))
+	return append(b, sig...)
+}
+
+// avroSchemaInfo is the schema registry handshake body.
+func avroSchemaInfo() map[string]any {
+	return map[string]any{
+		"type":        "schema",
+		"codec":       codecAvro,
+		"schema_id":   payloadSchemaID(),
+		"fingerprint": avroFingerprintHex(),
+		"schema":      json.RawMessage(avroSchema),
+	}
+}
+
+// lengthPrefixed frames data for the avro codec stream.
+func lengthPrefixed(data []byte) []byte {
+	out := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(out, uint32(len(data)))
+	return append(out, data...)
+}
+
+// avroHandshake returns the schema frame followed by the license frame, if
+// any, ready to precede a buyer's first avro sample.
+func avroHandshake() []byte {
+	schema, err := json.Marshal(avroSchemaInfo())
+	if err != nil {
+		log.Printf("avro: marshal schema handshake: %v", err)
+		return nil
+	}
+	out := lengthPrefixed(schema)
+	if license := licenseHandshake(); license != nil {
+		out = append(out, lengthPrefixed(license[:len(license)-1])...)
+	}
+	return out
+}
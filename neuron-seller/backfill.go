@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+// backfill {"from": unix, "to": unix, "max": n, "kind": ""} streams stored
+// samples to the buyer's open JSON streams, oldest first, for buyers that
+// missed data or want a history to start from. Unlike history, which
+// replays up to 1000 records in one frame for free, a backfill can cover
+// up to BACKFILL_MAX_SAMPLES records, goes out at BACKFILL_RATE_PER_SECOND
+// so live samples aren't held up, and every record sent is a delivery
+// billed at the backfill price (BACKFILL_PRICE_PER_SAMPLE_TINYBAR or
+// _USD_CENTS, default the list price) and marked backfill in the delivery
+// log, /revenue and invoices.
+//
+// The records of a job are framed by {"type":"backfill_start",...} and
+// {"type":"backfill_end",...} frames on each stream that gets some. A buyer
+// runs one backfill at a time; it is dropped when the buyer's streams close.
+
+type backfillFrame struct {
+	Type     string `json:"type"` // backfill_start or backfill_end
+	ID       string `json:"id"`
+	SellerID string `json:"seller_id"`
+	Kind     string `json:"kind"`
+	From     int64  `json:"from"`
+	To       int64  `json:"to"`
+	Count    int    `json:"count"` // records of the kind in the job (start) or sent (end)
+}
+
+type backfillJob struct {
+	ID      string
+	Key     string
+	From    int64
+	To      int64
+	Records []historyRecord
+	Next    int
+	Sent    map[string]int // by kind
+}
+
+type backfillQueue struct {
+	rate       int
+	maxSamples int
+
+	mu     sync.Mutex
+	jobs   []*backfillJob
+	nextID uint64
+}
+
+var backfills = &backfillQueue{rate: 20, maxSamples: 5000}
+
+func loadBackfill() {
+	backfills.rate = max(parseEnvInt("BACKFILL_RATE_PER_SECOND", 20), 1)
+	backfills.maxSamples = max(parseEnvInt("BACKFILL_MAX_SAMPLES", 5000), 1)
+}
+
+func backfillCommand(cmd commandEnvelope) (any, error) {
+	if history == nil {
+		return nil, ErrDisabled.With("history disabled on this node")
+	}
+	if memBudget.Level() != memoryOK {
+		return nil, ErrOverloaded.With("node is low on memory, retry later")
+	}
+	var p struct {
+		buyerParams
+		From int64  `json:"from"`
+		To   int64  `json:"to"`
+		Max  int    `json:"max"`
+		Kind string `json:"kind"`
+	}
+	if err := decodeParams(cmd, &p); err != nil {
+		return nil, err
+	}
+	if p.From == 0 {
+		return nil, commandErrorf(commandErrInvalidParams, "from is required")
+	}
+	if p.To == 0 {
+		p.To = time.Now().Unix()
+	}
+	if p.To <= p.From {
+		return nil, commandErrorf(commandErrInvalidParams, "to must be after from")
+	}
+	if p.Max <= 0 || p.Max > backfills.maxSamples {
+		p.Max = backfills.maxSamples
+	}
+	key, err := commandBuyer(cmd, p.Buyer)
+	if err != nil {
+		return nil, err
+	}
+	if len(connectedBuyerAccounts(key)) == 0 {
+		return nil, ErrPaymentRequired.With("buyer has no open paid stream to backfill into")
+	}
+
+	records, err := history.Query(time.Unix(p.From, 0), time.Unix(p.To, 0), p.Kind, p.Max)
+	if err != nil {
+		return nil, commandErrorf(commandErrFailed, "%v", err)
+	}
+	if len(records) == 0 {
+		return map[string]any{"queued": 0}, nil
+	}
+	job, err := backfills.add(key, p.From, p.To, records)
+	if err != nil {
+		return nil, commandErrorf(commandErrFailed, "%v", err)
+	}
+	q := backfillPrice(key, "", time.Now())
+	log.Printf("neuron-seller: backfill %s of %d records queued for buyer %.16s", job.ID, len(records), key)
+	return map[string]any{
+		"id":                       job.ID,
+		"queued":                   len(records),
+		"truncated":                len(records) == p.Max,
+		"rate_per_second":          backfills.rate,
+		"price_per_sample_tinybar": q.Tinybar,
+	}, nil
+}
+
+func (q *backfillQueue) add(key string, from, to int64, records []historyRecord) (*backfillJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.jobs {
+		if j.Key == key {
+			return nil, fmt.Errorf("backfill %s is still running", j.ID)
+		}
+	}
+	q.nextID++
+	job := &backfillJob{
+		ID:      fmt.Sprintf("bf-%d-%d", time.Now().Unix(), q.nextID),
+		Key:     key,
+		From:    from,
+		To:      to,
+		Records: records,
+		Sent:    map[string]int{},
+	}
+	q.jobs = append(q.jobs, job)
+	return job, nil
+}
+
+func (q *backfillQueue) active() []*backfillJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]*backfillJob(nil), q.jobs...)
+}
+
+func (q *backfillQueue) remove(job *backfillJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, j := range q.jobs {
+		if j == job {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// sendBackfills writes the next second's share of every backfill job.
+func (s *neuronSeller) sendBackfills(p2pHost host.Host, buffers *commonlib.NodeBuffers) {
+	for _, job := range backfills.active() {
+		end := min(job.Next+backfills.rate, len(job.Records))
+		streams := 0
+		for peerID, info := range buffers.GetBufferMap() {
+			if info.LibP2PState != types.Connected || !buyerPaid(info) {
+				continue
+			}
+			key, evm := buyerIdentity(info)
+			if key != job.Key || buyerCodec(info, s.cfg.Codec) != codecJSON {
+				continue
+			}
+			streams++
+			for i, kind := range s.cfg.Kinds {
+				total := job.count(kind.Name)
+				if total == 0 || !buyerWantsKind(info, kind, i == 0) {
+					continue
+				}
+				var frame []byte
+				var sent []historyRecord
+				if job.Next == 0 {
+					frame = job.marker("backfill_start", kind.Name, total)
+				}
+				for _, rec := range job.Records[job.Next:end] {
+					if rec.Kind == kind.Name {
+						frame = append(append(frame, rec.Payload...), '\n')
+						sent = append(sent, rec)
+					}
+				}
+				if end == len(job.Records) {
+					frame = append(frame, job.marker("backfill_end", kind.Name, job.Sent[kind.Name]+len(sent))...)
+				}
+				if frame == nil {
+					continue
+				}
+				if err := s.writeBuyerFrame(p2pHost, buffers, peerID, info, streamProtocol(info, kind), codecJSON, frame); err != nil {
+					log.Printf("neuron-seller: backfill %s to %s failed: %v", job.ID, peerID, err)
+					continue
+				}
+				job.Sent[kind.Name] += len(sent)
+				for _, rec := range sent {
+					recordBackfillDelivery(peerID.String(), key, evm, buyerSharedAccount(info), rec, len(rec.Payload)+1)
+				}
+			}
+		}
+		job.Next = end
+		switch {
+		case streams == 0:
+			log.Printf("neuron-seller: backfill %s dropped, buyer %.16s has no open stream", job.ID, job.Key)
+			backfills.remove(job)
+		case end == len(job.Records):
+			log.Printf("neuron-seller: backfill %s done, %d records", job.ID, len(job.Records))
+			backfills.remove(job)
+		}
+	}
+}
+
+func (j *backfillJob) count(kind string) int {
+	n := 0
+	for _, rec := range j.Records {
+		if rec.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+func (j *backfillJob) marker(typ, kind string, count int) []byte {
+	data, _ := json.Marshal(backfillFrame{
+		Type:     typ,
+		ID:       j.ID,
+		SellerID: sellerCfg.SellerID,
+		Kind:     kind,
+		From:     j.From,
+		To:       j.To,
+		Count:    count,
+	})
+	return append(data, '\n')
+}
+
+// recordBackfillDelivery logs and bills one backfilled record.
+func recordBackfillDelivery(peerID, key, evm, shared string, rec historyRecord, bytes int) {
+	d := deliveryRecord{
+		Ts:       time.Now().Unix(),
+		Peer:     peerID,
+		Buyer:    key,
+		Account:  evm,
+		Shared:   shared,
+		Kind:     rec.Kind,
+		Seq:      rec.Seq,
+		SampleID: rec.ID,
+		SampleTs: rec.Ts,
+		Codec:    codecJSON,
+		Bytes:    bytes,
+		Backfill: true,
+	}
+	q := backfillPrice(key, evm, time.Now())
+	d.Price = q.Tinybar
+	if q.Currency == currencyUSD {
+		d.Currency, d.Cents, d.CentsPerHbar = q.Currency, q.Cents, q.CentsPerHbar
+	}
+	deliveries.Record(d)
+	if d.Price > 0 {
+		payments.Charge(d)
+	}
+}
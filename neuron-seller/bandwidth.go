@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+type bandwidthSurface string
+
+const (
+	surfaceP2P  bandwidthSurface = "p2p"
+	surfaceHTTP bandwidthSurface = "http"
+)
+
+// capDecision is what a peer over its daily cap gets.
+type capDecision int
+
+const (
+	capAllow capDecision = iota
+	capThrottle
+	capSuspend
+)
+
+type bandwidthConfig struct {
+	DailyCapBytes  int64
+	Action         string // throttle or suspend
+	ThrottleFactor int
+	RetentionDays  int
+	StateFile      string
+}
+
+// peerDay is the traffic one peer caused on one UTC day.
+type peerDay struct {
+	P2P  int64 `json:"p2p_bytes"`
+	HTTP int64 `json:"http_bytes"`
+}
+
+func (d peerDay) total() int64 { return d.P2P + d.HTTP }
+
+// bandwidthMeter counts bytes sent per peer and per UTC day on the P2P and
+// HTTP surfaces. P2P peers are keyed by libp2p peer ID, HTTP clients by
+// "http:<ip>". Counters are saved to BANDWIDTH_STATE_FILE every minute so a
+// restart doesn't reset daily caps.
+type bandwidthMeter struct {
+	cfg bandwidthConfig
+
+	mu      sync.Mutex
+	days    map[string]map[string]*peerDay // day -> peer -> counters
+	totals  map[bandwidthSurface]int64     // since process start, for /metrics
+	skipped map[string]int                 // throttle counters per peer
+	suspend map[string]string              // peer -> day it was last suspended, for the audit log
+	dirty   bool
+}
+
+var bandwidth *bandwidthMeter
+
+// neuronBuffers is the SDK's buyer buffer map, set once the stream loop
+// starts, so HTTP handlers like /peers can report P2P peer state.
+var neuronBuffers *commonlib.NodeBuffers
+
+func loadBandwidthMeter() {
+	cfg := bandwidthConfig{
+		DailyCapBytes:  int64(parseEnvFloat("BANDWIDTH_PEER_DAILY_CAP_MB", 0) * 1024 * 1024),
+		Action:         strings.ToLower(getEnvOrDefault("BANDWIDTH_CAP_ACTION", "throttle")),
+		ThrottleFactor: parseEnvInt("BANDWIDTH_THROTTLE_FACTOR", 4),
+		RetentionDays:  parseEnvInt("BANDWIDTH_RETENTION_DAYS", 7),
+		StateFile:      getEnvOrDefault("BANDWIDTH_STATE_FILE", "data/bandwidth.json"),
+	}
+	if cfg.Action != "throttle" && cfg.Action != "suspend" {
+		log.Fatalf("bandwidth: unknown BANDWIDTH_CAP_ACTION %q (throttle, suspend)", cfg.Action)
+	}
+	if cfg.ThrottleFactor < 2 {
+		cfg.ThrottleFactor = 2
+	}
+	if cfg.RetentionDays < 1 {
+		cfg.RetentionDays = 1
+	}
+
+	bandwidth = &bandwidthMeter{
+		cfg:     cfg,
+		days:    make(map[string]map[string]*peerDay),
+		totals:  make(map[bandwidthSurface]int64),
+		skipped: make(map[string]int),
+		suspend: make(map[string]string),
+	}
+	if err := bandwidth.load(); err != nil {
+		log.Printf("bandwidth: ignoring state file: %v", err)
+	}
+	go bandwidth.persistLoop()
+
+	if cfg.DailyCapBytes > 0 {
+		log.Printf("Bandwidth : per-peer cap %.1f MB/day, then %s", float64(cfg.DailyCapBytes)/(1024*1024), cfg.Action)
+	}
+}
+
+func today() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// Record adds n bytes sent to peer on surface.
+func (b *bandwidthMeter) Record(surface bandwidthSurface, peer string, n int) {
+	if n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	day := today()
+	peers, ok := b.days[day]
+	if !ok {
+		peers = make(map[string]*peerDay)
+		b.days[day] = peers
+		b.pruneLocked()
+		b.skipped = make(map[string]int)
+	}
+	d, ok := peers[peer]
+	if !ok {
+		d = &peerDay{}
+		peers[peer] = d
+	}
+	switch surface {
+	case surfaceP2P:
+		d.P2P += int64(n)
+	case surfaceHTTP:
+		d.HTTP += int64(n)
+	}
+	b.totals[surface] += int64(n)
+	b.dirty = true
+}
+
+// Admit decides whether peer gets the next sample. Once over the daily cap a
+// throttled peer only gets every ThrottleFactor-th sample and a suspended
+// peer gets nothing until the UTC day rolls over.
+func (b *bandwidthMeter) Admit(peer string) capDecision {
+	if b.cfg.DailyCapBytes <= 0 {
+		return capAllow
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d := b.days[today()][peer]
+	if d == nil || d.total() < b.cfg.DailyCapBytes {
+		return capAllow
+	}
+	if b.cfg.Action == "suspend" {
+		if day := today(); b.suspend[peer] != day {
+			b.suspend[peer] = day
+			audit.Record("bandwidth", "node", "suspend_peer", "ok", map[string]any{"peer": peer, "day": day, "bytes": d.total(), "cap_bytes": b.cfg.DailyCapBytes})
+		}
+		return capSuspend
+	}
+	b.skipped[peer]++
+	if b.skipped[peer]%b.cfg.ThrottleFactor == 0 {
+		return capAllow
+	}
+	return capThrottle
+}
+
+func (b *bandwidthMeter) pruneLocked() {
+	cutoff := time.Now().UTC().AddDate(0, 0, -b.cfg.RetentionDays).Format("2006-01-02")
+	for day := range b.days {
+		if day <= cutoff {
+			delete(b.days, day)
+		}
+	}
+}
+
+type peerUsage struct {
+	Peer      string             `json:"peer"`
+	Today     peerDay            `json:"today"`
+	Days      map[string]peerDay `json:"days"`
+	OverCap   bool               `json:"over_cap"`
+	CapAction string             `json:"cap_action,omitempty"`
+}
+
+// Usage returns per-peer counters for the retained days, heaviest first.
+func (b *bandwidthMeter) Usage() []peerUsage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	day := today()
+	byPeer := make(map[string]*peerUsage)
+	for d, peers := range b.days {
+		for peer, c := range peers {
+			u, ok := byPeer[peer]
+			if !ok {
+				u = &peerUsage{Peer: peer, Days: make(map[string]peerDay)}
+				byPeer[peer] = u
+			}
+			u.Days[d] = *c
+			if d == day {
+				u.Today = *c
+			}
+		}
+	}
+
+	out := make([]peerUsage, 0, len(byPeer))
+	for _, u := range byPeer {
+		if b.cfg.DailyCapBytes > 0 && u.Today.total() >= b.cfg.DailyCapBytes {
+			u.OverCap = true
+			u.CapAction = b.cfg.Action
+		}
+		out = append(out, *u)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Today.total() != out[j].Today.total() {
+			return out[i].Today.total() > out[j].Today.total()
+		}
+		return out[i].Peer < out[j].Peer
+	})
+	return out
+}
+
+func (b *bandwidthMeter) load() error {
+	data, err := os.ReadFile(b.cfg.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var days map[string]map[string]*peerDay
+	if err := json.Unmarshal(data, &days); err != nil {
+		return fmt.Errorf("decode %s: %w", b.cfg.StateFile, err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if days != nil {
+		b.days = days
+	}
+	b.pruneLocked()
+	return nil
+}
+
+func (b *bandwidthMeter) persistLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := b.save(); err != nil {
+			log.Printf("bandwidth: save state: %v", err)
+		}
+	}
+}
+
+func (b *bandwidthMeter) save() error {
+	b.mu.Lock()
+	if !b.dirty {
+		b.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(b.days)
+	b.dirty = false
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(b.cfg.StateFile), 0o755); err != nil {
+		return err
+	}
+	tmp := b.cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.cfg.StateFile)
+}
+
+// httpPeer is the bandwidth key of an HTTP client.
+func httpPeer(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "http:" + host
+}
+
+// countingResponseWriter attributes response bytes to the HTTP client. It
+// keeps Flush working for /stream, and write deadlines through Unwrap.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	peer string
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	bandwidth.Record(surfaceHTTP, w.peer, n)
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func withBandwidthAccounting(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&countingResponseWriter{ResponseWriter: w, peer: httpPeer(r)}, r)
+	})
+}
+
+type p2pPeer struct {
+	Peer         string      `json:"peer"`
+	State        string      `json:"state"`
+	ValidAccount bool        `json:"valid_account"` // the SDK's shared account check
+	Paid         bool        `json:"paid"`          // per the payment backend
+	ServiceType  string      `json:"service_type,omitempty"`
+	Link         *linkStats  `json:"link,omitempty"`
+	Trial        *trialUsage `json:"trial,omitempty"`
+}
+
+// p2pPeers lists the buyers the SDK currently has buffers for.
+func p2pPeers() []p2pPeer {
+	var out []p2pPeer
+	if neuronBuffers == nil {
+		return out
+	}
+	for peerID, info := range neuronBuffers.GetBufferMap() {
+		p := p2pPeer{
+			Peer:         peerID.String(),
+			State:        fmt.Sprint(info.LibP2PState),
+			ValidAccount: info.IsOtherSideValidAccount,
+			Paid:         buyerPaid(info),
+			ServiceType:  requestedServiceType(info),
+		}
+		if st, ok := links.Stats(p.Peer); ok {
+			p.Link = &st
+		}
+		if !buyerPaid(info) {
+			if u, ok := trials.Usage(trialAccount(info)); ok {
+				p.Trial = &u
+			}
+		}
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Peer < out[j].Peer })
+	return out
+}
+
+// GET /peers – P2P buyers known to the SDK plus every peer with traffic in
+// the retention window.
+func peersHandler(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]any{
+		"p2p_buyers": p2pPeers(),
+		"bandwidth":  bandwidth.Usage(),
+	}
+	if bandwidth.cfg.DailyCapBytes > 0 {
+		resp["daily_cap_bytes"] = bandwidth.cfg.DailyCapBytes
+		resp["cap_action"] = bandwidth.cfg.Action
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// GET /metrics – Prometheus text exposition of the bandwidth and mirror
+// cache counters.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	usage := bandwidth.Usage()
+
+	bandwidth.mu.Lock()
+	totals := map[bandwidthSurface]int64{surfaceP2P: bandwidth.totals[surfaceP2P], surfaceHTTP: bandwidth.totals[surfaceHTTP]}
+	bandwidth.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintln(w, "# HELP localsense_bytes_sent_total Bytes sent since start, by surface.")
+	fmt.Fprintln(w, "# TYPE localsense_bytes_sent_total counter")
+	for _, s := range []bandwidthSurface{surfaceP2P, surfaceHTTP} {
+		fmt.Fprintf(w, "localsense_bytes_sent_total{surface=%q} %d\n", s, totals[s])
+	}
+	fmt.Fprintln(w, "# HELP localsense_peer_bytes_today Bytes sent to a peer since UTC midnight, by surface.")
+	fmt.Fprintln(w, "# TYPE localsense_peer_bytes_today gauge")
+	for _, u := range usage {
+		fmt.Fprintf(w, "localsense_peer_bytes_today{peer=%q,surface=%q} %d\n", u.Peer, surfaceP2P, u.Today.P2P)
+		fmt.Fprintf(w, "localsense_peer_bytes_today{peer=%q,surface=%q} %d\n", u.Peer, surfaceHTTP, u.Today.HTTP)
+	}
+	fmt.Fprintln(w, "# HELP localsense_peer_over_cap Whether a peer exceeded its daily bandwidth cap.")
+	fmt.Fprintln(w, "# TYPE localsense_peer_over_cap gauge")
+	for _, u := range usage {
+		over := 0
+		if u.OverCap {
+			over = 1
+		}
+		fmt.Fprintf(w, "localsense_peer_over_cap{peer=%q} %d\n", u.Peer, over)
+	}
+
+	if mirror != nil {
+		stats, entries := mirror.Stats()
+		fmt.Fprintln(w, "# HELP localsense_mirror_cache_requests_total Mirror node requests through the cache, by result.")
+		fmt.Fprintln(w, "# TYPE localsense_mirror_cache_requests_total counter")
+		for _, result := range []string{"hit", "miss", "coalesced", "error"} {
+			fmt.Fprintf(w, "localsense_mirror_cache_requests_total{result=%q} %d\n", result, stats[result])
+		}
+		fmt.Fprintln(w, "# HELP localsense_mirror_cache_entries Cached mirror node responses.")
+		fmt.Fprintln(w, "# TYPE localsense_mirror_cache_entries gauge")
+		fmt.Fprintf(w, "localsense_mirror_cache_entries %d\n", entries)
+	}
+	writePiPollMetrics(w)
+	writeWebhookMetrics(w)
+	writeConnLimitMetrics(w)
+	writeTopicLagMetrics(w)
+	writeProbeMetrics(w)
+	writeMemoryMetrics(w)
+	writeWriteErrorMetrics(w)
+	writeHederaQueueMetrics(w)
+	writeHealthMetrics(w)
+	writeStreamMetrics(w)
+	writeSamplerMetrics(w)
+	writeBusMetrics(w)
+	writePipelineMetrics(w)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Benchmarks for the per-tick broadcast path: building one sample payload,
+// encoding it for each codec, and fanning it out to N simulated buyers
+// whose streams discard what they are sent. `make bench` runs them and
+// checks the results against bench_thresholds.json.
+
+// The Neuron SDK's init() reads --port and --use-local-address from the
+// command line and exits without them (see the Makefile's test targets);
+// declare them here too so the test binary's own flag parsing accepts them.
+var (
+	_ = flag.String("port", "", "Neuron SDK listen port, read by the SDK's init()")
+	_ = flag.Bool("use-local-address", false, "skip the Neuron SDK's NAT probe, read by its init()")
+)
+
+func TestMain(m *testing.M) {
+	// The stream loop logs every write; keep benchmark output readable.
+	log.SetOutput(io.Discard)
+	dir, err := os.MkdirTemp("", "localsense-bench")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("BANDWIDTH_STATE_FILE", dir+"/bandwidth.json")
+	loadBandwidthMeter()
+	sellerCfg = SellerConfig{SellerID: "bench-seller", Label: "bench", Lat: 51.5, Lon: -0.12}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func benchSeller(b *testing.B, codec string) *neuronSeller {
+	b.Helper()
+	cfg, err := loadNeuronSellerConfig()
+	if err != nil {
+		b.Fatal(err)
+	}
+	cfg.Codec = codec
+	return &neuronSeller{
+		cfg:        cfg,
+		greeted:    make(map[string]string),
+		lastSent:   make(map[string]time.Time),
+		linkNotice: make(map[string]bool),
+		staleSince: make(map[peer.ID]time.Time),
+	}
+}
+
+func benchMetrics(kind sensorKind) *piMetrics {
+	return &piMetrics{
+		Ts:     float64(time.Now().Unix()),
+		Values: map[string]float64{kind.Field: 412.5},
+	}
+}
+
+func withSigner(b *testing.B, on bool) {
+	b.Helper()
+	prev := signer
+	signer = nil
+	if on {
+		_, key, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		signer = &sampleSigner{key: key}
+	}
+	b.Cleanup(func() { signer = prev })
+}
+
+func BenchmarkBuildSamplePayload(b *testing.B) {
+	for _, signed := range []bool{false, true} {
+		name := "unsigned"
+		if signed {
+			name = "signed"
+		}
+		b.Run(name, func(b *testing.B) {
+			withSigner(b, signed)
+			s := benchSeller(b, codecJSON)
+			kind := s.cfg.Kinds[0]
+			metrics := benchMetrics(kind)
+			now := time.Now()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := s.buildSamplePayload(now, kind, newSampleID(now), uint64(i), 412.5, metrics); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	s := benchSeller(b, codecJSON)
+	kind := s.cfg.Kinds[0]
+	b.Run("json", func(b *testing.B) {
+		p := samplePayload{
+			Ts: time.Now().Unix(), TsISO: time.Now().UTC(), Field: kind.Field, Value: 412.5,
+			SchemaID: payloadSchemaID(), SellerID: sellerCfg.SellerID, Label: sellerCfg.Label,
+			Lat: sellerCfg.Lat, Lon: sellerCfg.Lon, Kind: kind.Name, Unit: kind.Conversion.To,
+			PowerMode: powerNormal, Network: "testnet", TTL: 60, ExpiresAt: time.Now().Unix() + 60,
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p.Seq = uint64(i)
+			if _, err := encodePayload(&p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("avro", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			lengthPrefixed(avroPayload(kind, newSampleID(time.Now()), uint64(i), time.Now().Unix(), 412.5))
+		}
+	})
+}
+
+// discardWrites swaps the SDK stream write for one that drops the frame.
+func discardWrites(b *testing.B) {
+	b.Helper()
+	prev := writeBuyerStream
+	writeBuyerStream = func(commonlib.NodeBufferInfo, peer.ID, *commonlib.NodeBuffers, []byte, host.Host, protocol.ID) error {
+		return nil
+	}
+	b.Cleanup(func() { writeBuyerStream = prev })
+}
+
+func benchBuffers(n int, kind sensorKind) *commonlib.NodeBuffers {
+	buffers := commonlib.NewNodeBuffers()
+	for i := 0; i < n; i++ {
+		buffers.Buffers[peer.ID(fmt.Sprintf("bench-peer-%04d", i))] = &commonlib.NodeBufferInfo{
+			LibP2PState:             types.Connected,
+			IsOtherSideValidAccount: true,
+			RequestOrResponse: types.TopicPostalEnvelope{
+				Message: map[string]any{"k": fmt.Sprintf("%064x", i), "t": string(kind.Protocol)},
+			},
+		}
+	}
+	return buffers
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	for _, codec := range []string{codecJSON, codecAvro} {
+		for _, peers := range []int{1, 10, 100} {
+			b.Run(fmt.Sprintf("%s/peers=%d", codec, peers), func(b *testing.B) {
+				discardWrites(b)
+				withSigner(b, false)
+				s := benchSeller(b, codec)
+				kind := s.cfg.Kinds[0]
+				buffers := benchBuffers(peers, kind)
+				metrics := benchMetrics(kind)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					now := time.Now()
+					id := newSampleID(now)
+					payload, ts, err := s.buildSamplePayload(now, kind, id, uint64(i), 412.5, metrics)
+					if err != nil {
+						b.Fatal(err)
+					}
+					s.broadcastSample(nil, buffers, kind, true, payload, id, uint64(i), ts, 412.5)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Consumers of the data subscribe to a bus instead of each running a loop
+// of its own. Two buses exist: readings, the sampling engine's Pi readings
+// (the Neuron stream loop subscribes), and sampleBus, each finished sample
+// as it goes out (relay uplinks, the LoRaWAN sink, the rule engine and
+// every /stream client subscribe). Publish never waits: every
+// subscriber has a bounded queue, and one whose queue is full misses the
+// message, counted against it on /metrics by bus and subscriber name.
+
+// busSub is one subscription to a bus.
+type busSub[T any] struct {
+	name      string
+	ch        chan T
+	delivered atomic.Int64
+	dropped   atomic.Int64
+}
+
+// C delivers the subscription's messages; nil for a nil subscription.
+func (sub *busSub[T]) C() <-chan T {
+	if sub == nil {
+		return nil
+	}
+	return sub.ch
+}
+
+// fanout is a bus of messages of type T.
+type fanout[T any] struct {
+	name string
+
+	mu   sync.Mutex
+	subs map[*busSub[T]]struct{}
+	seq  int64 // for subscriber names that would otherwise collide
+}
+
+// busStats is one subscriber's counters, for /metrics.
+type busStats struct {
+	Bus, Subscriber    string
+	Queued             int
+	Delivered, Dropped int64
+}
+
+var (
+	busesMu sync.Mutex
+	buses   []func() []busStats
+)
+
+func newFanout[T any](name string) *fanout[T] {
+	b := &fanout[T]{name: name, subs: make(map[*busSub[T]]struct{})}
+	busesMu.Lock()
+	buses = append(buses, b.stats)
+	busesMu.Unlock()
+	return b
+}
+
+// Subscribe adds a subscriber with a queue of the given length. Names
+// ending in '#' get a number appended, for subscribers that come and go.
+func (b *fanout[T]) Subscribe(name string, queue int) *busSub[T] {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(name) > 0 && name[len(name)-1] == '#' {
+		b.seq++
+		name = fmt.Sprintf("%s%d", name, b.seq)
+	}
+	sub := &busSub[T]{name: name, ch: make(chan T, max(queue, 1))}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// Unsubscribe stops deliveries to sub; its channel is left open.
+func (b *fanout[T]) Unsubscribe(sub *busSub[T]) {
+	if sub == nil {
+		return
+	}
+	b.mu.Lock()
+	delete(b.subs, sub)
+	b.mu.Unlock()
+}
+
+// Publish hands v to every subscriber without waiting on any.
+func (b *fanout[T]) Publish(v T) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		select {
+		case sub.ch <- v:
+			sub.delivered.Add(1)
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// each calls fn for every subscriber under the bus lock.
+func (b *fanout[T]) each(fn func(sub *busSub[T])) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		fn(sub)
+	}
+}
+
+func (b *fanout[T]) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+func (b *fanout[T]) stats() []busStats {
+	var out []busStats
+	b.each(func(sub *busSub[T]) {
+		out = append(out, busStats{
+			Bus:        b.name,
+			Subscriber: sub.name,
+			Queued:     len(sub.ch),
+			Delivered:  sub.delivered.Load(),
+			Dropped:    sub.dropped.Load(),
+		})
+	})
+	return out
+}
+
+// busSample is a finished sample on sampleBus. Payload is shared and must
+// not be modified.
+type busSample struct {
+	Kind      string
+	KindIndex int
+	ID        string
+	Seq       uint64
+	Ts        int64
+	Value     float64
+	Payload   []byte
+	At        time.Time
+}
+
+var sampleBus = newFanout[busSample]("samples")
+
+func writeBusMetrics(w http.ResponseWriter) {
+	busesMu.Lock()
+	var all []busStats
+	for _, stats := range buses {
+		all = append(all, stats()...)
+	}
+	busesMu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Bus != all[j].Bus {
+			return all[i].Bus < all[j].Bus
+		}
+		return all[i].Subscriber < all[j].Subscriber
+	})
+	fmt.Fprintln(w, "# HELP localsense_bus_delivered_total Messages queued for a bus subscriber.")
+	fmt.Fprintln(w, "# TYPE localsense_bus_delivered_total counter")
+	for _, st := range all {
+		fmt.Fprintf(w, "localsense_bus_delivered_total{bus=%q,subscriber=%q} %d\n", st.Bus, st.Subscriber, st.Delivered)
+	}
+	fmt.Fprintln(w, "# HELP localsense_bus_dropped_total Messages a bus subscriber missed because its queue was full.")
+	fmt.Fprintln(w, "# TYPE localsense_bus_dropped_total counter")
+	for _, st := range all {
+		fmt.Fprintf(w, "localsense_bus_dropped_total{bus=%q,subscriber=%q} %d\n", st.Bus, st.Subscriber, st.Dropped)
+	}
+	fmt.Fprintln(w, "# HELP localsense_bus_queued Messages waiting in a bus subscriber's queue.")
+	fmt.Fprintln(w, "# TYPE localsense_bus_queued gauge")
+	for _, st := range all {
+		fmt.Fprintf(w, "localsense_bus_queued{bus=%q,subscriber=%q} %d\n", st.Bus, st.Subscriber, st.Queued)
+	}
+}
@@ -0,0 +1,337 @@
+// Package buyerclient decodes the newline-delimited JSON stream a localsense
+// seller writes to its buyers and, when given a Store, persists every sample
+// keyed by seller, kind and sequence number so integrators can detect and
+// report gaps after reconnects.
+package buyerclient
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Sample is one reading from a seller stream. Raw keeps the payload exactly
+// as received so nothing the seller adds later is lost.
+type Sample struct {
+	SellerID    string          `json:"seller_id"`
+	Kind        string          `json:"kind"`
+	Seq         uint64          `json:"seq"`
+	ID          string          `json:"id,omitempty"` // ULID, unique across sellers
+	Ts          int64           `json:"ts"`
+	Value       float64         `json:"value"`
+	Unit        string          `json:"unit,omitempty"`
+	LicenseHash string          `json:"license_sha256,omitempty"`
+	SchemaID    string          `json:"schema_id,omitempty"`
+	TTL         int             `json:"ttl,omitempty"`
+	ExpiresAt   int64           `json:"expires_at,omitempty"`
+	Raw         json.RawMessage `json:"-"`
+	// Derivation is set on values the seller computed (unit conversions,
+	// rollups) and names the source samples and the transform applied.
+	Derivation *Derivation `json:"provenance,omitempty"`
+	// Uncertainty is the seller's estimate of the reading's standard
+	// uncertainty, when it sends one.
+	Uncertainty *Uncertainty `json:"uncertainty,omitempty"`
+	// Provenance lists the hops a re-exposed sample went through; empty
+	// when it came straight from the seller.
+	Provenance []Hop `json:"-"`
+}
+
+// Derivation is the provenance block of a derived value.
+type Derivation struct {
+	Transform string             `json:"transform"`
+	Params    map[string]any     `json:"params,omitempty"`
+	Sources   []DerivationSource `json:"sources"`
+}
+
+// Uncertainty breaks a sample's standard uncertainty (Sigma, in the
+// sample's unit) into the sensor spec, calibration drift and the noise over
+// the seller's recent readings.
+type Uncertainty struct {
+	Sigma              float64 `json:"sigma"`
+	Spec               float64 `json:"spec,omitempty"`
+	Drift              float64 `json:"drift,omitempty"`
+	CalibrationAgeDays int     `json:"calibration_age_days,omitempty"`
+	Noise              float64 `json:"noise,omitempty"`
+}
+
+// DerivationSource references source samples by kind and inclusive sequence
+// range. Value is the source reading when there is exactly one.
+type DerivationSource struct {
+	SellerID string   `json:"seller_id"`
+	Kind     string   `json:"kind"`
+	Field    string   `json:"field,omitempty"`
+	Unit     string   `json:"unit,omitempty"`
+	FirstSeq uint64   `json:"first_seq,omitempty"`
+	LastSeq  uint64   `json:"last_seq,omitempty"`
+	Count    int      `json:"count,omitempty"`
+	Value    *float64 `json:"value,omitempty"`
+}
+
+// License is the handshake frame a seller sends before the first sample.
+type License struct {
+	SellerID string          `json:"seller_id"`
+	ID       string          `json:"license_id"`
+	Hash     string          `json:"license_sha256"`
+	Terms    json.RawMessage `json:"terms"`
+}
+
+// Heartbeat is sent on streams that have been idle for Interval seconds.
+// LastSeq is the newest sample the seller produced for Kind, so a buyer can
+// tell a quiet stream from one that lost samples.
+type Heartbeat struct {
+	SellerID string `json:"seller_id"`
+	Kind     string `json:"kind"`
+	Ts       int64  `json:"ts"`
+	LastSeq  uint64 `json:"last_seq"`
+	State    string `json:"state"`
+	Interval int    `json:"interval"`
+}
+
+// LinkQuality tells a buyer the seller changed how often it sends on this
+// stream because of the measured link quality: Interval is the new sample
+// interval in seconds, Factor the multiple of the normal one.
+type LinkQuality struct {
+	SellerID    string  `json:"seller_id"`
+	Ts          int64   `json:"ts"`
+	Interval    int     `json:"interval"`
+	Factor      int     `json:"factor"`
+	Score       float64 `json:"score"`
+	LatencyMs   float64 `json:"latency_ms"`
+	FailureRate float64 `json:"failure_rate"`
+}
+
+// Gap is an inclusive range of sequence numbers never received.
+type Gap struct {
+	SellerID string `json:"seller_id"`
+	Kind     string `json:"kind"`
+	From     uint64 `json:"from_seq"`
+	To       uint64 `json:"to_seq"`
+}
+
+// Missing is the number of samples in the gap.
+func (g Gap) Missing() uint64 {
+	return g.To - g.From + 1
+}
+
+// Store persists samples. Save reports false for a sample already stored.
+type Store interface {
+	Save(Sample) (bool, error)
+	Gaps(sellerID, kind string) ([]Gap, error)
+	Close() error
+}
+
+var (
+	// ErrNoSeq is returned for samples from sellers too old to number them.
+	ErrNoSeq = errors.New("sample has no seq")
+	// ErrExpired is returned for samples that arrived past expires_at or
+	// the client's MaxAge.
+	ErrExpired = errors.New("sample expired")
+	// ErrHeartbeat is returned by ParseLine for heartbeat frames; decode
+	// them into a Heartbeat instead.
+	ErrHeartbeat = errors.New("heartbeat frame")
+	// ErrLinkQuality is returned by ParseLine for link_quality frames;
+	// decode them into a LinkQuality instead.
+	ErrLinkQuality = errors.New("link quality frame")
+)
+
+// Expired reports whether the sample is stale at now: past its expires_at,
+// or older than maxAge when maxAge is set. Both bounds are inclusive of the
+// expiry instant, so every buyer with the same clock decides the same way.
+func (s Sample) Expired(now time.Time, maxAge time.Duration) bool {
+	if s.ExpiresAt > 0 && now.Unix() >= s.ExpiresAt {
+		return true
+	}
+	return maxAge > 0 && now.Sub(time.Unix(s.Ts, 0)) > maxAge
+}
+
+// ParseLine decodes one stream line into either a sample or a license frame.
+// Provenance frames are verified and unwrapped into their original sample.
+func ParseLine(line []byte) (*Sample, *License, error) {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(line, &head); err != nil {
+		return nil, nil, fmt.Errorf("decode line: %w", err)
+	}
+	switch head.Type {
+	case "license":
+		var lic License
+		if err := json.Unmarshal(line, &lic); err != nil {
+			return nil, nil, fmt.Errorf("decode license frame: %w", err)
+		}
+		return nil, &lic, nil
+	case "heartbeat":
+		return nil, nil, ErrHeartbeat
+	case "link_quality":
+		return nil, nil, ErrLinkQuality
+	case "provenance":
+		var env Envelope
+		if err := json.Unmarshal(line, &env); err != nil {
+			return nil, nil, fmt.Errorf("decode provenance frame: %w", err)
+		}
+		if err := env.VerifyChain(); err != nil {
+			return nil, nil, err
+		}
+		s, _, err := ParseLine(env.Origin)
+		if err != nil {
+			return nil, nil, fmt.Errorf("provenance origin: %w", err)
+		}
+		if s == nil {
+			return nil, nil, fmt.Errorf("provenance origin is not a sample")
+		}
+		if s.SellerID != env.SellerID {
+			return nil, nil, fmt.Errorf("%w: envelope names %s, origin %s", ErrBrokenChain, env.SellerID, s.SellerID)
+		}
+		s.Provenance = env.Chain
+		return s, nil, nil
+	}
+
+	var s Sample
+	if err := json.Unmarshal(line, &s); err != nil {
+		return nil, nil, fmt.Errorf("decode sample: %w", err)
+	}
+	if s.SellerID == "" || s.Kind == "" {
+		return nil, nil, fmt.Errorf("sample is missing seller_id or kind")
+	}
+	s.Raw = append(json.RawMessage(nil), line...)
+	return &s, nil, nil
+}
+
+// Client consumes seller streams. All fields are optional.
+type Client struct {
+	Store     Store
+	OnSample  func(Sample)
+	OnLicense func(License)
+	// OnHeartbeat sees the keep-alive frames of idle streams.
+	OnHeartbeat func(Heartbeat)
+	// OnLinkQuality sees the seller slowing down or speeding up this
+	// stream to suit the connection.
+	OnLinkQuality func(LinkQuality)
+	// Source is the seller ID the stream is bought from. Samples naming
+	// another seller are only accepted inside a verified provenance chain.
+	Source string
+	// SellerKey returns a seller's registered signing key (signing_pubkey
+	// in its HCS registration). Samples from known sellers must verify.
+	SellerKey func(sellerID string) (ed25519.PublicKey, bool)
+	// MaxAge drops samples older than this on arrival, on top of the
+	// seller's expires_at. Late samples are reported to OnError as
+	// ErrExpired and never stored.
+	MaxAge time.Duration
+	// Now overrides the clock used for expiry checks, e.g. for replay.
+	Now func() time.Time
+	// Dedup drops samples already seen, e.g. through another relay or a
+	// direct stream; share one between the Clients of those streams.
+	Dedup *Deduper
+	// OnError sees undecodable lines and store failures; the stream keeps
+	// going either way.
+	OnError func(error)
+}
+
+// Consume reads r until EOF or a read error.
+func (c *Client) Consume(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		sample, lic, err := ParseLine(line)
+		if errors.Is(err, ErrHeartbeat) {
+			c.heartbeat(line)
+			continue
+		}
+		if errors.Is(err, ErrLinkQuality) {
+			c.linkQuality(line)
+			continue
+		}
+		if err != nil {
+			c.fail(err)
+			continue
+		}
+		if lic != nil {
+			if c.OnLicense != nil {
+				c.OnLicense(*lic)
+			}
+			continue
+		}
+		c.handle(*sample)
+	}
+	return sc.Err()
+}
+
+func (c *Client) heartbeat(line []byte) {
+	var hb Heartbeat
+	if err := json.Unmarshal(line, &hb); err != nil {
+		c.fail(fmt.Errorf("decode heartbeat: %w", err))
+		return
+	}
+	if c.OnHeartbeat != nil {
+		c.OnHeartbeat(hb)
+	}
+}
+
+func (c *Client) linkQuality(line []byte) {
+	var lq LinkQuality
+	if err := json.Unmarshal(line, &lq); err != nil {
+		c.fail(fmt.Errorf("decode link quality: %w", err))
+		return
+	}
+	if c.OnLinkQuality != nil {
+		c.OnLinkQuality(lq)
+	}
+}
+
+func (c *Client) handle(s Sample) {
+	now := time.Now()
+	if c.Now != nil {
+		now = c.Now()
+	}
+	if s.Expired(now, c.MaxAge) {
+		c.fail(fmt.Errorf("%s/%s#%d: %w", s.SellerID, s.Kind, s.Seq, ErrExpired))
+		return
+	}
+	if err := c.checkOrigin(s); err != nil {
+		c.fail(fmt.Errorf("%s/%s#%d: %w", s.SellerID, s.Kind, s.Seq, err))
+		return
+	}
+	if c.Dedup != nil && c.Dedup.Duplicate(s) {
+		return
+	}
+	if c.Store != nil {
+		if s.Seq == 0 {
+			c.fail(fmt.Errorf("%s/%s: %w", s.SellerID, s.Kind, ErrNoSeq))
+		} else if fresh, err := c.Store.Save(s); err != nil {
+			c.fail(fmt.Errorf("store %s/%s#%d: %w", s.SellerID, s.Kind, s.Seq, err))
+		} else if !fresh {
+			return
+		}
+	}
+	if c.OnSample != nil {
+		c.OnSample(s)
+	}
+}
+
+// checkOrigin is the re-sale guard: a sample must either come from the
+// seller we bought from or carry a provenance chain back to its seller.
+func (c *Client) checkOrigin(s Sample) error {
+	if c.Source != "" && s.SellerID != c.Source && len(s.Provenance) == 0 {
+		return ErrUnattributed
+	}
+	if c.SellerKey != nil {
+		if pub, ok := c.SellerKey(s.SellerID); ok {
+			return VerifySeller(s.Raw, pub)
+		}
+	}
+	return nil
+}
+
+func (c *Client) fail(err error) {
+	if c.OnError != nil {
+		c.OnError(err)
+	}
+}
@@ -0,0 +1,108 @@
+package buyerclient
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// A buyer subscribed both directly and through a relay gets most samples
+// twice. A Deduper shared by the Clients of those streams lets the first
+// copy through and drops the rest. Samples are keyed by their ID (the
+// seller's ULID) or, from sellers that don't send one, by seller, kind and
+// seq; samples with neither pass through. Only the most recent Size keys
+// are remembered, so a copy arriving after that many newer samples gets
+// through again (a Store still catches it).
+
+// DefaultDedupSize is the number of keys a Deduper remembers by default.
+const DefaultDedupSize = 4096
+
+// DedupStats counts what a Deduper has seen.
+type DedupStats struct {
+	Unique     uint64 `json:"unique"`
+	Duplicates uint64 `json:"duplicates"`
+	Unkeyed    uint64 `json:"unkeyed"` // no ID and no seq, passed through
+	Evicted    uint64 `json:"evicted"`
+	Size       int    `json:"size"`
+	Capacity   int    `json:"capacity"`
+}
+
+// Deduper is a bounded LRU of sample keys, safe for concurrent use.
+type Deduper struct {
+	mu    sync.Mutex
+	cap   int
+	order *list.List // front is most recent
+	keys  map[string]*list.Element
+	stats DedupStats
+}
+
+// NewDeduper remembers up to size keys (DefaultDedupSize if size <= 0).
+func NewDeduper(size int) *Deduper {
+	if size <= 0 {
+		size = DefaultDedupSize
+	}
+	return &Deduper{cap: size, order: list.New(), keys: make(map[string]*list.Element, size)}
+}
+
+// dedupKey is the identity of s, "" when it has none.
+func dedupKey(s Sample) string {
+	switch {
+	case s.ID != "":
+		return "id:" + s.ID
+	case s.Seq != 0:
+		return s.SellerID + "|" + s.Kind + "|" + strconv.FormatUint(s.Seq, 10)
+	}
+	return ""
+}
+
+// Duplicate records s and reports whether it was seen before.
+func (d *Deduper) Duplicate(s Sample) bool {
+	key := dedupKey(s)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if key == "" {
+		d.stats.Unkeyed++
+		return false
+	}
+	if e, ok := d.keys[key]; ok {
+		d.order.MoveToFront(e)
+		d.stats.Duplicates++
+		return true
+	}
+	d.keys[key] = d.order.PushFront(key)
+	d.stats.Unique++
+	if d.order.Len() > d.cap {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.keys, oldest.Value.(string))
+		d.stats.Evicted++
+	}
+	return false
+}
+
+// Stats returns the counters so far.
+func (d *Deduper) Stats() DedupStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := d.stats
+	st.Size, st.Capacity = d.order.Len(), d.cap
+	return st
+}
+
+// WriteMetrics writes the counters in the Prometheus text format.
+func (d *Deduper) WriteMetrics(w io.Writer) {
+	st := d.Stats()
+	fmt.Fprintln(w, "# HELP localsense_buyer_dedup_samples_total Samples seen by the deduplicator, by outcome.")
+	fmt.Fprintln(w, "# TYPE localsense_buyer_dedup_samples_total counter")
+	fmt.Fprintf(w, "localsense_buyer_dedup_samples_total{outcome=\"unique\"} %d\n", st.Unique)
+	fmt.Fprintf(w, "localsense_buyer_dedup_samples_total{outcome=\"duplicate\"} %d\n", st.Duplicates)
+	fmt.Fprintf(w, "localsense_buyer_dedup_samples_total{outcome=\"unkeyed\"} %d\n", st.Unkeyed)
+	fmt.Fprintln(w, "# HELP localsense_buyer_dedup_evictions_total Keys dropped from the deduplicator to stay within capacity.")
+	fmt.Fprintln(w, "# TYPE localsense_buyer_dedup_evictions_total counter")
+	fmt.Fprintf(w, "localsense_buyer_dedup_evictions_total %d\n", st.Evicted)
+	fmt.Fprintln(w, "# HELP localsense_buyer_dedup_keys Keys the deduplicator remembers.")
+	fmt.Fprintln(w, "# TYPE localsense_buyer_dedup_keys gauge")
+	fmt.Fprintf(w, "localsense_buyer_dedup_keys %d\n", st.Size)
+}
@@ -0,0 +1,98 @@
+package buyerclient_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+
+	"localsense/neuron-seller/buyerclient"
+	"localsense/neuron-seller/contract"
+)
+
+// Fuzz targets for stream decoding: every line a buyer reads comes from a
+// seller, or a reseller, it has no reason to trust. Without -fuzz the seeds
+// run as ordinary tests.
+
+func streamSeeds(f *testing.F) [][]byte {
+	seeds := [][]byte{
+		[]byte(`{"type":"license","seller_id":"s","license_id":"l","license_sha256":"00","terms":{}}`),
+		[]byte(`{"type":"heartbeat","seller_id":"s","kind":"k","ts":1,"last_seq":2}`),
+		[]byte(`{"type":"link_quality","seller_id":"s","interval":5}`),
+		[]byte(`{"type":"provenance","seller_id":"s","origin":{"seller_id":"s","kind":"k","seq":1},"chain":[]}`),
+		[]byte(`{"type":"provenance","seller_id":"s","origin":{"type":"license"},"chain":null}`),
+		[]byte(`{"type":"provenance","seller_id":"s","origin":{"type":"provenance","origin":{}},"chain":[{"pubkey":"zz"}]}`),
+		[]byte(`{"seller_id":"s","kind":"k","seq":1,"ts":1,"value":1,"sig":"` + strings.Repeat("0", 128) + `"}`),
+		[]byte(`{"seller_id":"s","kind":"k","seq":18446744073709551615,"expires_at":-1}`),
+		[]byte(`[]`),
+		[]byte(`null`),
+	}
+	fixtures, err := contract.Fixtures()
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, fx := range fixtures {
+		seeds = append(seeds, fx.Payload)
+	}
+	return seeds
+}
+
+func FuzzParseLine(f *testing.F) {
+	for _, seed := range streamSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		smp, lic, err := buyerclient.ParseLine(line)
+		if err != nil {
+			if smp != nil || lic != nil {
+				t.Fatalf("%q: error %v with a result", line, err)
+			}
+			return
+		}
+		if (smp == nil) == (lic == nil) {
+			t.Fatalf("%q: want exactly one of sample and license", line)
+		}
+		if smp != nil {
+			if smp.SellerID == "" || smp.Kind == "" {
+				t.Fatalf("%q: sample without seller_id or kind", line)
+			}
+			if smp.Provenance == nil && !bytes.Equal(smp.Raw, line) {
+				t.Fatalf("%q: Raw is not the line", line)
+			}
+			buyerclient.VerifySeller(smp.Raw, make(ed25519.PublicKey, ed25519.PublicKeySize))
+		}
+	})
+}
+
+// FuzzConsume feeds whole streams through a Client with every check on.
+func FuzzConsume(f *testing.F) {
+	seeds := streamSeeds(f)
+	f.Add(bytes.Join(seeds[:4], []byte("\n"))) // license, heartbeat, link quality, provenance
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	key, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		c := &buyerclient.Client{
+			Source:    "s",
+			SellerKey: func(string) (ed25519.PublicKey, bool) { return key, true },
+			Dedup:     buyerclient.NewDeduper(16),
+			OnSample: func(s buyerclient.Sample) {
+				t.Fatalf("sample %s/%s#%d accepted without a valid signature", s.SellerID, s.Kind, s.Seq)
+			},
+			OnError: func(err error) {
+				if err == nil {
+					t.Fatal("nil error reported")
+				}
+			},
+		}
+		if err := c.Consume(bytes.NewReader(stream)); err != nil && !errors.Is(err, bufio.ErrTooLong) {
+			t.Fatalf("consume: %v", err)
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package buyerclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Sellers seal the samples of each anchor window into a Merkle tree and publish
+// each root to HCS (localsenseMerkleAnchor). A Proof from the seller's
+// GET /proof shows that a payload line is a leaf under such a root.
+
+// ProofStep is one sibling hash on the path from a leaf to the root.
+type ProofStep struct {
+	Hash string `json:"hash"`
+	Side string `json:"side"` // left or right of the running hash
+}
+
+// AnchorWindow is the sealed window a proof ends in.
+type AnchorWindow struct {
+	Start     int64                `json:"start"`
+	End       int64                `json:"end"`
+	Root      string               `json:"root"`
+	LeafCount int                  `json:"leaf_count"`
+	Kinds     map[string][2]uint64 `json:"kinds"`
+	Published bool                 `json:"published"`
+}
+
+// Proof is the body of GET /proof.
+type Proof struct {
+	Kind      string       `json:"kind"`
+	Seq       uint64       `json:"seq"`
+	LeafHash  string       `json:"leaf_hash"`
+	LeafIndex int          `json:"leaf_index"`
+	Path      []ProofStep  `json:"path"`
+	Window    AnchorWindow `json:"window"`
+}
+
+var ErrProofMismatch = errors.New("merkle proof does not reach the anchored root")
+
+// Verify checks that payload, exactly as received (a trailing newline is
+// ignored), hashes up the path to the window root. Compare the root with
+// the one published on HCS to finish the proof.
+func (p Proof) Verify(payload []byte) error {
+	sum := sha256.Sum256(append([]byte{0}, bytes.TrimRight(payload, "\r\n")...))
+	running := sum[:]
+	if hex.EncodeToString(running) != p.LeafHash {
+		return fmt.Errorf("%w: payload is not leaf %s", ErrProofMismatch, p.LeafHash)
+	}
+	for _, step := range p.Path {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return fmt.Errorf("proof step %q: %w", step.Hash, err)
+		}
+		var node []byte
+		switch step.Side {
+		case "left":
+			node = append(append([]byte{1}, sibling...), running...)
+		case "right":
+			node = append(append([]byte{1}, running...), sibling...)
+		default:
+			return fmt.Errorf("proof step side %q", step.Side)
+		}
+		h := sha256.Sum256(node)
+		running = h[:]
+	}
+	if hex.EncodeToString(running) != p.Window.Root {
+		return ErrProofMismatch
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package buyerclient_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"localsense/neuron-seller/buyerclient"
+)
+
+// Property tests for what a buyer does with a seller that keeps producing
+// while the link comes and goes: random runs of samples, disconnects,
+// corrupted lines, relay copies and reconnects with catch-up (the history
+// command, which replays from the last stored sample and overlaps what the
+// buyer already has) must never deliver a sample twice, deliver it out of
+// order unless it fills a reported gap, or leave gaps bigger than what was
+// missed, and a final catch-up must leave none.
+
+const (
+	opSample     = iota // the seller produces a sample
+	opDisconnect        // the stream drops
+	opReconnect         // the stream comes back, with catch-up
+	opCorrupt           // the next live line arrives mangled
+	opRelayCopy         // an earlier sample arrives again through a relay
+	numOps
+)
+
+type simKind struct {
+	name     string
+	produced uint64 // last seq the seller handed out
+	lines    map[uint64]string
+}
+
+// simRun plays ops through one Client and reports the first property it
+// breaks, or "".
+func simRun(ops []byte) string {
+	store := newMemStore()
+	var broke string
+	violate := func(format string, args ...any) {
+		if broke == "" {
+			broke = fmt.Sprintf(format, args...)
+		}
+	}
+	maxDelivered := map[string]uint64{}
+	seen := map[string]bool{}
+
+	c := &buyerclient.Client{
+		Store: store,
+		Dedup: buyerclient.NewDeduper(8),
+		OnSample: func(s buyerclient.Sample) {
+			key := fmt.Sprintf("%s#%d", s.Kind, s.Seq)
+			if seen[key] {
+				violate("%s delivered twice", key)
+			}
+			seen[key] = true
+			if s.Seq < maxDelivered[s.Kind] && !store.wasGap(s.Kind, s.Seq) {
+				violate("%s delivered after #%d without filling a gap", key, maxDelivered[s.Kind])
+			}
+			maxDelivered[s.Kind] = max(maxDelivered[s.Kind], s.Seq)
+		},
+	}
+
+	kinds := []*simKind{{name: "temp", lines: map[uint64]string{}}, {name: "lux", lines: map[uint64]string{}}}
+	connected, corrupt := true, false
+	missed := map[string]uint64{} // produced while the buyer could not get it
+	feed := func(line string) {
+		if corrupt {
+			line, corrupt = line[:len(line)/2], false
+		}
+		c.Consume(strings.NewReader(line + "\n"))
+	}
+
+	for i, op := range ops {
+		k := kinds[i%len(kinds)]
+		switch op % numOps {
+		case opSample:
+			k.produced++
+			line := fmt.Sprintf(`{"seller_id":"s","kind":%q,"seq":%d,"ts":%d,"value":%d}`, k.name, k.produced, 1767268800+i, i)
+			k.lines[k.produced] = line
+			if !connected {
+				missed[k.name]++
+				continue
+			}
+			if corrupt {
+				missed[k.name]++
+			}
+			feed(line)
+		case opDisconnect:
+			connected = false
+		case opReconnect:
+			connected = true
+			catchUp(k, store, feed)
+		case opCorrupt:
+			corrupt = connected
+		case opRelayCopy:
+			if k.produced > 0 {
+				seq := uint64(op)%k.produced + 1
+				c.Consume(strings.NewReader(k.lines[seq] + "\n"))
+			}
+		}
+		for _, k := range kinds {
+			if g := store.missing(k.name); g > missed[k.name] {
+				violate("%s: %d missing in gaps, only %d were missed", k.name, g, missed[k.name])
+			}
+		}
+	}
+
+	// A clean reconnect for every kind catches everything up.
+	corrupt = false
+	for _, k := range kinds {
+		catchUp(k, store, feed)
+		if g := store.missing(k.name); g != 0 {
+			violate("%s: %d still missing after catch-up", k.name, g)
+		}
+		if k.produced > 0 && maxDelivered[k.name] != k.produced && store.first(k.name) != 0 {
+			violate("%s: newest delivered #%d, produced #%d", k.name, maxDelivered[k.name], k.produced)
+		}
+	}
+	return broke
+}
+
+// catchUp replays the way the history command does: everything from the
+// first gap, or from the newest stored sample when there is none.
+func catchUp(k *simKind, store *memStore, feed func(string)) {
+	from := store.last(k.name)
+	if gaps, _ := store.Gaps("s", k.name); len(gaps) > 0 {
+		from = gaps[0].From
+	}
+	for seq := max(from, 1); seq <= k.produced; seq++ {
+		feed(k.lines[seq])
+	}
+}
+
+func TestPropertyCatchUp(t *testing.T) {
+	check := func(ops []byte) bool {
+		if broke := simRun(ops); broke != "" {
+			t.Logf("ops %v: %s", ops, broke)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// memStore is a buyerclient.Store in memory, with the gap semantics of
+// sqlitestore: holes between stored samples, not before the first.
+type memStore struct {
+	seqs     map[string]map[uint64]bool // by kind
+	everGaps map[string]map[uint64]bool // seqs ever reported missing
+}
+
+func newMemStore() *memStore {
+	return &memStore{seqs: map[string]map[uint64]bool{}, everGaps: map[string]map[uint64]bool{}}
+}
+
+func (m *memStore) Save(s buyerclient.Sample) (bool, error) {
+	// Record what was missing before this sample arrived.
+	if gaps, _ := m.Gaps(s.SellerID, s.Kind); len(gaps) > 0 {
+		if m.everGaps[s.Kind] == nil {
+			m.everGaps[s.Kind] = map[uint64]bool{}
+		}
+		for _, g := range gaps {
+			for seq := g.From; seq <= g.To; seq++ {
+				m.everGaps[s.Kind][seq] = true
+			}
+		}
+	}
+	if m.seqs[s.Kind] == nil {
+		m.seqs[s.Kind] = map[uint64]bool{}
+	}
+	if m.seqs[s.Kind][s.Seq] {
+		return false, nil
+	}
+	m.seqs[s.Kind][s.Seq] = true
+	return true, nil
+}
+
+func (m *memStore) Gaps(sellerID, kind string) ([]buyerclient.Gap, error) {
+	var seqs []uint64
+	for seq := range m.seqs[kind] {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	var gaps []buyerclient.Gap
+	for i := 1; i < len(seqs); i++ {
+		if seqs[i] > seqs[i-1]+1 {
+			gaps = append(gaps, buyerclient.Gap{SellerID: sellerID, Kind: kind, From: seqs[i-1] + 1, To: seqs[i] - 1})
+		}
+	}
+	return gaps, nil
+}
+
+func (m *memStore) Close() error { return nil }
+
+func (m *memStore) missing(kind string) uint64 {
+	gaps, _ := m.Gaps("s", kind)
+	var n uint64
+	for _, g := range gaps {
+		n += g.Missing()
+	}
+	return n
+}
+
+// wasGap reports whether seq was missing when it was saved: in a gap, or
+// older than anything stored before it (a relay copy from before the buyer
+// subscribed).
+func (m *memStore) wasGap(kind string, seq uint64) bool {
+	return m.everGaps[kind][seq] || m.first(kind) == seq
+}
+
+func (m *memStore) first(kind string) uint64 {
+	var first uint64
+	for seq := range m.seqs[kind] {
+		if first == 0 || seq < first {
+			first = seq
+		}
+	}
+	return first
+}
+
+func (m *memStore) last(kind string) uint64 {
+	var last uint64
+	for seq := range m.seqs[kind] {
+		last = max(last, seq)
+	}
+	return last
+}
@@ -0,0 +1,164 @@
+package buyerclient
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Buyers that re-expose a stream (aggregators, dashboards reselling feeds)
+// must not pass samples off as their own. A Republisher wraps each original
+// payload, byte for byte and still carrying the seller's signature, in a
+// provenance envelope and appends a signed hop. Every later hop signs over
+// the previous one, so stripping or reordering hops breaks the chain.
+
+// Hop is one node that handled a sample after the seller.
+type Hop struct {
+	NodeID    string `json:"node_id"`
+	PubKey    string `json:"pubkey"`
+	Role      string `json:"role"`
+	Ts        int64  `json:"ts"`
+	Watermark string `json:"watermark,omitempty"`
+	Sig       string `json:"sig"`
+}
+
+// Envelope is the "provenance" frame that carries a re-exposed sample.
+type Envelope struct {
+	Type     string          `json:"type"`
+	SellerID string          `json:"seller_id"`
+	Origin   json.RawMessage `json:"origin"`
+	Chain    []Hop           `json:"chain"`
+}
+
+var (
+	ErrUnsigned     = errors.New("sample carries no seller signature")
+	ErrBadSignature = errors.New("seller signature does not verify")
+	ErrBrokenChain  = errors.New("provenance chain does not verify")
+	ErrUnattributed = errors.New("sample from another seller without provenance")
+)
+
+// sigSuffixLen is len(`,"sig":"` + 128 hex chars + `"}`).
+const sigSuffixLen = 8 + 2*ed25519.SignatureSize + 2
+
+// SplitSignature separates a signed payload into the exact bytes the seller
+// signed and the signature. ok is false for unsigned payloads.
+func SplitSignature(payload []byte) (signed, sig []byte, ok bool) {
+	payload = bytes.TrimRight(payload, "\r\n")
+	n := len(payload)
+	if n < sigSuffixLen+1 || !bytes.HasPrefix(payload[n-sigSuffixLen:], []byte(`,"sig":"`)) || !bytes.HasSuffix(payload, []byte(`"}`)) {
+		return nil, nil, false
+	}
+	sig, err := hex.DecodeString(string(payload[n-sigSuffixLen+8 : n-2]))
+	if err != nil {
+		return nil, nil, false
+	}
+	signed = append(append([]byte(nil), payload[:n-sigSuffixLen]...), '}')
+	return signed, sig, true
+}
+
+// VerifySeller checks a payload's seller signature against pub.
+func VerifySeller(payload []byte, pub ed25519.PublicKey) error {
+	signed, sig, ok := SplitSignature(payload)
+	if !ok {
+		return ErrUnsigned
+	}
+	if !ed25519.Verify(pub, signed, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// hopDigest is what a hop signs: the origin hash, the previous hop's
+// signature (empty for the first hop) and the hop's own fields.
+func hopDigest(origin []byte, prevSig string, h Hop) []byte {
+	sum := sha256.New()
+	originSum := sha256.Sum256(origin)
+	sum.Write(originSum[:])
+	sum.Write([]byte(prevSig))
+	sum.Write([]byte("|" + h.NodeID + "|" + h.PubKey + "|" + h.Role + "|" + strconv.FormatInt(h.Ts, 10) + "|" + h.Watermark))
+	return sum.Sum(nil)
+}
+
+// VerifyChain checks every hop signature of the envelope.
+func (e Envelope) VerifyChain() error {
+	prev := ""
+	for i, h := range e.Chain {
+		pub, err := hex.DecodeString(h.PubKey)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return fmt.Errorf("%w: hop %d has an invalid pubkey", ErrBrokenChain, i)
+		}
+		sig, err := hex.DecodeString(h.Sig)
+		if err != nil || !ed25519.Verify(pub, hopDigest(e.Origin, prev, h), sig) {
+			return fmt.Errorf("%w: hop %d (%s)", ErrBrokenChain, i, h.NodeID)
+		}
+		prev = h.Sig
+	}
+	return nil
+}
+
+// Republisher wraps samples for re-exposure.
+type Republisher struct {
+	NodeID string
+	Key    ed25519.PrivateKey
+	// Role describes the hop, e.g. "aggregator".
+	Role string
+	// Watermark is free text stamped into the hop, e.g. the reseller's
+	// terms or a customer reference, so leaked copies are traceable.
+	Watermark string
+	// AllowUnsigned lets samples without a seller signature through;
+	// otherwise they are refused since their origin can't be proven.
+	AllowUnsigned bool
+}
+
+// Wrap returns the provenance frame for one received stream line, which may
+// be an original sample or an envelope from an upstream hop.
+func (r *Republisher) Wrap(line []byte) ([]byte, error) {
+	line = bytes.TrimRight(line, "\r\n")
+
+	var env Envelope
+	if err := json.Unmarshal(line, &env); err != nil {
+		return nil, fmt.Errorf("decode line: %w", err)
+	}
+	if env.Type == "provenance" {
+		if err := env.VerifyChain(); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, _, ok := SplitSignature(line); !ok && !r.AllowUnsigned {
+			return nil, ErrUnsigned
+		}
+		var head struct {
+			SellerID string `json:"seller_id"`
+		}
+		if err := json.Unmarshal(line, &head); err != nil || head.SellerID == "" {
+			return nil, fmt.Errorf("sample is missing seller_id")
+		}
+		env = Envelope{Type: "provenance", SellerID: head.SellerID, Origin: append(json.RawMessage(nil), line...)}
+	}
+
+	hop := Hop{
+		NodeID:    r.NodeID,
+		PubKey:    hex.EncodeToString(r.Key.Public().(ed25519.PublicKey)),
+		Role:      r.Role,
+		Ts:        time.Now().Unix(),
+		Watermark: r.Watermark,
+	}
+	prev := ""
+	if n := len(env.Chain); n > 0 {
+		prev = env.Chain[n-1].Sig
+	}
+	hop.Sig = hex.EncodeToString(ed25519.Sign(r.Key, hopDigest(env.Origin, prev, hop)))
+	env.Chain = append(env.Chain, hop)
+
+	out, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
@@ -0,0 +1,132 @@
+// Package sqlitestore is a buyerclient.Store backed by a local SQLite file.
+// It lives in its own package so only integrators who want persistence pay
+// for the cgo dependency.
+package sqlitestore
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"localsense/neuron-seller/buyerclient"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS samples (
+	seller_id   TEXT    NOT NULL,
+	kind        TEXT    NOT NULL,
+	seq         INTEGER NOT NULL,
+	ts          INTEGER NOT NULL,
+	value       REAL    NOT NULL,
+	unit        TEXT    NOT NULL DEFAULT '',
+	payload     TEXT    NOT NULL,
+	received_at INTEGER NOT NULL,
+	PRIMARY KEY (seller_id, kind, seq)
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS samples_ts ON samples (seller_id, kind, ts);
+`
+
+// gapQuery finds holes between consecutive stored sequence numbers. Samples
+// before the first one stored are not reported: the buyer wasn't subscribed.
+const gapQuery = `
+SELECT seller_id, kind, prev + 1, seq - 1 FROM (
+	SELECT seller_id, kind, seq,
+		LAG(seq) OVER (PARTITION BY seller_id, kind ORDER BY seq) AS prev
+	FROM samples
+	WHERE (?1 = '' OR seller_id = ?1) AND (?2 = '' OR kind = ?2)
+)
+WHERE prev IS NOT NULL AND seq > prev + 1
+ORDER BY seller_id, kind, seq`
+
+// Store keeps received samples in SQLite, one row per (seller, kind, seq).
+type Store struct {
+	db *sql.DB
+}
+
+var _ buyerclient.Store = (*Store)(nil)
+
+// Open creates or opens the database at path.
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	// SQLite allows one writer; a single connection avoids busy errors.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create schema: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Save inserts the sample and reports false if it was already stored.
+func (s *Store) Save(sample buyerclient.Sample) (bool, error) {
+	res, err := s.db.Exec(
+		`INSERT OR IGNORE INTO samples (seller_id, kind, seq, ts, value, unit, payload, received_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		sample.SellerID, sample.Kind, sample.Seq, sample.Ts, sample.Value, sample.Unit,
+		string(sample.Raw), time.Now().Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// Gaps lists missing sequence ranges; an empty sellerID or kind matches all.
+func (s *Store) Gaps(sellerID, kind string) ([]buyerclient.Gap, error) {
+	rows, err := s.db.Query(gapQuery, sellerID, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var gaps []buyerclient.Gap
+	for rows.Next() {
+		var g buyerclient.Gap
+		if err := rows.Scan(&g.SellerID, &g.Kind, &g.From, &g.To); err != nil {
+			return nil, err
+		}
+		gaps = append(gaps, g)
+	}
+	return gaps, rows.Err()
+}
+
+// Range returns stored samples with from <= seq <= to, oldest first.
+func (s *Store) Range(sellerID, kind string, from, to uint64) ([]buyerclient.Sample, error) {
+	rows, err := s.db.Query(
+		`SELECT seller_id, kind, seq, ts, value, unit, payload FROM samples
+		 WHERE seller_id = ? AND kind = ? AND seq BETWEEN ? AND ?
+		 ORDER BY seq`,
+		sellerID, kind, from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []buyerclient.Sample
+	for rows.Next() {
+		var (
+			sample  buyerclient.Sample
+			payload string
+		)
+		if err := rows.Scan(&sample.SellerID, &sample.Kind, &sample.Seq, &sample.Ts, &sample.Value, &sample.Unit, &payload); err != nil {
+			return nil, err
+		}
+		sample.Raw = []byte(payload)
+		out = append(out, sample)
+	}
+	return out, rows.Err()
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+// Buyers steer their own streams with the pause, resume, set_interval,
+// history and backfill (see backfill.go) commands. A buyer is identified by the public key in its service
+// request, so a command applies to every stream opened with the issuer's
+// key; operators may name another buyer with the "buyer" param.
+
+// buyerIdentity returns the public key and EVM address a buyer sent in its
+// service request.
+func buyerIdentity(info *commonlib.NodeBufferInfo) (key, evm string) {
+	switch msg := info.RequestOrResponse.Message.(type) {
+	case *types.NeuronServiceRequestMsg:
+		key, evm = msg.PublicKey, msg.EthPublicKey
+	case types.NeuronServiceRequestMsg:
+		key, evm = msg.PublicKey, msg.EthPublicKey
+	case map[string]any:
+		key, _ = msg["k"].(string)
+		evm, _ = msg["e"].(string)
+	}
+	return rawKey(key), evm
+}
+
+// buyerSharedAccount returns the shared account ("0.0.N") a buyer funds to
+// pay for its stream, or "" when it named none.
+func buyerSharedAccount(info *commonlib.NodeBufferInfo) string {
+	var num uint64
+	switch msg := info.RequestOrResponse.Message.(type) {
+	case *types.NeuronServiceRequestMsg:
+		num = msg.SharedAccID
+	case types.NeuronServiceRequestMsg:
+		num = msg.SharedAccID
+	case map[string]any:
+		if f, ok := msg["a"].(float64); ok {
+			num = uint64(f)
+		}
+	}
+	if num == 0 {
+		return ""
+	}
+	return "0.0." + strconv.FormatUint(num, 10)
+}
+
+// connectedBuyerAccounts returns the EVM addresses of the live streams opened
+// with key, one per stream; empty when the key has none.
+func connectedBuyerAccounts(key string) []string {
+	key = rawKey(key)
+	if neuronBuffers == nil || key == "" {
+		return nil
+	}
+	var out []string
+	for peerID, info := range neuronBuffers.GetBufferMap() {
+		if info.LibP2PState != types.Connected || !buyerPaid(info) || !buyerAccess.Admit(peerID, info) {
+			continue
+		}
+		if k, evm := buyerIdentity(info); k == key {
+			out = append(out, evm)
+		}
+	}
+	return out
+}
+
+type buyerControls struct {
+	mu       sync.Mutex
+	paused   map[string]bool
+	interval map[string]time.Duration
+	last     map[string]time.Time // buyer key + "|" + kind
+	replays  []historyReplay
+}
+
+// historyReplay is a batch of history records queued for one buyer.
+type historyReplay struct {
+	Key     string
+	Records []historyRecord
+}
+
+var controls = &buyerControls{
+	paused:   make(map[string]bool),
+	interval: make(map[string]time.Duration),
+	last:     make(map[string]time.Time),
+}
+
+// Admit reports whether a sample of kind may go to the buyer with key now,
+// given its pause state and requested interval.
+func (c *buyerControls) Admit(key, kind string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused[key] {
+		return false
+	}
+	if iv := c.interval[key]; iv > 0 {
+		slot := key + "|" + kind
+		// Allow a little slack so a requested interval equal to the tick
+		// doesn't skip every other sample on timer jitter.
+		if last, ok := c.last[slot]; ok && now.Sub(last) < iv-iv/10 {
+			return false
+		}
+		c.last[slot] = now
+	}
+	return true
+}
+
+// Paused reports whether the buyer with key has paused its streams.
+func (c *buyerControls) Paused(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused[key]
+}
+
+// Interval is the buyer's requested interval, 0 when it set none.
+func (c *buyerControls) Interval(key string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.interval[key]
+}
+
+// forget drops the pause, interval and rate-limit state of a buyer that has
+// no streams left.
+func (c *buyerControls) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.paused, key)
+	delete(c.interval, key)
+	for slot := range c.last {
+		if strings.HasPrefix(slot, key+"|") {
+			delete(c.last, slot)
+		}
+	}
+}
+
+func (c *buyerControls) takeReplays() []historyReplay {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := c.replays
+	c.replays = nil
+	return out
+}
+
+// commandBuyer is the buyer a stream command applies to: the issuer, or for
+// operators the optional "buyer" param.
+func commandBuyer(cmd commandEnvelope, buyer string) (string, error) {
+	if buyer == "" {
+		return rawKey(cmd.Issuer), nil
+	}
+	if !policy.IsOperator(cmd) {
+		return "", commandErrorf(commandErrUnauthorized, "only operators may act on another buyer")
+	}
+	key := rawKey(buyer)
+	if b, err := hex.DecodeString(key); err != nil || (len(b) != ed25519.PublicKeySize && len(b) != secp256k1.PubKeyBytesLenCompressed) {
+		return "", ErrPeerInvalid.With(fmt.Sprintf("buyer %q is not a hex ed25519 or compressed secp256k1 public key", buyer))
+	}
+	return key, nil
+}
+
+type buyerParams struct {
+	Buyer string `json:"buyer,omitempty"`
+}
+
+func decodeParams(cmd commandEnvelope, v any) error {
+	if len(cmd.Params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(cmd.Params, v); err != nil {
+		return commandErrorf(commandErrInvalidParams, "%v", err)
+	}
+	return nil
+}
+
+func pauseCommand(cmd commandEnvelope) (any, error) {
+	return setPaused(cmd, true)
+}
+
+func resumeCommand(cmd commandEnvelope) (any, error) {
+	return setPaused(cmd, false)
+}
+
+func setPaused(cmd commandEnvelope, paused bool) (any, error) {
+	var p buyerParams
+	if err := decodeParams(cmd, &p); err != nil {
+		return nil, err
+	}
+	key, err := commandBuyer(cmd, p.Buyer)
+	if err != nil {
+		return nil, err
+	}
+	controls.mu.Lock()
+	if paused {
+		controls.paused[key] = true
+	} else {
+		delete(controls.paused, key)
+	}
+	controls.mu.Unlock()
+	log.Printf("neuron-seller: buyer %.16s paused=%t", key, paused)
+	return map[string]any{"paused": paused, "streams": len(connectedBuyerAccounts(key))}, nil
+}
+
+// set_interval {"seconds": n} delivers at most one sample per kind every n
+// seconds to the buyer; 0 restores the node's own rate.
+func setIntervalCommand(cmd commandEnvelope) (any, error) {
+	var p struct {
+		buyerParams
+		Seconds *int `json:"seconds"`
+	}
+	if err := decodeParams(cmd, &p); err != nil {
+		return nil, err
+	}
+	if p.Seconds == nil || *p.Seconds < 0 || *p.Seconds > 86400 {
+		return nil, commandErrorf(commandErrInvalidParams, "seconds must be between 0 and 86400")
+	}
+	key, err := commandBuyer(cmd, p.Buyer)
+	if err != nil {
+		return nil, err
+	}
+	controls.mu.Lock()
+	if *p.Seconds == 0 {
+		delete(controls.interval, key)
+	} else {
+		controls.interval[key] = time.Duration(*p.Seconds) * time.Second
+	}
+	controls.mu.Unlock()
+	return map[string]any{"seconds": *p.Seconds}, nil
+}
+
+const maxReplayRecords = 1000
+
+// history {"from": unix, "to": unix, "kind": "", "limit": n} replays raw
+// history records to the buyer's open JSON streams, oldest first.
+func historyCommand(cmd commandEnvelope) (any, error) {
+	if history == nil {
+		return nil, ErrDisabled.With("history disabled on this node")
+	}
+	if memBudget.Level() != memoryOK {
+		return nil, ErrOverloaded.With("node is low on memory, retry later")
+	}
+	var p struct {
+		buyerParams
+		From  int64  `json:"from"`
+		To    int64  `json:"to"`
+		Kind  string `json:"kind"`
+		Limit int    `json:"limit"`
+	}
+	if err := decodeParams(cmd, &p); err != nil {
+		return nil, err
+	}
+	if p.From == 0 {
+		return nil, commandErrorf(commandErrInvalidParams, "from is required")
+	}
+	if p.To == 0 {
+		p.To = time.Now().Unix()
+	}
+	if p.Limit <= 0 || p.Limit > maxReplayRecords {
+		p.Limit = maxReplayRecords
+	}
+	key, err := commandBuyer(cmd, p.Buyer)
+	if err != nil {
+		return nil, err
+	}
+	if len(connectedBuyerAccounts(key)) == 0 {
+		return nil, ErrPaymentRequired.With("buyer has no open paid stream to replay into")
+	}
+
+	records, err := history.Query(time.Unix(p.From, 0), time.Unix(p.To, 0), p.Kind, p.Limit)
+	if err != nil {
+		return nil, commandErrorf(commandErrFailed, "%v", err)
+	}
+	controls.mu.Lock()
+	controls.replays = append(controls.replays, historyReplay{Key: key, Records: records})
+	controls.mu.Unlock()
+	return map[string]any{"queued": len(records), "truncated": len(records) == p.Limit}, nil
+}
+
+// sendReplays writes queued history replays to the matching buyers' streams,
+// one frame per stream. Avro streams are skipped: replayed records are the
+// JSON payloads as stored.
+func (s *neuronSeller) sendReplays(p2pHost host.Host, buffers *commonlib.NodeBuffers) {
+	for _, job := range controls.takeReplays() {
+		for peerID, info := range buffers.GetBufferMap() {
+			if info.LibP2PState != types.Connected || !buyerPaid(info) {
+				continue
+			}
+			if key, _ := buyerIdentity(info); key != job.Key || buyerCodec(info, s.cfg.Codec) != codecJSON {
+				continue
+			}
+			for i, kind := range s.cfg.Kinds {
+				if !buyerWantsKind(info, kind, i == 0) {
+					continue
+				}
+				var frame []byte
+				for _, rec := range job.Records {
+					if rec.Kind == kind.Name {
+						frame = append(append(frame, rec.Payload...), '\n')
+					}
+				}
+				if frame == nil {
+					continue
+				}
+				if err := s.writeBuyerFrame(p2pHost, buffers, peerID, info, streamProtocol(info, kind), codecJSON, frame); err != nil {
+					log.Printf("neuron-seller: history replay to %s failed: %v", peerID, err)
+					continue
+				}
+				log.Printf("neuron-seller: replayed %d bytes of %s history to %s", len(frame), kind.Name, peerID)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"math"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CAMERA_SOURCE makes a camera the brightness sensor, for deployments with
+// no light sensor on the Pi: picamera grabs a still from the Pi camera
+// (rpicam-still), an rtsp:// URL a frame from that stream (ffmpeg). The
+// frame is read from the capture command's stdout, never written to disk,
+// reduced to its mean luma (BT.601) and dropped; only the resulting
+// brightness reading (0-10 brightness_index, like the Pi's own) and the
+// capture time leave this file. CAMERA_CAPTURE_COMMAND replaces the default
+// command, {url} standing for the RTSP URL; it must write one JPEG or PNG
+// to stdout.
+//
+// With a camera source, readings come from the camera instead of the Pi's
+// /metrics. Captures are serialized and a frame younger than
+// CAMERA_MAX_AGE_SECONDS is shared between the stream loop and /stream
+// clients, so a slow camera isn't asked for several frames per tick.
+
+type cameraSource struct {
+	source  string
+	command []string
+	timeout time.Duration
+	maxAge  time.Duration
+
+	mu      sync.Mutex
+	last    *piMetrics
+	lastAt  time.Time
+	lastErr string
+}
+
+var camera *cameraSource
+
+func loadCameraSource() {
+	source := getEnvOrDefault("CAMERA_SOURCE", "")
+	if source == "" {
+		return
+	}
+	command := getEnvOrDefault("CAMERA_CAPTURE_COMMAND", "")
+	switch {
+	case command != "":
+	case source == "picamera":
+		command = "rpicam-still -n -t 1 --width 320 --height 240 -e jpg -o -"
+	case strings.HasPrefix(source, "rtsp://") || strings.HasPrefix(source, "rtsps://"):
+		command = "ffmpeg -loglevel error -rtsp_transport tcp -i {url} -frames:v 1 -vf scale=320:-1 -f image2pipe -vcodec mjpeg -"
+	default:
+		log.Fatalf("neuron-seller: CAMERA_SOURCE must be picamera or an rtsp:// URL, got %q", source)
+	}
+	args := strings.Fields(command)
+	for i := range args {
+		args[i] = strings.ReplaceAll(args[i], "{url}", source)
+	}
+	camera = &cameraSource{
+		source:  source,
+		command: args,
+		timeout: time.Duration(max(parseEnvInt("CAMERA_TIMEOUT_SECONDS", 10), 1)) * time.Second,
+		maxAge:  time.Duration(max(parseEnvInt("CAMERA_MAX_AGE_SECONDS", 2), 0)) * time.Second,
+	}
+	log.Printf("Camera    : brightness from %s (%s)", cameraName(source), args[0])
+}
+
+// Capture returns the brightness of a fresh frame as Pi metrics.
+func (c *cameraSource) Capture() (*piMetrics, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last != nil && time.Since(c.lastAt) < c.maxAge {
+		return c.last, nil
+	}
+	brightness, err := c.capture()
+	if err != nil {
+		c.lastErr = err.Error()
+		return nil, fmt.Errorf("camera %s: %w", cameraName(c.source), err)
+	}
+	now := time.Now()
+	c.last = &piMetrics{
+		Ts:         float64(now.Unix()),
+		Brightness: brightness,
+		Values:     map[string]float64{"ts": float64(now.Unix()), "brightness": brightness},
+	}
+	c.lastAt = now
+	c.lastErr = ""
+	return c.last, nil
+}
+
+// capture runs the capture command and returns the frame's brightness
+// index; the frame goes out of scope here.
+func (c *cameraSource) capture() (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.command[0], c.command[1:]...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return 0, fmt.Errorf("%w: %s", err, msg)
+		}
+		return 0, err
+	}
+	frame, _, err := image.Decode(&stdout)
+	if err != nil {
+		return 0, fmt.Errorf("decode frame: %w", err)
+	}
+	return math.Round(meanLuma(frame)/255*10*1e4) / 1e4, nil
+}
+
+// meanLuma is the average BT.601 luma (0-255) of img.
+func meanLuma(img image.Image) float64 {
+	b := img.Bounds()
+	if b.Empty() {
+		return 0
+	}
+	var sum float64
+	switch m := img.(type) {
+	case *image.YCbCr:
+		// JPEG frames: the Y plane is the luma.
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := m.Y[m.YOffset(b.Min.X, y) : m.YOffset(b.Max.X-1, y)+1]
+			for _, v := range row {
+				sum += float64(v)
+			}
+		}
+	default:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				sum += float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			}
+		}
+	}
+	return sum / float64(b.Dx()*b.Dy())
+}
+
+// Status is the camera state for /status.
+func (c *cameraSource) Status() map[string]any {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := map[string]any{"source": cameraName(c.source)}
+	if c.last != nil {
+		out["brightness"] = c.last.Brightness
+		out["captured_at"] = c.lastAt.UTC().Format(time.RFC3339)
+	}
+	if c.lastErr != "" {
+		out["error"] = c.lastErr
+	}
+	return out
+}
+
+// cameraName is the source without RTSP credentials.
+func cameraName(source string) string {
+	if at := strings.LastIndex(source, "@"); at >= 0 {
+		if scheme := strings.Index(source, "://"); scheme >= 0 && scheme < at {
+			return source[:scheme+3] + source[at+1:]
+		}
+	}
+	return source
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Before a schema change goes fleet-wide, one node can try it on a few
+// buyers. With CANARY_SCHEMA_VERSION set, CANARY_PERCENT of paid JSON
+// buyers (picked by key, so the same ones each time) or those listed in
+// CANARY_BUYERS get, next to a regular sample, one frame
+//
+//	{"type":"canary","canary_id":"...","schema_id":"urn:localsense:sample:v2","kind":"...","payload":{...}}
+//
+// whose payload is the sample under the canary schema ID, with the members
+// of CANARY_PAYLOAD_FILE merged in (null removes one). Buyers answer with a
+// canary_result command, {"canary_id": "...", "accepted": bool, "errors":
+// [...], "client": "..."}; unanswered canaries are resent hourly.
+// GET /admin/canary reports who accepted, who rejected and why.
+
+const canaryResend = time.Hour
+
+type canaryResult struct {
+	Accepted bool      `json:"accepted"`
+	Errors   []string  `json:"errors,omitempty"`
+	Client   string    `json:"client,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+type canaryBuyer struct {
+	Account string        `json:"account,omitempty"`
+	Kind    string        `json:"kind"`
+	SentAt  time.Time     `json:"sent_at"`
+	Sent    int           `json:"sent"`
+	Result  *canaryResult `json:"result,omitempty"`
+}
+
+type canaryState struct {
+	CanaryID string                  `json:"canary_id"`
+	Buyers   map[string]*canaryBuyer `json:"buyers"`
+}
+
+type canaryRollout struct {
+	id       string
+	schemaID string
+	percent  int
+	listed   map[string]bool
+	overlay  map[string]json.RawMessage
+	path     string
+
+	mu    sync.Mutex
+	state canaryState
+}
+
+var canary *canaryRollout
+
+func loadCanary() {
+	version := strings.TrimSpace(getEnvOrDefault("CANARY_SCHEMA_VERSION", ""))
+	if version == "" {
+		return
+	}
+	if version == payloadSchemaVersion() {
+		log.Fatalf("canary: CANARY_SCHEMA_VERSION is the current PAYLOAD_SCHEMA_VERSION (%s)", version)
+	}
+	c := &canaryRollout{
+		id:       fmt.Sprintf("%s:v%s", sellerCfg.SellerID, version),
+		schemaID: "urn:localsense:sample:v" + version,
+		percent:  min(max(parseEnvInt("CANARY_PERCENT", 10), 0), 100),
+		listed:   map[string]bool{},
+		path:     getEnvOrDefault("CANARY_STATE_FILE", "data/canary.json"),
+	}
+	for _, k := range strings.Split(getEnvOrDefault("CANARY_BUYERS", ""), ",") {
+		if k = rawKey(k); k != "" {
+			c.listed[k] = true
+		}
+	}
+	if path := getEnvOrDefault("CANARY_PAYLOAD_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("canary: read %s: %v", path, err)
+		}
+		if err := json.Unmarshal(data, &c.overlay); err != nil {
+			log.Fatalf("canary: parse %s: %v", path, err)
+		}
+	}
+	if err := c.load(); err != nil {
+		log.Fatalf("canary: %v", err)
+	}
+	canary = c
+	who := fmt.Sprintf("%d%% of buyers", c.percent)
+	if len(c.listed) > 0 {
+		who = fmt.Sprintf("%d listed buyer(s)", len(c.listed))
+	}
+	log.Printf("Canary    : %s to %s, %d member(s) overlaid", c.schemaID, who, len(c.overlay))
+}
+
+// picked reports whether the buyer with key is in the canary group.
+func (c *canaryRollout) picked(key string) bool {
+	if len(c.listed) > 0 {
+		return c.listed[key]
+	}
+	sum := sha256.Sum256([]byte(c.id + "|" + key))
+	return binary.BigEndian.Uint64(sum[:8])%100 < uint64(c.percent)
+}
+
+// Due reports whether the buyer with key should get a canary now.
+func (c *canaryRollout) Due(key string, now time.Time) bool {
+	if c == nil || key == "" || !c.picked(key) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.state.Buyers[key]
+	return b == nil || (b.Result == nil && now.Sub(b.SentAt) >= canaryResend)
+}
+
+// Frame is the canary frame for a sample payload.
+func (c *canaryRollout) Frame(kind string, payload []byte) ([]byte, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &members); err != nil {
+		return nil, err
+	}
+	// The signature covers the regular payload, not this one.
+	delete(members, "sig")
+	for k, v := range c.overlay {
+		if string(v) == "null" {
+			delete(members, k)
+		} else {
+			members[k] = v
+		}
+	}
+	members["schema_id"], _ = json.Marshal(c.schemaID)
+	frame, err := json.Marshal(map[string]any{
+		"type":      "canary",
+		"canary_id": c.id,
+		"schema_id": c.schemaID,
+		"kind":      kind,
+		"payload":   members,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(frame, '\n'), nil
+}
+
+// Sent notes a canary written to the buyer with key.
+func (c *canaryRollout) Sent(key, account, kind string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.state.Buyers[key]
+	if b == nil {
+		b = &canaryBuyer{}
+		c.state.Buyers[key] = b
+	}
+	b.Account, b.Kind, b.SentAt = account, kind, now
+	b.Sent++
+	if err := c.saveLocked(); err != nil {
+		log.Printf("canary: save: %v", err)
+	}
+}
+
+// sendCanary writes a canary frame next to a sample for buyers in the
+// canary group.
+func (s *neuronSeller) sendCanary(
+	p2pHost host.Host,
+	buffers *commonlib.NodeBuffers,
+	peerID peer.ID,
+	bufferInfo *commonlib.NodeBufferInfo,
+	proto protocol.ID,
+	buyerKey, buyerAccount string,
+	kind sensorKind,
+	payload []byte,
+) {
+	now := time.Now()
+	if !canary.Due(buyerKey, now) {
+		return
+	}
+	frame, err := canary.Frame(kind.Name, payload)
+	if err != nil {
+		log.Printf("canary: build frame: %v", err)
+		return
+	}
+	if err := s.writeBuyerFrame(p2pHost, buffers, peerID, bufferInfo, proto, codecJSON, frame); err != nil {
+		reportWriteError(peerID.String(), bufferInfo, err)
+		return
+	}
+	canary.Sent(buyerKey, buyerAccount, kind.Name, now)
+	log.Printf("canary: sent %s to buyer %.18s", canary.schemaID, buyerKey)
+}
+
+// canary_result {"canary_id": "...", "accepted": bool, "errors": [...],
+// "client": "..."} is a buyer's verdict on the canary it got.
+func canaryResultCommand(cmd commandEnvelope) (any, error) {
+	var p struct {
+		CanaryID string   `json:"canary_id"`
+		Accepted *bool    `json:"accepted"`
+		Errors   []string `json:"errors"`
+		Client   string   `json:"client"`
+	}
+	if err := decodeParams(cmd, &p); err != nil {
+		return nil, err
+	}
+	if canary == nil {
+		return nil, ErrDisabled.With("no canary is running")
+	}
+	if p.CanaryID != canary.id {
+		return nil, commandErrorf(commandErrInvalidParams, "canary_id %q is not the running canary %q", p.CanaryID, canary.id)
+	}
+	if p.Accepted == nil {
+		return nil, commandErrorf(commandErrInvalidParams, "accepted is required")
+	}
+	if len(p.Errors) > 20 {
+		p.Errors = p.Errors[:20]
+	}
+	key := rawKey(cmd.Issuer)
+	canary.mu.Lock()
+	defer canary.mu.Unlock()
+	b := canary.state.Buyers[key]
+	if b == nil {
+		return nil, commandErrorf(commandErrInvalidParams, "no canary was sent to this key")
+	}
+	b.Result = &canaryResult{Accepted: *p.Accepted, Errors: p.Errors, Client: p.Client, At: time.Now().UTC()}
+	if err := canary.saveLocked(); err != nil {
+		log.Printf("canary: save: %v", err)
+	}
+	log.Printf("canary: buyer %.18s accepted=%t %v", key, *p.Accepted, p.Errors)
+	return map[string]any{"canary_id": canary.id, "recorded": true}, nil
+}
+
+func (c *canaryRollout) load() error {
+	c.state = canaryState{CanaryID: c.id, Buyers: map[string]*canaryBuyer{}}
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st canaryState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("decode %s: %w", c.path, err)
+	}
+	// Results of an earlier canary don't speak for this one.
+	if st.CanaryID == c.id && st.Buyers != nil {
+		c.state = st
+	}
+	return nil
+}
+
+func (c *canaryRollout) saveLocked() error {
+	data, err := json.MarshalIndent(c.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// GET /admin/canary – the running canary and each buyer's verdict, with a
+// compatibility summary and the most common rejection reasons.
+func adminCanaryHandler(w http.ResponseWriter, r *http.Request) {
+	if canary == nil {
+		writeJSONError(w, ErrDisabled.With("no canary configured (CANARY_SCHEMA_VERSION)"))
+		return
+	}
+	canary.mu.Lock()
+	defer canary.mu.Unlock()
+	var accepted, rejected, pending int
+	reasons := map[string]int{}
+	for _, b := range canary.state.Buyers {
+		switch {
+		case b.Result == nil:
+			pending++
+		case b.Result.Accepted:
+			accepted++
+		default:
+			rejected++
+			for _, e := range b.Result.Errors {
+				reasons[e]++
+			}
+		}
+	}
+	type reason struct {
+		Error  string `json:"error"`
+		Buyers int    `json:"buyers"`
+	}
+	top := make([]reason, 0, len(reasons))
+	for e, n := range reasons {
+		top = append(top, reason{e, n})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Buyers != top[j].Buyers {
+			return top[i].Buyers > top[j].Buyers
+		}
+		return top[i].Error < top[j].Error
+	})
+	if len(top) > 10 {
+		top = top[:10]
+	}
+	summary := map[string]any{"sent": len(canary.state.Buyers), "accepted": accepted, "rejected": rejected, "pending": pending}
+	if accepted+rejected > 0 {
+		summary["compatible_percent"] = float64(accepted*10000/(accepted+rejected)) / 100
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"canary_id":      canary.id,
+		"schema_id":      canary.schemaID,
+		"current_schema": payloadSchemaID(),
+		"percent":        canary.percent,
+		"listed_buyers":  len(canary.listed),
+		"summary":        summary,
+		"top_rejections": top,
+		"buyers":         canary.state.Buyers,
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// codec=cbor (or PAYLOAD_CODEC=cbor) is the compact codec for metered
+// links. Frames are length prefixed as for avro: JSON control frames start
+// with '{', samples are CBOR maps (RFC 8949) with the members of the JSON
+// payload, in the same order. Integers are CBOR integers, other numbers
+// single-precision floats when that is exact and doubles otherwise.
+//
+// sig is the last member. When present it is the ed25519 signature over the
+// encoded map minus its final 70 bytes (the "sig" key, the byte string
+// header and the 64 signature bytes); the JSON payload's signature can't be
+// checked against CBOR.
+
+const codecCBOR = "cbor"
+
+// lengthFramed is true for codecs whose streams are length-prefixed frames.
+func lengthFramed(codec string) bool {
+	return codec == codecAvro || codec == codecCBOR
+}
+
+// cborHandshake is the control frames a cbor stream starts with.
+func cborHandshake() []byte {
+	if license := licenseHandshake(); license != nil {
+		return lengthPrefixed(license[:len(license)-1])
+	}
+	return nil
+}
+
+// cborPayload re-encodes a JSON sample payload as CBOR.
+func cborPayload(payload []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("cbor: payload is not a JSON object")
+	}
+	var body []byte
+	n := 0
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := tok.(string)
+		if key == "sig" {
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		body = appendCBORString(body, key)
+		if body, err = appendCBORValue(body, dec); err != nil {
+			return nil, err
+		}
+		n++
+	}
+
+	if signer == nil {
+		return append(appendCBORHead(make([]byte, 0, len(body)+9), 5, uint64(n)), body...), nil
+	}
+	out := appendCBORHead(make([]byte, 0, len(body)+80), 5, uint64(n+1))
+	out = append(out, body...)
+	sig := ed25519.Sign(signer.key, out)
+	out = appendCBORString(out, "sig")
+	out = appendCBORHead(out, 2, uint64(len(sig)))
+	return append(out, sig...), nil
+}
+
+// appendCBORValue encodes the next JSON value from dec.
+func appendCBORValue(dst []byte, dec *json.Decoder) ([]byte, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		var items []byte
+		n := 0
+		for dec.More() {
+			if t == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				items = appendCBORString(items, key.(string))
+			}
+			if items, err = appendCBORValue(items, dec); err != nil {
+				return nil, err
+			}
+			n++
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		major := byte(4)
+		if t == '{' {
+			major = 5
+		}
+		return append(appendCBORHead(dst, major, uint64(n)), items...), nil
+	case string:
+		return appendCBORString(dst, t), nil
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			if i < 0 {
+				return appendCBORHead(dst, 1, uint64(-1-i)), nil
+			}
+			return appendCBORHead(dst, 0, uint64(i)), nil
+		}
+		f, err := t.Float64()
+		if err != nil {
+			return nil, err
+		}
+		if f32 := float32(f); float64(f32) == f {
+			return binary.BigEndian.AppendUint32(append(dst, 0xfa), math.Float32bits(f32)), nil
+		}
+		return binary.BigEndian.AppendUint64(append(dst, 0xfb), math.Float64bits(f)), nil
+	case bool:
+		if t {
+			return append(dst, 0xf5), nil
+		}
+		return append(dst, 0xf4), nil
+	case nil:
+		return append(dst, 0xf6), nil
+	}
+	return nil, fmt.Errorf("cbor: unexpected token %v", tok)
+}
+
+func appendCBORString(dst []byte, s string) []byte {
+	return append(appendCBORHead(dst, 3, uint64(len(s))), s...)
+}
+
+// appendCBORHead writes a data item head: major type and argument.
+func appendCBORHead(dst []byte, major byte, n uint64) []byte {
+	m := major << 5
+	switch {
+	case n < 24:
+		return append(dst, m|byte(n))
+	case n <= math.MaxUint8:
+		return append(dst, m|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, m|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, m|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, m|27), n)
+}
@@ -0,0 +1,131 @@
+// Command benchcheck reads `go test -bench -benchmem` output on stdin and
+// fails if any benchmark is slower or allocates more than its threshold.
+// With -count > 1 the best run of each benchmark is compared, so one noisy
+// run on a busy device doesn't fail the check. Benchmarks without a
+// threshold are reported but not checked.
+//
+// Thresholds are a JSON object keyed by benchmark name without the -GOMAXPROCS
+// suffix:
+//
+//	{"BenchmarkEncode/json": {"ns_per_op": 8000, "allocs_per_op": 1}}
+//
+// A zero or missing limit is not checked.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type threshold struct {
+	NsPerOp     float64 `json:"ns_per_op"`
+	AllocsPerOp float64 `json:"allocs_per_op"`
+}
+
+type result struct {
+	nsPerOp     float64
+	allocsPerOp float64
+}
+
+var procsSuffix = regexp.MustCompile(`-\d+$`)
+
+func main() {
+	path := flag.String("thresholds", "bench_thresholds.json", "JSON file of per-benchmark limits")
+	flag.Parse()
+	log.SetFlags(0)
+
+	data, err := os.ReadFile(*path)
+	if err != nil {
+		log.Fatalf("benchcheck: %v", err)
+	}
+	var limits map[string]threshold
+	if err := json.Unmarshal(data, &limits); err != nil {
+		log.Fatalf("benchcheck: %s: %v", *path, err)
+	}
+
+	best := map[string]result{}
+	sc := bufio.NewScanner(os.Stdin)
+	for sc.Scan() {
+		name, r, ok := parseLine(sc.Text())
+		if !ok {
+			continue
+		}
+		if prev, seen := best[name]; seen {
+			r.nsPerOp = min(r.nsPerOp, prev.nsPerOp)
+			r.allocsPerOp = min(r.allocsPerOp, prev.allocsPerOp)
+		}
+		best[name] = r
+	}
+	if err := sc.Err(); err != nil {
+		log.Fatalf("benchcheck: %v", err)
+	}
+	if len(best) == 0 {
+		log.Fatalf("benchcheck: no benchmark results on stdin")
+	}
+
+	names := make([]string, 0, len(best))
+	for name := range best {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failed := 0
+	for _, name := range names {
+		r := best[name]
+		lim, ok := limits[name]
+		status := "ok"
+		switch {
+		case !ok:
+			status = "no threshold"
+		case lim.NsPerOp > 0 && r.nsPerOp > lim.NsPerOp:
+			status = fmt.Sprintf("FAIL: %.0f ns/op over %.0f", r.nsPerOp, lim.NsPerOp)
+		case lim.AllocsPerOp > 0 && r.allocsPerOp > lim.AllocsPerOp:
+			status = fmt.Sprintf("FAIL: %.0f allocs/op over %.0f", r.allocsPerOp, lim.AllocsPerOp)
+		}
+		if strings.HasPrefix(status, "FAIL") {
+			failed++
+		}
+		fmt.Printf("%-45s %12.0f ns/op %6.0f allocs/op  %s\n", name, r.nsPerOp, r.allocsPerOp, status)
+	}
+	for name := range limits {
+		if _, ok := best[name]; !ok {
+			fmt.Printf("%-45s missing from results\n", name)
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("benchcheck: %d benchmark(s) over threshold", failed)
+	}
+}
+
+// parseLine picks the name, ns/op and allocs/op out of a benchmark result
+// line.
+func parseLine(line string) (string, result, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+		return "", result{}, false
+	}
+	var r result
+	found := false
+	for i := 2; i+1 < len(fields); i += 2 {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return "", result{}, false
+		}
+		switch fields[i+1] {
+		case "ns/op":
+			r.nsPerOp = v
+			found = true
+		case "allocs/op":
+			r.allocsPerOp = v
+		}
+	}
+	return procsSuffix.ReplaceAllString(fields[0], ""), r, found
+}
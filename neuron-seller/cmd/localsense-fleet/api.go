@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"localsense/neuron-seller/fleet"
+)
+
+type api struct {
+	store      *store
+	hub        *hub
+	adminToken string
+}
+
+func (a *api) routes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/nodes", a.admin(a.listNodes))
+	mux.HandleFunc("GET /api/nodes/{id}", a.admin(a.getNode))
+	mux.HandleFunc("PUT /api/nodes/{id}/wave", a.admin(a.setWave))
+	mux.HandleFunc("POST /api/nodes/{id}/restart", a.admin(a.restartNode))
+	mux.HandleFunc("GET /api/nodes/{id}/agent-token", a.admin(a.agentToken))
+	mux.HandleFunc("GET /api/configs", a.admin(a.listConfigs))
+	mux.HandleFunc("POST /api/configs", a.admin(a.createConfig))
+	mux.HandleFunc("GET /api/rollouts", a.admin(a.listRollouts))
+	mux.HandleFunc("POST /api/rollouts", a.admin(a.createRollout))
+	mux.HandleFunc("POST /api/rollouts/{id}/advance", a.admin(a.advanceRollout))
+	mux.HandleFunc("GET /dashboard", a.admin(a.dashboard))
+}
+
+func (a *api) admin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// An empty token never matches: main refuses to start without one,
+		// and a zero-value api must not fall open.
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || a.adminToken == "" || subtle.ConstantTimeCompare([]byte(got), []byte(a.adminToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, "admin token required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (a *api) listNodes(w http.ResponseWriter, r *http.Request) {
+	nodes := []node{}
+	a.store.view(func(st *fleetState) {
+		for _, n := range st.sortedNodes() {
+			nodes = append(nodes, *n)
+		}
+	})
+	writeJSON(w, http.StatusOK, nodes)
+}
+
+func (a *api) getNode(w http.ResponseWriter, r *http.Request) {
+	var (
+		n  node
+		ok bool
+	)
+	a.store.view(func(st *fleetState) {
+		var p *node
+		if p, ok = st.Nodes[r.PathValue("id")]; ok {
+			n = *p
+		}
+	})
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown node")
+		return
+	}
+	writeJSON(w, http.StatusOK, n)
+}
+
+func (a *api) setWave(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Wave int `json:"wave"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	id := r.PathValue("id")
+	err := a.store.update(func(st *fleetState) error {
+		n, ok := st.Nodes[id]
+		if !ok {
+			return fmt.Errorf("unknown node %s", id)
+		}
+		n.Wave = req.Wave
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "wave": req.Wave})
+}
+
+func (a *api) restartNode(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	cmdID, err := a.hub.send(id, fleet.TypeRestart, nil, 0)
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	log.Printf("[api] restart sent to %s (%s)", id, cmdID)
+	writeJSON(w, http.StatusAccepted, map[string]any{"command_id": cmdID})
+}
+
+// agentToken returns the token a node sets as its FLEET_TOKEN. The node
+// needn't have registered yet.
+func (a *api) agentToken(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "token": a.hub.agentToken(id)})
+}
+
+func (a *api) listConfigs(w http.ResponseWriter, r *http.Request) {
+	var configs []configVersion
+	a.store.view(func(st *fleetState) { configs = append(configs, st.Configs...) })
+	writeJSON(w, http.StatusOK, configs)
+}
+
+func (a *api) createConfig(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Values map[string]string `json:"values"`
+		Note   string            `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Values) == 0 {
+		writeError(w, http.StatusBadRequest, "body must be {\"values\": {...}}")
+		return
+	}
+	cv, err := a.store.addConfig(req.Values, req.Note)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, cv)
+}
+
+func (a *api) listRollouts(w http.ResponseWriter, r *http.Request) {
+	var rollouts []rollout
+	a.store.view(func(st *fleetState) {
+		for _, ro := range st.Rollouts {
+			rollouts = append(rollouts, *ro)
+		}
+	})
+	writeJSON(w, http.StatusOK, rollouts)
+}
+
+// createRollout plans a rollout of a config version across all current
+// waves. Nothing is pushed until the first advance.
+func (a *api) createRollout(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ConfigVersion int `json:"config_version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	var ro *rollout
+	err := a.store.update(func(st *fleetState) error {
+		if _, ok := st.config(req.ConfigVersion); !ok {
+			return fmt.Errorf("unknown config version %d", req.ConfigVersion)
+		}
+		now := time.Now().UTC()
+		ro = &rollout{
+			ID:            len(st.Rollouts) + 1,
+			ConfigVersion: req.ConfigVersion,
+			Waves:         st.waves(),
+			CurrentWave:   -1,
+			Status:        "pending",
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+		st.Rollouts = append(st.Rollouts, ro)
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, ro)
+}
+
+// advanceRollout pushes the rollout's config to the next wave. Operators
+// check the dashboard between waves before advancing again.
+func (a *api) advanceRollout(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid rollout id")
+		return
+	}
+
+	var (
+		cv      configVersion
+		targets []string
+		wave    int
+		snap    rollout
+	)
+	err = a.store.update(func(st *fleetState) error {
+		ro, ok := st.rollout(id)
+		if !ok {
+			return fmt.Errorf("unknown rollout %d", id)
+		}
+		if ro.Status == "done" {
+			return fmt.Errorf("rollout %d already finished", id)
+		}
+		if len(ro.Waves) == 0 {
+			return fmt.Errorf("rollout %d has no waves (no nodes were registered)", id)
+		}
+		ro.CurrentWave++
+		wave = ro.Waves[ro.CurrentWave]
+		cv, _ = st.config(ro.ConfigVersion)
+		for _, n := range st.sortedNodes() {
+			if n.Wave == wave {
+				n.DesiredConfigVersion = cv.Version
+				targets = append(targets, n.ID)
+			}
+		}
+		ro.Status = "running"
+		if ro.CurrentWave == len(ro.Waves)-1 {
+			ro.Status = "done"
+		}
+		ro.UpdatedAt = time.Now().UTC()
+		snap = *ro
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	sent := map[string]string{}
+	for _, nodeID := range targets {
+		cmdID, err := a.hub.send(nodeID, fleet.TypeConfigPush, fleet.ConfigPush{Version: cv.Version, Values: cv.Values}, cv.Version)
+		if err != nil {
+			// Offline nodes pick the desired config up when they reconnect.
+			sent[nodeID] = "deferred: " + err.Error()
+			continue
+		}
+		sent[nodeID] = cmdID
+	}
+	log.Printf("[api] rollout %d wave %d: config v%d to %d nodes", id, wave, cv.Version, len(targets))
+	writeJSON(w, http.StatusOK, map[string]any{"rollout": snap, "wave": wave, "nodes": sent})
+}
+
+var dashboardTmpl = template.Must(template.New("dashboard").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="15">
+<title>LocalSense fleet</title>
+<style>body{font-family:sans-serif}td,th{padding:4px 8px;border-bottom:1px solid #ddd}.bad{color:#b00}.ok{color:#070}</style>
+</head><body>
+<h1>LocalSense fleet ({{len .}} nodes)</h1>
+<table><tr><th>Node</th><th>Label</th><th>Wave</th><th>Online</th><th>Pi</th><th>Config</th><th>Uptime</th><th>Last seen</th></tr>
+{{range .}}<tr>
+<td>{{.ID}}</td><td>{{.Inventory.Label}}</td><td>{{.Wave}}</td>
+<td>{{if .Connected}}<span class="ok">yes</span>{{else}}<span class="bad">no</span>{{end}}</td>
+<td>{{with .LastHealth}}{{if .PiReachable}}<span class="ok">ok</span>{{else}}<span class="bad">{{.PiError}}</span>{{end}}{{else}}-{{end}}</td>
+<td>v{{.AppliedConfigVersion}}{{if ne .AppliedConfigVersion .DesiredConfigVersion}} → v{{.DesiredConfigVersion}}{{end}}</td>
+<td>{{with .LastHealth}}{{.UptimeSeconds}}s{{else}}-{{end}}</td>
+<td>{{.LastSeen.Format "2006-01-02 15:04:05"}}</td>
+</tr>{{end}}
+</table></body></html>`))
+
+func (a *api) dashboard(w http.ResponseWriter, r *http.Request) {
+	var nodes []node
+	a.store.view(func(st *fleetState) {
+		for _, n := range st.sortedNodes() {
+			nodes = append(nodes, *n)
+		}
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTmpl.Execute(w, nodes); err != nil {
+		log.Printf("[dashboard] render error: %v", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[api] encode error: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]any{"error": msg})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"localsense/neuron-seller/fleet"
+)
+
+// hub tracks live agent connections and routes commands to them.
+//
+// Each node authenticates with a token of its own, derived from the
+// controller's FLEET_TOKEN and the node ID (see agentToken); a node can't
+// work out another node's token, so it can't register under another ID or
+// take over another node's session.
+type hub struct {
+	store    *store
+	upgrader websocket.Upgrader
+	token    string
+
+	mu    sync.Mutex
+	conns map[string]*agentConn
+
+	nextCmd atomic.Uint64
+	// pending maps command IDs to the config version they carry (0 for
+	// commands that are not config pushes) so acks can be attributed.
+	pendingMu sync.Mutex
+	pending   map[string]int
+}
+
+type agentConn struct {
+	nodeID  string
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+func newHub(st *store, token string) *hub {
+	return &hub{
+		store:   st,
+		token:   token,
+		conns:   map[string]*agentConn{},
+		pending: map[string]int{},
+	}
+}
+
+// agentToken is the bearer token nodeID authenticates with.
+func (h *hub) agentToken(nodeID string) string {
+	mac := hmac.New(sha256.New, []byte(h.token))
+	mac.Write([]byte("localsense-fleet-agent\x00" + nodeID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *hub) serveAgent(w http.ResponseWriter, r *http.Request) {
+	// The node ID comes with the hello, so the token is checked against it
+	// once that is in; nothing is registered before.
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("[agent] upgrade from %s failed: %v", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+
+	var hello fleet.Envelope
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if err := conn.ReadJSON(&hello); err != nil || hello.Type != fleet.TypeHello {
+		log.Printf("[agent] %s did not send hello: %v", r.RemoteAddr, err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var inv fleet.Inventory
+	if err := json.Unmarshal(hello.Payload, &inv); err != nil || inv.SellerID == "" {
+		log.Printf("[agent] %s sent invalid inventory: %v", r.RemoteAddr, err)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.agentToken(inv.SellerID))) != 1 {
+		log.Printf("[agent] %s: wrong token for node %s", r.RemoteAddr, inv.SellerID)
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "unauthorized"), time.Now().Add(time.Second))
+		return
+	}
+	if err := h.store.registerNode(inv); err != nil {
+		log.Printf("[agent] register %s: %v", inv.SellerID, err)
+		return
+	}
+
+	ac := &agentConn{nodeID: inv.SellerID, conn: conn}
+	h.mu.Lock()
+	// Holding the node's token proves the same identity: this is the node
+	// reconnecting before its old connection timed out.
+	if old, ok := h.conns[ac.nodeID]; ok {
+		old.conn.Close()
+	}
+	h.conns[ac.nodeID] = ac
+	h.mu.Unlock()
+	log.Printf("[agent] node %s connected from %s (config v%d)", ac.nodeID, r.RemoteAddr, inv.ConfigVersion)
+
+	defer func() {
+		h.mu.Lock()
+		if h.conns[ac.nodeID] == ac {
+			delete(h.conns, ac.nodeID)
+			h.store.setConnected(ac.nodeID, false)
+		}
+		h.mu.Unlock()
+		log.Printf("[agent] node %s disconnected", ac.nodeID)
+	}()
+
+	h.syncDesiredConfig(ac.nodeID)
+
+	for {
+		var env fleet.Envelope
+		if err := conn.ReadJSON(&env); err != nil {
+			return
+		}
+		h.handleAgentFrame(ac.nodeID, env)
+	}
+}
+
+func (h *hub) handleAgentFrame(nodeID string, env fleet.Envelope) {
+	switch env.Type {
+	case fleet.TypeHealth:
+		var health fleet.Health
+		if err := json.Unmarshal(env.Payload, &health); err != nil {
+			log.Printf("[agent] %s: bad health payload: %v", nodeID, err)
+			return
+		}
+		if err := h.store.recordHealth(nodeID, health); err != nil {
+			log.Printf("[agent] %s: %v", nodeID, err)
+		}
+
+	case fleet.TypeAck:
+		var ack fleet.Ack
+		if err := json.Unmarshal(env.Payload, &ack); err != nil {
+			log.Printf("[agent] %s: bad ack payload: %v", nodeID, err)
+			return
+		}
+		h.pendingMu.Lock()
+		version := h.pending[env.ID]
+		delete(h.pending, env.ID)
+		h.pendingMu.Unlock()
+		if err := h.store.recordAck(nodeID, version, ack); err != nil {
+			log.Printf("[agent] %s: %v", nodeID, err)
+		}
+		log.Printf("[agent] %s acked %s ok=%t err=%q", nodeID, env.ID, ack.OK, ack.Error)
+
+	default:
+		log.Printf("[agent] %s: ignoring frame type %q", nodeID, env.Type)
+	}
+}
+
+// send delivers a command to a connected node and returns its command ID.
+func (h *hub) send(nodeID, msgType string, payload any, configVersion int) (string, error) {
+	h.mu.Lock()
+	ac, ok := h.conns[nodeID]
+	h.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("node %s is not connected", nodeID)
+	}
+
+	id := fmt.Sprintf("cmd-%d", h.nextCmd.Add(1))
+	env, err := fleet.NewEnvelope(msgType, nodeID, id, payload)
+	if err != nil {
+		return "", err
+	}
+
+	h.pendingMu.Lock()
+	h.pending[id] = configVersion
+	h.pendingMu.Unlock()
+
+	ac.writeMu.Lock()
+	defer ac.writeMu.Unlock()
+	ac.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := ac.conn.WriteJSON(env); err != nil {
+		return "", fmt.Errorf("write to %s: %w", nodeID, err)
+	}
+	return id, nil
+}
+
+// syncDesiredConfig pushes the desired config to a node that is behind, e.g.
+// because it was offline while its rollout wave ran.
+func (h *hub) syncDesiredConfig(nodeID string) {
+	var (
+		cv   configVersion
+		push bool
+	)
+	h.store.view(func(st *fleetState) {
+		n, ok := st.Nodes[nodeID]
+		if !ok || n.DesiredConfigVersion == 0 || n.DesiredConfigVersion == n.AppliedConfigVersion {
+			return
+		}
+		cv, push = st.config(n.DesiredConfigVersion)
+	})
+	if !push {
+		return
+	}
+	if _, err := h.send(nodeID, fleet.TypeConfigPush, fleet.ConfigPush{Version: cv.Version, Values: cv.Values}, cv.Version); err != nil {
+		log.Printf("[agent] resync %s to config v%d: %v", nodeID, cv.Version, err)
+	}
+}
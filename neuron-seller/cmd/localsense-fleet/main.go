@@ -0,0 +1,55 @@
+// Command localsense-fleet is the fleet controller: seller nodes running the
+// fleet agent dial in on /agent, and operators manage registered nodes,
+// desired-config versions and rollout waves through the /api routes.
+//
+// The /api routes and the dashboard need FLEET_ADMIN_TOKEN as a bearer
+// token. FLEET_TOKEN is the secret every node's agent token is derived
+// from: each node sets FLEET_TOKEN to its own token, which
+// GET /api/nodes/{id}/agent-token returns. The controller refuses to start
+// without either.
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+)
+
+func getEnvOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func main() {
+	addr := getEnvOrDefault("FLEET_LISTEN_ADDR", ":9100")
+	dbPath := getEnvOrDefault("FLEET_DB_PATH", "fleet-state.json")
+	adminToken := os.Getenv("FLEET_ADMIN_TOKEN")
+	if adminToken == "" {
+		log.Fatalf("FLEET_ADMIN_TOKEN is not set; refusing to serve the admin API without it")
+	}
+	agentSecret := os.Getenv("FLEET_TOKEN")
+	if agentSecret == "" {
+		log.Fatalf("FLEET_TOKEN is not set; refusing to accept agents without it")
+	}
+
+	st, err := openStore(dbPath)
+	if err != nil {
+		log.Fatalf("open store: %v", err)
+	}
+
+	h := newHub(st, agentSecret)
+	a := &api{store: st, hub: h, adminToken: adminToken}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/agent", h.serveAgent)
+	a.routes(mux)
+
+	log.Printf("=== LocalSense Fleet Controller ===")
+	log.Printf("State file : %s", dbPath)
+	log.Printf("Listening  : %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("ListenAndServe: %v", err)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"localsense/neuron-seller/fleet"
+)
+
+const healthHistoryLimit = 120
+
+type node struct {
+	ID                   string          `json:"id"`
+	Inventory            fleet.Inventory `json:"inventory"`
+	Wave                 int             `json:"wave"`
+	Connected            bool            `json:"connected"`
+	FirstSeen            time.Time       `json:"first_seen"`
+	LastSeen             time.Time       `json:"last_seen"`
+	LastHealth           *fleet.Health   `json:"last_health,omitempty"`
+	HealthHistory        []healthPoint   `json:"health_history,omitempty"`
+	DesiredConfigVersion int             `json:"desired_config_version"`
+	AppliedConfigVersion int             `json:"applied_config_version"`
+	LastAck              *fleet.Ack      `json:"last_ack,omitempty"`
+}
+
+type healthPoint struct {
+	Time        time.Time `json:"time"`
+	PiReachable bool      `json:"pi_reachable"`
+	HeapBytes   uint64    `json:"heap_bytes"`
+}
+
+type configVersion struct {
+	Version   int               `json:"version"`
+	Values    map[string]string `json:"values"`
+	Note      string            `json:"note,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+type rollout struct {
+	ID            int       `json:"id"`
+	ConfigVersion int       `json:"config_version"`
+	Waves         []int     `json:"waves"`
+	CurrentWave   int       `json:"current_wave"` // index into Waves, -1 before the first push
+	Status        string    `json:"status"`       // pending, running, done
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+type fleetState struct {
+	Nodes    map[string]*node `json:"nodes"`
+	Configs  []configVersion  `json:"configs"`
+	Rollouts []*rollout       `json:"rollouts"`
+}
+
+// store keeps the controller state in memory and snapshots it to a JSON file
+// after every mutation. A fleet of a few hundred Pis fits comfortably.
+type store struct {
+	mu    sync.RWMutex
+	path  string
+	state fleetState
+}
+
+func openStore(path string) (*store, error) {
+	s := &store{
+		path:  path,
+		state: fleetState{Nodes: map[string]*node{}},
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	if s.state.Nodes == nil {
+		s.state.Nodes = map[string]*node{}
+	}
+	// Nobody is connected right after a controller restart.
+	for _, n := range s.state.Nodes {
+		n.Connected = false
+	}
+	return s, nil
+}
+
+// saveLocked must be called with s.mu held.
+func (s *store) saveLocked() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *store) update(fn func(st *fleetState) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := fn(&s.state); err != nil {
+		return err
+	}
+	return s.saveLocked()
+}
+
+func (s *store) view(fn func(st *fleetState)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fn(&s.state)
+}
+
+func (s *store) registerNode(inv fleet.Inventory) error {
+	return s.update(func(st *fleetState) error {
+		now := time.Now().UTC()
+		n, ok := st.Nodes[inv.SellerID]
+		if !ok {
+			n = &node{ID: inv.SellerID, FirstSeen: now}
+			st.Nodes[inv.SellerID] = n
+		}
+		n.Inventory = inv
+		n.Connected = true
+		n.LastSeen = now
+		n.AppliedConfigVersion = inv.ConfigVersion
+		return nil
+	})
+}
+
+func (s *store) recordHealth(id string, h fleet.Health) error {
+	return s.update(func(st *fleetState) error {
+		n, ok := st.Nodes[id]
+		if !ok {
+			return fmt.Errorf("unknown node %s", id)
+		}
+		now := time.Now().UTC()
+		n.LastSeen = now
+		n.LastHealth = &h
+		n.HealthHistory = append(n.HealthHistory, healthPoint{Time: now, PiReachable: h.PiReachable, HeapBytes: h.HeapBytes})
+		if len(n.HealthHistory) > healthHistoryLimit {
+			n.HealthHistory = n.HealthHistory[len(n.HealthHistory)-healthHistoryLimit:]
+		}
+		return nil
+	})
+}
+
+func (s *store) setConnected(id string, connected bool) {
+	_ = s.update(func(st *fleetState) error {
+		if n, ok := st.Nodes[id]; ok {
+			n.Connected = connected
+		}
+		return nil
+	})
+}
+
+func (s *store) recordAck(id string, configVersion int, ack fleet.Ack) error {
+	return s.update(func(st *fleetState) error {
+		n, ok := st.Nodes[id]
+		if !ok {
+			return fmt.Errorf("unknown node %s", id)
+		}
+		n.LastAck = &ack
+		if ack.OK && configVersion > 0 {
+			n.AppliedConfigVersion = configVersion
+		}
+		return nil
+	})
+}
+
+func (s *store) addConfig(values map[string]string, note string) (configVersion, error) {
+	var cv configVersion
+	err := s.update(func(st *fleetState) error {
+		next := 1
+		if n := len(st.Configs); n > 0 {
+			next = st.Configs[n-1].Version + 1
+		}
+		cv = configVersion{Version: next, Values: values, Note: note, CreatedAt: time.Now().UTC()}
+		st.Configs = append(st.Configs, cv)
+		return nil
+	})
+	return cv, err
+}
+
+func (st *fleetState) config(version int) (configVersion, bool) {
+	for _, cv := range st.Configs {
+		if cv.Version == version {
+			return cv, true
+		}
+	}
+	return configVersion{}, false
+}
+
+func (st *fleetState) rollout(id int) (*rollout, bool) {
+	for _, r := range st.Rollouts {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// waves returns the distinct wave numbers of all registered nodes, ascending.
+func (st *fleetState) waves() []int {
+	seen := map[int]bool{}
+	var out []int
+	for _, n := range st.Nodes {
+		if !seen[n.Wave] {
+			seen[n.Wave] = true
+			out = append(out, n.Wave)
+		}
+	}
+	sort.Ints(out)
+	return out
+}
+
+func (st *fleetState) sortedNodes() []*node {
+	out := make([]*node, 0, len(st.Nodes))
+	for _, n := range st.Nodes {
+		out = append(out, n)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"localsense/neuron-seller/relay"
+)
+
+// aggregator folds every seller's samples into per-kind statistics over
+// grid cells of RELAY_AGGREGATE_GRID_DEG degrees and windows of
+// RELAY_AGGREGATE_WINDOW_SECONDS. When a window closes, only cells at
+// least RELAY_AGGREGATE_K distinct sellers contributed to go out on
+// relay.StatsProtocol; sparser cells are withheld, so no published figure
+// can be pinned on fewer than K sellers. Sellers are counted by ingest
+// peer, not by the seller ID they claim, and aggregator mode needs
+// RELAY_ALLOWED_SELLERS: one party running K-1 peers in a cell could
+// otherwise get it published and subtract its own readings.
+type aggregator struct {
+	grid   float64
+	window time.Duration
+	k      int
+
+	mu       sync.Mutex
+	start    time.Time
+	cells    map[cellKey]*cellStats
+	subs     map[chan []byte]bool
+	withheld int64
+}
+
+type cellKey struct {
+	kind     string
+	lat, lon int64 // grid indexes
+}
+
+type cellStats struct {
+	sellers       map[peer.ID]int // ingest peer -> samples
+	count         int
+	min, max, sum float64
+}
+
+func newAggregator(grid float64, window time.Duration, k int) *aggregator {
+	return &aggregator{
+		grid:   grid,
+		window: window,
+		k:      k,
+		start:  time.Now().Truncate(window),
+		cells:  map[cellKey]*cellStats{},
+		subs:   map[chan []byte]bool{},
+	}
+}
+
+// add counts one sample line from the ingest peer from; anything without a
+// kind, a location and a finite value is ignored.
+func (a *aggregator) add(from peer.ID, line []byte) {
+	var smp struct {
+		Kind  string   `json:"kind"`
+		Lat   *float64 `json:"lat"`
+		Lon   *float64 `json:"lon"`
+		Value *float64 `json:"value"`
+	}
+	if err := json.Unmarshal(line, &smp); err != nil || smp.Kind == "" || smp.Lat == nil || smp.Lon == nil || smp.Value == nil {
+		return
+	}
+	v := *smp.Value
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+	key := cellKey{
+		kind: smp.Kind,
+		lat:  int64(math.Floor(*smp.Lat / a.grid)),
+		lon:  int64(math.Floor(*smp.Lon / a.grid)),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.cells[key]
+	if !ok {
+		c = &cellStats{sellers: map[peer.ID]int{}, min: v, max: v}
+		a.cells[key] = c
+	}
+	c.sellers[from]++
+	c.count++
+	c.min, c.max = min(c.min, v), max(c.max, v)
+	c.sum += v
+}
+
+// run closes a window every a.window.
+func (a *aggregator) run() {
+	t := time.NewTicker(a.window)
+	defer t.Stop()
+	for now := range t.C {
+		a.flush(now)
+	}
+}
+
+// flush publishes the cells of the window that just closed and starts the
+// next one.
+func (a *aggregator) flush(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	start, end := a.start, now.Truncate(a.window)
+	if !end.After(start) {
+		end = now
+	}
+	cells := a.cells
+	a.cells = map[cellKey]*cellStats{}
+	a.start = end
+
+	published, withheld := 0, 0
+	for key, c := range cells {
+		if len(c.sellers) < a.k {
+			withheld++
+			continue
+		}
+		frame, err := json.Marshal(relay.RegionStats{
+			Type:        relay.TypeRegionStats,
+			Kind:        key.kind,
+			Lat:         float64(key.lat) * a.grid,
+			Lon:         float64(key.lon) * a.grid,
+			GridDeg:     a.grid,
+			WindowStart: start.Unix(),
+			WindowEnd:   end.Unix(),
+			Sellers:     len(c.sellers),
+			Count:       c.count,
+			Min:         c.min,
+			Max:         c.max,
+			Mean:        c.sum / float64(c.count),
+		})
+		if err != nil {
+			continue
+		}
+		published++
+		frame = append(frame, '\n')
+		for out := range a.subs {
+			select {
+			case out <- frame:
+			default:
+				log.Printf("[stats] subscriber too slow, disconnecting")
+				delete(a.subs, out)
+				close(out)
+			}
+		}
+	}
+	a.withheld += int64(withheld)
+	if published > 0 || withheld > 0 {
+		log.Printf("[stats] window %s: %d cell(s) published, %d withheld with fewer than %d sellers (%d since start)",
+			start.UTC().Format(time.RFC3339), published, withheld, a.k, a.withheld)
+	}
+}
+
+// handleStats streams RegionStats lines to anyone who asks.
+func (a *aggregator) handleStats(s network.Stream) {
+	defer s.Close()
+	out := make(chan []byte, 256)
+	a.mu.Lock()
+	a.subs[out] = true
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		if a.subs[out] {
+			delete(a.subs, out)
+			close(out)
+		}
+		a.mu.Unlock()
+	}()
+
+	for frame := range out {
+		s.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := s.Write(frame); err != nil {
+			log.Printf("[stats] write to %s: %v", s.Conn().RemotePeer(), err)
+			return
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"localsense/neuron-seller/buyerclient"
+	"localsense/neuron-seller/relay"
+)
+
+// hub fans ingest streams out to subscribers.
+type hub struct {
+	rep     *buyerclient.Republisher
+	allowed map[peer.ID]bool
+	pins    *pinStore
+	agg     *aggregator // nil unless in aggregator mode
+
+	mu    sync.Mutex
+	feeds map[string]*feed
+}
+
+// feed is one seller's stream. It outlives the ingest connection so
+// subscribers survive a seller reconnect.
+type feed struct {
+	sellerID string
+	peer     peer.ID // ingest peer; empty while the seller is offline
+	pubKey   ed25519.PublicKey
+	license  []byte
+	buyers   map[peer.ID]bool
+	subs     map[*subscriber]bool
+}
+
+type subscriber struct {
+	peer  peer.ID
+	kinds map[string]bool
+	out   chan []byte
+}
+
+func newHub(rep *buyerclient.Republisher, pins *pinStore, allowed []string) *hub {
+	h := &hub{rep: rep, pins: pins, allowed: map[peer.ID]bool{}, feeds: map[string]*feed{}}
+	for _, a := range allowed {
+		id, err := peer.Decode(a)
+		if err != nil {
+			log.Fatalf("RELAY_ALLOWED_SELLERS: %q: %v", a, err)
+		}
+		h.allowed[id] = true
+	}
+	return h
+}
+
+func (h *hub) handleIngest(s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+	if len(h.allowed) > 0 && !h.allowed[remote] {
+		log.Printf("[ingest] rejecting %s: not in RELAY_ALLOWED_SELLERS", remote)
+		s.Reset()
+		return
+	}
+
+	var hello relay.IngestHello
+	r, err := relay.ReadHello(s, &hello)
+	if err != nil || hello.Type != relay.TypeIngestHello || hello.SellerID == "" {
+		log.Printf("[ingest] %s sent no valid hello: %v", remote, err)
+		s.Reset()
+		return
+	}
+
+	var pub ed25519.PublicKey
+	if key, err := hex.DecodeString(hello.SigningPubKey); err == nil && len(key) == ed25519.PublicKeySize {
+		pub = key
+	}
+	if err := h.pins.check(hello.SellerID, remote, pub); err != nil {
+		log.Printf("[ingest] rejecting %s: %v", remote, err)
+		s.Reset()
+		return
+	}
+
+	f, ok := h.attach(hello.SellerID, remote, pub)
+	if !ok {
+		log.Printf("[ingest] %s claims seller %s already held by another peer", remote, hello.SellerID)
+		s.Reset()
+		return
+	}
+	log.Printf("[ingest] seller %s connected from %s (kinds %v)", hello.SellerID, remote, hello.Kinds)
+	defer h.detach(f, remote)
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := append([]byte(nil), sc.Bytes()...)
+		if len(line) > 0 {
+			h.ingest(f, line)
+		}
+	}
+	log.Printf("[ingest] seller %s disconnected: %v", hello.SellerID, sc.Err())
+}
+
+// attach binds a seller ID to its pinned ingest peer, which keeps it while
+// connected.
+func (h *hub) attach(sellerID string, remote peer.ID, pub ed25519.PublicKey) (*feed, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, ok := h.feeds[sellerID]
+	if !ok {
+		f = &feed{sellerID: sellerID, buyers: map[peer.ID]bool{}, subs: map[*subscriber]bool{}}
+		h.feeds[sellerID] = f
+	}
+	if f.peer != "" && f.peer != remote {
+		return nil, false
+	}
+	f.peer = remote
+	f.pubKey = pub
+	return f, true
+}
+
+func (h *hub) detach(f *feed, remote peer.ID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if f.peer == remote {
+		f.peer = ""
+	}
+}
+
+func (h *hub) ingest(f *feed, line []byte) {
+	var head struct {
+		Type     string   `json:"type"`
+		SellerID string   `json:"seller_id"`
+		Kind     string   `json:"kind"`
+		Peers    []string `json:"peers"`
+	}
+	if err := json.Unmarshal(line, &head); err != nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch head.Type {
+	case relay.TypeBuyers:
+		f.buyers = make(map[peer.ID]bool, len(head.Peers))
+		for _, p := range head.Peers {
+			if id, err := peer.Decode(p); err == nil {
+				f.buyers[id] = true
+			}
+		}
+		for sub := range f.subs {
+			if !f.buyers[sub.peer] {
+				log.Printf("[subscribe] %s no longer a buyer of %s", sub.peer, f.sellerID)
+				h.dropLocked(f, sub)
+			}
+		}
+		return
+	case "license":
+		f.license = append(line, '\n')
+		h.fanOutLocked(f, "", f.license)
+		return
+	case "":
+	default:
+		return
+	}
+
+	if head.SellerID != f.sellerID {
+		log.Printf("[ingest] dropping sample for %s on %s's stream", head.SellerID, f.sellerID)
+		return
+	}
+	if f.pubKey != nil {
+		if err := buyerclient.VerifySeller(line, f.pubKey); err != nil {
+			log.Printf("[ingest] dropping sample from %s: %v", f.sellerID, err)
+			return
+		}
+	}
+	if h.agg != nil {
+		h.agg.add(f.peer, line)
+	}
+	wrapped, err := h.rep.Wrap(line)
+	if err != nil {
+		log.Printf("[ingest] wrap sample from %s: %v", f.sellerID, err)
+		return
+	}
+	h.fanOutLocked(f, head.Kind, wrapped)
+}
+
+// fanOutLocked queues a frame for subscribers of kind ("" for all). A
+// subscriber too slow to drain its queue is disconnected.
+func (h *hub) fanOutLocked(f *feed, kind string, frame []byte) {
+	for sub := range f.subs {
+		if kind != "" && len(sub.kinds) > 0 && !sub.kinds[kind] {
+			continue
+		}
+		select {
+		case sub.out <- frame:
+		default:
+			log.Printf("[subscribe] %s too slow for %s, disconnecting", sub.peer, f.sellerID)
+			h.dropLocked(f, sub)
+		}
+	}
+}
+
+func (h *hub) dropLocked(f *feed, sub *subscriber) {
+	if f.subs[sub] {
+		delete(f.subs, sub)
+		close(sub.out)
+	}
+}
+
+func (h *hub) handleSubscribe(s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+
+	var hello relay.SubscribeHello
+	if _, err := relay.ReadHello(s, &hello); err != nil {
+		s.Reset()
+		return
+	}
+
+	sub := &subscriber{peer: remote, kinds: map[string]bool{}, out: make(chan []byte, 64)}
+	for _, k := range hello.Kinds {
+		sub.kinds[k] = true
+	}
+
+	h.mu.Lock()
+	f, ok := h.feeds[hello.SellerID]
+	authorised := ok && f.buyers[remote]
+	var license []byte
+	if authorised {
+		f.subs[sub] = true
+		license = f.license
+	}
+	h.mu.Unlock()
+
+	if !authorised {
+		log.Printf("[subscribe] refusing %s for %s: not a buyer", remote, hello.SellerID)
+		relay.WriteFrame(s, relay.SubscribeReply{Error: "not an authorised buyer of " + hello.SellerID})
+		return
+	}
+	log.Printf("[subscribe] %s subscribed to %s", remote, hello.SellerID)
+	defer func() {
+		h.mu.Lock()
+		h.dropLocked(f, sub)
+		h.mu.Unlock()
+	}()
+
+	if err := relay.WriteFrame(s, relay.SubscribeReply{OK: true}); err != nil {
+		return
+	}
+	if license != nil {
+		if _, err := s.Write(license); err != nil {
+			return
+		}
+	}
+	for frame := range sub.out {
+		s.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := s.Write(frame); err != nil {
+			log.Printf("[subscribe] write to %s: %v", remote, err)
+			return
+		}
+	}
+}
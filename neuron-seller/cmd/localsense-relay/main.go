@@ -0,0 +1,143 @@
+// Command localsense-relay is a well-connected libp2p node that relays
+// seller streams to buyers that can't reach the seller directly. Sellers dial
+// in on relay.IngestProtocol (RELAY_ADDRS on the seller) and buyers the
+// seller has authorised subscribe on relay.SubscribeProtocol. Each seller ID
+// is pinned to the peer and signing key it first came in with (pins.go);
+// RELAY_ALLOWED_SELLERS narrows who may come in at all.
+//
+// With RELAY_AGGREGATE_K set the relay is also an aggregator: it publishes
+// k-anonymous regional statistics over the samples it relays on
+// relay.StatsProtocol (see aggregate.go).
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"localsense/neuron-seller/buyerclient"
+	"localsense/neuron-seller/relay"
+)
+
+func getEnvOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// loadKey reads the relay's ed25519 seed, generating one on first start. The
+// same key is the libp2p identity and signs the relay hop.
+func loadKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return priv, os.WriteFile(path, []byte(hex.EncodeToString(priv.Seed())+"\n"), 0o600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s must hold a hex ed25519 seed", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func main() {
+	keyPath := getEnvOrDefault("RELAY_KEY_FILE", "relay.key")
+	listen := splitList(getEnvOrDefault("RELAY_LISTEN_ADDRS",
+		"/ip4/0.0.0.0/tcp/4010,/ip4/0.0.0.0/udp/4010/quic-v1,/ip6/::/tcp/4010,/ip6/::/udp/4010/quic-v1"))
+
+	key, err := loadKey(keyPath)
+	if err != nil {
+		log.Fatalf("relay key: %v", err)
+	}
+	p2pKey, err := crypto.UnmarshalEd25519PrivateKey(key)
+	if err != nil {
+		log.Fatalf("relay key: %v", err)
+	}
+	h, err := libp2p.New(libp2p.Identity(p2pKey), libp2p.ListenAddrStrings(listen...))
+	if err != nil {
+		log.Fatalf("start libp2p host: %v", err)
+	}
+	defer h.Close()
+
+	pins, err := openPinStore(getEnvOrDefault("RELAY_PINS_FILE", "relay-pins.json"))
+	if err != nil {
+		log.Fatalf("relay pins: %v", err)
+	}
+	hb := newHub(&buyerclient.Republisher{
+		NodeID:    h.ID().String(),
+		Key:       key,
+		Role:      "relay",
+		Watermark: os.Getenv("RELAY_WATERMARK"),
+		// Buyers judge unsigned sellers themselves; the relay only
+		// refuses samples whose signature is present and wrong.
+		AllowUnsigned: true,
+	}, pins, splitList(os.Getenv("RELAY_ALLOWED_SELLERS")))
+	h.SetStreamHandler(relay.IngestProtocol, hb.handleIngest)
+	h.SetStreamHandler(relay.SubscribeProtocol, hb.handleSubscribe)
+	if v := os.Getenv("RELAY_AGGREGATE_K"); v != "" {
+		k, err := strconv.Atoi(v)
+		if err != nil || k < 2 {
+			log.Fatalf("RELAY_AGGREGATE_K must be a number of sellers, 2 or more")
+		}
+		if len(hb.allowed) == 0 {
+			log.Fatalf("RELAY_AGGREGATE_K needs RELAY_ALLOWED_SELLERS, so the K sellers are known peers")
+		}
+		grid, err := strconv.ParseFloat(getEnvOrDefault("RELAY_AGGREGATE_GRID_DEG", "0.1"), 64)
+		if err != nil || grid <= 0 || grid > 90 {
+			log.Fatalf("RELAY_AGGREGATE_GRID_DEG must be between 0 and 90")
+		}
+		secs, err := strconv.Atoi(getEnvOrDefault("RELAY_AGGREGATE_WINDOW_SECONDS", "300"))
+		if err != nil || secs <= 0 {
+			log.Fatalf("RELAY_AGGREGATE_WINDOW_SECONDS must be a positive number")
+		}
+		hb.agg = newAggregator(grid, time.Duration(secs)*time.Second, k)
+		h.SetStreamHandler(relay.StatsProtocol, hb.agg.handleStats)
+		go hb.agg.run()
+	}
+
+	log.Printf("=== LocalSense Relay ===")
+	log.Printf("Peer ID    : %s", h.ID())
+	log.Printf("Listening  : %s", strings.Join(listen, ", "))
+	log.Printf("Pins       : %d seller(s) in %s", len(pins.pins), pins.path)
+	if len(hb.allowed) > 0 {
+		log.Printf("Sellers    : %d allowed peer(s)", len(hb.allowed))
+	}
+	if hb.agg != nil {
+		log.Printf("Aggregate  : %g° cells, %s windows, k=%d", hb.agg.grid, hb.agg.window, hb.agg.k)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	log.Printf("shutting down")
+}
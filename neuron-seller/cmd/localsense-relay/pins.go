@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// pinStore binds each seller ID to the ingest peer and signing key it was
+// first seen with, kept in RELAY_PINS_FILE across restarts. A later hello
+// for that seller ID from another peer, or with another key, is refused:
+// otherwise anyone could claim an offline seller's ID, have its samples
+// checked against their own key and name its buyers. Moving a seller to a
+// new peer or key means deleting its entry.
+type pinStore struct {
+	path string
+
+	mu   sync.Mutex
+	pins map[string]sellerPin
+}
+
+type sellerPin struct {
+	Peer          string    `json:"peer"`
+	SigningPubKey string    `json:"signing_pub_key,omitempty"`
+	FirstSeen     time.Time `json:"first_seen"`
+}
+
+func openPinStore(path string) (*pinStore, error) {
+	p := &pinStore{path: path, pins: map[string]sellerPin{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &p.pins); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+// check pins sellerID to remote and pub on first sight, and otherwise
+// reports whether they match the pin.
+func (p *pinStore) check(sellerID string, remote peer.ID, pub ed25519.PublicKey) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := hex.EncodeToString(pub)
+	pin, ok := p.pins[sellerID]
+	if !ok {
+		p.pins[sellerID] = sellerPin{Peer: remote.String(), SigningPubKey: key, FirstSeen: time.Now().UTC()}
+		return p.saveLocked()
+	}
+	if pin.Peer != remote.String() {
+		return fmt.Errorf("seller %s is pinned to peer %s", sellerID, pin.Peer)
+	}
+	want, _ := hex.DecodeString(pin.SigningPubKey)
+	if !bytes.Equal(want, pub) {
+		return fmt.Errorf("seller %s is pinned to another signing key", sellerID)
+	}
+	return nil
+}
+
+func (p *pinStore) saveLocked() error {
+	data, err := json.MarshalIndent(p.pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(p.path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(p.path+".tmp", p.path)
+}
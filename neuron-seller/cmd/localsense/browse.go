@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// browse lists the sellers the Neuron explorer knows (or the stdout topics
+// given with -topics), with what their latest localsenseRegistration and
+// localsenseHealth messages on the mirror node say: location, kinds,
+// price and health score. Sellers that never published a registration are
+// not localsense sellers and are left out.
+//
+// -buy adds a seller's key to list_of_sellers in the env file, which is how
+// a Neuron buyer picks whom to send its service request to on its next
+// start.
+
+type listing struct {
+	SellerID   string         `json:"seller_id"`
+	Label      string         `json:"label"`
+	Lat        float64        `json:"lat"`
+	Lon        float64        `json:"lon"`
+	Kinds      []string       `json:"kinds"`
+	Price      map[string]any `json:"price,omitempty"`
+	Health     *int           `json:"health_score,omitempty"`
+	Grade      string         `json:"health_grade,omitempty"`
+	PublicKey  string         `json:"public_key,omitempty"`
+	StdOut     string         `json:"stdout_topic"`
+	Registered time.Time      `json:"registered"`
+	DistanceKM *float64       `json:"distance_km,omitempty"`
+}
+
+func runBrowse(args []string) error {
+	fs := flag.NewFlagSet("browse", flag.ExitOnError)
+	envFile := fs.String("env", ".env", "Neuron env file of the buyer")
+	topics := fs.String("topics", "", "comma-separated seller stdout topics, instead of asking the explorer")
+	kind := fs.String("kind", "", "only sellers offering this kind")
+	near := fs.String("near", "", "lat,lon to sort sellers by distance from")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	buy := fs.String("buy", "", "seller ID or public key to add to list_of_sellers")
+	fs.Parse(args)
+
+	if err := loadEnv(*envFile); err != nil {
+		return err
+	}
+	mirror := getEnvOrDefault("mirror_api_url", "https://testnet.mirrornode.hedera.com/api/v1")
+
+	list := splitList(*topics)
+	if len(list) == 0 {
+		explorer := os.Getenv("neuron_explorer_url")
+		if explorer == "" {
+			return errors.New("set neuron_explorer_url or pass -topics")
+		}
+		var err error
+		if list, err = explorerTopics(explorer); err != nil {
+			return fmt.Errorf("explorer: %w", err)
+		}
+	}
+
+	sellers := lookupSellers(mirror, list)
+	if *kind != "" {
+		sellers = slices.DeleteFunc(sellers, func(l listing) bool { return !slices.Contains(l.Kinds, *kind) })
+	}
+	sort.Slice(sellers, func(i, j int) bool { return sellers[i].SellerID < sellers[j].SellerID })
+	if *near != "" {
+		lat, lon, err := parseLatLon(*near)
+		if err != nil {
+			return err
+		}
+		for i := range sellers {
+			d := haversineKM(lat, lon, sellers[i].Lat, sellers[i].Lon)
+			sellers[i].DistanceKM = &d
+		}
+		sort.SliceStable(sellers, func(i, j int) bool { return *sellers[i].DistanceKM < *sellers[j].DistanceKM })
+	}
+
+	if *buy != "" {
+		return addSeller(*envFile, sellers, *buy)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(sellers)
+	}
+	printListings(sellers)
+	return nil
+}
+
+// explorerTopics asks the Neuron explorer for its devices and returns their
+// stdout topics.
+func explorerTopics(explorer string) ([]string, error) {
+	var body any
+	if err := getJSON(explorer, &body); err != nil {
+		return nil, err
+	}
+	// The explorer answers with a list of devices, bare or under a key.
+	devices, _ := body.([]any)
+	if obj, ok := body.(map[string]any); ok {
+		for _, key := range []string{"devices", "data", "items"} {
+			if list, ok := obj[key].([]any); ok {
+				devices = list
+				break
+			}
+		}
+	}
+	var topics []string
+	for _, d := range devices {
+		dev, _ := d.(map[string]any)
+		for _, key := range []string{"stdOut", "stdout", "stdOutTopic", "stdout_topic", "topic_stdout"} {
+			if v, ok := dev[key]; ok {
+				if topic := fmt.Sprint(v); topic != "" {
+					topics = append(topics, topic)
+				}
+				break
+			}
+		}
+	}
+	if len(topics) == 0 {
+		return nil, errors.New("no devices with a stdout topic")
+	}
+	return topics, nil
+}
+
+// lookupSellers reads the latest registration and health report from each
+// topic, a few topics at a time.
+func lookupSellers(mirror string, topics []string) []listing {
+	var (
+		mu  sync.Mutex
+		out []listing
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, 8)
+	)
+	for _, topic := range topics {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			l, err := lookupSeller(mirror, topic)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "localsense browse: %s: %v\n", topic, err)
+				return
+			}
+			if l != nil {
+				mu.Lock()
+				out = append(out, *l)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return out
+}
+
+func lookupSeller(mirror, topic string) (*listing, error) {
+	var (
+		reg struct {
+			Device struct {
+				SellerID string  `json:"seller_id"`
+				Label    string  `json:"label"`
+				Lat      float64 `json:"lat"`
+				Lon      float64 `json:"lon"`
+				Kinds    []struct {
+					Name string `json:"name"`
+				} `json:"kinds"`
+			} `json:"device"`
+			Time      time.Time      `json:"time"`
+			PublicKey string         `json:"public_key"`
+			Price     map[string]any `json:"price"`
+		}
+		health struct {
+			Score int    `json:"score"`
+			Grade string `json:"grade"`
+		}
+		haveReg, haveHealth bool
+	)
+	err := scanTopic(mirror, topic, 5, func(msg []byte) bool {
+		switch messageType(msg) {
+		case "localsenseRegistration":
+			haveReg = haveReg || json.Unmarshal(msg, &reg) == nil
+		case "localsenseHealth":
+			haveHealth = haveHealth || json.Unmarshal(msg, &health) == nil
+		}
+		return !haveReg || !haveHealth
+	})
+	if err != nil || !haveReg {
+		return nil, err
+	}
+	l := &listing{
+		SellerID:   reg.Device.SellerID,
+		Label:      reg.Device.Label,
+		Lat:        reg.Device.Lat,
+		Lon:        reg.Device.Lon,
+		Price:      reg.Price,
+		PublicKey:  reg.PublicKey,
+		StdOut:     topic,
+		Registered: reg.Time,
+	}
+	for _, k := range reg.Device.Kinds {
+		l.Kinds = append(l.Kinds, k.Name)
+	}
+	if haveHealth {
+		l.Health, l.Grade = &health.Score, health.Grade
+	}
+	return l, nil
+}
+
+func printListings(sellers []listing) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SELLER\tLABEL\tLOCATION\tKINDS\tPRICE/SAMPLE\tHEALTH")
+	for _, l := range sellers {
+		loc := fmt.Sprintf("%.4f,%.4f", l.Lat, l.Lon)
+		if l.DistanceKM != nil {
+			loc += fmt.Sprintf(" (%.1f km)", *l.DistanceKM)
+		}
+		health := "-"
+		if l.Health != nil {
+			health = fmt.Sprintf("%d %s", *l.Health, l.Grade)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", l.SellerID, l.Label, loc, strings.Join(l.Kinds, ","), formatPrice(l.Price), health)
+	}
+	tw.Flush()
+	if len(sellers) == 0 {
+		fmt.Fprintln(os.Stderr, "no sellers found")
+	}
+}
+
+func formatPrice(p map[string]any) string {
+	if v, ok := p["price_per_sample_usd_cents"]; ok {
+		return fmt.Sprintf("%v¢", v)
+	}
+	if v, ok := p["price_per_sample_tinybar"]; ok {
+		return fmt.Sprintf("%v tℏ", v)
+	}
+	return "-"
+}
+
+// addSeller puts the seller named by id into list_of_sellers.
+func addSeller(envFile string, sellers []listing, id string) error {
+	i := slices.IndexFunc(sellers, func(l listing) bool { return l.SellerID == id || l.PublicKey == id })
+	if i < 0 {
+		return fmt.Errorf("no seller %q found", id)
+	}
+	l := sellers[i]
+	if l.PublicKey == "" {
+		return fmt.Errorf("%s's registration has no public key; it needs a newer shim", l.SellerID)
+	}
+	current := splitList(os.Getenv("list_of_sellers"))
+	if !slices.Contains(current, l.PublicKey) {
+		if err := setEnvLine(envFile, "list_of_sellers", strings.Join(append(current, l.PublicKey), ",")); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%s (%s) is in list_of_sellers in %s; the buyer sends it a service request when it next starts\n", l.SellerID, l.PublicKey, envFile)
+	return nil
+}
+
+func parseLatLon(s string) (float64, float64, error) {
+	latStr, lonStr, ok := strings.Cut(s, ",")
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	lon, err2 := strconv.ParseFloat(strings.TrimSpace(lonStr), 64)
+	if !ok || err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("-near wants lat,lon, got %q", s)
+	}
+	return lat, lon, nil
+}
+
+func haversineKM(lat1, lon1, lat2, lon2 float64) float64 {
+	const r = 6371.0
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * r * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+)
+
+// validateSchema checks v (decoded with UseNumber or into any) against the
+// subset of JSON Schema the seller's /schema uses: type, const, enum,
+// pattern, minimum, maximum, exclusiveMaximum, required, properties,
+// additionalProperties, items and oneOf. path names v in errors.
+func validateSchema(schema map[string]any, v any, path string) error {
+	if t, ok := schema["type"].(string); ok && !hasType(v, t) {
+		return fmt.Errorf("%s: want %s, got %s", path, t, jsonType(v))
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, v) {
+		return fmt.Errorf("%s: want %v, got %v", path, c, v)
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			found = found || jsonEqual(e, v)
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, v, enum)
+		}
+	}
+	if p, ok := schema["pattern"].(string); ok {
+		if s, isStr := v.(string); isStr {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return fmt.Errorf("%s: schema pattern: %w", path, err)
+			}
+			if !re.MatchString(s) {
+				return fmt.Errorf("%s: %q does not match %s", path, s, p)
+			}
+		}
+	}
+	if n, isNum := v.(float64); isNum {
+		if m, ok := schema["minimum"].(float64); ok && n < m {
+			return fmt.Errorf("%s: %v below minimum %v", path, n, m)
+		}
+		if m, ok := schema["maximum"].(float64); ok && n > m {
+			return fmt.Errorf("%s: %v above maximum %v", path, n, m)
+		}
+		if m, ok := schema["exclusiveMaximum"].(float64); ok && n >= m {
+			return fmt.Errorf("%s: %v not below %v", path, n, m)
+		}
+	}
+	if obj, isObj := v.(map[string]any); isObj {
+		if err := validateObject(schema, obj, path); err != nil {
+			return err
+		}
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		if list, isList := v.([]any); isList {
+			for i, item := range list {
+				if err := validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if variants, ok := schema["oneOf"].([]any); ok {
+		matched := 0
+		var last error
+		for _, variant := range variants {
+			vs, _ := variant.(map[string]any)
+			if err := validateSchema(vs, v, path); err != nil {
+				last = err
+				continue
+			}
+			matched++
+		}
+		if matched != 1 {
+			if matched == 0 && last != nil {
+				return fmt.Errorf("%s: matches no oneOf variant (%v)", path, last)
+			}
+			return fmt.Errorf("%s: matches %d oneOf variants, want exactly one", path, matched)
+		}
+	}
+	return nil
+}
+
+func validateObject(schema map[string]any, obj map[string]any, path string) error {
+	required, _ := schema["required"].([]any)
+	for _, r := range required {
+		if _, ok := obj[fmt.Sprint(r)]; !ok {
+			return fmt.Errorf("%s: missing %s", path, r)
+		}
+	}
+	props, _ := schema["properties"].(map[string]any)
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ps, ok := props[k].(map[string]any)
+		if !ok {
+			if extra, isSchema := schema["additionalProperties"].(map[string]any); isSchema {
+				ps = extra
+			} else if allowed, isBool := schema["additionalProperties"].(bool); isBool && !allowed {
+				return fmt.Errorf("%s: unexpected member %s", path, k)
+			} else {
+				continue
+			}
+		}
+		if err := validateSchema(ps, obj[k], path+"."+k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasType(v any, t string) bool {
+	switch t {
+	case "integer":
+		n, ok := v.(float64)
+		return ok && n == math.Trunc(n)
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	}
+	return jsonType(v) == t
+}
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// jsonEqual compares two decoded JSON values.
+func jsonEqual(a, b any) bool {
+	da, _ := json.Marshal(a)
+	db, _ := json.Marshal(b)
+	var x, y any
+	json.Unmarshal(da, &x)
+	json.Unmarshal(db, &y)
+	return reflect.DeepEqual(x, y)
+}
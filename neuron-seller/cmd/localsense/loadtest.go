@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// loadtest puts a seller on this machine under many buyers at once: each
+// simulated buyer is its own libp2p host (its own peer ID) reading the
+// selftest stream over loopback, so the node encodes and writes every
+// sample once per buyer. While it runs, the node's /metrics are scraped for
+// memory, bytes sent and Hedera messages; the report covers throughput per
+// buyer, how many buyers got each sample and how far apart (fan-out skew),
+// and what the node spent doing it.
+
+type loadReport struct {
+	Buyers         int      `json:"buyers"`
+	Connected      int      `json:"connected"`
+	Failed         int      `json:"failed"`
+	DurationSec    float64  `json:"duration_seconds"`
+	Samples        int      `json:"samples"`        // distinct samples seen
+	Deliveries     int64    `json:"deliveries"`     // sample lines received, all buyers
+	BytesReceived  int64    `json:"bytes_received"` // all buyers
+	PerBuyerRate   float64  `json:"per_buyer_rate"` // samples/s, mean over connected buyers
+	Completeness   float64  `json:"completeness"`   // share of connected buyers that got each sample, mean
+	SkewP50Ms      float64  `json:"fanout_skew_p50_ms"`
+	SkewP95Ms      float64  `json:"fanout_skew_p95_ms"`
+	SkewMaxMs      float64  `json:"fanout_skew_max_ms"`
+	MemoryStartMB  float64  `json:"memory_start_mb"`
+	MemoryPeakMB   float64  `json:"memory_peak_mb"`
+	BytesSent      float64  `json:"node_bytes_sent"`
+	HederaMessages float64  `json:"hedera_messages"`
+	HederaPerHour  float64  `json:"hedera_messages_per_hour"`
+	Errors         []string `json:"errors,omitempty"`
+}
+
+type arrival struct {
+	first, last time.Time
+	buyers      int
+}
+
+type loadRun struct {
+	mu         sync.Mutex
+	arrivals   map[string]*arrival
+	deliveries int64
+	bytes      int64
+	connected  int
+	errors     []string
+}
+
+func runLoadtest(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	base := fs.String("url", "", "seller HTTP address (default http://127.0.0.1:$SELLER_PORT)")
+	addr := fs.String("addr", "", "loopback multiaddr of the seller's libp2p host (default from /status)")
+	buyers := fs.Int("buyers", 50, "simulated buyers")
+	duration := fs.Duration("duration", 5*time.Minute, "how long to hold the load")
+	ramp := fs.Duration("ramp", 10*time.Second, "spread buyer connects over this long")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+	if *buyers < 1 {
+		return errors.New("-buyers must be at least 1")
+	}
+	if *base == "" {
+		*base = "http://127.0.0.1:" + getEnvOrDefault("SELLER_PORT", "9000")
+	}
+	*base = strings.TrimSuffix(*base, "/")
+	if *addr == "" {
+		var err error
+		if *addr, err = selftestAddr(*base); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	before, err := scrapeMetrics(*base)
+	if err != nil {
+		return fmt.Errorf("metrics: %w", err)
+	}
+	peak := before["localsense_memory_bytes"]
+
+	ctx, cancel := context.WithDeadline(context.Background(), start.Add(*duration))
+	defer cancel()
+	run := &loadRun{arrivals: map[string]*arrival{}}
+	var wg sync.WaitGroup
+	for i := 0; i < *buyers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-time.After(*ramp * time.Duration(i) / time.Duration(*buyers)):
+			case <-ctx.Done():
+				return
+			}
+			if err := run.buyer(ctx, *addr); err != nil && ctx.Err() == nil {
+				run.fail(fmt.Sprintf("buyer %d: %v", i, err))
+			}
+		}()
+	}
+
+	// Watch the node's memory while the buyers run.
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-tick.C:
+			if m, err := scrapeMetrics(*base); err == nil {
+				peak = max(peak, m["localsense_memory_bytes"])
+			}
+			if !*asJSON {
+				run.mu.Lock()
+				fmt.Fprintf(os.Stderr, "\r%s  %d/%d buyers  %d samples delivered", time.Since(start).Truncate(time.Second), run.connected, *buyers, run.deliveries)
+				run.mu.Unlock()
+			}
+		}
+	}
+	wg.Wait()
+	if !*asJSON {
+		fmt.Fprintln(os.Stderr)
+	}
+	after, err := scrapeMetrics(*base)
+	if err != nil {
+		return fmt.Errorf("metrics: %w", err)
+	}
+	peak = max(peak, after["localsense_memory_bytes"])
+
+	rep := run.report(*buyers, time.Since(start))
+	rep.MemoryStartMB = before["localsense_memory_bytes"] / (1 << 20)
+	rep.MemoryPeakMB = peak / (1 << 20)
+	rep.BytesSent = after["localsense_bytes_sent_total"] - before["localsense_bytes_sent_total"]
+	rep.HederaMessages = after["localsense_hedera_queue_sent_total"] - before["localsense_hedera_queue_sent_total"]
+	rep.HederaPerHour = rep.HederaMessages / rep.DurationSec * 3600
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rep)
+	}
+	printLoadReport(rep)
+	return nil
+}
+
+// buyer is one simulated buyer: its own host, one stream, until ctx ends.
+func (run *loadRun) buyer(ctx context.Context, addr string) error {
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	info, err := peer.AddrInfoFromString(addr)
+	if err != nil {
+		return err
+	}
+	if err := h.Connect(ctx, *info); err != nil {
+		return err
+	}
+	s, err := h.NewStream(ctx, info.ID, selftestProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	deadline, _ := ctx.Deadline()
+	s.SetReadDeadline(deadline)
+
+	run.mu.Lock()
+	run.connected++
+	run.mu.Unlock()
+	sc := bufio.NewScanner(s)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		now := time.Now()
+		var head struct {
+			ID   string `json:"id"`
+			Kind string `json:"kind"`
+			Seq  uint64 `json:"seq"`
+		}
+		if json.Unmarshal(sc.Bytes(), &head) != nil {
+			continue
+		}
+		key := head.ID
+		if key == "" {
+			key = head.Kind + "/" + strconv.FormatUint(head.Seq, 10)
+		}
+		run.mu.Lock()
+		run.deliveries++
+		run.bytes += int64(len(sc.Bytes())) + 1
+		a, ok := run.arrivals[key]
+		if !ok {
+			a = &arrival{first: now}
+			run.arrivals[key] = a
+		}
+		a.last = now
+		a.buyers++
+		run.mu.Unlock()
+	}
+	return sc.Err()
+}
+
+func (run *loadRun) fail(msg string) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.errors = append(run.errors, msg)
+}
+
+func (run *loadRun) report(buyers int, elapsed time.Duration) loadReport {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	rep := loadReport{
+		Buyers:        buyers,
+		Connected:     run.connected,
+		Failed:        len(run.errors),
+		DurationSec:   elapsed.Seconds(),
+		Samples:       len(run.arrivals),
+		Deliveries:    run.deliveries,
+		BytesReceived: run.bytes,
+		Errors:        run.errors,
+	}
+	if run.connected == 0 || len(run.arrivals) == 0 {
+		return rep
+	}
+	rep.PerBuyerRate = float64(run.deliveries) / float64(run.connected) / elapsed.Seconds()
+	var skews []float64
+	var share float64
+	for _, a := range run.arrivals {
+		skews = append(skews, float64(a.last.Sub(a.first).Microseconds())/1000)
+		share += float64(a.buyers) / float64(run.connected)
+	}
+	rep.Completeness = share / float64(len(run.arrivals))
+	slices.Sort(skews)
+	pct := func(p float64) float64 { return skews[min(int(p*float64(len(skews))), len(skews)-1)] }
+	rep.SkewP50Ms, rep.SkewP95Ms, rep.SkewMaxMs = pct(0.5), pct(0.95), skews[len(skews)-1]
+	return rep
+}
+
+func printLoadReport(rep loadReport) {
+	fmt.Printf("buyers        %d connected of %d (%d failed)\n", rep.Connected, rep.Buyers, rep.Failed)
+	fmt.Printf("duration      %.0fs\n", rep.DurationSec)
+	fmt.Printf("samples       %d distinct, %d deliveries, %.1f KB received\n", rep.Samples, rep.Deliveries, float64(rep.BytesReceived)/1024)
+	fmt.Printf("throughput    %.2f samples/s per buyer\n", rep.PerBuyerRate)
+	fmt.Printf("completeness  %.1f%% of buyers got each sample\n", rep.Completeness*100)
+	fmt.Printf("fan-out skew  p50 %.1f ms, p95 %.1f ms, max %.1f ms\n", rep.SkewP50Ms, rep.SkewP95Ms, rep.SkewMaxMs)
+	fmt.Printf("node memory   %.1f MB at start, %.1f MB peak\n", rep.MemoryStartMB, rep.MemoryPeakMB)
+	fmt.Printf("node sent     %.1f KB\n", rep.BytesSent/1024)
+	fmt.Printf("hedera        %.0f messages (%.1f/hour)\n", rep.HederaMessages, rep.HederaPerHour)
+	for _, e := range rep.Errors {
+		fmt.Printf("error         %s\n", e)
+	}
+}
+
+// selftestAddr asks the node's /status for its loopback selftest address.
+func selftestAddr(base string) (string, error) {
+	var status struct {
+		Selftest *struct {
+			Addrs []string `json:"addrs"`
+		} `json:"selftest"`
+	}
+	if err := getJSON(base+"/status", &status); err != nil {
+		return "", err
+	}
+	if status.Selftest == nil || len(status.Selftest.Addrs) == 0 {
+		return "", errors.New("the node serves no selftest: is NEURON_ENABLE on and SELFTEST_ENABLE not false?")
+	}
+	return status.Selftest.Addrs[0], nil
+}
+
+// scrapeMetrics reads the node's /metrics, summing each metric over its
+// labels.
+func scrapeMetrics(base string) (map[string]float64, error) {
+	resp, err := httpClient.Get(base + "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return parseMetrics(resp.Body)
+}
+
+func parseMetrics(r io.Reader) (map[string]float64, error) {
+	out := map[string]float64{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			continue
+		}
+		name := line[:i]
+		if j := strings.IndexByte(name, '{'); j >= 0 {
+			name = name[:j]
+		}
+		out[name] += v
+	}
+	return out, sc.Err()
+}
@@ -0,0 +1,121 @@
+// Command localsense is the buyer-side companion to the seller shim:
+//
+//	localsense browse   list sellers from the Neuron explorer and mirror node
+//	localsense tap      buy a seller's stream and print it as NDJSON
+//	localsense selftest check the seller on this machine over loopback
+//	localsense loadtest put that seller under many simulated buyers
+//	localsense soak     run that seller through a schedule of failures
+//
+// Settings come from the buyer's Neuron env file (-env, .env by default):
+// mirror_api_url, neuron_explorer_url and list_of_sellers, as the Neuron SDK
+// reads them. The process environment overrides the file.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+type command struct {
+	summary string
+	run     func(args []string) error
+}
+
+var commands = map[string]command{
+	"browse":   {"list sellers and ask to buy from one", runBrowse},
+	"tap":      {"buy a seller's stream and print it", runTap},
+	"selftest": {"check the seller on this machine end to end", runSelftest},
+	"loadtest": {"measure the seller on this machine under many buyers", runLoadtest},
+	"soak":     {"check the seller on this machine recovers from failures", runSoak},
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 || commands[os.Args[1]].run == nil {
+		usage()
+		os.Exit(2)
+	}
+	if err := commands[os.Args[1]].run(os.Args[2:]); err != nil {
+		log.Fatalf("localsense %s: %v", os.Args[1], err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: localsense <command> [flags]")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", name, commands[name].summary)
+	}
+}
+
+// loadEnv reads the Neuron env file into the process environment without
+// overriding what is already set. A missing file is fine.
+func loadEnv(path string) error {
+	values, err := godotenv.Read(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+	for key, val := range values {
+		if _, ok := os.LookupEnv(key); !ok {
+			os.Setenv(key, val)
+		}
+	}
+	return nil
+}
+
+func getEnvOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// setEnvLine sets key=value in the env file at path, keeping every other
+// line (comments included) as it was.
+func setEnvLine(path, key, value string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var lines []string
+	found := false
+	sc := bufio.NewScanner(strings.NewReader(string(data)))
+	for sc.Scan() {
+		line := sc.Text()
+		if k, _, ok := strings.Cut(line, "="); ok && strings.TrimSpace(k) == key {
+			line, found = key+"="+value, true
+		}
+		lines = append(lines, line)
+	}
+	if !found {
+		lines = append(lines, key+"="+value)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
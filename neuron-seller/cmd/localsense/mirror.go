@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 15 * time.Second}
+
+func getJSON(rawURL string, v any) error {
+	resp, err := httpClient.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: HTTP %d", rawURL, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// topicMessage is one HCS message as the mirror node returns it.
+type topicMessage struct {
+	ConsensusTimestamp string `json:"consensus_timestamp"`
+	Message            string `json:"message"` // base64
+}
+
+// scanTopic walks a topic's messages newest first, at most pages pages of
+// 100, until fn returns false.
+func scanTopic(mirror, topic string, pages int, fn func(msg []byte) bool) error {
+	base, err := url.Parse(mirror)
+	if err != nil {
+		return fmt.Errorf("mirror URL: %w", err)
+	}
+	next := strings.TrimSuffix(mirror, "/") + "/topics/" + url.PathEscape(topic) + "/messages?order=desc&limit=100"
+	for ; next != "" && pages > 0; pages-- {
+		var page struct {
+			Messages []topicMessage `json:"messages"`
+			Links    struct {
+				Next string `json:"next"`
+			} `json:"links"`
+		}
+		if err := getJSON(next, &page); err != nil {
+			return err
+		}
+		for _, m := range page.Messages {
+			data, err := base64.StdEncoding.DecodeString(m.Message)
+			if err != nil {
+				continue
+			}
+			if !fn(data) {
+				return nil
+			}
+		}
+		next = ""
+		if page.Links.Next != "" {
+			// links.next is a path from the mirror host, /api/v1 included.
+			ref, err := url.Parse(page.Links.Next)
+			if err != nil {
+				return err
+			}
+			next = base.ResolveReference(ref).String()
+		}
+	}
+	return nil
+}
+
+// messageType is the messageType member of an HCS message, "" for none.
+func messageType(data []byte) string {
+	var head struct {
+		MessageType string `json:"messageType"`
+	}
+	json.Unmarshal(data, &head)
+	return head.MessageType
+}
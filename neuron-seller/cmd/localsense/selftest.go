@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"localsense/neuron-seller/buyerclient"
+)
+
+// selftest checks a seller on this machine end to end after an install:
+// it reads the node's /status, /device and /schema over HTTP, starts an
+// ephemeral libp2p host, dials the node's selftest protocol over loopback
+// and checks -n samples: they decode, name this seller, carry a valid
+// signature when the node has a signing key, match the schema and have
+// rising sequence numbers per kind. Any failure exits nonzero.
+
+const selftestProtocol = "/localsense/selftest/v1"
+
+func runSelftest(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	base := fs.String("url", "", "seller HTTP address (default http://127.0.0.1:$SELLER_PORT)")
+	addr := fs.String("addr", "", "loopback multiaddr of the seller's libp2p host (default from /status)")
+	count := fs.Int("n", 3, "samples to check")
+	timeout := fs.Duration("timeout", 2*time.Minute, "how long to wait for them")
+	fs.Parse(args)
+	if *base == "" {
+		*base = "http://127.0.0.1:" + getEnvOrDefault("SELLER_PORT", "9000")
+	}
+	*base = strings.TrimSuffix(*base, "/")
+
+	if *addr == "" {
+		err := step("status", func() (err error) {
+			*addr, err = selftestAddr(*base)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	var device struct {
+		SellerID   string `json:"seller_id"`
+		SigningKey string `json:"signing_pubkey"`
+	}
+	if err := step("device", func() error { return getJSON(*base+"/device", &device) }); err != nil {
+		return err
+	}
+	var pub ed25519.PublicKey
+	if device.SigningKey != "" {
+		key, err := hex.DecodeString(device.SigningKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fail("device", fmt.Errorf("signing_pubkey %q is not an ed25519 key", device.SigningKey))
+		}
+		pub = key
+	}
+	var schema map[string]any
+	if err := step("schema", func() error { return getJSON(*base+"/schema", &schema) }); err != nil {
+		return err
+	}
+
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		return fail("connect", err)
+	}
+	defer h.Close()
+	info, err := peer.AddrInfoFromString(*addr)
+	if err != nil {
+		return fail("connect", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := h.Connect(ctx, *info); err != nil {
+		return fail("connect", err)
+	}
+	s, err := h.NewStream(ctx, info.ID, selftestProtocol)
+	if err != nil {
+		return fail("connect", err)
+	}
+	defer s.Close()
+	pass("connect", *addr)
+
+	s.SetReadDeadline(time.Now().Add(*timeout))
+	sc := bufio.NewScanner(s)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	lastSeq := map[string]uint64{}
+	for n := 1; n <= *count; n++ {
+		name := fmt.Sprintf("sample %d/%d", n, *count)
+		if !sc.Scan() {
+			err := sc.Err()
+			if err == nil {
+				err = errors.New("stream closed")
+			}
+			return fail(name, fmt.Errorf("no sample: %w", err))
+		}
+		line := sc.Bytes()
+		smp, err := checkSample(line, device.SellerID, pub, schema)
+		if err != nil {
+			return fail(name, err)
+		}
+		if smp.Seq <= lastSeq[smp.Kind] {
+			return fail(name, fmt.Errorf("%s seq %d after %d", smp.Kind, smp.Seq, lastSeq[smp.Kind]))
+		}
+		lastSeq[smp.Kind] = smp.Seq
+		signed := "unsigned"
+		if pub != nil {
+			signed = "signature ok"
+		}
+		pass(name, fmt.Sprintf("%s seq %d = %v %s, %s", smp.Kind, smp.Seq, smp.Value, smp.Unit, signed))
+	}
+	fmt.Println("selftest passed")
+	return nil
+}
+
+// checkSample decodes one line and checks it against the node's identity
+// and schema.
+func checkSample(line []byte, sellerID string, pub ed25519.PublicKey, schema map[string]any) (*buyerclient.Sample, error) {
+	smp, _, err := buyerclient.ParseLine(line)
+	if err != nil {
+		return nil, err
+	}
+	if smp == nil {
+		return nil, errors.New("not a sample")
+	}
+	if smp.SellerID != sellerID {
+		return nil, fmt.Errorf("seller_id %q, /device says %q", smp.SellerID, sellerID)
+	}
+	if pub != nil {
+		if err := buyerclient.VerifySeller(line, pub); err != nil {
+			return nil, err
+		}
+	}
+	var doc any
+	if err := json.Unmarshal(line, &doc); err != nil {
+		return nil, err
+	}
+	if err := validateSchema(schema, doc, "sample"); err != nil {
+		return nil, fmt.Errorf("schema: %w", err)
+	}
+	return smp, nil
+}
+
+func step(name string, fn func() error) error {
+	if err := fn(); err != nil {
+		return fail(name, err)
+	}
+	pass(name, "")
+	return nil
+}
+
+func pass(name, detail string) {
+	if detail != "" {
+		detail = ": " + detail
+	}
+	fmt.Printf("ok    %s%s\n", name, detail)
+}
+
+func fail(name string, err error) error {
+	fmt.Printf("FAIL  %s: %v\n", name, err)
+	return fmt.Errorf("%s failed", name)
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// soak runs a seller on this machine through a schedule of failures for
+// hours or days and checks it recovers from each one, for release
+// qualification. Point the node's PI_BASE at -pi-listen; soak proxies to
+// the real Pi (-pi) so it can take it away. The faults:
+//
+//   - pi_down:    the Pi proxy answers 503 and cuts open streams
+//   - peer_churn: -buyers loopback buyers connect and drop every -every
+//   - partition:  the Pi proxy hangs and every loopback buyer is cut off
+//   - none:       a quiet period
+//
+// An observer buyer stays on the selftest stream throughout (except
+// during a partition). After each fault, within -recovery, samples must
+// flow to the observer again and the node's health score must be back at
+// -min-health. Over the whole run, each kind's sequence numbers must only
+// rise as the observer sees them and memory must not grow by more than
+// -max-memory-growth. The report (-report, JSON) lists every step and
+// invariant; any failure exits nonzero.
+
+type soakStep struct {
+	Fault    string   `json:"fault"`
+	Duration duration `json:"duration"`
+	Buyers   int      `json:"buyers,omitempty"` // peer_churn
+	Every    duration `json:"every,omitempty"`  // peer_churn
+}
+
+// duration is a time.Duration written as "2m" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type soakSchedule struct {
+	Cycles int        `json:"cycles"` // 0 repeats until interrupted or -for runs out
+	Steps  []soakStep `json:"steps"`
+}
+
+var defaultSoakSchedule = soakSchedule{
+	Cycles: 0,
+	Steps: []soakStep{
+		{Fault: "none", Duration: duration(5 * time.Minute)},
+		{Fault: "pi_down", Duration: duration(2 * time.Minute)},
+		{Fault: "none", Duration: duration(5 * time.Minute)},
+		{Fault: "peer_churn", Duration: duration(5 * time.Minute), Buyers: 10, Every: duration(15 * time.Second)},
+		{Fault: "none", Duration: duration(5 * time.Minute)},
+		{Fault: "partition", Duration: duration(time.Minute)},
+	},
+}
+
+type soakStepResult struct {
+	Cycle         int       `json:"cycle"`
+	Fault         string    `json:"fault"`
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Recovered     bool      `json:"recovered"`
+	RecoverySec   float64   `json:"recovery_seconds"`
+	HealthScore   float64   `json:"health_score"`
+	SamplesDuring int64     `json:"samples_during"`
+	Errors        []string  `json:"errors,omitempty"`
+}
+
+type soakInvariant struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type soakReport struct {
+	Started    time.Time        `json:"started"`
+	Ended      time.Time        `json:"ended"`
+	Cycles     int              `json:"cycles"`
+	Steps      []soakStepResult `json:"steps"`
+	Invariants []soakInvariant  `json:"invariants"`
+	Passed     bool             `json:"passed"`
+}
+
+func runSoak(args []string) error {
+	fs := flag.NewFlagSet("soak", flag.ExitOnError)
+	base := fs.String("url", "", "seller HTTP address (default http://127.0.0.1:$SELLER_PORT)")
+	pi := fs.String("pi", "", "the real Pi's base URL")
+	piListen := fs.String("pi-listen", "127.0.0.1:9911", "where to serve the Pi proxy; the node's PI_BASE must point here")
+	schedPath := fs.String("schedule", "", "JSON schedule of faults (default: the built-in cycle)")
+	total := fs.Duration("for", 0, "stop after this long (0 runs the schedule's cycles, or until interrupted)")
+	recovery := fs.Duration("recovery", 2*time.Minute, "how long the node has to recover after a fault")
+	minHealth := fs.Float64("min-health", 50, "health score the node must get back to")
+	maxGrowth := fs.Float64("max-memory-growth", 0.5, "allowed memory growth over the run, as a fraction")
+	reportPath := fs.String("report", "soak-report.json", "where to write the report")
+	fs.Parse(args)
+	if *pi == "" {
+		return errors.New("-pi is required: the node reaches the Pi through soak")
+	}
+	if *base == "" {
+		*base = "http://127.0.0.1:" + getEnvOrDefault("SELLER_PORT", "9000")
+	}
+	*base = strings.TrimSuffix(*base, "/")
+
+	sched := defaultSoakSchedule
+	if *schedPath != "" {
+		data, err := os.ReadFile(*schedPath)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &sched); err != nil {
+			return fmt.Errorf("%s: %w", *schedPath, err)
+		}
+	}
+	for i, st := range sched.Steps {
+		switch st.Fault {
+		case "none", "pi_down", "partition":
+		case "peer_churn":
+			if st.Buyers < 1 || st.Every <= 0 {
+				return fmt.Errorf("step %d: peer_churn needs buyers and every", i)
+			}
+		default:
+			return fmt.Errorf("step %d: unknown fault %q", i, st.Fault)
+		}
+		if st.Duration <= 0 {
+			return fmt.Errorf("step %d: duration must be positive", i)
+		}
+	}
+	if len(sched.Steps) == 0 {
+		return errors.New("the schedule has no steps")
+	}
+
+	proxy, err := newFaultProxy(*pi)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.ListenAndServe(*piListen, proxy); err != nil {
+			log.Fatalf("localsense soak: pi proxy: %v", err)
+		}
+	}()
+	addr, err := selftestAddr(*base)
+	if err != nil {
+		return err
+	}
+	obs := &soakObserver{addr: addr, lastSeq: map[string]uint64{}}
+	go obs.run()
+
+	rep := soakReport{Started: time.Now().UTC()}
+	startMem, _ := scrapeMetrics(*base)
+	var deadline time.Time
+	if *total > 0 {
+		deadline = time.Now().Add(*total)
+	}
+	expired := func() bool { return !deadline.IsZero() && time.Now().After(deadline) }
+
+	for cycle := 1; (sched.Cycles == 0 || cycle <= sched.Cycles) && !expired(); cycle++ {
+		for _, st := range sched.Steps {
+			if expired() {
+				break
+			}
+			res := soakStepResult{Cycle: cycle, Fault: st.Fault, Start: time.Now().UTC()}
+			log.Printf("soak: cycle %d: %s for %s", cycle, st.Fault, time.Duration(st.Duration))
+			before := obs.count()
+			runFault(st, proxy, obs, addr, &res)
+			res.SamplesDuring = obs.count() - before
+
+			// Give the node -recovery to show samples and health again.
+			faultEnd := time.Now()
+			res.Recovered = waitRecovered(*base, obs, *recovery, *minHealth, &res)
+			res.RecoverySec = time.Since(faultEnd).Seconds()
+			res.End = time.Now().UTC()
+			if !res.Recovered {
+				log.Printf("soak: cycle %d: %s: no recovery within %s", cycle, st.Fault, *recovery)
+			}
+			rep.Steps = append(rep.Steps, res)
+			writeSoakReport(*reportPath, rep)
+		}
+		rep.Cycles = cycle
+	}
+	rep.Ended = time.Now().UTC()
+
+	endMem, _ := scrapeMetrics(*base)
+	rep.Invariants = append(rep.Invariants, obs.invariant())
+	growth := soakInvariant{Name: "memory", Passed: true}
+	if start := startMem["localsense_memory_bytes"]; start > 0 {
+		g := endMem["localsense_memory_bytes"]/start - 1
+		growth.Passed = g <= *maxGrowth
+		growth.Detail = fmt.Sprintf("%.0f%% growth (%.1f MB to %.1f MB)", g*100, start/(1<<20), endMem["localsense_memory_bytes"]/(1<<20))
+	}
+	rep.Invariants = append(rep.Invariants, growth)
+	recoveries := soakInvariant{Name: "recovery", Passed: true}
+	for _, st := range rep.Steps {
+		if !st.Recovered {
+			recoveries.Passed = false
+			recoveries.Detail += fmt.Sprintf("cycle %d %s; ", st.Cycle, st.Fault)
+		}
+	}
+	rep.Invariants = append(rep.Invariants, recoveries)
+	rep.Passed = true
+	for _, inv := range rep.Invariants {
+		rep.Passed = rep.Passed && inv.Passed
+	}
+	if err := writeSoakReport(*reportPath, rep); err != nil {
+		return err
+	}
+	for _, inv := range rep.Invariants {
+		if inv.Passed {
+			pass(inv.Name, inv.Detail)
+		} else {
+			fail(inv.Name, errors.New(inv.Detail))
+		}
+	}
+	if !rep.Passed {
+		return fmt.Errorf("soak failed, see %s", *reportPath)
+	}
+	fmt.Printf("soak passed, report in %s\n", *reportPath)
+	return nil
+}
+
+// runFault applies one step for its duration.
+func runFault(st soakStep, proxy *faultProxy, obs *soakObserver, addr string, res *soakStepResult) {
+	d := time.Duration(st.Duration)
+	switch st.Fault {
+	case "none":
+		time.Sleep(d)
+	case "pi_down":
+		proxy.set(faultDown)
+		time.Sleep(d)
+		proxy.set(faultNone)
+	case "partition":
+		proxy.set(faultHang)
+		obs.pause(true)
+		time.Sleep(d)
+		obs.pause(false)
+		proxy.set(faultNone)
+	case "peer_churn":
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		defer cancel()
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		for i := 0; i < st.Buyers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for ctx.Err() == nil {
+					// Each connection lives for up to Every, staggered.
+					life := time.Duration(st.Every) * time.Duration(i+1) / time.Duration(st.Buyers)
+					cctx, ccancel := context.WithTimeout(ctx, life)
+					err := churnBuyer(cctx, addr)
+					ccancel()
+					if err != nil {
+						mu.Lock()
+						res.Errors = append(res.Errors, err.Error())
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// waitRecovered waits until the observer gets a fresh sample and the node's
+// health score is at least minHealth.
+func waitRecovered(base string, obs *soakObserver, within time.Duration, minHealth float64, res *soakStepResult) bool {
+	deadline := time.Now().Add(within)
+	mark := obs.count()
+	for time.Now().Before(deadline) {
+		m, err := scrapeMetrics(base)
+		if err == nil {
+			res.HealthScore = m["localsense_health_score"]
+		}
+		if err == nil && obs.count() > mark && res.HealthScore >= minHealth {
+			return true
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return false
+}
+
+// churnBuyer holds one selftest stream open until ctx ends.
+func churnBuyer(ctx context.Context, addr string) error {
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	info, err := peer.AddrInfoFromString(addr)
+	if err != nil {
+		return err
+	}
+	if err := h.Connect(ctx, *info); err != nil {
+		return err
+	}
+	s, err := h.NewStream(ctx, info.ID, selftestProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	go func() {
+		<-ctx.Done()
+		s.Reset()
+	}()
+	_, err = io.Copy(io.Discard, s)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// soakObserver holds one buyer stream open for the whole soak and checks
+// sequence numbers.
+type soakObserver struct {
+	addr string
+
+	mu         sync.Mutex
+	paused     bool
+	cancel     context.CancelFunc
+	samples    int64
+	lastSeq    map[string]uint64
+	violations []string
+}
+
+func (o *soakObserver) run() {
+	for {
+		o.mu.Lock()
+		if o.paused {
+			o.mu.Unlock()
+			time.Sleep(time.Second)
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		o.cancel = cancel
+		o.mu.Unlock()
+		o.follow(ctx)
+		cancel()
+		time.Sleep(time.Second)
+	}
+}
+
+func (o *soakObserver) follow(ctx context.Context) {
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		return
+	}
+	defer h.Close()
+	info, err := peer.AddrInfoFromString(o.addr)
+	if err != nil || h.Connect(ctx, *info) != nil {
+		return
+	}
+	s, err := h.NewStream(ctx, info.ID, selftestProtocol)
+	if err != nil {
+		return
+	}
+	defer s.Close()
+	go func() {
+		<-ctx.Done()
+		s.Reset()
+	}()
+	sc := bufio.NewScanner(s)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var head struct {
+			Kind string `json:"kind"`
+			Seq  uint64 `json:"seq"`
+		}
+		if json.Unmarshal(sc.Bytes(), &head) != nil {
+			continue
+		}
+		o.mu.Lock()
+		o.samples++
+		if last := o.lastSeq[head.Kind]; head.Seq <= last {
+			o.violations = append(o.violations, fmt.Sprintf("%s seq %d after %d", head.Kind, head.Seq, last))
+		}
+		o.lastSeq[head.Kind] = max(o.lastSeq[head.Kind], head.Seq)
+		o.mu.Unlock()
+	}
+}
+
+// pause cuts the observer off (true) or lets it reconnect (false).
+func (o *soakObserver) pause(on bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.paused = on
+	if on && o.cancel != nil {
+		o.cancel()
+	}
+}
+
+func (o *soakObserver) count() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.samples
+}
+
+func (o *soakObserver) invariant() soakInvariant {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	inv := soakInvariant{Name: "sequence", Passed: len(o.violations) == 0}
+	if !inv.Passed {
+		inv.Detail = fmt.Sprintf("%d regression(s), first: %s", len(o.violations), o.violations[0])
+	} else {
+		inv.Detail = fmt.Sprintf("%d samples, rising per kind", o.samples)
+	}
+	return inv
+}
+
+type faultMode int
+
+const (
+	faultNone faultMode = iota
+	faultDown
+	faultHang
+)
+
+// faultProxy forwards to the Pi unless a fault is on. Turning one on cuts
+// requests in flight, streams included.
+type faultProxy struct {
+	rp *httputil.ReverseProxy
+
+	mu     sync.Mutex
+	mode   faultMode
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newFaultProxy(target string) (*faultProxy, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("-pi %q is not a URL", target)
+	}
+	p := &faultProxy{rp: httputil.NewSingleHostReverseProxy(u)}
+	p.rp.FlushInterval = -1
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	return p, nil
+}
+
+func (p *faultProxy) set(mode faultMode) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if mode != faultNone {
+		p.cancel()
+		p.ctx, p.cancel = context.WithCancel(context.Background())
+	}
+	p.mode = mode
+}
+
+func (p *faultProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	mode, gen := p.mode, p.ctx
+	p.mu.Unlock()
+	switch mode {
+	case faultDown:
+		http.Error(w, "pi down (soak)", http.StatusServiceUnavailable)
+		return
+	case faultHang:
+		select {
+		case <-r.Context().Done():
+		case <-gen.Done():
+		}
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-gen.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	p.rp.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func writeSoakReport(path string, rep soakReport) error {
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+
+	neuronsdk "github.com/NeuronInnovations/neuron-go-hedera-sdk"
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/hashgraph/hedera-sdk-go/v2"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"localsense/neuron-seller/buyerclient"
+)
+
+// tap buys one seller's stream and copies it to stdout or -o: the Neuron
+// SDK runs as a buyer with only that seller in list_of_sellers, so it does
+// the Hedera service request and the seller dials back over libp2p. The
+// seller is named by its public key, or by its seller ID looked up as
+// browse does. -n stops after that many samples.
+
+var hexKey = regexp.MustCompile(`^(0x)?[0-9a-fA-F]{66}$`)
+
+func runTap(args []string) error {
+	fs := flag.NewFlagSet("tap", flag.ExitOnError)
+	envFile := fs.String("env", ".env", "Neuron env file of the buyer")
+	proto := fs.String("protocol", "", "stream protocol (default NEURON_PROTOCOL_ID or /localsense/brightness/v1)")
+	version := fs.String("version", "0.1.0", "Neuron node version to announce")
+	port := fs.String("port", "", "libp2p port for the SDK (its default when empty)")
+	outPath := fs.String("o", "", "write the stream to this file instead of stdout")
+	count := fs.Int("n", 0, "exit after this many samples (0 runs until interrupted)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: localsense tap [flags] <seller-id or public key>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := loadEnv(*envFile); err != nil {
+		return err
+	}
+
+	key, err := resolveSeller(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *proto == "" {
+		*proto = getEnvOrDefault("NEURON_PROTOCOL_ID", "/localsense/brightness/v1")
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		f, err := os.OpenFile(*outPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	t := &tapSink{out: bufio.NewWriter(out), limit: *count, done: make(chan struct{})}
+
+	// The SDK parses its own flags from os.Args.
+	os.Setenv("list_of_sellers", key)
+	os.Args = []string{os.Args[0], "--mode=peer", "--buyer-or-seller=buyer", "--list-of-sellers-source=env", "--envFile=" + *envFile}
+	if *port != "" {
+		os.Args = append(os.Args, "--port="+*port)
+	}
+	fmt.Fprintf(os.Stderr, "localsense tap: asking %s for %s\n", key, *proto)
+
+	go neuronsdk.LaunchSDK(
+		*version,
+		protocol.ID(*proto),
+		nil,
+		func(ctx context.Context, h host.Host, b *commonlib.NodeBuffers) {
+			h.SetStreamHandler(protocol.ID(*proto), t.handle)
+		},
+		func(msg hedera.TopicMessage) {},
+		func(ctx context.Context, h host.Host, b *commonlib.NodeBuffers) {},
+		func(msg hedera.TopicMessage) {},
+	)
+	<-t.done
+	return t.err
+}
+
+// resolveSeller returns the public key for a seller ID, or id itself when
+// it already is one.
+func resolveSeller(id string) (string, error) {
+	if hexKey.MatchString(id) {
+		return id, nil
+	}
+	explorer := os.Getenv("neuron_explorer_url")
+	if explorer == "" {
+		return "", errors.New("set neuron_explorer_url to look sellers up by ID, or pass the public key")
+	}
+	topics, err := explorerTopics(explorer)
+	if err != nil {
+		return "", fmt.Errorf("explorer: %w", err)
+	}
+	mirror := getEnvOrDefault("mirror_api_url", "https://testnet.mirrornode.hedera.com/api/v1")
+	for _, l := range lookupSellers(mirror, topics) {
+		if l.SellerID == id && l.PublicKey != "" {
+			return l.PublicKey, nil
+		}
+	}
+	return "", fmt.Errorf("no seller %q with a public key found", id)
+}
+
+// tapSink copies the seller's streams to out, a line at a time.
+type tapSink struct {
+	mu      sync.Mutex
+	out     *bufio.Writer
+	limit   int
+	samples int
+	err     error
+	done    chan struct{}
+	closed  bool
+}
+
+func (t *tapSink) handle(s network.Stream) {
+	defer s.Close()
+	fmt.Fprintf(os.Stderr, "localsense tap: stream from %s\n", s.Conn().RemotePeer())
+	sc := bufio.NewScanner(s)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		if !t.line(sc.Bytes()) {
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "localsense tap: stream from %s closed: %v\n", s.Conn().RemotePeer(), sc.Err())
+}
+
+// line writes one line, reporting whether to keep reading.
+func (t *tapSink) line(line []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.out.Write(line)
+	t.out.WriteByte('\n')
+	if err := t.out.Flush(); err != nil {
+		t.finish(err)
+		return false
+	}
+	if s, _, err := buyerclient.ParseLine(line); err == nil && s != nil {
+		t.samples++
+	}
+	if t.limit > 0 && t.samples >= t.limit {
+		t.finish(nil)
+		return false
+	}
+	return true
+}
+
+func (t *tapSink) finish(err error) {
+	if !t.closed {
+		t.closed, t.err = true, err
+		close(t.done)
+	}
+}
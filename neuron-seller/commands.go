@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"github.com/hashgraph/hedera-sdk-go/v2"
+	"golang.org/x/crypto/sha3"
+)
+
+// Operators and buyers drive nodes through stdin topic messages with
+// messageType localsenseCommand. Every command carries a fresh nonce and is
+// signed by its issuer: an ed25519 key (64 hex) with ed25519, or a compressed
+// secp256k1 key (66 hex, what Hedera ECDSA accounts use) with a 64-byte r||s
+// ECDSA signature over the keccak256 of the signed bytes, as the Hedera SDKs
+// produce. The signature covers commandEnvelope.signingBytes, which ends
+// with params exactly as sent, so issuers sign the bytes they publish.
+// Whether a verified issuer may run a command is up to the policy (see
+// policy.go); keys in COMMAND_ISSUERS are operators.
+//
+// A command that passes every check (version, target, type, signature,
+// policy, freshness, nonce) gets a localsenseCommandReply on reply_to
+// (default: this node's stdout topic) with status ok and a result, or status
+// error and invalid_params, failed or a code from errors.go for failures it
+// shares with the HTTP API (disabled, overloaded, payment_required...).
+// Anyone can publish to the stdin topic and every reply is a paid topic
+// message, so a command refused by those checks is only logged and audited
+// with its commandErr* code, never answered.
+
+const (
+	commandMessageType = "localsenseCommand"
+	commandReplyType   = "localsenseCommandReply"
+	commandVersion     = 1
+)
+
+type commandEnvelope struct {
+	MessageType string          `json:"messageType"`
+	Version     int             `json:"v"`
+	Type        string          `json:"type"`
+	Target      string          `json:"target"` // seller ID, or "*" for every node
+	Nonce       string          `json:"nonce"`
+	Issuer      string          `json:"issuer"`            // hex public key
+	Account     string          `json:"account,omitempty"` // issuer's Hedera account ID or EVM address
+	IssuedAt    int64           `json:"issued_at"`
+	ExpiresAt   int64           `json:"expires_at,omitempty"`
+	ReplyTo     string          `json:"reply_to,omitempty"` // topic ID
+	Params      json.RawMessage `json:"params,omitempty"`
+	Signature   string          `json:"signature"`
+}
+
+func (c commandEnvelope) signingBytes() []byte {
+	head := fmt.Sprintf("%s|%d|%s|%s|%s|%s|%s|%d|%d|",
+		commandMessageType, c.Version, c.Target, c.Type, c.Nonce, c.Issuer, c.Account, c.IssuedAt, c.ExpiresAt)
+	return append([]byte(head), c.Params...)
+}
+
+// Error codes of a command reply.
+const (
+	commandErrMalformed     = "malformed"
+	commandErrVersion       = "unsupported_version"
+	commandErrUnknownType   = "unknown_type"
+	commandErrUnauthorized  = "unauthorized"
+	commandErrBadSignature  = "bad_signature"
+	commandErrExpired       = "expired"
+	commandErrReplayed      = "replayed"
+	commandErrInvalidParams = "invalid_params"
+	commandErrFailed        = "failed"
+)
+
+type commandError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *commandError) Error() string { return e.Code + ": " + e.Message }
+
+func commandErrorf(code, format string, args ...any) *commandError {
+	return &commandError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+type commandReply struct {
+	MessageType string        `json:"messageType"`
+	Version     int           `json:"v"`
+	SellerID    string        `json:"seller_id"`
+	Type        string        `json:"type,omitempty"`
+	Nonce       string        `json:"nonce,omitempty"`
+	Status      string        `json:"status"` // ok or error
+	Result      any           `json:"result,omitempty"`
+	Error       *commandError `json:"error,omitempty"`
+	Time        time.Time     `json:"time"`
+}
+
+// commandHandler runs a verified command. Errors that are neither a
+// *commandError nor of a kind in errors.go are reported with code failed.
+type commandHandler func(cmd commandEnvelope) (any, error)
+
+var commandHandlers = map[string]commandHandler{
+	"ping":           pingCommand,
+	"purge":          purgeTopicCommand,
+	"pause":          pauseCommand,
+	"resume":         resumeCommand,
+	"set_interval":   setIntervalCommand,
+	"history":        historyCommand,
+	"backfill":       backfillCommand,
+	"redeem_voucher": redeemVoucherCommand,
+	"sample_now":     sampleNowCommand,
+	"canary_result":  canaryResultCommand,
+}
+
+type commandConfig struct {
+	Issuers   map[string]bool // operator keys, lower-case hex
+	MaxAge    time.Duration
+	MaxSkew   time.Duration
+	NonceFile string
+}
+
+var (
+	commandCfg commandConfig
+	nonces     *nonceStore
+)
+
+// loadCommands reads COMMAND_ISSUERS; the purge operator key is always an
+// issuer so existing deployments keep working.
+func loadCommands() {
+	commandCfg = commandConfig{
+		Issuers:   make(map[string]bool),
+		MaxAge:    time.Duration(parseEnvInt("COMMAND_MAX_AGE_SECONDS", 600)) * time.Second,
+		MaxSkew:   time.Duration(parseEnvInt("COMMAND_MAX_SKEW_SECONDS", 60)) * time.Second,
+		NonceFile: getEnvOrDefault("COMMAND_NONCE_FILE", "data/command_nonces.json"),
+	}
+	keys := strings.Split(getEnvOrDefault("COMMAND_ISSUERS", ""), ",")
+	keys = append(keys, getEnvOrDefault("PURGE_OPERATOR_PUBKEY", ""))
+	for _, k := range keys {
+		k = rawKey(k)
+		if k == "" {
+			continue
+		}
+		if pub, err := hex.DecodeString(k); err != nil || (len(pub) != ed25519.PublicKeySize && len(pub) != secp256k1.PubKeyBytesLenCompressed) {
+			log.Fatalf("commands: issuer %q is not a hex ed25519 or compressed secp256k1 public key", k)
+		}
+		commandCfg.Issuers[k] = true
+	}
+
+	nonces = &nonceStore{path: commandCfg.NonceFile, seen: make(map[string]int64)}
+	if err := nonces.load(); err != nil {
+		log.Printf("commands: ignoring nonce file: %v", err)
+	}
+	if len(commandCfg.Issuers) > 0 {
+		log.Printf("Commands  : %d issuer(s), max age %s", len(commandCfg.Issuers), commandCfg.MaxAge)
+	}
+}
+
+// handleCommandMessage verifies, runs and answers one topic command.
+func handleCommandMessage(contents []byte) {
+	var cmd commandEnvelope
+	if err := json.Unmarshal(contents, &cmd); err != nil {
+		log.Printf("commands: ignoring malformed command: %v", err)
+		return
+	}
+	handler, cerr := admitCommand(cmd, time.Now())
+	if cerr != nil {
+		log.Printf("commands: %s %s from %.16s refused: %v", cmd.Type, cmd.Nonce, cmd.Issuer, cerr)
+		audit.Record("command", rawKey(cmd.Issuer), cmd.Type, cerr.Code, map[string]any{"nonce": cmd.Nonce, "error": cerr.Message})
+		return
+	}
+	result, err := handler(cmd)
+
+	reply := commandReply{
+		MessageType: commandReplyType,
+		Version:     commandVersion,
+		SellerID:    sellerCfg.SellerID,
+		Type:        cmd.Type,
+		Nonce:       cmd.Nonce,
+		Status:      "ok",
+		Result:      result,
+		Time:        time.Now().UTC(),
+	}
+	if err != nil {
+		var cerr *commandError
+		if !errors.As(err, &cerr) {
+			code := commandErrFailed
+			if kind := errorKind(err, nil); kind != nil {
+				code = kind.Code()
+			}
+			cerr = &commandError{Code: code, Message: err.Error()}
+		}
+		reply.Status, reply.Result, reply.Error = "error", nil, cerr
+		log.Printf("commands: %s %s failed: %v", cmd.Type, cmd.Nonce, cerr)
+		audit.Record("command", rawKey(cmd.Issuer), cmd.Type, cerr.Code, map[string]any{"nonce": cmd.Nonce, "error": cerr.Message})
+	} else {
+		audit.Record("command", rawKey(cmd.Issuer), cmd.Type, "ok", map[string]any{"nonce": cmd.Nonce, "result": result})
+		log.Printf("commands: %s %s from %.16s done", cmd.Type, cmd.Nonce, cmd.Issuer)
+	}
+	postCommandReply(cmd.ReplyTo, reply)
+}
+
+// postCommandReply is sendCommandReply; the fuzz tests swap it to check
+// replies without a Hedera client.
+var postCommandReply = sendCommandReply
+
+// admitCommand checks the envelope in order (version, target, type,
+// signature, policy, freshness, nonce) and returns the handler to run it.
+// The nonce is spent once the command is admitted, whether or not the
+// handler succeeds.
+func admitCommand(cmd commandEnvelope, now time.Time) (commandHandler, *commandError) {
+	if cmd.Version != commandVersion {
+		return nil, commandErrorf(commandErrVersion, "v=%d, this node speaks v=%d", cmd.Version, commandVersion)
+	}
+	if cmd.Target != "*" && cmd.Target != sellerCfg.SellerID {
+		return nil, commandErrorf(commandErrMalformed, "target %q is not this node", cmd.Target)
+	}
+	handler, ok := commandHandlers[cmd.Type]
+	if !ok {
+		return nil, commandErrorf(commandErrUnknownType, "unknown command type %q", cmd.Type)
+	}
+	if cmd.Nonce == "" {
+		return nil, commandErrorf(commandErrMalformed, "nonce is required")
+	}
+	if !verifyCommandSignature(cmd.Issuer, cmd.signingBytes(), cmd.Signature) {
+		return nil, commandErrorf(commandErrBadSignature, "signature does not verify")
+	}
+	if d := policy.Authorize(cmd); !d.Allowed {
+		return nil, commandErrorf(commandErrUnauthorized, "%s", d.Reason)
+	}
+
+	issued := time.Unix(cmd.IssuedAt, 0)
+	if now.Sub(issued) > commandCfg.MaxAge || issued.Sub(now) > commandCfg.MaxSkew {
+		return nil, commandErrorf(commandErrExpired, "issued_at %s is outside the accepted window", issued.UTC().Format(time.RFC3339))
+	}
+	if cmd.ExpiresAt > 0 && now.Unix() >= cmd.ExpiresAt {
+		return nil, commandErrorf(commandErrExpired, "command expired at %s", time.Unix(cmd.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	}
+	// Nonces only need remembering until the command would be too old
+	// anyway.
+	if !nonces.Spend(cmd.Issuer+"/"+cmd.Nonce, issued.Add(commandCfg.MaxAge+commandCfg.MaxSkew), now) {
+		return nil, commandErrorf(commandErrReplayed, "nonce %q was already used", cmd.Nonce)
+	}
+	return handler, nil
+}
+
+// verifyCommandSignature checks sigHex over msg for an ed25519 or compressed
+// secp256k1 issuer key.
+func verifyCommandSignature(keyHex string, msg []byte, sigHex string) bool {
+	key, err := hex.DecodeString(strings.TrimPrefix(keyHex, "0x"))
+	if err != nil {
+		return false
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(sigHex, "0x"))
+	if err != nil {
+		return false
+	}
+	switch len(key) {
+	case ed25519.PublicKeySize:
+		return ed25519.Verify(ed25519.PublicKey(key), msg, sig)
+	case secp256k1.PubKeyBytesLenCompressed:
+		pub, err := secp256k1.ParsePubKey(key)
+		if err != nil || len(sig) != 64 {
+			return false
+		}
+		var r, s secp256k1.ModNScalar
+		if r.SetByteSlice(sig[:32]) || s.SetByteSlice(sig[32:]) {
+			return false
+		}
+		h := sha3.NewLegacyKeccak256()
+		h.Write(msg)
+		return ecdsa.NewSignature(&r, &s).Verify(h.Sum(nil), pub)
+	}
+	return false
+}
+
+func sendCommandReply(replyTo string, reply commandReply) {
+	data, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("commands: marshal reply: %v", err)
+		return
+	}
+	topic := commonlib.MyStdOut
+	if replyTo != "" {
+		if t, err := hedera.TopicIDFromString(replyTo); err == nil {
+			topic = t
+		} else {
+			log.Printf("commands: invalid reply_to %q, replying on stdout", replyTo)
+		}
+	}
+	go func() {
+		if err := sendToTopic(topic, data, "command reply"); err != nil && !errors.Is(err, errHederaQueued) {
+			log.Printf("commands: reply to %s failed: %v", topic, err)
+		}
+	}()
+}
+
+func pingCommand(cmd commandEnvelope) (any, error) {
+	return map[string]any{
+		"shim_version": currentDevice(false).ShimVersion,
+		"uptime_s":     int64(time.Since(processStartedAt).Seconds()),
+		"network":      hederaNet.Name,
+	}, nil
+}
+
+func purgeTopicCommand(cmd commandEnvelope) (any, error) {
+	var p struct {
+		After  int64 `json:"after"`
+		Before int64 `json:"before"`
+	}
+	if err := json.Unmarshal(cmd.Params, &p); err != nil {
+		return nil, commandErrorf(commandErrInvalidParams, "%v", err)
+	}
+	if p.Before == 0 {
+		return nil, commandErrorf(commandErrInvalidParams, "before is required")
+	}
+	return runPurge(time.Unix(p.After, 0), time.Unix(p.Before, 0), "topic:"+cmd.Issuer, cmd.Nonce)
+}
+
+// nonceStore remembers spent command nonces until they expire. It is saved
+// on every spend because the SDK can redeliver old topic messages after a
+// restart.
+type nonceStore struct {
+	mu   sync.Mutex
+	path string
+	seen map[string]int64 // nonce -> unix expiry
+}
+
+// Spend records nonce and reports false if it was already spent.
+func (n *nonceStore) Spend(nonce string, until, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for k, exp := range n.seen {
+		if exp < now.Unix() {
+			delete(n.seen, k)
+		}
+	}
+	if _, ok := n.seen[nonce]; ok {
+		return false
+	}
+	n.seen[nonce] = until.Unix()
+	if err := n.saveLocked(); err != nil {
+		log.Printf("commands: save nonces: %v", err)
+	}
+	return true
+}
+
+func (n *nonceStore) load() error {
+	data, err := os.ReadFile(n.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &n.seen)
+}
+
+func (n *nonceStore) saveLocked() error {
+	data, err := json.Marshal(n.seen)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(n.path), 0o755); err != nil {
+		return err
+	}
+	tmp := n.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, n.path)
+}
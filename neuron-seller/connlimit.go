@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// A Pi on a home connection can't afford to run a QUIC and security
+// handshake for every dialer that hammers it. Inbound libp2p connections are
+// counted per peer and overall over the last minute: past
+// P2P_CONN_PER_PEER_PER_MINUTE a peer is banned for P2P_CONN_BAN_MINUTES
+// and its connections closed as they come up; past
+// P2P_CONN_PER_MINUTE new connections from anyone are closed until the
+// minute has passed. Loopback (selftest, loadtest) is exempt, as are
+// connections we dialled ourselves. Bans land in the audit log and
+// refusals in /metrics. 0 turns a limit off.
+
+type connLimiter struct {
+	perPeer int
+	global  int
+	ban     time.Duration
+
+	mu      sync.Mutex
+	recent  map[peer.ID][]time.Time // inbound connection times in the last minute
+	all     []time.Time
+	banned  map[peer.ID]time.Time // until
+	refused map[string]*atomic.Uint64
+}
+
+var connLimits *connLimiter
+
+func loadConnLimits() {
+	l := &connLimiter{
+		perPeer: parseEnvInt("P2P_CONN_PER_PEER_PER_MINUTE", 20),
+		global:  parseEnvInt("P2P_CONN_PER_MINUTE", 300),
+		ban:     time.Duration(parseEnvInt("P2P_CONN_BAN_MINUTES", 15)) * time.Minute,
+		recent:  make(map[peer.ID][]time.Time),
+		banned:  make(map[peer.ID]time.Time),
+		refused: map[string]*atomic.Uint64{"banned": {}, "peer_rate": {}, "global_rate": {}},
+	}
+	if l.perPeer <= 0 && l.global <= 0 {
+		return
+	}
+	connLimits = l
+	log.Printf("ConnLimit : %d/min per peer (ban %s), %d/min overall", l.perPeer, l.ban, l.global)
+}
+
+// startConnLimits watches the host's inbound connections.
+func startConnLimits(p2pHost host.Host) {
+	if connLimits == nil {
+		return
+	}
+	p2pHost.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, c network.Conn) {
+			if c.Stat().Direction != network.DirInbound || loopbackAddr(c.RemoteMultiaddr()) {
+				return
+			}
+			reason := connLimits.Admit(c.RemotePeer(), c.RemoteMultiaddr(), time.Now())
+			if reason == "" {
+				return
+			}
+			// Closing from inside the notification would block the swarm.
+			go c.Close()
+		},
+	})
+}
+
+// Admit counts an inbound connection from p and returns why it must be
+// closed, or "" to keep it.
+func (l *connLimiter) Admit(p peer.ID, addr ma.Multiaddr, now time.Time) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until, ok := l.banned[p]; ok {
+		if now.Before(until) {
+			l.refused["banned"].Add(1)
+			return "banned"
+		}
+		delete(l.banned, p)
+	}
+
+	cutoff := now.Add(-time.Minute)
+	l.all = append(pruneBefore(l.all, cutoff), now)
+	recent := append(pruneBefore(l.recent[p], cutoff), now)
+	l.recent[p] = recent
+
+	if l.perPeer > 0 && len(recent) > l.perPeer {
+		delete(l.recent, p)
+		l.refused["peer_rate"].Add(1)
+		if l.ban > 0 {
+			l.banned[p] = now.Add(l.ban)
+			log.Printf("neuron-seller: banned %s (%s) for %s: %d connections in a minute", p, addr, l.ban, len(recent))
+			audit.Record("p2p", "node", "ban_peer", "ok", map[string]any{
+				"peer": p.String(), "addr": fmt.Sprint(addr), "connections": len(recent), "until": now.Add(l.ban).UTC(),
+			})
+		}
+		return "peer_rate"
+	}
+	if l.global > 0 && len(l.all) > l.global {
+		l.refused["global_rate"].Add(1)
+		return "global_rate"
+	}
+	l.sweep(cutoff, now)
+	return ""
+}
+
+// sweep forgets peers with nothing in the window and expired bans, so the
+// maps don't grow with every dialer ever seen. Called with l.mu held.
+func (l *connLimiter) sweep(cutoff, now time.Time) {
+	if len(l.recent) < 1024 {
+		return
+	}
+	for p, times := range l.recent {
+		if len(pruneBefore(times, cutoff)) == 0 {
+			delete(l.recent, p)
+		}
+	}
+	for p, until := range l.banned {
+		if !now.Before(until) {
+			delete(l.banned, p)
+		}
+	}
+}
+
+// pruneBefore drops the times before cutoff from the front of times.
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// Status is the limits and current bans, for /status.
+func (l *connLimiter) Status(now time.Time) map[string]any {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	banned := map[string]time.Time{}
+	for p, until := range l.banned {
+		if now.Before(until) {
+			banned[p.String()] = until.UTC()
+		}
+	}
+	return map[string]any{
+		"per_peer_per_minute": l.perPeer,
+		"per_minute":          l.global,
+		"banned":              banned,
+	}
+}
+
+func writeConnLimitMetrics(w http.ResponseWriter) {
+	if connLimits == nil {
+		return
+	}
+	fmt.Fprintln(w, "# HELP localsense_p2p_conns_refused_total Inbound libp2p connections closed by the rate limits, by reason.")
+	fmt.Fprintln(w, "# TYPE localsense_p2p_conns_refused_total counter")
+	for _, reason := range []string{"banned", "peer_rate", "global_rate"} {
+		fmt.Fprintf(w, "localsense_p2p_conns_refused_total{reason=%q} %d\n", reason, connLimits.refused[reason].Load())
+	}
+}
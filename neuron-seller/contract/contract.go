@@ -0,0 +1,85 @@
+// Package contract holds golden sample payloads, one directory per payload
+// schema version (golden/v1, golden/v2, ...), so the seller's encoder and
+// buyerclient's decoder are tested against the same bytes buyers receive.
+//
+// The seller's tests regenerate the current version's fixtures with
+// `go test -run TestGolden -update`; review the diff like any other change.
+// Fixtures of earlier versions are never rewritten: buyers built against
+// them are still out there, so this package's tests check that every later
+// version keeps each member they carry, with the same JSON type.
+package contract
+
+import (
+	"bytes"
+	"embed"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed golden
+var golden embed.FS
+
+// Fixture is one golden payload, exactly as the seller encodes it.
+type Fixture struct {
+	Version string // payload schema version, "1" for golden/v1
+	Name    string // file name without .json
+	Payload []byte // one JSON line, without the newline
+}
+
+// Path is where the fixture lives, relative to this package.
+func (f Fixture) Path() string {
+	return Path(f.Version, f.Name)
+}
+
+// Path is where the fixture name of a version lives, relative to this
+// package.
+func Path(version, name string) string {
+	return path.Join("golden", "v"+version, name+".json")
+}
+
+// Fixtures returns every fixture, oldest version first, by name within one.
+func Fixtures() ([]Fixture, error) {
+	var out []Fixture
+	err := fs.WalkDir(golden, "golden", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path.Ext(p) != ".json" {
+			return err
+		}
+		data, err := golden.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		out = append(out, Fixture{
+			Version: strings.TrimPrefix(path.Base(path.Dir(p)), "v"),
+			Name:    strings.TrimSuffix(path.Base(p), ".json"),
+			Payload: bytes.TrimRight(data, "\n"),
+		})
+		return nil
+	})
+	sort.SliceStable(out, func(i, j int) bool {
+		vi, _ := strconv.Atoi(out[i].Version)
+		vj, _ := strconv.Atoi(out[j].Version)
+		if vi != vj {
+			return vi < vj
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out, err
+}
+
+// Version returns the fixtures of one schema version by name.
+func Version(version string) (map[string]Fixture, error) {
+	all, err := Fixtures()
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]Fixture{}
+	for _, f := range all {
+		if f.Version == version {
+			out[f.Name] = f
+		}
+	}
+	return out, nil
+}
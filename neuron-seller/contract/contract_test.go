@@ -0,0 +1,104 @@
+package contract_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"localsense/neuron-seller/buyerclient"
+	"localsense/neuron-seller/contract"
+)
+
+// TestDecode checks that buyerclient decodes every fixture of every
+// version, and that what it decodes encodes back to the same members.
+func TestDecode(t *testing.T) {
+	fixtures, err := contract.Fixtures()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures")
+	}
+	for _, f := range fixtures {
+		smp, _, err := buyerclient.ParseLine(f.Payload)
+		if err != nil {
+			t.Errorf("%s: %v", f.Path(), err)
+			continue
+		}
+		if string(smp.Raw) != string(f.Payload) {
+			t.Errorf("%s: Raw is not the line as received", f.Path())
+		}
+		if want := "urn:localsense:sample:v" + f.Version; smp.SchemaID != want {
+			t.Errorf("%s: schema_id %q, want %q", f.Path(), smp.SchemaID, want)
+		}
+		again, err := json.Marshal(smp)
+		if err != nil {
+			t.Fatalf("%s: %v", f.Path(), err)
+		}
+		var orig, round map[string]any
+		json.Unmarshal(f.Payload, &orig)
+		json.Unmarshal(again, &round)
+		for k, v := range round {
+			if !jsonEqual(orig[k], v) {
+				t.Errorf("%s: %s decoded as %s, fixture has %s", f.Path(), k, encode(v), encode(orig[k]))
+			}
+		}
+	}
+}
+
+// TestBackwardsCompatible checks that a fixture kept through later versions
+// still carries each member it had, with the same JSON type: a buyer
+// written against an older version must be able to read newer payloads.
+func TestBackwardsCompatible(t *testing.T) {
+	fixtures, err := contract.Fixtures()
+	if err != nil {
+		t.Fatal(err)
+	}
+	earlier := map[string]contract.Fixture{} // by name, the last version seen
+	for _, f := range fixtures {
+		prev, ok := earlier[f.Name]
+		earlier[f.Name] = f
+		if !ok {
+			continue
+		}
+		var old, cur map[string]any
+		if err := json.Unmarshal(prev.Payload, &old); err != nil {
+			t.Fatalf("%s: %v", prev.Path(), err)
+		}
+		if err := json.Unmarshal(f.Payload, &cur); err != nil {
+			t.Fatalf("%s: %v", f.Path(), err)
+		}
+		for k, v := range old {
+			nv, ok := cur[k]
+			if !ok {
+				t.Errorf("%s drops %s, which %s has", f.Path(), k, prev.Path())
+			} else if jsonType(nv) != jsonType(v) {
+				t.Errorf("%s: %s is a %s, was a %s in %s", f.Path(), k, jsonType(nv), jsonType(v), prev.Path())
+			}
+		}
+	}
+}
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	}
+	return "object"
+}
+
+func jsonEqual(a, b any) bool {
+	return encode(a) == encode(b)
+}
+
+func encode(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deliveryRecord notes one sample written and flushed to a buyer stream.
+// libp2p has no application-level ack, so a successful flush is the
+// seller's record of delivery.
+type deliveryRecord struct {
+	Ts       int64  `json:"ts"`
+	Peer     string `json:"peer"`
+	Buyer    string `json:"buyer"`             // public key from the service request
+	Account  string `json:"account,omitempty"` // EVM address from the service request
+	Shared   string `json:"shared_account,omitempty"`
+	Kind     string `json:"kind"`
+	Seq      uint64 `json:"seq"`
+	SampleTs int64  `json:"sample_ts"`
+	Codec    string `json:"codec"`
+	Bytes    int    `json:"bytes"`
+	Price    int64  `json:"price_tinybar"`      // billed for this sample, after discounts
+	Free     string `json:"free,omitempty"`     // voucher or trial when not billed
+	Backfill bool   `json:"backfill,omitempty"` // sent by a backfill, at the backfill price
+
+	// SampleID is the sample's ULID (see ulid.go).
+	SampleID string `json:"sample_id,omitempty"`
+
+	// Set when the list price is in USD (PRICE_CURRENCY=USD): the cents
+	// billed and the rate they were converted to tinybar at, 0 if no rate
+	// was available.
+	Currency     string  `json:"currency,omitempty"`
+	Cents        float64 `json:"price_usd_cents,omitempty"`
+	CentsPerHbar float64 `json:"cents_per_hbar,omitempty"`
+}
+
+// matches reports whether the record belongs to buyer, given as a public
+// key, EVM address or peer ID.
+func (d deliveryRecord) matches(buyer string) bool {
+	return d.Buyer == rawKey(buyer) || strings.EqualFold(d.Account, buyer) || d.Peer == buyer
+}
+
+// deliveryLog keeps delivery records as one JSONL file per UTC day under
+// DELIVERY_LOG_DIR, for DELIVERY_RETENTION_DAYS.
+type deliveryLog struct {
+	mu        sync.Mutex
+	dir       string
+	retention int
+	day       string
+	file      *os.File
+}
+
+var deliveries *deliveryLog
+
+func loadDeliveryLog() {
+	if !parseEnvBool("DELIVERY_LOG_ENABLE", true) {
+		return
+	}
+	d := &deliveryLog{
+		dir:       getEnvOrDefault("DELIVERY_LOG_DIR", "data/deliveries"),
+		retention: parseEnvInt("DELIVERY_RETENTION_DAYS", 90),
+	}
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		log.Fatalf("deliveries: %v", err)
+	}
+	deliveries = d
+}
+
+// Record appends rec; a nil log (DELIVERY_LOG_ENABLE=false) drops it.
+func (d *deliveryLog) Record(rec deliveryRecord) {
+	if d == nil {
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	day := dayOf(rec.Ts)
+	if day != d.day || d.file == nil {
+		if d.file != nil {
+			d.file.Close()
+		}
+		d.file, err = os.OpenFile(filepath.Join(d.dir, day+".jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Printf("deliveries: %v", err)
+			d.file = nil
+			return
+		}
+		d.day = day
+		d.prune()
+	}
+	if _, err := d.file.Write(append(line, '\n')); err != nil {
+		log.Printf("deliveries: %v", err)
+	}
+}
+
+func (d *deliveryLog) prune() {
+	cutoff := time.Now().UTC().AddDate(0, 0, -d.retention).Format("2006-01-02")
+	files, _ := filepath.Glob(filepath.Join(d.dir, "*.jsonl"))
+	for _, f := range files {
+		if strings.TrimSuffix(filepath.Base(f), ".jsonl") < cutoff {
+			os.Remove(f)
+		}
+	}
+}
+
+// Query returns buyer's deliveries with from <= ts < to, oldest first; an
+// empty buyer matches every buyer.
+func (d *deliveryLog) Query(buyer string, from, to time.Time) ([]deliveryRecord, error) {
+	files, err := filepath.Glob(filepath.Join(d.dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	fromDay, toDay := dayOf(from.Unix()), dayOf(to.Unix())
+
+	var out []deliveryRecord
+	for _, path := range files {
+		day := strings.TrimSuffix(filepath.Base(path), ".jsonl")
+		if day < fromDay || day > toDay {
+			continue
+		}
+		if err := scanDeliveries(path, func(rec deliveryRecord) {
+			if rec.Ts >= from.Unix() && rec.Ts < to.Unix() && (buyer == "" || rec.matches(buyer)) {
+				out = append(out, rec)
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func scanDeliveries(path string, fn func(deliveryRecord)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec deliveryRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			// A torn last line after a power cut; skip it.
+			continue
+		}
+		fn(rec)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
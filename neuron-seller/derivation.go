@@ -0,0 +1,78 @@
+package main
+
+// Values the seller computes rather than reads off the sensor (unit
+// conversions like the lux estimate, history rollups) carry a provenance
+// block naming the source samples and the transformation applied, so buyers
+// can audit derived data and recompute it from the sources.
+//
+// Only JSON payloads carry it; the Avro schema has no provenance field.
+
+// derivation is the provenance block of a derived value.
+type derivation struct {
+	Transform string             `json:"transform"`
+	Params    map[string]any     `json:"params,omitempty"`
+	Sources   []derivationSource `json:"sources"`
+}
+
+// derivationSource references the samples a derived value was computed from
+// by kind and inclusive sequence range.
+type derivationSource struct {
+	SellerID string   `json:"seller_id"`
+	Kind     string   `json:"kind"`
+	Field    string   `json:"field,omitempty"` // Pi /metrics field
+	Unit     unit     `json:"unit,omitempty"`
+	FirstSeq uint64   `json:"first_seq,omitempty"`
+	LastSeq  uint64   `json:"last_seq,omitempty"`
+	Count    int      `json:"count,omitempty"`
+	Value    *float64 `json:"value,omitempty"` // the single source reading, when there is one
+}
+
+// Derivation describes converting raw into the kind's target unit, or nil
+// when the kind is sent in the unit the sensor reports.
+func (c unitConversion) Derivation(kind sensorKind, seq uint64, raw float64) *derivation {
+	if c.From == c.To {
+		return nil
+	}
+	d := &derivation{
+		Params: map[string]any{"from": c.From, "to": c.To},
+		Sources: []derivationSource{{
+			SellerID: sellerCfg.SellerID,
+			Kind:     kind.Name,
+			Field:    kind.Field,
+			Unit:     c.From,
+			FirstSeq: seq,
+			LastSeq:  seq,
+			Count:    1,
+			Value:    &raw,
+		}},
+	}
+	if temperatureUnits[c.From] {
+		d.Transform = "temperature_conversion"
+		return d
+	}
+	// Light units go through a 0..1 fraction of full scale, see
+	// unitConversion; both scales are what makes the result reproducible.
+	d.Transform = "linear_full_scale"
+	d.Params["adc_max"] = c.ADCMax
+	d.Params["lux_full_scale"] = c.LuxFullScale
+	d.Params["rounding"] = 4
+	return d
+}
+
+// provenance describes how a rollup bucket was computed from raw samples.
+func (rec aggregateRecord) provenance() *derivation {
+	return &derivation{
+		Transform: "aggregate",
+		Params: map[string]any{
+			"window":    rec.Res,
+			"functions": []string{"count", "min", "max", "mean"},
+		},
+		Sources: []derivationSource{{
+			SellerID: sellerCfg.SellerID,
+			Kind:     rec.Kind,
+			FirstSeq: rec.FirstSeq,
+			LastSeq:  rec.LastSeq,
+			Count:    rec.Count,
+		}},
+	}
+}
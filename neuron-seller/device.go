@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// deviceMetadata is the operator-maintained part of the digital twin, read
+// from DEVICE_METADATA_FILE (see device.example.json).
+type deviceMetadata struct {
+	HardwareModel   string            `json:"hardware_model"`
+	SerialNumber    string            `json:"serial_number,omitempty"`
+	Sensors         []sensorPart      `json:"sensors"`
+	Firmware        map[string]string `json:"firmware,omitempty"`
+	Install         installInfo       `json:"install"`
+	CalibrationDate string            `json:"calibration_date,omitempty"`
+	Notes           string            `json:"notes,omitempty"`
+
+	// Localized label and description by language tag (see i18n.go).
+	Labels       map[string]string `json:"labels,omitempty"`
+	Descriptions map[string]string `json:"descriptions,omitempty"`
+}
+
+type sensorPart struct {
+	Kind            string `json:"kind"`
+	PartNumber      string `json:"part_number"`
+	Manufacturer    string `json:"manufacturer,omitempty"`
+	CalibrationDate string `json:"calibration_date,omitempty"`
+	// Accuracy is the rated standard uncertainty and DriftPerYear how much
+	// it grows per year since calibration, both in the kind's unit.
+	Accuracy     float64 `json:"accuracy,omitempty"`
+	DriftPerYear float64 `json:"drift_per_year,omitempty"`
+}
+
+type installInfo struct {
+	HeightM        float64 `json:"height_m"`
+	OrientationDeg float64 `json:"orientation_deg"` // compass azimuth the sensor faces
+	TiltDeg        float64 `json:"tilt_deg"`
+	Mounting       string  `json:"mounting,omitempty"` // e.g. rooftop, window, pole
+	Indoor         bool    `json:"indoor"`
+	InstalledAt    string  `json:"installed_at,omitempty"`
+}
+
+// deviceDescriptor is what GET /device returns and what gets anchored in the
+// registration message on HCS.
+type deviceDescriptor struct {
+	SellerID    string         `json:"seller_id"`
+	Label       string         `json:"label"`
+	Lat         float64        `json:"lat"`
+	Lon         float64        `json:"lon"`
+	ShimVersion string         `json:"shim_version"`
+	SigningKey  string         `json:"signing_pubkey,omitempty"`
+	Kinds       []sensorKind   `json:"kinds"`
+	Metadata    deviceMetadata `json:"metadata"`
+	PiConfig    map[string]any `json:"pi_config,omitempty"`
+
+	// LocationVersion counts label and coordinate changes (POST /admin/location).
+	LocationVersion int `json:"location_version"`
+
+	// LegacyProtocols are old protocol IDs still served during a migration,
+	// mapped to their replacements.
+	LegacyProtocols map[string]string `json:"legacy_protocols,omitempty"`
+}
+
+type registrationMessage struct {
+	MessageType    string           `json:"messageType"`
+	Device         deviceDescriptor `json:"device"`
+	DescriptorHash string           `json:"descriptor_sha256"`
+	LicenseHash    string           `json:"license_sha256,omitempty"`
+	Time           time.Time        `json:"time"`
+	Version        string           `json:"v"`
+
+	// What a buyer needs to ask for the stream: the key to put in its
+	// list_of_sellers, and the list price.
+	PublicKey  string         `json:"public_key,omitempty"`
+	StdInTopic string         `json:"stdin_topic,omitempty"`
+	Price      map[string]any `json:"price,omitempty"`
+
+	// Where to dial the seller directly instead of waiting for the
+	// Hedera handshake.
+	PeerID     string   `json:"peer_id,omitempty"`
+	Multiaddrs []string `json:"multiaddrs,omitempty"`
+
+	// Set while the node is under maintenance and not sampling.
+	Maintenance *maintenanceState `json:"maintenance,omitempty"`
+}
+
+var (
+	deviceMeta   deviceMetadata
+	deviceMetaMu sync.RWMutex
+)
+
+func loadDeviceMetadata() {
+	path := getEnvOrDefault("DEVICE_METADATA_FILE", "device.json")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Device    : no metadata file at %s; /device will only report config", path)
+		return
+	}
+	if err != nil {
+		log.Fatalf("device: read %s: %v", path, err)
+	}
+
+	var meta deviceMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		log.Fatalf("device: decode %s: %v", path, err)
+	}
+	if err := validateLocalized("labels", meta.Labels); err != nil {
+		log.Fatalf("device: %s: %v", path, err)
+	}
+	if err := validateLocalized("descriptions", meta.Descriptions); err != nil {
+		log.Fatalf("device: %s: %v", path, err)
+	}
+	setPayloadI18n(meta)
+
+	deviceMetaMu.Lock()
+	deviceMeta = meta
+	deviceMetaMu.Unlock()
+	log.Printf("Device    : %s with %d sensors (metadata from %s)", meta.HardwareModel, len(meta.Sensors), path)
+}
+
+// currentDevice assembles the descriptor. The Pi's own /config is included
+// when reachable so its firmware version is reported live.
+func currentDevice(includePi bool) deviceDescriptor {
+	neuron, _ := getNeuronSellerConfig()
+
+	deviceMetaMu.RLock()
+	meta := deviceMeta
+	deviceMetaMu.RUnlock()
+
+	loc := privacy.Public().Location(currentLocation())
+	desc := deviceDescriptor{
+		SellerID:    sellerCfg.SellerID,
+		Label:       loc.Label,
+		Lat:         loc.Lat,
+		Lon:         loc.Lon,
+		ShimVersion: neuron.Version,
+		SigningKey:  signingPublicKey(),
+		Kinds:       neuron.Kinds,
+		Metadata:    meta,
+
+		LocationVersion: loc.Version,
+		LegacyProtocols: migrations.Legacy(),
+	}
+	if includePi {
+		piConfig := make(map[string]any)
+		if err := fetchJSON(sellerCfg.PiBase+"/config", &piConfig); err != nil {
+			log.Printf("device: unable to fetch Pi /config: %v", err)
+		} else {
+			desc.PiConfig = piConfig
+		}
+	}
+	return desc
+}
+
+func (d deviceDescriptor) hash() (string, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func deviceHandler(w http.ResponseWriter, r *http.Request) {
+	desc := currentDevice(true)
+	hash, err := desc.hash()
+	if err != nil {
+		writeJSONError(w, ErrInternal.Wrap(err))
+		return
+	}
+	w.Header().Set("ETag", `"`+hash+`"`)
+	writeJSON(w, http.StatusOK, desc)
+}
+
+// publishRegistration posts the device descriptor to our stdout topic so
+// buyers and registries can check provenance without reaching the node.
+func publishRegistration() error {
+	desc := currentDevice(true)
+	hash, err := desc.hash()
+	if err != nil {
+		return fmt.Errorf("hash descriptor: %w", err)
+	}
+	msg := registrationMessage{
+		MessageType:    "localsenseRegistration",
+		Device:         desc,
+		DescriptorHash: hash,
+		LicenseHash:    licenseHash(),
+		Time:           time.Now().UTC(),
+		Version:        "0.1",
+		PublicKey:      commonlib.MyPublicKey.StringRaw(),
+		StdInTopic:     commonlib.MyStdIn.String(),
+		Price:          pricingSummary(),
+		Maintenance:    maintenanceStatus(),
+	}
+	if p2p := dialInfo(); p2p != nil {
+		msg.PeerID, msg.Multiaddrs = p2p.PeerID, p2p.Addrs
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal registration: %w", err)
+	}
+	if err := sendToTopic(commonlib.MyStdOut, data, "registration"); errors.Is(err, errHederaQueued) {
+		log.Printf("neuron-seller: device registration queued until Hedera is reachable (sha256=%s)", hash)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("send registration: %w", err)
+	}
+	log.Printf("neuron-seller: published device registration (sha256=%s)", hash)
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"strings"
+)
+
+// Community deployments can put differential-privacy noise on the
+// aggregates they serve: the 1m/1h buckets on /history and GraphQL and the
+// per-kind figures on /stats. DP_MECHANISM picks laplace or gaussian (off
+// when unset); DP_EPSILON is the budget for one bucket, split evenly over
+// its count, min, max and mean, and DP_DELTA the gaussian mechanism's
+// delta.
+//
+// A kind's sensitivity is <KIND>_DP_SENSITIVITY, or the width of its valid
+// range (<KIND>_MIN to <KIND>_MAX); count's is 1 and mean's the kind's over
+// the bucket's count. Aggregates of a kind with neither are withheld, as
+// no noise would hide one sample in them. Every noised bucket says how in
+// its provenance, under "noise". Raw samples are never noised.
+
+type dpMechanism struct {
+	Mechanism   string             `json:"mechanism"`
+	Epsilon     float64            `json:"epsilon"`
+	Delta       float64            `json:"delta,omitempty"`
+	Sensitivity map[string]float64 `json:"sensitivity"` // per kind
+
+	ranges map[string]*valueRange
+}
+
+var aggregateNoise *dpMechanism
+
+func loadAggregateNoise() {
+	mech := strings.ToLower(getEnvOrDefault("DP_MECHANISM", ""))
+	if mech == "" || mech == "off" {
+		return
+	}
+	if mech != "laplace" && mech != "gaussian" {
+		log.Fatalf("dp: DP_MECHANISM must be laplace or gaussian, got %q", mech)
+	}
+	m := &dpMechanism{
+		Mechanism:   mech,
+		Epsilon:     parseEnvFloat("DP_EPSILON", 1),
+		Sensitivity: map[string]float64{},
+		ranges:      map[string]*valueRange{},
+	}
+	if m.Epsilon <= 0 {
+		log.Fatalf("dp: DP_EPSILON must be positive")
+	}
+	if mech == "gaussian" {
+		m.Delta = parseEnvFloat("DP_DELTA", 1e-5)
+		if m.Delta <= 0 || m.Delta >= 1 {
+			log.Fatalf("dp: DP_DELTA must be between 0 and 1")
+		}
+	}
+	cfg, err := getNeuronSellerConfig()
+	if err != nil {
+		log.Fatalf("dp: %v", err)
+	}
+	for _, k := range cfg.ensureDefaults().Kinds {
+		m.ranges[k.Name] = k.Range
+		key := strings.ToUpper(k.Name) + "_DP_SENSITIVITY"
+		switch {
+		case getEnvOrDefault(key, "") != "":
+			s := parseEnvFloat(key, 0)
+			if s <= 0 {
+				log.Fatalf("dp: %s must be positive", key)
+			}
+			m.Sensitivity[k.Name] = s
+		case k.Range != nil && k.Range.Min != nil && k.Range.Max != nil && *k.Range.Max > *k.Range.Min:
+			m.Sensitivity[k.Name] = *k.Range.Max - *k.Range.Min
+		default:
+			log.Printf("neuron-seller: dp: %s has no sensitivity or valid range, its aggregates are withheld", k.Name)
+		}
+	}
+	aggregateNoise = m
+	log.Printf("DP noise  : %s, epsilon %g per bucket", mech, m.Epsilon)
+}
+
+// noise draws from the mechanism for a query of sensitivity s, at a quarter
+// of the bucket's epsilon.
+func (m *dpMechanism) noise(s float64) float64 {
+	eps := m.Epsilon / 4
+	if m.Mechanism == "gaussian" {
+		sigma := s * math.Sqrt(2*math.Log(1.25/m.Delta)) / eps
+		return rand.NormFloat64() * sigma
+	}
+	u := rand.Float64() - 0.5
+	return -s / eps * math.Copysign(math.Log(1-2*math.Abs(u)), u)
+}
+
+// params is what goes into a noised bucket's provenance.
+func (m *dpMechanism) params(kind string) map[string]any {
+	p := map[string]any{
+		"mechanism":   m.Mechanism,
+		"epsilon":     m.Epsilon,
+		"split":       []string{"count", "min", "max", "mean"},
+		"sensitivity": m.Sensitivity[kind],
+	}
+	if m.Delta > 0 {
+		p["delta"] = m.Delta
+	}
+	return p
+}
+
+// Bucket noises rec, clamping the figures back into the kind's valid
+// range; false means rec has to be withheld.
+func (m *dpMechanism) Bucket(rec aggregateRecord) (aggregateRecord, bool) {
+	if m == nil {
+		return rec, true
+	}
+	s, ok := m.Sensitivity[rec.Kind]
+	if !ok {
+		return rec, false
+	}
+	clamp := func(v float64) float64 {
+		if r := m.ranges[rec.Kind]; r != nil {
+			if r.Min != nil {
+				v = max(v, *r.Min)
+			}
+			if r.Max != nil {
+				v = min(v, *r.Max)
+			}
+		}
+		return v
+	}
+	count := rec.Count
+	rec.Count = max(int(math.Round(float64(count)+m.noise(1))), 0)
+	rec.Min = clamp(rec.Min + m.noise(s))
+	rec.Max = clamp(rec.Max + m.noise(s))
+	rec.Mean = clamp(rec.Mean + m.noise(s/float64(max(count, 1))))
+	// Sequence numbers would give the true count away.
+	rec.FirstSeq, rec.LastSeq = 0, 0
+	if rec.Provenance != nil {
+		prov := *rec.Provenance
+		prov.Params = maps.Clone(prov.Params)
+		prov.Params["noise"] = m.params(rec.Kind)
+		prov.Sources = nil
+		rec.Provenance = &prov
+	}
+	return rec, true
+}
+
+// Buckets noises recs, leaving out what has to be withheld.
+func (m *dpMechanism) Buckets(recs []aggregateRecord) []aggregateRecord {
+	if m == nil {
+		return recs
+	}
+	out := recs[:0]
+	for _, rec := range recs {
+		if rec, ok := m.Bucket(rec); ok {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The stream loop emits every kind in one of three ways at once:
+//
+//   - periodic: on the kind's own interval, <KIND>_INTERVAL_SECONDS
+//     (default NEURON_STREAM_INTERVAL_SECONDS), stretched while saving power
+//     and jittered. Kinds with the same interval share their rounds, so the
+//     Pi is read once for all of them. While the Pi pushes readings, kinds
+//     are sampled from the pushes instead: every push, or at most once per
+//     interval for kinds with an interval of their own and while saving
+//     power.
+//   - event: event kinds (see events.go) are read every base interval and
+//     every push and go out when their state changes.
+//   - on demand: the sample_now command and POST /admin/sample take a
+//     fresh reading of one periodic kind, or all of them, right away.
+//
+// Fused kinds go out whenever the kind they fuse does.
+
+type kindClock struct {
+	interval time.Duration
+	explicit bool // set with <KIND>_INTERVAL_SECONDS
+	event    bool
+	next     time.Time
+	last     time.Time
+}
+
+type emissionScheduler struct {
+	mu     sync.Mutex
+	kinds  map[string]*kindClock
+	order  []string
+	demand chan string
+}
+
+var emissions *emissionScheduler
+
+func loadEmissions() {
+	cfg, err := getNeuronSellerConfig()
+	if err != nil {
+		return
+	}
+	cfg = cfg.ensureDefaults()
+	e := &emissionScheduler{kinds: make(map[string]*kindClock), demand: make(chan string, 8)}
+	for _, k := range cfg.Kinds {
+		if k.FusedFrom != "" {
+			continue
+		}
+		c := &kindClock{interval: cfg.StreamInterval, event: k.Event}
+		if secs := parseEnvInt(strings.ToUpper(k.Name)+"_INTERVAL_SECONDS", 0); secs > 0 && !k.Event {
+			c.interval, c.explicit = time.Duration(secs)*time.Second, true
+			log.Printf("Emission  : %s every %s", k.Name, c.interval)
+		}
+		e.kinds[k.Name] = c
+		e.order = append(e.order, k.Name)
+	}
+	emissions = e
+}
+
+// Start arms every kind's first round.
+func (e *emissionScheduler) Start(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	first := map[time.Duration]time.Duration{}
+	for _, c := range e.kinds {
+		d, ok := first[c.interval]
+		if !ok {
+			d = firstTick(power.Interval(c.interval))
+			first[c.interval] = d
+		}
+		c.next = now.Add(d)
+	}
+}
+
+// Wait is how long until the next kind is due.
+func (e *emissionScheduler) Wait(now time.Time) time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var next time.Time
+	for _, c := range e.kinds {
+		if next.IsZero() || c.next.Before(next) {
+			next = c.next
+		}
+	}
+	return max(next.Sub(now), 0)
+}
+
+// Due returns the kinds whose round has come and schedules their next one.
+func (e *emissionScheduler) Due(now time.Time) map[string]bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	due := map[string]bool{}
+	delay := map[time.Duration]time.Duration{}
+	for name, c := range e.kinds {
+		if c.next.After(now) {
+			continue
+		}
+		d, ok := delay[c.interval]
+		if !ok {
+			d = jittered(power.Interval(c.interval))
+			delay[c.interval] = d
+		}
+		c.next = now.Add(d)
+		c.last = now
+		due[name] = true
+	}
+	return due
+}
+
+// PerMinute is how many periodic samples of kind go out a minute to a
+// buyer that asked for one every buyerInterval (0 for none); 0 for event
+// kinds.
+func (e *emissionScheduler) PerMinute(kind string, buyerInterval time.Duration) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	c, ok := e.kinds[kind]
+	if !ok || c.event {
+		return 0
+	}
+	iv := max(power.Interval(c.interval), buyerInterval)
+	if iv <= 0 {
+		return 0
+	}
+	return float64(time.Minute) / float64(iv)
+}
+
+// PushDue returns the kinds to sample from a pushed document.
+func (e *emissionScheduler) PushDue(now time.Time) map[string]bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	saving := power.Mode() != powerNormal
+	due := map[string]bool{}
+	for name, c := range e.kinds {
+		var gap time.Duration
+		switch {
+		case c.event:
+		case saving:
+			gap = power.Interval(c.interval)
+		case c.explicit:
+			gap = c.interval
+		}
+		if now.Sub(c.last) < gap {
+			continue
+		}
+		c.last = now
+		due[name] = true
+	}
+	return due
+}
+
+// Demand asks for a sample of kind ("" for every periodic kind) now.
+func (e *emissionScheduler) Demand(kind string) error {
+	if e == nil {
+		return fmt.Errorf("P2P streaming is not enabled")
+	}
+	if kind != "" {
+		c, ok := e.kinds[kind]
+		if !ok {
+			return fmt.Errorf("unknown kind %q", kind)
+		}
+		if c.event {
+			return fmt.Errorf("%s is an event kind, sent on change only", kind)
+		}
+	}
+	select {
+	case e.demand <- kind:
+		return nil
+	default:
+		return fmt.Errorf("too many pending on-demand samples")
+	}
+}
+
+// Demands delivers on-demand requests; a nil scheduler's never does.
+func (e *emissionScheduler) Demands() <-chan string {
+	if e == nil {
+		return nil
+	}
+	return e.demand
+}
+
+// Demanded is the set of kinds an on-demand request covers.
+func (e *emissionScheduler) Demanded(kind string) map[string]bool {
+	if kind != "" {
+		return map[string]bool{kind: true}
+	}
+	due := map[string]bool{}
+	for name, c := range e.kinds {
+		if !c.event {
+			due[name] = true
+		}
+	}
+	return due
+}
+
+// Status lists each kind's mode and timing for /status.
+func (e *emissionScheduler) Status() []map[string]any {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]map[string]any, 0, len(e.order))
+	for _, name := range e.order {
+		c := e.kinds[name]
+		mode := "periodic"
+		if c.event {
+			mode = "event"
+		}
+		entry := map[string]any{
+			"kind":             name,
+			"mode":             mode,
+			"interval_seconds": power.Interval(c.interval).Seconds(),
+			"next":             c.next.UTC().Format(time.RFC3339),
+		}
+		if !c.last.IsZero() {
+			entry["last"] = c.last.UTC().Format(time.RFC3339)
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+// sample_now {"kind": ""} sends a fresh sample of one periodic kind, or of
+// all of them, to their buyers right away.
+func sampleNowCommand(cmd commandEnvelope) (any, error) {
+	var p struct {
+		Kind string `json:"kind"`
+	}
+	if err := decodeParams(cmd, &p); err != nil {
+		return nil, err
+	}
+	if err := emissions.Demand(p.Kind); err != nil {
+		return nil, commandErrorf(commandErrFailed, "%v", err)
+	}
+	return map[string]any{"kinds": sortedKeys(emissions.Demanded(p.Kind))}, nil
+}
+
+// POST /admin/sample[?kind=] – take and send a sample now.
+func adminSampleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, ErrMethodNotAllowed)
+		return
+	}
+	kind := r.URL.Query().Get("kind")
+	if err := emissions.Demand(kind); err != nil {
+		writeJSONError(w, ErrConflict.Wrap(err))
+		return
+	}
+	log.Printf("[/admin/sample] on-demand sample of %q requested by %s", kind, r.RemoteAddr)
+	writeJSON(w, http.StatusAccepted, map[string]any{"kinds": sortedKeys(emissions.Demanded(kind))})
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Errors the node reports carry a stable code next to the message, so
+// clients branch on the code and show the message. HTTP error bodies are
+// {"error": "<message>", "code": "<code>", "request_id": "<id>"} with the
+// code's status; command replies on topics carry it as error.code (next to
+// the command codes in commands.go), and fleet messages as error_code.
+// Codes never change meaning once shipped; add a new one instead.
+//
+// Handlers return one of these, with detail added through With or Wrap:
+//
+//	writeJSONError(w, ErrBadRequest.With("invalid from: "+err.Error()))
+//	writeJSONError(w, ErrInternal.Wrap(err))
+
+// apiError is one kind of error in the taxonomy.
+type apiError struct {
+	code   string
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string { return e.msg }
+
+// Code is the stable string code.
+func (e *apiError) Code() string { return e.code }
+
+// Status is the HTTP status the code is served with.
+func (e *apiError) Status() int { return e.status }
+
+// With returns an error of this kind with msg as its message.
+func (e *apiError) With(msg string) error {
+	return &detailedError{kind: e, msg: msg}
+}
+
+// Wrap returns err as an error of this kind, unless it already has a kind.
+func (e *apiError) Wrap(err error) error {
+	var kind *apiError
+	if errors.As(err, &kind) {
+		return err
+	}
+	return &detailedError{kind: e, msg: err.Error(), cause: err}
+}
+
+var (
+	ErrBadRequest       = &apiError{"bad_request", http.StatusBadRequest, "bad request"}
+	ErrPeerInvalid      = &apiError{"peer_invalid", http.StatusBadRequest, "not a valid buyer key or account"}
+	ErrUnauthorized     = &apiError{"unauthorized", http.StatusUnauthorized, "admin token required"}
+	ErrPaymentRequired  = &apiError{"payment_required", http.StatusPaymentRequired, "the buyer has no paid stream"}
+	ErrNotFound         = &apiError{"not_found", http.StatusNotFound, "not found"}
+	ErrDisabled         = &apiError{"disabled", http.StatusNotFound, "disabled on this node"}
+	ErrMethodNotAllowed = &apiError{"method_not_allowed", http.StatusMethodNotAllowed, "method not allowed"}
+	ErrConflict         = &apiError{"conflict", http.StatusConflict, "conflict"}
+	ErrRateLimited      = &apiError{"rate_limited", http.StatusTooManyRequests, "rate limited"}
+	ErrInternal         = &apiError{"internal", http.StatusInternalServerError, "internal error"}
+	ErrPiUnreachable    = &apiError{"pi_unreachable", http.StatusBadGateway, "the Pi is unreachable"}
+	ErrUpstream         = &apiError{"upstream_failed", http.StatusBadGateway, "upstream request failed"}
+	ErrUnavailable      = &apiError{"unavailable", http.StatusServiceUnavailable, "temporarily unavailable"}
+	ErrOverloaded       = &apiError{"overloaded", http.StatusServiceUnavailable, "node is over its memory budget, retry later"}
+)
+
+// detailedError is an apiError kind with its own message.
+type detailedError struct {
+	kind  *apiError
+	msg   string
+	cause error
+}
+
+func (e *detailedError) Error() string { return e.msg }
+
+func (e *detailedError) Unwrap() []error {
+	if e.cause != nil {
+		return []error{e.kind, e.cause}
+	}
+	return []error{e.kind}
+}
+
+// errorKind is err's kind, or fallback when it has none.
+func errorKind(err error, fallback *apiError) *apiError {
+	var kind *apiError
+	if errors.As(err, &kind) {
+		return kind
+	}
+	return fallback
+}
+
+// errorBody is the JSON form of err.
+func errorBody(err error) map[string]any {
+	return map[string]any{"error": err.Error(), "code": errorKind(err, ErrInternal).code}
+}
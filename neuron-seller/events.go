@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event kinds (PIR motion, door contacts, occupancy) are sent when their
+// state changes, not every tick: a reading turning non-zero is a "rise", one
+// turning zero a "fall", and a reading that repeats the last state sends
+// nothing. The first reading only sets the state. Changes within
+// EVENT_DEBOUNCE_MS of the last one are contact bounce or PIR retriggers
+// and are dropped (counted as debounced). Every event payload carries an
+// event block with the number of rises in the current EVENT_WINDOW_SECONDS
+// window (aligned to the clock).
+//
+// Fields motion, pir, occupancy, door and door_open are event kinds by
+// default; <KIND>_EVENT=true|false overrides. Their readings arrive with the
+// Pi's /metrics polls, so for events to go out as they happen rather than at
+// the next tick, the Pi should push them (PI_SUBSCRIBE_PATH).
+
+type sampleEvent struct {
+	Edge          string `json:"edge"` // rise or fall
+	Count         int    `json:"count"`
+	Debounced     int    `json:"debounced,omitempty"`
+	WindowStart   int64  `json:"window_start"`
+	WindowSeconds int    `json:"window_seconds"`
+}
+
+// eventState follows one event kind.
+type eventState struct {
+	seen        bool
+	active      bool
+	lastChange  time.Time
+	windowStart time.Time
+	count       int
+	debounced   int
+}
+
+var (
+	eventDebounce = 2 * time.Second
+	eventWindow   = 5 * time.Minute
+	eventStatesMu sync.Mutex
+	eventStates   = map[string]*eventState{}
+	lastEvents    = map[string]*sampleEvent{}
+)
+
+// loadKindEvents reads <KIND>_EVENT for each kind.
+func loadKindEvents(kinds []sensorKind) []sensorKind {
+	for i := range kinds {
+		def := false
+		switch kinds[i].Field {
+		case "motion", "pir", "occupancy", "door", "door_open":
+			def = true
+		}
+		kinds[i].Event = parseEnvBool(strings.ToUpper(kinds[i].Name)+"_EVENT", def)
+	}
+	return kinds
+}
+
+func loadEvents() {
+	eventDebounce = time.Duration(max(parseEnvInt("EVENT_DEBOUNCE_MS", 2000), 0)) * time.Millisecond
+	eventWindow = time.Duration(max(parseEnvInt("EVENT_WINDOW_SECONDS", 300), 1)) * time.Second
+	cfg, err := getNeuronSellerConfig()
+	if err != nil {
+		return
+	}
+	for _, k := range cfg.Kinds {
+		if k.Event {
+			log.Printf("Events    : %s sent on change (debounce %s, counted per %s)", k.Name, eventDebounce, eventWindow)
+		}
+	}
+}
+
+// observe takes one reading and returns the event it makes, if any.
+func (e *eventState) observe(value float64, at time.Time) (*sampleEvent, bool) {
+	if start := at.Truncate(eventWindow); !start.Equal(e.windowStart) {
+		e.windowStart, e.count, e.debounced = start, 0, 0
+	}
+	active := value != 0
+	if !e.seen {
+		e.seen, e.active, e.lastChange = true, active, at
+		return nil, false
+	}
+	if active == e.active {
+		return nil, false
+	}
+	if at.Sub(e.lastChange) < eventDebounce {
+		e.debounced++
+		return nil, false
+	}
+	e.active, e.lastChange = active, at
+	edge := "fall"
+	if active {
+		edge = "rise"
+		e.count++
+	}
+	return &sampleEvent{
+		Edge:          edge,
+		Count:         e.count,
+		Debounced:     e.debounced,
+		WindowStart:   e.windowStart.Unix(),
+		WindowSeconds: int(eventWindow / time.Second),
+	}, true
+}
+
+// detectEvent feeds a reading of an event kind to its state; true when it
+// is an event to send.
+func detectEvent(kind sensorKind, value float64, at time.Time) bool {
+	eventStatesMu.Lock()
+	defer eventStatesMu.Unlock()
+	e, ok := eventStates[kind.Name]
+	if !ok {
+		e = &eventState{}
+		eventStates[kind.Name] = e
+	}
+	ev, ok := e.observe(value, at)
+	if ok {
+		lastEvents[kind.Name] = ev
+	}
+	return ok
+}
+
+// lastEvent is the kind's last event.
+func lastEvent(kind string) *sampleEvent {
+	eventStatesMu.Lock()
+	defer eventStatesMu.Unlock()
+	return lastEvents[kind]
+}
+
+// appendJSON writes e as encoding/json would.
+func (e *sampleEvent) appendJSON(dst []byte) []byte {
+	dst = append(dst, `{"edge":`...)
+	dst = appendJSONString(dst, e.Edge)
+	dst = append(dst, `,"count":`...)
+	dst = strconv.AppendInt(dst, int64(e.Count), 10)
+	if e.Debounced != 0 {
+		dst = append(dst, `,"debounced":`...)
+		dst = strconv.AppendInt(dst, int64(e.Debounced), 10)
+	}
+	dst = append(dst, `,"window_start":`...)
+	dst = strconv.AppendInt(dst, e.WindowStart, 10)
+	dst = append(dst, `,"window_seconds":`...)
+	dst = strconv.AppendInt(dst, int64(e.WindowSeconds), 10)
+	return append(dst, '}')
+}
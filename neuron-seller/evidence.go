@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// An evidence bundle packages everything the seller can show about what a
+// buyer was sent over a time range, for settling payment disputes: the
+// delivery records, the signed sample payloads they refer to, Merkle proofs
+// tying each sample to a root anchored on HCS, the audit entries that
+// mention the buyer, and the operator's annotations on the range. The
+// bundle is signed with the sample signing key over sha256 of its JSON
+// encoding with digest and signature left empty, so a third party can check
+// it was not edited after export.
+
+const evidenceVersion = 1
+
+type evidenceProof struct {
+	Kind        string      `json:"kind"`
+	Seq         uint64      `json:"seq"`
+	LeafHash    string      `json:"leaf_hash"`
+	LeafIndex   int         `json:"leaf_index"`
+	Path        []proofStep `json:"path"`
+	WindowStart int64       `json:"window_start"`
+}
+
+type evidenceBundle struct {
+	Version       int               `json:"version"`
+	SellerID      string            `json:"seller_id"`
+	Network       string            `json:"network"`
+	StdOutTopic   string            `json:"stdout_topic,omitempty"` // where anchors were published
+	Buyer         string            `json:"buyer"`
+	From          int64             `json:"from"`
+	To            int64             `json:"to"`
+	GeneratedAt   time.Time         `json:"generated_at"`
+	SigningPubKey string            `json:"signing_pubkey,omitempty"`
+	Deliveries    []deliveryRecord  `json:"deliveries"`
+	Samples       []json.RawMessage `json:"samples"`
+	Anchors       []anchorWindow    `json:"anchors"`
+	Proofs        []evidenceProof   `json:"proofs"`
+	Audit         []auditEntry      `json:"audit"`
+	Annotations   []annotation      `json:"annotations,omitempty"` // operator notes on the range
+	Missing       []string          `json:"missing,omitempty"`     // what could not be included, and why
+	Digest        string            `json:"digest"`
+	Signature     string            `json:"signature,omitempty"`
+}
+
+type sampleKey struct {
+	kind string
+	seq  uint64
+}
+
+func buildEvidenceBundle(buyer string, from, to time.Time) (*evidenceBundle, error) {
+	if deliveries == nil {
+		return nil, fmt.Errorf("delivery log disabled (DELIVERY_LOG_ENABLE=false)")
+	}
+	b := &evidenceBundle{
+		Version:       evidenceVersion,
+		SellerID:      sellerCfg.SellerID,
+		Network:       hederaNet.Name,
+		Buyer:         buyer,
+		From:          from.Unix(),
+		To:            to.Unix(),
+		GeneratedAt:   time.Now().UTC(),
+		SigningPubKey: signingPublicKey(),
+	}
+	if neuronStreamingEnabled() {
+		b.StdOutTopic = commonlib.MyStdOut.String()
+	}
+
+	var err error
+	if b.Deliveries, err = deliveries.Query(buyer, from, to); err != nil {
+		return nil, fmt.Errorf("deliveries: %w", err)
+	}
+	delivered := make(map[sampleKey]bool, len(b.Deliveries))
+	var sampleFrom, sampleTo int64 = to.Unix(), from.Unix()
+	peers := map[string]bool{}
+	for _, d := range b.Deliveries {
+		delivered[sampleKey{d.Kind, d.Seq}] = true
+		sampleFrom, sampleTo = min(sampleFrom, d.SampleTs), max(sampleTo, d.SampleTs)
+		peers[d.Peer] = true
+	}
+
+	b.collectSamples(delivered, sampleFrom, sampleTo)
+	b.collectProofs()
+	if err := b.collectAudit(peers, from, to); err != nil {
+		b.Missing = append(b.Missing, "audit: "+err.Error())
+	}
+	b.Annotations = annotations.Overlapping(from, to, "")
+	return b, b.sign()
+}
+
+func (b *evidenceBundle) collectSamples(delivered map[sampleKey]bool, from, to int64) {
+	if len(delivered) == 0 {
+		return
+	}
+	if history == nil {
+		b.Missing = append(b.Missing, "samples: history disabled (HISTORY_ENABLE=false)")
+		return
+	}
+	records, err := history.Query(time.Unix(from, 0), time.Unix(to+1, 0), "", 0)
+	if err != nil {
+		b.Missing = append(b.Missing, "samples: "+err.Error())
+		return
+	}
+	found := 0
+	for _, rec := range records {
+		if delivered[sampleKey{rec.Kind, rec.Seq}] {
+			b.Samples = append(b.Samples, rec.Payload)
+			found++
+		}
+	}
+	if found < len(delivered) {
+		b.Missing = append(b.Missing, fmt.Sprintf("samples: %d of %d delivered samples are past raw history retention", len(delivered)-found, len(delivered)))
+	}
+}
+
+func (b *evidenceBundle) collectProofs() {
+	if len(b.Deliveries) == 0 {
+		return
+	}
+	if anchors == nil {
+		b.Missing = append(b.Missing, "proofs: anchoring disabled (ANCHOR_WINDOW_MINUTES=0)")
+		return
+	}
+	windows := map[int64]bool{}
+	proven := map[sampleKey]bool{}
+	unproven := 0
+	for _, d := range b.Deliveries {
+		key := sampleKey{d.Kind, d.Seq}
+		if proven[key] {
+			continue // delivered to more than one of the buyer's streams
+		}
+		proven[key] = true
+		win, leaf, idx, path, err := anchors.Proof(d.Kind, d.Seq)
+		if err != nil {
+			unproven++
+			continue
+		}
+		b.Proofs = append(b.Proofs, evidenceProof{Kind: d.Kind, Seq: d.Seq, LeafHash: leaf.Hash, LeafIndex: idx, Path: path, WindowStart: win.Start})
+		if !windows[win.Start] {
+			windows[win.Start] = true
+			b.Anchors = append(b.Anchors, win)
+		}
+	}
+	if unproven > 0 {
+		b.Missing = append(b.Missing, fmt.Sprintf("proofs: %d samples are in no anchored window", unproven))
+	}
+}
+
+// collectAudit keeps entries in range whose actor is the buyer or whose
+// detail names the buyer or one of its peers.
+func (b *evidenceBundle) collectAudit(peers map[string]bool, from, to time.Time) error {
+	if audit == nil {
+		return fmt.Errorf("audit log disabled (AUDIT_ENABLE=false)")
+	}
+	entries, err := audit.read(0, "", 0)
+	if err != nil {
+		return err
+	}
+	needles := [][]byte{[]byte(rawKey(b.Buyer)), []byte(b.Buyer)}
+	for p := range peers {
+		needles = append(needles, []byte(p))
+	}
+	for _, e := range entries {
+		if e.Time.Before(from) || !e.Time.Before(to) {
+			continue
+		}
+		match := e.Actor == rawKey(b.Buyer)
+		for _, n := range needles {
+			match = match || (len(n) > 0 && bytes.Contains(e.Detail, n))
+		}
+		if match {
+			b.Audit = append(b.Audit, e)
+		}
+	}
+	return nil
+}
+
+// sign sets Digest and, when a signing key is loaded, Signature.
+func (b *evidenceBundle) sign() error {
+	b.Digest, b.Signature = "", ""
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	b.Digest = hex.EncodeToString(sum[:])
+	if signer != nil {
+		b.Signature = hex.EncodeToString(ed25519.Sign(signer.key, sum[:]))
+	}
+	return nil
+}
+
+// GET /admin/evidence?buyer=&from=&to= exports the evidence bundle for a
+// buyer given as public key, EVM address or peer ID; from/to take RFC3339 or
+// unix seconds and default to the last 24 hours.
+func adminEvidenceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, ErrMethodNotAllowed.With("use GET"))
+		return
+	}
+	q := r.URL.Query()
+	buyer := q.Get("buyer")
+	if buyer == "" {
+		writeJSONError(w, ErrBadRequest.With("buyer is required"))
+		return
+	}
+	now := time.Now()
+	to, err := parseTimeParam(q.Get("to"), now)
+	if err != nil {
+		writeJSONError(w, ErrBadRequest.With("invalid to: "+err.Error()))
+		return
+	}
+	from, err := parseTimeParam(q.Get("from"), to.Add(-24*time.Hour))
+	if err != nil {
+		writeJSONError(w, ErrBadRequest.With("invalid from: "+err.Error()))
+		return
+	}
+
+	bundle, err := buildEvidenceBundle(buyer, from, to)
+	if err != nil {
+		writeJSONError(w, ErrUnavailable.Wrap(err))
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="evidence-%s-%d.json"`, sellerCfg.SellerID, bundle.From))
+	writeJSON(w, http.StatusOK, bundle)
+}
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Filters and derived fields are small expressions in config, evaluated
+// per sample:
+//
+//	SAMPLE_FILTER=brightness > 0.1 && hour(ts) > 6
+//	BRIGHTNESS_SAMPLE_FILTER=value < 900
+//	DERIVED_FIELDS=dark=value < 0.1; lux_k=round(value / 1000, 2)
+//
+// A kind's <KIND>_FILTER, or else SAMPLE_FILTER, must be true for the
+// sample to be sent (pipeline stage "filter"). DERIVED_FIELDS are
+// name=expression pairs, separated by semicolons, whose results go out in
+// the payload's "derived" object (stage "derive").
+//
+// Expressions have numbers, 'strings', true and false; + - * / %,
+// comparisons, == and !=, && || !, cond ? a : b and parentheses. Names are
+// value (the sample), raw (the reading before unit conversion), kind,
+// field, ts (Unix seconds) and any field of the Pi's metrics document.
+// Functions: hour, minute and weekday (0 = Sunday) of a ts in SCHEDULE_TZ,
+// abs, floor, ceil, sqrt, log, pow, min, max, round(x[, digits]) and
+// has('field').
+
+type exprNode interface {
+	eval(env exprEnv) (any, error)
+}
+
+// exprEnv resolves names; ok is false for an unknown one.
+type exprEnv func(name string) (v any, ok bool)
+
+type expr struct {
+	src  string
+	root exprNode
+}
+
+func compileExpr(src string) (*expr, error) {
+	p := &exprParser{src: src}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos].text)
+	}
+	return &expr{src: src, root: root}, nil
+}
+
+// Eval runs the expression.
+func (e *expr) Eval(env exprEnv) (any, error) {
+	return e.root.eval(env)
+}
+
+// Bool runs a predicate.
+func (e *expr) Bool(env exprEnv) (bool, error) {
+	v, err := e.root.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%q is not true or false", e.src)
+	}
+	return b, nil
+}
+
+// --- tokens ---
+
+type exprTokKind int
+
+const (
+	tokNum exprTokKind = iota
+	tokStr
+	tokIdent
+	tokOp
+)
+
+type exprTok struct {
+	kind exprTokKind
+	text string
+	num  float64
+}
+
+type exprParser struct {
+	src  string
+	toks []exprTok
+	pos  int
+}
+
+func (p *exprParser) tokenize() error {
+	s := p.src
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c >= '0' && c <= '9' || c == '.':
+			j := i
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.' || s[j] == 'e' || s[j] == 'E' ||
+				(s[j] == '-' || s[j] == '+') && j > i && (s[j-1] == 'e' || s[j-1] == 'E')) {
+				j++
+			}
+			f, err := strconv.ParseFloat(s[i:j], 64)
+			if err != nil {
+				return fmt.Errorf("bad number %q", s[i:j])
+			}
+			p.toks = append(p.toks, exprTok{kind: tokNum, text: s[i:j], num: f})
+			i = j
+		case c == '\'' || c == '"':
+			j := strings.IndexByte(s[i+1:], s[i])
+			if j < 0 {
+				return fmt.Errorf("unterminated string")
+			}
+			p.toks = append(p.toks, exprTok{kind: tokStr, text: s[i+1 : i+1+j]})
+			i += j + 2
+		case c == '_' || unicode.IsLetter(c):
+			j := i
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			p.toks = append(p.toks, exprTok{kind: tokIdent, text: s[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, o := range []string{"&&", "||", "==", "!=", "<=", ">=", "+", "-", "*", "/", "%", "<", ">", "!", "(", ")", ",", "?", ":"} {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return fmt.Errorf("unexpected %q", s[i:i+1])
+			}
+			p.toks = append(p.toks, exprTok{kind: tokOp, text: op})
+			i += len(op)
+		}
+	}
+	return nil
+}
+
+func (p *exprParser) peekOp(ops ...string) string {
+	if p.pos >= len(p.toks) || p.toks[p.pos].kind != tokOp {
+		return ""
+	}
+	for _, op := range ops {
+		if p.toks[p.pos].text == op {
+			return op
+		}
+	}
+	return ""
+}
+
+func (p *exprParser) expect(op string) error {
+	if p.peekOp(op) == "" {
+		if p.pos >= len(p.toks) {
+			return fmt.Errorf("expected %q at end", op)
+		}
+		return fmt.Errorf("expected %q, got %q", op, p.toks[p.pos].text)
+	}
+	p.pos++
+	return nil
+}
+
+// --- grammar, loosest first ---
+
+func (p *exprParser) parseTernary() (exprNode, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil || p.peekOp("?") == "" {
+		return cond, err
+	}
+	p.pos++
+	a, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	b, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	return exprCond{cond, a, b}, nil
+}
+
+var exprLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) parseBinary(level int) (exprNode, error) {
+	if level == len(exprLevels) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peekOp(exprLevels[level]...)
+		if op == "" {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op, left, right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if op := p.peekOp("-", "!"); op != "" {
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprUnary{op, x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	if p.pos >= len(p.toks) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	switch t.kind {
+	case tokNum:
+		return exprLit{t.num}, nil
+	case tokStr:
+		return exprLit{t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return exprLit{true}, nil
+		case "false":
+			return exprLit{false}, nil
+		}
+		if p.peekOp("(") == "" {
+			return exprName(t.text), nil
+		}
+		p.pos++
+		fn, ok := exprFuncs[t.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %s", t.text)
+		}
+		call := exprCall{name: t.text, fn: fn}
+		for p.peekOp(")") == "" {
+			if len(call.args) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+		}
+		p.pos++
+		return call, nil
+	}
+	if t.text == "(" {
+		x, err := p.parseTernary()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+// --- evaluation ---
+
+type exprLit struct{ v any }
+
+func (l exprLit) eval(exprEnv) (any, error) { return l.v, nil }
+
+type exprName string
+
+func (n exprName) eval(env exprEnv) (any, error) {
+	v, ok := env(string(n))
+	if !ok {
+		return nil, fmt.Errorf("unknown name %s", string(n))
+	}
+	return v, nil
+}
+
+type exprUnary struct {
+	op string
+	x  exprNode
+}
+
+func (u exprUnary) eval(env exprEnv) (any, error) {
+	v, err := u.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if u.op == "!" {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("! needs true or false")
+		}
+		return !b, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("- needs a number")
+	}
+	return -f, nil
+}
+
+type exprBinary struct {
+	op   string
+	l, r exprNode
+}
+
+func (b exprBinary) eval(env exprEnv) (any, error) {
+	l, err := b.l.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	// && and || don't evaluate their right side needlessly.
+	if b.op == "&&" || b.op == "||" {
+		lb, ok := l.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs true or false", b.op)
+		}
+		if lb == (b.op == "||") {
+			return lb, nil
+		}
+		r, err := b.r.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := r.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs true or false", b.op)
+		}
+		return rb, nil
+	}
+	r, err := b.r.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch b.op {
+	case "==":
+		return l == r, nil
+	case "!=":
+		return l != r, nil
+	}
+	if ls, ok := l.(string); ok {
+		rs, ok := r.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s needs two strings or two numbers", b.op)
+		}
+		switch b.op {
+		case "+":
+			return ls + rs, nil
+		case "<":
+			return ls < rs, nil
+		case "<=":
+			return ls <= rs, nil
+		case ">":
+			return ls > rs, nil
+		case ">=":
+			return ls >= rs, nil
+		}
+		return nil, fmt.Errorf("%s needs numbers", b.op)
+	}
+	lf, lok := l.(float64)
+	rf, rok := r.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("%s needs numbers", b.op)
+	}
+	switch b.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		return lf / rf, nil
+	case "%":
+		return math.Mod(lf, rf), nil
+	case "<":
+		return lf < rf, nil
+	case "<=":
+		return lf <= rf, nil
+	case ">":
+		return lf > rf, nil
+	case ">=":
+		return lf >= rf, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", b.op)
+}
+
+type exprCond struct{ cond, a, b exprNode }
+
+func (c exprCond) eval(env exprEnv) (any, error) {
+	v, err := c.cond.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("?: needs true or false")
+	}
+	if b {
+		return c.a.eval(env)
+	}
+	return c.b.eval(env)
+}
+
+type exprCall struct {
+	name string
+	fn   func(env exprEnv, args []any) (any, error)
+	args []exprNode
+}
+
+func (c exprCall) eval(env exprEnv) (any, error) {
+	args := make([]any, len(c.args))
+	for i, a := range c.args {
+		v, err := a.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	v, err := c.fn(env, args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.name, err)
+	}
+	return v, nil
+}
+
+// numbers checks for n numeric arguments (or between n and m).
+func numbers(args []any, n, m int) ([]float64, error) {
+	if len(args) < n || len(args) > m {
+		if n == m {
+			return nil, fmt.Errorf("takes %d arguments", n)
+		}
+		return nil, fmt.Errorf("takes %d to %d arguments", n, m)
+	}
+	out := make([]float64, len(args))
+	for i, a := range args {
+		f, ok := a.(float64)
+		if !ok {
+			return nil, fmt.Errorf("argument %d is not a number", i+1)
+		}
+		out[i] = f
+	}
+	return out, nil
+}
+
+func math1(f func(float64) float64) func(exprEnv, []any) (any, error) {
+	return func(_ exprEnv, args []any) (any, error) {
+		x, err := numbers(args, 1, 1)
+		if err != nil {
+			return nil, err
+		}
+		return f(x[0]), nil
+	}
+}
+
+func clock(part func(t time.Time) int) func(exprEnv, []any) (any, error) {
+	return func(_ exprEnv, args []any) (any, error) {
+		x, err := numbers(args, 1, 1)
+		if err != nil {
+			return nil, err
+		}
+		return float64(part(time.Unix(int64(x[0]), 0).In(schedule.location))), nil
+	}
+}
+
+var exprFuncs map[string]func(exprEnv, []any) (any, error)
+
+func init() {
+	exprFuncs = map[string]func(exprEnv, []any) (any, error){
+		"abs":     math1(math.Abs),
+		"floor":   math1(math.Floor),
+		"ceil":    math1(math.Ceil),
+		"sqrt":    math1(math.Sqrt),
+		"log":     math1(math.Log),
+		"hour":    clock(func(t time.Time) int { return t.Hour() }),
+		"minute":  clock(func(t time.Time) int { return t.Minute() }),
+		"weekday": clock(func(t time.Time) int { return int(t.Weekday()) }),
+		"pow": func(_ exprEnv, args []any) (any, error) {
+			x, err := numbers(args, 2, 2)
+			if err != nil {
+				return nil, err
+			}
+			return math.Pow(x[0], x[1]), nil
+		},
+		"min": func(_ exprEnv, args []any) (any, error) {
+			x, err := numbers(args, 1, math.MaxInt)
+			if err != nil {
+				return nil, err
+			}
+			return slices.Min(x), nil
+		},
+		"max": func(_ exprEnv, args []any) (any, error) {
+			x, err := numbers(args, 1, math.MaxInt)
+			if err != nil {
+				return nil, err
+			}
+			return slices.Max(x), nil
+		},
+		"round": func(_ exprEnv, args []any) (any, error) {
+			x, err := numbers(args, 1, 2)
+			if err != nil {
+				return nil, err
+			}
+			if len(x) == 1 {
+				return math.Round(x[0]), nil
+			}
+			scale := math.Pow(10, math.Round(x[1]))
+			return math.Round(x[0]*scale) / scale, nil
+		},
+		"has": func(env exprEnv, args []any) (any, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("takes 1 argument")
+			}
+			name, ok := args[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("argument 1 is not a string")
+			}
+			_, ok = env(name)
+			return ok, nil
+		},
+	}
+}
+
+// --- filters and derived fields ---
+
+type derivedField struct {
+	name string
+	expr *expr
+}
+
+var (
+	sampleFilter  *expr
+	kindFilters   = map[string]*expr{}
+	derivedFields []derivedField
+)
+
+func loadExpressions() {
+	compile := func(key, src string) *expr {
+		e, err := compileExpr(src)
+		if err != nil {
+			log.Fatalf("expr: %s: %v", key, err)
+		}
+		return e
+	}
+	if src := getEnvOrDefault("SAMPLE_FILTER", ""); src != "" {
+		sampleFilter = compile("SAMPLE_FILTER", src)
+		log.Printf("Filter    : %s", src)
+	}
+	if cfg, err := getNeuronSellerConfig(); err == nil {
+		for _, k := range cfg.ensureDefaults().Kinds {
+			key := strings.ToUpper(k.Name) + "_FILTER"
+			if src := getEnvOrDefault(key, ""); src != "" {
+				kindFilters[k.Name] = compile(key, src)
+				log.Printf("Filter    : %s: %s", k.Name, src)
+			}
+		}
+	}
+	for _, def := range strings.Split(getEnvOrDefault("DERIVED_FIELDS", ""), ";") {
+		if strings.TrimSpace(def) == "" {
+			continue
+		}
+		name, src, ok := strings.Cut(def, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.TrimSpace(src) == "" {
+			log.Fatalf("expr: DERIVED_FIELDS: want name=expression, got %q", def)
+		}
+		derivedFields = append(derivedFields, derivedField{name: name, expr: compile("DERIVED_FIELDS "+name, src)})
+	}
+	if len(derivedFields) > 0 {
+		log.Printf("Derived   : %d field(s)", len(derivedFields))
+	}
+}
+
+// sampleEnv resolves names for a sample in the pipeline.
+func sampleEnv(smp *pipelineSample) exprEnv {
+	return func(name string) (any, bool) {
+		switch name {
+		case "value":
+			return smp.Value, true
+		case "raw":
+			return smp.Raw, true
+		case "kind":
+			return smp.Kind.Name, true
+		case "field":
+			return smp.Kind.Field, true
+		case "ts":
+			switch {
+			case smp.Ts > 0:
+				return float64(smp.Ts), true
+			case smp.Metrics != nil && smp.Metrics.Ts > 0:
+				return smp.Metrics.Ts, true
+			}
+			return float64(smp.Tick.Unix()), true
+		}
+		if smp.Metrics != nil {
+			if v, ok := smp.Metrics.Values[name]; ok {
+				return v, true
+			}
+		}
+		return nil, false
+	}
+}
+
+// filterSample is the filter stage.
+func filterSample(smp *pipelineSample) (bool, error) {
+	f := kindFilters[smp.Kind.Name]
+	if f == nil {
+		f = sampleFilter
+	}
+	if f == nil {
+		return true, nil
+	}
+	return f.Bool(sampleEnv(smp))
+}
+
+// deriveFields is the derive stage: it puts the derived fields in the
+// payload. A field whose expression fails is left out.
+func deriveFields(smp *pipelineSample) (bool, error) {
+	if len(derivedFields) == 0 || smp.Payload == nil {
+		return true, nil
+	}
+	env := sampleEnv(smp)
+	out := make(map[string]any, len(derivedFields))
+	for _, d := range derivedFields {
+		v, err := d.expr.Eval(env)
+		if f, ok := v.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			err = fmt.Errorf("not a number")
+		}
+		if err != nil {
+			log.Printf("neuron-seller: derived field %s: %v", d.name, err)
+			continue
+		}
+		out[d.name] = v
+	}
+	if len(out) == 0 {
+		return true, nil
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return false, err
+	}
+	smp.Payload.Derived = data
+	return true, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// featureFlag names an experimental behavior that can be switched on per node
+// so fleet rollouts can enable it gradually.
+type featureFlag string
+
+const (
+	flagBatching  featureFlag = "batching"
+	flagDeltaMode featureFlag = "delta_mode"
+)
+
+var knownFeatureFlags = map[featureFlag]string{
+	flagBatching:  "group several samples into one P2P frame",
+	flagDeltaMode: "only broadcast samples whose value changed",
+}
+
+type featureFlags struct {
+	mu     sync.RWMutex
+	values map[featureFlag]bool
+}
+
+var features = &featureFlags{values: map[featureFlag]bool{}}
+
+// loadFeatureFlags reads FEATURE_FLAGS (comma separated list of enabled
+// flags) and then per-flag FEATURE_<NAME> overrides.
+func loadFeatureFlags() {
+	values := make(map[featureFlag]bool, len(knownFeatureFlags))
+	for _, name := range strings.Split(getEnvOrDefault("FEATURE_FLAGS", ""), ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := knownFeatureFlags[featureFlag(name)]; !ok {
+			log.Printf("feature-flags: ignoring unknown flag %q", name)
+			continue
+		}
+		values[featureFlag(name)] = true
+	}
+	for name := range knownFeatureFlags {
+		key := "FEATURE_" + strings.ToUpper(string(name))
+		values[name] = parseEnvBool(key, values[name])
+	}
+
+	features.mu.Lock()
+	features.values = values
+	features.mu.Unlock()
+
+	if enabled := features.enabledNames(); len(enabled) > 0 {
+		log.Printf("Features  : %s", strings.Join(enabled, ", "))
+	}
+}
+
+func (f *featureFlags) Enabled(name featureFlag) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.values[name]
+}
+
+func (f *featureFlags) Set(name featureFlag, enabled bool) error {
+	if _, ok := knownFeatureFlags[name]; !ok {
+		return fmt.Errorf("unknown feature flag %q", name)
+	}
+	f.mu.Lock()
+	f.values[name] = enabled
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *featureFlags) Snapshot() map[string]bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	out := make(map[string]bool, len(knownFeatureFlags))
+	for name := range knownFeatureFlags {
+		out[string(name)] = f.values[name]
+	}
+	return out
+}
+
+func (f *featureFlags) enabledNames() []string {
+	var names []string
+	for name, on := range f.Snapshot() {
+		if on {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GET lists every known flag; POST/PUT takes {"flag": bool, ...} and applies
+// it at runtime. Changes are not persisted across restarts.
+func adminFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		var req map[string]bool
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, ErrBadRequest.With("invalid JSON body"))
+			return
+		}
+		for name := range req {
+			if _, ok := knownFeatureFlags[featureFlag(name)]; !ok {
+				writeJSONError(w, ErrBadRequest.With(fmt.Sprintf("unknown feature flag %q", name)))
+				return
+			}
+		}
+		for name, enabled := range req {
+			_ = features.Set(featureFlag(name), enabled)
+			log.Printf("[/admin/flags] %s set to %t by %s", name, enabled, r.RemoteAddr)
+		}
+	default:
+		writeJSONError(w, ErrMethodNotAllowed)
+		return
+	}
+
+	descriptions := make(map[string]string, len(knownFeatureFlags))
+	for name, desc := range knownFeatureFlags {
+		descriptions[string(name)] = desc
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"flags":        features.Snapshot(),
+		"descriptions": descriptions,
+	})
+}
@@ -0,0 +1,86 @@
+// Package fleet defines the wire messages exchanged between a seller node's
+// fleet agent and the fleet controller. Every frame is a JSON Envelope sent
+// over a WebSocket that the node dials outbound, so operators never need
+// inbound access to the Pi.
+package fleet
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Message types carried in Envelope.Type.
+const (
+	TypeHello      = "hello"       // node -> controller, first frame, Inventory payload
+	TypeHealth     = "health"      // node -> controller, periodic, Health payload
+	TypeAck        = "ack"         // node -> controller, result of a command
+	TypeConfigPush = "config_push" // controller -> node, ConfigPush payload
+	TypeRestart    = "restart"     // controller -> node, no payload
+)
+
+// Envelope wraps every frame on the agent connection.
+type Envelope struct {
+	Type    string          `json:"type"`
+	NodeID  string          `json:"node_id,omitempty"`
+	ID      string          `json:"id,omitempty"`
+	Time    time.Time       `json:"time"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Inventory describes a node when it registers with the controller.
+type Inventory struct {
+	SellerID      string          `json:"seller_id"`
+	Label         string          `json:"label"`
+	Lat           float64         `json:"lat"`
+	Lon           float64         `json:"lon"`
+	Hostname      string          `json:"hostname"`
+	Version       string          `json:"version"`
+	Protocol      string          `json:"protocol"`
+	Profile       string          `json:"profile,omitempty"`
+	GoVersion     string          `json:"go_version"`
+	OS            string          `json:"os"`
+	Arch          string          `json:"arch"`
+	ConfigVersion int             `json:"config_version"`
+	Features      map[string]bool `json:"features"`
+}
+
+// Health is the periodic status report of a node.
+type Health struct {
+	UptimeSeconds int64  `json:"uptime_seconds"`
+	PiReachable   bool   `json:"pi_reachable"`
+	PiError       string `json:"pi_error,omitempty"`
+	PiErrorCode   string `json:"pi_error_code,omitempty"` // stable code, see the seller's errors.go
+	ConfigVersion int    `json:"config_version"`
+	Goroutines    int    `json:"goroutines"`
+	HeapBytes     uint64 `json:"heap_bytes"`
+}
+
+// ConfigPush carries a desired-config version. Values are environment keys;
+// the node only applies keys it allows to be managed remotely.
+type ConfigPush struct {
+	Version int               `json:"version"`
+	Values  map[string]string `json:"values"`
+}
+
+// Ack reports the outcome of a controller command, matched by Envelope.ID.
+type Ack struct {
+	OK              bool     `json:"ok"`
+	Error           string   `json:"error,omitempty"`
+	ErrorCode       string   `json:"error_code,omitempty"`
+	Applied         []string `json:"applied,omitempty"`
+	Rejected        []string `json:"rejected,omitempty"`
+	RestartRequired bool     `json:"restart_required,omitempty"`
+}
+
+// NewEnvelope marshals payload (which may be nil) into an Envelope.
+func NewEnvelope(msgType, nodeID, id string, payload any) (Envelope, error) {
+	env := Envelope{Type: msgType, NodeID: nodeID, ID: id, Time: time.Now().UTC()}
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return Envelope{}, err
+		}
+		env.Payload = raw
+	}
+	return env, nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/gorilla/websocket"
+
+	"localsense/neuron-seller/fleet"
+)
+
+type fleetAgentConfig struct {
+	Enabled        bool
+	ControllerURL  string
+	Token          string
+	ReportInterval time.Duration
+}
+
+// fleetManagedPrefixes lists the env keys a controller may push. Keys, RPC
+// endpoints and account IDs are never remotely writable.
+var fleetManagedPrefixes = []string{"SELLER_LABEL", "NEURON_", "FEATURE_", "LOCALSENSE_PROFILE"}
+
+// fleetKeyPattern is the shape of a pushable key. The SDK writes .env lines
+// unquoted, so a key or value with a line break in it could add any other
+// key to the file.
+var fleetKeyPattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+type fleetAgent struct {
+	cfg           fleetAgentConfig
+	configVersion int
+
+	writeMu sync.Mutex
+	conn    *websocket.Conn
+}
+
+func loadFleetAgentConfig() fleetAgentConfig {
+	return fleetAgentConfig{
+		Enabled:        parseEnvBool("FLEET_ENABLE", false),
+		ControllerURL:  getEnvOrDefault("FLEET_CONTROLLER_URL", ""),
+		Token:          getEnvOrDefault("FLEET_TOKEN", ""),
+		ReportInterval: time.Duration(parseEnvInt("FLEET_REPORT_INTERVAL_SECONDS", 30)) * time.Second,
+	}
+}
+
+// startFleetAgent launches the outbound agent loop when FLEET_ENABLE is set.
+func startFleetAgent() {
+	cfg := loadFleetAgentConfig()
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.ControllerURL == "" {
+		log.Printf("fleet-agent: FLEET_ENABLE set but FLEET_CONTROLLER_URL is empty; agent disabled")
+		return
+	}
+	if cfg.ReportInterval <= 0 {
+		cfg.ReportInterval = 30 * time.Second
+	}
+
+	agent := &fleetAgent{
+		cfg:           cfg,
+		configVersion: parseEnvInt("FLEET_CONFIG_VERSION", 0),
+	}
+	log.Printf("fleet-agent: reporting to %s every %s", cfg.ControllerURL, cfg.ReportInterval)
+	go agent.run()
+}
+
+func (a *fleetAgent) run() {
+	backoff := time.Second
+	for {
+		err := a.session()
+		if err != nil {
+			log.Printf("fleet-agent: session ended: %v (retry in %s)", err, backoff)
+		}
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+		if err == nil {
+			backoff = time.Second
+		}
+	}
+}
+
+func (a *fleetAgent) session() error {
+	header := http.Header{}
+	if a.cfg.Token != "" {
+		header.Set("Authorization", "Bearer "+a.cfg.Token)
+	}
+	conn, _, err := outboundDialer().Dial(a.cfg.ControllerURL, header)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", a.cfg.ControllerURL, err)
+	}
+	defer conn.Close()
+
+	a.writeMu.Lock()
+	a.conn = conn
+	a.writeMu.Unlock()
+
+	if err := a.send(fleet.TypeHello, "", a.inventory()); err != nil {
+		return err
+	}
+	log.Printf("fleet-agent: connected to controller")
+
+	done := make(chan struct{})
+	defer close(done)
+	go a.reportLoop(done)
+
+	for {
+		var env fleet.Envelope
+		if err := conn.ReadJSON(&env); err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+		a.handleCommand(env)
+	}
+}
+
+func (a *fleetAgent) reportLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(a.cfg.ReportInterval)
+	defer ticker.Stop()
+
+	a.reportHealth()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			a.reportHealth()
+		}
+	}
+}
+
+func (a *fleetAgent) reportHealth() {
+	if err := a.send(fleet.TypeHealth, "", a.health()); err != nil {
+		log.Printf("fleet-agent: health report failed: %v", err)
+	}
+}
+
+func (a *fleetAgent) send(msgType, id string, payload any) error {
+	env, err := fleet.NewEnvelope(msgType, sellerCfg.SellerID, id, payload)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", msgType, err)
+	}
+
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	if a.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+	a.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return a.conn.WriteJSON(env)
+}
+
+func (a *fleetAgent) handleCommand(env fleet.Envelope) {
+	switch env.Type {
+	case fleet.TypeConfigPush:
+		var push fleet.ConfigPush
+		if err := json.Unmarshal(env.Payload, &push); err != nil {
+			a.ack(env.ID, fleet.Ack{Error: fmt.Sprintf("invalid config_push: %v", err), ErrorCode: ErrBadRequest.Code()})
+			return
+		}
+		a.ack(env.ID, a.applyConfig(push))
+
+	case fleet.TypeRestart:
+		log.Printf("fleet-agent: restart requested by controller (command %s)", env.ID)
+		a.ack(env.ID, fleet.Ack{OK: true})
+		go func() {
+			// Give the ack a moment to leave; the service manager restarts us.
+			time.Sleep(time.Second)
+			os.Exit(0)
+		}()
+
+	default:
+		log.Printf("fleet-agent: ignoring unknown command type %q", env.Type)
+		a.ack(env.ID, fleet.Ack{Error: "unknown command type " + env.Type, ErrorCode: commandErrUnknownType})
+	}
+}
+
+func (a *fleetAgent) ack(id string, ack fleet.Ack) {
+	if err := a.send(fleet.TypeAck, id, ack); err != nil {
+		log.Printf("fleet-agent: ack %s failed: %v", id, err)
+	}
+}
+
+// applyConfig writes allowed keys to the environment and the .env file.
+// Feature flags take effect immediately; everything else needs a restart.
+// The push is acked OK only when at least one key was applied.
+func (a *fleetAgent) applyConfig(push fleet.ConfigPush) fleet.Ack {
+	var ack fleet.Ack
+
+	keys := make([]string, 0, len(push.Values))
+	for key := range push.Values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	reloadFlags := false
+	for _, key := range keys {
+		val := push.Values[key]
+		if !fleetManagedKey(key) || strings.ContainsAny(val, "\n\r\x00") {
+			ack.Rejected = append(ack.Rejected, key)
+			continue
+		}
+		os.Setenv(key, val)
+		if err := commonlib.UpdateEnvVariable(key, val, commonlib.MyEnvFile); err != nil {
+			log.Printf("fleet-agent: could not persist %s: %v", key, err)
+		}
+		ack.Applied = append(ack.Applied, key)
+		if strings.HasPrefix(key, "FEATURE_") {
+			reloadFlags = true
+		} else {
+			ack.RestartRequired = true
+		}
+	}
+
+	if reloadFlags {
+		loadFeatureFlags()
+	}
+	ack.OK = len(ack.Applied) > 0
+	if ack.OK {
+		a.configVersion = push.Version
+		os.Setenv("FLEET_CONFIG_VERSION", fmt.Sprint(push.Version))
+		_ = commonlib.UpdateEnvVariable("FLEET_CONFIG_VERSION", fmt.Sprint(push.Version), commonlib.MyEnvFile)
+	}
+
+	log.Printf("fleet-agent: config v%d applied=%v rejected=%v", push.Version, ack.Applied, ack.Rejected)
+	result := "ok"
+	switch {
+	case !ack.OK:
+		result = "rejected"
+		ack.Error = "no key in the push may be set remotely"
+	case len(ack.Rejected) > 0:
+		result = "partial"
+	}
+	audit.Record("fleet", "fleet-controller", "config_push", result, map[string]any{
+		"version":          push.Version,
+		"applied":          ack.Applied,
+		"rejected":         ack.Rejected,
+		"restart_required": ack.RestartRequired,
+	})
+	return ack
+}
+
+func fleetManagedKey(key string) bool {
+	if !fleetKeyPattern.MatchString(key) {
+		return false
+	}
+	for _, prefix := range fleetManagedPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *fleetAgent) inventory() fleet.Inventory {
+	hostname, _ := os.Hostname()
+	neuron, _ := getNeuronSellerConfig()
+	loc := currentLocation()
+	return fleet.Inventory{
+		SellerID:      sellerCfg.SellerID,
+		Label:         loc.Label,
+		Lat:           loc.Lat,
+		Lon:           loc.Lon,
+		Hostname:      hostname,
+		Version:       neuron.Version,
+		Protocol:      string(neuron.Protocol),
+		Profile:       activeProfile,
+		GoVersion:     runtime.Version(),
+		OS:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		ConfigVersion: a.configVersion,
+		Features:      features.Snapshot(),
+	}
+}
+
+func (a *fleetAgent) health() fleet.Health {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	h := fleet.Health{
+		UptimeSeconds: int64(time.Since(processStartedAt).Seconds()),
+		ConfigVersion: a.configVersion,
+		Goroutines:    runtime.NumGoroutine(),
+		HeapBytes:     mem.HeapAlloc,
+	}
+
+	piHealth := make(map[string]any)
+	if err := fetchJSON(sellerCfg.PiBase+"/health", &piHealth); err != nil {
+		h.PiError, h.PiErrorCode = err.Error(), ErrPiUnreachable.Code()
+	} else {
+		h.PiReachable = true
+	}
+	return h
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Behind a reverse proxy every request comes from the proxy. With the
+// proxy's address in TRUSTED_PROXIES (IPs or CIDRs, comma separated; "unix"
+// for requests over a LISTEN_ADDRS socket) the client is taken from
+// X-Forwarded-For instead, the right-most address that is not itself a
+// trusted proxy, for logs, the audit trail, bandwidth accounting and caps,
+// and the loopback check on admin calls. X-Forwarded-Proto and
+// X-Forwarded-Host go into the access log. Headers from any other peer are
+// ignored, so clients can't choose their own address.
+//
+// BASE_PATH (e.g. /shims/rooftop-3) serves every route under that prefix so
+// several shims can share one ingress host; anything outside it is a 404.
+
+var forwarding struct {
+	trusted   []netip.Prefix
+	trustUnix bool
+	basePath  string
+}
+
+func loadForwarding() {
+	for _, entry := range strings.Split(getEnvOrDefault("TRUSTED_PROXIES", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case entry == "unix":
+			forwarding.trustUnix = true
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(entry)
+			if aerr != nil {
+				log.Fatalf("neuron-seller: TRUSTED_PROXIES: %q is not an IP, CIDR or unix", entry)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		forwarding.trusted = append(forwarding.trusted, prefix.Masked())
+	}
+
+	base := strings.TrimRight(getEnvOrDefault("BASE_PATH", ""), "/")
+	if base != "" && !strings.HasPrefix(base, "/") {
+		log.Fatalf("neuron-seller: BASE_PATH must start with /, got %q", base)
+	}
+	forwarding.basePath = base
+
+	if len(forwarding.trusted) > 0 || forwarding.trustUnix {
+		log.Printf("Proxies   : trusting X-Forwarded-* from %s", getEnvOrDefault("TRUSTED_PROXIES", ""))
+	}
+	if base != "" {
+		log.Printf("BasePath  : serving routes under %s", base)
+	}
+}
+
+// trustedProxy reports whether a request's immediate peer is a trusted
+// proxy; remoteAddr is ip:port, or "@" or "" over a unix socket.
+func trustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return forwarding.trustUnix && (remoteAddr == "@" || remoteAddr == "")
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	return trustedAddr(addr)
+}
+
+func trustedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range forwarding.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClient is the client address X-Forwarded-For names: walking from
+// the right, the first hop that isn't a trusted proxy.
+func forwardedClient(r *http.Request) (netip.Addr, bool) {
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// Past a hop we can't read nothing further left is reliable.
+			break
+		}
+		client = addr.Unmap()
+		if !trustedAddr(client) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
+
+// withForwarding applies the forwarded client address and BASE_PATH. It
+// wraps everything else so bandwidth accounting and logs see the client.
+func withForwarding(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if trustedProxy(r.RemoteAddr) {
+			if client, ok := forwardedClient(r); ok {
+				r = r.WithContext(r.Context())
+				r.RemoteAddr = net.JoinHostPort(client.String(), "0")
+			}
+		} else {
+			// Only trusted proxies get to describe the original request.
+			r.Header.Del("X-Forwarded-Proto")
+			r.Header.Del("X-Forwarded-Host")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withBasePath serves next under BASE_PATH.
+func withBasePath(next http.Handler) http.Handler {
+	base := forwarding.basePath
+	if base == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, base)
+		if !ok || (rest != "" && rest[0] != '/') {
+			writeJSONError(w, ErrNotFound.With("no route outside "+base))
+			return
+		}
+		if rest == "" {
+			rest = "/"
+		}
+		r2 := r.WithContext(r.Context())
+		u := *r.URL
+		u.Path = rest
+		u.RawPath = ""
+		r2.URL = &u
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// forwardedFor describes how a request reached us, for the access log.
+func forwardedFor(r *http.Request) string {
+	proto, host := r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Forwarded-Host")
+	if proto == "" && host == "" {
+		return ""
+	}
+	return " via " + proto + "://" + host
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /freshness answers the question an external monitor actually has:
+// is data reaching people? For every surface that delivered a sample since
+// start (P2P buyers, relays, /stream, /poll, LoRaWAN, sink plugins) it
+// reports the age of the newest sample delivered there, by the sample's own
+// timestamp, against an SLO target: FRESHNESS_SLO_SECONDS for all of them
+// (default three stream intervals, at least 30 seconds), overridden per
+// surface with FRESHNESS_SLO="lorawan=900,http_poll=120". A surface listed
+// in FRESHNESS_SLO is reported, and fails, even before its first delivery.
+// The response is 200 when every surface passes and 503 otherwise, so it can
+// be used as an uptime check as is. While the duty schedule is quiescent or
+// the node is under maintenance no samples are expected: surfaces pass, and
+// "paused" says why.
+
+type freshnessSurface string
+
+const (
+	freshP2P        freshnessSurface = "p2p"
+	freshRelay      freshnessSurface = "relay"
+	freshHTTPStream freshnessSurface = "http_stream"
+	freshHTTPPoll   freshnessSurface = "http_poll"
+	freshLoRaWAN    freshnessSurface = "lorawan"
+	freshPlugin     freshnessSurface = "plugin"
+)
+
+var freshnessSurfaces = []freshnessSurface{freshP2P, freshRelay, freshHTTPStream, freshHTTPPoll, freshLoRaWAN, freshPlugin}
+
+type freshnessTracker struct {
+	target  time.Duration
+	targets map[freshnessSurface]time.Duration
+
+	mu     sync.Mutex
+	newest map[freshnessSurface]int64     // newest sample ts delivered, unix seconds
+	at     map[freshnessSurface]time.Time // when it was delivered
+}
+
+var freshness = &freshnessTracker{
+	newest: map[freshnessSurface]int64{},
+	at:     map[freshnessSurface]time.Time{},
+}
+
+func loadFreshness() {
+	neuron, _ := getNeuronSellerConfig()
+	def := max(3*neuron.ensureDefaults().StreamInterval, 30*time.Second)
+	freshness.target = time.Duration(parseEnvInt("FRESHNESS_SLO_SECONDS", int(def/time.Second))) * time.Second
+	freshness.targets = map[freshnessSurface]time.Duration{}
+	for _, entry := range strings.Split(getEnvOrDefault("FRESHNESS_SLO", ""), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, secs, ok := strings.Cut(entry, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(secs))
+		surface := freshnessSurface(strings.TrimSpace(name))
+		known := false
+		for _, s := range freshnessSurfaces {
+			known = known || s == surface
+		}
+		if !ok || err != nil || n <= 0 || !known {
+			log.Fatalf("freshness: FRESHNESS_SLO entry %q must be <surface>=<seconds>, surfaces %v", entry, freshnessSurfaces)
+		}
+		freshness.targets[surface] = time.Duration(n) * time.Second
+	}
+}
+
+// Delivered records that a sample with timestamp ts reached surface.
+func (f *freshnessTracker) Delivered(surface freshnessSurface, ts int64, now time.Time) {
+	if ts <= 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ts >= f.newest[surface] {
+		f.newest[surface] = ts
+		f.at[surface] = now
+	}
+}
+
+func (f *freshnessTracker) targetFor(surface freshnessSurface) time.Duration {
+	if t, ok := f.targets[surface]; ok {
+		return t
+	}
+	return f.target
+}
+
+type surfaceFreshness struct {
+	NewestTs    int64     `json:"newest_ts,omitempty"`
+	DeliveredAt time.Time `json:"delivered_at,omitzero"`
+	AgeSeconds  *float64  `json:"age_s"` // null before the first delivery
+	SLOSeconds  float64   `json:"slo_s"`
+	Pass        bool      `json:"pass"`
+}
+
+// Report is the freshness of every surface at now.
+func (f *freshnessTracker) Report(now time.Time) map[string]any {
+	paused := ""
+	switch {
+	case underMaintenance():
+		paused = "maintenance"
+	case !schedule.Active(now):
+		paused = "quiescent"
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	surfaces := map[freshnessSurface]bool{}
+	for s := range f.newest {
+		surfaces[s] = true
+	}
+	for s := range f.targets {
+		surfaces[s] = true
+	}
+	names := make([]string, 0, len(surfaces))
+	for s := range surfaces {
+		names = append(names, string(s))
+	}
+	sort.Strings(names)
+
+	pass := true
+	out := map[string]surfaceFreshness{}
+	for _, name := range names {
+		s := freshnessSurface(name)
+		target := f.targetFor(s)
+		sf := surfaceFreshness{SLOSeconds: target.Seconds(), Pass: paused != ""}
+		if ts, ok := f.newest[s]; ok {
+			age := max(now.Sub(time.Unix(ts, 0)), 0)
+			secs := age.Seconds()
+			sf.NewestTs, sf.DeliveredAt, sf.AgeSeconds = ts, f.at[s].UTC(), &secs
+			sf.Pass = sf.Pass || age <= target
+		}
+		pass = pass && sf.Pass
+		out[name] = sf
+	}
+	resp := map[string]any{"time": now.UTC(), "pass": pass, "surfaces": out}
+	if paused != "" {
+		resp["paused"] = paused
+	}
+	return resp
+}
+
+// GET /freshness – newest delivered sample age per surface against its SLO.
+func freshnessHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, ErrMethodNotAllowed.With("use GET"))
+		return
+	}
+	report := freshness.Report(time.Now())
+	status := http.StatusOK
+	if !report["pass"].(bool) {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, report)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"localsense/neuron-seller/buyerclient"
+)
+
+// Sensor fusion combines this node's reading with those of co-located
+// sellers into one estimate, published as its own kind (FUSION_KIND,
+// default fused_brightness) on FUSION_PROTOCOL.
+//
+// FUSION_SOURCES lists the NDJSON streams of the other sellers (their
+// /stream?kind= URLs); samples of FUSION_SOURCE_KIND (default the primary
+// kind) in the same unit as ours are kept per seller. Each time the node
+// samples, every source with a reading newer than FUSION_MAX_AGE_SECONDS is
+// weighted by the inverse of its variance over the last FUSION_WINDOW
+// readings, floored at FUSION_SIGMA_FLOOR so a flat-lining sensor can't
+// take over, and the weighted mean goes out with a provenance block naming
+// each source sample, the estimate's standard deviation and its 95%
+// confidence interval. With fewer than FUSION_MIN_SOURCES fresh sources
+// (ours included) no fused sample is sent.
+//
+// Fused samples go to P2P buyers, /poll and history; /stream serves sensor
+// readings only.
+
+const fusionTransform = "inverse_variance_mean"
+
+type fusionSource struct {
+	SellerID string    `json:"seller_id"`
+	Kind     string    `json:"kind"`
+	Unit     unit      `json:"unit,omitempty"`
+	Seq      uint64    `json:"seq"`
+	Value    float64   `json:"value"`
+	Ts       time.Time `json:"ts"`
+	Sigma    float64   `json:"sigma"`
+
+	recent []float64
+}
+
+type fusedEstimate struct {
+	Value   float64
+	Sigma   float64
+	Sources []fusionSource
+}
+
+type sensorFusion struct {
+	kind      sensorKind // the fused kind
+	source    sensorKind // our kind being fused
+	urls      []string
+	window    int
+	maxAge    time.Duration
+	floor     float64
+	minSource int
+
+	mu      sync.Mutex
+	sources map[string]*fusionSource // by seller ID
+	last    *fusedEstimate
+}
+
+var fusion *sensorFusion
+
+// withFusedKind appends the fused kind to kinds when FUSION_SOURCES is set.
+// It goes last so our own reading is taken first in every round.
+func withFusedKind(kinds []sensorKind) ([]sensorKind, error) {
+	if getEnvOrDefault("FUSION_SOURCES", "") == "" {
+		return kinds, nil
+	}
+	name := getEnvOrDefault("FUSION_SOURCE_KIND", kinds[0].Name)
+	var src *sensorKind
+	for i := range kinds {
+		if kinds[i].Name == name {
+			src = &kinds[i]
+		}
+	}
+	if src == nil {
+		return nil, fmt.Errorf("FUSION_SOURCE_KIND %q is not a configured kind", name)
+	}
+	fused := getEnvOrDefault("FUSION_KIND", "fused_"+src.Field)
+	for _, k := range kinds {
+		if k.Name == fused {
+			return nil, fmt.Errorf("FUSION_KIND %q is already a sensor kind", fused)
+		}
+	}
+	return append(kinds, sensorKind{
+		Name:       fused,
+		Field:      fused,
+		Protocol:   protocol.ID(getEnvOrDefault("FUSION_PROTOCOL", "/localsense/"+fused+"/v1")),
+		Conversion: unitConversion{From: src.Conversion.To, To: src.Conversion.To},
+		FusedFrom:  src.Name,
+	}), nil
+}
+
+func loadFusion() {
+	cfg, err := getNeuronSellerConfig()
+	if err != nil {
+		return
+	}
+	var f *sensorFusion
+	for _, k := range cfg.Kinds {
+		if k.FusedFrom == "" {
+			continue
+		}
+		src, _ := cfg.kindByName(k.FusedFrom)
+		f = &sensorFusion{
+			kind:      k,
+			source:    src,
+			window:    max(parseEnvInt("FUSION_WINDOW", 12), 2),
+			maxAge:    time.Duration(max(parseEnvInt("FUSION_MAX_AGE_SECONDS", 30), 1)) * time.Second,
+			floor:     math.Max(parseEnvFloat("FUSION_SIGMA_FLOOR", 0.1), 1e-9),
+			minSource: max(parseEnvInt("FUSION_MIN_SOURCES", 2), 1),
+			sources:   make(map[string]*fusionSource),
+		}
+	}
+	if f == nil {
+		return
+	}
+	for _, url := range strings.Split(getEnvOrDefault("FUSION_SOURCES", ""), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			f.urls = append(f.urls, url)
+		}
+	}
+	fusion = f
+	for _, url := range f.urls {
+		go f.follow(url)
+	}
+	log.Printf("Fusion    : %s from %s and %d peer stream(s), min %d sources", f.kind.Name, f.source.Name, len(f.urls), f.minSource)
+}
+
+// follow consumes one peer stream, reconnecting with backoff.
+func (f *sensorFusion) follow(url string) {
+	backoff := time.Second
+	client := &buyerclient.Client{
+		MaxAge: f.maxAge,
+		OnSample: func(s buyerclient.Sample) {
+			backoff = time.Second
+			if s.Kind != f.source.Name || unit(s.Unit) != f.source.Conversion.To {
+				return
+			}
+			f.observe(s.SellerID, s.Kind, unit(s.Unit), s.Seq, s.Value, time.Unix(s.Ts, 0))
+		},
+	}
+	for {
+		err := f.consume(client, url)
+		log.Printf("fusion: %s: %v", url, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func (f *sensorFusion) consume(client *buyerclient.Client, url string) error {
+	resp, err := outboundClient(0).Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	if err := client.Consume(resp.Body); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream ended")
+}
+
+// observe records one reading from a source.
+func (f *sensorFusion) observe(sellerID, kind string, u unit, seq uint64, value float64, ts time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	src, ok := f.sources[sellerID]
+	if !ok {
+		src = &fusionSource{SellerID: sellerID}
+		f.sources[sellerID] = src
+	}
+	src.Kind, src.Unit, src.Seq, src.Value, src.Ts = kind, u, seq, value, ts
+	src.recent = append(src.recent, value)
+	if len(src.recent) > f.window {
+		src.recent = src.recent[len(src.recent)-f.window:]
+	}
+	src.Sigma = math.Max(stddev(src.recent), f.floor)
+}
+
+// Fuse records our own reading and returns the fused value, or false with
+// too few fresh sources.
+func (f *sensorFusion) Fuse(seq uint64, value float64, now time.Time) (float64, bool) {
+	f.observe(sellerCfg.SellerID, f.source.Name, f.source.Conversion.To, seq, value, now)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var used []fusionSource
+	var sumW, sumWX float64
+	for _, src := range f.sources {
+		if now.Sub(src.Ts) > f.maxAge {
+			continue
+		}
+		w := 1 / (src.Sigma * src.Sigma)
+		sumW += w
+		sumWX += w * src.Value
+		used = append(used, *src)
+	}
+	if len(used) < f.minSource {
+		f.last = nil
+		return 0, false
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].SellerID < used[j].SellerID })
+	// Rounded like converted readings, see unitConversion.Apply.
+	f.last = &fusedEstimate{Value: math.Round(sumWX/sumW*1e4) / 1e4, Sigma: math.Sqrt(1 / sumW), Sources: used}
+	return f.last.Value, true
+}
+
+// Sigma is the standard deviation of the last fused value; 0 without one.
+func (f *sensorFusion) Sigma() float64 {
+	if f == nil {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.last == nil {
+		return 0
+	}
+	return f.last.Sigma
+}
+
+// Provenance describes the last fused value.
+func (f *sensorFusion) Provenance() *derivation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	est := f.last
+	if est == nil {
+		return nil
+	}
+	d := &derivation{
+		Transform: fusionTransform,
+		Params: map[string]any{
+			"sigma": est.Sigma,
+			"ci95":  []float64{est.Value - 1.96*est.Sigma, est.Value + 1.96*est.Sigma},
+		},
+	}
+	for _, src := range est.Sources {
+		value := src.Value
+		d.Sources = append(d.Sources, derivationSource{
+			SellerID: src.SellerID,
+			Kind:     src.Kind,
+			Unit:     src.Unit,
+			FirstSeq: src.Seq,
+			LastSeq:  src.Seq,
+			Count:    1,
+			Value:    &value,
+		})
+	}
+	return d
+}
+
+func stddev(xs []float64) float64 {
+	if len(xs) < 2 {
+		return 0
+	}
+	var mean float64
+	for _, x := range xs {
+		mean += x
+	}
+	mean /= float64(len(xs))
+	var ss float64
+	for _, x := range xs {
+		ss += (x - mean) * (x - mean)
+	}
+	return math.Sqrt(ss / float64(len(xs)-1))
+}
+
+// fusionHandler serves GET /fusion: the sources and the last estimate.
+func fusionHandler(w http.ResponseWriter, r *http.Request) {
+	if fusion == nil {
+		writeJSONError(w, ErrDisabled.With("sensor fusion is not configured (FUSION_SOURCES)"))
+		return
+	}
+	fusion.mu.Lock()
+	sources := make([]fusionSource, 0, len(fusion.sources))
+	for _, src := range fusion.sources {
+		sources = append(sources, *src)
+	}
+	resp := map[string]any{
+		"kind":        fusion.kind.Name,
+		"source_kind": fusion.source.Name,
+		"unit":        fusion.kind.Conversion.To,
+		"peers":       fusion.urls,
+		"min_sources": fusion.minSource,
+	}
+	if est := fusion.last; est != nil {
+		resp["estimate"] = map[string]any{
+			"value":   est.Value,
+			"sigma":   est.Sigma,
+			"ci95":    []float64{est.Value - 1.96*est.Sigma, est.Value + 1.96*est.Sigma},
+			"sources": len(est.Sources),
+		}
+	}
+	fusion.mu.Unlock()
+	sort.Slice(sources, func(i, j int) bool { return sources[i].SellerID < sources[j].SellerID })
+	resp["sources"] = sources
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hashgraph/hedera-sdk-go/v2"
+)
+
+// Fuzz targets for what the node reads off its stdin topic, which anyone
+// can publish to: `go test -fuzz FuzzSellerTopicMessage` and so on. Without
+// -fuzz the seeds run as ordinary tests.
+
+var topicSeeds = []string{
+	``,
+	`{}`,
+	`not json`,
+	`{"messageType":"localsenseCommand"}`,
+	`{"messageType":"localsenseCommand","v":1,"type":"ping","target":"*","nonce":"n1","issuer":"00","issued_at":1767268800,"signature":"00"}`,
+	`{"messageType":"localsenseCommand","v":1,"type":"purge","target":"bench-seller","nonce":"n2","issuer":"0x02` + "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798" + `","issued_at":-1,"expires_at":1,"params":{"after":0,"before":1},"signature":"zz"}`,
+	`{"messageType":"localsenseCommand","v":2,"type":"sample_now","target":"other"}`,
+	`{"messageType":"localsenseCommand","v":1,"type":"history","target":"*","nonce":"n3","params":[1,2,3],"reply_to":"0.0.x"}`,
+	`{"messageType":"localsensePurge","after":0,"before":9223372036854775807,"nonce":"n4","signature":"00"}`,
+	`{"messageType":"localsenseCommand","v":1,"type":"ping","target":"*","nonce":"\u0000","issuer":"` + "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff" + `","signature":"` + "00000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000" + `"}`,
+}
+
+// commandReplies captures command replies for one fuzz run.
+func commandReplies(f *testing.F) *[]commandReply {
+	var replies []commandReply
+	prev := postCommandReply
+	postCommandReply = func(replyTo string, reply commandReply) {
+		replies = append(replies, reply)
+	}
+	f.Cleanup(func() { postCommandReply = prev })
+	return &replies
+}
+
+func FuzzSellerTopicMessage(f *testing.F) {
+	for _, seed := range topicSeeds {
+		f.Add([]byte(seed))
+	}
+	replies := commandReplies(f)
+	s := &neuronSeller{}
+	f.Fuzz(func(t *testing.T, contents []byte) {
+		*replies = (*replies)[:0]
+		s.handleSellerTopicMessage(hedera.TopicMessage{Contents: contents})
+		checkUnanswered(t, contents, *replies)
+	})
+}
+
+func FuzzCommandEnvelope(f *testing.F) {
+	for _, seed := range topicSeeds {
+		f.Add([]byte(seed))
+	}
+	replies := commandReplies(f)
+	f.Fuzz(func(t *testing.T, contents []byte) {
+		*replies = (*replies)[:0]
+		handleCommandMessage(contents)
+		checkUnanswered(t, contents, *replies)
+
+		// Whatever decodes must sign the same way twice.
+		var cmd commandEnvelope
+		if json.Unmarshal(contents, &cmd) == nil && string(cmd.signingBytes()) != string(cmd.signingBytes()) {
+			t.Fatalf("%q: signing bytes are not stable", contents)
+		}
+	})
+}
+
+// checkUnanswered checks that an unsigned (or wrongly signed) command got
+// no reply: anyone can publish to the topic, and replies cost HBAR.
+func checkUnanswered(t *testing.T, contents []byte, replies []commandReply) {
+	t.Helper()
+	if len(replies) != 0 {
+		t.Fatalf("%q: answered without a valid signature: %+v", contents, replies)
+	}
+}
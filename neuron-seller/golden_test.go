@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"localsense/neuron-seller/buyerclient"
+	"localsense/neuron-seller/contract"
+)
+
+// Golden payload tests: the encoder must produce the current schema
+// version's fixtures in package contract byte for byte, and each fixture
+// must decode with buyerclient and satisfy /schema. After an intended
+// payload change, regenerate them with `go test -run TestGolden -update`
+// (and bump PAYLOAD_SCHEMA_VERSION if buyers need to know).
+
+var updateGolden = flag.Bool("update", false, "rewrite the current version's golden payloads")
+
+// goldenPayloads are the payloads behind the current version's fixtures.
+func goldenPayloads() map[string]samplePayload {
+	ts := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	base := samplePayload{
+		Ts: ts.Unix(), TsISO: ts, Field: "brightness", Value: 412.5, Seq: 42,
+		SchemaID: payloadSchemaID(), SellerID: "golden-seller", Label: "Golden <roof>",
+		Lat: 51.5, Lon: -0.12, Kind: "brightness_sample", Unit: unitLux,
+		PowerMode: powerNormal, Network: "testnet",
+	}
+	full := base
+	raw := 1650.0
+	full.LicenseSHA256 = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	full.TTL, full.ExpiresAt = 60, ts.Unix()+60
+	full.ID = "01KDX7Y6W0ZB3Q9V8T2M4N6P8R"
+	full.Provenance = &derivation{
+		Transform: "unit:adc_counts->lux",
+		Params:    map[string]any{"lux_full_scale": 1000},
+		Sources:   []derivationSource{{SellerID: "golden-seller", Kind: "brightness_sample", Field: "brightness", Unit: unitADCCounts, FirstSeq: 42, LastSeq: 42, Value: &raw}},
+	}
+	full.Uncertainty = sampleUncertainty{Sigma: 4.2, Spec: 3, Drift: 1.5, CalibrationAgeDays: 30, Noise: 2.5}
+	full.Tags = []byte(`{"deployment":"roof"}`)
+	full.Labels = []byte(`{"de":"Dach","en":"Roof"}`)
+	return map[string]samplePayload{"minimal": base, "full": full}
+}
+
+func TestGoldenEncode(t *testing.T) {
+	version := payloadSchemaVersion()
+	fixtures, err := contract.Version(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloads := goldenPayloads()
+	names := make([]string, 0, len(payloads))
+	for name := range payloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := payloads[name]
+		got, err := encodePayload(&p)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if *updateGolden {
+			path := filepath.Join("contract", contract.Path(version, name))
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, append(got, '\n'), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		f, ok := fixtures[name]
+		if !ok {
+			t.Errorf("%s: no fixture in v%s; run go test -run TestGolden -update", name, version)
+			continue
+		}
+		if !bytes.Equal(got, f.Payload) {
+			t.Errorf("%s: encoding changed\n got: %s\nwant: %s", name, got, f.Payload)
+		}
+	}
+	for name := range fixtures {
+		if _, ok := payloads[name]; !ok && !*updateGolden {
+			t.Errorf("%s: v%s fixture has no payload in goldenPayloads", name, version)
+		}
+	}
+}
+
+func TestGoldenDecode(t *testing.T) {
+	for name, p := range goldenPayloads() {
+		data, err := encodePayload(&p)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		smp, _, err := buyerclient.ParseLine(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if smp.SellerID != p.SellerID || smp.Kind != p.Kind || smp.Seq != p.Seq || smp.Ts != p.Ts ||
+			smp.Value != p.Value || smp.Unit != string(p.Unit) || smp.SchemaID != p.SchemaID ||
+			smp.ID != p.ID || smp.LicenseHash != p.LicenseSHA256 || smp.TTL != p.TTL || smp.ExpiresAt != p.ExpiresAt {
+			t.Errorf("%s: decoded %+v from %s", name, *smp, data)
+		}
+		if (smp.Derivation != nil) != (p.Provenance != nil) || (smp.Uncertainty != nil) != (p.Uncertainty.Sigma != 0) {
+			t.Errorf("%s: provenance or uncertainty lost in %s", name, data)
+		}
+	}
+}
+
+// TestGoldenSchema checks the current fixtures against what /schema
+// promises: the required members are there and every member is described.
+func TestGoldenSchema(t *testing.T) {
+	fixtures, err := contract.Version(payloadSchemaVersion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := payloadSchema()
+	props := schema["properties"].(map[string]any)
+	for name, f := range fixtures {
+		var doc map[string]json.RawMessage
+		if err := json.Unmarshal(f.Payload, &doc); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, r := range schema["required"].([]string) {
+			if _, ok := doc[r]; !ok {
+				t.Errorf("%s: missing required %s", name, r)
+			}
+		}
+		for k := range doc {
+			if _, ok := props[k]; !ok {
+				t.Errorf("%s: member %s is not in /schema", name, k)
+			}
+		}
+		var id string
+		json.Unmarshal(doc["schema_id"], &id)
+		if id != payloadSchemaID() {
+			t.Errorf("%s: schema_id %q, want %q", name, id, payloadSchemaID())
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+// /graphql exposes local samples, per-kind stats, peers and the device
+// descriptor in one schema so dashboards can fetch exactly what they need in
+// one round trip. Field names follow the snake_case of the REST endpoints.
+
+const (
+	graphqlDefaultPage = 100
+	graphqlMaxPage     = 1000
+)
+
+var (
+	graphqlSchemaOnce sync.Once
+	graphqlSchema     graphql.Schema
+	graphqlSchemaErr  error
+)
+
+func stringResolver(fn func(src any) string) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (any, error) {
+		return fn(p.Source), nil
+	}
+}
+
+func unixISO(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+// sampleCursor identifies a raw record for after: pagination.
+func sampleCursor(rec historyRecord) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d|%s|%d", rec.Ts, rec.Kind, rec.Seq)))
+}
+
+func parseSampleCursor(c string) (ts int64, kind string, seq uint64, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil {
+		return 0, "", 0, errors.New("invalid cursor")
+	}
+	parts := strings.SplitN(string(raw), "|", 3)
+	if len(parts) != 3 {
+		return 0, "", 0, errors.New("invalid cursor")
+	}
+	ts, err1 := strconv.ParseInt(parts[0], 10, 64)
+	seq, err2 := strconv.ParseUint(parts[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, "", 0, errors.New("invalid cursor")
+	}
+	return ts, parts[1], seq, nil
+}
+
+// afterCursor reports whether rec sorts after the cursor position. Records
+// come back in file order, which is by ts and then by write order.
+func afterCursor(rec historyRecord, ts int64, kind string, seq uint64) bool {
+	if rec.Ts != ts {
+		return rec.Ts > ts
+	}
+	if rec.Kind != kind {
+		return rec.Kind > kind
+	}
+	return rec.Seq > seq
+}
+
+func rangeArgs(args map[string]any) (from, to time.Time, err error) {
+	now := time.Now().UTC()
+	fromArg, _ := args["from"].(string)
+	toArg, _ := args["to"].(string)
+	if from, err = parseTimeParam(fromArg, now.Add(-time.Hour)); err != nil {
+		return from, to, fmt.Errorf("invalid from: %w", err)
+	}
+	if to, err = parseTimeParam(toArg, now.Add(time.Second)); err != nil {
+		return from, to, fmt.Errorf("invalid to: %w", err)
+	}
+	return from, to, nil
+}
+
+func buildGraphQLSchema() (graphql.Schema, error) {
+	rangeArgConfig := graphql.FieldConfigArgument{
+		"kind": &graphql.ArgumentConfig{Type: graphql.String},
+		"from": &graphql.ArgumentConfig{Type: graphql.String, Description: "RFC3339 or unix seconds; default one hour ago"},
+		"to":   &graphql.ArgumentConfig{Type: graphql.String, Description: "RFC3339 or unix seconds; default now"},
+	}
+
+	sampleType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Sample",
+		Fields: graphql.Fields{
+			"seq":   &graphql.Field{Type: graphql.Int},
+			"ts":    &graphql.Field{Type: graphql.Int},
+			"time":  &graphql.Field{Type: graphql.String, Resolve: stringResolver(func(src any) string { return unixISO(src.(historyRecord).Ts) })},
+			"kind":  &graphql.Field{Type: graphql.String},
+			"value": &graphql.Field{Type: graphql.Float},
+			"payload": &graphql.Field{
+				Type:        graphql.String,
+				Description: "the payload exactly as sent to buyers, JSON encoded",
+				Resolve:     stringResolver(func(src any) string { return string(src.(historyRecord).Payload) }),
+			},
+			"cursor": &graphql.Field{Type: graphql.String, Resolve: stringResolver(func(src any) string { return sampleCursor(src.(historyRecord)) })},
+		},
+	})
+
+	bucketType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Bucket",
+		Fields: graphql.Fields{
+			"ts":        &graphql.Field{Type: graphql.Int},
+			"time":      &graphql.Field{Type: graphql.String, Resolve: stringResolver(func(src any) string { return unixISO(src.(aggregateRecord).Ts) })},
+			"kind":      &graphql.Field{Type: graphql.String},
+			"res":       &graphql.Field{Type: graphql.String},
+			"count":     &graphql.Field{Type: graphql.Int},
+			"min":       &graphql.Field{Type: graphql.Float},
+			"max":       &graphql.Field{Type: graphql.Float},
+			"mean":      &graphql.Field{Type: graphql.Float},
+			"first_seq": &graphql.Field{Type: graphql.Int},
+			"last_seq":  &graphql.Field{Type: graphql.Int},
+		},
+	})
+
+	pageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "SamplePage",
+		Fields: graphql.Fields{
+			"resolution":    &graphql.Field{Type: graphql.String},
+			"samples":       &graphql.Field{Type: graphql.NewList(sampleType), Description: "set when resolution is raw"},
+			"buckets":       &graphql.Field{Type: graphql.NewList(bucketType), Description: "set for 1m and 1h resolution"},
+			"has_next_page": &graphql.Field{Type: graphql.Boolean},
+			"end_cursor":    &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	statsType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "KindStats",
+		Fields: graphql.Fields{
+			"kind":       &graphql.Field{Type: graphql.String},
+			"count":      &graphql.Field{Type: graphql.Int},
+			"min":        &graphql.Field{Type: graphql.Float},
+			"max":        &graphql.Field{Type: graphql.Float},
+			"mean":       &graphql.Field{Type: graphql.Float},
+			"resolution": &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	peerType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Peer",
+		Fields: graphql.Fields{
+			"peer":             &graphql.Field{Type: graphql.String},
+			"state":            &graphql.Field{Type: graphql.String},
+			"valid_account":    &graphql.Field{Type: graphql.Boolean},
+			"service_type":     &graphql.Field{Type: graphql.String},
+			"p2p_bytes_today":  &graphql.Field{Type: graphql.Float},
+			"http_bytes_today": &graphql.Field{Type: graphql.Float},
+			"over_cap":         &graphql.Field{Type: graphql.Boolean},
+		},
+	})
+
+	kindType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Kind",
+		Fields: graphql.Fields{
+			"name":        &graphql.Field{Type: graphql.String},
+			"field":       &graphql.Field{Type: graphql.String},
+			"protocol":    &graphql.Field{Type: graphql.String},
+			"unit":        &graphql.Field{Type: graphql.String, Resolve: stringResolver(func(src any) string { return string(src.(sensorKind).Conversion.To) })},
+			"ttl_seconds": &graphql.Field{Type: graphql.Int},
+		},
+	})
+
+	sensorType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Sensor",
+		Fields: graphql.Fields{
+			"kind":             &graphql.Field{Type: graphql.String},
+			"part_number":      &graphql.Field{Type: graphql.String},
+			"manufacturer":     &graphql.Field{Type: graphql.String},
+			"calibration_date": &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	installType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Install",
+		Fields: graphql.Fields{
+			"height_m":        &graphql.Field{Type: graphql.Float},
+			"orientation_deg": &graphql.Field{Type: graphql.Float},
+			"tilt_deg":        &graphql.Field{Type: graphql.Float},
+			"mounting":        &graphql.Field{Type: graphql.String},
+			"indoor":          &graphql.Field{Type: graphql.Boolean},
+			"installed_at":    &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	metadata := func(p graphql.ResolveParams) deviceMetadata { return p.Source.(deviceDescriptor).Metadata }
+	deviceType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Device",
+		Fields: graphql.Fields{
+			"seller_id":      &graphql.Field{Type: graphql.String},
+			"label":          &graphql.Field{Type: graphql.String},
+			"lat":            &graphql.Field{Type: graphql.Float},
+			"lon":            &graphql.Field{Type: graphql.Float},
+			"shim_version":   &graphql.Field{Type: graphql.String},
+			"signing_pubkey": &graphql.Field{Type: graphql.String},
+			"kinds":          &graphql.Field{Type: graphql.NewList(kindType)},
+			"hardware_model": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (any, error) { return metadata(p).HardwareModel, nil }},
+			"serial_number":  &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (any, error) { return metadata(p).SerialNumber, nil }},
+			"calibration_date": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (any, error) {
+				return metadata(p).CalibrationDate, nil
+			}},
+			"sensors": &graphql.Field{Type: graphql.NewList(sensorType), Resolve: func(p graphql.ResolveParams) (any, error) { return metadata(p).Sensors, nil }},
+			"install": &graphql.Field{Type: installType, Resolve: func(p graphql.ResolveParams) (any, error) { return metadata(p).Install, nil }},
+			"firmware": &graphql.Field{Type: graphql.String, Description: "component -> version, JSON encoded", Resolve: func(p graphql.ResolveParams) (any, error) {
+				data, err := json.Marshal(metadata(p).Firmware)
+				return string(data), err
+			}},
+		},
+	})
+
+	samplesArgs := graphql.FieldConfigArgument{
+		"first":      &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: graphqlDefaultPage},
+		"after":      &graphql.ArgumentConfig{Type: graphql.String, Description: "end_cursor of the previous page (raw resolution)"},
+		"resolution": &graphql.ArgumentConfig{Type: graphql.String, Description: "raw, 1m or 1h; default picks by range"},
+	}
+	for k, v := range rangeArgConfig {
+		samplesArgs[k] = v
+	}
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"samples": &graphql.Field{Type: pageType, Args: samplesArgs, Resolve: resolveSamples},
+			"stats":   &graphql.Field{Type: graphql.NewList(statsType), Args: rangeArgConfig, Resolve: resolveStats},
+			"peers":   &graphql.Field{Type: graphql.NewList(peerType), Resolve: resolvePeers},
+			"device": &graphql.Field{Type: deviceType, Resolve: func(p graphql.ResolveParams) (any, error) {
+				return currentDevice(false), nil
+			}},
+		},
+	})
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query})
+}
+
+func resolveSamples(p graphql.ResolveParams) (any, error) {
+	if history == nil {
+		return nil, errors.New("history disabled (HISTORY_ENABLE=false)")
+	}
+	from, to, err := rangeArgs(p.Args)
+	if err != nil {
+		return nil, err
+	}
+	kind, _ := p.Args["kind"].(string)
+	first, _ := p.Args["first"].(int)
+	if first <= 0 || first > graphqlMaxPage {
+		return nil, fmt.Errorf("first must be between 1 and %d", graphqlMaxPage)
+	}
+	res, _ := p.Args["resolution"].(string)
+	if res == "" {
+		res = history.tiers.resolutionFor(from, time.Now().UTC())
+	}
+
+	page := map[string]any{"resolution": res, "has_next_page": false}
+	switch res {
+	case resolution1m, resolution1h:
+		buckets, err := history.QueryAggregates(from, to, kind, res, first+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(buckets) > first {
+			buckets = buckets[:first]
+			page["has_next_page"] = true
+			page["end_cursor"] = strconv.FormatInt(buckets[first-1].Ts+1, 10)
+		}
+		buckets = aggregateNoise.Buckets(buckets)
+		privacy.Public().Buckets(buckets)
+		page["buckets"] = buckets
+		return page, nil
+	case resolutionRaw:
+	default:
+		return nil, errors.New("resolution must be raw, 1m or 1h")
+	}
+
+	var (
+		cursorTs   int64
+		cursorKind string
+		cursorSeq  uint64
+		hasCursor  bool
+	)
+	if after, _ := p.Args["after"].(string); after != "" {
+		if cursorTs, cursorKind, cursorSeq, err = parseSampleCursor(after); err != nil {
+			return nil, err
+		}
+		hasCursor = true
+		if t := time.Unix(cursorTs, 0); t.After(from) {
+			from = t
+		}
+	}
+
+	// Over-fetch a little: records sharing the cursor's second are skipped.
+	records, err := history.Query(from, to, kind, first+1+64)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]historyRecord, 0, first)
+	for _, rec := range records {
+		if hasCursor && !afterCursor(rec, cursorTs, cursorKind, cursorSeq) {
+			continue
+		}
+		if len(out) == first {
+			page["has_next_page"] = true
+			break
+		}
+		out = append(out, rec)
+	}
+	if len(out) > 0 {
+		page["end_cursor"] = sampleCursor(out[len(out)-1])
+	}
+	if err := privacy.Public().Records(out); err != nil {
+		return nil, err
+	}
+	page["samples"] = out
+	return page, nil
+}
+
+func resolveStats(p graphql.ResolveParams) (any, error) {
+	if history == nil {
+		return nil, errors.New("history disabled (HISTORY_ENABLE=false)")
+	}
+	from, to, err := rangeArgs(p.Args)
+	if err != nil {
+		return nil, err
+	}
+	kind, _ := p.Args["kind"].(string)
+	out, _, err := kindStats(from, to, kind)
+	return out, err
+}
+
+func resolvePeers(p graphql.ResolveParams) (any, error) {
+	byPeer := map[string]map[string]any{}
+	var order []string
+	entry := func(id string) map[string]any {
+		if e, ok := byPeer[id]; ok {
+			return e
+		}
+		e := map[string]any{"peer": id}
+		byPeer[id] = e
+		order = append(order, id)
+		return e
+	}
+	for _, peer := range p2pPeers() {
+		e := entry(peer.Peer)
+		e["state"] = peer.State
+		e["valid_account"] = peer.ValidAccount
+		e["service_type"] = peer.ServiceType
+	}
+	for _, u := range bandwidth.Usage() {
+		e := entry(u.Peer)
+		e["p2p_bytes_today"] = float64(u.Today.P2P)
+		e["http_bytes_today"] = float64(u.Today.HTTP)
+		e["over_cap"] = u.OverCap
+	}
+
+	out := make([]map[string]any, 0, len(order))
+	for _, id := range order {
+		out = append(out, byPeer[id])
+	}
+	return out, nil
+}
+
+type graphqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// GET /graphql?query= or POST /graphql with {"query", "variables",
+// "operationName"}.
+func graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	graphqlSchemaOnce.Do(func() {
+		graphqlSchema, graphqlSchemaErr = buildGraphQLSchema()
+	})
+	if graphqlSchemaErr != nil {
+		writeJSONError(w, ErrInternal.Wrap(graphqlSchemaErr))
+		return
+	}
+
+	var req graphqlRequest
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeJSONError(w, ErrBadRequest.With("invalid variables: "+err.Error()))
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeJSONError(w, ErrBadRequest.With("invalid request: "+err.Error()))
+			return
+		}
+	default:
+		writeJSONError(w, ErrMethodNotAllowed.With("use GET or POST"))
+		return
+	}
+	if req.Query == "" {
+		writeJSONError(w, ErrBadRequest.With("query is required"))
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         graphqlSchema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        r.Context(),
+	})
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// The health score (0-100) rolls the node's reliability into one number
+// buyers and registries can rank sellers by. It is the weighted mean of
+// five components, each 0-1, over the last hour:
+//
+//   - pi (30%): share of Pi reads (polls, pushes, camera captures) that
+//     worked.
+//   - freshness (25%): how recent the last sample is: 1 within two
+//     intervals, falling to 0 at ten. Left out while the schedule is
+//     quiescent or nobody is listening.
+//   - anomalies (15%): share of readings inside their kind's valid range.
+//   - peer_errors (15%): share of buyer stream writes that worked.
+//   - hedera_balance (15%): operator account balance from the mirror node,
+//     1 at HEALTH_BALANCE_OK_HBAR or more, 0 when empty.
+//
+// Components with no data (no buyers yet, no operator account) are left
+// out and the rest reweighted. The score is on /status and /metrics and is
+// published to our stdout topic every HEALTH_PUBLISH_MINUTES (0 disables).
+
+const healthWindowMinutes = 60
+
+type healthComponent string
+
+const (
+	healthPi         healthComponent = "pi"
+	healthFreshness  healthComponent = "freshness"
+	healthAnomalies  healthComponent = "anomalies"
+	healthPeerWrites healthComponent = "peer_errors"
+	healthBalance    healthComponent = "hedera_balance"
+)
+
+var healthWeights = []struct {
+	component healthComponent
+	weight    float64
+}{
+	{healthPi, 0.30},
+	{healthFreshness, 0.25},
+	{healthAnomalies, 0.15},
+	{healthPeerWrites, 0.15},
+	{healthBalance, 0.15},
+}
+
+// outcomeWindow counts good and bad outcomes per minute over the window.
+type outcomeWindow struct {
+	minutes [healthWindowMinutes]struct {
+		minute    int64
+		good, bad int
+	}
+}
+
+func (o *outcomeWindow) add(now time.Time, good bool) {
+	m := now.Unix() / 60
+	b := &o.minutes[m%healthWindowMinutes]
+	if b.minute != m {
+		b.minute, b.good, b.bad = m, 0, 0
+	}
+	if good {
+		b.good++
+	} else {
+		b.bad++
+	}
+}
+
+// ratio is the share of good outcomes, false without any.
+func (o *outcomeWindow) ratio(now time.Time) (float64, bool) {
+	m := now.Unix() / 60
+	var good, total int
+	for _, b := range o.minutes {
+		if m-b.minute < healthWindowMinutes {
+			good += b.good
+			total += b.good + b.bad
+		}
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return float64(good) / float64(total), true
+}
+
+type healthMonitor struct {
+	interval     time.Duration
+	balanceOK    float64 // hbar
+	publishEvery time.Duration
+
+	mu          sync.Mutex
+	outcomes    map[healthComponent]*outcomeWindow
+	lastSample  time.Time
+	idleSince   time.Time
+	balance     float64 // hbar
+	balanceAt   time.Time
+	balanceErr  string
+	lastPublish time.Time
+}
+
+var nodeHealth = &healthMonitor{outcomes: map[healthComponent]*outcomeWindow{}}
+
+func loadHealth() {
+	neuron, _ := getNeuronSellerConfig()
+	nodeHealth.interval = neuron.ensureDefaults().StreamInterval
+	nodeHealth.balanceOK = math.Max(parseEnvFloat("HEALTH_BALANCE_OK_HBAR", 10), 0.01)
+	nodeHealth.publishEvery = time.Duration(max(parseEnvInt("HEALTH_PUBLISH_MINUTES", 60), 0)) * time.Minute
+	if hederaNet.AccountID != "" {
+		go nodeHealth.watchBalance()
+	}
+	if nodeHealth.publishEvery > 0 && neuronStreamingEnabled() {
+		go nodeHealth.publishLoop()
+	}
+}
+
+// Observe records a good or bad outcome for a rate component.
+func (h *healthMonitor) Observe(c healthComponent, good bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	o, ok := h.outcomes[c]
+	if !ok {
+		o = &outcomeWindow{}
+		h.outcomes[c] = o
+	}
+	o.add(time.Now(), good)
+}
+
+// Sampled notes that a sample was produced.
+func (h *healthMonitor) Sampled(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSample = now
+	h.idleSince = time.Time{}
+}
+
+// Idle notes that a tick went unsampled on purpose (quiescent schedule, no
+// audience), so staleness isn't held against the node.
+func (h *healthMonitor) Idle(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.idleSince.IsZero() {
+		h.idleSince = now
+	}
+}
+
+// Serving reports whether the node is sampling on time, or idle on purpose.
+func (h *healthMonitor) Serving(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.idleSince.IsZero() {
+		return true
+	}
+	since := h.lastSample
+	if since.IsZero() {
+		since = processStartedAt
+	}
+	return h.interval <= 0 || now.Sub(since) <= 2*power.Interval(h.interval)
+}
+
+// Score is the composite score and its components.
+func (h *healthMonitor) Score(now time.Time) (int, map[healthComponent]float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	components := map[healthComponent]float64{}
+	for _, c := range []healthComponent{healthPi, healthAnomalies, healthPeerWrites} {
+		if o, ok := h.outcomes[c]; ok {
+			if r, ok := o.ratio(now); ok {
+				components[c] = r
+			}
+		}
+	}
+	if h.idleSince.IsZero() && h.interval > 0 {
+		since := h.lastSample
+		if since.IsZero() {
+			since = processStartedAt
+		}
+		age := now.Sub(since).Seconds() / h.interval.Seconds()
+		components[healthFreshness] = math.Max(0, math.Min(1, (10-age)/8))
+	}
+	if !h.balanceAt.IsZero() {
+		components[healthBalance] = math.Min(1, h.balance/h.balanceOK)
+	}
+
+	var sum, weights float64
+	for _, w := range healthWeights {
+		if v, ok := components[w.component]; ok {
+			sum += v * w.weight
+			weights += w.weight
+		}
+	}
+	for c, v := range components {
+		components[c] = math.Round(v*1000) / 1000
+	}
+	if weights == 0 {
+		return 100, components
+	}
+	return int(math.Round(100 * sum / weights)), components
+}
+
+func healthGrade(score int) string {
+	switch {
+	case score >= 80:
+		return "ok"
+	case score >= 50:
+		return "degraded"
+	}
+	return "poor"
+}
+
+// Status is the health report for /status and HCS.
+func (h *healthMonitor) Status() map[string]any {
+	score, components := h.Score(time.Now())
+	out := map[string]any{"score": score, "grade": healthGrade(score), "components": components}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.balanceAt.IsZero() {
+		out["hedera_balance_hbar"] = h.balance
+	}
+	if h.balanceErr != "" {
+		out["balance_error"] = h.balanceErr
+	}
+	if !h.lastPublish.IsZero() {
+		out["last_published"] = h.lastPublish.UTC().Format(time.RFC3339)
+	}
+	return out
+}
+
+// watchBalance reads the operator account balance every 15 minutes.
+func (h *healthMonitor) watchBalance() {
+	for {
+		var account struct {
+			Balance struct {
+				Balance int64 `json:"balance"`
+			} `json:"balance"`
+		}
+		err := getJSON(hederaNet.MirrorURL+"/accounts/"+hederaNet.AccountID, &account)
+		h.mu.Lock()
+		if err != nil {
+			h.balanceErr = err.Error()
+		} else {
+			h.balance = float64(account.Balance.Balance) / 1e8
+			h.balanceAt = time.Now()
+			h.balanceErr = ""
+		}
+		h.mu.Unlock()
+		time.Sleep(15 * time.Minute)
+	}
+}
+
+type healthReport struct {
+	MessageType string                      `json:"messageType"`
+	SellerID    string                      `json:"seller_id"`
+	Score       int                         `json:"score"`
+	Grade       string                      `json:"grade"`
+	Components  map[healthComponent]float64 `json:"components"`
+	Time        time.Time                   `json:"time"`
+	Version     string                      `json:"v"`
+}
+
+func (h *healthMonitor) publishLoop() {
+	t := time.NewTicker(h.publishEvery)
+	defer t.Stop()
+	for now := range t.C {
+		score, components := h.Score(now)
+		data, err := json.Marshal(healthReport{
+			MessageType: "localsenseHealth",
+			SellerID:    sellerCfg.SellerID,
+			Score:       score,
+			Grade:       healthGrade(score),
+			Components:  components,
+			Time:        now.UTC(),
+			Version:     "0.1",
+		})
+		if err != nil {
+			continue
+		}
+		if err := sendToTopic(commonlib.MyStdOut, data, "health report"); err != nil && !errors.Is(err, errHederaQueued) {
+			log.Printf("neuron-seller: health report failed: %v", err)
+			continue
+		}
+		h.mu.Lock()
+		h.lastPublish = now
+		h.mu.Unlock()
+	}
+}
+
+func writeHealthMetrics(w http.ResponseWriter) {
+	score, components := nodeHealth.Score(time.Now())
+	fmt.Fprintln(w, "# HELP localsense_health_score Composite node health, 0-100.")
+	fmt.Fprintln(w, "# TYPE localsense_health_score gauge")
+	fmt.Fprintf(w, "localsense_health_score %d\n", score)
+	fmt.Fprintln(w, "# HELP localsense_health_component Health score components, 0-1.")
+	fmt.Fprintln(w, "# TYPE localsense_health_component gauge")
+	for _, hw := range healthWeights {
+		if v, ok := components[hw.component]; ok {
+			fmt.Fprintf(w, "localsense_health_component{component=%q} %g\n", hw.component, v)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+// Delta mode and quiescent schedule windows can keep a buyer stream silent
+// for a long time. Any stream that got nothing for HEARTBEAT_INTERVAL_SECONDS
+// gets a small heartbeat frame instead, so buyers and intermediaries can tell
+// "nothing new" from "connection dead": a buyer that sees neither samples nor
+// heartbeats for a few intervals should reconnect.
+
+type heartbeatFrame struct {
+	Type     string `json:"type"` // always "heartbeat"
+	SellerID string `json:"seller_id"`
+	Kind     string `json:"kind"`
+	Ts       int64  `json:"ts"`
+	LastSeq  uint64 `json:"last_seq"`
+	State    string `json:"state"` // active, quiescent (see localsenseSchedule) or maintenance
+	Interval int    `json:"interval"`
+}
+
+// sendHeartbeats writes a heartbeat to every buyer stream that has been
+// idle for at least the heartbeat interval.
+func (s *neuronSeller) sendHeartbeats(p2pHost host.Host, buffers *commonlib.NodeBuffers, now time.Time) {
+	state := "quiescent"
+	switch {
+	case underMaintenance():
+		state = "maintenance"
+	case s.scheduleActive:
+		state = "active"
+	}
+
+	for peerID, bufferInfo := range buffers.GetBufferMap() {
+		if bufferInfo.LibP2PState != types.Connected || !buyerPaid(bufferInfo) {
+			continue
+		}
+		for i, kind := range s.cfg.Kinds {
+			if !buyerWantsKind(bufferInfo, kind, i == 0) {
+				continue
+			}
+			proto := streamProtocol(bufferInfo, kind)
+			key := string(peerID) + string(proto)
+			if now.Sub(s.lastSent[key]) < s.cfg.HeartbeatInterval || s.batches[key] != nil {
+				continue
+			}
+
+			data, err := json.Marshal(heartbeatFrame{
+				Type:     "heartbeat",
+				SellerID: sellerCfg.SellerID,
+				Kind:     kind.Name,
+				Ts:       now.UTC().Unix(),
+				LastSeq:  sequencer.Last(kind.Name),
+				State:    state,
+				Interval: int(s.cfg.HeartbeatInterval / time.Second),
+			})
+			if err != nil {
+				log.Printf("neuron-seller: marshal heartbeat: %v", err)
+				return
+			}
+
+			codec := buyerCodec(bufferInfo, s.cfg.Codec)
+			frame := append(data, '\n')
+			if lengthFramed(codec) {
+				frame = lengthPrefixed(data)
+			}
+			if err := s.writeBuyerFrame(p2pHost, buffers, peerID, bufferInfo, proto, codec, frame); err != nil {
+				log.Printf("neuron-seller: heartbeat to %s failed: %v", peerID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	hedera_helper "github.com/NeuronInnovations/neuron-go-hedera-sdk/hedera"
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+	"github.com/hashgraph/hedera-sdk-go/v2"
+)
+
+// Topic messages the node sends on its own (anchors, audit anchors,
+// registrations, invoices, command replies, deletion attestations, schedule
+// announcements) go through a queue, so an internet outage on a flaky rural
+// link doesn't lose them. A submission that fails without an answer from
+// the network (timeouts, unreachable nodes) is queued, as is every one after
+// it while the queue is non-empty, so messages reach their topics in the
+// order they were sent. The queue is retried every HEDERA_QUEUE_RETRY_SECONDS
+// and kept in HEDERA_QUEUE_FILE across restarts, up to HEDERA_QUEUE_MAX
+// messages (the oldest are dropped beyond that). Rejections by the network
+// (precheck failures such as a bad topic or an empty balance) are returned
+// to the caller as before; retrying wouldn't help.
+//
+// peerError messages to buyers aren't queued: they're stale once the link
+// is back.
+
+// errHederaQueued is returned by sendToTopic when the message was queued
+// rather than sent.
+var errHederaQueued = errors.New("Hedera unreachable, message queued")
+
+type queuedMessage struct {
+	Topic    string    `json:"topic"`
+	Data     string    `json:"data"`
+	Label    string    `json:"label"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+type hederaQueue struct {
+	path  string
+	max   int
+	retry time.Duration
+
+	mu      sync.Mutex
+	pending []queuedMessage
+	lastErr string
+	sent    int64
+	dropped int64
+}
+
+var hederaOutbox = &hederaQueue{max: 1000, retry: 30 * time.Second}
+
+func loadHederaQueue() {
+	hederaOutbox.path = getEnvOrDefault("HEDERA_QUEUE_FILE", "data/hedera_queue.json")
+	hederaOutbox.max = max(parseEnvInt("HEDERA_QUEUE_MAX", 1000), 1)
+	hederaOutbox.retry = time.Duration(max(parseEnvInt("HEDERA_QUEUE_RETRY_SECONDS", 30), 1)) * time.Second
+	if err := hederaOutbox.load(); err != nil {
+		log.Printf("hedera-queue: load %s: %v", hederaOutbox.path, err)
+	}
+	if n := hederaOutbox.Pending(); n > 0 {
+		log.Printf("HederaQ   : %d messages queued from the last run", n)
+	}
+	go hederaOutbox.run()
+}
+
+// sendToTopic submits data to topic, or queues it when Hedera can't be
+// reached; label names the message in logs.
+func sendToTopic(topic hedera.TopicID, data []byte, label string) error {
+	return hederaOutbox.send(topic, string(data), label)
+}
+
+// sendEnvelope is sendToTopic for an SDK postal envelope.
+func sendEnvelope(env types.TopicPostalEnvelope, label string) error {
+	data, err := json.Marshal(env.Message)
+	if err != nil {
+		return err
+	}
+	return sendToTopic(env.OtherStdInTopic, data, label)
+}
+
+func (q *hederaQueue) send(topic hedera.TopicID, data, label string) error {
+	q.mu.Lock()
+	backlog := len(q.pending) > 0
+	q.mu.Unlock()
+	if !backlog {
+		err := hedera_helper.SendToTopic(topic, data)
+		if err == nil || !hederaUnreachable(err) {
+			return err
+		}
+		q.setErr(err)
+	}
+	q.enqueue(queuedMessage{Topic: topic.String(), Data: data, Label: label, QueuedAt: time.Now().UTC()})
+	return errHederaQueued
+}
+
+// hederaUnreachable is true for errors where the network never answered.
+func hederaUnreachable(err error) bool {
+	var precheck hedera.ErrHederaPreCheckStatus
+	var receipt hedera.ErrHederaReceiptStatus
+	return !errors.As(err, &precheck) && !errors.As(err, &receipt)
+}
+
+func (q *hederaQueue) enqueue(m queuedMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = append(q.pending, m)
+	if over := len(q.pending) - q.max; over > 0 {
+		log.Printf("hedera-queue: full, dropping %d oldest messages", over)
+		q.pending = q.pending[over:]
+		q.dropped += int64(over)
+	}
+	log.Printf("hedera-queue: queued %s for %s (%d pending)", m.Label, m.Topic, len(q.pending))
+	if err := q.saveLocked(); err != nil {
+		log.Printf("hedera-queue: save: %v", err)
+	}
+}
+
+func (q *hederaQueue) run() {
+	t := time.NewTicker(q.retry)
+	defer t.Stop()
+	for range t.C {
+		q.flush()
+	}
+}
+
+// flush sends queued messages in order until one fails.
+func (q *hederaQueue) flush() {
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		m := q.pending[0]
+		q.mu.Unlock()
+
+		topic, err := hedera.TopicIDFromString(m.Topic)
+		if err == nil {
+			err = hedera_helper.SendToTopic(topic, m.Data)
+		}
+		if err != nil && hederaUnreachable(err) {
+			q.setErr(err)
+			return
+		}
+
+		q.mu.Lock()
+		q.pending = q.pending[1:]
+		if err != nil {
+			log.Printf("hedera-queue: %s for %s rejected, dropped: %v", m.Label, m.Topic, err)
+			q.dropped++
+		} else {
+			log.Printf("hedera-queue: sent %s for %s, queued %s ago", m.Label, m.Topic, time.Since(m.QueuedAt).Round(time.Second))
+			q.sent++
+		}
+		if len(q.pending) == 0 {
+			q.lastErr = ""
+		}
+		if err := q.saveLocked(); err != nil {
+			log.Printf("hedera-queue: save: %v", err)
+		}
+		q.mu.Unlock()
+	}
+}
+
+func (q *hederaQueue) setErr(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.lastErr = err.Error()
+}
+
+// Pending is the number of queued messages.
+func (q *hederaQueue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+func (q *hederaQueue) load() error {
+	data, err := os.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return json.Unmarshal(data, &q.pending)
+}
+
+func (q *hederaQueue) saveLocked() error {
+	if len(q.pending) == 0 {
+		err := os.Remove(q.path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.Marshal(q.pending)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0o755); err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// Status is the queue state for /status.
+func (q *hederaQueue) Status() map[string]any {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := map[string]any{"pending": len(q.pending), "sent": q.sent, "dropped": q.dropped}
+	if len(q.pending) > 0 {
+		out["oldest"] = q.pending[0].QueuedAt.Format(time.RFC3339)
+	}
+	if q.lastErr != "" {
+		out["error"] = q.lastErr
+	}
+	return out
+}
+
+func writeHederaQueueMetrics(w http.ResponseWriter) {
+	q := hederaOutbox
+	q.mu.Lock()
+	pending, sent, dropped := len(q.pending), q.sent, q.dropped
+	q.mu.Unlock()
+	fmt.Fprintln(w, "# HELP localsense_hedera_queue_pending Topic messages waiting for Hedera to be reachable.")
+	fmt.Fprintln(w, "# TYPE localsense_hedera_queue_pending gauge")
+	fmt.Fprintf(w, "localsense_hedera_queue_pending %d\n", pending)
+	fmt.Fprintln(w, "# HELP localsense_hedera_queue_sent_total Queued topic messages sent after reconnecting.")
+	fmt.Fprintln(w, "# TYPE localsense_hedera_queue_sent_total counter")
+	fmt.Fprintf(w, "localsense_hedera_queue_sent_total %d\n", sent)
+	fmt.Fprintln(w, "# HELP localsense_hedera_queue_dropped_total Queued topic messages dropped (queue full or rejected).")
+	fmt.Fprintln(w, "# TYPE localsense_hedera_queue_dropped_total counter")
+	fmt.Fprintf(w, "localsense_hedera_queue_dropped_total %d\n", dropped)
+}
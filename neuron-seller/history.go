@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyRecord is one line of the on-disk sample log.
+type historyRecord struct {
+	Seq     uint64          `json:"seq"`
+	Ts      int64           `json:"ts"`
+	Kind    string          `json:"kind"`
+	Value   float64         `json:"value"`
+	Payload json.RawMessage `json:"payload"`
+
+	// Tags the sample was sent with, for filtering without decoding Payload.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// ID is the sample's ULID; records from before IDs have none.
+	ID string `json:"id,omitempty"`
+}
+
+// historyPos is where a record's line starts.
+type historyPos struct {
+	day    string
+	offset int64
+}
+
+// historyStore is an append-only log of produced samples, one JSONL file per
+// UTC day under HISTORY_DIR. Appends are fsync'ed on day rollover and close
+// only; losing the last few seconds on power cut is acceptable here.
+type historyStore struct {
+	mu    sync.Mutex
+	dir   string
+	day   string
+	file  *os.File
+	tiers tierConfig
+
+	// byID indexes raw records by ID; size is the open file's length.
+	byID map[string]historyPos
+	size int64
+}
+
+var history *historyStore
+
+func loadHistoryStore() {
+	if !parseEnvBool("HISTORY_ENABLE", true) {
+		return
+	}
+	dir := getEnvOrDefault("HISTORY_DIR", "data/history")
+	store, err := openHistoryStore(dir)
+	if err != nil {
+		log.Fatalf("history: %v", err)
+	}
+	store.tiers = loadTierConfig()
+	history = store
+	go store.compactLoop()
+	log.Printf("History   : %s (raw %s, 1m %s, 1h %s)", dir,
+		store.tiers.Raw.Retention, store.tiers.Minute.Retention, store.tiers.Hour.Retention)
+}
+
+func openHistoryStore(dir string) (*historyStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create %s: %w", dir, err)
+	}
+	h := &historyStore{dir: dir}
+	// Resume every kind's sequence so buyers don't see it restart.
+	if err := h.reindex(func(rec historyRecord) { sequencer.Seed(rec.Kind, rec.Seq) }); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// reindex rebuilds the ID index from the raw day files, passing every
+// record to seen if set. Callers other than openHistoryStore hold h.mu.
+func (h *historyStore) reindex(seen func(historyRecord)) error {
+	days, err := h.days()
+	if err != nil {
+		return err
+	}
+	byID := map[string]historyPos{}
+	for _, day := range days {
+		err := h.scanDayAt(day, func(rec historyRecord, offset int64) bool {
+			if rec.ID != "" {
+				byID[rec.ID] = historyPos{day, offset}
+			}
+			if seen != nil {
+				seen(rec)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	h.byID = byID
+	return nil
+}
+
+func dayOf(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format("2006-01-02")
+}
+
+func (h *historyStore) dayPath(day string) string {
+	return filepath.Join(h.dir, day+".jsonl")
+}
+
+// days lists the stored days in ascending order.
+func (h *historyStore) days() ([]string, error) {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %w", h.dir, err)
+	}
+	var days []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".jsonl") {
+			continue
+		}
+		days = append(days, strings.TrimSuffix(name, ".jsonl"))
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// Append stores a record; its Seq comes from the sequencer.
+func (h *historyStore) Append(rec historyRecord) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	day := dayOf(rec.Ts)
+	if h.file == nil || h.day != day {
+		if h.file != nil {
+			h.file.Sync()
+			h.file.Close()
+		}
+		f, err := os.OpenFile(h.dayPath(day), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			h.file = nil
+			return fmt.Errorf("open history file: %w", err)
+		}
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			h.file = nil
+			return fmt.Errorf("open history file: %w", err)
+		}
+		h.file, h.day, h.size = f, day, st.Size()
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("marshal history record: %w", err)
+	}
+	n, err := h.file.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("write history record: %w", err)
+	}
+	if rec.ID != "" {
+		h.byID[rec.ID] = historyPos{day, h.size}
+	}
+	h.size += int64(n)
+	return nil
+}
+
+// Get returns the raw record with id, false if there is none (any more).
+func (h *historyStore) Get(id string) (historyRecord, bool, error) {
+	h.mu.Lock()
+	pos, ok := h.byID[id]
+	if ok && h.file != nil && h.day == pos.day {
+		h.file.Sync()
+	}
+	h.mu.Unlock()
+	if !ok {
+		return historyRecord{}, false, nil
+	}
+
+	f, err := os.Open(h.dayPath(pos.day))
+	if errors.Is(err, fs.ErrNotExist) {
+		return historyRecord{}, false, nil
+	}
+	if err != nil {
+		return historyRecord{}, false, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(pos.offset, io.SeekStart); err != nil {
+		return historyRecord{}, false, err
+	}
+	line, err := bufio.NewReaderSize(f, 4096).ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return historyRecord{}, false, err
+	}
+	var rec historyRecord
+	if err := json.Unmarshal(line, &rec); err != nil || rec.ID != id {
+		return historyRecord{}, false, nil
+	}
+	return rec, true, nil
+}
+
+// scanDay calls fn for every record of a day until fn returns false.
+// Corrupt lines (e.g. a torn final write) are skipped.
+func (h *historyStore) scanDay(day string, fn func(historyRecord) bool) error {
+	return h.scanDayAt(day, func(rec historyRecord, _ int64) bool { return fn(rec) })
+}
+
+// scanDayAt is scanDay, also passing the offset of each record's line.
+func (h *historyStore) scanDayAt(day string, fn func(historyRecord, int64) bool) error {
+	f, err := os.Open(h.dayPath(day))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	var offset int64
+	for sc.Scan() {
+		line := sc.Bytes()
+		at := offset
+		offset += int64(len(line)) + 1
+		var rec historyRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			continue
+		}
+		if !fn(rec, at) {
+			return nil
+		}
+	}
+	return sc.Err()
+}
+
+// Query returns records with from <= ts < to, optionally of one kind, oldest
+// first, at most limit records (0 means no limit).
+func (h *historyStore) Query(from, to time.Time, kind string, limit int) ([]historyRecord, error) {
+	return h.QueryTagged(from, to, kind, nil, limit)
+}
+
+// QueryTagged is Query for records carrying every tag in tagged.
+func (h *historyStore) QueryTagged(from, to time.Time, kind string, tagged map[string]string, limit int) ([]historyRecord, error) {
+	h.mu.Lock()
+	if h.file != nil {
+		h.file.Sync()
+	}
+	h.mu.Unlock()
+
+	days, err := h.days()
+	if err != nil {
+		return nil, err
+	}
+	fromDay, toDay := dayOf(from.Unix()), dayOf(to.Unix())
+
+	var out []historyRecord
+	for _, day := range days {
+		if day < fromDay || day > toDay {
+			continue
+		}
+		err := h.scanDay(day, func(rec historyRecord) bool {
+			if rec.Ts < from.Unix() || rec.Ts >= to.Unix() || (kind != "" && rec.Kind != kind) || !tagsMatch(rec.Tags, tagged) {
+				return true
+			}
+			out = append(out, rec)
+			return limit <= 0 || len(out) < limit
+		})
+		if err != nil {
+			return nil, err
+		}
+		if limit > 0 && len(out) >= limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+// GET /history?id= returns the one raw record with that sample ID.
+//
+// GET /history?from=&to=&kind=&limit=&resolution=&tag= with RFC3339 or
+// unix-second bounds; defaults to the last hour. Without resolution the
+// finest tier still retained at from is used: raw records within the raw
+// window, else 1m or 1h buckets. tag=key:value (repeatable) keeps records
+// carrying those tags; buckets don't keep tags, so it implies raw.
+// Records and buckets are shown at the public privacy tier.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if history == nil {
+		writeJSONError(w, ErrDisabled.With("history disabled (HISTORY_ENABLE=false)"))
+		return
+	}
+
+	q := r.URL.Query()
+	if id := q.Get("id"); id != "" {
+		if !validULID(id) {
+			writeJSONError(w, ErrBadRequest.With("invalid id: want a 26-character ULID"))
+			return
+		}
+		rec, ok, err := history.Get(id)
+		if err == nil && ok {
+			rec, err = privacy.Public().Record(rec)
+		}
+		switch {
+		case err != nil:
+			writeJSONError(w, ErrInternal.Wrap(err))
+		case !ok:
+			writeJSONError(w, ErrNotFound.With("no raw record with id "+id))
+		default:
+			writeJSON(w, http.StatusOK, rec)
+		}
+		return
+	}
+
+	now := time.Now().UTC()
+	from, err := parseTimeParam(q.Get("from"), now.Add(-time.Hour))
+	if err != nil {
+		writeJSONError(w, ErrBadRequest.With("invalid from: "+err.Error()))
+		return
+	}
+	to, err := parseTimeParam(q.Get("to"), now.Add(time.Second))
+	if err != nil {
+		writeJSONError(w, ErrBadRequest.With("invalid to: "+err.Error()))
+		return
+	}
+	limit := 1000
+	if l := q.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			writeJSONError(w, ErrBadRequest.With("invalid limit"))
+			return
+		}
+	}
+
+	tagged, err := tagFilter(q)
+	if err != nil {
+		writeJSONError(w, ErrBadRequest.Wrap(err))
+		return
+	}
+
+	res := q.Get("resolution")
+	switch {
+	case res == "" && len(tagged) > 0:
+		res = resolutionRaw
+	case res == "":
+		res = history.tiers.resolutionFor(from, now)
+	case len(tagged) > 0 && res != resolutionRaw:
+		writeJSONError(w, ErrBadRequest.With("tag filters need resolution=raw"))
+		return
+	case res == resolutionRaw, res == resolution1m, res == resolution1h:
+	default:
+		writeJSONError(w, ErrBadRequest.With("resolution must be raw, 1m or 1h"))
+		return
+	}
+
+	if res != resolutionRaw {
+		buckets, err := history.QueryAggregates(from, to, q.Get("kind"), res, limit)
+		if err != nil {
+			writeJSONError(w, ErrInternal.Wrap(err))
+			return
+		}
+		buckets = aggregateNoise.Buckets(buckets)
+		privacy.Public().Buckets(buckets)
+		writeJSON(w, http.StatusOK, map[string]any{
+			"from":        from,
+			"to":          to,
+			"resolution":  res,
+			"count":       len(buckets),
+			"buckets":     buckets,
+			"annotations": annotations.Overlapping(from, to, q.Get("kind")),
+		})
+		return
+	}
+
+	records, err := history.QueryTagged(from, to, q.Get("kind"), tagged, limit)
+	if err == nil {
+		err = privacy.Public().Records(records)
+	}
+	if err != nil {
+		writeJSONError(w, ErrInternal.Wrap(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"from":        from,
+		"to":          to,
+		"resolution":  res,
+		"count":       len(records),
+		"records":     records,
+		"annotations": annotations.Overlapping(from, to, q.Get("kind")),
+	})
+}
+
+// parseTimeParam accepts RFC3339 or unix seconds.
+func parseTimeParam(s string, fallback time.Time) (time.Time, error) {
+	if s == "" {
+		return fallback, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// kindStats folds the samples between from and to into count, min, max and
+// mean per kind, at the finest resolution history still has for from.
+func kindStats(from, to time.Time, kind string) ([]map[string]any, string, error) {
+	res := history.tiers.resolutionFor(from, time.Now().UTC())
+
+	// Fold everything into one bucket per kind.
+	agg := newAggregator(res, time.Duration(math.MaxInt64))
+	if res == resolutionRaw {
+		records, err := history.Query(from, to, kind, 0)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, rec := range records {
+			agg.addRaw(rec)
+		}
+	} else {
+		buckets, err := history.QueryAggregates(from, to, kind, res, 0)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, b := range buckets {
+			agg.addAggregate(b)
+		}
+	}
+
+	var out []map[string]any
+	for _, b := range agg.records() {
+		b, ok := aggregateNoise.Bucket(b)
+		if !ok {
+			continue
+		}
+		stats := map[string]any{
+			"kind":       b.Kind,
+			"count":      b.Count,
+			"min":        b.Min,
+			"max":        b.Max,
+			"mean":       b.Mean,
+			"resolution": res,
+		}
+		if aggregateNoise != nil {
+			stats["noise"] = aggregateNoise.params(b.Kind)
+		}
+		out = append(out, stats)
+	}
+	return out, res, nil
+}
+
+// GET /stats?from=&to=&kind= – per-kind stats over the range (with history
+// on) and where the sun is over the seller now.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	now := time.Now().UTC()
+	from, err := parseTimeParam(q.Get("from"), now.Add(-time.Hour))
+	if err != nil {
+		writeJSONError(w, ErrBadRequest.With("invalid from: "+err.Error()))
+		return
+	}
+	to, err := parseTimeParam(q.Get("to"), now.Add(time.Second))
+	if err != nil {
+		writeJSONError(w, ErrBadRequest.With("invalid to: "+err.Error()))
+		return
+	}
+	loc := currentLocation()
+	resp := map[string]any{
+		"from":  from,
+		"to":    to,
+		"solar": sunPosition(loc.Lat, loc.Lon, now),
+	}
+	if history != nil {
+		kinds, res, err := kindStats(from, to, q.Get("kind"))
+		if err != nil {
+			writeJSONError(w, ErrInternal.Wrap(err))
+			return
+		}
+		resp["kinds"] = kinds
+		resp["resolution"] = res
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
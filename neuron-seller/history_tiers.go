@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Older history is kept at lower resolution: raw samples for
+// HISTORY_RAW_RETENTION_HOURS, 1-minute aggregates for
+// HISTORY_1M_RETENTION_DAYS and hourly aggregates for
+// HISTORY_1H_RETENTION_DAYS. Aggregates live next to the raw files in 1m/
+// and 1h/ subdirectories, one JSONL file per UTC day, and are rolled up once
+// a day is complete. Days not rolled up yet are aggregated on the fly, so
+// every tier always covers up to now.
+
+type historyTier struct {
+	Name      string
+	Bucket    time.Duration
+	Retention time.Duration
+}
+
+const (
+	resolutionRaw = "raw"
+	resolution1m  = "1m"
+	resolution1h  = "1h"
+)
+
+type tierConfig struct {
+	Raw, Minute, Hour historyTier
+	CompactInterval   time.Duration
+}
+
+// aggregateRecord is one bucket of a kind at 1m or 1h resolution.
+type aggregateRecord struct {
+	Ts       int64   `json:"ts"` // bucket start, unix seconds
+	Kind     string  `json:"kind"`
+	Res      string  `json:"res"`
+	Count    int     `json:"count"`
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+	Mean     float64 `json:"mean"`
+	FirstSeq uint64  `json:"first_seq,omitempty"`
+	LastSeq  uint64  `json:"last_seq,omitempty"`
+
+	// Provenance is filled in on query, never stored.
+	Provenance *derivation `json:"provenance,omitempty"`
+}
+
+func loadTierConfig() tierConfig {
+	return tierConfig{
+		Raw:             historyTier{resolutionRaw, 0, time.Duration(parseEnvInt("HISTORY_RAW_RETENTION_HOURS", 24)) * time.Hour},
+		Minute:          historyTier{resolution1m, time.Minute, time.Duration(parseEnvInt("HISTORY_1M_RETENTION_DAYS", 30)) * 24 * time.Hour},
+		Hour:            historyTier{resolution1h, time.Hour, time.Duration(parseEnvInt("HISTORY_1H_RETENTION_DAYS", 365)) * 24 * time.Hour},
+		CompactInterval: time.Duration(parseEnvInt("HISTORY_COMPACT_INTERVAL_MINUTES", 10)) * time.Minute,
+	}
+}
+
+// resolutionFor picks the finest tier still retained at from.
+func (c tierConfig) resolutionFor(from, now time.Time) string {
+	switch {
+	case !from.Before(now.Add(-c.Raw.Retention)):
+		return resolutionRaw
+	case !from.Before(now.Add(-c.Minute.Retention)):
+		return resolution1m
+	default:
+		return resolution1h
+	}
+}
+
+func (h *historyStore) tierDir(res string) string {
+	if res == resolutionRaw {
+		return h.dir
+	}
+	return filepath.Join(h.dir, res)
+}
+
+func (h *historyStore) tierPath(res, day string) string {
+	return filepath.Join(h.tierDir(res), day+".jsonl")
+}
+
+// daysIn lists the days stored for a tier in ascending order.
+func (h *historyStore) daysIn(res string) ([]string, error) {
+	entries, err := os.ReadDir(h.tierDir(res))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %w", h.tierDir(res), err)
+	}
+	var days []string
+	for _, e := range entries {
+		if name := e.Name(); !e.IsDir() && strings.HasSuffix(name, ".jsonl") {
+			days = append(days, strings.TrimSuffix(name, ".jsonl"))
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// aggregator folds raw records or finer aggregates into buckets.
+type aggregator struct {
+	res    string
+	bucket int64
+	out    map[string]*aggregateRecord
+}
+
+func newAggregator(res string, bucket time.Duration) *aggregator {
+	return &aggregator{res: res, bucket: int64(bucket / time.Second), out: make(map[string]*aggregateRecord)}
+}
+
+func (a *aggregator) add(kind string, ts int64, count int, min, max, mean float64, firstSeq, lastSeq uint64) {
+	start := ts - ts%a.bucket
+	key := fmt.Sprintf("%s|%d", kind, start)
+	b, ok := a.out[key]
+	if !ok {
+		a.out[key] = &aggregateRecord{Ts: start, Kind: kind, Res: a.res, Count: count, Min: min, Max: max, Mean: mean, FirstSeq: firstSeq, LastSeq: lastSeq}
+		return
+	}
+	b.Mean = (b.Mean*float64(b.Count) + mean*float64(count)) / float64(b.Count+count)
+	b.Count += count
+	b.Min = minFloat(b.Min, min)
+	b.Max = maxFloat(b.Max, max)
+	if firstSeq > 0 && (b.FirstSeq == 0 || firstSeq < b.FirstSeq) {
+		b.FirstSeq = firstSeq
+	}
+	if lastSeq > b.LastSeq {
+		b.LastSeq = lastSeq
+	}
+}
+
+func (a *aggregator) addRaw(rec historyRecord) {
+	a.add(rec.Kind, rec.Ts, 1, rec.Value, rec.Value, rec.Value, rec.Seq, rec.Seq)
+}
+
+func (a *aggregator) addAggregate(rec aggregateRecord) {
+	a.add(rec.Kind, rec.Ts, rec.Count, rec.Min, rec.Max, rec.Mean, rec.FirstSeq, rec.LastSeq)
+}
+
+// records returns the buckets ordered by time, then kind.
+func (a *aggregator) records() []aggregateRecord {
+	out := make([]aggregateRecord, 0, len(a.out))
+	for _, b := range a.out {
+		out = append(out, *b)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Ts != out[j].Ts {
+			return out[i].Ts < out[j].Ts
+		}
+		return out[i].Kind < out[j].Kind
+	})
+	return out
+}
+
+func minFloat(a, b float64) float64 {
+	if b < a {
+		return b
+	}
+	return a
+}
+
+func maxFloat(a, b float64) float64 {
+	if b > a {
+		return b
+	}
+	return a
+}
+
+// scanAggregates calls fn for every bucket stored in a tier file.
+func (h *historyStore) scanAggregates(res, day string, fn func(aggregateRecord)) error {
+	data, err := os.ReadFile(h.tierPath(res, day))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		var rec aggregateRecord
+		if line == "" || json.Unmarshal([]byte(line), &rec) != nil {
+			continue
+		}
+		fn(rec)
+	}
+	return nil
+}
+
+// aggregateDay builds a day's buckets at res from the finest data at hand:
+// the tier's own file, else the next finer tier, else raw samples.
+func (h *historyStore) aggregateDay(res, day string) ([]aggregateRecord, error) {
+	if fileExists(h.tierPath(res, day)) {
+		var out []aggregateRecord
+		err := h.scanAggregates(res, day, func(rec aggregateRecord) { out = append(out, rec) })
+		return out, err
+	}
+
+	bucket := time.Minute
+	if res == resolution1h {
+		bucket = time.Hour
+	}
+	agg := newAggregator(res, bucket)
+	if res == resolution1h && fileExists(h.tierPath(resolution1m, day)) {
+		err := h.scanAggregates(resolution1m, day, agg.addAggregate)
+		return agg.records(), err
+	}
+	err := h.scanDay(day, func(rec historyRecord) bool {
+		agg.addRaw(rec)
+		return true
+	})
+	return agg.records(), err
+}
+
+func writeAggregates(path string, recs []aggregateRecord) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	var buf []byte
+	for _, rec := range recs {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// QueryAggregates returns buckets at res with from <= ts < to, oldest first.
+func (h *historyStore) QueryAggregates(from, to time.Time, kind, res string, limit int) ([]aggregateRecord, error) {
+	h.mu.Lock()
+	if h.file != nil {
+		h.file.Sync()
+	}
+	h.mu.Unlock()
+
+	seen := map[string]bool{}
+	var days []string
+	for _, tier := range []string{resolutionRaw, resolution1m, resolution1h} {
+		tierDays, err := h.daysIn(tier)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range tierDays {
+			if !seen[d] {
+				seen[d] = true
+				days = append(days, d)
+			}
+		}
+	}
+	sort.Strings(days)
+
+	fromDay, toDay := dayOf(from.Unix()), dayOf(to.Unix())
+	var out []aggregateRecord
+	for _, day := range days {
+		if day < fromDay || day > toDay {
+			continue
+		}
+		recs, err := h.aggregateDay(res, day)
+		if err != nil {
+			return nil, fmt.Errorf("aggregate %s: %w", day, err)
+		}
+		for _, rec := range recs {
+			if rec.Ts < from.Unix() || rec.Ts >= to.Unix() || (kind != "" && rec.Kind != kind) {
+				continue
+			}
+			rec.Provenance = rec.provenance()
+			out = append(out, rec)
+			if limit > 0 && len(out) >= limit {
+				return out, nil
+			}
+		}
+	}
+	return out, nil
+}
+
+// compact rolls up complete days and drops data past each tier's retention.
+func (h *historyStore) compact(now time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	todayUTC := dayOf(now.Unix())
+	dayEnd := func(day string) time.Time {
+		t, _ := time.Parse("2006-01-02", day)
+		return t.Add(24 * time.Hour)
+	}
+
+	rawDays, err := h.daysIn(resolutionRaw)
+	if err != nil {
+		return err
+	}
+	for _, day := range rawDays {
+		if day >= todayUTC {
+			continue
+		}
+		for _, res := range []string{resolution1m, resolution1h} {
+			if fileExists(h.tierPath(res, day)) {
+				continue
+			}
+			recs, err := h.aggregateDay(res, day)
+			if err != nil {
+				return fmt.Errorf("roll up %s to %s: %w", day, res, err)
+			}
+			if err := writeAggregates(h.tierPath(res, day), recs); err != nil {
+				return fmt.Errorf("write %s %s: %w", res, day, err)
+			}
+		}
+		if dayEnd(day).Before(now.Add(-h.tiers.Raw.Retention)) {
+			if h.day == day && h.file != nil {
+				h.file.Close()
+				h.file, h.day = nil, ""
+			}
+			if err := os.Remove(h.dayPath(day)); err != nil {
+				return err
+			}
+			for id, pos := range h.byID {
+				if pos.day == day {
+					delete(h.byID, id)
+				}
+			}
+			log.Printf("history: raw samples of %s rolled up and removed", day)
+		}
+	}
+
+	for _, tier := range []historyTier{h.tiers.Minute, h.tiers.Hour} {
+		days, err := h.daysIn(tier.Name)
+		if err != nil {
+			return err
+		}
+		for _, day := range days {
+			if dayEnd(day).Before(now.Add(-tier.Retention)) {
+				if err := os.Remove(h.tierPath(tier.Name, day)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (h *historyStore) compactLoop() {
+	for {
+		if err := h.compact(time.Now()); err != nil {
+			log.Printf("history: compaction failed: %v", err)
+		}
+		time.Sleep(h.tiers.CompactInterval)
+	}
+}
+
+// purgeAggregates drops buckets starting in [after, before) from the 1m and
+// 1h tiers, so purged samples don't survive in rolled-up form.
+func (h *historyStore) purgeAggregates(after, before time.Time, res *purgeResult) error {
+	for _, tier := range []string{resolution1m, resolution1h} {
+		days, err := h.daysIn(tier)
+		if err != nil {
+			return err
+		}
+		for _, day := range days {
+			if day < dayOf(after.Unix()) || day > dayOf(before.Unix()) {
+				continue
+			}
+			var kept []aggregateRecord
+			dropped := 0
+			err := h.scanAggregates(tier, day, func(rec aggregateRecord) {
+				if rec.Ts >= after.Unix() && rec.Ts < before.Unix() {
+					dropped++
+				} else {
+					kept = append(kept, rec)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if dropped == 0 {
+				continue
+			}
+			name := tier + "/" + day
+			if len(kept) == 0 {
+				if err := os.Remove(h.tierPath(tier, day)); err != nil {
+					return err
+				}
+				res.FilesRemoved = append(res.FilesRemoved, name)
+				continue
+			}
+			if err := writeAggregates(h.tierPath(tier, day), kept); err != nil {
+				return err
+			}
+			res.FilesRewritten = append(res.FilesRewritten, name)
+		}
+	}
+	return nil
+}
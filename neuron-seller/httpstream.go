@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// /stream clients are written from their own goroutine so a slow one can't
+// hold up the sampling ticker. Lines queue in a buffer of
+// STREAM_BUFFER_LINES; each write and flush must finish within
+// STREAM_WRITE_TIMEOUT_SECONDS. A client whose buffer stays full for
+// STREAM_SLOW_CLIENT_SECONDS, or whose write times out, is evicted: it gets
+// a final {"type":"error","code":408,...} line if the connection still
+// takes one, and the stream ends. Lines that didn't fit meanwhile are
+// dropped and counted on /metrics.
+
+type streamConfig struct {
+	buffer       int
+	writeTimeout time.Duration
+	slowAfter    time.Duration
+}
+
+var (
+	streamCfg       streamConfig
+	streamEvictions atomic.Int64
+	streamDropped   atomic.Int64
+	streamClients   atomic.Int64
+)
+
+func loadStreamConfig() {
+	streamCfg = streamConfig{
+		buffer:       max(parseEnvInt("STREAM_BUFFER_LINES", 16), 1),
+		writeTimeout: time.Duration(max(parseEnvInt("STREAM_WRITE_TIMEOUT_SECONDS", 10), 1)) * time.Second,
+		slowAfter:    time.Duration(max(parseEnvInt("STREAM_SLOW_CLIENT_SECONDS", 30), 1)) * time.Second,
+	}
+}
+
+var errSlowClient = errors.New("client too slow")
+
+// streamWriter feeds one /stream response from a bounded queue.
+type streamWriter struct {
+	w     http.ResponseWriter
+	rc    *http.ResponseController
+	lines chan streamLine
+	stop  chan struct{}
+	done  chan struct{}
+
+	mu        sync.Mutex
+	err       error
+	fullSince time.Time
+}
+
+func newStreamWriter(w http.ResponseWriter) *streamWriter {
+	sw := &streamWriter{
+		w:     w,
+		rc:    http.NewResponseController(w),
+		lines: make(chan streamLine, streamCfg.buffer),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	streamClients.Add(1)
+	go sw.run()
+	return sw
+}
+
+func (sw *streamWriter) run() {
+	defer close(sw.done)
+	for {
+		select {
+		case <-sw.stop:
+			return
+		case line := <-sw.lines:
+			if err := sw.write(line.data); err != nil {
+				sw.fail(err)
+				return
+			}
+			freshness.Delivered(freshHTTPStream, line.ts, time.Now())
+		}
+	}
+}
+
+func (sw *streamWriter) write(line []byte) error {
+	if err := sw.rc.SetWriteDeadline(time.Now().Add(streamCfg.writeTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	if _, err := sw.w.Write(line); err != nil {
+		return err
+	}
+	return sw.rc.Flush()
+}
+
+func (sw *streamWriter) fail(err error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.err == nil {
+		sw.err = err
+	}
+}
+
+// Done is closed once the writer has stopped; Err says why.
+func (sw *streamWriter) Done() <-chan struct{} { return sw.done }
+
+func (sw *streamWriter) Err() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.err
+}
+
+// Evicted reports whether the client was dropped for being slow, rather
+// than going away.
+func (sw *streamWriter) Evicted() bool {
+	err := sw.Err()
+	var ne net.Error
+	return errors.Is(err, errSlowClient) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// streamLine is one queued line and the timestamp of the sample in it.
+type streamLine struct {
+	data []byte
+	ts   int64
+}
+
+// Send queues line, carrying a sample taken at ts, without blocking. It
+// reports false once the client has been full for too long and should be
+// evicted.
+func (sw *streamWriter) Send(line []byte, ts int64, now time.Time) bool {
+	select {
+	case sw.lines <- streamLine{line, ts}:
+		sw.fullSince = time.Time{}
+		return true
+	default:
+	}
+	streamDropped.Add(1)
+	if sw.fullSince.IsZero() {
+		sw.fullSince = now
+	}
+	if now.Sub(sw.fullSince) >= streamCfg.slowAfter {
+		sw.fail(errSlowClient)
+		return false
+	}
+	return true
+}
+
+// Close stops the writer and waits for it; the handler may not return while
+// it is still writing. Slow clients get the 408 line, best effort.
+func (sw *streamWriter) Close() {
+	close(sw.stop)
+	<-sw.done
+	streamClients.Add(-1)
+	if !sw.Evicted() {
+		return
+	}
+	streamEvictions.Add(1)
+	data, _ := json.Marshal(map[string]any{
+		"type":  "error",
+		"code":  http.StatusRequestTimeout,
+		"error": "evicted: " + sw.Err().Error(),
+	})
+	sw.rc.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, werr := sw.w.Write(append(data, '\n')); werr == nil {
+		sw.rc.Flush()
+	}
+}
+
+func writeStreamMetrics(w http.ResponseWriter) {
+	fmt.Fprintln(w, "# HELP localsense_http_stream_clients Open /stream connections.")
+	fmt.Fprintln(w, "# TYPE localsense_http_stream_clients gauge")
+	fmt.Fprintf(w, "localsense_http_stream_clients %d\n", streamClients.Load())
+	fmt.Fprintln(w, "# HELP localsense_http_stream_dropped_lines_total Lines not queued for a full /stream client.")
+	fmt.Fprintln(w, "# TYPE localsense_http_stream_dropped_lines_total counter")
+	fmt.Fprintf(w, "localsense_http_stream_dropped_lines_total %d\n", streamDropped.Load())
+	fmt.Fprintln(w, "# HELP localsense_http_stream_evictions_total /stream clients dropped for being too slow.")
+	fmt.Fprintln(w, "# TYPE localsense_http_stream_evictions_total counter")
+	fmt.Fprintf(w, "localsense_http_stream_evictions_total %d\n", streamEvictions.Load())
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// Localized names let marketplace UIs show the seller in the viewer's
+// language without a lookup. DEVICE_METADATA_FILE may hold "labels" and
+// "descriptions", each a map of BCP 47 language tag to text:
+//
+//	"labels": {"en": "Rooftop light meter", "hi": "छत प्रकाश मीटर"}
+//
+// /device always reports them. Payloads carry them as "labels" and
+// "descriptions" unless PAYLOAD_I18N=false (the low-bandwidth profile turns
+// them off: they repeat in every sample). The plain label stays the
+// fallback.
+
+const maxLocalizedLen = 512
+
+var localeTagPattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// payloadLabels and payloadDescriptions are the encoded maps payloads
+// carry, nil when there are none; set once at startup.
+var payloadLabels, payloadDescriptions []byte
+
+func validateLocalized(field string, m map[string]string) error {
+	for tag, text := range m {
+		if !localeTagPattern.MatchString(tag) {
+			return fmt.Errorf("%s: %q is not a language tag (en, pt-BR, zh-Hant)", field, tag)
+		}
+		if text == "" || len(text) > maxLocalizedLen {
+			return fmt.Errorf("%s.%s: must be 1-%d bytes", field, tag, maxLocalizedLen)
+		}
+	}
+	return nil
+}
+
+// setPayloadI18n encodes the metadata's localized names for payloads.
+func setPayloadI18n(meta deviceMetadata) {
+	if !parseEnvBool("PAYLOAD_I18N", true) {
+		return
+	}
+	// json.Marshal sorts map keys, keeping payloads deterministic.
+	if len(meta.Labels) > 0 {
+		payloadLabels, _ = json.Marshal(meta.Labels)
+	}
+	if len(meta.Descriptions) > 0 {
+		payloadDescriptions, _ = json.Marshal(meta.Descriptions)
+	}
+}
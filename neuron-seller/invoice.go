@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+	"github.com/hashgraph/hedera-sdk-go/v2"
+)
+
+// Every INVOICE_INTERVAL_MINUTES the seller totals what each buyer was
+// billed in the delivery log since the last invoice and sends it a
+// localsenseInvoice message on the buyer's stdin topic, or on the seller's
+// stdout topic when the buyer is no longer connected. Invoices name the
+// pricing currency and, for USD pricing, every exchange rate the period's
+// samples were converted at, so a buyer can check the tinybar amount
+// against the list price. The end of the last invoiced period is kept in
+// INVOICE_STATE_FILE so a restart neither skips nor repeats a period.
+
+const invoiceType = "localsenseInvoice"
+
+// invoiceRate groups the samples of an invoice converted at one rate.
+type invoiceRate struct {
+	CentsPerHbar float64 `json:"cents_per_hbar"` // 0: no rate was available, billed 0 tinybar
+	Samples      int     `json:"samples"`
+	Cents        float64 `json:"usd_cents"`
+	Tinybar      int64   `json:"tinybar"`
+}
+
+type invoiceMsg struct {
+	MessageType   string        `json:"messageType"`
+	InvoiceID     string        `json:"invoice_id"`
+	SellerID      string        `json:"seller_id"`
+	Buyer         string        `json:"buyer"`
+	Account       string        `json:"account,omitempty"`
+	SharedAccount string        `json:"shared_account,omitempty"`
+	PeriodStart   int64         `json:"period_start"`
+	PeriodEnd     int64         `json:"period_end"`
+	Samples       int           `json:"samples"` // billed samples; free ones are listed separately
+	FreeSamples   int           `json:"free_samples,omitempty"`
+	Currency      string        `json:"currency"`
+	AmountTinybar int64         `json:"amount_tinybar"`
+	AmountCents   float64       `json:"amount_usd_cents,omitempty"`
+	RateSource    string        `json:"rate_source,omitempty"`
+	Rates         []invoiceRate `json:"rates,omitempty"`
+
+	// Backfilled samples, at the backfill price; included in samples and
+	// the amounts.
+	BackfillSamples int   `json:"backfill_samples,omitempty"`
+	BackfillTinybar int64 `json:"backfill_amount_tinybar,omitempty"`
+
+	// SLA credit from earlier periods, already taken off amount_tinybar,
+	// and this period's SLA report (see sla.go).
+	SLACreditTinybar int64      `json:"sla_credit_tinybar,omitempty"`
+	SLA              *slaReport `json:"sla,omitempty"`
+}
+
+type invoiceState struct {
+	LastEnd int64  `json:"last_end"`
+	Number  uint64 `json:"number"`
+}
+
+type invoicer struct {
+	interval  time.Duration
+	stateFile string
+
+	mu    sync.Mutex
+	state invoiceState
+}
+
+var invoices *invoicer
+
+func loadInvoices() {
+	minutes := parseEnvInt("INVOICE_INTERVAL_MINUTES", 60)
+	if minutes <= 0 || deliveries == nil || !neuronStreamingEnabled() {
+		return
+	}
+	inv := &invoicer{
+		interval:  time.Duration(minutes) * time.Minute,
+		stateFile: getEnvOrDefault("INVOICE_STATE_FILE", "data/invoices.json"),
+	}
+	if err := inv.load(); err != nil {
+		log.Printf("invoice: ignoring state file: %v", err)
+	}
+	invoices = inv
+	go inv.loop()
+	log.Printf("Invoices  : every %s in %s", inv.interval, pricing.Currency)
+}
+
+func (inv *invoicer) loop() {
+	for {
+		next := time.Now().Truncate(inv.interval).Add(inv.interval)
+		time.Sleep(time.Until(next))
+		inv.run(next)
+	}
+}
+
+// run invoices every buyer billed between the last invoiced period's end
+// (or one interval ago, the first time) and end.
+func (inv *invoicer) run(end time.Time) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	start := time.Unix(inv.state.LastEnd, 0)
+	if inv.state.LastEnd == 0 {
+		start = end.Add(-inv.interval)
+	}
+	if !end.After(start) {
+		return
+	}
+	recs, err := deliveries.Query("", start, end)
+	if err != nil {
+		log.Printf("invoice: %v", err)
+		return
+	}
+	msgs := buildInvoices(recs, start, end)
+	sla.Close(start, end, msgs, recs)
+	for _, msg := range msgs {
+		inv.state.Number++
+		msg.InvoiceID = fmt.Sprintf("%s-%d-%d", sellerCfg.SellerID, end.Unix(), inv.state.Number)
+		inv.send(msg)
+	}
+	inv.state.LastEnd = end.Unix()
+	if err := inv.save(); err != nil {
+		log.Printf("invoice: save state: %v", err)
+	}
+}
+
+// buildInvoices totals recs per buyer, skipping buyers who only got free
+// samples.
+func buildInvoices(recs []deliveryRecord, start, end time.Time) []*invoiceMsg {
+	byBuyer := map[string]*invoiceMsg{}
+	rates := map[string]map[float64]*invoiceRate{}
+	for _, rec := range recs {
+		msg := byBuyer[rec.Buyer]
+		if msg == nil {
+			msg = &invoiceMsg{
+				MessageType: invoiceType,
+				SellerID:    sellerCfg.SellerID,
+				Buyer:       rec.Buyer,
+				PeriodStart: start.Unix(),
+				PeriodEnd:   end.Unix(),
+				Currency:    currencyHBAR,
+			}
+			byBuyer[rec.Buyer] = msg
+			rates[rec.Buyer] = map[float64]*invoiceRate{}
+		}
+		if rec.Account != "" {
+			msg.Account = rec.Account
+		}
+		if rec.Shared != "" {
+			msg.SharedAccount = rec.Shared
+		}
+		if rec.Free != "" {
+			msg.FreeSamples++
+			continue
+		}
+		msg.Samples++
+		msg.AmountTinybar += rec.Price
+		if rec.Backfill {
+			msg.BackfillSamples++
+			msg.BackfillTinybar += rec.Price
+		}
+		if rec.Currency != currencyUSD {
+			continue
+		}
+		msg.Currency = currencyUSD
+		msg.RateSource = pricing.RateSource
+		msg.AmountCents += rec.Cents
+		r := rates[rec.Buyer][rec.CentsPerHbar]
+		if r == nil {
+			r = &invoiceRate{CentsPerHbar: rec.CentsPerHbar}
+			rates[rec.Buyer][rec.CentsPerHbar] = r
+		}
+		r.Samples++
+		r.Cents += rec.Cents
+		r.Tinybar += rec.Price
+	}
+
+	out := make([]*invoiceMsg, 0, len(byBuyer))
+	for buyer, msg := range byBuyer {
+		if msg.Samples == 0 {
+			continue
+		}
+		for _, r := range rates[buyer] {
+			msg.Rates = append(msg.Rates, *r)
+		}
+		sort.Slice(msg.Rates, func(i, j int) bool { return msg.Rates[i].CentsPerHbar < msg.Rates[j].CentsPerHbar })
+		out = append(out, msg)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Buyer < out[j].Buyer })
+	return out
+}
+
+// send publishes msg to the buyer's stdin topic and audits the outcome.
+func (inv *invoicer) send(msg *invoiceMsg) {
+	topic, direct := buyerStdIn(msg.Buyer)
+	if !direct {
+		topic = commonlib.MyStdOut
+	}
+	data, _ := json.Marshal(msg)
+	result := "ok"
+	if err := sendToTopic(topic, data, "invoice "+msg.InvoiceID); errors.Is(err, errHederaQueued) {
+		result = "queued"
+	} else if err != nil {
+		log.Printf("invoice: send %s to %.18s: %v", msg.InvoiceID, msg.Buyer, err)
+		result = "error"
+	} else {
+		log.Printf("invoice: sent %s to %.18s: %d samples, %d tinybar", msg.InvoiceID, msg.Buyer, msg.Samples, msg.AmountTinybar)
+	}
+	audit.Record("billing", "node", "invoice", result, map[string]any{
+		"invoice_id":     msg.InvoiceID,
+		"buyer":          msg.Buyer,
+		"samples":        msg.Samples,
+		"currency":       msg.Currency,
+		"amount_tinybar": msg.AmountTinybar,
+		"direct":         direct,
+	})
+}
+
+// buyerStdIn finds the stdin topic of a connected stream of buyer key.
+func buyerStdIn(key string) (hedera.TopicID, bool) {
+	if neuronBuffers == nil {
+		return hedera.TopicID{}, false
+	}
+	for _, info := range neuronBuffers.GetBufferMap() {
+		if info.LibP2PState != types.Connected {
+			continue
+		}
+		if k, _ := buyerIdentity(info); k == key {
+			return info.RequestOrResponse.OtherStdInTopic, true
+		}
+	}
+	return hedera.TopicID{}, false
+}
+
+func (inv *invoicer) load() error {
+	data, err := os.ReadFile(inv.stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &inv.state); err != nil {
+		return fmt.Errorf("decode %s: %w", inv.stateFile, err)
+	}
+	return nil
+}
+
+func (inv *invoicer) save() error {
+	data, err := json.Marshal(inv.state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(inv.stateFile), 0o755); err != nil {
+		return err
+	}
+	tmp := inv.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, inv.stateFile)
+}
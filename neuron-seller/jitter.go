@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// Sellers sharing one Pi backend or reporting to one aggregator tend to
+// start together (same boot, same deploy) and then tick in lockstep, so
+// every fetch and broadcast lands on the same second. With
+// TICK_JITTER_PERCENT set, the first tick of each sampling loop comes at a
+// random point within one interval and every later interval is stretched
+// or shortened by up to that percentage, so the loops drift apart and stay
+// apart. The average rate is unchanged.
+
+// tickJitter is the largest fraction of an interval a tick moves by; 0
+// keeps ticks on the interval.
+var tickJitter float64
+
+func loadTickJitter() {
+	pct := min(max(parseEnvInt("TICK_JITTER_PERCENT", 0), 0), 50)
+	tickJitter = float64(pct) / 100
+	if pct > 0 {
+		log.Printf("Jitter    : ticks within ±%d%% of their interval", pct)
+	}
+}
+
+// jittered returns d moved by a random amount within ±tickJitter of it.
+func jittered(d time.Duration) time.Duration {
+	if tickJitter == 0 || d <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*tickJitter*float64(d))
+}
+
+// firstTick is the delay before a loop's first tick: a random point within
+// d when jitter is on, so loops started together don't share a phase.
+func firstTick(d time.Duration) time.Duration {
+	if tickJitter == 0 || d <= 0 {
+		return d
+	}
+	return time.Duration(rand.Int64N(int64(d))) + 1
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+)
+
+// dataLicense is the machine-readable license/terms blob the operator ships
+// in DATA_LICENSE_FILE. It is sent to each buyer when their stream opens,
+// anchored on HCS through the registration message, and referenced by hash
+// from every payload.
+type dataLicense struct {
+	ID   string
+	Raw  json.RawMessage
+	Hash string
+}
+
+type licenseFrame struct {
+	Type     string          `json:"type"`
+	SellerID string          `json:"seller_id"`
+	ID       string          `json:"license_id"`
+	Hash     string          `json:"license_sha256"`
+	Terms    json.RawMessage `json:"terms"`
+}
+
+var currentLicense *dataLicense
+
+func loadDataLicense() {
+	path := getEnvOrDefault("DATA_LICENSE_FILE", "license.json")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("license: read %s: %v", path, err)
+	}
+
+	// Hash the compacted JSON so whitespace edits don't change the anchor.
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		log.Fatalf("license: %s is not valid JSON: %v", path, err)
+	}
+	var head struct {
+		ID string `json:"id"`
+	}
+	_ = json.Unmarshal(compact.Bytes(), &head)
+
+	sum := sha256.Sum256(compact.Bytes())
+	currentLicense = &dataLicense{
+		ID:   head.ID,
+		Raw:  json.RawMessage(compact.Bytes()),
+		Hash: hex.EncodeToString(sum[:]),
+	}
+	log.Printf("License   : %s (sha256=%s)", currentLicense.ID, currentLicense.Hash)
+}
+
+// licenseHandshake returns the frame written to a buyer before its first
+// sample, or nil when no license is configured.
+func licenseHandshake() []byte {
+	if currentLicense == nil {
+		return nil
+	}
+	data, err := json.Marshal(licenseFrame{
+		Type:     "license",
+		SellerID: sellerCfg.SellerID,
+		ID:       currentLicense.ID,
+		Hash:     currentLicense.Hash,
+		Terms:    currentLicense.Raw,
+	})
+	if err != nil {
+		log.Printf("license: marshal handshake: %v", err)
+		return nil
+	}
+	return append(data, '\n')
+}
+
+func licenseHash() string {
+	if currentLicense == nil {
+		return ""
+	}
+	return currentLicense.Hash
+}
+
+func licenseHandler(w http.ResponseWriter, r *http.Request) {
+	if currentLicense == nil {
+		writeJSONError(w, ErrDisabled.With("no data license configured"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"license_id":     currentLicense.ID,
+		"license_sha256": currentLicense.Hash,
+		"terms":          currentLicense.Raw,
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Every P2P write is timed. Per peer we keep moving averages of write latency
+// and failure rate; when either crosses its threshold the peer's send rate is
+// halved (only every 2nd, 4th, ... tick carries samples), and it is doubled
+// again once the link has recovered. Buyers get a link_quality frame on
+// their stream whenever their effective interval changes.
+
+const (
+	linkEWMAAlpha = 0.2
+	// linkSettleWrites is how many writes a new factor gets before it can
+	// change again, so the averages catch up with the new rate.
+	linkSettleWrites = 5
+)
+
+type linkQualityConfig struct {
+	Enabled        bool
+	SlowWrite      time.Duration // LINK_SLOW_WRITE_MS
+	MaxFailureRate float64       // LINK_MAX_FAILURE_RATE
+	MaxFactor      int           // LINK_MAX_BACKOFF_FACTOR
+}
+
+type linkStats struct {
+	LatencyMs   float64 `json:"latency_ms"`
+	FailureRate float64 `json:"failure_rate"`
+	Writes      int64   `json:"writes"`
+	Failures    int64   `json:"failures"`
+	Factor      int     `json:"interval_factor"`
+	Score       float64 `json:"score"`
+
+	sinceChange int
+}
+
+type linkQualityTracker struct {
+	cfg   linkQualityConfig
+	mu    sync.Mutex
+	peers map[string]*linkStats
+}
+
+var links = &linkQualityTracker{peers: make(map[string]*linkStats)}
+
+func loadLinkQuality() {
+	links.cfg = linkQualityConfig{
+		Enabled:        parseEnvBool("LINK_ADAPTIVE_ENABLE", true),
+		SlowWrite:      time.Duration(parseEnvInt("LINK_SLOW_WRITE_MS", 500)) * time.Millisecond,
+		MaxFailureRate: parseEnvFloat("LINK_MAX_FAILURE_RATE", 0.2),
+		MaxFactor:      parseEnvInt("LINK_MAX_BACKOFF_FACTOR", 8),
+	}
+	if links.cfg.MaxFactor < 1 {
+		links.cfg.MaxFactor = 1
+	}
+}
+
+// Observe records one write to peer. It returns the peer's new interval
+// factor and whether it changed.
+func (l *linkQualityTracker) Observe(peer string, took time.Duration, err error) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	st, ok := l.peers[peer]
+	if !ok {
+		st = &linkStats{LatencyMs: float64(took.Milliseconds()), Factor: 1}
+		l.peers[peer] = st
+	}
+	failed := 0.0
+	if err != nil {
+		failed = 1
+		st.Failures++
+	}
+	st.Writes++
+	st.LatencyMs += linkEWMAAlpha * (float64(took.Milliseconds()) - st.LatencyMs)
+	st.FailureRate += linkEWMAAlpha * (failed - st.FailureRate)
+	st.Score = l.score(st)
+	st.sinceChange++
+
+	if !l.cfg.Enabled || st.sinceChange < linkSettleWrites {
+		return st.Factor, false
+	}
+	slow := float64(l.cfg.SlowWrite.Milliseconds())
+	prev := st.Factor
+	switch {
+	case st.LatencyMs > slow || st.FailureRate > l.cfg.MaxFailureRate:
+		st.Factor = min(st.Factor*2, l.cfg.MaxFactor)
+	case st.LatencyMs < slow/2 && st.FailureRate < l.cfg.MaxFailureRate/2:
+		st.Factor = max(st.Factor/2, 1)
+	}
+	if st.Factor == prev {
+		return st.Factor, false
+	}
+	st.sinceChange = 0
+	return st.Factor, true
+}
+
+// score is 1 for a fast, lossless link and falls towards 0 as writes slow
+// down past LINK_SLOW_WRITE_MS or fail.
+func (l *linkQualityTracker) score(st *linkStats) float64 {
+	speed := 1.0
+	if slow := float64(l.cfg.SlowWrite.Milliseconds()); slow > 0 && st.LatencyMs > slow {
+		speed = slow / st.LatencyMs
+	}
+	return math.Round((1-st.FailureRate)*speed*1000) / 1000
+}
+
+// Due reports whether peer gets samples on this tick.
+func (l *linkQualityTracker) Due(peer string, tick uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st, ok := l.peers[peer]
+	return !ok || tick%uint64(st.Factor) == 0
+}
+
+// Forget drops peer's link stats.
+func (l *linkQualityTracker) Forget(peer string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.peers, peer)
+}
+
+// Stats returns a copy of peer's link stats.
+func (l *linkQualityTracker) Stats(peer string) (linkStats, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st, ok := l.peers[peer]
+	if !ok {
+		return linkStats{}, false
+	}
+	return *st, true
+}
+
+// linkQualityFrame tells a buyer its sample interval changed because of the
+// link quality measured on its stream.
+func linkQualityFrame(peer string, interval time.Duration, codec string) []byte {
+	st, _ := links.Stats(peer)
+	data, err := json.Marshal(map[string]any{
+		"type":         "link_quality",
+		"seller_id":    sellerCfg.SellerID,
+		"ts":           time.Now().UTC().Unix(),
+		"interval":     int(interval / time.Second),
+		"factor":       st.Factor,
+		"score":        st.Score,
+		"latency_ms":   math.Round(st.LatencyMs),
+		"failure_rate": math.Round(st.FailureRate*1000) / 1000,
+	})
+	if err != nil {
+		log.Printf("neuron-seller: marshal link quality frame: %v", err)
+		return nil
+	}
+	if lengthFramed(codec) {
+		return lengthPrefixed(data)
+	}
+	return append(data, '\n')
+}
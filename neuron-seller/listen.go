@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/gorilla/websocket"
+	"github.com/libp2p/go-libp2p/core/host"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// The HTTP API listens on :SELLER_PORT, every address of both families,
+// unless LISTEN_ADDRS names the addresses to bind (comma separated
+// host:port, IPv6 in brackets: "[::1]:9000,192.168.1.5:9000"). IP_FAMILY
+// (dual, ipv4 or ipv6) limits the default listener and every connection the
+// node opens (the Pi, mirror node, price feeds, webhooks, MQTT) to one
+// family, for IPv6-only networks where IPv4 attempts would only time out, or
+// the reverse; dual leaves the choice to the resolver.
+//
+// A LISTEN_ADDRS entry of unix:/path serves the API on a unix socket, for a
+// reverse proxy on the same machine, with LISTEN_SOCKET_MODE permissions
+// (default 0660). Listing only sockets keeps the API off the network
+// entirely. Requests over a socket don't count as loopback for admin calls;
+// set ADMIN_TOKEN.
+//
+// The Neuron SDK only listens on /ip4/0.0.0.0. Unless IP_FAMILY=ipv4 the
+// stream loop adds /ip6/::/udp/<port>/quic-v1 on the SDK's port, plus
+// anything in P2P_LISTEN_ADDRS, so buyers on IPv6 can dial the seller and
+// get IPv6 addresses in the ones it hands them.
+//
+// Buyers that don't want to wait for discovery over Hedera can dial the
+// seller directly: its peer ID and dialable multiaddrs are on /status and in
+// every registration. The host's own addresses are only what it has
+// discovered so far; P2P_ANNOUNCE_ADDRS lists ones the operator knows work
+// (a forwarded port, /dns4/ names) and are put first.
+
+const (
+	familyDual = "dual"
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+var listenCfg struct {
+	family     string
+	http       []string
+	p2p        []string
+	announce   []string
+	socketMode os.FileMode
+
+	mu        sync.Mutex
+	httpBound []string
+	p2pHost   host.Host
+}
+
+func loadListenConfig() {
+	listenCfg.family = strings.ToLower(getEnvOrDefault("IP_FAMILY", familyDual))
+	switch listenCfg.family {
+	case familyDual, familyIPv4, familyIPv6:
+	default:
+		log.Fatalf("neuron-seller: IP_FAMILY must be dual, ipv4 or ipv6, got %q", listenCfg.family)
+	}
+
+	mode, err := strconv.ParseUint(getEnvOrDefault("LISTEN_SOCKET_MODE", "0660"), 8, 32)
+	if err != nil || mode > 0o777 {
+		log.Fatalf("neuron-seller: LISTEN_SOCKET_MODE must be octal permissions like 0660")
+	}
+	listenCfg.socketMode = os.FileMode(mode)
+
+	for _, addr := range strings.Split(getEnvOrDefault("LISTEN_ADDRS", ""), ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			if path == "" {
+				log.Fatalf("neuron-seller: LISTEN_ADDRS: unix: needs a socket path")
+			}
+			listenCfg.http = append(listenCfg.http, addr)
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			log.Fatalf("neuron-seller: LISTEN_ADDRS: %q is not host:port (IPv6 goes in brackets): %v", addr, err)
+		}
+		listenCfg.http = append(listenCfg.http, addr)
+	}
+	if len(listenCfg.http) == 0 {
+		listenCfg.http = []string{wildcardHost() + ":" + sellerCfg.Port}
+	}
+
+	for _, addr := range strings.Split(getEnvOrDefault("P2P_LISTEN_ADDRS", ""), ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if _, err := ma.NewMultiaddr(addr); err != nil {
+			log.Fatalf("neuron-seller: P2P_LISTEN_ADDRS: %q: %v", addr, err)
+		}
+		listenCfg.p2p = append(listenCfg.p2p, addr)
+	}
+
+	for _, addr := range strings.Split(getEnvOrDefault("P2P_ANNOUNCE_ADDRS", ""), ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if _, err := ma.NewMultiaddr(addr); err != nil {
+			log.Fatalf("neuron-seller: P2P_ANNOUNCE_ADDRS: %q: %v", addr, err)
+		}
+		if strings.Contains(addr, "/p2p/") {
+			log.Fatalf("neuron-seller: P2P_ANNOUNCE_ADDRS: %q: leave out /p2p/, the peer ID is added", addr)
+		}
+		listenCfg.announce = append(listenCfg.announce, addr)
+	}
+
+	if listenCfg.family != familyDual {
+		restrictDialFamily()
+	}
+	log.Printf("Listen    : HTTP on %s (%s)", strings.Join(listenCfg.http, ", "), listenCfg.family)
+}
+
+// tcpNetwork is the network name for TCP under IP_FAMILY.
+func tcpNetwork() string {
+	switch listenCfg.family {
+	case familyIPv4:
+		return "tcp4"
+	case familyIPv6:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// wildcardHost is the host of the default HTTP listener: empty (both
+// families) or the one family's wildcard.
+func wildcardHost() string {
+	switch listenCfg.family {
+	case familyIPv4:
+		return "0.0.0.0"
+	case familyIPv6:
+		return "[::]"
+	}
+	return ""
+}
+
+// loopbackListenAddr is host:port on the loopback address of IP_FAMILY.
+func loopbackListenAddr(port string) string {
+	if listenCfg.family == familyIPv6 {
+		return net.JoinHostPort("::1", port)
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// restrictDialFamily makes the default HTTP transport and websocket dialer,
+// which every outbound client here is built from, dial only IP_FAMILY.
+func restrictDialFamily() {
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	dial := func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return d.DialContext(ctx, tcpNetwork(), addr)
+	}
+	http.DefaultTransport.(*http.Transport).DialContext = dial
+	websocket.DefaultDialer.NetDialContext = dial
+}
+
+// serveHTTP serves server on every listen address; it returns when one of
+// them stops.
+func serveHTTP(server *http.Server) error {
+	var lns []net.Listener
+	for _, addr := range listenCfg.http {
+		var ln net.Listener
+		var err error
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			ln, err = listenUnix(path)
+		} else {
+			ln, err = net.Listen(tcpNetwork(), addr)
+		}
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return fmt.Errorf("listen on %s: %w", addr, err)
+		}
+		lns = append(lns, ln)
+	}
+
+	listenCfg.mu.Lock()
+	for _, ln := range lns {
+		listenCfg.httpBound = append(listenCfg.httpBound, listenerName(ln))
+	}
+	listenCfg.mu.Unlock()
+
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		log.Printf("HTTP seller shim listening on %s", listenerName(ln))
+		go func() { errs <- server.Serve(ln) }()
+	}
+	return <-errs
+}
+
+// listenUnix listens on a unix socket at path, replacing a socket left
+// behind by an earlier run but nothing else.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, listenCfg.socketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func listenerName(ln net.Listener) string {
+	if ln.Addr().Network() == "unix" {
+		return "unix:" + ln.Addr().String()
+	}
+	return ln.Addr().String()
+}
+
+// listenP2P adds the IPv6 and P2P_LISTEN_ADDRS listeners to the SDK's host.
+func listenP2P(p2pHost host.Host) {
+	listenCfg.mu.Lock()
+	listenCfg.p2pHost = p2pHost
+	listenCfg.mu.Unlock()
+
+	addrs := listenCfg.p2p
+	if listenCfg.family != familyIPv4 {
+		port := "0"
+		if commonlib.PortFlag != nil && *commonlib.PortFlag != "" {
+			port = *commonlib.PortFlag
+		}
+		addrs = append([]string{"/ip6/::/udp/" + port + "/quic-v1"}, addrs...)
+	}
+	for _, addr := range addrs {
+		m, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			log.Printf("neuron-seller: P2P listen address %s: %v", addr, err)
+			continue
+		}
+		if err := p2pHost.Network().Listen(m); err != nil {
+			log.Printf("neuron-seller: unable to listen on %s: %v", addr, err)
+			continue
+		}
+		log.Printf("neuron-seller: also listening on %s", addr)
+	}
+}
+
+type p2pIdentity struct {
+	PeerID string   `json:"peer_id"`
+	Addrs  []string `json:"addrs"` // with /p2p/<peer_id>, ready to dial
+}
+
+// dialInfo is the peer ID and the multiaddrs buyers can dial: announced
+// ones first, then the host's own minus loopback. Nil before the stream
+// loop starts.
+func dialInfo() *p2pIdentity {
+	listenCfg.mu.Lock()
+	p2pHost := listenCfg.p2pHost
+	listenCfg.mu.Unlock()
+	if p2pHost == nil {
+		return nil
+	}
+	id := p2pHost.ID().String()
+	info := &p2pIdentity{PeerID: id, Addrs: []string{}}
+	seen := map[string]bool{}
+	add := func(addr string) {
+		if !seen[addr] {
+			seen[addr] = true
+			info.Addrs = append(info.Addrs, addr+"/p2p/"+id)
+		}
+	}
+	for _, addr := range listenCfg.announce {
+		add(addr)
+	}
+	for _, m := range p2pHost.Addrs() {
+		if !loopbackAddr(m) {
+			add(m.String())
+		}
+	}
+	return info
+}
+
+// listenStatus is what the node is listening on, for /status.
+func listenStatus() map[string]any {
+	listenCfg.mu.Lock()
+	defer listenCfg.mu.Unlock()
+	out := map[string]any{"family": listenCfg.family, "http": listenCfg.httpBound}
+	if listenCfg.p2pHost != nil {
+		var p2p []string
+		for _, m := range listenCfg.p2pHost.Network().ListenAddresses() {
+			p2p = append(p2p, m.String())
+		}
+		out["p2p"] = p2p
+	}
+	return out
+}
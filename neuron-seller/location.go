@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+)
+
+// A relocated sensor gets its new label and coordinates with
+// POST /admin/location instead of a restart with new SELLER_LABEL,
+// SELLER_LAT and SELLER_LON. Every change bumps the location version and is
+// kept in LOCATION_FILE, which then takes precedence over the environment.
+// Payloads carry the new values from the next sample on; connected paid
+// buyers get a localsenseLocation message on their stdin topic, and the
+// device registration is republished so registries see the move.
+
+type siteLocation struct {
+	Label     string    `json:"label"`
+	Lat       float64   `json:"lat"`
+	Lon       float64   `json:"lon"`
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at,omitzero"`
+}
+
+type locationAnnouncement struct {
+	MessageType string       `json:"messageType"`
+	SellerID    string       `json:"seller_id"`
+	Location    siteLocation `json:"location"`
+	RequestID   string       `json:"request_id,omitempty"`
+	Version     string       `json:"v"`
+}
+
+var site struct {
+	mu   sync.RWMutex
+	loc  siteLocation
+	path string
+}
+
+func loadLocation() {
+	site.path = getEnvOrDefault("LOCATION_FILE", "data/location.json")
+	loc := siteLocation{Label: sellerCfg.Label, Lat: sellerCfg.Lat, Lon: sellerCfg.Lon, Version: 1}
+	data, err := os.ReadFile(site.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		log.Fatalf("location: read %s: %v", site.path, err)
+	default:
+		if err := json.Unmarshal(data, &loc); err != nil {
+			log.Fatalf("location: parse %s: %v", site.path, err)
+		}
+		log.Printf("Location  : (%f, %f) label=%s, version %d from %s (overrides SELLER_LAT/LON/LABEL)",
+			loc.Lat, loc.Lon, loc.Label, loc.Version, site.path)
+	}
+	site.mu.Lock()
+	site.loc = loc
+	site.mu.Unlock()
+}
+
+// currentLocation is the label and coordinates to report now.
+func currentLocation() siteLocation {
+	site.mu.RLock()
+	defer site.mu.RUnlock()
+	return site.loc
+}
+
+type locationUpdate struct {
+	Label *string  `json:"label"`
+	Lat   *float64 `json:"lat"`
+	Lon   *float64 `json:"lon"`
+}
+
+// updateLocation applies u, persists the result and announces it under
+// requestID.
+func updateLocation(u locationUpdate, now time.Time, requestID string) (siteLocation, error) {
+	site.mu.Lock()
+	loc := site.loc
+	if u.Label != nil {
+		loc.Label = strings.TrimSpace(*u.Label)
+	}
+	if u.Lat != nil {
+		loc.Lat = *u.Lat
+	}
+	if u.Lon != nil {
+		loc.Lon = *u.Lon
+	}
+	switch {
+	case loc.Label == "":
+		site.mu.Unlock()
+		return siteLocation{}, fmt.Errorf("label must not be empty")
+	case loc.Lat < -90 || loc.Lat > 90:
+		site.mu.Unlock()
+		return siteLocation{}, fmt.Errorf("lat must be between -90 and 90")
+	case loc.Lon < -180 || loc.Lon > 180:
+		site.mu.Unlock()
+		return siteLocation{}, fmt.Errorf("lon must be between -180 and 180")
+	}
+	if loc.Label == site.loc.Label && loc.Lat == site.loc.Lat && loc.Lon == site.loc.Lon {
+		site.mu.Unlock()
+		return loc, nil
+	}
+	loc.Version++
+	loc.UpdatedAt = now.UTC()
+	if err := saveLocation(loc); err != nil {
+		site.mu.Unlock()
+		return siteLocation{}, fmt.Errorf("save %s: %w", site.path, err)
+	}
+	site.loc = loc
+	site.mu.Unlock()
+
+	log.Printf("neuron-seller: location now (%f, %f) label=%s, version %d", loc.Lat, loc.Lon, loc.Label, loc.Version)
+	go announceLocation(loc, requestID)
+	return loc, nil
+}
+
+func saveLocation(loc siteLocation) error {
+	data, err := json.MarshalIndent(loc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(site.path), 0o755); err != nil {
+		return err
+	}
+	tmp := site.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, site.path)
+}
+
+// announceLocation tells connected paid buyers about a move, via their
+// stdin topic, and republishes the device registration.
+func announceLocation(loc siteLocation, requestID string) {
+	msg := locationAnnouncement{
+		MessageType: "localsenseLocation",
+		SellerID:    sellerCfg.SellerID,
+		Location:    loc,
+		RequestID:   requestID,
+		Version:     "0.1",
+	}
+	// Before the stream loop starts there is nobody to tell, and the
+	// registration it publishes will carry the new location.
+	if neuronBuffers == nil {
+		return
+	}
+	for peerID, bufferInfo := range neuronBuffers.GetBufferMap() {
+		if bufferInfo.LibP2PState != types.Connected || !buyerPaid(bufferInfo) {
+			continue
+		}
+		_, tier := privacy.TierFor(bufferInfo)
+		msg.Location = tier.Location(loc)
+		env := types.TopicPostalEnvelope{
+			Message:         msg,
+			OtherStdInTopic: bufferInfo.RequestOrResponse.OtherStdInTopic,
+		}
+		if err := sendEnvelope(env, "location announcement"); err != nil && !errors.Is(err, errHederaQueued) {
+			log.Printf("neuron-seller: location announcement to %s failed: %v", peerID, err)
+		}
+	}
+	if err := publishRegistration(); err != nil {
+		log.Printf("neuron-seller: %v", err)
+	}
+}
+
+// GET|POST /admin/location – current label and coordinates, or move the
+// sensor with {"label": "...", "lat": 0, "lon": 0} (any subset).
+func adminLocationHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, currentLocation())
+	case http.MethodPost, http.MethodPut:
+		var u locationUpdate
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			writeJSONError(w, ErrBadRequest.With("invalid JSON body"))
+			return
+		}
+		loc, err := updateLocation(u, time.Now(), requestID(r))
+		if err != nil {
+			writeJSONError(w, ErrBadRequest.Wrap(err))
+			return
+		}
+		logRequest(r, "[/admin/location] version %d set by %s", loc.Version, r.RemoteAddr)
+		writeJSON(w, http.StatusOK, loc)
+	default:
+		writeJSONError(w, ErrMethodNotAllowed)
+	}
+}
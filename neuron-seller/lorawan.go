@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LORAWAN_TRANSPORT sends samples as LoRaWAN uplinks, for sites with no IP
+// backhaul at the sensor:
+//
+//   - modem: through a LoRaWAN modem on a serial port (LORAWAN_MODEM_DEVICE,
+//     joined to ChirpStack, TTN or another network server beforehand) with
+//     LORAWAN_MODEM_SEND, by default the RUI3 "AT+SEND={port}:{hex}".
+//   - ttn: through The Things Stack's uplink API (LORAWAN_API_URL,
+//     LORAWAN_API_KEY, LORAWAN_APP_ID, LORAWAN_DEVICE_ID), for a forwarder
+//     with IP posting on the sensor's behalf.
+//
+// Airtime is scarce, so only the latest sample of each kind is kept and an
+// uplink goes out at most every LORAWAN_MIN_INTERVAL_SECONDS, holding as many
+// kinds as fit in LORAWAN_MAX_PAYLOAD bytes. The codec is documented on
+// GET /schema?format=lorawan, decoder included. Uplinks aren't signed; the
+// LoRaWAN MIC authenticates the device.
+
+const (
+	loraCodecVersion = 1
+	loraRecordSize   = 11
+)
+
+type loraSink struct {
+	transport   string
+	fport       int
+	maxPayload  int
+	minInterval time.Duration
+
+	// modem
+	device  string
+	sendCmd string
+	lines   chan string
+	port    *os.File
+
+	// ttn
+	apiURL   string
+	apiKey   string
+	appID    string
+	deviceID string
+
+	mu      sync.Mutex
+	latest  map[int][]byte // kind index -> record
+	sent    int64
+	lastAt  time.Time
+	lastErr string
+	kinds   []sensorKind
+}
+
+var lorawan *loraSink
+
+func loadLoRaWAN() {
+	transport := strings.ToLower(getEnvOrDefault("LORAWAN_TRANSPORT", ""))
+	if transport == "" {
+		return
+	}
+	cfg, err := getNeuronSellerConfig()
+	if err != nil {
+		return
+	}
+	l := &loraSink{
+		transport:   transport,
+		fport:       parseEnvInt("LORAWAN_FPORT", 10),
+		maxPayload:  max(parseEnvInt("LORAWAN_MAX_PAYLOAD", 51), loraRecordSize),
+		minInterval: time.Duration(max(parseEnvInt("LORAWAN_MIN_INTERVAL_SECONDS", 300), 1)) * time.Second,
+		latest:      make(map[int][]byte),
+		kinds:       cfg.Kinds,
+	}
+	if l.fport < 1 || l.fport > 223 {
+		log.Fatalf("lorawan: LORAWAN_FPORT must be 1-223, got %d", l.fport)
+	}
+	if len(cfg.Kinds) > 16 {
+		log.Fatalf("lorawan: the codec has room for 16 kinds, %d configured", len(cfg.Kinds))
+	}
+	switch transport {
+	case "modem":
+		l.device = getEnvOrDefault("LORAWAN_MODEM_DEVICE", "/dev/ttyUSB0")
+		l.sendCmd = getEnvOrDefault("LORAWAN_MODEM_SEND", "AT+SEND={port}:{hex}")
+		if err := l.openModem(getEnvOrDefault("LORAWAN_MODEM_BAUD", "115200")); err != nil {
+			log.Fatalf("lorawan: %v", err)
+		}
+	case "ttn":
+		l.apiURL = strings.TrimSuffix(getEnvOrDefault("LORAWAN_API_URL", "https://eu1.cloud.thethings.network"), "/")
+		l.apiKey = getEnvOrDefault("LORAWAN_API_KEY", "")
+		l.appID = getEnvOrDefault("LORAWAN_APP_ID", "")
+		l.deviceID = getEnvOrDefault("LORAWAN_DEVICE_ID", "")
+		if l.apiKey == "" || l.appID == "" || l.deviceID == "" {
+			log.Fatalf("lorawan: the ttn transport needs LORAWAN_API_KEY, LORAWAN_APP_ID and LORAWAN_DEVICE_ID")
+		}
+	default:
+		log.Fatalf("lorawan: LORAWAN_TRANSPORT must be modem or ttn, got %q", transport)
+	}
+	lorawan = l
+	go l.run()
+	go l.follow(sampleBus.Subscribe("lorawan", 16))
+	log.Printf("LoRaWAN   : uplinks via %s on port %d, at most every %s", transport, l.fport, l.minInterval)
+}
+
+// follow keeps every sample sent as its kind's latest.
+func (l *loraSink) follow(sub *busSub[busSample]) {
+	for smp := range sub.C() {
+		l.Add(smp.KindIndex, smp.Seq, smp.Ts, smp.Value)
+	}
+}
+
+// Add keeps a sample as its kind's latest.
+func (l *loraSink) Add(kindIndex int, seq uint64, ts int64, value float64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.latest[kindIndex] = loraRecord(kindIndex, seq, ts, value)
+}
+
+// loraRecord encodes one sample: version and kind index (4 bits each), the
+// low 16 bits of seq, ts as uint32 and value as float32, big-endian.
+func loraRecord(kindIndex int, seq uint64, ts int64, value float64) []byte {
+	b := make([]byte, 0, loraRecordSize)
+	b = append(b, byte(loraCodecVersion<<4|kindIndex&0x0f))
+	b = binary.BigEndian.AppendUint16(b, uint16(seq))
+	b = binary.BigEndian.AppendUint32(b, uint32(ts))
+	return binary.BigEndian.AppendUint32(b, math.Float32bits(float32(value)))
+}
+
+func (l *loraSink) run() {
+	t := time.NewTicker(l.minInterval)
+	defer t.Stop()
+	for range t.C {
+		payload := l.take()
+		if payload == nil {
+			continue
+		}
+		var err error
+		switch l.transport {
+		case "modem":
+			err = l.sendModem(payload)
+		case "ttn":
+			err = l.sendTTN(payload)
+		}
+		l.mu.Lock()
+		if err != nil {
+			l.lastErr = err.Error()
+			log.Printf("lorawan: uplink of %d bytes failed: %v", len(payload), err)
+		} else {
+			l.sent++
+			l.lastAt = time.Now()
+			l.lastErr = ""
+			freshness.Delivered(freshLoRaWAN, loraNewestTs(payload), l.lastAt)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// take removes the records that fit in one uplink, lowest kind first.
+func (l *loraSink) take() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var payload []byte
+	for i := range l.kinds {
+		rec, ok := l.latest[i]
+		if !ok || len(payload)+len(rec) > l.maxPayload {
+			continue
+		}
+		payload = append(payload, rec...)
+		delete(l.latest, i)
+	}
+	return payload
+}
+
+// loraNewestTs is the newest sample timestamp in an uplink of records.
+func loraNewestTs(payload []byte) int64 {
+	var newest int64
+	for rec := payload; len(rec) >= loraRecordSize; rec = rec[loraRecordSize:] {
+		newest = max(newest, int64(binary.BigEndian.Uint32(rec[3:7])))
+	}
+	return newest
+}
+
+func (l *loraSink) openModem(baud string) error {
+	if out, err := runShell(context.Background(), "stty", "-F", l.device, baud, "raw", "-echo"); err != nil {
+		return fmt.Errorf("configure %s: %v: %s", l.device, err, strings.TrimSpace(out))
+	}
+	f, err := os.OpenFile(l.device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	l.port = f
+	l.lines = make(chan string, 16)
+	go func() {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			if line := strings.TrimSpace(sc.Text()); line != "" {
+				select {
+				case l.lines <- line:
+				default:
+				}
+			}
+		}
+		log.Printf("lorawan: modem %s closed: %v", l.device, sc.Err())
+	}()
+	return nil
+}
+
+// sendModem writes the send command and waits for the modem's OK or error.
+func (l *loraSink) sendModem(payload []byte) error {
+	for len(l.lines) > 0 {
+		<-l.lines
+	}
+	cmd := strings.NewReplacer("{port}", strconv.Itoa(l.fport), "{hex}", strings.ToUpper(hex.EncodeToString(payload))).Replace(l.sendCmd)
+	if _, err := l.port.WriteString(cmd + "\r\n"); err != nil {
+		return err
+	}
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case line := <-l.lines:
+			switch {
+			case line == "OK":
+				return nil
+			case strings.Contains(line, "ERROR"), strings.HasPrefix(line, "AT_"):
+				return fmt.Errorf("modem: %s", line)
+			}
+		case <-timeout:
+			return fmt.Errorf("modem: no answer to %s", cmd)
+		}
+	}
+}
+
+func (l *loraSink) sendTTN(payload []byte) error {
+	body, _ := json.Marshal(map[string]any{
+		"uplink_message": map[string]any{
+			"f_port":      l.fport,
+			"frm_payload": base64.StdEncoding.EncodeToString(payload),
+		},
+	})
+	u := fmt.Sprintf("%s/api/v3/as/applications/%s/devices/%s/up/simulate", l.apiURL, l.appID, l.deviceID)
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+l.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := outboundClient(15 * time.Second).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("network server: %s", resp.Status)
+	}
+	return nil
+}
+
+// Status is the sink state for /status.
+func (l *loraSink) Status() map[string]any {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := map[string]any{"transport": l.transport, "f_port": l.fport, "uplinks": l.sent, "pending_kinds": len(l.latest)}
+	if !l.lastAt.IsZero() {
+		out["last_uplink"] = l.lastAt.UTC().Format(time.RFC3339)
+	}
+	if l.lastErr != "" {
+		out["error"] = l.lastErr
+	}
+	return out
+}
+
+// loraSchemaInfo documents the uplink codec for GET /schema?format=lorawan.
+func loraSchemaInfo() map[string]any {
+	cfg, _ := getNeuronSellerConfig()
+	cfg = cfg.ensureDefaults()
+	kinds := make([]map[string]any, 0, len(cfg.Kinds))
+	for i, k := range cfg.Kinds {
+		kinds = append(kinds, map[string]any{"index": i, "kind": k.Name, "unit": k.Conversion.To})
+	}
+	fport := parseEnvInt("LORAWAN_FPORT", 10)
+	return map[string]any{
+		"type":         "schema",
+		"codec":        "lorawan",
+		"version":      loraCodecVersion,
+		"f_port":       fport,
+		"record_bytes": loraRecordSize,
+		"records": "the payload is one or more records, each: byte 0 version<<4|kind index, " +
+			"bytes 1-2 seq mod 65536, bytes 3-6 ts (unix seconds), bytes 7-10 value (IEEE 754 float32), big-endian",
+		"seller_id": sellerCfg.SellerID,
+		"kinds":     kinds,
+		"decoder":   loraDecoderJS(kinds),
+	}
+}
+
+// loraDecoderJS is a decodeUplink payload formatter for TTN and ChirpStack.
+func loraDecoderJS(kinds []map[string]any) string {
+	names, _ := json.Marshal(kinds)
+	return `var KINDS = ` + string(names) + `;
+function decodeUplink(input) {
+  var b = input.bytes, samples = [];
+  for (var i = 0; i + 11 <= b.length; i += 11) {
+    var k = KINDS[b[i] & 15] || {kind: "unknown", unit: ""};
+    var v = new DataView(new Uint8Array(b.slice(i + 7, i + 11)).buffer).getFloat32(0);
+    samples.push({kind: k.kind, unit: k.unit, version: b[i] >> 4,
+      seq: (b[i + 1] << 8) | b[i + 2],
+      ts: ((b[i + 3] << 24) >>> 0) + (b[i + 4] << 16) + (b[i + 5] << 8) + b[i + 6],
+      value: v});
+  }
+  return {data: {samples: samples}};
+}`
+}
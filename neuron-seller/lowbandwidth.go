@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Nodes backhauled over LTE or LoRa pay for every byte. The low-bandwidth
+// profile (--profile mainnet,low-bandwidth) switches on everything below,
+// plus the cbor codec, a 60s interval and 300s heartbeats:
+//
+//   - batching (feature flag): a buyer stream's samples are held and written
+//     together once BATCH_MAX_SAMPLES are waiting or the oldest has waited
+//     BATCH_MAX_DELAY_SECONDS, saving the per-write transport overhead.
+//     Samples are billed when their batch is written.
+//   - compression (P2P_COMPRESSION): a batch of two or more frames on a
+//     length-framed stream (avro, cbor) is sent as one frame holding the
+//     zlib-compressed frames, if that is smaller. Its body starts with 0x78,
+//     which no other frame does. NDJSON streams are never compressed.
+//   - delta mode (feature flag): a periodic kind is only sampled when its
+//     value moved by more than <KIND>_DELTA (default: any change) since the
+//     last sample sent; heartbeats keep quiet streams alive.
+//
+// /status reports the month's data usage projected from the bandwidth
+// meter's counts: frame bytes to buyers and HTTP clients, without transport
+// or Hedera overhead.
+
+var lowBandwidth struct {
+	batchMax   int
+	batchDelay time.Duration
+	compress   bool
+	delta      map[string]float64
+}
+
+func loadLowBandwidth() {
+	lowBandwidth.batchMax = max(parseEnvInt("BATCH_MAX_SAMPLES", 10), 1)
+	lowBandwidth.batchDelay = time.Duration(max(parseEnvInt("BATCH_MAX_DELAY_SECONDS", 60), 1)) * time.Second
+	lowBandwidth.compress = parseEnvBool("P2P_COMPRESSION", false)
+	lowBandwidth.delta = map[string]float64{}
+	if cfg, err := getNeuronSellerConfig(); err == nil {
+		for _, k := range cfg.Kinds {
+			lowBandwidth.delta[k.Name] = math.Max(parseEnvFloat(strings.ToUpper(k.Name)+"_DELTA", 0), 0)
+		}
+	}
+	if features.Enabled(flagBatching) {
+		log.Printf("Batching  : up to %d samples or %s per write, compression %v", lowBandwidth.batchMax, lowBandwidth.batchDelay, lowBandwidth.compress)
+	}
+}
+
+// streamBatch is the samples waiting for one buyer stream.
+type streamBatch struct {
+	peerID   peer.ID
+	info     *commonlib.NodeBufferInfo
+	proto    protocol.ID
+	codec    string
+	greetKey string
+	frames   []byte
+	count    int
+	since    time.Time
+	sent     []func()
+}
+
+// queueBatch adds frame to its stream's batch; sent runs once it's written.
+func (s *neuronSeller) queueBatch(
+	p2pHost host.Host,
+	buffers *commonlib.NodeBuffers,
+	peerID peer.ID,
+	info *commonlib.NodeBufferInfo,
+	proto protocol.ID,
+	codec, greetKey string,
+	frame []byte,
+	sent func(),
+) {
+	if s.batches == nil {
+		s.batches = make(map[string]*streamBatch)
+	}
+	key := string(peerID) + string(proto)
+	b := s.batches[key]
+	if b != nil && b.codec != codec {
+		s.flushBatch(p2pHost, buffers, key, b)
+		b = nil
+	}
+	if b == nil {
+		b = &streamBatch{peerID: peerID, info: info, proto: proto, codec: codec, greetKey: greetKey, since: time.Now()}
+		s.batches[key] = b
+	}
+	b.frames = append(b.frames, frame...)
+	b.count++
+	b.sent = append(b.sent, sent)
+	if b.count >= lowBandwidth.batchMax {
+		s.flushBatch(p2pHost, buffers, key, b)
+	}
+}
+
+// flushBatches writes the batches that have waited long enough.
+func (s *neuronSeller) flushBatches(p2pHost host.Host, buffers *commonlib.NodeBuffers, now time.Time) {
+	for key, b := range s.batches {
+		if now.Sub(b.since) >= lowBandwidth.batchDelay || !features.Enabled(flagBatching) {
+			s.flushBatch(p2pHost, buffers, key, b)
+		}
+	}
+}
+
+func (s *neuronSeller) flushBatch(p2pHost host.Host, buffers *commonlib.NodeBuffers, key string, b *streamBatch) {
+	delete(s.batches, key)
+	frame := b.frames
+	if lowBandwidth.compress && lengthFramed(b.codec) && b.count > 1 {
+		if z := compressedFrame(frame); len(z) < len(frame) {
+			frame = z
+		}
+	}
+	if err := s.writeBuyerFrame(p2pHost, buffers, b.peerID, b.info, b.proto, b.codec, frame); err != nil {
+		delete(s.greeted, b.greetKey)
+		reportWriteError(b.peerID.String(), b.info, err)
+		return
+	}
+	for _, sent := range b.sent {
+		sent()
+	}
+}
+
+// compressedFrame is frames zlib-compressed into a single frame.
+func compressedFrame(frames []byte) []byte {
+	var buf bytes.Buffer
+	zw, _ := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	zw.Write(frames)
+	zw.Close()
+	return lengthPrefixed(buf.Bytes())
+}
+
+// deltaChanged reports whether value is worth sending in delta mode and
+// remembers it if so.
+func (s *neuronSeller) deltaChanged(kind string, value float64) bool {
+	if s.lastValues == nil {
+		s.lastValues = make(map[string]float64)
+	}
+	if prev, ok := s.lastValues[kind]; ok && math.Abs(value-prev) <= lowBandwidth.delta[kind] {
+		return false
+	}
+	s.lastValues[kind] = value
+	return true
+}
+
+// MonthlyEstimate projects the bytes sent over 30 days from the retained
+// daily counts.
+func (b *bandwidthMeter) MonthlyEstimate(now time.Time) map[string]any {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var p2p, web int64
+	oldest := today()
+	for day, peers := range b.days {
+		oldest = min(oldest, day)
+		for _, c := range peers {
+			p2p += c.P2P
+			web += c.HTTP
+		}
+	}
+	start, _ := time.Parse("2006-01-02", oldest)
+	if processStartedAt.After(start) && processStartedAt.UTC().Format("2006-01-02") == oldest {
+		start = processStartedAt
+	}
+	elapsed := max(now.Sub(start), time.Hour)
+	scale := 30 * 24 * float64(time.Hour) / float64(elapsed)
+	mb := func(n int64) float64 { return math.Round(float64(n)*scale/(1024*1024)*10) / 10 }
+	return map[string]any{
+		"estimated_month_mb": mb(p2p + web),
+		"p2p_mb":             mb(p2p),
+		"http_mb":            mb(web),
+		"measured_hours":     math.Round(elapsed.Hours()*10) / 10,
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -26,6 +27,8 @@ type SellerConfig struct {
 
 var sellerCfg SellerConfig
 
+var processStartedAt = time.Now()
+
 func mustGetEnv(key string) string {
 	v := os.Getenv(key)
 	if v == "" {
@@ -67,7 +70,6 @@ func loadConfig() {
 	log.Printf("SellerID  : %s", sellerCfg.SellerID)
 	log.Printf("PiBase    : %s", sellerCfg.PiBase)
 	log.Printf("Location  : (%f, %f) label=%s", sellerCfg.Lat, sellerCfg.Lon, sellerCfg.Label)
-	log.Printf("HTTP seller shim listening on :%s", sellerCfg.Port)
 }
 
 // -----------------------------
@@ -75,7 +77,12 @@ func loadConfig() {
 // -----------------------------
 
 func fetchJSON(url string, dest any) error {
-	resp, err := http.Get(url)
+	return fetchJSONWith(http.DefaultClient, url, dest)
+}
+
+// fetchJSONWith is fetchJSON over client, for callers that need a timeout.
+func fetchJSONWith(client *http.Client, url string, dest any) error {
+	resp, err := client.Get(url)
 	if err != nil {
 		return fmt.Errorf("GET %s: %w", url, err)
 	}
@@ -101,7 +108,39 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "LocalSense Neuron Seller Shim")
 	fmt.Fprintln(w, "Endpoints:")
 	fmt.Fprintln(w, "  GET /status – one-shot status (config + Pi metrics + Pi health)")
-	fmt.Fprintln(w, "  GET /stream – NDJSON stream of brightness samples")
+	fmt.Fprintln(w, "  GET /freshness – age of the newest sample per delivery surface vs SLO (503 when failing)")
+	fmt.Fprintln(w, "  GET /stream[?kind=&max_age=] – NDJSON stream of samples (default: first sensor kind)")
+	fmt.Fprintln(w, "  GET /poll?since_seq=[&kind=&timeout=&max_age=] – long-poll for samples newer than since_seq")
+	fmt.Fprintln(w, "  GET /device – device descriptor (hardware, sensors, install, calibration)")
+	fmt.Fprintln(w, "  GET /license – data license/terms blob and its sha256")
+	fmt.Fprintln(w, "  GET /schema[?format=avro|lorawan] – payload JSON Schema, Avro schema and fingerprint, or LoRaWAN uplink codec")
+	fmt.Fprintln(w, "  GET /history?from=&to=&kind=&limit=&resolution=&tag= – local samples (raw, 1m or 1h)")
+	fmt.Fprintln(w, "  GET /history?id= – one raw sample by its ULID")
+	fmt.Fprintln(w, "  GET|POST|DELETE /annotations[?from=&to=&kind=|?id=] – operator notes on time ranges (POST/DELETE admin)")
+	fmt.Fprintln(w, "  GET /stats?from=&to=&kind= – per-kind count/min/max/mean and the current solar position")
+	fmt.Fprintln(w, "  GET /proof?seq=[&kind=] – Merkle path from a sample to its anchored window root")
+	fmt.Fprintln(w, "  GET /fusion – fused kind's peer sources, their weights and the last estimate")
+	fmt.Fprintln(w, "  GET /revenue?from=&to= – per-buyer samples, billed and settled amounts, projection (admin)")
+	fmt.Fprintln(w, "  GET /peers – P2P buyers and per-peer, per-day bandwidth")
+	fmt.Fprintln(w, "  GET /metrics – Prometheus metrics")
+	fmt.Fprintln(w, "  GET|POST /graphql – GraphQL over samples, stats, peers and device metadata")
+	fmt.Fprintln(w, "  GET|POST /admin/flags – list or toggle experimental feature flags")
+	fmt.Fprintln(w, "  GET  /admin/sla – per-buyer SLA reports and pending credits (?buyer=)")
+	fmt.Fprintln(w, "  GET|POST /admin/migrations – protocol migration progress, or retire an old protocol early")
+	fmt.Fprintln(w, "  GET  /admin/canary – canary payload results per buyer and compatibility")
+	fmt.Fprintln(w, "  GET  /admin/plugins – subprocess plugins and their state")
+	fmt.Fprintln(w, "  POST /admin/sample[?kind=] – take and send a sample of one periodic kind, or all, now")
+	fmt.Fprintln(w, "  GET|POST /admin/supervisor – Pi service supervisor state, or force a restart")
+	fmt.Fprintln(w, "  GET /admin/audit?since_seq=&source=&limit=&format= – hash-chained audit log of control-plane actions")
+	fmt.Fprintln(w, "  GET /admin/evidence?buyer=[&from=&to=] – signed dispute evidence bundle for one buyer")
+	fmt.Fprintln(w, "  GET|DELETE /admin/trials[?account=] – buyer trial usage, or grant an account a fresh trial")
+	fmt.Fprintln(w, "  GET|POST|DELETE /admin/vouchers[?id=] – list, issue or revoke signed voucher codes")
+	fmt.Fprintln(w, "  GET|POST /admin/credits – prepaid balances, or top up an account (PAYMENT_BACKEND=ledger)")
+	fmt.Fprintln(w, "  POST /admin/purge?before=[&after=] – delete local history and publish an attestation")
+	fmt.Fprintln(w, "  GET /admin/rules – edge actuation rules and their state")
+	fmt.Fprintln(w, "  GET|POST /admin/location – label and coordinates, or update them after moving the sensor")
+	fmt.Fprintln(w, "  GET|POST|DELETE /admin/maintenance – maintenance state, or start/end it with a reason and ETA")
+	fmt.Fprintln(w, "  GET|POST /admin/tags – sample tags, or set dynamic ones ({\"campaign\": \"winter-test\"})")
 }
 
 // One-shot status, now includes Pi /metrics and /health
@@ -113,80 +152,160 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	piMetrics := make(map[string]any)
 	piHealth := make(map[string]any)
 
-	// Try to fetch Pi metrics and health; if they fail, we just log and omit them.
+	// Try to fetch Pi metrics and health; if they fail, we log, omit them
+	// and say why under pi_error.
+	var piErr error
 	if err := fetchJSON(sellerCfg.PiBase+"/metrics", &piMetrics); err != nil {
 		log.Printf("[/status] error fetching /metrics from Pi: %v", err)
-		piMetrics = nil
+		piMetrics, piErr = nil, err
 	}
 	if err := fetchJSON(sellerCfg.PiBase+"/health", &piHealth); err != nil {
 		log.Printf("[/status] error fetching /health from Pi: %v", err)
-		piHealth = nil
+		piHealth, piErr = nil, err
 	}
 
+	// /status is open to anyone: the public privacy tier applies.
+	public := privacy.Public()
+	loc := public.Location(currentLocation())
+	cfg := sellerCfg
+	cfg.Lat, cfg.Lon, cfg.Label = loc.Lat, loc.Lon, loc.Label
+
 	resp := map[string]any{
-		"config":   sellerCfg,
+		"config":   cfg,
 		"time_iso": now,
+		"power":    power.Snapshot(),
+		"pi_feed":  piFeedStatus(),
+		"camera":   camera.Status(),
+		"emission": emissions.Status(),
+		"privacy":  privacy.Status(),
+		"selftest": selftestStatus(),
+		"probe":    probes.Status(),
+		"pipeline": samplePipeline.Names(),
+		"weather":  weather.Status(),
+		"network":  hederaNet,
+		"schedule": map[string]any{
+			"active":      schedule.Active(time.Now()),
+			"next_change": schedule.NextChange(time.Now()),
+			"windows":     schedule.windowSpecs(),
+			"cron":        schedule.cronSpec,
+		},
 	}
 
+	resp["location"] = loc
+	resp["listen"] = listenStatus()
+	if p2p := dialInfo(); p2p != nil {
+		resp["p2p"] = p2p
+	}
+	resp["maintenance"] = currentMaintenance()
+	if access := buyerAccess.Status(); access != nil {
+		resp["buyer_access"] = access
+	}
+	if limits := connLimits.Status(time.Now()); limits != nil {
+		resp["p2p_limits"] = limits
+	}
+	resp["health"] = nodeHealth.Status()
+	resp["hedera_queue"] = hederaOutbox.Status()
+	resp["topic_lag"] = topicLag.Status(time.Now())
+	resp["data_usage"] = bandwidth.MonthlyEstimate(time.Now())
+	if l := lorawan.Status(); l != nil {
+		resp["lorawan"] = l
+	}
+	if proxy := outboundProxyStatus(); proxy != nil {
+		resp["outbound"] = proxy
+	}
 	if piMetrics != nil {
 		resp["pi_metrics"] = piMetrics
 	}
 	if piHealth != nil {
 		resp["pi_health"] = piHealth
 	}
+	if piErr != nil {
+		resp["pi_error"] = errorBody(ErrPiUnreachable.Wrap(piErr))
+	}
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Printf("[/status] encode error: %v", err)
 	}
 }
 
-// Streaming endpoint: emits brightness samples as NDJSON
+// Streaming endpoint: emits samples of one sensor kind (?kind=, default the
+// first configured kind) as NDJSON. Lines are the payloads the pipeline
+// sent out (same id, seq, tags and signature as P2P and /history), shown at
+// the public privacy tier.
 func streamHandler(w http.ResponseWriter, r *http.Request) {
+	neuron, _ := getNeuronSellerConfig()
+	kind := neuron.Kinds[0]
+	if name := r.URL.Query().Get("kind"); name != "" {
+		k, ok := neuron.kindByName(name)
+		if !ok {
+			writeJSONError(w, ErrNotFound.With(fmt.Sprintf("unknown kind %q", name)))
+			return
+		}
+		kind = k
+	}
+	maxAge := parseMaxAge(r.URL.Query().Get("max_age"))
+
 	// NDJSON = one JSON object per line
 	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+	if _, ok := w.(http.Flusher); !ok {
+		writeJSONError(w, ErrInternal.With("streaming not supported"))
+		return
+	}
+	if sampler == nil {
+		writeJSONError(w, ErrUnavailable.With("sampling is not configured"))
 		return
 	}
 
-	log.Printf("[/stream] client connected from %s", r.RemoteAddr)
-
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	samples := sampleBus.Subscribe("http_stream#", max(streamCfg.buffer, 64))
+	defer sampleBus.Unsubscribe(samples)
 
-	enc := json.NewEncoder(w)
+	log.Printf("[/stream] client connected from %s (kind=%s)", r.RemoteAddr, kind.Name)
+	sw := newStreamWriter(w)
+	defer func() {
+		sw.Close()
+		if sw.Evicted() {
+			log.Printf("[/stream] evicted %s: %v", r.RemoteAddr, sw.Err())
+		}
+	}()
 
+	// /stream is open to anyone: the public privacy tier applies.
+	public := privacy.Public()
 	for {
 		select {
 		case <-r.Context().Done():
 			log.Printf("[/stream] client disconnected from %s", r.RemoteAddr)
 			return
 
-		case t := <-ticker.C:
-			piMetrics := make(map[string]any)
-			if err := fetchJSON(sellerCfg.PiBase+"/metrics", &piMetrics); err != nil {
-				log.Printf("[/stream] error fetching /metrics from Pi: %v", err)
+		case <-sw.Done():
+			return
+
+		case smp := <-samples.C():
+			if smp.Kind != kind.Name {
 				continue
 			}
-
-			payload := map[string]any{
-				"ts":         piMetrics["ts"],
-				"brightness": piMetrics["brightness"],
-				"seller_id":  sellerCfg.SellerID,
-				"lat":        sellerCfg.Lat,
-				"lon":        sellerCfg.Lon,
-				"label":      sellerCfg.Label,
-				"time_iso":   t.UTC().Format(time.RFC3339),
+			if !sampleFresh(time.Now(), smp.Ts, sampleExpiry(kind, smp.Ts), maxAge) {
+				continue
 			}
-
-			if err := enc.Encode(payload); err != nil {
-				log.Printf("[/stream] encode error: %v", err)
+			switch bandwidth.Admit(httpPeer(r)) {
+			case capSuspend:
+				log.Printf("[/stream] %s is over its daily bandwidth cap, closing", r.RemoteAddr)
 				return
+			case capThrottle:
+				continue
 			}
 
-			flusher.Flush()
+			payload, err := public.Apply(smp.Payload)
+			if err != nil {
+				log.Printf("[/stream] apply public privacy tier to %s seq %d: %v", kind.Name, smp.Seq, err)
+				continue
+			}
+			// The bus payload is shared: copy before adding the newline.
+			payload = bytes.TrimSpace(payload)
+			line := append(payload[:len(payload):len(payload)], '\n')
+			if !sw.Send(line, smp.Ts, time.Now()) {
+				return
+			}
 		}
 	}
 }
@@ -196,14 +315,84 @@ func streamHandler(w http.ResponseWriter, r *http.Request) {
 // -----------------------------
 
 func main() {
+	loadProfile()
 	loadConfig()
+	loadListenConfig()
+	loadForwarding()
+	loadLocation()
+	loadMaintenance()
+	loadOutboundProxy()
+	loadMemoryBudget()
+	loadAuditLog()
+	loadWebhooks()
+	loadHederaNetwork()
+	loadHederaQueue()
+	loadMirrorCache()
+	loadFeatureFlags()
+	startFleetAgent()
+	startSupervisor()
+	loadPowerMonitor()
+	loadTickJitter()
+	loadPiSubscription()
+	loadPiPolling()
+	loadCameraSource()
+	loadFusion()
+	loadUncertainty()
+	loadWeather()
+	loadSolarPosition()
+	loadSoundLevels()
+	loadEvents()
+	loadEmissions()
+	loadExpressions()
+	loadPlugins()
+	loadWASMTransforms()
+	loadPipeline()
+	loadLowBandwidth()
+	loadLoRaWAN()
+	loadSchedule()
+	loadRules()
+	loadTags()
+	loadPrivacy()
+	loadAggregateNoise()
+	loadMigrations()
+	loadCanary()
+	loadDeviceMetadata()
+	loadDataLicense()
+	loadSigningKey()
+	loadCommands()
+	loadPolicy()
+	loadBuyerAccess()
+	loadConnLimits()
+	loadHistoryStore()
+	loadAnnotations()
+	loadAnchors()
+	loadDeliveryLog()
+	loadTrials()
+	loadBackfill()
+	loadVouchers()
+	loadPricing()
+	loadPayments()
+	loadInvoices()
+	loadSLA()
+	loadBandwidthMeter()
+	loadLinkQuality()
+	loadWriteErrors()
+	loadHealth()
+	loadTopicLag()
+	loadProbe()
+	loadFreshness()
+	loadPollBuffer()
+	loadStreamConfig()
+	loadAccessLog()
+	startSampler()
 
 	server := buildHTTPServer()
+	webhooks.Emit(webhookStarted, map[string]any{"addr": server.Addr, "shim_version": currentDevice(false).ShimVersion})
 
 	if neuronStreamingEnabled() {
 		log.Printf("Neuron seller mode enabled; exposing shim on %s and starting Neuron SDK", server.Addr)
 		go func() {
-			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			if err := serveHTTP(server); err != nil && !errors.Is(err, http.ErrServerClosed) {
 				log.Fatalf("HTTP server error: %v", err)
 			}
 		}()
@@ -211,11 +400,13 @@ func main() {
 		if err := runNeuronSellerNode(); err != nil {
 			log.Fatalf("Neuron seller exited with error: %v", err)
 		}
+		// The SDK returns on SIGINT/SIGTERM.
+		anchors.Close()
 		return
 	}
 
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("ListenAndServe: %v", err)
+	if err := serveHTTP(server); err != nil {
+		log.Fatalf("HTTP server error: %v", err)
 	}
 }
 
@@ -223,10 +414,41 @@ func buildHTTPServer() *http.Server {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", healthHandler)
 	mux.HandleFunc("/status", statusHandler)
-	mux.HandleFunc("/stream", streamHandler)
+	mux.HandleFunc("/freshness", freshnessHandler)
+	mux.HandleFunc("/stream", shedOverBudget(streamHandler))
+	mux.HandleFunc("/poll", shedOverBudget(pollHandler))
+	mux.HandleFunc("/device", deviceHandler)
+	mux.HandleFunc("/license", licenseHandler)
+	mux.HandleFunc("/schema", schemaHandler)
+	mux.HandleFunc("/history", historyHandler)
+	mux.HandleFunc("/annotations", annotationsHandler)
+	mux.HandleFunc("/stats", statsHandler)
+	mux.HandleFunc("/proof", proofHandler)
+	mux.HandleFunc("/fusion", fusionHandler)
+	mux.HandleFunc("/revenue", requireAdmin(revenueHandler))
+	mux.HandleFunc("/peers", peersHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/graphql", graphqlHandler)
+	mux.HandleFunc("/admin/purge", requireAdmin(adminPurgeHandler))
+	mux.HandleFunc("/admin/flags", requireAdmin(adminFlagsHandler))
+	mux.HandleFunc("/admin/sla", requireAdmin(adminSLAHandler))
+	mux.HandleFunc("/admin/migrations", requireAdmin(adminMigrationsHandler))
+	mux.HandleFunc("/admin/canary", requireAdmin(adminCanaryHandler))
+	mux.HandleFunc("/admin/plugins", requireAdmin(adminPluginsHandler))
+	mux.HandleFunc("/admin/sample", requireAdmin(adminSampleHandler))
+	mux.HandleFunc("/admin/supervisor", requireAdmin(adminSupervisorHandler))
+	mux.HandleFunc("/admin/audit", requireAdmin(adminAuditHandler))
+	mux.HandleFunc("/admin/evidence", requireAdmin(adminEvidenceHandler))
+	mux.HandleFunc("/admin/trials", requireAdmin(adminTrialsHandler))
+	mux.HandleFunc("/admin/vouchers", requireAdmin(adminVouchersHandler))
+	mux.HandleFunc("/admin/credits", requireAdmin(adminCreditsHandler))
+	mux.HandleFunc("/admin/rules", requireAdmin(adminRulesHandler))
+	mux.HandleFunc("/admin/tags", requireAdmin(adminTagsHandler))
+	mux.HandleFunc("/admin/location", requireAdmin(adminLocationHandler))
+	mux.HandleFunc("/admin/maintenance", requireAdmin(adminMaintenanceHandler))
 
 	return &http.Server{
-		Addr:    ":" + sellerCfg.Port,
-		Handler: mux,
+		Addr:    listenCfg.http[0],
+		Handler: withForwarding(withBandwidthAccounting(withRequestID(withBasePath(mux)))),
 	}
 }
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+)
+
+// Maintenance mode is for planned work on the sensor (cleaning, moving,
+// firmware): POST /admin/maintenance puts the node under maintenance with a
+// reason and an ETA, and it stops sampling until the operator ends it. It is
+// kept in MAINTENANCE_FILE so a reboot halfway through doesn't resume
+// streaming. Connected paid buyers get a localsenseMaintenance message on
+// their stdin topic when it starts and ends, heartbeats say "maintenance",
+// and /status and the device registration carry the state so registries can
+// tell a node under maintenance from a dead one.
+
+type maintenanceState struct {
+	Active bool      `json:"active"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since,omitzero"`
+	ETA    time.Time `json:"eta,omitzero"`
+	SetBy  string    `json:"set_by,omitempty"`
+}
+
+type maintenanceAnnouncement struct {
+	MessageType string           `json:"messageType"`
+	SellerID    string           `json:"seller_id"`
+	State       string           `json:"state"` // maintenance or resumed
+	Maintenance maintenanceState `json:"maintenance"`
+	RequestID   string           `json:"request_id,omitempty"`
+	Version     string           `json:"v"`
+}
+
+var maintenance struct {
+	mu    sync.RWMutex
+	state maintenanceState
+	path  string
+}
+
+func loadMaintenance() {
+	maintenance.path = getEnvOrDefault("MAINTENANCE_FILE", "data/maintenance.json")
+	data, err := os.ReadFile(maintenance.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return
+	case err != nil:
+		log.Fatalf("maintenance: read %s: %v", maintenance.path, err)
+	}
+	var st maintenanceState
+	if err := json.Unmarshal(data, &st); err != nil {
+		log.Fatalf("maintenance: parse %s: %v", maintenance.path, err)
+	}
+	maintenance.mu.Lock()
+	maintenance.state = st
+	maintenance.mu.Unlock()
+	if st.Active {
+		log.Printf("Maint     : under maintenance since %s (%s), not sampling until POST /admin/maintenance ends it",
+			st.Since.Format(time.RFC3339), st.Reason)
+	}
+}
+
+// currentMaintenance is the maintenance state now.
+func currentMaintenance() maintenanceState {
+	maintenance.mu.RLock()
+	defer maintenance.mu.RUnlock()
+	return maintenance.state
+}
+
+func underMaintenance() bool {
+	return currentMaintenance().Active
+}
+
+// maintenanceStatus is the state for /status and the registration, nil
+// when the node is not under maintenance.
+func maintenanceStatus() *maintenanceState {
+	st := currentMaintenance()
+	if !st.Active {
+		return nil
+	}
+	return &st
+}
+
+type maintenanceUpdate struct {
+	Active     bool      `json:"active"`
+	Reason     string    `json:"reason"`
+	ETA        time.Time `json:"eta"`
+	ETAMinutes int       `json:"eta_minutes"`
+}
+
+// setMaintenance starts or ends maintenance, persists it and tells buyers
+// and registries, under requestID.
+func setMaintenance(u maintenanceUpdate, setBy, requestID string, now time.Time) (maintenanceState, error) {
+	st := maintenanceState{Active: u.Active}
+	if u.Active {
+		st.Reason = strings.TrimSpace(u.Reason)
+		st.Since = now.UTC()
+		st.SetBy = setBy
+		switch {
+		case u.ETAMinutes < 0:
+			return st, fmt.Errorf("eta_minutes must not be negative")
+		case u.ETAMinutes > 0:
+			st.ETA = now.Add(time.Duration(u.ETAMinutes) * time.Minute).UTC().Truncate(time.Second)
+		case !u.ETA.IsZero() && !u.ETA.After(now):
+			return st, fmt.Errorf("eta must be in the future")
+		default:
+			st.ETA = u.ETA.UTC()
+		}
+	}
+
+	maintenance.mu.Lock()
+	prev := maintenance.state
+	if prev.Active && st.Active {
+		// Extending or re-explaining keeps the original start.
+		st.Since = prev.Since
+	}
+	if err := saveMaintenance(st); err != nil {
+		maintenance.mu.Unlock()
+		return prev, fmt.Errorf("save %s: %w", maintenance.path, err)
+	}
+	maintenance.state = st
+	maintenance.mu.Unlock()
+
+	switch {
+	case st.Active && !prev.Active:
+		log.Printf("neuron-seller: under maintenance (%s), ETA %s, set by %s", st.Reason, formatETA(st.ETA), setBy)
+		webhooks.Emit(webhookMaintenanceStarted, map[string]any{"reason": st.Reason, "eta": st.ETA})
+	case st.Active:
+		log.Printf("neuron-seller: maintenance updated (%s), ETA %s, set by %s", st.Reason, formatETA(st.ETA), setBy)
+	case prev.Active:
+		log.Printf("neuron-seller: maintenance over after %s, ended by %s", now.Sub(prev.Since).Round(time.Second), setBy)
+		webhooks.Emit(webhookMaintenanceEnded, map[string]any{"since": prev.Since})
+	default:
+		return st, nil
+	}
+	go announceMaintenance(st, requestID)
+	return st, nil
+}
+
+func formatETA(eta time.Time) string {
+	if eta.IsZero() {
+		return "unknown"
+	}
+	return eta.Format(time.RFC3339)
+}
+
+func saveMaintenance(st maintenanceState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(maintenance.path), 0o755); err != nil {
+		return err
+	}
+	tmp := maintenance.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, maintenance.path)
+}
+
+// announceMaintenance tells connected paid buyers, via their stdin topic,
+// and republishes the device registration.
+func announceMaintenance(st maintenanceState, requestID string) {
+	msg := maintenanceAnnouncement{
+		MessageType: "localsenseMaintenance",
+		SellerID:    sellerCfg.SellerID,
+		State:       "resumed",
+		Maintenance: st,
+		RequestID:   requestID,
+		Version:     "0.1",
+	}
+	if st.Active {
+		msg.State = "maintenance"
+	}
+	if neuronBuffers == nil {
+		return
+	}
+	for peerID, bufferInfo := range neuronBuffers.GetBufferMap() {
+		if bufferInfo.LibP2PState != types.Connected || !buyerPaid(bufferInfo) {
+			continue
+		}
+		env := types.TopicPostalEnvelope{
+			Message:         msg,
+			OtherStdInTopic: bufferInfo.RequestOrResponse.OtherStdInTopic,
+		}
+		if err := sendEnvelope(env, "maintenance announcement"); err != nil && !errors.Is(err, errHederaQueued) {
+			log.Printf("neuron-seller: maintenance announcement to %s failed: %v", peerID, err)
+		}
+	}
+	if err := publishRegistration(); err != nil {
+		log.Printf("neuron-seller: %v", err)
+	}
+}
+
+// GET|POST /admin/maintenance – current state, or start it with
+// {"active": true, "reason": "...", "eta": "<RFC3339>"} (or "eta_minutes")
+// and end it with {"active": false}. DELETE ends it too.
+func adminMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	var u maintenanceUpdate
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, currentMaintenance())
+		return
+	case http.MethodPost, http.MethodPut:
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			writeJSONError(w, ErrBadRequest.With("invalid JSON body"))
+			return
+		}
+	case http.MethodDelete:
+	default:
+		writeJSONError(w, ErrMethodNotAllowed)
+		return
+	}
+	st, err := setMaintenance(u, adminActor(r), requestID(r), time.Now())
+	if err != nil {
+		writeJSONError(w, ErrBadRequest.Wrap(err))
+		return
+	}
+	logRequest(r, "[/admin/maintenance] active=%t set by %s", st.Active, r.RemoteAddr)
+	writeJSON(w, http.StatusOK, st)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// On a 512 MB Pi the shim shares memory with the sensor stack, so the
+// per-tick path avoids garbage: sample payloads are encoded into pooled
+// buffers and only the final bytes, which history, /poll and anchoring
+// keep, are allocated per sample.
+//
+// With MEMORY_BUDGET_MB set, the runtime's soft memory limit is set to the
+// budget so the GC works harder before the process outgrows it, and every
+// MEMORY_CHECK_SECONDS the Go memory in use is compared with it. Above
+// MEMORY_SHED_PERCENT of the budget the node sheds optional work: history
+// replays are refused and the mirror cache stops storing responses. Over the
+// budget it also stops streaming to free (trial and voucher) buyers, turns
+// new /stream and /poll clients away with 503, empties the mirror cache and
+// returns freed memory to the OS. Paid buyers are never shed.
+
+type memoryLevel int32
+
+const (
+	memoryOK memoryLevel = iota
+	memorySoft
+	memoryHard
+)
+
+func (l memoryLevel) String() string {
+	switch l {
+	case memorySoft:
+		return "soft"
+	case memoryHard:
+		return "hard"
+	}
+	return "ok"
+}
+
+type memoryBudget struct {
+	limit  uint64
+	shedAt uint64
+
+	level atomic.Int32
+	inUse atomic.Uint64
+}
+
+var memBudget *memoryBudget
+
+func loadMemoryBudget() {
+	mb := parseEnvInt("MEMORY_BUDGET_MB", 0)
+	if mb <= 0 {
+		return
+	}
+	pct := min(max(parseEnvInt("MEMORY_SHED_PERCENT", 80), 1), 100)
+	m := &memoryBudget{limit: uint64(mb) << 20}
+	m.shedAt = m.limit * uint64(pct) / 100
+	debug.SetMemoryLimit(int64(m.limit))
+	memBudget = m
+	go m.watch(time.Duration(max(parseEnvInt("MEMORY_CHECK_SECONDS", 5), 1)) * time.Second)
+	log.Printf("Memory    : budget %d MB, shedding from %d%%", mb, pct)
+}
+
+// Level is the current shedding level; a nil budget is always memoryOK.
+func (m *memoryBudget) Level() memoryLevel {
+	if m == nil {
+		return memoryOK
+	}
+	return memoryLevel(m.level.Load())
+}
+
+func (m *memoryBudget) watch(every time.Duration) {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for range ticker.C {
+		metrics.Read(samples)
+		// The same measure the runtime's memory limit applies to.
+		inUse := samples[0].Value.Uint64() - samples[1].Value.Uint64()
+		m.inUse.Store(inUse)
+
+		level := memoryOK
+		switch {
+		case inUse >= m.limit:
+			level = memoryHard
+		case inUse >= m.shedAt:
+			level = memorySoft
+		}
+		prev := memoryLevel(m.level.Swap(int32(level)))
+		if level == prev {
+			continue
+		}
+		log.Printf("memory: %d MB in use of %d MB, shedding %s -> %s", inUse>>20, m.limit>>20, prev, level)
+		if level == memoryHard {
+			mirror.Purge()
+			debug.FreeOSMemory()
+			webhooks.Emit(webhookBudgetExceeded, map[string]any{"in_use_bytes": inUse, "budget_bytes": m.limit})
+		} else if prev == memoryHard {
+			webhooks.Emit(webhookBudgetRecovered, map[string]any{"in_use_bytes": inUse, "budget_bytes": m.limit})
+		}
+	}
+}
+
+// shedOverBudget turns requests away with 503 while the node is over its
+// memory budget.
+func shedOverBudget(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if memBudget.Level() == memoryHard {
+			w.Header().Set("Retry-After", "30")
+			writeJSONError(w, ErrOverloaded)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeMemoryMetrics(w http.ResponseWriter) {
+	if memBudget == nil {
+		return
+	}
+	fmt.Fprintln(w, "# HELP localsense_memory_bytes Go memory in use, as counted against the budget.")
+	fmt.Fprintln(w, "# TYPE localsense_memory_bytes gauge")
+	fmt.Fprintf(w, "localsense_memory_bytes %d\n", memBudget.inUse.Load())
+	fmt.Fprintln(w, "# HELP localsense_memory_budget_bytes Configured memory budget (MEMORY_BUDGET_MB).")
+	fmt.Fprintln(w, "# TYPE localsense_memory_budget_bytes gauge")
+	fmt.Fprintf(w, "localsense_memory_budget_bytes %d\n", memBudget.limit)
+	fmt.Fprintln(w, "# HELP localsense_memory_shed_level Load shedding level: 0 none, 1 optional work, 2 over budget.")
+	fmt.Fprintln(w, "# TYPE localsense_memory_shed_level gauge")
+	fmt.Fprintf(w, "localsense_memory_shed_level %d\n", memBudget.Level())
+}
+
+// encodeBuffers hold the per-sample scratch space, with room for a typical
+// payload to start with.
+var encodeBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, 0, 1024)
+	return &buf
+}}
+
+// encodePayload encodes p through a pooled buffer and returns a copy with
+// one spare byte of capacity, so appending the stream newline doesn't
+// reallocate.
+func encodePayload(p *samplePayload) ([]byte, error) {
+	bufp := encodeBuffers.Get().(*[]byte)
+	data, err := p.appendJSON((*bufp)[:0])
+	if err != nil {
+		encodeBuffers.Put(bufp)
+		return nil, err
+	}
+	// Don't pin an outsized buffer left by an unusual payload.
+	if cap(data) <= 64<<10 {
+		*bufp = data
+		encodeBuffers.Put(bufp)
+	}
+	out := make([]byte, len(data), len(data)+1)
+	copy(out, data)
+	return out, nil
+}
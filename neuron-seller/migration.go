@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// A schema upgrade moves a kind to a new protocol ID without cutting off
+// buyers still on the old one. PROTOCOL_MIGRATIONS pairs them,
+//
+//	/localsense/brightness/v1=/localsense/brightness/v2
+//
+// with the new ID the kind's protocol in SENSOR_KINDS. For
+// MIGRATION_GRACE_DAYS both are served: buyers asking for the old ID keep
+// getting the kind on it, and are told once (localsenseProtocolMigration,
+// status "deprecated") to move. Buyers seen on the old ID and later on the
+// new one count as migrated. When the grace period ends, or on
+// POST /admin/migrations, the old ID is retired: its buyers get nothing
+// more, and the retirement is announced on our stdout topic and to them.
+// Progress survives restarts in MIGRATION_STATE_FILE.
+
+type migrationBuyer struct {
+	Account    string    `json:"account,omitempty"`
+	Protocol   string    `json:"protocol"` // the one last seen
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	MigratedAt time.Time `json:"migrated_at,omitzero"`
+	Notified   bool      `json:"notified,omitempty"`
+}
+
+type protocolMigration struct {
+	From      string                     `json:"from"`
+	To        string                     `json:"to"`
+	Kind      string                     `json:"kind"`
+	Started   time.Time                  `json:"started"`
+	RetireAt  time.Time                  `json:"retire_at"`
+	RetiredAt time.Time                  `json:"retired_at,omitzero"`
+	Buyers    map[string]*migrationBuyer `json:"buyers"`
+}
+
+type migrationNotice struct {
+	MessageType string    `json:"messageType"`
+	SellerID    string    `json:"seller_id"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Kind        string    `json:"kind"`
+	Status      string    `json:"status"` // started, deprecated, retired
+	RetireAt    time.Time `json:"retire_at"`
+	Version     string    `json:"v"`
+}
+
+type migrationTracker struct {
+	path string
+
+	mu   sync.Mutex
+	byID map[string]*protocolMigration // by old protocol
+}
+
+var migrations *migrationTracker
+
+func loadMigrations() {
+	spec := strings.TrimSpace(getEnvOrDefault("PROTOCOL_MIGRATIONS", ""))
+	if spec == "" {
+		return
+	}
+	neuron, _ := getNeuronSellerConfig()
+	neuron = neuron.ensureDefaults()
+	grace := time.Duration(max(parseEnvFloat("MIGRATION_GRACE_DAYS", 14), 0) * float64(24*time.Hour))
+	t := &migrationTracker{
+		path: getEnvOrDefault("MIGRATION_STATE_FILE", "data/migrations.json"),
+		byID: map[string]*protocolMigration{},
+	}
+	if err := t.load(); err != nil {
+		log.Fatalf("migrations: %v", err)
+	}
+
+	now := time.Now()
+	configured := map[string]bool{}
+	var started []*protocolMigration
+	for _, pair := range strings.Split(spec, ",") {
+		from, to, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" || from == to {
+			log.Fatalf("migrations: %q must look like /old/protocol=/new/protocol", pair)
+		}
+		kind, found := sensorKind{}, false
+		for _, k := range neuron.Kinds {
+			if string(k.Protocol) == to {
+				kind, found = k, true
+			}
+			if string(k.Protocol) == from {
+				log.Fatalf("migrations: %s is still the protocol of kind %s", from, k.Name)
+			}
+		}
+		if !found {
+			log.Fatalf("migrations: %s is not the protocol of any kind in SENSOR_KINDS", to)
+		}
+		configured[from] = true
+		m := t.byID[from]
+		if m == nil || m.To != to {
+			m = &protocolMigration{
+				From:     from,
+				To:       to,
+				Kind:     kind.Name,
+				Started:  now,
+				RetireAt: now.Add(grace),
+				Buyers:   map[string]*migrationBuyer{},
+			}
+			t.byID[from] = m
+			started = append(started, m)
+		}
+		state := "serving both until " + m.RetireAt.Format(time.RFC3339)
+		if !m.RetiredAt.IsZero() {
+			state = "retired " + m.RetiredAt.Format(time.RFC3339)
+		}
+		log.Printf("Migration : %s -> %s (%s), %s", from, to, kind.Name, state)
+	}
+	for from := range t.byID {
+		if !configured[from] {
+			delete(t.byID, from)
+		}
+	}
+
+	t.mu.Lock()
+	if err := t.saveLocked(); err != nil {
+		log.Printf("migrations: save: %v", err)
+	}
+	t.mu.Unlock()
+	migrations = t
+	for _, m := range started {
+		go t.announce(m, "started")
+	}
+	go t.loop()
+}
+
+// Accepts reports whether a buyer asking for service gets kind on it: an
+// old protocol of kind that hasn't been retired.
+func (t *migrationTracker) Accepts(service string, kind sensorKind) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := t.byID[service]
+	return m != nil && m.To == string(kind.Protocol) && m.RetiredAt.IsZero()
+}
+
+// Legacy is the old protocols still served, mapped to their new ones.
+func (t *migrationTracker) Legacy() map[string]string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out map[string]string
+	for from, m := range t.byID {
+		if m.RetiredAt.IsZero() {
+			if out == nil {
+				out = map[string]string{}
+			}
+			out[from] = m.To
+		}
+	}
+	return out
+}
+
+// streamProtocol is the protocol to write kind to a buyer on: the old one
+// if it asked for that during a migration.
+func streamProtocol(info *commonlib.NodeBufferInfo, kind sensorKind) protocol.ID {
+	if service := requestedServiceType(info); migrations.Accepts(service, kind) {
+		return protocol.ID(service)
+	}
+	return kind.Protocol
+}
+
+func (t *migrationTracker) loop() {
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for now := range tick.C {
+		t.observe(now)
+	}
+}
+
+// observe tracks which buyers are on which protocol and retires old
+// protocols whose grace period is over.
+func (t *migrationTracker) observe(now time.Time) {
+	type seen struct {
+		info    *commonlib.NodeBufferInfo
+		account string
+		service string
+	}
+	var buyers map[string]seen
+	if neuronBuffers != nil {
+		buyers = map[string]seen{}
+		for _, info := range neuronBuffers.GetBufferMap() {
+			if info.LibP2PState != types.Connected {
+				continue
+			}
+			key, account := buyerIdentity(info)
+			if key == "" {
+				continue
+			}
+			buyers[key] = seen{info: info, account: account, service: requestedServiceType(info)}
+		}
+	}
+
+	var notify []types.TopicPostalEnvelope
+	var retired []*protocolMigration
+	t.mu.Lock()
+	for _, m := range t.byID {
+		if !m.RetiredAt.IsZero() {
+			continue
+		}
+		for key, b := range buyers {
+			onOld := b.service == m.From
+			if !onOld && b.service != m.To && b.service != m.Kind {
+				continue
+			}
+			mb := m.Buyers[key]
+			if mb == nil {
+				mb = &migrationBuyer{FirstSeen: now}
+				m.Buyers[key] = mb
+			}
+			if !onOld && mb.Protocol == m.From && mb.MigratedAt.IsZero() {
+				mb.MigratedAt = now
+				log.Printf("migrations: buyer %.18s moved from %s to %s", key, m.From, m.To)
+			}
+			mb.Account, mb.LastSeen = b.account, now
+			mb.Protocol = m.To
+			if onOld {
+				mb.Protocol = m.From
+				if !mb.Notified && buyerPaid(b.info) {
+					mb.Notified = true
+					notify = append(notify, types.TopicPostalEnvelope{
+						Message:         m.notice("deprecated"),
+						OtherStdInTopic: b.info.RequestOrResponse.OtherStdInTopic,
+					})
+				}
+			}
+		}
+		if !now.Before(m.RetireAt) {
+			m.RetiredAt = now
+			retired = append(retired, m)
+		}
+	}
+	if err := t.saveLocked(); err != nil {
+		log.Printf("migrations: save: %v", err)
+	}
+	t.mu.Unlock()
+
+	for _, env := range notify {
+		if err := sendEnvelope(env, "migration notice"); err != nil && !errors.Is(err, errHederaQueued) {
+			log.Printf("migrations: notice failed: %v", err)
+		}
+	}
+	for _, m := range retired {
+		t.retired(m)
+	}
+}
+
+// Retire ends the grace period of the migration from old now.
+func (t *migrationTracker) Retire(from string, now time.Time) (*protocolMigration, error) {
+	t.mu.Lock()
+	m := t.byID[from]
+	switch {
+	case m == nil:
+		t.mu.Unlock()
+		return nil, fmt.Errorf("no migration from %s", from)
+	case !m.RetiredAt.IsZero():
+		t.mu.Unlock()
+		return nil, fmt.Errorf("%s was retired at %s", from, m.RetiredAt.Format(time.RFC3339))
+	}
+	m.RetiredAt = now
+	if err := t.saveLocked(); err != nil {
+		log.Printf("migrations: save: %v", err)
+	}
+	t.mu.Unlock()
+	t.retired(m)
+	return m, nil
+}
+
+func (t *migrationTracker) retired(m *protocolMigration) {
+	log.Printf("migrations: retired %s; %s now only goes out on %s", m.From, m.Kind, m.To)
+	audit.Record("admin", "node", "protocol_retired", "ok", map[string]any{"from": m.From, "to": m.To})
+	t.announce(m, "retired")
+	if err := publishRegistration(); err != nil {
+		log.Printf("neuron-seller: %v", err)
+	}
+}
+
+func (m *protocolMigration) notice(status string) migrationNotice {
+	return migrationNotice{
+		MessageType: "localsenseProtocolMigration",
+		SellerID:    sellerCfg.SellerID,
+		From:        m.From,
+		To:          m.To,
+		Kind:        m.Kind,
+		Status:      status,
+		RetireAt:    m.RetireAt.UTC(),
+		Version:     "0.1",
+	}
+}
+
+// announce publishes a migration's start or retirement on our stdout topic
+// and, on retirement, to the connected buyers still on the old protocol.
+func (t *migrationTracker) announce(m *protocolMigration, status string) {
+	msg := m.notice(status)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	if err := sendToTopic(commonlib.MyStdOut, data, "migration "+status); err != nil && !errors.Is(err, errHederaQueued) {
+		log.Printf("migrations: %s announcement failed: %v", status, err)
+	}
+	if status != "retired" || neuronBuffers == nil {
+		return
+	}
+	for peerID, info := range neuronBuffers.GetBufferMap() {
+		if info.LibP2PState != types.Connected || !buyerPaid(info) || requestedServiceType(info) != m.From {
+			continue
+		}
+		env := types.TopicPostalEnvelope{Message: msg, OtherStdInTopic: info.RequestOrResponse.OtherStdInTopic}
+		if err := sendEnvelope(env, "migration notice"); err != nil && !errors.Is(err, errHederaQueued) {
+			log.Printf("migrations: retirement notice to %s failed: %v", peerID, err)
+		}
+	}
+}
+
+func (t *migrationTracker) load() error {
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*protocolMigration
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("decode %s: %w", t.path, err)
+	}
+	for _, m := range list {
+		if m.Buyers == nil {
+			m.Buyers = map[string]*migrationBuyer{}
+		}
+		t.byID[m.From] = m
+	}
+	return nil
+}
+
+func (t *migrationTracker) listLocked() []*protocolMigration {
+	list := make([]*protocolMigration, 0, len(t.byID))
+	for _, m := range t.byID {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].From < list[j].From })
+	return list
+}
+
+func (t *migrationTracker) saveLocked() error {
+	data, err := json.MarshalIndent(t.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o755); err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// GET|POST /admin/migrations – protocol migrations with per-buyer progress,
+// or retire an old protocol early with {"retire": "/old/protocol"}.
+func adminMigrationsHandler(w http.ResponseWriter, r *http.Request) {
+	if migrations == nil {
+		writeJSONError(w, ErrDisabled.With("no protocol migrations configured (PROTOCOL_MIGRATIONS)"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		var req struct {
+			Retire string `json:"retire"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Retire == "" {
+			writeJSONError(w, ErrBadRequest.With(`body must be {"retire": "/old/protocol"}`))
+			return
+		}
+		if _, err := migrations.Retire(req.Retire, time.Now()); err != nil {
+			writeJSONError(w, ErrBadRequest.Wrap(err))
+			return
+		}
+		log.Printf("[/admin/migrations] %s retired by %s", req.Retire, r.RemoteAddr)
+	default:
+		writeJSONError(w, ErrMethodNotAllowed)
+		return
+	}
+
+	migrations.mu.Lock()
+	defer migrations.mu.Unlock()
+	out := []map[string]any{}
+	for _, m := range migrations.listLocked() {
+		var old, moved, fresh int
+		for _, b := range m.Buyers {
+			switch {
+			case b.Protocol == m.From:
+				old++
+			case !b.MigratedAt.IsZero():
+				moved++
+			default:
+				fresh++
+			}
+		}
+		out = append(out, map[string]any{
+			"migration": m,
+			"summary": map[string]int{
+				"on_old_protocol": old,
+				"migrated":        moved,
+				"new_buyers":      fresh,
+			},
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"migrations": out})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The SDK queries the mirror node (account balances for payment checks, topic
+// messages) straight from mirror_api_url on every tick. With MIRROR_CACHE_ENABLE
+// the shim runs a small caching proxy on loopback and points mirror_api_url at
+// it: successful GETs are cached for a per-path TTL and concurrent identical
+// requests share one upstream call.
+
+type mirrorCacheEntry struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// mirrorCall is an upstream request in flight; followers wait on done.
+type mirrorCall struct {
+	done  chan struct{}
+	entry *mirrorCacheEntry
+	err   error
+}
+
+type mirrorCache struct {
+	upstream   *url.URL
+	client     *http.Client
+	accountTTL time.Duration
+	topicTTL   time.Duration
+	defaultTTL time.Duration
+	maxEntries int
+
+	mu       sync.Mutex
+	entries  map[string]*mirrorCacheEntry
+	inflight map[string]*mirrorCall
+	stats    map[string]int64 // hit, miss, coalesced, error
+}
+
+var mirror *mirrorCache
+
+func loadMirrorCache() {
+	if !parseEnvBool("MIRROR_CACHE_ENABLE", true) {
+		return
+	}
+	upstream, err := url.Parse(hederaNet.MirrorURL)
+	if err != nil {
+		log.Fatalf("mirror-cache: invalid mirror URL %q: %v", hederaNet.MirrorURL, err)
+	}
+	c := &mirrorCache{
+		upstream:   upstream,
+		client:     outboundClient(15 * time.Second),
+		accountTTL: time.Duration(parseEnvInt("MIRROR_CACHE_ACCOUNT_TTL_SECONDS", 30)) * time.Second,
+		topicTTL:   time.Duration(parseEnvInt("MIRROR_CACHE_TOPIC_TTL_SECONDS", 5)) * time.Second,
+		defaultTTL: time.Duration(parseEnvInt("MIRROR_CACHE_TTL_SECONDS", 10)) * time.Second,
+		maxEntries: parseEnvInt("MIRROR_CACHE_MAX_ENTRIES", 1024),
+		entries:    make(map[string]*mirrorCacheEntry),
+		inflight:   make(map[string]*mirrorCall),
+		stats:      make(map[string]int64),
+	}
+
+	ln, err := net.Listen(tcpNetwork(), getEnvOrDefault("MIRROR_CACHE_LISTEN", loopbackListenAddr("0")))
+	if err != nil {
+		log.Fatalf("mirror-cache: listen: %v", err)
+	}
+	go func() {
+		if err := http.Serve(ln, c); err != nil {
+			log.Printf("mirror-cache: server stopped: %v", err)
+		}
+	}()
+	go c.evictLoop()
+
+	local := "http://" + ln.Addr().String() + strings.TrimRight(upstream.Path, "/")
+	os.Setenv("mirror_api_url", local)
+	mirror = c
+	hederaNet.MirrorCache = local
+	log.Printf("Mirror    : caching %s on %s", hederaNet.MirrorURL, local)
+}
+
+// ttl picks the cache lifetime for a mirror path.
+func (c *mirrorCache) ttl(path string) time.Duration {
+	switch {
+	case strings.Contains(path, "/accounts/") || strings.Contains(path, "/balances"):
+		return c.accountTTL
+	case strings.Contains(path, "/topics/"):
+		return c.topicTTL
+	}
+	return c.defaultTTL
+}
+
+func (c *mirrorCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, ErrMethodNotAllowed.With("mirror cache only proxies GET"))
+		return
+	}
+	entry, err := c.get(r.URL.RequestURI())
+	if err != nil {
+		writeJSONError(w, ErrUpstream.Wrap(err))
+		return
+	}
+	for k, v := range entry.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+func (c *mirrorCache) get(uri string) (*mirrorCacheEntry, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[uri]; ok && time.Now().Before(e.expires) {
+		c.stats["hit"]++
+		c.mu.Unlock()
+		return e, nil
+	}
+	if call, ok := c.inflight[uri]; ok {
+		c.stats["coalesced"]++
+		c.mu.Unlock()
+		<-call.done
+		return call.entry, call.err
+	}
+	call := &mirrorCall{done: make(chan struct{})}
+	c.inflight[uri] = call
+	c.stats["miss"]++
+	c.mu.Unlock()
+
+	call.entry, call.err = c.fetch(uri)
+
+	c.mu.Lock()
+	delete(c.inflight, uri)
+	if call.err != nil {
+		c.stats["error"]++
+	} else if call.entry.status == http.StatusOK && len(c.entries) < c.maxEntries && memBudget.Level() == memoryOK {
+		c.entries[uri] = call.entry
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.entry, call.err
+}
+
+func (c *mirrorCache) fetch(uri string) (*mirrorCacheEntry, error) {
+	target := c.upstream.Scheme + "://" + c.upstream.Host + uri
+	resp, err := c.client.Get(target)
+	if err != nil {
+		return nil, fmt.Errorf("mirror node: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return nil, fmt.Errorf("mirror node: read %s: %w", uri, err)
+	}
+	header := http.Header{}
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		header.Set("Content-Type", ct)
+	}
+	return &mirrorCacheEntry{
+		status:  resp.StatusCode,
+		header:  header,
+		body:    body,
+		expires: time.Now().Add(c.ttl(uri)),
+	}, nil
+}
+
+// evictLoop drops expired entries so the cache stays under maxEntries.
+func (c *mirrorCache) evictLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		c.mu.Lock()
+		for uri, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, uri)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Purge drops every cached response; a nil cache has none.
+func (c *mirrorCache) Purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	clear(c.entries)
+	c.mu.Unlock()
+}
+
+// Stats returns the request counters by result and the current entry count.
+func (c *mirrorCache) Stats() (map[string]int64, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]int64, len(c.stats))
+	for k, v := range c.stats {
+		out[k] = v
+	}
+	return out, len(c.entries)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// HEDERA_NETWORK selects testnet, previewnet or mainnet. The SDK reads its
+// mirror node and JSON-RPC relay from mirror_api_url and eth_rpc_url, so
+// those default to the selected network's public endpoints;
+// HEDERA_MIRROR_URL and HEDERA_RPC_URL point at custom ones instead. Startup
+// refuses endpoints that name another network and an operator account the
+// selected network's mirror node has never heard of (HEDERA_NETWORK_CHECK).
+
+type hederaNetwork struct {
+	Name      string `json:"name"`
+	MirrorURL string `json:"mirror_url"`
+	RPCURL    string `json:"rpc_url"`
+	ChainID   int    `json:"chain_id"`
+	AccountID string `json:"account_id,omitempty"`
+	// MirrorCache is the local caching proxy the SDK talks to instead of
+	// MirrorURL, when enabled.
+	MirrorCache string `json:"mirror_cache,omitempty"`
+	// HCSNetwork is where the SDK submits topic messages; the SDK builds
+	// its Hedera client for testnet whatever the selected network.
+	HCSNetwork string `json:"hcs_network"`
+}
+
+var knownNetworks = map[string]hederaNetwork{
+	"testnet": {
+		Name:      "testnet",
+		MirrorURL: "https://testnet.mirrornode.hedera.com/api/v1",
+		RPCURL:    "https://testnet.hashio.io/api",
+		ChainID:   296,
+	},
+	"previewnet": {
+		Name:      "previewnet",
+		MirrorURL: "https://previewnet.mirrornode.hedera.com/api/v1",
+		RPCURL:    "https://previewnet.hashio.io/api",
+		ChainID:   297,
+	},
+	"mainnet": {
+		Name:      "mainnet",
+		MirrorURL: "https://mainnet-public.mirrornode.hedera.com/api/v1",
+		RPCURL:    "https://mainnet.hashio.io/api",
+		ChainID:   295,
+	},
+}
+
+var hederaNet hederaNetwork
+
+var accountIDPattern = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+
+func loadHederaNetwork() {
+	name := strings.ToLower(getEnvOrDefault("HEDERA_NETWORK", "testnet"))
+	sel, ok := knownNetworks[name]
+	if !ok {
+		log.Fatalf("network: unknown HEDERA_NETWORK %q (testnet, previewnet, mainnet)", name)
+	}
+	sel.MirrorURL = strings.TrimRight(firstEnv(sel.MirrorURL, "HEDERA_MIRROR_URL", "mirror_api_url"), "/")
+	sel.RPCURL = firstEnv(sel.RPCURL, "HEDERA_RPC_URL", "eth_rpc_url")
+	sel.AccountID = getEnvOrDefault("hedera_id", "")
+	sel.HCSNetwork = "testnet"
+
+	if err := sel.checkEndpoints(); err != nil {
+		log.Fatalf("network: %v", err)
+	}
+	if sel.AccountID != "" && !accountIDPattern.MatchString(sel.AccountID) {
+		log.Fatalf("network: hedera_id %q is not a shard.realm.num account ID", sel.AccountID)
+	}
+
+	// The SDK only looks at its own variable names.
+	os.Setenv("mirror_api_url", sel.MirrorURL)
+	os.Setenv("eth_rpc_url", sel.RPCURL)
+	hederaNet = sel
+
+	log.Printf("Network   : %s (mirror %s, chain %d)", sel.Name, sel.MirrorURL, sel.ChainID)
+	if sel.Name != sel.HCSNetwork && neuronStreamingEnabled() {
+		log.Printf("Network   : warning: the Neuron SDK submits HCS messages on %s; only mirror and RPC traffic uses %s", sel.HCSNetwork, sel.Name)
+	}
+	if sel.AccountID != "" && parseEnvBool("HEDERA_NETWORK_CHECK", true) {
+		if err := sel.checkAccount(); err != nil {
+			log.Fatalf("network: %v", err)
+		}
+	}
+}
+
+// firstEnv returns the first of keys that is set, or fallback.
+func firstEnv(fallback string, keys ...string) string {
+	for _, key := range keys {
+		if v := getEnvOrDefault(key, ""); v != "" {
+			return v
+		}
+	}
+	return fallback
+}
+
+// checkEndpoints rejects mirror or RPC URLs whose host names a different
+// well-known network, e.g. a testnet mirror with HEDERA_NETWORK=mainnet.
+func (n hederaNetwork) checkEndpoints() error {
+	for label, raw := range map[string]string{"mirror node": n.MirrorURL, "JSON-RPC relay": n.RPCURL} {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("%s URL %q is not a valid URL", label, raw)
+		}
+		for other := range knownNetworks {
+			if other != n.Name && strings.Contains(u.Hostname(), other) {
+				return fmt.Errorf("%s %s is a %s endpoint but HEDERA_NETWORK=%s", label, raw, other, n.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkAccount asks the mirror node for the operator account. A 404 means the
+// account was created on another network; unreachable mirrors only warn so
+// an offline node can still start.
+func (n hederaNetwork) checkAccount() error {
+	client := outboundClient(5 * time.Second)
+	resp, err := client.Get(n.MirrorURL + "/accounts/" + n.AccountID)
+	if err != nil {
+		log.Printf("Network   : could not verify account %s: %v", n.AccountID, err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return fmt.Errorf("account %s does not exist on %s (check HEDERA_NETWORK and hedera_id)", n.AccountID, n.Name)
+	default:
+		log.Printf("Network   : could not verify account %s: mirror node returned %s", n.AccountID, resp.Status)
+		return nil
+	}
+
+	var account struct {
+		EvmAddress string `json:"evm_address"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&account); err != nil {
+		log.Printf("Network   : could not verify account %s: %v", n.AccountID, err)
+		return nil
+	}
+	evm := strings.ToLower(getEnvOrDefault("hedera_evm_id", ""))
+	// Not fatal: ed25519 accounts can be addressed by their long-zero
+	// address as well as by the alias the mirror node reports.
+	if evm != "" && account.EvmAddress != "" && !strings.EqualFold(strings.TrimPrefix(evm, "0x"), strings.TrimPrefix(account.EvmAddress, "0x")) {
+		log.Printf("Network   : warning: hedera_evm_id %s differs from the EVM address %s reports for %s (%s)", evm, n.Name, n.AccountID, account.EvmAddress)
+	}
+	return nil
+}
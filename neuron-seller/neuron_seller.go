@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -13,10 +12,10 @@ import (
 
 	neuronsdk "github.com/NeuronInnovations/neuron-go-hedera-sdk"
 	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
-	hedera_helper "github.com/NeuronInnovations/neuron-go-hedera-sdk/hedera"
 	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
 	"github.com/hashgraph/hedera-sdk-go/v2"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 )
 
@@ -26,15 +25,64 @@ type neuronSellerConfig struct {
 	Version        string
 	StreamInterval time.Duration
 	SampleKind     string
+	Kinds          []sensorKind
+	Codec          string // default payload codec: json, avro or cbor
+
+	// HeartbeatInterval is how long a buyer stream may stay silent before
+	// it gets a heartbeat frame; 0 disables heartbeats.
+	HeartbeatInterval time.Duration
+
+	// StalePeerAfter is how long a buyer may stay disconnected or unpaid
+	// before its buffer and stream state are dropped; 0 keeps them forever.
+	StalePeerAfter time.Duration
 }
 
 type neuronSeller struct {
 	cfg neuronSellerConfig
+
+	// scheduleActive is the last duty-cycle state announced to buyers.
+	scheduleActive bool
+
+	// greeted records, per peer ID + protocol + codec, the libp2p stream
+	// that already got its handshake frames (license, avro schema, cbor
+	// fingerprint). A buyer that reconnects between two samples is on a
+	// new stream and is greeted again; one that is not connected loses its
+	// entries.
+	greeted map[string]string
+
+	// lastSent is when each peer stream (peer ID + protocol) last got a
+	// frame, for heartbeats.
+	lastSent map[string]time.Time
+
+	// ticks counts stream loop ticks; peers on a degraded link only get
+	// samples on every n-th one.
+	ticks uint64
+
+	// linkNotice marks peers whose interval changed and who still have to
+	// be told with a link_quality frame.
+	linkNotice map[string]bool
+
+	// staleSince is when each buyer was first seen disconnected or
+	// unpaid, for stale-peer collection.
+	staleSince map[peer.ID]time.Time
+
+	// batches holds samples per peer stream while batching is on, and
+	// lastValues each kind's last value sent in delta mode.
+	batches    map[string]*streamBatch
+	lastValues map[string]float64
+
+	// connected is the set of connected buyers at the last check, for
+	// the buyer webhooks.
+	connected map[string]bool
 }
 
 type piMetrics struct {
 	Ts         float64 `json:"ts"`
 	Brightness float64 `json:"brightness"`
+
+	// Values holds every numeric field of the /metrics document so each
+	// configured sensor kind can pick its own reading.
+	Values map[string]float64 `json:"-"`
 }
 
 var (
@@ -61,7 +109,14 @@ func runNeuronSellerNode() error {
 		return nil
 	}
 
-	seller := &neuronSeller{cfg: cfg.ensureDefaults()}
+	seller := &neuronSeller{
+		cfg:            cfg.ensureDefaults(),
+		scheduleActive: true,
+		greeted:        make(map[string]string),
+		lastSent:       make(map[string]time.Time),
+		linkNotice:     make(map[string]bool),
+		staleSince:     make(map[peer.ID]time.Time),
+	}
 
 	log.Printf(
 		"neuron-seller: starting Neuron SDK (version=%s protocol=%s interval=%s)",
@@ -99,8 +154,29 @@ func loadNeuronSellerConfig() (neuronSellerConfig, error) {
 		Version:        getEnvOrDefault("NEURON_VERSION", "0.1.0"),
 		StreamInterval: time.Duration(parseEnvInt("NEURON_STREAM_INTERVAL_SECONDS", 5)) * time.Second,
 		SampleKind:     getEnvOrDefault("NEURON_SAMPLE_KIND", "brightness_sample"),
+		Codec:          getEnvOrDefault("PAYLOAD_CODEC", codecJSON),
+
+		HeartbeatInterval: time.Duration(parseEnvInt("HEARTBEAT_INTERVAL_SECONDS", 30)) * time.Second,
+		StalePeerAfter:    time.Duration(parseEnvInt("PEER_GC_STALE_MINUTES", 60)) * time.Minute,
+	}
+	if cfg.Codec != codecJSON && cfg.Codec != codecAvro && cfg.Codec != codecCBOR {
+		return neuronSellerConfig{}, fmt.Errorf("PAYLOAD_CODEC must be json, avro or cbor, got %q", cfg.Codec)
+	}
+	kinds, err := parseSensorKinds(getEnvOrDefault("SENSOR_KINDS", ""))
+	if err != nil {
+		return neuronSellerConfig{}, err
+	}
+	cfg.Kinds = kinds
+	cfg = cfg.ensureDefaults()
+
+	if cfg.Kinds, err = loadKindUnits(cfg.Kinds); err != nil {
+		return neuronSellerConfig{}, err
+	}
+	if cfg.Kinds, err = withFusedKind(cfg.Kinds); err != nil {
+		return neuronSellerConfig{}, err
 	}
-	return cfg.ensureDefaults(), nil
+	cfg.Kinds = loadKindEvents(loadKindRanges(loadKindTTLs(cfg.Kinds)))
+	return cfg, nil
 }
 
 func (c neuronSellerConfig) ensureDefaults() neuronSellerConfig {
@@ -116,39 +192,159 @@ func (c neuronSellerConfig) ensureDefaults() neuronSellerConfig {
 	if c.SampleKind == "" {
 		c.SampleKind = "brightness_sample"
 	}
+	if len(c.Kinds) == 0 {
+		c.Kinds = []sensorKind{{Name: c.SampleKind, Field: "brightness", Protocol: c.Protocol}}
+	}
 	return c
 }
 
 func (s *neuronSeller) handleSellerStream(ctx context.Context, p2pHost host.Host, buffers *commonlib.NodeBuffers) {
-	ticker := time.NewTicker(s.cfg.StreamInterval)
-	defer ticker.Stop()
+	// Readings come from the shared sampling engine, which only fetches
+	// when this loop (or another subscriber) has somewhere to send them.
+	readings := sampler.Subscribe("neuron", func(now time.Time) bool {
+		return s.wantsSample(buffers, now)
+	})
+	defer sampler.Unsubscribe(readings)
 
-	log.Printf("neuron-seller: stream loop running (tick=%s)", s.cfg.StreamInterval)
+	var heartbeats <-chan time.Time
+	if s.cfg.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(s.cfg.HeartbeatInterval / 2)
+		defer ticker.Stop()
+		heartbeats = ticker.C
+	}
+	backfillTicks := time.NewTicker(time.Second)
+	defer backfillTicks.Stop()
+	var sweeps <-chan time.Time
+	if s.cfg.StalePeerAfter > 0 {
+		ticker := time.NewTicker(max(s.cfg.StalePeerAfter/6, time.Minute))
+		defer ticker.Stop()
+		sweeps = ticker.C
+	}
+
+	log.Printf("neuron-seller: stream loop running (tick=%s, jitter=±%.0f%%)", s.cfg.StreamInterval, tickJitter*100)
+	neuronBuffers = buffers
+	listenP2P(p2pHost)
+	startConnLimits(p2pHost)
+
+	go func() {
+		if err := publishRegistration(); err != nil {
+			log.Printf("neuron-seller: %v", err)
+		}
+	}()
+	startRelayUplinks(ctx, p2pHost, buffers, s.cfg.Kinds)
+	startSelftest(p2pHost)
+	startProbe(ctx)
 
 	for {
 		select {
 		case <-ctx.Done():
 			log.Println("neuron-seller: context cancelled, stopping stream loop")
 			return
-		case tick := <-ticker.C:
-			if len(buffers.GetBufferMap()) == 0 {
+		case now := <-heartbeats:
+			s.sendHeartbeats(p2pHost, buffers, now)
+		case now := <-sweeps:
+			s.sweepStalePeers(p2pHost, buffers, now)
+		case <-backfillTicks.C:
+			s.enforceBuyerAccess(p2pHost, buffers)
+			s.sendReplays(p2pHost, buffers)
+			s.sendBackfills(p2pHost, buffers)
+			s.flushBatches(p2pHost, buffers, time.Now())
+			s.watchBuyers(buffers)
+		case r := <-readings.C():
+			if !s.sampling(buffers, r.At) || r.Metrics == nil {
 				continue
 			}
+			s.sample(p2pHost, buffers, r.At, r.Metrics, r.Due, r.Pushed)
+		}
+	}
+}
 
-			metrics, err := fetchPiMetrics()
-			if err != nil {
-				log.Printf("neuron-seller: unable to fetch Pi metrics: %v", err)
+// sampling reports whether a sample taken at now has anyone to go to and
+// falls in the duty schedule, announcing schedule changes to buyers.
+func (s *neuronSeller) sampling(buffers *commonlib.NodeBuffers, now time.Time) bool {
+	if !s.hasAudience(buffers, now) {
+		return false
+	}
+	active := schedule.Active(now)
+	if active != s.scheduleActive {
+		s.scheduleActive = active
+		s.announceSchedule(buffers, active, now)
+	}
+	return active
+}
+
+// hasAudience reports whether a sample taken at now has anyone to go to.
+func (s *neuronSeller) hasAudience(buffers *commonlib.NodeBuffers, now time.Time) bool {
+	// Keep sampling without buyers when history is on so the local log has
+	// no gaps, and while /stream or /poll clients or a selftest are around.
+	return len(buffers.GetBufferMap()) != 0 || history != nil || streamClients.Load() > 0 || polls.Active(now) || selftestActive()
+}
+
+// wantsSample is sampling without the side effects, for the sampling
+// engine's goroutine.
+func (s *neuronSeller) wantsSample(buffers *commonlib.NodeBuffers, now time.Time) bool {
+	return s.hasAudience(buffers, now) && schedule.Active(now)
+}
+
+// sample turns one Pi metrics document into a sample of every due kind
+// (and the kinds fused from them) and sends it out. A pushed document may
+// carry only some fields; kinds it has no reading for are skipped quietly.
+func (s *neuronSeller) sample(p2pHost host.Host, buffers *commonlib.NodeBuffers, tick time.Time, metrics *piMetrics, due map[string]bool, pushed bool) {
+	s.ticks++
+	// Readings sampled this round, by kind, for fused kinds.
+	var sampled map[string]uint64
+	var sampledValue map[string]float64
+	for i, kind := range s.cfg.Kinds {
+		if kind.FusedFrom == "" && !due[kind.Name] {
+			continue
+		}
+		raw, ok := metrics.Values[kind.Field]
+		if kind.FusedFrom != "" {
+			seq, own := sampled[kind.FusedFrom]
+			if !own {
 				continue
 			}
-
-			payload, tsEpoch, err := s.buildSamplePayload(tick, metrics)
-			if err != nil {
-				log.Printf("neuron-seller: unable to build payload: %v", err)
+			if raw, ok = fusion.Fuse(seq, sampledValue[kind.FusedFrom], tick); !ok {
 				continue
 			}
+		}
+		if !ok {
+			if !pushed {
+				log.Printf("neuron-seller: Pi metrics have no %q field for kind %s", kind.Field, kind.Name)
+			}
+			continue
+		}
+		smp := &pipelineSample{Tick: tick, Kind: kind, KindIndex: i, Metrics: metrics, Raw: raw, seller: s}
+		if !samplePipeline.Run(smp) {
+			continue
+		}
+		id, seq, value, payload, tsEpoch := smp.ID, smp.Seq, smp.Value, smp.Data, smp.Ts
+		if fusion != nil && kind.FusedFrom == "" {
+			if sampled == nil {
+				sampled, sampledValue = map[string]uint64{}, map[string]float64{}
+			}
+			sampled[kind.Name], sampledValue[kind.Name] = seq, value
+		}
+		nodeHealth.Sampled(tick)
 
-			s.broadcastSample(p2pHost, buffers, payload, tsEpoch, metrics.Brightness)
+		if history != nil {
+			rec := historyRecord{Seq: seq, Ts: tsEpoch, Kind: kind.Name, Value: value, Tags: tags.Current(), ID: id, Payload: payload}
+			if err := history.Append(rec); err != nil {
+				log.Printf("neuron-seller: history append failed: %v", err)
+			}
+		}
+
+		polls.Add(kind.Name, polledSample{Seq: seq, Ts: tsEpoch, ExpiresAt: sampleExpiry(kind, tsEpoch), Payload: payload})
+		anchors.Add(kind.Name, seq, payload, tick)
+
+		if !sampleFresh(time.Now(), tsEpoch, sampleExpiry(kind, tsEpoch), 0) {
+			log.Printf("neuron-seller: %s sample from ts=%d already expired, not sending", kind.Name, tsEpoch)
+			continue
 		}
+
+		// Relays, the LoRaWAN sink and the rule engine take it from the bus.
+		sampleBus.Publish(busSample{Kind: kind.Name, KindIndex: i, ID: id, Seq: seq, Ts: tsEpoch, Value: value, Payload: payload, At: time.Now()})
+		s.broadcastSample(p2pHost, buffers, kind, i == 0, payload, id, seq, tsEpoch, value)
 	}
 }
 
@@ -163,51 +359,200 @@ func (s *neuronSeller) handleSellerTopicMessage(msg hedera.TopicMessage) {
 		return
 	}
 	log.Printf("neuron-seller: topic message type=%s consensus_ts=%s", messageType, msg.ConsensusTimestamp)
+	topicLag.Observe(messageType, msg.ConsensusTimestamp, time.Now())
+
+	switch messageType {
+	case commandMessageType:
+		handleCommandMessage(msg.Contents)
+	default:
+		log.Printf("neuron-seller: ignoring topic message type %s", messageType)
+	}
 }
 
+// broadcastSample writes one kind's payload to the buyers subscribed to it,
+// on that kind's protocol.
 func (s *neuronSeller) broadcastSample(
 	p2pHost host.Host,
 	buffers *commonlib.NodeBuffers,
+	kind sensorKind,
+	primary bool,
 	payload []byte,
+	id string,
+	seq uint64,
 	tsEpoch int64,
-	brightness float64,
+	value float64,
 ) {
-	line := append(payload, '\n')
+	// Frames by privacy tier, made on first use.
+	type tierFrames struct{ payload, line, avro, cbor []byte }
+	frames := map[string]*tierFrames{}
 	for peerID, bufferInfo := range buffers.GetBufferMap() {
-		if bufferInfo.LibP2PState != types.Connected || !bufferInfo.IsOtherSideValidAccount {
+		if bufferInfo.LibP2PState != types.Connected {
+			s.forgetGreetings(peerID)
+			continue
+		}
+		if !buyerWantsKind(bufferInfo, kind, primary) || !buyerWantsTags(bufferInfo) {
+			continue
+		}
+		if !sampleFresh(time.Now(), tsEpoch, sampleExpiry(kind, tsEpoch), buyerMaxAge(bufferInfo)) {
+			continue
+		}
+		if bandwidth.Admit(peerID.String()) != capAllow {
 			continue
 		}
+		if !links.Due(peerID.String(), s.ticks) {
+			continue
+		}
+		buyerKey, buyerAccount := buyerIdentity(bufferInfo)
+		if !controls.Admit(buyerKey, kind.Name, time.Now()) {
+			continue
+		}
+		// Unpaid buyers only get samples on a voucher or while their
+		// trial lasts.
+		var freeVia string
+		if !buyerPaid(bufferInfo) {
+			switch {
+			case memBudget.Level() == memoryHard:
+				continue
+			case vouchers.Admit(bufferInfo, time.Now()):
+				freeVia = "voucher"
+			case trials.Admit(trialAccount(bufferInfo), time.Now()):
+				freeVia = "trial"
+			default:
+				continue
+			}
+		}
 
-		if err := commonlib.WriteAndFlushBuffer(
-			*bufferInfo,
-			peerID,
-			buffers,
-			line,
-			p2pHost,
-			s.cfg.Protocol,
-		); err != nil {
-			log.Printf("neuron-seller: stream write to %s failed: %v", peerID, err)
-			hedera_helper.PeerSendErrorMessage(
-				bufferInfo.RequestOrResponse.OtherStdInTopic,
-				types.WriteError,
-				fmt.Sprintf("localsense node %s unavailable: %v", sellerCfg.SellerID, err),
-				types.SendFreshHederaRequest,
+		tierName, tier := privacy.TierFor(bufferInfo)
+		fr := frames[tierName]
+		if fr == nil {
+			tiered, err := tier.Apply(payload)
+			if err != nil {
+				log.Printf("neuron-seller: apply privacy tier %s to %s sample: %v", tierName, kind.Name, err)
+				continue
+			}
+			fr = &tierFrames{payload: tiered, line: append(tiered, '\n')}
+			frames[tierName] = fr
+		}
+
+		codec := buyerCodec(bufferInfo, s.cfg.Codec)
+		proto := streamProtocol(bufferInfo, kind)
+		greetKey := string(peerID) + string(proto) + codec
+		stream := buyerStreamID(p2pHost, peerID, proto)
+		greetedStream, ok := s.greeted[greetKey]
+		greeted := ok && greetedStream == stream
+		var frame []byte
+		switch codec {
+		case codecAvro:
+			if fr.avro == nil {
+				fr.avro = lengthPrefixed(avroPayloadAt(kind, id, seq, tier.Ts(tsEpoch), value, tier.Location(currentLocation())))
+			}
+			frame = fr.avro
+			if !greeted {
+				frame = append(avroHandshake(), fr.avro...)
+			}
+		case codecCBOR:
+			if fr.cbor == nil {
+				data, err := cborPayload(fr.payload)
+				if err != nil {
+					log.Printf("neuron-seller: encode %s sample as cbor: %v", kind.Name, err)
+					continue
+				}
+				fr.cbor = lengthPrefixed(data)
+			}
+			frame = fr.cbor
+			if !greeted {
+				frame = append(cborHandshake(), fr.cbor...)
+			}
+		default:
+			frame = fr.line
+			if handshake := licenseHandshake(); handshake != nil && !greeted {
+				frame = append(handshake, fr.line...)
+			}
+		}
+
+		// delivered books the sample once it has been written.
+		delivered := func() {
+			switch freeVia {
+			case "voucher":
+				vouchers.Delivered(buyerKey, buyerAccount, time.Now())
+			case "trial":
+				trials.Delivered(trialAccount(bufferInfo))
+			}
+			rec := deliveryRecord{
+				Ts:       time.Now().Unix(),
+				Peer:     peerID.String(),
+				Buyer:    buyerKey,
+				Account:  buyerAccount,
+				Shared:   buyerSharedAccount(bufferInfo),
+				Kind:     kind.Name,
+				Seq:      seq,
+				SampleID: id,
+				SampleTs: tsEpoch,
+				Codec:    codec,
+				Bytes:    len(frame),
+				Free:     freeVia,
+			}
+			if freeVia == "" {
+				q := samplePrice(buyerKey, buyerAccount, time.Now())
+				rec.Price = q.Tinybar
+				if q.Currency == currencyUSD {
+					rec.Currency, rec.Cents, rec.CentsPerHbar = q.Currency, q.Cents, q.CentsPerHbar
+				}
+			}
+			deliveries.Record(rec)
+			freshness.Delivered(freshP2P, tsEpoch, time.Now())
+			if rec.Price > 0 {
+				payments.Charge(rec)
+			}
+
+			log.Printf(
+				"neuron-seller: streamed %s %.3f (ts=%d) to peer %s",
+				kind.Name,
+				value,
+				tsEpoch,
+				peerID,
 			)
+		}
+		// Canary frames are JSON and only tried on paying buyers.
+		withCanary := func() {
+			if codec == codecJSON && freeVia == "" {
+				s.sendCanary(p2pHost, buffers, peerID, bufferInfo, proto, buyerKey, buyerAccount, kind, fr.payload)
+			}
+		}
+		if features.Enabled(flagBatching) {
+			s.greeted[greetKey] = stream
+			s.queueBatch(p2pHost, buffers, peerID, bufferInfo, proto, codec, greetKey, frame, delivered)
+			withCanary()
+			continue
+		}
+		if err := s.writeBuyerFrame(p2pHost, buffers, peerID, bufferInfo, proto, codec, frame); err != nil {
+			delete(s.greeted, greetKey)
+			reportWriteError(peerID.String(), bufferInfo, err)
 			continue
 		}
+		s.greeted[greetKey] = stream
+		delivered()
+		withCanary()
+	}
+}
 
-		log.Printf(
-			"neuron-seller: streamed brightness %.3f (ts=%d) to peer %s",
-			brightness,
-			tsEpoch,
-			peerID,
-		)
+func (s *neuronSeller) buildSamplePayload(now time.Time, kind sensorKind, id string, seq uint64, value float64, metrics *piMetrics) ([]byte, int64, error) {
+	payload, tsEpoch, err := newSamplePayload(now, kind, id, seq, value, metrics)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := encodeSamplePayload(&payload)
+	if err != nil {
+		return nil, 0, err
 	}
+	return data, tsEpoch, nil
 }
 
-func (s *neuronSeller) buildSamplePayload(now time.Time, metrics *piMetrics) ([]byte, int64, error) {
+// newSamplePayload fills in a sample's payload: the pipeline's enrich
+// stage.
+func newSamplePayload(now time.Time, kind sensorKind, id string, seq uint64, value float64, metrics *piMetrics) (samplePayload, int64, error) {
 	if metrics == nil {
-		return nil, 0, fmt.Errorf("metrics payload is nil")
+		return samplePayload{}, 0, fmt.Errorf("metrics payload is nil")
 	}
 
 	tsEpoch := int64(metrics.Ts)
@@ -219,34 +564,76 @@ func (s *neuronSeller) buildSamplePayload(now time.Time, metrics *piMetrics) ([]
 		isoTime = now.UTC()
 	}
 
-	payload := map[string]any{
-		"ts":         tsEpoch,
-		"ts_iso":     isoTime.Format(time.RFC3339),
-		"brightness": metrics.Brightness,
-		"seller_id":  sellerCfg.SellerID,
-		"source":     sellerCfg.SellerID,
-		"label":      sellerCfg.Label,
-		"lat":        sellerCfg.Lat,
-		"lon":        sellerCfg.Lon,
-		"kind":       s.cfg.SampleKind,
+	loc := currentLocation()
+	payload := samplePayload{
+		Ts:            tsEpoch,
+		TsISO:         isoTime,
+		Field:         kind.Field,
+		Value:         value,
+		Seq:           seq,
+		ID:            id,
+		SchemaID:      payloadSchemaID(),
+		SellerID:      sellerCfg.SellerID,
+		Label:         loc.Label,
+		Lat:           loc.Lat,
+		Lon:           loc.Lon,
+		Kind:          kind.Name,
+		Unit:          kind.Conversion.To,
+		PowerMode:     power.Mode(),
+		Network:       hederaNet.Name,
+		LicenseSHA256: licenseHash(),
+		Provenance:    kind.Conversion.Derivation(kind, seq, metrics.Values[kind.Field]),
+	}
+	if kind.FusedFrom != "" {
+		payload.Provenance = fusion.Provenance()
+	}
+	if kind.Event {
+		payload.Event = lastEvent(kind.Name)
+	} else {
+		payload.Uncertainty = uncertainty.Estimate(kind, value, now)
 	}
+	payload.Weather = weather.Current(now)
+	payload.Tags = tags.Encoded()
+	payload.Labels, payload.Descriptions = payloadLabels, payloadDescriptions
+	payload.Solar = sampleSolarPosition(isoTime)
+	if aqi, ok := computeAQI(kind, value); ok {
+		payload.AQI = aqi
+	}
+	if kind.Conversion.To == unitDBA {
+		payload.Sound = lastSoundLevel(kind.Name)
+	}
+	if expiresAt := sampleExpiry(kind, tsEpoch); expiresAt > 0 {
+		payload.TTL = kind.TTLSeconds
+		payload.ExpiresAt = expiresAt
+	}
+	return payload, tsEpoch, nil
+}
 
-	data, err := json.Marshal(payload)
+// encodeSamplePayload encodes and signs a payload: the pipeline's encode
+// stage.
+func encodeSamplePayload(payload *samplePayload) ([]byte, error) {
+	data, err := encodePayload(payload)
 	if err != nil {
-		return nil, 0, fmt.Errorf("marshal payload: %w", err)
+		return nil, fmt.Errorf("marshal payload: %w", err)
 	}
-	return data, tsEpoch, nil
+	if signer != nil {
+		data = signer.Sign(data)
+	}
+	return data, nil
 }
 
-func fetchPiMetrics() (*piMetrics, error) {
-	if sellerCfg.PiBase == "" {
-		return nil, fmt.Errorf("PI_BASE_URL is not configured")
-	}
-	var metrics piMetrics
-	if err := fetchJSON(sellerCfg.PiBase+"/metrics", &metrics); err != nil {
-		return nil, err
+// piMetricsFromDoc keeps the numeric fields of a decoded Pi metrics
+// document.
+func piMetricsFromDoc(raw map[string]any) *piMetrics {
+	metrics := piMetrics{Values: make(map[string]float64, len(raw))}
+	for key, val := range raw {
+		if f, ok := val.(float64); ok {
+			metrics.Values[key] = f
+		}
 	}
-	return &metrics, nil
+	metrics.Ts = metrics.Values["ts"]
+	metrics.Brightness = metrics.Values["brightness"]
+	return &metrics
 }
 
 func getEnvOrDefault(key, fallback string) string {
@@ -284,3 +671,65 @@ func parseEnvInt(key string, fallback int) int {
 	}
 	return parsed
 }
+
+// writeBuyerStream is the SDK's stream write; the benchmarks swap it for
+// one that discards frames.
+var writeBuyerStream = commonlib.WriteAndFlushBuffer
+
+// buyerStreamID is the ID of the open stream to peerID on proto, the one
+// the next write goes out on; "" without one.
+func buyerStreamID(p2pHost host.Host, peerID peer.ID, proto protocol.ID) string {
+	if p2pHost == nil {
+		return ""
+	}
+	for _, conn := range p2pHost.Network().ConnsToPeer(peerID) {
+		for _, stream := range conn.GetStreams() {
+			if stream.Protocol() == proto {
+				return stream.ID()
+			}
+		}
+	}
+	return ""
+}
+
+// writeBuyerFrame writes frame to one buyer stream, timing the write for
+// link quality scoring. A pending link_quality notice goes out in front of
+// the frame.
+func (s *neuronSeller) writeBuyerFrame(
+	p2pHost host.Host,
+	buffers *commonlib.NodeBuffers,
+	peerID peer.ID,
+	bufferInfo *commonlib.NodeBufferInfo,
+	proto protocol.ID,
+	codec string,
+	frame []byte,
+) error {
+	if !buyerAccess.Admit(peerID, bufferInfo) {
+		return errBuyerRefused
+	}
+	peerKey := peerID.String()
+	interval := func(factor int) time.Duration {
+		return power.Interval(s.cfg.StreamInterval) * time.Duration(factor)
+	}
+	notice := s.linkNotice[peerKey]
+	if notice {
+		st, _ := links.Stats(peerKey)
+		frame = append(linkQualityFrame(peerKey, interval(st.Factor), codec), frame...)
+	}
+
+	start := time.Now()
+	err := writeBuyerStream(*bufferInfo, peerID, buffers, frame, p2pHost, proto)
+	if factor, changed := links.Observe(peerKey, time.Since(start), err); changed {
+		log.Printf("neuron-seller: link to %s now at 1/%d of the sample rate (every %s)", peerKey, factor, interval(factor))
+		s.linkNotice[peerKey] = true
+	} else if notice && err == nil {
+		delete(s.linkNotice, peerKey)
+	}
+	if err != nil {
+		return err
+	}
+	writeErrors.Succeeded(peerKey)
+	s.lastSent[string(peerID)+string(proto)] = time.Now()
+	bandwidth.Record(surfaceP2P, peerKey, len(frame))
+	return nil
+}
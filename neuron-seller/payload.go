@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// samplePayload is the JSON document sent for one sample. appendJSON
+// writes it by hand, with keys in the sorted order json.Marshal used for
+// the map[string]any it replaces and the same number and string
+// formatting, so payloads (and the signatures over them) are byte for byte
+// what they were, without the map, the reflection or the boxing per tick.
+type samplePayload struct {
+	Ts            int64
+	TsISO         time.Time
+	Field         string // the kind's metrics field, repeating Value
+	Value         float64
+	Seq           uint64
+	SchemaID      string
+	SellerID      string // also sent as "source"
+	Label         string
+	Lat, Lon      float64
+	Kind          string
+	Unit          unit
+	PowerMode     powerMode
+	Network       string
+	LicenseSHA256 string // omitted when empty
+	TTL           int    // ttl and expires_at are omitted when ExpiresAt is 0
+	ExpiresAt     int64
+	Provenance    *derivation       // omitted when nil
+	Uncertainty   sampleUncertainty // omitted when Sigma is 0
+	Weather       *weatherSnapshot  // omitted when nil
+	Solar         solarPosition     // omitted unless valid
+	AQI           sampleAQI         // omitted for kinds without one
+	Sound         *soundLevel       // omitted when nil
+	Event         *sampleEvent      // omitted when nil
+	Tags          []byte            // encoded object, omitted when empty
+	Labels        []byte            // encoded locale map, omitted when empty
+	Descriptions  []byte            // encoded locale map, omitted when empty
+	ID            string            // ULID, omitted when empty
+
+	// Derived is the encoded DERIVED_FIELDS object, omitted when empty.
+	Derived []byte
+}
+
+// payloadKeys are the fixed members in encoding order.
+var payloadKeys = [...]string{
+	"aqi", "derived", "descriptions", "event", "expires_at", "id", "kind", "label", "labels", "lat",
+	"license_sha256", "lon", "network", "power_mode", "provenance", "schema_id", "seller_id",
+	"seq", "solar", "sound", "source", "tags", "ts", "ts_iso", "ttl", "uncertainty", "unit",
+	"value", "weather",
+}
+
+func (p *samplePayload) has(key string) bool {
+	switch key {
+	case "expires_at", "ttl":
+		return p.ExpiresAt != 0
+	case "license_sha256":
+		return p.LicenseSHA256 != ""
+	case "provenance":
+		return p.Provenance != nil
+	case "uncertainty":
+		return p.Uncertainty.Sigma != 0
+	case "weather":
+		return p.Weather != nil
+	case "solar":
+		return p.Solar.valid
+	case "aqi":
+		return p.AQI.Category != ""
+	case "sound":
+		return p.Sound != nil
+	case "event":
+		return p.Event != nil
+	case "tags":
+		return len(p.Tags) > 0
+	case "labels":
+		return len(p.Labels) > 0
+	case "descriptions":
+		return len(p.Descriptions) > 0
+	case "derived":
+		return len(p.Derived) > 0
+	case "id":
+		return p.ID != ""
+	}
+	return true
+}
+
+// appendJSON appends the encoded payload to dst.
+func (p *samplePayload) appendJSON(dst []byte) ([]byte, error) {
+	var err error
+	dst = append(dst, '{')
+	first := true
+	member := func(key string) {
+		if !first {
+			dst = append(dst, ',')
+		}
+		first = false
+		dst = appendJSONString(dst, key)
+		dst = append(dst, ':')
+	}
+
+	// The kind's field goes in its sorted place. Where it shares a name
+	// with a fixed member the later write to the old map wins: the field
+	// over ts and ts_iso, every other member over the field.
+	fieldDone := false
+	for _, key := range payloadKeys {
+		if !p.has(key) {
+			continue
+		}
+		if !fieldDone && p.Field < key {
+			member(p.Field)
+			if dst, err = appendJSONFloat(dst, p.Value); err != nil {
+				return nil, err
+			}
+			fieldDone = true
+		}
+		member(key)
+		if key == p.Field {
+			fieldDone = true
+			if key == "ts" || key == "ts_iso" {
+				if dst, err = appendJSONFloat(dst, p.Value); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		switch key {
+		case "aqi":
+			dst = p.AQI.appendJSON(dst)
+		case "derived":
+			dst = append(dst, p.Derived...)
+		case "descriptions":
+			dst = append(dst, p.Descriptions...)
+		case "event":
+			dst = p.Event.appendJSON(dst)
+		case "expires_at":
+			dst = strconv.AppendInt(dst, p.ExpiresAt, 10)
+		case "id":
+			dst = appendJSONString(dst, p.ID)
+		case "kind":
+			dst = appendJSONString(dst, p.Kind)
+		case "label":
+			dst = appendJSONString(dst, p.Label)
+		case "labels":
+			dst = append(dst, p.Labels...)
+		case "lat":
+			dst, err = appendJSONFloat(dst, p.Lat)
+		case "license_sha256":
+			dst = appendJSONString(dst, p.LicenseSHA256)
+		case "lon":
+			dst, err = appendJSONFloat(dst, p.Lon)
+		case "network":
+			dst = appendJSONString(dst, p.Network)
+		case "power_mode":
+			dst = appendJSONString(dst, string(p.PowerMode))
+		case "provenance":
+			// Only present for unit conversions; not worth hand-encoding.
+			var b []byte
+			if b, err = json.Marshal(p.Provenance); err == nil {
+				dst = append(dst, b...)
+			}
+		case "schema_id":
+			dst = appendJSONString(dst, p.SchemaID)
+		case "seller_id", "source":
+			dst = appendJSONString(dst, p.SellerID)
+		case "seq":
+			dst = strconv.AppendUint(dst, p.Seq, 10)
+		case "solar":
+			dst = p.Solar.appendJSON(dst)
+		case "sound":
+			dst, err = p.Sound.appendJSON(dst)
+		case "tags":
+			dst = append(dst, p.Tags...)
+		case "ts":
+			dst = strconv.AppendInt(dst, p.Ts, 10)
+		case "ts_iso":
+			dst = append(dst, '"')
+			dst = p.TsISO.AppendFormat(dst, time.RFC3339)
+			dst = append(dst, '"')
+		case "ttl":
+			dst = strconv.AppendInt(dst, int64(p.TTL), 10)
+		case "uncertainty":
+			dst = p.Uncertainty.appendJSON(dst)
+		case "unit":
+			dst = appendJSONString(dst, string(p.Unit))
+		case "value":
+			dst, err = appendJSONFloat(dst, p.Value)
+		case "weather":
+			dst = append(dst, p.Weather.encoded...)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !fieldDone {
+		member(p.Field)
+		if dst, err = appendJSONFloat(dst, p.Value); err != nil {
+			return nil, err
+		}
+	}
+	return append(dst, '}'), nil
+}
+
+// appendJSONFloat formats f the way encoding/json does.
+func appendJSONFloat(dst []byte, f float64) ([]byte, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return dst, fmt.Errorf("json: unsupported value: %s", strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	dst = strconv.AppendFloat(dst, f, format, -1, 64)
+	if format == 'e' {
+		// e-09 -> e-9, as encoding/json does.
+		if n := len(dst); n >= 4 && dst[n-4] == 'e' && dst[n-3] == '-' && dst[n-2] == '0' {
+			dst[n-2] = dst[n-1]
+			dst = dst[:n-1]
+		}
+	}
+	return dst, nil
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString quotes s the way encoding/json does with HTML escaping
+// on: <, > and & as \u escapes, invalid UTF-8 replaced by U+FFFD, and
+// U+2028 and U+2029 escaped.
+func appendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch b {
+			case '\\', '"':
+				dst = append(dst, '\\', b)
+			case '\b':
+				dst = append(dst, '\\', 'b')
+			case '\f':
+				dst = append(dst, '\\', 'f')
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if c == '\u2028' || c == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// Whether a buyer has paid, and what it has paid, comes from the payment
+// backend chosen with PAYMENT_BACKEND:
+//
+//	hedera  the SDK's check of the buyer's shared account
+//	        (IsOtherSideValidAccount) and its hourly scheduled transfers,
+//	        read back from the mirror node. The default.
+//	ledger  a prepaid-credit file (PAYMENT_LEDGER_FILE): every billed sample
+//	        is debited from the buyer account's balance, and accounts without
+//	        enough left for the next sample are unpaid. Operators top
+//	        accounts up through POST /admin/credits.
+//	api     an external billing service at PAYMENT_API_URL, asked whether a
+//	        buyer is authorized and sent batched usage records.
+//
+// The ledger and api backends bill the identity in the buyer's service
+// request, so like hedera they only authorize buyers whose account the SDK
+// has validated. Unpaid buyers can still stream on a voucher or trial.
+
+type paymentBackend interface {
+	Name() string
+	// Authorized reports whether the buyer on info may get paid samples.
+	// It is called per sample and must not block on the network.
+	Authorized(info *commonlib.NodeBufferInfo) bool
+	// Charge takes payment for a billed delivery.
+	Charge(rec deliveryRecord)
+	// Payer is the account rec is paid from, as Settled reports it.
+	Payer(rec deliveryRecord) string
+	// Settled returns what each payer paid between from and to.
+	Settled(from, to time.Time) (map[string]int64, error)
+}
+
+var payments paymentBackend = hederaPayments{}
+
+func loadPayments() {
+	switch name := strings.ToLower(getEnvOrDefault("PAYMENT_BACKEND", "hedera")); name {
+	case "hedera":
+		payments = hederaPayments{}
+	case "ledger":
+		payments = loadCreditLedger()
+	case "api":
+		payments = loadBillingAPI()
+	default:
+		log.Fatalf("payments: PAYMENT_BACKEND must be hedera, ledger or api, got %q", name)
+	}
+	log.Printf("Payments  : %s", payments.Name())
+}
+
+// buyerPaid reports whether the buyer on info has paid for its stream.
+func buyerPaid(info *commonlib.NodeBufferInfo) bool {
+	return payments.Authorized(info)
+}
+
+// billingAccount is the account a buyer is billed under by the ledger and
+// api backends: its EVM address, or its public key when it sent none.
+func billingAccount(key, evm string) string {
+	if evm != "" {
+		return normalizeEVM(evm)
+	}
+	return key
+}
+
+// parseBillingAccount normalizes an operator-supplied EVM address or public
+// key the way billingAccount does.
+func parseBillingAccount(s string) string {
+	if raw := rawKey(s); len(raw) == 40 {
+		return normalizeEVM(raw)
+	}
+	return rawKey(s)
+}
+
+// hederaPayments leaves verification and settlement to the SDK.
+type hederaPayments struct{}
+
+func (hederaPayments) Name() string { return "hedera" }
+
+func (hederaPayments) Authorized(info *commonlib.NodeBufferInfo) bool {
+	return info.IsOtherSideValidAccount
+}
+
+// Charge does nothing: the SDK settles by transferring the shared account
+// balance each hour.
+func (hederaPayments) Charge(deliveryRecord) {}
+
+func (hederaPayments) Payer(rec deliveryRecord) string { return rec.Shared }
+
+func (hederaPayments) Settled(from, to time.Time) (map[string]int64, error) {
+	if hederaNet.AccountID == "" {
+		return nil, errNoHederaAccount
+	}
+	return fetchSettlements(hederaNet.AccountID, from, to)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// billingAPI is the external payment backend. It talks to three endpoints
+// under PAYMENT_API_URL, with PAYMENT_API_TOKEN as a bearer token if set:
+//
+//	GET  /authorize?account=&key=&shared_account=  -> {"authorized": bool}
+//	POST /usage  {"seller_id", "records": [deliveryRecord...]}
+//	GET  /settlements?from=&to=  (unix seconds) -> {"accounts": {account: tinybar}}
+//
+// Authorizations are cached for PAYMENT_API_CACHE_SECONDS and refreshed in
+// the background, so the stream loop never waits on the API; a buyer is
+// unpaid until its first answer arrives. Usage is posted every
+// PAYMENT_API_FLUSH_SECONDS and kept for the next flush if the post fails.
+
+const billingAPIMaxQueue = 10000
+
+type billingAuth struct {
+	ok      bool
+	checked time.Time
+	pending bool
+}
+
+type billingAPI struct {
+	base   string
+	token  string
+	ttl    time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	auth  map[string]*billingAuth
+	queue []deliveryRecord
+}
+
+func loadBillingAPI() *billingAPI {
+	base := strings.TrimRight(getEnvOrDefault("PAYMENT_API_URL", ""), "/")
+	if base == "" {
+		log.Fatalf("payments: PAYMENT_BACKEND=api needs PAYMENT_API_URL")
+	}
+	a := &billingAPI{
+		base:   base,
+		token:  getEnvOrDefault("PAYMENT_API_TOKEN", ""),
+		ttl:    time.Duration(parseEnvInt("PAYMENT_API_CACHE_SECONDS", 60)) * time.Second,
+		client: outboundClient(10 * time.Second),
+		auth:   make(map[string]*billingAuth),
+	}
+	flush := time.Duration(parseEnvInt("PAYMENT_API_FLUSH_SECONDS", 30)) * time.Second
+	go func() {
+		ticker := time.NewTicker(max(flush, time.Second))
+		defer ticker.Stop()
+		for range ticker.C {
+			a.flush()
+		}
+	}()
+	return a
+}
+
+func (a *billingAPI) Name() string { return "api" }
+
+// Authorized reports what the billing service last said about the buyer,
+// asking again in the background once that is older than the TTL. Buyers
+// whose account the SDK hasn't validated aren't asked about: anyone could
+// claim their identity.
+func (a *billingAPI) Authorized(info *commonlib.NodeBufferInfo) bool {
+	if !info.IsOtherSideValidAccount {
+		return false
+	}
+	key, evm := buyerIdentity(info)
+	account := billingAccount(key, evm)
+	if account == "" {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st, ok := a.auth[account]
+	if !ok {
+		st = &billingAuth{}
+		a.auth[account] = st
+	}
+	if !st.pending && time.Since(st.checked) >= a.ttl {
+		st.pending = true
+		go a.authorize(account, key, buyerSharedAccount(info))
+	}
+	return st.ok
+}
+
+func (a *billingAPI) authorize(account, key, shared string) {
+	q := url.Values{"account": {account}, "key": {key}}
+	if shared != "" {
+		q.Set("shared_account", shared)
+	}
+	var resp struct {
+		Authorized bool `json:"authorized"`
+	}
+	err := a.do(http.MethodGet, "/authorize?"+q.Encode(), nil, &resp)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st := a.auth[account]
+	st.pending = false
+	st.checked = time.Now()
+	if err != nil {
+		// Keep the last answer rather than cutting buyers off while the
+		// billing service is down.
+		log.Printf("payments: authorize %.18s: %v", account, err)
+		return
+	}
+	if st.ok != resp.Authorized {
+		log.Printf("payments: %.18s authorized=%v", account, resp.Authorized)
+	}
+	st.ok = resp.Authorized
+}
+
+func (a *billingAPI) Charge(rec deliveryRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.queue) >= billingAPIMaxQueue {
+		log.Printf("payments: usage queue full, dropping oldest record")
+		a.queue = a.queue[1:]
+	}
+	a.queue = append(a.queue, rec)
+}
+
+func (a *billingAPI) flush() {
+	a.mu.Lock()
+	batch := a.queue
+	a.queue = nil
+	a.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	body := map[string]any{"seller_id": sellerCfg.SellerID, "records": batch}
+	if err := a.do(http.MethodPost, "/usage", body, nil); err != nil {
+		log.Printf("payments: post %d usage records: %v", len(batch), err)
+		a.mu.Lock()
+		a.queue = append(batch, a.queue...)
+		if over := len(a.queue) - billingAPIMaxQueue; over > 0 {
+			a.queue = a.queue[over:]
+		}
+		a.mu.Unlock()
+	}
+}
+
+func (a *billingAPI) Payer(rec deliveryRecord) string {
+	return billingAccount(rec.Buyer, rec.Account)
+}
+
+func (a *billingAPI) Settled(from, to time.Time) (map[string]int64, error) {
+	q := url.Values{
+		"from": {strconv.FormatInt(from.Unix(), 10)},
+		"to":   {strconv.FormatInt(to.Unix(), 10)},
+	}
+	var resp struct {
+		Accounts map[string]int64 `json:"accounts"`
+	}
+	if err := a.do(http.MethodGet, "/settlements?"+q.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Accounts, nil
+}
+
+// do sends a request to the billing API and decodes a JSON reply into out
+// when out is non-nil.
+func (a *billingAPI) do(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, a.base+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("billing api: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("billing api: %s %s: %s", method, strings.SplitN(path, "?", 2)[0], resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("billing api: %w", err)
+	}
+	return nil
+}
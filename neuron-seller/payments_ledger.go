@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// creditLedger is the prepaid-credit payment backend: tinybar balances per
+// billing account, kept in PAYMENT_LEDGER_FILE.
+
+type creditAccount struct {
+	Balance  int64     `json:"balance_tinybar"`
+	Credited int64     `json:"credited_tinybar"`
+	Debited  int64     `json:"debited_tinybar"`
+	Updated  time.Time `json:"updated"`
+}
+
+type creditLedger struct {
+	file string
+
+	mu       sync.Mutex
+	accounts map[string]*creditAccount
+	dirty    bool
+}
+
+func loadCreditLedger() *creditLedger {
+	l := &creditLedger{
+		file:     getEnvOrDefault("PAYMENT_LEDGER_FILE", "data/credits.json"),
+		accounts: make(map[string]*creditAccount),
+	}
+	if err := l.load(); err != nil {
+		log.Fatalf("payments: %v", err)
+	}
+	go l.persistLoop()
+	return l
+}
+
+func (l *creditLedger) Name() string { return "ledger" }
+
+// Authorized reports whether the buyer's balance covers one more sample at
+// its current price. The identity in a service request is the buyer's own
+// claim, so nobody is billed before the SDK has validated its account.
+func (l *creditLedger) Authorized(info *commonlib.NodeBufferInfo) bool {
+	if !info.IsOtherSideValidAccount {
+		return false
+	}
+	key, evm := buyerIdentity(info)
+	price := samplePrice(key, evm, time.Now()).Tinybar
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a, ok := l.accounts[billingAccount(key, evm)]
+	return ok && a.Balance > 0 && a.Balance >= price
+}
+
+func (l *creditLedger) Charge(rec deliveryRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a, ok := l.accounts[l.Payer(rec)]
+	if !ok {
+		return
+	}
+	a.Balance -= rec.Price
+	a.Debited += rec.Price
+	a.Updated = time.Unix(rec.Ts, 0).UTC()
+	l.dirty = true
+}
+
+func (l *creditLedger) Payer(rec deliveryRecord) string {
+	return billingAccount(rec.Buyer, rec.Account)
+}
+
+// Settled is what was debited: prepaid credit is paid up front, so every
+// billed sample is settled when it is sent.
+func (l *creditLedger) Settled(from, to time.Time) (map[string]int64, error) {
+	if deliveries == nil {
+		return nil, fmt.Errorf("delivery log disabled (DELIVERY_LOG_ENABLE=false)")
+	}
+	recs, err := deliveries.Query("", from, to)
+	if err != nil {
+		return nil, err
+	}
+	paid := map[string]int64{}
+	for _, rec := range recs {
+		if rec.Price > 0 {
+			paid[l.Payer(rec)] += rec.Price
+		}
+	}
+	return paid, nil
+}
+
+// Credit adds amount (negative to correct a mistake) to account.
+func (l *creditLedger) Credit(account string, amount int64) creditAccount {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a, ok := l.accounts[account]
+	if !ok {
+		a = &creditAccount{}
+		l.accounts[account] = a
+	}
+	a.Balance += amount
+	a.Credited += amount
+	a.Updated = time.Now().UTC()
+	l.dirty = true
+	return *a
+}
+
+func (l *creditLedger) load() error {
+	data, err := os.ReadFile(l.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var accounts map[string]*creditAccount
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return fmt.Errorf("decode %s: %w", l.file, err)
+	}
+	if accounts != nil {
+		l.accounts = accounts
+	}
+	return nil
+}
+
+func (l *creditLedger) persistLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := l.save(); err != nil {
+			log.Printf("payments: save ledger: %v", err)
+		}
+	}
+}
+
+func (l *creditLedger) save() error {
+	l.mu.Lock()
+	if !l.dirty {
+		l.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(l.accounts)
+	l.dirty = false
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(l.file), 0o755); err != nil {
+		return err
+	}
+	tmp := l.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.file)
+}
+
+// GET /admin/credits lists prepaid balances; POST /admin/credits with
+// {"account", "amount_tinybar"} tops an account up.
+func adminCreditsHandler(w http.ResponseWriter, r *http.Request) {
+	l, ok := payments.(*creditLedger)
+	if !ok {
+		writeJSONError(w, ErrDisabled.With("prepaid credit is off (PAYMENT_BACKEND="+payments.Name()+")"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Account string `json:"account"`
+			Amount  int64  `json:"amount_tinybar"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, ErrBadRequest.With("invalid JSON: "+err.Error()))
+			return
+		}
+		account := parseBillingAccount(req.Account)
+		if account == "" || req.Amount == 0 {
+			writeJSONError(w, ErrBadRequest.With("account and a non-zero amount_tinybar are required"))
+			return
+		}
+		a := l.Credit(account, req.Amount)
+		if err := l.save(); err != nil {
+			writeJSONError(w, ErrInternal.Wrap(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"account": account, "balance": a})
+		return
+	default:
+		writeJSONError(w, ErrMethodNotAllowed)
+		return
+	}
+
+	l.mu.Lock()
+	type row struct {
+		Account string `json:"account"`
+		creditAccount
+	}
+	rows := make([]row, 0, len(l.accounts))
+	for account, a := range l.accounts {
+		rows = append(rows, row{Account: account, creditAccount: *a})
+	}
+	l.mu.Unlock()
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Account < rows[j].Account })
+	writeJSON(w, http.StatusOK, map[string]any{"accounts": rows})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Private deployments can restrict which marketplace buyers they serve.
+// BUYER_ACCESS_FILE lists buyers to allow and to deny, each by libp2p peer
+// ID, public key, EVM address or shared account (0.0.N):
+//
+//	{"allow": ["12D3KooW...", "0x52a..."], "deny": ["0.0.4711"]}
+//
+// A denied buyer is never served; with a non-empty allow list nobody else
+// is either. The check sits in front of every write to a buyer stream, and
+// the stream loop drops the SDK's buffer of any buyer it refuses, so a
+// refused buyer gets nothing and has to send a new service request once it
+// is let in. The file is re-read when it changes (checked every
+// BUYER_ACCESS_RELOAD_SECONDS); a file that fails to parse is logged and
+// the previous lists stay in force. Buyers over HTTP (/poll, /stream) are
+// not covered: they have no peer ID or account to match.
+//
+// The key, EVM address and account in a service request are whatever the
+// buyer put there; they only count once the SDK has validated the buyer's
+// account. Until then a buyer matches by peer ID alone, so a deny entry
+// that is not a peer ID can't be dodged by claiming someone else's key,
+// and an allow entry that is not one admits nobody unvalidated.
+
+type buyerAccessDoc struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+type buyerAccessList struct {
+	path string
+
+	mu       sync.RWMutex
+	allow    map[string]bool
+	deny     map[string]bool
+	modTime  time.Time
+	size     int64
+	loadedAt time.Time
+	refused  map[string]bool // peers already logged as refused
+}
+
+// buyerAccess is nil when there is no BUYER_ACCESS_FILE; then every buyer
+// is served.
+var buyerAccess *buyerAccessList
+
+func loadBuyerAccess() {
+	path := getEnvOrDefault("BUYER_ACCESS_FILE", "buyer_access.json")
+	a := &buyerAccessList{path: path, refused: map[string]bool{}}
+	if _, err := a.reload(); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		log.Fatalf("buyer access: %v", err)
+	}
+	buyerAccess = a
+	log.Printf("Access    : %d allowed, %d denied buyer(s) from %s", len(a.allow), len(a.deny), path)
+
+	if every := parseEnvInt("BUYER_ACCESS_RELOAD_SECONDS", 10); every > 0 {
+		go a.watch(time.Duration(every) * time.Second)
+	}
+}
+
+// reload reads the file if it changed since the last read, reporting
+// whether it did.
+func (a *buyerAccessList) reload() (bool, error) {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return false, err
+	}
+	a.mu.RLock()
+	unchanged := fi.ModTime().Equal(a.modTime) && fi.Size() == a.size
+	a.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return false, err
+	}
+	var doc buyerAccessDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return false, fmt.Errorf("parse %s: %w", a.path, err)
+	}
+	allow, err := buyerAccessSet(doc.Allow)
+	if err != nil {
+		return false, fmt.Errorf("%s: allow: %w", a.path, err)
+	}
+	deny, err := buyerAccessSet(doc.Deny)
+	if err != nil {
+		return false, fmt.Errorf("%s: deny: %w", a.path, err)
+	}
+
+	a.mu.Lock()
+	a.allow, a.deny = allow, deny
+	a.modTime, a.size, a.loadedAt = fi.ModTime(), fi.Size(), time.Now().UTC()
+	a.refused = map[string]bool{}
+	a.mu.Unlock()
+	return true, nil
+}
+
+func (a *buyerAccessList) watch(every time.Duration) {
+	for range time.Tick(every) {
+		changed, err := a.reload()
+		switch {
+		case err != nil:
+			log.Printf("buyer access: keeping the previous lists: %v", err)
+		case changed:
+			st := a.Status()
+			log.Printf("buyer access: reloaded %s (%d allowed, %d denied)", a.path, st["allowed"], st["denied"])
+		}
+	}
+}
+
+// buyerAccessSet normalizes list entries so they compare equal to what
+// buyerAccessIDs derives from a buffer.
+func buyerAccessSet(entries []string) (map[string]bool, error) {
+	set := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		id, err := normalizeBuyerAccessID(e)
+		if err != nil {
+			return nil, err
+		}
+		set[id] = true
+	}
+	return set, nil
+}
+
+func normalizeBuyerAccessID(e string) (string, error) {
+	e = strings.TrimSpace(e)
+	if strings.HasPrefix(e, "0.0.") {
+		return e, nil
+	}
+	if raw := rawKey(e); raw != "" && isHex(raw) {
+		if len(raw) == 40 {
+			return normalizeEVM(raw), nil
+		}
+		return raw, nil
+	}
+	id, err := peer.Decode(e)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a peer ID, public key, EVM address or 0.0.N account", e)
+	}
+	return id.String(), nil
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// buyerAccessIDs is every identifier a buyer can be listed under: its peer
+// ID, and once its account is validated the identity it claims.
+func buyerAccessIDs(peerID peer.ID, info *commonlib.NodeBufferInfo) []string {
+	ids := []string{peerID.String()}
+	if !info.IsOtherSideValidAccount {
+		return ids
+	}
+	key, evm := buyerIdentity(info)
+	if key != "" {
+		ids = append(ids, key)
+	}
+	if evm != "" {
+		ids = append(ids, normalizeEVM(evm))
+	}
+	if acc := buyerSharedAccount(info); acc != "" {
+		ids = append(ids, acc)
+	}
+	return ids
+}
+
+var errBuyerRefused = errors.New("buyer refused by BUYER_ACCESS_FILE")
+
+// Admit reports whether the buyer behind peerID may be served.
+func (a *buyerAccessList) Admit(peerID peer.ID, info *commonlib.NodeBufferInfo) bool {
+	if a == nil {
+		return true
+	}
+	ids := buyerAccessIDs(peerID, info)
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	allowed := len(a.allow) == 0
+	for _, id := range ids {
+		if a.deny[id] {
+			return false
+		}
+		allowed = allowed || a.allow[id]
+	}
+	return allowed
+}
+
+// enforceBuyerAccess drops the buffers of buyers the lists refuse; it runs
+// on the stream loop goroutine, which owns the per-stream maps.
+func (s *neuronSeller) enforceBuyerAccess(p2pHost host.Host, buffers *commonlib.NodeBuffers) {
+	if buyerAccess == nil {
+		return
+	}
+	for peerID, info := range buffers.GetBufferMap() {
+		if buyerAccess.Admit(peerID, info) {
+			continue
+		}
+		p2pHost.Network().ClosePeer(peerID)
+		buffers.RemoveBuffer(peerID)
+		s.forgetPeer(peerID)
+
+		buyerAccess.mu.Lock()
+		logged := buyerAccess.refused[peerID.String()]
+		buyerAccess.refused[peerID.String()] = true
+		buyerAccess.mu.Unlock()
+		if !logged {
+			key, evm := buyerIdentity(info)
+			log.Printf("neuron-seller: refused buyer %s (key %.16s, account %s) per %s", peerID, key, evm, buyerAccess.path)
+		}
+	}
+}
+
+// Status is the access lists in force, for /status.
+func (a *buyerAccessList) Status() map[string]any {
+	if a == nil {
+		return nil
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return map[string]any{
+		"file":      a.path,
+		"allowed":   len(a.allow),
+		"denied":    len(a.deny),
+		"loaded_at": a.loadedAt,
+	}
+}
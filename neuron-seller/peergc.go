@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// The SDK keeps a NodeBuffers entry for every buyer that ever sent a
+// service request and keeps trying to reconnect to it, and the stream loop
+// keeps handshake, heartbeat and link state per stream on top. On a seller
+// that runs for months that is memory per historical buyer. Every
+// PEER_GC_STALE_MINUTES/6 the stream loop sweeps the buffers: a buyer that
+// is not connected, or is connected but neither paid nor sent a sample (no
+// trial or voucher), is stale from the first sweep that sees it so; one
+// still stale after PEER_GC_STALE_MINUTES is removed from the SDK's buffers
+// along with everything the shim keeps for it. A buyer that comes back
+// later starts over with a fresh service request.
+
+// sweepStalePeers runs on the stream loop goroutine, which owns the
+// per-stream maps it prunes.
+func (s *neuronSeller) sweepStalePeers(p2pHost host.Host, buffers *commonlib.NodeBuffers, now time.Time) {
+	bufferMap := buffers.GetBufferMap()
+	for peerID := range s.staleSince {
+		if _, ok := bufferMap[peerID]; !ok {
+			delete(s.staleSince, peerID) // the SDK dropped it itself
+		}
+	}
+
+	removedKeys := map[string]bool{}
+	for peerID, info := range bufferMap {
+		if !s.peerStale(peerID, info, now) {
+			delete(s.staleSince, peerID)
+			continue
+		}
+		since, ok := s.staleSince[peerID]
+		if !ok {
+			s.staleSince[peerID] = now
+			continue
+		}
+		if now.Sub(since) < s.cfg.StalePeerAfter {
+			continue
+		}
+
+		p2pHost.Network().ClosePeer(peerID)
+		buffers.RemoveBuffer(peerID)
+		s.forgetPeer(peerID)
+		delete(s.staleSince, peerID)
+		key, _ := buyerIdentity(info)
+		if key != "" {
+			removedKeys[key] = true
+		}
+		log.Printf("neuron-seller: dropped stale peer %s (%v, stale for %s)", peerID, info.LibP2PState, now.Sub(since).Round(time.Minute))
+	}
+
+	// Buyer-level controls go once the buyer has no streams left.
+	if len(removedKeys) == 0 {
+		return
+	}
+	for _, info := range buffers.GetBufferMap() {
+		key, _ := buyerIdentity(info)
+		delete(removedKeys, key)
+	}
+	for key := range removedKeys {
+		controls.forget(key)
+	}
+}
+
+// peerStale reports whether peerID is neither connected and paid nor sent
+// anything within StalePeerAfter.
+func (s *neuronSeller) peerStale(peerID peer.ID, info *commonlib.NodeBufferInfo, now time.Time) bool {
+	if info.LibP2PState != types.Connected {
+		return true
+	}
+	if buyerPaid(info) {
+		return false
+	}
+	for key, sent := range s.lastSent {
+		if strings.HasPrefix(key, string(peerID)) && now.Sub(sent) < s.cfg.StalePeerAfter {
+			return false
+		}
+	}
+	return true
+}
+
+// forgetPeer drops the stream loop's state for every stream of peerID.
+func (s *neuronSeller) forgetPeer(peerID peer.ID) {
+	prefix := string(peerID)
+	s.forgetGreetings(peerID)
+	for key := range s.lastSent {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.lastSent, key)
+		}
+	}
+	for key := range s.batches {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.batches, key)
+		}
+	}
+	delete(s.linkNotice, peerID.String())
+	links.Forget(peerID.String())
+	writeErrors.Forget(peerID.String())
+}
+
+// forgetGreetings makes every stream of peerID get its handshake frames
+// again, for a buyer that lost its connection and may come back on a new
+// stream.
+func (s *neuronSeller) forgetGreetings(peerID peer.ID) {
+	prefix := string(peerID)
+	for key := range s.greeted {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.greeted, key)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Each reading becomes a sample by passing through a chain of stages:
+//
+//   - calibrate: the kind's unit conversion, raw reading to value
+//   - validate:  drops NaN and infinite values
+//   - anomaly:   drops values outside the kind's valid range (feeds the
+//     "anomalies" health component)
+//   - filter:    drops samples failing SAMPLE_FILTER or <KIND>_FILTER
+//   - sound:     aggregates dBA kinds over their window
+//   - event:     lets event kinds through only on a change
+//   - delta:     drops unchanged values while delta mode is on
+//   - enrich:    numbers the sample and fills in its payload (location,
+//     weather, uncertainty, tags, ...)
+//   - derive:    adds DERIVED_FIELDS to the payload
+//   - encode:    encodes the payload as JSON
+//   - sign:      signs it (when a signing key is loaded)
+//
+// SAMPLE_PIPELINE lists the stages to run, in order; a stage left out is
+// off. enrich, encode and sign can't be left out, enrich comes before
+// encode and sign comes last. Stages between encode and sign work on the
+// JSON payload (WASM transforms). Other code in this package can add
+// stages of its own with RegisterSampleStage from an init function; they
+// run where SAMPLE_PIPELINE names them, or just before enrich when it
+// isn't set.
+
+// pipelineSample is one sample on its way through the pipeline. Stages
+// before enrich see Raw and Value; enrich fills in Seq, ID, Payload and
+// Ts, encode Data.
+type pipelineSample struct {
+	Tick      time.Time
+	Kind      sensorKind
+	KindIndex int
+	Metrics   *piMetrics
+	Raw       float64
+	Value     float64
+
+	Seq     uint64
+	ID      string
+	Payload *samplePayload
+	Data    []byte
+	Ts      int64
+
+	seller *neuronSeller
+}
+
+// SampleStage is one step of the sample pipeline. Process works on smp in
+// place and returns false to drop it; an error drops it with a log line.
+// Stages run on the stream loop's goroutine, one sample at a time.
+type SampleStage interface {
+	Name() string
+	Process(smp *pipelineSample) (bool, error)
+}
+
+type stageFunc struct {
+	name string
+	fn   func(smp *pipelineSample) (bool, error)
+}
+
+func (f stageFunc) Name() string                              { return f.name }
+func (f stageFunc) Process(smp *pipelineSample) (bool, error) { return f.fn(smp) }
+
+var defaultPipeline = []string{"calibrate", "validate", "anomaly", "filter", "sound", "event", "delta", "enrich", "derive", "encode", "sign"}
+
+// customStage is a stage added from outside this file; payload stages
+// work on the encoded payload.
+type customStage struct {
+	SampleStage
+	payload bool
+}
+
+var (
+	stagesMu     sync.Mutex
+	customStages []customStage
+)
+
+// RegisterSampleStage adds a stage for SAMPLE_PIPELINE to name. Call it
+// from an init function.
+func RegisterSampleStage(st SampleStage) {
+	stagesMu.Lock()
+	defer stagesMu.Unlock()
+	customStages = append(customStages, customStage{SampleStage: st})
+}
+
+// registerPayloadStage adds a stage that works on the encoded payload, by
+// default just before sign.
+func registerPayloadStage(st SampleStage) {
+	stagesMu.Lock()
+	defer stagesMu.Unlock()
+	customStages = append(customStages, customStage{SampleStage: st, payload: true})
+}
+
+type pipelineStage struct {
+	SampleStage
+	dropped atomic.Int64
+	errors  atomic.Int64
+}
+
+type sampleChain struct {
+	stages []*pipelineStage
+}
+
+var samplePipeline *sampleChain
+
+func builtinStages() []SampleStage {
+	return []SampleStage{
+		stageFunc{"calibrate", func(smp *pipelineSample) (bool, error) {
+			smp.Value = smp.Kind.Conversion.Apply(smp.Raw)
+			return true, nil
+		}},
+		stageFunc{"validate", func(smp *pipelineSample) (bool, error) {
+			if math.IsNaN(smp.Value) || math.IsInf(smp.Value, 0) {
+				log.Printf("neuron-seller: %s reading %v is not a number, not sent", smp.Kind.Name, smp.Value)
+				return false, nil
+			}
+			return true, nil
+		}},
+		stageFunc{"anomaly", func(smp *pipelineSample) (bool, error) {
+			inRange := smp.Kind.InRange(smp.Value)
+			nodeHealth.Observe(healthAnomalies, inRange)
+			if !inRange {
+				log.Printf("neuron-seller: %s reading %v %s outside its valid range, not sent", smp.Kind.Name, smp.Value, smp.Kind.Conversion.To)
+				return false, nil
+			}
+			return true, nil
+		}},
+		stageFunc{"filter", filterSample},
+		stageFunc{"sound", func(smp *pipelineSample) (bool, error) {
+			if smp.Kind.Conversion.To != unitDBA {
+				return true, nil
+			}
+			var ok bool
+			smp.Value, ok = aggregateSoundLevel(smp.Kind, smp.Value, smp.Metrics.Values, smp.Tick)
+			return ok, nil
+		}},
+		stageFunc{"event", func(smp *pipelineSample) (bool, error) {
+			return !smp.Kind.Event || detectEvent(smp.Kind, smp.Value, smp.Tick), nil
+		}},
+		stageFunc{"delta", func(smp *pipelineSample) (bool, error) {
+			if !features.Enabled(flagDeltaMode) || smp.Kind.Event {
+				return true, nil
+			}
+			return smp.seller.deltaChanged(smp.Kind.Name, smp.Value), nil
+		}},
+		stageFunc{"enrich", func(smp *pipelineSample) (bool, error) {
+			smp.Seq = sequencer.Next(smp.Kind.Name)
+			smp.ID = newSampleID(time.Now())
+			payload, ts, err := newSamplePayload(smp.Tick, smp.Kind, smp.ID, smp.Seq, smp.Value, smp.Metrics)
+			if err != nil {
+				return false, err
+			}
+			smp.Payload, smp.Ts = &payload, ts
+			return true, nil
+		}},
+		stageFunc{"derive", deriveFields},
+		stageFunc{"encode", func(smp *pipelineSample) (bool, error) {
+			data, err := encodePayload(smp.Payload)
+			if err != nil {
+				return false, fmt.Errorf("marshal payload: %w", err)
+			}
+			smp.Data = data
+			return true, nil
+		}},
+		stageFunc{"sign", func(smp *pipelineSample) (bool, error) {
+			if signer != nil {
+				smp.Data = signer.Sign(smp.Data)
+			}
+			return true, nil
+		}},
+	}
+}
+
+func loadPipeline() {
+	byName := map[string]SampleStage{}
+	for _, st := range builtinStages() {
+		byName[st.Name()] = st
+	}
+	stagesMu.Lock()
+	custom := slices.Clone(customStages)
+	stagesMu.Unlock()
+	for _, st := range custom {
+		if _, dup := byName[st.Name()]; dup || st.Name() == "" {
+			log.Fatalf("pipeline: stage name %q is taken", st.Name())
+		}
+		byName[st.Name()] = st.SampleStage
+	}
+
+	names := defaultPipeline
+	if v := getEnvOrDefault("SAMPLE_PIPELINE", ""); v != "" {
+		names = nil
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	} else if len(custom) > 0 {
+		names = slices.Clone(defaultPipeline)
+		for _, st := range custom {
+			before := "enrich"
+			if st.payload {
+				before = "sign"
+			}
+			names = slices.Insert(names, slices.Index(names, before), st.Name())
+		}
+	}
+
+	chain := &sampleChain{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		st, ok := byName[name]
+		if !ok {
+			log.Fatalf("pipeline: SAMPLE_PIPELINE: unknown stage %q", name)
+		}
+		if seen[name] {
+			log.Fatalf("pipeline: SAMPLE_PIPELINE: stage %q listed twice", name)
+		}
+		seen[name] = true
+		chain.stages = append(chain.stages, &pipelineStage{SampleStage: st})
+	}
+	enrich, encode, sign := slices.Index(names, "enrich"), slices.Index(names, "encode"), slices.Index(names, "sign")
+	if enrich < 0 || encode < enrich || sign != len(names)-1 {
+		log.Fatalf("pipeline: SAMPLE_PIPELINE must have enrich before encode and end with sign")
+	}
+	samplePipeline = chain
+	if !slices.Equal(names, defaultPipeline) {
+		log.Printf("Pipeline  : %s", strings.Join(names, ", "))
+	}
+}
+
+// Run passes smp through every stage, reporting whether it came out the
+// other end.
+func (c *sampleChain) Run(smp *pipelineSample) bool {
+	for _, st := range c.stages {
+		ok, err := st.Process(smp)
+		if err != nil {
+			st.errors.Add(1)
+			log.Printf("neuron-seller: %s stage: %v", st.Name(), err)
+			return false
+		}
+		if !ok {
+			st.dropped.Add(1)
+			return false
+		}
+	}
+	return true
+}
+
+// Names lists the stages in order.
+func (c *sampleChain) Names() []string {
+	if c == nil {
+		return nil
+	}
+	names := make([]string, len(c.stages))
+	for i, st := range c.stages {
+		names[i] = st.Name()
+	}
+	return names
+}
+
+func writePipelineMetrics(w http.ResponseWriter) {
+	if samplePipeline == nil {
+		return
+	}
+	fmt.Fprintln(w, "# HELP localsense_pipeline_dropped_total Samples a pipeline stage dropped.")
+	fmt.Fprintln(w, "# TYPE localsense_pipeline_dropped_total counter")
+	for _, st := range samplePipeline.stages {
+		fmt.Fprintf(w, "localsense_pipeline_dropped_total{stage=%q} %d\n", st.Name(), st.dropped.Load())
+	}
+	fmt.Fprintln(w, "# HELP localsense_pipeline_errors_total Samples a pipeline stage failed on.")
+	fmt.Fprintln(w, "# TYPE localsense_pipeline_errors_total counter")
+	for _, st := range samplePipeline.stages {
+		fmt.Fprintf(w, "localsense_pipeline_errors_total{stage=%q} %d\n", st.Name(), st.errors.Load())
+	}
+}
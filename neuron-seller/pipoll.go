@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Polling /metrics every tick sends the Pi's reading again whenever it
+// hasn't changed since the last poll (a slow sensor, a stalled camera
+// job). The sampling engine (see sampler.go), which polls the Pi for every
+// surface, remembers the ETag and Last-Modified of the last reading it got
+// and sends them back, so a Pi that supports conditional requests answers
+// 304; failing that, a reading with the same ts as the previous one is
+// dropped. Either way nothing is sampled for that round and the
+// suppression is counted on /metrics. PI_DEDUP=false samples every poll as
+// before.
+
+// errPiUnchanged means the Pi has no reading newer than the last one.
+var errPiUnchanged = errors.New("Pi reading unchanged")
+
+var (
+	piDedup = true
+
+	piNotModified atomic.Int64
+	piSameTs      atomic.Int64
+)
+
+func loadPiPolling() {
+	piDedup = parseEnvBool("PI_DEDUP", true)
+}
+
+// piPoller fetches Pi metrics for the sampling engine.
+type piPoller struct {
+	etag         string
+	lastModified string
+	lastTs       float64
+}
+
+// Fetch returns the current Pi metrics: a camera reading with a camera
+// source, the latest pushed document while the Pi subscription is live,
+// else a poll of /metrics. It returns errPiUnchanged for a reading the
+// poller has already had.
+func (p *piPoller) Fetch() (*piMetrics, error) {
+	if camera != nil {
+		m, err := camera.Capture()
+		if err != nil {
+			return nil, err
+		}
+		return p.fresh(m)
+	}
+	if m := piFeed.Latest(); m != nil {
+		return p.fresh(m)
+	}
+	if sellerCfg.PiBase == "" {
+		return nil, fmt.Errorf("PI_BASE_URL is not configured")
+	}
+	url := sellerCfg.PiBase + "/metrics"
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if piDedup {
+		if p.etag != "" {
+			req.Header.Set("If-None-Match", p.etag)
+		}
+		if p.lastModified != "" {
+			req.Header.Set("If-Modified-Since", p.lastModified)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		piNotModified.Add(1)
+		return nil, errPiUnchanged
+	default:
+		return nil, fmt.Errorf("GET %s: status %s", url, resp.Status)
+	}
+	var raw map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", url, err)
+	}
+	p.etag = resp.Header.Get("ETag")
+	p.lastModified = resp.Header.Get("Last-Modified")
+	return p.fresh(piMetricsFromDoc(raw))
+}
+
+// fresh drops a reading whose ts repeats the previous one.
+func (p *piPoller) fresh(m *piMetrics) (*piMetrics, error) {
+	if piDedup && m.Ts > 0 && m.Ts == p.lastTs {
+		piSameTs.Add(1)
+		return nil, errPiUnchanged
+	}
+	p.lastTs = m.Ts
+	return m, nil
+}
+
+func writePiPollMetrics(w http.ResponseWriter) {
+	fmt.Fprintln(w, "# HELP localsense_pi_duplicates_suppressed_total Pi readings not sampled because they repeated the last one, by how it was detected.")
+	fmt.Fprintln(w, "# TYPE localsense_pi_duplicates_suppressed_total counter")
+	fmt.Fprintf(w, "localsense_pi_duplicates_suppressed_total{reason=%q} %d\n", "not_modified", piNotModified.Load())
+	fmt.Fprintf(w, "localsense_pi_duplicates_suppressed_total{reason=%q} %d\n", "same_ts", piSameTs.Load())
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// With PI_SUBSCRIBE_PATH set, the shim subscribes to a streaming endpoint
+// on the Pi instead of polling /metrics every tick. The path is joined to
+// PI_BASE_URL, or used as is when it is a full http(s):// or ws(s):// URL.
+// An HTTP endpoint may answer with Server-Sent Events (text/event-stream,
+// one JSON document per event) or NDJSON (one per line); a ws(s):// URL is
+// read as a WebSocket with one JSON document per message. Each document is
+// sampled as it arrives, so sample latency is the Pi's, not the ticker's.
+//
+// The subscription counts as live from its first document until the
+// connection drops or stays silent for PI_SUBSCRIBE_IDLE_SECONDS. While it
+// isn't live the stream loop polls /metrics as before, and the subscriber
+// reconnects with backoff up to PI_SUBSCRIBE_RETRY_SECONDS.
+
+type piSubscription struct {
+	url      string
+	idle     time.Duration
+	maxRetry time.Duration
+
+	updates chan *piMetrics
+	live    atomic.Bool
+	latest  atomic.Pointer[piMetrics]
+}
+
+var piFeed *piSubscription
+
+func loadPiSubscription() {
+	path := getEnvOrDefault("PI_SUBSCRIBE_PATH", "")
+	if path == "" {
+		return
+	}
+	url := path
+	if !strings.Contains(path, "://") {
+		url = strings.TrimRight(sellerCfg.PiBase, "/") + "/" + strings.TrimLeft(path, "/")
+	}
+	piFeed = &piSubscription{
+		url:      url,
+		idle:     time.Duration(max(parseEnvInt("PI_SUBSCRIBE_IDLE_SECONDS", 30), 1)) * time.Second,
+		maxRetry: time.Duration(max(parseEnvInt("PI_SUBSCRIBE_RETRY_SECONDS", 30), 1)) * time.Second,
+		updates:  make(chan *piMetrics, 1),
+	}
+	go piFeed.run()
+	log.Printf("PiFeed    : subscribing to %s, polling while it is down", url)
+}
+
+// Live reports whether pushed metrics are arriving; false for a nil feed.
+func (f *piSubscription) Live() bool {
+	return f != nil && f.live.Load()
+}
+
+// Updates delivers pushed metrics, newest only if the reader falls behind.
+// A nil feed's channel never delivers.
+func (f *piSubscription) Updates() <-chan *piMetrics {
+	if f == nil {
+		return nil
+	}
+	return f.updates
+}
+
+// Latest is the last pushed document while the feed is live, else nil.
+func (f *piSubscription) Latest() *piMetrics {
+	if !f.Live() {
+		return nil
+	}
+	return f.latest.Load()
+}
+
+func (f *piSubscription) run() {
+	backoff := time.Second
+	for {
+		got, err := f.subscribe()
+		if f.live.Swap(false) {
+			log.Printf("pi feed: subscription lost (%v), polling /metrics", err)
+		} else {
+			log.Printf("pi feed: subscribe %s: %v", f.url, err)
+		}
+		if got {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, f.maxRetry)
+	}
+}
+
+// subscribe reads one connection until it fails and reports whether any
+// document came through.
+func (f *piSubscription) subscribe() (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Closing the connection is the only way out of a silent read.
+	watchdog := time.AfterFunc(f.idle, cancel)
+	defer watchdog.Stop()
+
+	got := false
+	deliver := func(doc []byte) {
+		var raw map[string]any
+		if err := json.Unmarshal(doc, &raw); err != nil {
+			log.Printf("pi feed: skipping undecodable document: %v", err)
+			return
+		}
+		watchdog.Reset(f.idle)
+		f.push(piMetricsFromDoc(raw))
+		got = true
+	}
+
+	var err error
+	if strings.HasPrefix(f.url, "ws://") || strings.HasPrefix(f.url, "wss://") {
+		err = f.readWebSocket(ctx, deliver)
+	} else {
+		err = f.readHTTP(ctx, deliver)
+	}
+	if ctx.Err() != nil && !errors.Is(err, errPiFeedClosed) {
+		err = fmt.Errorf("no document for %s", f.idle)
+	}
+	return got, err
+}
+
+var errPiFeedClosed = errors.New("stream closed by the Pi")
+
+func (f *piSubscription) push(m *piMetrics) {
+	f.latest.Store(m)
+	if !f.live.Swap(true) {
+		log.Printf("pi feed: receiving pushed metrics from %s", f.url)
+	}
+	for {
+		select {
+		case f.updates <- m:
+			return
+		default:
+		}
+		// Drop the unread document for the newer one.
+		select {
+		case <-f.updates:
+		default:
+		}
+	}
+}
+
+func (f *piSubscription) readHTTP(ctx context.Context, deliver func([]byte)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream, application/x-ndjson")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 0, 4096), 1<<20)
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" {
+		readSSE(sc, deliver)
+	} else {
+		for sc.Scan() {
+			if line := bytes.TrimSpace(sc.Bytes()); len(line) > 0 {
+				deliver(line)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return errPiFeedClosed
+}
+
+// readSSE delivers the data of each event; multi-line data is joined with
+// newlines as the spec says, and event names, ids and comments are ignored.
+func readSSE(sc *bufio.Scanner, deliver func([]byte)) {
+	var data []byte
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) == 0 {
+			if len(data) > 0 {
+				deliver(data)
+				data = data[:0]
+			}
+			continue
+		}
+		field, value, _ := bytes.Cut(line, []byte(":"))
+		if string(field) != "data" {
+			continue
+		}
+		value = bytes.TrimPrefix(value, []byte(" "))
+		if len(data) > 0 {
+			data = append(data, '\n')
+		}
+		data = append(data, value...)
+	}
+}
+
+func (f *piSubscription) readWebSocket(ctx context.Context, deliver func([]byte)) error {
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, f.url, nil)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("%w (status %s)", err, resp.Status)
+		}
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return errPiFeedClosed
+			}
+			return err
+		}
+		deliver(msg)
+	}
+}
+
+// piFeedStatus is the subscription's state for /status, nil when disabled.
+func piFeedStatus() map[string]any {
+	if piFeed == nil {
+		return nil
+	}
+	return map[string]any{"url": piFeed.url, "live": piFeed.Live()}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sources, sinks and transforms can be added without rebuilding the node:
+// each plugin is a program run as a subprocess that speaks newline
+// delimited JSON on its stdin and stdout. PLUGINS_DIR holds one directory
+// per plugin with a plugin.json manifest:
+//
+//	{"name": "scale", "type": "transform", "command": ["./scale"],
+//	 "env": {"FACTOR": "2"}, "timeout_ms": 200, "on_error": "pass"}
+//
+//   - source: every line the plugin writes is a metrics document
+//     ({"field": number, ...}) sampled like one pushed by the Pi.
+//   - sink: gets every sample sent, one {"kind","id","seq","ts","value",
+//     "payload"} line each.
+//   - transform: a pipeline stage named plugin:<name>. It gets
+//     {"id","kind","field","raw","value","ts"} and answers {"id","value"},
+//     {"id","drop":true} or {"id","error"}; ts is the tick's Unix time.
+//
+// A plugin runs in its own directory with only PATH, HOME and its manifest
+// env set. Its failures stay its own: a plugin that exits is restarted
+// with a growing backoff, its stderr is logged, and a transform that
+// errors or misses timeout_ms leaves the sample as it was (on_error "pass")
+// or drops it ("drop"). After pluginTripAfter failures in a row a
+// transform is bypassed for pluginTripFor and its process restarted.
+
+const (
+	pluginTripAfter  = 5
+	pluginTripFor    = time.Minute
+	pluginMaxBackoff = 5 * time.Minute
+)
+
+type pluginManifest struct {
+	Name      string            `json:"name"`
+	Type      string            `json:"type"` // source, sink or transform
+	Command   []string          `json:"command"`
+	Env       map[string]string `json:"env,omitempty"`
+	TimeoutMS int               `json:"timeout_ms,omitempty"`
+	OnError   string            `json:"on_error,omitempty"` // pass or drop
+}
+
+type pluginReply struct {
+	ID    uint64   `json:"id"`
+	Value *float64 `json:"value,omitempty"`
+	Drop  bool     `json:"drop,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+type plugin struct {
+	pluginManifest
+	dir     string
+	timeout time.Duration
+
+	mu        sync.Mutex
+	stdin     *os.File
+	proc      *os.Process
+	running   bool
+	restarts  int
+	failures  int // in a row
+	trippedTo time.Time
+	lastErr   string
+	calls     uint64
+	errors    uint64
+	nextID    uint64
+
+	replies chan pluginReply
+}
+
+var (
+	plugins       []*plugin
+	pluginSources = make(chan *piMetrics, 4)
+)
+
+func loadPlugins() {
+	dir := getEnvOrDefault("PLUGINS_DIR", "")
+	if dir == "" {
+		return
+	}
+	manifests, err := filepath.Glob(filepath.Join(dir, "*", "plugin.json"))
+	if err != nil {
+		log.Fatalf("plugins: %v", err)
+	}
+	sort.Strings(manifests)
+	names := map[string]bool{}
+	for _, path := range manifests {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("plugins: %v", err)
+		}
+		var m pluginManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			log.Fatalf("plugins: %s: %v", path, err)
+		}
+		if err := m.validate(); err != nil {
+			log.Fatalf("plugins: %s: %v", path, err)
+		}
+		if names[m.Name] {
+			log.Fatalf("plugins: %s: name %q is taken", path, m.Name)
+		}
+		names[m.Name] = true
+		p := &plugin{
+			pluginManifest: m,
+			dir:            filepath.Dir(path),
+			timeout:        time.Duration(max(m.TimeoutMS, 1)) * time.Millisecond,
+			replies:        make(chan pluginReply, 1),
+		}
+		if m.TimeoutMS == 0 {
+			p.timeout = 200 * time.Millisecond
+		}
+		plugins = append(plugins, p)
+		if m.Type == "transform" {
+			RegisterSampleStage(pluginStage{p})
+		}
+		go p.supervise()
+		log.Printf("Plugin    : %s (%s) from %s", m.Name, m.Type, p.dir)
+	}
+}
+
+func (m pluginManifest) validate() error {
+	if m.Name == "" || strings.ContainsAny(m.Name, " ,") {
+		return fmt.Errorf("name must be set and have no spaces or commas")
+	}
+	switch m.Type {
+	case "source", "sink", "transform":
+	default:
+		return fmt.Errorf("type must be source, sink or transform, got %q", m.Type)
+	}
+	if len(m.Command) == 0 {
+		return fmt.Errorf("command must be set")
+	}
+	switch m.OnError {
+	case "", "pass", "drop":
+	default:
+		return fmt.Errorf("on_error must be pass or drop, got %q", m.OnError)
+	}
+	return nil
+}
+
+// supervise runs the plugin, restarting it whenever it exits.
+func (p *plugin) supervise() {
+	var sink *busSub[busSample]
+	if p.Type == "sink" {
+		sink = sampleBus.Subscribe("plugin "+p.Name, 64)
+		go p.feedSink(sink)
+	}
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := p.run()
+		p.mu.Lock()
+		p.running, p.stdin, p.proc = false, nil, nil
+		p.restarts++
+		if err != nil {
+			p.lastErr = err.Error()
+		}
+		p.mu.Unlock()
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("plugin %s: exited (%v); restarting in %s", p.Name, err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, pluginMaxBackoff)
+	}
+}
+
+func (p *plugin) run() error {
+	cmd := exec.Command(p.Command[0], p.Command[1:]...)
+	cmd.Dir = p.dir
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "HOME=" + p.dir, "LOCALSENSE_PLUGIN=" + p.Name}
+	for k, v := range p.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	// A pipe of our own rather than StdinPipe, for write deadlines: a
+	// plugin that stops reading mustn't stall the stream loop.
+	stdinR, stdin, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer stdin.Close()
+	cmd.Stdin = stdinR
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	stdinR.Close()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.running, p.stdin, p.proc = true, stdin, cmd.Process
+	p.mu.Unlock()
+
+	go func() {
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			log.Printf("plugin %s: %s", p.Name, sc.Text())
+		}
+	}()
+	sc := bufio.NewScanner(stdout)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		p.handleLine(sc.Bytes())
+	}
+	return cmd.Wait()
+}
+
+// handleLine takes one line the plugin wrote.
+func (p *plugin) handleLine(line []byte) {
+	switch p.Type {
+	case "source":
+		var doc map[string]any
+		if err := json.Unmarshal(line, &doc); err != nil {
+			p.fail(fmt.Errorf("bad metrics line: %w", err))
+			return
+		}
+		select {
+		case pluginSources <- piMetricsFromDoc(doc):
+		default:
+		}
+	case "transform":
+		var reply pluginReply
+		if err := json.Unmarshal(line, &reply); err != nil {
+			p.fail(fmt.Errorf("bad reply: %w", err))
+			return
+		}
+		select {
+		case p.replies <- reply:
+		default:
+		}
+	default:
+		log.Printf("plugin %s: %s", p.Name, line)
+	}
+}
+
+func (p *plugin) feedSink(sub *busSub[busSample]) {
+	for smp := range sub.C() {
+		line := map[string]any{"kind": smp.Kind, "id": smp.ID, "seq": smp.Seq, "ts": smp.Ts, "value": smp.Value}
+		if json.Valid(smp.Payload) {
+			line["payload"] = json.RawMessage(smp.Payload)
+		}
+		if err := p.write(line); err != nil {
+			p.fail(err)
+			continue
+		}
+		freshness.Delivered(freshPlugin, smp.Ts, time.Now())
+	}
+}
+
+// write sends one JSON line to the plugin.
+func (p *plugin) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	stdin := p.stdin
+	p.mu.Unlock()
+	if stdin == nil {
+		return errors.New("not running")
+	}
+	stdin.SetWriteDeadline(time.Now().Add(p.timeout))
+	_, err = stdin.Write(append(data, '\n'))
+	return err
+}
+
+// fail records a failure; enough in a row trips a transform and restarts
+// its process.
+func (p *plugin) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.errors++
+	p.failures++
+	p.lastErr = err.Error()
+	if p.Type == "transform" && p.failures >= pluginTripAfter {
+		p.failures = 0
+		p.trippedTo = time.Now().Add(pluginTripFor)
+		log.Printf("plugin %s: %d failures in a row (%v), bypassed for %s", p.Name, pluginTripAfter, err, pluginTripFor)
+		if p.proc != nil {
+			p.proc.Kill()
+		}
+	}
+}
+
+// pluginStage is a transform plugin as a pipeline stage.
+type pluginStage struct{ p *plugin }
+
+func (st pluginStage) Name() string                              { return "plugin:" + st.p.Name }
+func (st pluginStage) Process(smp *pipelineSample) (bool, error) { return st.p.transform(smp) }
+
+// transform asks the plugin for the sample's new value.
+func (p *plugin) transform(smp *pipelineSample) (bool, error) {
+	p.mu.Lock()
+	bypass := !p.running || time.Now().Before(p.trippedTo)
+	p.nextID++
+	id := p.nextID
+	p.calls++
+	p.mu.Unlock()
+	if bypass {
+		return p.onError(nil)
+	}
+	// Forget a reply that came in after its call timed out.
+	select {
+	case <-p.replies:
+	default:
+	}
+	req := map[string]any{"id": id, "kind": smp.Kind.Name, "field": smp.Kind.Field, "raw": smp.Raw, "value": smp.Value, "ts": smp.Tick.Unix()}
+	if err := p.write(req); err != nil {
+		p.fail(err)
+		return p.onError(err)
+	}
+	timeout := time.NewTimer(p.timeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case reply := <-p.replies:
+			if reply.ID != id {
+				continue
+			}
+			switch {
+			case reply.Error != "":
+				err := errors.New(reply.Error)
+				p.fail(err)
+				return p.onError(err)
+			case reply.Drop:
+				p.ok()
+				return false, nil
+			case reply.Value != nil:
+				p.ok()
+				smp.Value = *reply.Value
+				return true, nil
+			}
+			p.ok()
+			return true, nil
+		case <-timeout.C:
+			err := fmt.Errorf("no reply within %s", p.timeout)
+			p.fail(err)
+			return p.onError(err)
+		}
+	}
+}
+
+func (p *plugin) ok() {
+	p.mu.Lock()
+	p.failures = 0
+	p.mu.Unlock()
+}
+
+// onError applies on_error: the sample goes on unchanged, or is dropped.
+func (p *plugin) onError(err error) (bool, error) {
+	if p.OnError == "drop" {
+		if err != nil {
+			log.Printf("plugin %s: %v, sample dropped", p.Name, err)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// Status is the plugin's state for /admin/plugins.
+func (p *plugin) Status() map[string]any {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := map[string]any{
+		"name":     p.Name,
+		"type":     p.Type,
+		"dir":      p.dir,
+		"running":  p.running,
+		"restarts": p.restarts,
+		"calls":    p.calls,
+		"errors":   p.errors,
+	}
+	if time.Now().Before(p.trippedTo) {
+		out["bypassed_until"] = p.trippedTo.UTC().Format(time.RFC3339)
+	}
+	if p.lastErr != "" {
+		out["last_error"] = p.lastErr
+	}
+	return out
+}
+
+func adminPluginsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, ErrMethodNotAllowed)
+		return
+	}
+	out := make([]map[string]any, 0, len(plugins))
+	for _, p := range plugins {
+		out = append(out, p.Status())
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"plugins": out})
+}
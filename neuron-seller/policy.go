@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The command policy decides which verified issuers may run which command
+// types. It maps principals (a public key and/or account) to roles and roles
+// to command types; COMMAND_POLICY_FILE overrides the defaults below. Keys in
+// COMMAND_ISSUERS always hold the operator role, and buyers with a live
+// stream get connected_buyer_roles unless they are listed explicitly.
+// Commands listed under "public" (by default redeem_voucher, which carries
+// its own proof of entitlement) may be run by any verified signer. Every
+// decision goes to the audit log.
+//
+//	{
+//	  "roles": {"operator": ["*"], "buyer": ["pause", "resume"]},
+//	  "principals": [{"name": "acme", "account": "0x52a...", "roles": ["buyer"]}],
+//	  "connected_buyer_roles": []
+//	}
+//
+// A principal with only an account matches connected buyers whose service
+// request carries that EVM address.
+
+type policyPrincipal struct {
+	Name    string   `json:"name,omitempty"`
+	Key     string   `json:"key,omitempty"`     // hex public key
+	Account string   `json:"account,omitempty"` // Hedera account ID or EVM address
+	Roles   []string `json:"roles"`
+}
+
+type policyDoc struct {
+	Roles               map[string][]string `json:"roles"` // role -> command types, "*" for all
+	Principals          []policyPrincipal   `json:"principals"`
+	ConnectedBuyerRoles []string            `json:"connected_buyer_roles"`
+	Public              []string            `json:"public"` // command types open to any verified signer
+}
+
+const roleOperator = "operator"
+
+func defaultPolicyDoc() policyDoc {
+	return policyDoc{
+		Roles: map[string][]string{
+			roleOperator: {"*"},
+			"buyer":      {"ping", "pause", "resume", "set_interval", "history", "backfill", "canary_result"},
+		},
+		ConnectedBuyerRoles: []string{"buyer"},
+		Public:              []string{"redeem_voucher"},
+	}
+}
+
+type policyDecision struct {
+	Time      time.Time `json:"time"`
+	Command   string    `json:"command"`
+	Nonce     string    `json:"nonce"`
+	Issuer    string    `json:"issuer"`
+	Account   string    `json:"account,omitempty"`
+	Principal string    `json:"principal,omitempty"`
+	Roles     []string  `json:"roles,omitempty"`
+	Allowed   bool      `json:"allowed"`
+	Reason    string    `json:"reason"`
+}
+
+type commandPolicy struct {
+	mu    sync.RWMutex
+	doc   policyDoc
+	logMu sync.Mutex
+	logTo string
+}
+
+var policy = &commandPolicy{doc: defaultPolicyDoc()}
+
+func loadPolicy() {
+	path := getEnvOrDefault("COMMAND_POLICY_FILE", "policy.json")
+	doc := defaultPolicyDoc()
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		log.Fatalf("policy: read %s: %v", path, err)
+	default:
+		if err := json.Unmarshal(data, &doc); err != nil {
+			log.Fatalf("policy: parse %s: %v", path, err)
+		}
+		if err := doc.validate(); err != nil {
+			log.Fatalf("policy: %s: %v", path, err)
+		}
+		log.Printf("Policy    : %s (%d roles, %d principals)", path, len(doc.Roles), len(doc.Principals))
+	}
+
+	policy.mu.Lock()
+	policy.doc = doc
+	policy.mu.Unlock()
+}
+
+func (d policyDoc) validate() error {
+	for i, p := range d.Principals {
+		if p.Key == "" && p.Account == "" {
+			return fmt.Errorf("principal %d needs a key or an account", i)
+		}
+		for _, role := range p.Roles {
+			if _, ok := d.Roles[role]; !ok {
+				return fmt.Errorf("principal %d has undefined role %q", i, role)
+			}
+		}
+	}
+	for _, role := range d.ConnectedBuyerRoles {
+		if _, ok := d.Roles[role]; !ok {
+			return fmt.Errorf("connected_buyer_roles has undefined role %q", role)
+		}
+	}
+	return nil
+}
+
+// Hedera tooling often prints keys DER-encoded; strip the SubjectPublicKeyInfo
+// headers so they compare equal to raw keys.
+var derKeyPrefixes = []string{
+	"302a300506032b6570032100",     // ed25519
+	"302d300706052b8104000a032200", // compressed secp256k1
+}
+
+func rawKey(k string) string {
+	k = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(k), "0x"))
+	for _, prefix := range derKeyPrefixes {
+		k = strings.TrimPrefix(k, prefix)
+	}
+	return k
+}
+
+// roles resolves the roles of a verified issuer and the principal that
+// granted them.
+func (p *commandPolicy) roles(cmd commandEnvelope) ([]string, string) {
+	key := rawKey(cmd.Issuer)
+	var roles []string
+	var principal string
+	if commandCfg.Issuers[key] {
+		roles, principal = append(roles, roleOperator), "COMMAND_ISSUERS"
+	}
+
+	p.mu.RLock()
+	doc := p.doc
+	p.mu.RUnlock()
+
+	connected := connectedBuyerAccounts(key)
+	for _, pr := range doc.Principals {
+		if pr.Account != "" && cmd.Account != "" && !strings.EqualFold(pr.Account, cmd.Account) {
+			continue
+		}
+		switch {
+		case pr.Key != "" && rawKey(pr.Key) == key:
+		case pr.Key == "" && slices.ContainsFunc(connected, func(a string) bool { return strings.EqualFold(a, pr.Account) }):
+		default:
+			continue
+		}
+		roles = append(roles, pr.Roles...)
+		if principal == "" {
+			principal = pr.Name
+			if principal == "" {
+				principal = pr.Key + pr.Account
+			}
+		}
+	}
+	if len(roles) == 0 && len(connected) > 0 {
+		roles, principal = doc.ConnectedBuyerRoles, "connected-buyer"
+	}
+	return roles, principal
+}
+
+// Authorize decides whether cmd's issuer may run cmd.Type and logs the
+// decision. The signature must already have been verified.
+func (p *commandPolicy) Authorize(cmd commandEnvelope) policyDecision {
+	roles, principal := p.roles(cmd)
+	d := policyDecision{
+		Time:      time.Now().UTC(),
+		Command:   cmd.Type,
+		Nonce:     cmd.Nonce,
+		Issuer:    rawKey(cmd.Issuer),
+		Account:   cmd.Account,
+		Principal: principal,
+		Roles:     roles,
+	}
+
+	p.mu.RLock()
+	if slices.Contains(p.doc.Public, cmd.Type) {
+		d.Allowed, d.Reason = true, "public command"
+	}
+	for _, role := range roles {
+		for _, t := range p.doc.Roles[role] {
+			if t == "*" || t == cmd.Type {
+				d.Allowed, d.Reason = true, "role "+role
+			}
+		}
+	}
+	p.mu.RUnlock()
+	if !d.Allowed {
+		if len(roles) == 0 {
+			d.Reason = "issuer matches no principal and has no live stream"
+		} else {
+			d.Reason = fmt.Sprintf("roles %s do not allow %s", strings.Join(roles, ","), cmd.Type)
+		}
+	}
+
+	log.Printf("[policy] %s %s by %.16s (%s): allowed=%t %s", cmd.Type, cmd.Nonce, d.Issuer, principal, d.Allowed, d.Reason)
+	result := "denied"
+	if d.Allowed {
+		result = "allowed"
+	}
+	audit.Record("policy", d.Issuer, "authorize "+cmd.Type, result, d)
+	return d
+}
+
+// IsOperator reports whether cmd's issuer holds the operator role.
+func (p *commandPolicy) IsOperator(cmd commandEnvelope) bool {
+	roles, _ := p.roles(cmd)
+	return slices.Contains(roles, roleOperator)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// GET /poll is the long-polling fallback to /stream for clients behind
+// proxies that buffer streaming responses. The stream loop keeps the last
+// POLL_BUFFER_SIZE payloads of each kind in memory; a poll returns those
+// newer than since_seq straight away, or waits up to timeout seconds for the
+// next one.
+
+type polledSample struct {
+	Seq       uint64
+	Ts        int64
+	ExpiresAt int64
+	Payload   json.RawMessage
+}
+
+type pollBuffer struct {
+	mu       sync.Mutex
+	size     int
+	samples  map[string][]polledSample
+	notify   chan struct{} // closed and replaced on every Add
+	lastPoll time.Time
+}
+
+var polls *pollBuffer
+
+func loadPollBuffer() {
+	size := parseEnvInt("POLL_BUFFER_SIZE", 256)
+	if size < 1 {
+		size = 1
+	}
+	polls = &pollBuffer{size: size, samples: make(map[string][]polledSample), notify: make(chan struct{})}
+}
+
+// Add records a sample and wakes every waiting poll.
+func (p *pollBuffer) Add(kind string, s polledSample) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	buf := append(p.samples[kind], s)
+	if len(buf) > p.size {
+		buf = buf[len(buf)-p.size:]
+	}
+	p.samples[kind] = buf
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+// Since returns kind's buffered samples with seq > since, whether older
+// samples were already dropped from the buffer, and a channel that is closed
+// on the next Add.
+func (p *pollBuffer) Since(kind string, since uint64) (out []polledSample, truncated bool, wait <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastPoll = time.Now()
+	buf := p.samples[kind]
+	if since > 0 && len(buf) > 0 && since+1 < buf[0].Seq {
+		truncated = true
+	}
+	for _, s := range buf {
+		if s.Seq > since {
+			out = append(out, s)
+		}
+	}
+	return out, truncated, p.notify
+}
+
+// Active reports whether anyone polled recently, so the stream loop keeps
+// sampling for pollers when there are no P2P buyers.
+func (p *pollBuffer) Active(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return now.Sub(p.lastPoll) < 2*time.Minute
+}
+
+// GET /poll?since_seq=&kind=&timeout=&max_age= – samples of one kind newer
+// than since_seq; waits up to timeout seconds (POLL_MAX_WAIT_SECONDS cap)
+// when there are none yet. Samples are shown at the public privacy tier.
+func pollHandler(w http.ResponseWriter, r *http.Request) {
+	neuron, _ := getNeuronSellerConfig()
+	q := r.URL.Query()
+	kind := neuron.Kinds[0]
+	if name := q.Get("kind"); name != "" {
+		k, ok := neuron.kindByName(name)
+		if !ok {
+			writeJSONError(w, ErrNotFound.With("unknown kind "+strconv.Quote(name)))
+			return
+		}
+		kind = k
+	}
+
+	var since uint64
+	if s := q.Get("since_seq"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			writeJSONError(w, ErrBadRequest.With("invalid since_seq"))
+			return
+		}
+	}
+	maxWait := parseEnvInt("POLL_MAX_WAIT_SECONDS", 30)
+	wait := maxWait
+	if t := q.Get("timeout"); t != "" {
+		n, err := strconv.Atoi(t)
+		if err != nil || n < 0 {
+			writeJSONError(w, ErrBadRequest.With("invalid timeout"))
+			return
+		}
+		wait = min(n, maxWait)
+	}
+	maxAge := parseMaxAge(q.Get("max_age"))
+
+	if bandwidth.Admit(httpPeer(r)) != capAllow {
+		writeJSONError(w, ErrRateLimited.With("daily bandwidth cap reached"))
+		return
+	}
+
+	public := privacy.Public()
+	deadline := time.NewTimer(time.Duration(wait) * time.Second)
+	defer deadline.Stop()
+	for {
+		samples, truncated, next := polls.Since(kind.Name, since)
+		now := time.Now()
+		fresh := make([]json.RawMessage, 0, len(samples))
+		last := since
+		var newest int64
+		for _, s := range samples {
+			last = s.Seq
+			if !sampleFresh(now, s.Ts, s.ExpiresAt, maxAge) {
+				continue
+			}
+			payload, err := public.Apply(s.Payload)
+			if err != nil {
+				log.Printf("[/poll] apply public privacy tier to %s seq %d: %v", kind.Name, s.Seq, err)
+				continue
+			}
+			fresh = append(fresh, payload)
+			newest = max(newest, s.Ts)
+		}
+		if len(fresh) > 0 || last > since {
+			writePoll(w, kind.Name, fresh, last, truncated)
+			freshness.Delivered(freshHTTPPoll, newest, now)
+			return
+		}
+
+		select {
+		case <-next:
+		case <-deadline.C:
+			writePoll(w, kind.Name, fresh, since, truncated)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writePoll answers a poll. Clients pass last_seq back as since_seq;
+// truncated means samples between their since_seq and the first one
+// returned were dropped from the buffer (see /history for those).
+func writePoll(w http.ResponseWriter, kind string, samples []json.RawMessage, last uint64, truncated bool) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"kind":      kind,
+		"samples":   samples,
+		"last_seq":  last,
+		"truncated": truncated,
+	})
+}
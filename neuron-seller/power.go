@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type powerMode string
+
+const (
+	powerNormal   powerMode = "normal"
+	powerSaver    powerMode = "saver"
+	powerCritical powerMode = "critical"
+)
+
+type powerConfig struct {
+	Source          string // "", "pi" or "sysfs"
+	PiPath          string
+	SysfsPath       string
+	LowPercent      float64
+	CriticalPercent float64
+	SaverFactor     int
+	CriticalFactor  int
+	RefreshInterval time.Duration
+}
+
+// powerState is what the Pi endpoint returns and what sysfs is mapped onto.
+type powerState struct {
+	BatteryPercent *float64 `json:"battery_percent"`
+	Charging       bool     `json:"charging"`
+	SolarWatts     float64  `json:"solar_watts"`
+}
+
+// powerMonitor stretches the sampling interval on battery-powered nodes
+// when the charge drops, so a cloudy week doesn't flatten the battery.
+type powerMonitor struct {
+	cfg powerConfig
+
+	mu         sync.Mutex
+	state      powerState
+	mode       powerMode
+	refreshed  time.Time
+	refreshing bool
+}
+
+var power = &powerMonitor{mode: powerNormal}
+
+// powerClient reads the Pi's power endpoint; a hung Pi must not hold up
+// the sampling loop, which asks for the mode every tick.
+var powerClient = &http.Client{Timeout: 5 * time.Second}
+
+func loadPowerConfig() powerConfig {
+	return powerConfig{
+		Source:          strings.ToLower(getEnvOrDefault("POWER_SOURCE", "")),
+		PiPath:          getEnvOrDefault("POWER_PI_PATH", "/power"),
+		SysfsPath:       getEnvOrDefault("POWER_SYSFS_PATH", "/sys/class/power_supply/BAT0"),
+		LowPercent:      float64(parseEnvInt("POWER_LOW_PERCENT", 30)),
+		CriticalPercent: float64(parseEnvInt("POWER_CRITICAL_PERCENT", 10)),
+		SaverFactor:     parseEnvInt("POWER_SAVER_FACTOR", 3),
+		CriticalFactor:  parseEnvInt("POWER_CRITICAL_FACTOR", 12),
+		RefreshInterval: time.Duration(parseEnvInt("POWER_REFRESH_SECONDS", 60)) * time.Second,
+	}
+}
+
+func loadPowerMonitor() {
+	cfg := loadPowerConfig()
+	switch cfg.Source {
+	case "":
+		return
+	case "pi", "sysfs":
+	default:
+		log.Fatalf("power: unknown POWER_SOURCE %q (pi, sysfs)", cfg.Source)
+	}
+	if cfg.SaverFactor < 1 {
+		cfg.SaverFactor = 1
+	}
+	if cfg.CriticalFactor < cfg.SaverFactor {
+		cfg.CriticalFactor = cfg.SaverFactor
+	}
+
+	power.mu.Lock()
+	power.cfg = cfg
+	power.mu.Unlock()
+	log.Printf("Power     : source=%s low=%.0f%% critical=%.0f%%", cfg.Source, cfg.LowPercent, cfg.CriticalPercent)
+}
+
+// Mode returns the current power mode, refreshing the reading when stale.
+// The reading is taken without holding the lock; callers that come in
+// while a refresh is in flight get the cached mode.
+func (p *powerMonitor) Mode() powerMode {
+	p.mu.Lock()
+	if p.cfg.Source == "" {
+		p.mu.Unlock()
+		return powerNormal
+	}
+	if p.refreshing || time.Since(p.refreshed) < p.cfg.RefreshInterval {
+		defer p.mu.Unlock()
+		return p.mode
+	}
+	p.refreshing = true
+	cfg := p.cfg
+	p.mu.Unlock()
+
+	state, err := readPower(cfg)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refreshing = false
+	p.refreshed = time.Now()
+	if err != nil {
+		// Keep the previous mode; a missing reading shouldn't speed us up.
+		log.Printf("power: unable to read power state: %v", err)
+		return p.mode
+	}
+	p.state = state
+
+	mode := powerNormal
+	if state.BatteryPercent != nil && !state.Charging {
+		switch {
+		case *state.BatteryPercent <= cfg.CriticalPercent:
+			mode = powerCritical
+		case *state.BatteryPercent <= cfg.LowPercent:
+			mode = powerSaver
+		}
+	}
+	if mode != p.mode {
+		log.Printf("power: mode %s -> %s (battery=%s charging=%t solar=%.1fW)",
+			p.mode, mode, formatPercent(state.BatteryPercent), state.Charging, state.SolarWatts)
+		p.mode = mode
+	}
+	return p.mode
+}
+
+// Interval stretches base according to the current power mode.
+func (p *powerMonitor) Interval(base time.Duration) time.Duration {
+	switch p.Mode() {
+	case powerCritical:
+		return base * time.Duration(p.cfg.CriticalFactor)
+	case powerSaver:
+		return base * time.Duration(p.cfg.SaverFactor)
+	default:
+		return base
+	}
+}
+
+func (p *powerMonitor) Snapshot() map[string]any {
+	mode := p.Mode()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return map[string]any{
+		"source":          p.cfg.Source,
+		"mode":            mode,
+		"battery_percent": p.state.BatteryPercent,
+		"charging":        p.state.Charging,
+		"solar_watts":     p.state.SolarWatts,
+	}
+}
+
+func readPower(cfg powerConfig) (powerState, error) {
+	if cfg.Source == "pi" {
+		var state powerState
+		if err := fetchJSONWith(powerClient, sellerCfg.PiBase+cfg.PiPath, &state); err != nil {
+			return powerState{}, err
+		}
+		return state, nil
+	}
+	return readSysfsPower(cfg.SysfsPath)
+}
+
+// readSysfsPower reads a Linux power_supply device (capacity + status).
+func readSysfsPower(dir string) (powerState, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, "capacity"))
+	if err != nil {
+		return powerState{}, err
+	}
+	pct, err := strconv.ParseFloat(strings.TrimSpace(string(raw)), 64)
+	if err != nil {
+		return powerState{}, fmt.Errorf("parse %s/capacity: %w", dir, err)
+	}
+
+	state := powerState{BatteryPercent: &pct}
+	if status, err := os.ReadFile(filepath.Join(dir, "status")); err == nil {
+		s := strings.TrimSpace(string(status))
+		state.Charging = s == "Charging" || s == "Full"
+	}
+	return state, nil
+}
+
+func formatPercent(p *float64) string {
+	if p == nil {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.0f%%", *p)
+}
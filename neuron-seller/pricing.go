@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buyers are billed per delivered sample, always in tinybar. PRICE_CURRENCY
+// picks how the list price is set: HBAR takes PRICE_PER_SAMPLE_TINYBAR as
+// is; USD takes PRICE_PER_SAMPLE_USD_CENTS and converts it at send time
+// with the HBAR/USD rate from Hedera's exchange-rate file (via the mirror
+// node) or, with PRICE_RATE_SOURCE=oracle, from PRICE_RATE_ORACLE_URL.
+// Discount vouchers take their percentage off. The price, and for USD the
+// rate it was converted at, is kept in the delivery log so later price or
+// rate changes don't rewrite what was billed.
+
+const (
+	currencyHBAR = "HBAR"
+	currencyUSD  = "USD"
+)
+
+type priceConfig struct {
+	Currency    string
+	Tinybar     int64   // list price when Currency is HBAR
+	Cents       float64 // list price when Currency is USD
+	RateSource  string  // hedera or oracle
+	OracleURL   string
+	OracleField string // dotted path to USD per HBAR in the oracle's JSON
+	RateRefresh time.Duration
+	RateMaxAge  time.Duration
+
+	// Backfilled history samples have their own price, in the same
+	// currency; it defaults to the list price.
+	BackfillTinybar int64
+	BackfillCents   float64
+}
+
+// exchangeRate is the HBAR/USD rate samples are converted at.
+type exchangeRate struct {
+	CentsPerHbar float64   `json:"cents_per_hbar"`
+	Source       string    `json:"source"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	Error        string    `json:"error,omitempty"` // last refresh failure
+}
+
+var (
+	pricing priceConfig
+
+	rateMu      sync.Mutex
+	currentRate exchangeRate
+)
+
+func loadPricing() {
+	pricing = priceConfig{
+		Currency:    strings.ToUpper(getEnvOrDefault("PRICE_CURRENCY", currencyHBAR)),
+		Tinybar:     int64(parseEnvInt("PRICE_PER_SAMPLE_TINYBAR", 0)),
+		Cents:       parseEnvFloat("PRICE_PER_SAMPLE_USD_CENTS", 0),
+		RateSource:  strings.ToLower(getEnvOrDefault("PRICE_RATE_SOURCE", "hedera")),
+		OracleURL:   getEnvOrDefault("PRICE_RATE_ORACLE_URL", ""),
+		OracleField: getEnvOrDefault("PRICE_RATE_ORACLE_FIELD", "usd"),
+		RateRefresh: time.Duration(parseEnvInt("PRICE_RATE_REFRESH_SECONDS", 300)) * time.Second,
+		RateMaxAge:  time.Duration(parseEnvInt("PRICE_RATE_MAX_AGE_MINUTES", 60)) * time.Minute,
+	}
+	pricing.BackfillTinybar = int64(parseEnvInt("BACKFILL_PRICE_PER_SAMPLE_TINYBAR", int(pricing.Tinybar)))
+	pricing.BackfillCents = parseEnvFloat("BACKFILL_PRICE_PER_SAMPLE_USD_CENTS", pricing.Cents)
+	switch pricing.Currency {
+	case currencyHBAR:
+		if pricing.Tinybar > 0 {
+			log.Printf("Pricing   : %d tinybar per sample", pricing.Tinybar)
+		}
+		return
+	case currencyUSD:
+	default:
+		log.Fatalf("pricing: PRICE_CURRENCY must be HBAR or USD, got %q", pricing.Currency)
+	}
+	switch pricing.RateSource {
+	case "hedera":
+	case "oracle":
+		if pricing.OracleURL == "" {
+			log.Fatalf("pricing: PRICE_RATE_SOURCE=oracle needs PRICE_RATE_ORACLE_URL")
+		}
+	default:
+		log.Fatalf("pricing: PRICE_RATE_SOURCE must be hedera or oracle, got %q", pricing.RateSource)
+	}
+	if pricing.Cents <= 0 {
+		return
+	}
+	refreshRate()
+	go func() {
+		ticker := time.NewTicker(max(pricing.RateRefresh, 30*time.Second))
+		defer ticker.Stop()
+		for range ticker.C {
+			refreshRate()
+		}
+	}()
+	rate, _ := usableRate(time.Now())
+	log.Printf("Pricing   : %g USD cents per sample (%s rate, %.4f cents/HBAR)", pricing.Cents, pricing.RateSource, rate.CentsPerHbar)
+}
+
+// priceQuote is how a sample's price was arrived at.
+type priceQuote struct {
+	Tinybar      int64
+	Currency     string
+	Cents        float64 // USD only: billed cents, after discounts
+	CentsPerHbar float64 // USD only: 0 when no rate was usable
+}
+
+// samplePrice is what the buyer is billed for one sample sent now. A USD
+// price with no rate fresher than PRICE_RATE_MAX_AGE_MINUTES bills 0 tinybar
+// but keeps the cents, so the sample can be priced once a rate is known.
+func samplePrice(key, evm string, now time.Time) priceQuote {
+	return quotePrice(pricing.Tinybar, pricing.Cents, key, evm, now)
+}
+
+// backfillPrice is what the buyer is billed for one backfilled sample.
+func backfillPrice(key, evm string, now time.Time) priceQuote {
+	return quotePrice(pricing.BackfillTinybar, pricing.BackfillCents, key, evm, now)
+}
+
+func quotePrice(tinybar int64, cents float64, key, evm string, now time.Time) priceQuote {
+	pct := int64(vouchers.Discount(key, evm, now))
+	if pricing.Currency != currencyUSD {
+		return priceQuote{Currency: currencyHBAR, Tinybar: tinybar * (100 - pct) / 100}
+	}
+	q := priceQuote{Currency: currencyUSD, Cents: cents * float64(100-pct) / 100}
+	if rate, ok := usableRate(now); ok {
+		q.CentsPerHbar = rate.CentsPerHbar
+		q.Tinybar = centsToTinybar(q.Cents, rate.CentsPerHbar)
+	}
+	return q
+}
+
+func centsToTinybar(cents, centsPerHbar float64) int64 {
+	return int64(math.Round(cents / centsPerHbar * 1e8))
+}
+
+// usableRate returns the current rate if it is fresh enough to bill at.
+func usableRate(now time.Time) (exchangeRate, bool) {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	ok := currentRate.CentsPerHbar > 0 && now.Sub(currentRate.FetchedAt) <= pricing.RateMaxAge
+	return currentRate, ok
+}
+
+func refreshRate() {
+	var (
+		cents float64
+		err   error
+	)
+	switch pricing.RateSource {
+	case "oracle":
+		cents, err = fetchOracleRate(pricing.OracleURL, pricing.OracleField)
+	default:
+		cents, err = fetchHederaRate(time.Now())
+	}
+
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	if err != nil {
+		log.Printf("pricing: exchange rate: %v", err)
+		currentRate.Error = err.Error()
+		return
+	}
+	currentRate = exchangeRate{CentsPerHbar: cents, Source: pricing.RateSource, FetchedAt: time.Now().UTC()}
+}
+
+// fetchHederaRate reads the network's exchange-rate file (0.0.112) through
+// the mirror node and returns US cents per HBAR, switching to next_rate once
+// current_rate has expired.
+func fetchHederaRate(now time.Time) (float64, error) {
+	base := strings.TrimRight(getEnvOrDefault("mirror_api_url", hederaNet.MirrorURL), "/")
+	var body struct {
+		Current hederaRate `json:"current_rate"`
+		Next    hederaRate `json:"next_rate"`
+	}
+	if err := getJSON(base+"/network/exchangerate", &body); err != nil {
+		return 0, err
+	}
+	r := body.Current
+	if body.Next.HbarEquivalent > 0 && body.Current.ExpirationTime > 0 && now.Unix() >= body.Current.ExpirationTime {
+		r = body.Next
+	}
+	if r.HbarEquivalent <= 0 || r.CentEquivalent <= 0 {
+		return 0, fmt.Errorf("mirror node: empty exchange rate")
+	}
+	return float64(r.CentEquivalent) / float64(r.HbarEquivalent), nil
+}
+
+type hederaRate struct {
+	CentEquivalent int64 `json:"cent_equivalent"`
+	HbarEquivalent int64 `json:"hbar_equivalent"`
+	ExpirationTime int64 `json:"expiration_time"`
+}
+
+// fetchOracleRate reads USD per HBAR from field, a dotted path into the
+// oracle's JSON (e.g. "hedera-hashgraph.usd" for CoinGecko's simple price
+// API), and returns it as cents per HBAR.
+func fetchOracleRate(oracleURL, field string) (float64, error) {
+	var body any
+	if err := getJSON(oracleURL, &body); err != nil {
+		return 0, err
+	}
+	usd, ok := jsonPathNumber(body, field)
+	if !ok {
+		return 0, fmt.Errorf("oracle: no %q in response", field)
+	}
+	if usd <= 0 {
+		return 0, fmt.Errorf("oracle: %q is not a positive number", field)
+	}
+	return usd * 100, nil
+}
+
+// jsonPathNumber follows a dotted path through decoded JSON objects to a
+// number, or a string holding one.
+func jsonPathNumber(body any, path string) (float64, bool) {
+	v := body
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return 0, false
+		}
+		v = obj[part]
+	}
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func getJSON(rawURL string, v any) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	resp, err := outboundClient(10 * time.Second).Get(rawURL)
+	if err != nil {
+		return fmt.Errorf("%s: %w", u.Host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u.Host, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: %w", u.Host, err)
+	}
+	return nil
+}
+
+// pricingSummary describes the current price for /revenue and invoices.
+func pricingSummary() map[string]any {
+	out := map[string]any{"currency": pricing.Currency}
+	if pricing.Currency != currencyUSD {
+		out["price_per_sample_tinybar"] = pricing.Tinybar
+		return out
+	}
+	out["price_per_sample_usd_cents"] = pricing.Cents
+	rateMu.Lock()
+	out["exchange_rate"] = currentRate
+	rateMu.Unlock()
+	return out
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// Sellers in residential areas can sell useful data without giving away
+// their address. PRIVACY_FILE (see privacy.example.json) defines tiers,
+// each of which can
+//
+//   - round lat/lon to a grid of location_grid_deg degrees,
+//   - round ts down to timestamp_quantum_seconds, and
+//   - suppress_label: leave out label and labels.
+//
+// Buyers are put in a tier by their key or EVM address under "buyers";
+// everyone else gets default_tier. public_tier (default_tier if unset)
+// covers what anyone can see: /stream, /poll, /history, /graphql, /status,
+// /device and the registration published to the Hedera topic. Payloads are
+// rewritten once per tier per sample and signed again; the local history
+// keeps the exact values, and only admin endpoints show them.
+
+type privacyTier struct {
+	LocationGridDeg  float64 `json:"location_grid_deg,omitempty"`
+	TimestampQuantum int64   `json:"timestamp_quantum_seconds,omitempty"`
+	SuppressLabel    bool    `json:"suppress_label,omitempty"`
+}
+
+type privacyPolicy struct {
+	DefaultTier string                  `json:"default_tier"`
+	PublicTier  string                  `json:"public_tier,omitempty"`
+	Tiers       map[string]*privacyTier `json:"tiers"`
+	Buyers      map[string]string       `json:"buyers,omitempty"` // buyer key or EVM address -> tier
+}
+
+var privacy *privacyPolicy
+
+func loadPrivacy() {
+	path := getEnvOrDefault("PRIVACY_FILE", "privacy.json")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("privacy: read %s: %v", path, err)
+	}
+	var p privacyPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		log.Fatalf("privacy: parse %s: %v", path, err)
+	}
+	if err := p.validate(); err != nil {
+		log.Fatalf("privacy: %s: %v", path, err)
+	}
+	buyers := make(map[string]string, len(p.Buyers))
+	for id, tier := range p.Buyers {
+		buyers[rawKey(id)] = tier
+	}
+	p.Buyers = buyers
+	privacy = &p
+	log.Printf("Privacy   : %d tier(s) from %s, default %s, public %s", len(p.Tiers), path, p.DefaultTier, p.publicTier())
+}
+
+func (p *privacyPolicy) validate() error {
+	if p.DefaultTier == "" {
+		return fmt.Errorf("default_tier must be set")
+	}
+	names := []string{p.DefaultTier, p.PublicTier}
+	for _, tier := range p.Buyers {
+		names = append(names, tier)
+	}
+	for _, name := range names {
+		if _, ok := p.Tiers[name]; name != "" && !ok {
+			return fmt.Errorf("unknown tier %q", name)
+		}
+	}
+	for name, t := range p.Tiers {
+		if t == nil || t.LocationGridDeg < 0 || t.LocationGridDeg > 90 || t.TimestampQuantum < 0 {
+			return fmt.Errorf("tier %q: location_grid_deg must be 0-90 and timestamp_quantum_seconds not negative", name)
+		}
+	}
+	return nil
+}
+
+func (p *privacyPolicy) publicTier() string {
+	if p.PublicTier != "" {
+		return p.PublicTier
+	}
+	return p.DefaultTier
+}
+
+// TierFor is the tier of a buyer; "" and nil without a policy. A buyer
+// whose account the SDK has not validated gets the default tier: the key
+// and EVM address it names are its own claim.
+func (p *privacyPolicy) TierFor(info *commonlib.NodeBufferInfo) (string, *privacyTier) {
+	if p == nil {
+		return "", nil
+	}
+	var name string
+	ok := false
+	if info.IsOtherSideValidAccount {
+		key, evm := buyerIdentity(info)
+		name, ok = p.Buyers[rawKey(key)]
+		if !ok && evm != "" {
+			name, ok = p.Buyers[rawKey(evm)]
+		}
+	}
+	if !ok {
+		name = p.DefaultTier
+	}
+	return name, p.Tiers[name]
+}
+
+// Public is the tier for what anyone can see.
+func (p *privacyPolicy) Public() *privacyTier {
+	if p == nil {
+		return nil
+	}
+	return p.Tiers[p.publicTier()]
+}
+
+// Location applies the tier to loc.
+func (t *privacyTier) Location(loc siteLocation) siteLocation {
+	if t == nil {
+		return loc
+	}
+	if t.LocationGridDeg > 0 {
+		loc.Lat, loc.Lon = snapToGrid(loc.Lat, t.LocationGridDeg), snapToGrid(loc.Lon, t.LocationGridDeg)
+	}
+	if t.SuppressLabel {
+		loc.Label = ""
+	}
+	return loc
+}
+
+// Ts applies the tier to a Unix timestamp.
+func (t *privacyTier) Ts(ts int64) int64 {
+	if t == nil || t.TimestampQuantum <= 0 {
+		return ts
+	}
+	return ts - ts%t.TimestampQuantum
+}
+
+// identity reports whether the tier changes nothing.
+func (t *privacyTier) identity() bool {
+	return t == nil || (t.LocationGridDeg == 0 && t.TimestampQuantum == 0 && !t.SuppressLabel)
+}
+
+// snapToGrid rounds v to the nearest multiple of grid, without float
+// noise in the last digits.
+func snapToGrid(v, grid float64) float64 {
+	snapped := math.Round(v/grid) * grid
+	digits := max(int(math.Ceil(-math.Log10(grid))), 0) + 1
+	scale := math.Pow(10, float64(digits))
+	return math.Round(snapped*scale) / scale
+}
+
+// Apply rewrites an encoded JSON payload for the tier, signing it again
+// if it was signed.
+func (t *privacyTier) Apply(payload []byte) ([]byte, error) {
+	if t.identity() {
+		return payload, nil
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &members); err != nil {
+		return nil, err
+	}
+	_, signed := members["sig"]
+	delete(members, "sig")
+	set := func(key string, v any) error {
+		if _, ok := members[key]; !ok {
+			return nil
+		}
+		data, err := json.Marshal(v)
+		members[key] = data
+		return err
+	}
+	if t.LocationGridDeg > 0 {
+		for _, key := range []string{"lat", "lon"} {
+			var v float64
+			if err := json.Unmarshal(members[key], &v); err == nil {
+				if err := set(key, snapToGrid(v, t.LocationGridDeg)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if t.TimestampQuantum > 0 {
+		var ts int64
+		if err := json.Unmarshal(members["ts"], &ts); err == nil {
+			ts = t.Ts(ts)
+			if err := set("ts", ts); err != nil {
+				return nil, err
+			}
+			if err := set("ts_iso", time.Unix(ts, 0).UTC().Format(time.RFC3339)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if t.SuppressLabel {
+		delete(members, "label")
+		delete(members, "labels")
+	}
+	out, err := json.Marshal(members)
+	if err != nil {
+		return nil, err
+	}
+	if signed && signer != nil {
+		out = signer.Sign(out)
+	}
+	return out, nil
+}
+
+// Record applies the tier to a local history record.
+func (t *privacyTier) Record(rec historyRecord) (historyRecord, error) {
+	payload, err := t.Apply(rec.Payload)
+	if err != nil {
+		return rec, err
+	}
+	rec.Payload, rec.Ts = payload, t.Ts(rec.Ts)
+	return rec, nil
+}
+
+// Records applies the tier to history records, in place.
+func (t *privacyTier) Records(records []historyRecord) error {
+	for i, rec := range records {
+		var err error
+		if records[i], err = t.Record(rec); err != nil {
+			return fmt.Errorf("seq %d: %w", rec.Seq, err)
+		}
+	}
+	return nil
+}
+
+// Buckets applies the tier to history buckets, in place.
+func (t *privacyTier) Buckets(buckets []aggregateRecord) {
+	for i := range buckets {
+		buckets[i].Ts = t.Ts(buckets[i].Ts)
+	}
+}
+
+// Status lists the tiers and how many buyers each has, for /status.
+func (p *privacyPolicy) Status() map[string]any {
+	if p == nil {
+		return nil
+	}
+	counts := map[string]int{}
+	for _, tier := range p.Buyers {
+		counts[tier]++
+	}
+	names := make([]string, 0, len(p.Tiers))
+	for name := range p.Tiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tiers := make([]map[string]any, 0, len(names))
+	for _, name := range names {
+		tiers = append(tiers, map[string]any{"name": name, "policy": p.Tiers[name], "buyers": counts[name]})
+	}
+	return map[string]any{"default_tier": p.DefaultTier, "public_tier": p.publicTier(), "tiers": tiers}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"localsense/neuron-seller/buyerclient"
+)
+
+// /status can say everything is fine while nothing reaches buyers: a
+// wedged stream loop, a sampler that stopped publishing, a broken signer.
+// With PROBE_INTERVAL_SECONDS set the node probes its own data path the way
+// `localsense selftest` does: an ephemeral libp2p host dials the selftest
+// protocol over loopback and waits up to PROBE_TIMEOUT_SECONDS for a sample
+// from this seller, signed when signing is on, no older than
+// PROBE_MAX_AGE_SECONDS. Results and latency go to /metrics and /status.
+// Probes are skipped while the duty schedule is quiescent or the node is
+// under maintenance, when no samples are expected. Needs SELFTEST_ENABLE.
+
+type probeResult struct {
+	At        time.Time `json:"at"`
+	OK        bool      `json:"ok"`
+	Skipped   string    `json:"skipped,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMs int64     `json:"latency_ms,omitempty"` // dial to first sample
+	AgeMs     int64     `json:"sample_age_ms,omitempty"`
+	Kind      string    `json:"kind,omitempty"`
+	Seq       uint64    `json:"seq,omitempty"`
+}
+
+type prober struct {
+	every   time.Duration
+	timeout time.Duration
+	maxAge  time.Duration
+
+	mu          sync.Mutex
+	last        probeResult
+	lastSuccess time.Time
+	counts      map[string]uint64 // ok, fail, skipped
+}
+
+// probes is nil unless PROBE_INTERVAL_SECONDS is set.
+var probes *prober
+
+func loadProbe() {
+	every := parseEnvInt("PROBE_INTERVAL_SECONDS", 0)
+	if every <= 0 {
+		return
+	}
+	neuron, _ := getNeuronSellerConfig()
+	interval := neuron.ensureDefaults().StreamInterval
+	probes = &prober{
+		every:   time.Duration(every) * time.Second,
+		timeout: time.Duration(parseEnvInt("PROBE_TIMEOUT_SECONDS", int(max(3*interval, 30*time.Second)/time.Second))) * time.Second,
+		maxAge:  time.Duration(parseEnvInt("PROBE_MAX_AGE_SECONDS", 60)) * time.Second,
+		counts:  map[string]uint64{"ok": 0, "fail": 0, "skipped": 0},
+	}
+	log.Printf("Probe     : end-to-end probe every %s (timeout %s, max sample age %s)", probes.every, probes.timeout, probes.maxAge)
+}
+
+// startProbe runs the probe loop once the selftest protocol is up.
+func startProbe(ctx context.Context) {
+	if probes == nil {
+		return
+	}
+	selftests.mu.Lock()
+	addrs := selftests.addrs
+	selftests.mu.Unlock()
+	if len(addrs) == 0 {
+		const why = "probe needs SELFTEST_ENABLE and a loopback listen address"
+		log.Printf("neuron-seller: %s, not probing", why)
+		probes.mu.Lock()
+		probes.last = probeResult{At: time.Now().UTC(), Error: why}
+		probes.mu.Unlock()
+		return
+	}
+	go probes.loop(ctx, addrs[0])
+}
+
+func (p *prober) loop(ctx context.Context, addr string) {
+	ticker := time.NewTicker(p.every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		res := p.run(ctx, addr, time.Now())
+		p.mu.Lock()
+		p.last = res
+		switch {
+		case res.Skipped != "":
+			p.counts["skipped"]++
+		case res.OK:
+			p.counts["ok"]++
+			p.lastSuccess = res.At
+		default:
+			p.counts["fail"]++
+		}
+		p.mu.Unlock()
+		if res.Skipped == "" && !res.OK {
+			log.Printf("neuron-seller: end-to-end probe failed: %s", res.Error)
+		}
+	}
+}
+
+func (p *prober) run(ctx context.Context, addr string, now time.Time) probeResult {
+	res := probeResult{At: now.UTC()}
+	switch {
+	case underMaintenance():
+		res.Skipped = "maintenance"
+		return res
+	case !schedule.Active(now):
+		res.Skipped = "quiescent"
+		return res
+	}
+
+	smp, latency, err := p.probe(ctx, addr)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Kind, res.Seq = smp.Kind, smp.Seq
+	res.LatencyMs = latency.Milliseconds()
+	age := time.Since(time.Unix(smp.Ts, 0))
+	res.AgeMs = age.Milliseconds()
+	if age > p.maxAge {
+		res.Error = fmt.Sprintf("%s sample seq %d is %s old", smp.Kind, smp.Seq, age.Round(time.Second))
+		return res
+	}
+	res.OK = true
+	return res
+}
+
+// probe dials the selftest protocol from a fresh host and returns the first
+// sample and how long it took to arrive.
+func (p *prober) probe(ctx context.Context, addr string) (*buyerclient.Sample, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	start := time.Now()
+
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		return nil, 0, fmt.Errorf("start host: %w", err)
+	}
+	defer h.Close()
+	info, err := peer.AddrInfoFromString(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := h.Connect(ctx, *info); err != nil {
+		return nil, 0, fmt.Errorf("connect: %w", err)
+	}
+	s, err := h.NewStream(ctx, info.ID, selftestProtocol)
+	if err != nil {
+		return nil, 0, fmt.Errorf("open stream: %w", err)
+	}
+	defer s.Close()
+	deadline, _ := ctx.Deadline()
+	s.SetReadDeadline(deadline)
+
+	sc := bufio.NewScanner(s)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !sc.Scan() {
+		err := sc.Err()
+		if err == nil {
+			err = errors.New("stream closed")
+		}
+		return nil, 0, fmt.Errorf("no sample within %s: %w", p.timeout, err)
+	}
+	latency := time.Since(start)
+	line := sc.Bytes()
+	smp, _, err := buyerclient.ParseLine(line)
+	if err != nil {
+		return nil, 0, err
+	}
+	if smp == nil {
+		return nil, 0, errors.New("first frame is not a sample")
+	}
+	if smp.SellerID != sellerCfg.SellerID {
+		return nil, 0, fmt.Errorf("seller_id %q, want %q", smp.SellerID, sellerCfg.SellerID)
+	}
+	if key := signingPublicKey(); key != "" {
+		pub, _ := hex.DecodeString(key)
+		if err := buyerclient.VerifySeller(line, ed25519.PublicKey(pub)); err != nil {
+			return nil, 0, fmt.Errorf("signature: %w", err)
+		}
+	}
+	return smp, latency, nil
+}
+
+// Status is the last probe, for /status.
+func (p *prober) Status() map[string]any {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := map[string]any{"interval_s": p.every.Seconds(), "ok": p.counts["ok"], "failed": p.counts["fail"]}
+	if !p.last.At.IsZero() {
+		out["last"] = p.last
+	}
+	if !p.lastSuccess.IsZero() {
+		out["last_success"] = p.lastSuccess
+	}
+	return out
+}
+
+func writeProbeMetrics(w http.ResponseWriter) {
+	p := probes
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintln(w, "# HELP localsense_probe_total End-to-end data path probes, by result.")
+	fmt.Fprintln(w, "# TYPE localsense_probe_total counter")
+	for _, result := range []string{"ok", "fail", "skipped"} {
+		fmt.Fprintf(w, "localsense_probe_total{result=%q} %d\n", result, p.counts[result])
+	}
+	if p.lastSuccess.IsZero() {
+		return
+	}
+	fmt.Fprintln(w, "# HELP localsense_probe_last_success_timestamp_seconds When a probe last got a fresh sample.")
+	fmt.Fprintln(w, "# TYPE localsense_probe_last_success_timestamp_seconds gauge")
+	fmt.Fprintf(w, "localsense_probe_last_success_timestamp_seconds %d\n", p.lastSuccess.Unix())
+	if p.last.OK {
+		fmt.Fprintln(w, "# HELP localsense_probe_latency_seconds Dial to first sample, last successful probe.")
+		fmt.Fprintln(w, "# TYPE localsense_probe_latency_seconds gauge")
+		fmt.Fprintf(w, "localsense_probe_latency_seconds %.3f\n", float64(p.last.LatencyMs)/1000)
+		fmt.Fprintln(w, "# HELP localsense_probe_sample_age_seconds Age of the sample the last successful probe got.")
+		fmt.Fprintln(w, "# TYPE localsense_probe_sample_age_seconds gauge")
+		fmt.Fprintf(w, "localsense_probe_sample_age_seconds %.3f\n", float64(p.last.AgeMs)/1000)
+	}
+}
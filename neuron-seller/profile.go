@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/joho/godotenv"
+	flag "github.com/spf13/pflag"
+)
+
+// envProfile bundles the settings that have to change together when a node
+// moves between environments (network, protocol IDs, intervals).
+type envProfile struct {
+	Name   string
+	Values map[string]string
+}
+
+var builtinProfiles = map[string]envProfile{
+	"testnet": {
+		Name: "testnet",
+		Values: map[string]string{
+			"HEDERA_NETWORK":                 "testnet",
+			"NEURON_PROTOCOL_ID":             "/localsense/brightness/v1",
+			"NEURON_STREAM_INTERVAL_SECONDS": "5",
+			"eth_rpc_url":                    "https://testnet.hashio.io/api",
+			"mirror_api_url":                 "https://testnet.mirrornode.hedera.com/api/v1",
+		},
+	},
+	"mainnet": {
+		Name: "mainnet",
+		Values: map[string]string{
+			"HEDERA_NETWORK":                 "mainnet",
+			"NEURON_PROTOCOL_ID":             "/localsense/brightness/v1",
+			"NEURON_STREAM_INTERVAL_SECONDS": "10",
+			"eth_rpc_url":                    "https://mainnet.hashio.io/api",
+			"mirror_api_url":                 "https://mainnet.mirrornode.hedera.com/api/v1",
+		},
+	},
+	"lab": {
+		Name: "lab",
+		Values: map[string]string{
+			"HEDERA_NETWORK":                 "testnet",
+			"NEURON_PROTOCOL_ID":             "/localsense-lab/brightness/v1",
+			"NEURON_STREAM_INTERVAL_SECONDS": "1",
+			"eth_rpc_url":                    "https://testnet.hashio.io/api",
+			"mirror_api_url":                 "https://testnet.mirrornode.hedera.com/api/v1",
+		},
+	},
+	// low-bandwidth goes on top of a network profile
+	// (--profile mainnet,low-bandwidth) for LTE or LoRa backhauled nodes;
+	// see lowbandwidth.go.
+	"low-bandwidth": {
+		Name: "low-bandwidth",
+		Values: map[string]string{
+			"FEATURE_BATCHING":               "true",
+			"FEATURE_DELTA_MODE":             "true",
+			"PAYLOAD_CODEC":                  "cbor",
+			"P2P_COMPRESSION":                "true",
+			"NEURON_STREAM_INTERVAL_SECONDS": "60",
+			"HEARTBEAT_INTERVAL_SECONDS":     "300",
+			"BATCH_MAX_SAMPLES":              "10",
+			"BATCH_MAX_DELAY_SECONDS":        "300",
+			"PAYLOAD_I18N":                   "false",
+		},
+	},
+}
+
+var (
+	profileFlag   = flag.String("profile", "", "Environment profiles to apply, comma separated: testnet, mainnet, lab, low-bandwidth")
+	activeProfile string
+)
+
+// loadProfile applies the selected profiles on top of the environment the
+// SDK already loaded from .env. Precedence, highest first: process
+// environment, later profiles, earlier profiles, .env; within a profile
+// .env.<profile> beats the built-in values.
+func loadProfile() {
+	flag.CommandLine.ParseErrorsWhitelist.UnknownFlags = true
+	flag.Parse()
+
+	list := strings.TrimSpace(strings.ToLower(*profileFlag))
+	if list == "" {
+		list = strings.TrimSpace(strings.ToLower(os.Getenv("LOCALSENSE_PROFILE")))
+	}
+	if list == "" {
+		return
+	}
+
+	envFile := commonlib.MyEnvFile
+	if envFile == "" {
+		envFile = ".env"
+	}
+	base, err := godotenv.Read(envFile)
+	if err != nil {
+		base = map[string]string{}
+	}
+
+	var names []string
+	fromProfile := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		profile, ok := builtinProfiles[name]
+		if !ok {
+			log.Fatalf("unknown profile %q (expected one of %s)", name, strings.Join(profileNames(), ", "))
+		}
+
+		overrides, err := readProfileFile(envFile, name)
+		if err != nil {
+			log.Fatalf("profile %s: %v", name, err)
+		}
+
+		applied := 0
+		for key, val := range overrides {
+			if setFromProfile(key, val, base, fromProfile) {
+				applied++
+			}
+		}
+		for key, val := range profile.Values {
+			if _, ok := overrides[key]; ok {
+				continue
+			}
+			if setFromProfile(key, val, base, fromProfile) {
+				applied++
+			}
+		}
+		names = append(names, profile.Name)
+		log.Printf("Profile   : %s (%d settings applied)", profile.Name, applied)
+	}
+	activeProfile = strings.Join(names, ",")
+}
+
+// readProfileFile loads .env.<profile> from the directory of the base env
+// file. A missing file is fine; the built-in values still apply.
+func readProfileFile(envFile, name string) (map[string]string, error) {
+	path := filepath.Join(filepath.Dir(envFile), ".env."+name)
+	values, err := godotenv.Read(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	log.Printf("Profile   : loaded %s", path)
+	return values, nil
+}
+
+// setFromProfile only overrides keys that are unset, still carry the value
+// from the base .env file or were set by an earlier profile, so explicit
+// process environment always wins.
+func setFromProfile(key, val string, base map[string]string, fromProfile map[string]bool) bool {
+	if cur, ok := os.LookupEnv(key); ok && !fromProfile[key] {
+		if baseVal, fromBase := base[key]; !fromBase || baseVal != cur {
+			return false
+		}
+	}
+	os.Setenv(key, val)
+	fromProfile[key] = true
+	return true
+}
+
+func profileNames() []string {
+	names := make([]string, 0, len(builtinProfiles))
+	for name := range builtinProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
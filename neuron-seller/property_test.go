@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"testing/quick"
+)
+
+// Property test for sequence numbers across restarts: whatever mix of
+// samples, samples dropped before they were logged, and restarts (the
+// counters come back from the history log) happens, a kind's sequence
+// numbers never repeat for samples that were sent and never go backwards
+// from what the log holds. Samples are logged before they are sent, so a
+// number handed out but never logged was never seen by a buyer.
+
+func TestPropertySequenceRestarts(t *testing.T) {
+	kinds := []string{"temp", "lux", "co2"}
+	check := func(ops []uint16) bool {
+		seq := &sampleSequencer{last: make(map[string]uint64)}
+		logged := map[string]uint64{} // newest seq in the history log
+		sent := map[string]map[uint64]bool{}
+		for _, k := range kinds {
+			sent[k] = map[uint64]bool{}
+		}
+		for i, op := range ops {
+			kind := kinds[i%len(kinds)]
+			switch op % 4 {
+			case 0, 1: // a sample, logged to history and sent
+				n := seq.Next(kind)
+				if n <= logged[kind] || sent[kind][n] {
+					t.Logf("ops %v: %s #%d sent again", ops, kind, n)
+					return false
+				}
+				sent[kind][n] = true
+				logged[kind] = n
+			case 2: // a sample the pipeline dropped before logging it
+				if n := seq.Next(kind); sent[kind][n] {
+					t.Logf("ops %v: %s #%d was already sent", ops, kind, n)
+					return false
+				}
+			case 3: // restart: reindex the history log
+				seq = &sampleSequencer{last: make(map[string]uint64)}
+				for k, n := range logged {
+					seq.Seed(k, n)
+					seq.Seed(k, uint64(op)%(n+1)) // older records reindex too
+				}
+				for k := range logged {
+					if seq.Last(k) != logged[k] {
+						t.Logf("ops %v: %s resumed at %d, log ends at %d", ops, k, seq.Last(k), logged[k])
+						return false
+					}
+				}
+			}
+		}
+		return true
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Fatal(err)
+	}
+}
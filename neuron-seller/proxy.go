@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// OUTBOUND_PROXY sends the node's outbound HTTP traffic (mirror node, price
+// feeds, payment API, fusion sources, the fleet controller) through an
+// http://, https://, socks5:// or socks5h:// proxy, for sellers whose only
+// way out is a proxy on the uplink. The Pi is never proxied, nor are hosts in
+// OUTBOUND_NO_PROXY (comma separated, a leading dot matches subdomains) or
+// loopback addresses.
+//
+// The SDK's Hedera gRPC client only follows HTTPS_PROXY, and only over HTTP
+// CONNECT: with an http(s) OUTBOUND_PROXY, HTTPS_PROXY is set to it (unless
+// already set) with the Pi in NO_PROXY. A SOCKS proxy can't carry it, so
+// Hedera submissions then go direct. libp2p streams to buyers are never
+// proxied.
+
+var outboundProxy struct {
+	url     *url.URL
+	noProxy []string
+}
+
+func loadOutboundProxy() {
+	raw := getEnvOrDefault("OUTBOUND_PROXY", "")
+	if raw == "" {
+		return
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		log.Fatalf("neuron-seller: invalid OUTBOUND_PROXY %q", raw)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		log.Fatalf("neuron-seller: OUTBOUND_PROXY must be http, https, socks5 or socks5h, got %q", u.Scheme)
+	}
+	outboundProxy.url = u
+	for _, h := range strings.Split(getEnvOrDefault("OUTBOUND_NO_PROXY", ""), ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			outboundProxy.noProxy = append(outboundProxy.noProxy, h)
+		}
+	}
+	piHost := ""
+	if pi, err := url.Parse(sellerCfg.PiBase); err == nil {
+		piHost = pi.Hostname()
+		outboundProxy.noProxy = append(outboundProxy.noProxy, strings.ToLower(piHost))
+	}
+
+	grpc := "direct (SOCKS proxies can't carry it)"
+	if u.Scheme == "http" || u.Scheme == "https" {
+		if os.Getenv("HTTPS_PROXY") == "" && os.Getenv("https_proxy") == "" {
+			os.Setenv("HTTPS_PROXY", raw)
+			if piHost != "" {
+				os.Setenv("NO_PROXY", strings.Trim(os.Getenv("NO_PROXY")+","+piHost, ","))
+			}
+		}
+		grpc = "proxied"
+	}
+	log.Printf("Proxy     : outbound via %s://%s, Hedera gRPC %s", u.Scheme, u.Host, grpc)
+}
+
+// proxyFor is the proxy for a request, nil to go direct.
+func proxyFor(r *http.Request) (*url.URL, error) {
+	if outboundProxy.url == nil || !useProxy(r.URL.Hostname()) {
+		return nil, nil
+	}
+	return outboundProxy.url, nil
+}
+
+func useProxy(host string) bool {
+	host = strings.ToLower(host)
+	if host == "localhost" {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return false
+	}
+	for _, h := range outboundProxy.noProxy {
+		if host == h || (strings.HasPrefix(h, ".") && strings.HasSuffix(host, h)) {
+			return false
+		}
+	}
+	return true
+}
+
+// outboundClient is an HTTP client for traffic leaving the node.
+func outboundClient(timeout time.Duration) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = proxyFor
+	return &http.Client{Timeout: timeout, Transport: t}
+}
+
+// outboundDialer is a websocket dialer for connections leaving the node.
+func outboundDialer() *websocket.Dialer {
+	d := *websocket.DefaultDialer
+	d.Proxy = proxyFor
+	return &d
+}
+
+// outboundProxyStatus is the proxy for /status, without credentials.
+func outboundProxyStatus() map[string]any {
+	u := outboundProxy.url
+	if u == nil {
+		return nil
+	}
+	return map[string]any{"proxy": u.Scheme + "://" + u.Host, "no_proxy": outboundProxy.noProxy}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// purgeResult summarises a deletion; Digest is the sha256 over every deleted
+// line in order, so an auditor holding a copy can confirm exactly what went.
+type purgeResult struct {
+	After          time.Time `json:"after"`
+	Before         time.Time `json:"before"`
+	RecordsDeleted int       `json:"records_deleted"`
+	FilesRemoved   []string  `json:"files_removed,omitempty"`
+	FilesRewritten []string  `json:"files_rewritten,omitempty"`
+	FirstSeq       uint64    `json:"first_seq,omitempty"`
+	LastSeq        uint64    `json:"last_seq,omitempty"`
+	Digest         string    `json:"digest_sha256"`
+}
+
+type deletionAttestation struct {
+	MessageType string      `json:"messageType"`
+	SellerID    string      `json:"seller_id"`
+	RequestedBy string      `json:"requested_by"`
+	RequestID   string      `json:"request_id,omitempty"`
+	Result      purgeResult `json:"result"`
+	Time        time.Time   `json:"time"`
+	Version     string      `json:"v"`
+}
+
+// Purge deletes records with after <= ts < before. Whole days inside the
+// range are unlinked; boundary days are rewritten through a temp file.
+func (h *historyStore) Purge(after, before time.Time) (purgeResult, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	res := purgeResult{After: after.UTC(), Before: before.UTC()}
+	digest := sha256.New()
+
+	// Close the open file so rewrites don't race with appends.
+	if h.file != nil {
+		h.file.Sync()
+		h.file.Close()
+		h.file, h.day = nil, ""
+	}
+
+	days, err := h.days()
+	if err != nil {
+		return res, err
+	}
+	for _, day := range days {
+		if day < dayOf(after.Unix()) || day > dayOf(before.Unix()) {
+			continue
+		}
+
+		var kept, deleted [][]byte
+		err := h.scanDay(day, func(rec historyRecord) bool {
+			line, _ := json.Marshal(rec)
+			if rec.Ts >= after.Unix() && rec.Ts < before.Unix() {
+				deleted = append(deleted, line)
+				if res.FirstSeq == 0 || rec.Seq < res.FirstSeq {
+					res.FirstSeq = rec.Seq
+				}
+				if rec.Seq > res.LastSeq {
+					res.LastSeq = rec.Seq
+				}
+			} else {
+				kept = append(kept, line)
+			}
+			return true
+		})
+		if err != nil {
+			return res, fmt.Errorf("scan %s: %w", day, err)
+		}
+		if len(deleted) == 0 {
+			continue
+		}
+		for _, line := range deleted {
+			digest.Write(line)
+			digest.Write([]byte{'\n'})
+		}
+		res.RecordsDeleted += len(deleted)
+
+		path := h.dayPath(day)
+		if len(kept) == 0 {
+			if err := os.Remove(path); err != nil {
+				return res, fmt.Errorf("remove %s: %w", path, err)
+			}
+			res.FilesRemoved = append(res.FilesRemoved, day)
+			continue
+		}
+
+		tmp := path + ".tmp"
+		f, err := os.Create(tmp)
+		if err != nil {
+			return res, fmt.Errorf("rewrite %s: %w", path, err)
+		}
+		for _, line := range kept {
+			f.Write(append(line, '\n'))
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return res, fmt.Errorf("rewrite %s: %w", path, err)
+		}
+		f.Close()
+		if err := os.Rename(tmp, path); err != nil {
+			return res, fmt.Errorf("rewrite %s: %w", path, err)
+		}
+		res.FilesRewritten = append(res.FilesRewritten, day)
+	}
+
+	if err := h.purgeAggregates(after, before, &res); err != nil {
+		return res, fmt.Errorf("purge aggregates: %w", err)
+	}
+
+	res.Digest = hex.EncodeToString(digest.Sum(nil))
+	// Rewritten days moved their records.
+	if err := h.reindex(nil); err != nil {
+		log.Printf("history: reindex after purge: %v", err)
+	}
+	return res, nil
+}
+
+// runPurge deletes the range and publishes a deletion attestation on HCS,
+// tagged with the requestID of the call or command that asked for it.
+func runPurge(after, before time.Time, requestedBy, requestID string) (purgeResult, error) {
+	if history == nil {
+		return purgeResult{}, fmt.Errorf("history disabled")
+	}
+	if !before.After(after) {
+		return purgeResult{}, fmt.Errorf("before must be later than after")
+	}
+
+	res, err := history.Purge(after, before)
+	if err != nil {
+		return res, err
+	}
+	log.Printf("purge: deleted %d records in [%s, %s) requested by %s (req=%s)",
+		res.RecordsDeleted, after.Format(time.RFC3339), before.Format(time.RFC3339), requestedBy, requestID)
+
+	att := deletionAttestation{
+		MessageType: "localsenseDeletionAttestation",
+		SellerID:    sellerCfg.SellerID,
+		RequestedBy: requestedBy,
+		RequestID:   requestID,
+		Result:      res,
+		Time:        time.Now().UTC(),
+		Version:     "0.1",
+	}
+	if neuronStreamingEnabled() {
+		go func() {
+			data, _ := json.Marshal(att)
+			if err := sendToTopic(commonlib.MyStdOut, data, "deletion attestation"); err != nil && !errors.Is(err, errHederaQueued) {
+				log.Printf("purge: unable to publish deletion attestation: %v", err)
+			}
+		}()
+	}
+	return res, nil
+}
+
+// POST /admin/purge?before=<time>[&after=<time>]; times are RFC3339 or unix
+// seconds. after defaults to the beginning of time.
+func adminPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, ErrMethodNotAllowed.With("use POST"))
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("before") == "" {
+		writeJSONError(w, ErrBadRequest.With("before is required"))
+		return
+	}
+	before, err := parseTimeParam(q.Get("before"), time.Time{})
+	if err != nil {
+		writeJSONError(w, ErrBadRequest.With("invalid before: "+err.Error()))
+		return
+	}
+	after, err := parseTimeParam(q.Get("after"), time.Unix(0, 0))
+	if err != nil {
+		writeJSONError(w, ErrBadRequest.With("invalid after: "+err.Error()))
+		return
+	}
+
+	res, err := runPurge(after, before, "admin-api:"+r.RemoteAddr, requestID(r))
+	if err != nil {
+		writeJSONError(w, ErrBadRequest.Wrap(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
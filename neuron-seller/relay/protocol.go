@@ -0,0 +1,162 @@
+// Package relay defines the streams between sellers, a localsense relay and
+// buyers. A seller behind NAT dials the relay outbound and pushes its stream
+// on IngestProtocol; buyers that can't reach the seller open
+// SubscribeProtocol on the relay instead. Both streams are newline-delimited
+// JSON starting with a hello frame.
+//
+// The relay never re-signs samples: it forwards the seller's signed payload
+// untouched inside a provenance envelope (see buyerclient.Envelope) with a
+// "relay" hop appended, so buyers verify the seller signature as usual.
+//
+// A relay in aggregator mode also publishes regional statistics on
+// StatsProtocol: one RegionStats line per grid cell and kind each window,
+// only for cells at least K distinct sellers contributed to.
+package relay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	IngestProtocol    protocol.ID = "/localsense/relay/ingest/v1"
+	SubscribeProtocol protocol.ID = "/localsense/relay/subscribe/v1"
+	StatsProtocol     protocol.ID = "/localsense/relay/stats/v1"
+)
+
+// Frame types sent by the seller on the ingest stream besides samples and
+// its license frame.
+const (
+	TypeIngestHello = "relay_hello"
+	TypeBuyers      = "relay_buyers"
+)
+
+// IngestHello opens an ingest stream.
+type IngestHello struct {
+	Type          string   `json:"type"`
+	SellerID      string   `json:"seller_id"`
+	SigningPubKey string   `json:"signing_pubkey,omitempty"`
+	Kinds         []string `json:"kinds"`
+}
+
+// Buyers lists the peers the seller has sold the stream to. The relay only
+// serves subscribers in the latest list.
+type Buyers struct {
+	Type  string   `json:"type"`
+	Peers []string `json:"peers"`
+}
+
+// SubscribeHello opens a subscribe stream; Kinds empty means all kinds.
+type SubscribeHello struct {
+	SellerID string   `json:"seller_id"`
+	Kinds    []string `json:"kinds,omitempty"`
+}
+
+// TypeRegionStats is the type of RegionStats frames.
+const TypeRegionStats = "region_stats"
+
+// RegionStats summarises one kind in one grid cell over a window. Lat and
+// Lon are the cell's south-west corner; Sellers is how many distinct
+// sellers contributed, never fewer than the relay's K.
+type RegionStats struct {
+	Type        string  `json:"type"`
+	Kind        string  `json:"kind"`
+	Lat         float64 `json:"lat"`
+	Lon         float64 `json:"lon"`
+	GridDeg     float64 `json:"grid_deg"`
+	WindowStart int64   `json:"window_start"`
+	WindowEnd   int64   `json:"window_end"`
+	Sellers     int     `json:"sellers"`
+	Count       int     `json:"count"`
+	Min         float64 `json:"min"`
+	Max         float64 `json:"max"`
+	Mean        float64 `json:"mean"`
+}
+
+// SubscribeReply is the relay's first line on a subscribe stream.
+type SubscribeReply struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// WriteFrame writes v as one JSON line.
+func WriteFrame(s network.Stream, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.Write(append(data, '\n'))
+	return err
+}
+
+// Subscribe connects to a relay and asks for a seller's stream. On success
+// the returned stream yields provenance frames (plus the seller's license
+// frame) ready for buyerclient.Client.Consume.
+func Subscribe(ctx context.Context, h host.Host, relayAddr string, hello SubscribeHello) (network.Stream, error) {
+	info, err := peer.AddrInfoFromString(relayAddr)
+	if err != nil {
+		return nil, fmt.Errorf("relay address %q: %w", relayAddr, err)
+	}
+	if err := h.Connect(ctx, *info); err != nil {
+		return nil, fmt.Errorf("connect to relay: %w", err)
+	}
+	s, err := h.NewStream(ctx, info.ID, SubscribeProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("open subscribe stream: %w", err)
+	}
+	if err := WriteFrame(s, hello); err != nil {
+		s.Reset()
+		return nil, err
+	}
+
+	// Read the reply byte by byte so nothing after it is buffered away
+	// from the caller.
+	line, err := readLine(s)
+	if err != nil {
+		s.Reset()
+		return nil, fmt.Errorf("read relay reply: %w", err)
+	}
+	var reply SubscribeReply
+	if err := json.Unmarshal(line, &reply); err != nil {
+		s.Reset()
+		return nil, fmt.Errorf("decode relay reply: %w", err)
+	}
+	if !reply.OK {
+		s.Reset()
+		return nil, fmt.Errorf("relay refused subscription: %s", reply.Error)
+	}
+	return s, nil
+}
+
+// ReadHello reads the first line of a stream into v. It returns a reader
+// positioned after the hello for the rest of the stream.
+func ReadHello(s network.Stream, v any) (*bufio.Reader, error) {
+	r := bufio.NewReader(s)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	return r, json.Unmarshal(line, v)
+}
+
+func readLine(s network.Stream) ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 4096 {
+		if _, err := s.Read(b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			return line, nil
+		}
+		line = append(line, b[0])
+	}
+	return nil, fmt.Errorf("line too long")
+}
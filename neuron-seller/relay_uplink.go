@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"localsense/neuron-seller/relay"
+)
+
+// relayUplink pushes our stream to one relay node (RELAY_ADDRS) over an
+// outbound libp2p stream, so buyers that can't dial a NAT-bound Pi can
+// subscribe at the relay instead. Samples come off sampleBus; those queued
+// while the relay is unreachable are dropped once the queue is full.
+type relayUplink struct {
+	addr    string
+	samples *busSub[busSample]
+}
+
+var relayUplinks []*relayUplink
+
+const relayBuyersInterval = 30 * time.Second
+
+func startRelayUplinks(ctx context.Context, p2pHost host.Host, buffers *commonlib.NodeBuffers, kinds []sensorKind) {
+	for _, addr := range strings.Split(getEnvOrDefault("RELAY_ADDRS", ""), ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		u := &relayUplink{addr: addr, samples: sampleBus.Subscribe("relay "+addr, 256)}
+		relayUplinks = append(relayUplinks, u)
+		go u.run(ctx, p2pHost, buffers, kinds)
+	}
+	if len(relayUplinks) > 0 {
+		log.Printf("neuron-seller: relaying stream via %d relay(s)", len(relayUplinks))
+	}
+}
+
+func (u *relayUplink) run(ctx context.Context, p2pHost host.Host, buffers *commonlib.NodeBuffers, kinds []sensorKind) {
+	backoff := 5 * time.Second
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := u.session(ctx, p2pHost, buffers, kinds)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > time.Minute {
+			backoff = 5 * time.Second
+		}
+		log.Printf("neuron-seller: relay %s: %v; retrying in %s", u.addr, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 5*time.Minute)
+	}
+}
+
+func (u *relayUplink) session(ctx context.Context, p2pHost host.Host, buffers *commonlib.NodeBuffers, kinds []sensorKind) error {
+	info, err := peer.AddrInfoFromString(u.addr)
+	if err != nil {
+		return err
+	}
+	if err := p2pHost.Connect(ctx, *info); err != nil {
+		return err
+	}
+	s, err := p2pHost.NewStream(ctx, info.ID, relay.IngestProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	hello := relay.IngestHello{
+		Type:          relay.TypeIngestHello,
+		SellerID:      sellerCfg.SellerID,
+		SigningPubKey: signingPublicKey(),
+	}
+	for _, k := range kinds {
+		hello.Kinds = append(hello.Kinds, k.Name)
+	}
+	if err := relay.WriteFrame(s, hello); err != nil {
+		return err
+	}
+	if handshake := licenseHandshake(); handshake != nil {
+		if _, err := s.Write(handshake); err != nil {
+			return err
+		}
+	}
+	if err := writeRelayBuyers(s, buffers); err != nil {
+		return err
+	}
+	log.Printf("neuron-seller: relay %s connected", u.addr)
+
+	ticker := time.NewTicker(relayBuyersInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := writeRelayBuyers(s, buffers); err != nil {
+				return err
+			}
+		case smp := <-u.samples.C():
+			// Full slice expression so the newline never lands in the
+			// payload's backing array, shared with the direct broadcast.
+			line := append(smp.Payload[:len(smp.Payload):len(smp.Payload)], '\n')
+			s.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			n, err := s.Write(line)
+			bandwidth.Record(surfaceP2P, info.ID.String(), n)
+			if err != nil {
+				return err
+			}
+			freshness.Delivered(freshRelay, smp.Ts, time.Now())
+		}
+	}
+}
+
+// writeRelayBuyers tells the relay which peers bought our stream; the relay
+// serves nobody else.
+func writeRelayBuyers(s network.Stream, buffers *commonlib.NodeBuffers) error {
+	msg := relay.Buyers{Type: relay.TypeBuyers, Peers: []string{}}
+	for peerID, info := range buffers.GetBufferMap() {
+		if buyerPaid(info) && buyerAccess.Admit(peerID, info) {
+			msg.Peers = append(msg.Peers, peerID.String())
+		}
+	}
+	return relay.WriteFrame(s, msg)
+}
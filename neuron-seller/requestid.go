@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Every HTTP request carries a correlation ID: the caller's X-Request-ID
+// when it sends a usable one, else a fresh ULID. It is echoed in the
+// response header and in error bodies, prefixes the request's log lines
+// (req=<id>), lands in the admin audit trail, and travels as request_id in
+// any Hedera message the request causes (deletion attestations, location
+// announcements), so one ID follows a call from the caller's logs to HCS.
+// Topic commands use their nonce the same way.
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+var accessLog bool
+
+func loadAccessLog() {
+	accessLog = parseEnvBool("HTTP_ACCESS_LOG", true)
+}
+
+// validRequestID accepts up to 128 characters of [A-Za-z0-9._:-], enough
+// for UUIDs, ULIDs and trace IDs and nothing that could break a log line.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == ':', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newSampleID(start)
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		sw := &auditStatusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		if accessLog {
+			log.Printf("[http] req=%s %s %s %d %s from %s%s", id, r.Method, r.URL.Path, sw.status,
+				time.Since(start).Round(time.Millisecond), r.RemoteAddr, forwardedFor(r))
+		}
+	})
+}
+
+// requestID is the correlation ID of r, or "" outside withRequestID.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// logRequest logs with r's correlation ID in front.
+func logRequest(r *http.Request, format string, args ...any) {
+	log.Printf("req="+requestID(r)+" "+format, args...)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GET /revenue summarizes earnings per buyer from the delivery log (samples
+// sent and what they were billed) and the payment backend (what buyers
+// actually paid). With the hedera backend that is the mirror node: the SDK
+// settles by scheduling a transfer of the whole shared account balance, 60%
+// to the seller's parent account and 40% to the device, so settled amounts
+// are what left the shared account in transfers that credited this device.
+
+var errNoHederaAccount = errors.New("hedera_id not set")
+
+type buyerRevenue struct {
+	Buyer         string  `json:"buyer"`
+	Account       string  `json:"account,omitempty"`
+	SharedAccount string  `json:"shared_account,omitempty"`
+	Samples       int     `json:"samples"`
+	FreeSamples   int     `json:"free_samples"`
+	Billed        int64   `json:"billed_tinybar"`
+	BilledCents   float64 `json:"billed_usd_cents,omitempty"` // USD-priced samples only
+	Unrated       int     `json:"unrated_samples,omitempty"`  // USD-priced with no rate to convert at
+	Backfill      int     `json:"backfill_samples,omitempty"` // included in samples
+	BackfillFee   int64   `json:"backfill_billed_tinybar,omitempty"`
+	Settled       int64   `json:"settled_tinybar"`
+	Outstanding   int64   `json:"outstanding_tinybar"`
+	LastDelivery  int64   `json:"last_delivery,omitempty"`
+}
+
+type revenueTotals struct {
+	Samples     int     `json:"samples"`
+	FreeSamples int     `json:"free_samples"`
+	Billed      int64   `json:"billed_tinybar"`
+	BilledCents float64 `json:"billed_usd_cents,omitempty"`
+	Unrated     int     `json:"unrated_samples,omitempty"`
+	Backfill    int     `json:"backfill_samples,omitempty"`
+	BackfillFee int64   `json:"backfill_billed_tinybar,omitempty"`
+	Settled     int64   `json:"settled_tinybar"`
+	Outstanding int64   `json:"outstanding_tinybar"`
+	// Unattributed is money received from payers that no delivered
+	// buyer maps to.
+	Unattributed int64 `json:"unattributed_tinybar"`
+}
+
+type revenueProjection struct {
+	BasisDays    float64 `json:"basis_days"`
+	DailyBilled  int64   `json:"daily_billed_tinybar"`
+	Next30Days   int64   `json:"next_30_days_tinybar"`
+	ActiveBuyers int     `json:"active_buyers"` // buyers with a delivery in the last 24h
+}
+
+// GET /revenue?from=&to= with RFC3339 or unix-second bounds; defaults to
+// the last 30 days.
+func revenueHandler(w http.ResponseWriter, r *http.Request) {
+	if deliveries == nil {
+		writeJSONError(w, ErrDisabled.With("delivery log disabled (DELIVERY_LOG_ENABLE=false)"))
+		return
+	}
+	q := r.URL.Query()
+	now := time.Now()
+	to, err := parseTimeParam(q.Get("to"), now)
+	if err != nil {
+		writeJSONError(w, ErrBadRequest.With("invalid to: "+err.Error()))
+		return
+	}
+	from, err := parseTimeParam(q.Get("from"), to.AddDate(0, 0, -30))
+	if err != nil {
+		writeJSONError(w, ErrBadRequest.With("invalid from: "+err.Error()))
+		return
+	}
+
+	recs, err := deliveries.Query("", from, to)
+	if err != nil {
+		writeJSONError(w, ErrInternal.Wrap(err))
+		return
+	}
+	byBuyer := map[string]*buyerRevenue{}
+	byPayer := map[string]*buyerRevenue{}
+	var totals revenueTotals
+	active := map[string]bool{}
+	var firstTs int64
+	for _, rec := range recs {
+		b := byBuyer[rec.Buyer]
+		if b == nil {
+			b = &buyerRevenue{Buyer: rec.Buyer}
+			byBuyer[rec.Buyer] = b
+		}
+		if rec.Account != "" {
+			b.Account = rec.Account
+		}
+		if rec.Shared != "" {
+			b.SharedAccount = rec.Shared
+		}
+		if payer := payments.Payer(rec); payer != "" {
+			byPayer[payer] = b
+		}
+		b.Samples++
+		totals.Samples++
+		if rec.Free != "" {
+			b.FreeSamples++
+			totals.FreeSamples++
+		}
+		b.Billed += rec.Price
+		totals.Billed += rec.Price
+		b.BilledCents += rec.Cents
+		totals.BilledCents += rec.Cents
+		if rec.Currency == currencyUSD && rec.CentsPerHbar == 0 {
+			b.Unrated++
+			totals.Unrated++
+		}
+		if rec.Backfill {
+			b.Backfill++
+			totals.Backfill++
+			b.BackfillFee += rec.Price
+			totals.BackfillFee += rec.Price
+		}
+		b.LastDelivery = max(b.LastDelivery, rec.Ts)
+		if now.Unix()-rec.Ts < 86400 {
+			active[rec.Buyer] = true
+		}
+		if firstTs == 0 {
+			firstTs = rec.Ts
+		}
+	}
+
+	settlement := map[string]any{"backend": payments.Name()}
+	if payments.Name() == "hedera" {
+		settlement["account"] = hederaNet.AccountID
+	}
+	if paid, err := payments.Settled(from, to); err != nil {
+		settlement["error"] = err.Error()
+	} else {
+		for payer, amount := range paid {
+			if b := byPayer[payer]; b != nil {
+				b.Settled += amount
+				totals.Settled += amount
+			} else {
+				totals.Unattributed += amount
+			}
+		}
+	}
+
+	buyers := make([]buyerRevenue, 0, len(byBuyer))
+	for _, b := range byBuyer {
+		b.Outstanding = max(b.Billed-b.Settled, 0)
+		totals.Outstanding += b.Outstanding
+		buyers = append(buyers, *b)
+	}
+	sort.Slice(buyers, func(i, j int) bool { return buyers[i].Billed > buyers[j].Billed })
+
+	// Project from the billing rate over the span actually covered by
+	// deliveries, so a node that started yesterday doesn't average over 30
+	// days.
+	proj := revenueProjection{ActiveBuyers: len(active)}
+	if firstTs > 0 {
+		span := to.Sub(time.Unix(firstTs, 0)).Hours() / 24
+		proj.BasisDays = max(span, 1.0/24)
+		proj.DailyBilled = int64(float64(totals.Billed) / proj.BasisDays)
+		proj.Next30Days = proj.DailyBilled * 30
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"from":       from.Unix(),
+		"to":         to.Unix(),
+		"pricing":    pricingSummary(),
+		"buyers":     buyers,
+		"totals":     totals,
+		"projection": proj,
+		"settlement": settlement,
+	})
+}
+
+// fetchSettlements sums, per paying account, the HBAR that left it in
+// successful transfers crediting account between from and to.
+func fetchSettlements(account string, from, to time.Time) (map[string]int64, error) {
+	base := strings.TrimRight(getEnvOrDefault("mirror_api_url", hederaNet.MirrorURL), "/")
+	q := url.Values{}
+	q.Set("account.id", account)
+	q.Set("transactiontype", "CRYPTOTRANSFER")
+	q.Set("result", "success")
+	q.Set("order", "asc")
+	q.Set("limit", "100")
+	q.Add("timestamp", "gte:"+strconv.FormatInt(from.Unix(), 10))
+	q.Add("timestamp", "lt:"+strconv.FormatInt(to.Unix(), 10))
+	next := base + "/transactions?" + q.Encode()
+
+	client := outboundClient(10 * time.Second)
+	paid := map[string]int64{}
+	for pages := 0; next != "" && pages < 50; pages++ {
+		resp, err := client.Get(next)
+		if err != nil {
+			return nil, fmt.Errorf("mirror node: %w", err)
+		}
+		var page struct {
+			Transactions []struct {
+				Transfers []struct {
+					Account string `json:"account"`
+					Amount  int64  `json:"amount"`
+				} `json:"transfers"`
+			} `json:"transactions"`
+			Links struct {
+				Next string `json:"next"`
+			} `json:"links"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("mirror node: %s", resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("mirror node: %w", err)
+		}
+
+		for _, tx := range page.Transactions {
+			credited := false
+			for _, t := range tx.Transfers {
+				credited = credited || (t.Account == account && t.Amount > 0)
+			}
+			if !credited {
+				continue
+			}
+			for _, t := range tx.Transfers {
+				if t.Amount < 0 && t.Account != account {
+					paid[t.Account] += -t.Amount
+				}
+			}
+		}
+
+		next = ""
+		if page.Links.Next != "" {
+			// links.next is "/api/v1/transactions?..." relative to the host.
+			u, err := url.Parse(base)
+			if err != nil {
+				return nil, err
+			}
+			next = u.Scheme + "://" + u.Host + page.Links.Next
+		}
+	}
+	return paid, nil
+}
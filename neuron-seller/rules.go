@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Edge rules let the node drive local actuators (lights, relays) from its
+// own readings while it keeps selling them. RULES_FILE (see
+// rules.example.json) lists rules; each has a threshold on a kind's value
+// (above and/or below), local time windows (HH:MM-HH:MM, in SCHEDULE_TZ), or
+// both. A rule turns on once its condition has held for for_seconds, and off
+// once it hasn't for as long, so a reading hovering at the threshold doesn't
+// flap the lights. On turning on it runs its "on" action, on turning off its
+// "off" action:
+//
+//   - gpio: runs GPIO_SET_COMMAND (default libgpiod's gpioset) with {chip},
+//     {pin} and {value}.
+//   - webhook: sends method (default POST) to url with body, or a JSON
+//     description of the change.
+//   - mqtt: publishes payload to topic on broker (mqtt:// or mqtts://), QoS 0.
+//
+// Bodies and payloads may use {rule}, {state}, {kind} and {value}. Rules are
+// evaluated on every sample of their kind and every 15 seconds for window
+// changes; actions run in the background and are recorded in the audit log.
+// GET /admin/rules shows every rule's state.
+
+type ruleAction struct {
+	Type string `json:"type"` // gpio, webhook or mqtt
+
+	Chip  string `json:"chip,omitempty"`
+	Pin   int    `json:"pin,omitempty"`
+	Value int    `json:"value,omitempty"`
+
+	URL    string `json:"url,omitempty"`
+	Method string `json:"method,omitempty"`
+	Body   string `json:"body,omitempty"`
+
+	Broker   string `json:"broker,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+	Payload  string `json:"payload,omitempty"`
+	Retain   bool   `json:"retain,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+type edgeRule struct {
+	Name       string      `json:"name"`
+	Kind       string      `json:"kind,omitempty"`
+	Above      *float64    `json:"above,omitempty"`
+	Below      *float64    `json:"below,omitempty"`
+	Windows    []string    `json:"windows,omitempty"`
+	ForSeconds int         `json:"for_seconds,omitempty"`
+	On         *ruleAction `json:"on,omitempty"`
+	Off        *ruleAction `json:"off,omitempty"`
+
+	windows []timeWindow
+	active  bool
+	pending time.Time // when the condition started disagreeing with active
+	changed time.Time
+	lastErr string
+}
+
+type ruleEngine struct {
+	gpioCmd string
+	loc     *time.Location
+
+	mu     sync.Mutex
+	rules  []*edgeRule
+	values map[string]float64
+}
+
+var rules *ruleEngine
+
+func loadRules() {
+	path := getEnvOrDefault("RULES_FILE", "rules.json")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("rules: read %s: %v", path, err)
+	}
+	var doc struct {
+		Rules []*edgeRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		log.Fatalf("rules: parse %s: %v", path, err)
+	}
+	neuron, _ := getNeuronSellerConfig()
+	neuron = neuron.ensureDefaults()
+	for i, r := range doc.Rules {
+		if err := r.validate(neuron); err != nil {
+			log.Fatalf("rules: %s: rule %d: %v", path, i, err)
+		}
+	}
+	rules = &ruleEngine{
+		gpioCmd: getEnvOrDefault("GPIO_SET_COMMAND", "gpioset {chip} {pin}={value}"),
+		loc:     schedule.location,
+		rules:   doc.Rules,
+		values:  make(map[string]float64),
+	}
+	go rules.run()
+	go rules.follow(sampleBus.Subscribe("rules", 64))
+	log.Printf("Rules     : %d from %s", len(doc.Rules), path)
+}
+
+func (r *edgeRule) validate(neuron neuronSellerConfig) error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if r.Kind == "" && len(r.Windows) == 0 {
+		return fmt.Errorf("%s: needs a kind threshold or windows", r.Name)
+	}
+	if r.Kind != "" {
+		if _, ok := neuron.kindByName(r.Kind); !ok {
+			return fmt.Errorf("%s: unknown kind %q", r.Name, r.Kind)
+		}
+		if r.Above == nil && r.Below == nil {
+			return fmt.Errorf("%s: kind %s needs above or below", r.Name, r.Kind)
+		}
+	}
+	for _, spec := range r.Windows {
+		w, err := parseTimeWindow(spec)
+		if err != nil {
+			return fmt.Errorf("%s: %w", r.Name, err)
+		}
+		r.windows = append(r.windows, w)
+	}
+	if r.On == nil && r.Off == nil {
+		return fmt.Errorf("%s: needs an on or off action", r.Name)
+	}
+	for _, a := range []*ruleAction{r.On, r.Off} {
+		if a == nil {
+			continue
+		}
+		switch a.Type {
+		case "gpio":
+		case "webhook":
+			if a.URL == "" {
+				return fmt.Errorf("%s: webhook needs a url", r.Name)
+			}
+		case "mqtt":
+			if a.Broker == "" || a.Topic == "" {
+				return fmt.Errorf("%s: mqtt needs a broker and a topic", r.Name)
+			}
+		default:
+			return fmt.Errorf("%s: unknown action type %q", r.Name, a.Type)
+		}
+	}
+	return nil
+}
+
+// Observe feeds a sample to the rules on its kind.
+func (e *ruleEngine) Observe(kind string, value float64, now time.Time) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.values[kind] = value
+	for _, r := range e.rules {
+		if r.Kind == kind {
+			e.evaluate(r, now)
+		}
+	}
+}
+
+// follow observes every sample sent.
+func (e *ruleEngine) follow(sub *busSub[busSample]) {
+	for smp := range sub.C() {
+		e.Observe(smp.Kind, smp.Value, time.Now())
+	}
+}
+
+func (e *ruleEngine) run() {
+	t := time.NewTicker(15 * time.Second)
+	defer t.Stop()
+	for now := range t.C {
+		e.mu.Lock()
+		for _, r := range e.rules {
+			e.evaluate(r, now)
+		}
+		e.mu.Unlock()
+	}
+}
+
+// evaluate moves r towards its condition; called with e.mu held.
+func (e *ruleEngine) evaluate(r *edgeRule, now time.Time) {
+	want, ok := e.condition(r, now)
+	if !ok {
+		return
+	}
+	if want == r.active {
+		r.pending = time.Time{}
+		return
+	}
+	if r.pending.IsZero() {
+		r.pending = now
+	}
+	if now.Sub(r.pending) < time.Duration(r.ForSeconds)*time.Second {
+		return
+	}
+	r.active, r.pending, r.changed = want, time.Time{}, now
+	action, state := r.Off, "off"
+	if want {
+		action, state = r.On, "on"
+	}
+	log.Printf("rules: %s turned %s", r.Name, state)
+	if action != nil {
+		value := e.values[r.Kind]
+		go e.fire(r, action, state, value)
+	}
+}
+
+// condition is whether r should be on; false ok while its kind has no
+// reading yet.
+func (e *ruleEngine) condition(r *edgeRule, now time.Time) (bool, bool) {
+	if len(r.windows) > 0 {
+		local := now.In(e.loc)
+		minute := local.Hour()*60 + local.Minute()
+		in := false
+		for _, w := range r.windows {
+			in = in || w.contains(minute)
+		}
+		if !in {
+			return false, true
+		}
+	}
+	if r.Kind == "" {
+		return true, true
+	}
+	value, ok := e.values[r.Kind]
+	if !ok {
+		return false, false
+	}
+	return (r.Above == nil || value > *r.Above) && (r.Below == nil || value < *r.Below), true
+}
+
+func (e *ruleEngine) fire(r *edgeRule, a *ruleAction, state string, value float64) {
+	expand := strings.NewReplacer(
+		"{rule}", r.Name,
+		"{state}", state,
+		"{kind}", r.Kind,
+		"{value}", strconv.FormatFloat(value, 'f', -1, 64),
+	).Replace
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	var err error
+	switch a.Type {
+	case "gpio":
+		err = e.setGPIO(ctx, a)
+	case "webhook":
+		body := expand(a.Body)
+		if a.Body == "" {
+			data, _ := json.Marshal(map[string]any{"rule": r.Name, "state": state, "kind": r.Kind, "value": value, "seller_id": sellerCfg.SellerID})
+			body = string(data)
+		}
+		err = ruleWebhook(ctx, a, body)
+	case "mqtt":
+		err = mqttPublish(ctx, a, expand(a.Payload))
+	}
+
+	result := "ok"
+	e.mu.Lock()
+	r.lastErr = ""
+	if err != nil {
+		result = "error"
+		r.lastErr = err.Error()
+		log.Printf("rules: %s %s action (%s) failed: %v", r.Name, state, a.Type, err)
+	}
+	e.mu.Unlock()
+	audit.Record("rules", "node", "rule_"+state, result, map[string]any{"rule": r.Name, "action": a.Type, "kind": r.Kind, "value": value})
+}
+
+func (e *ruleEngine) setGPIO(ctx context.Context, a *ruleAction) error {
+	chip := a.Chip
+	if chip == "" {
+		chip = "gpiochip0"
+	}
+	args := strings.Fields(e.gpioCmd)
+	for i := range args {
+		args[i] = strings.NewReplacer("{chip}", chip, "{pin}", strconv.Itoa(a.Pin), "{value}", strconv.Itoa(a.Value)).Replace(args[i])
+	}
+	if out, err := runShell(ctx, args[0], args[1:]...); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+func ruleWebhook(ctx context.Context, a *ruleAction, body string) error {
+	method := a.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, a.URL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(body, "{") {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", a.URL, resp.Status)
+	}
+	return nil
+}
+
+// mqttPublish connects, publishes one QoS 0 message and disconnects
+// (MQTT 3.1.1).
+func mqttPublish(ctx context.Context, a *ruleAction, payload string) error {
+	u, err := url.Parse(a.Broker)
+	if err != nil {
+		return fmt.Errorf("broker %q: %w", a.Broker, err)
+	}
+	host := u.Host
+	var d net.Dialer
+	var conn net.Conn
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "1883")
+		}
+		conn, err = d.DialContext(ctx, tcpNetwork(), host)
+	case "mqtts", "ssl", "tls":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "8883")
+		}
+		td := tls.Dialer{NetDialer: &d, Config: &tls.Config{ServerName: u.Hostname()}}
+		conn, err = td.DialContext(ctx, tcpNetwork(), host)
+	default:
+		return fmt.Errorf("broker %q: scheme must be mqtt or mqtts", a.Broker)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var connect []byte
+	connect = appendMQTTString(connect, "MQTT")
+	flags := byte(0x02) // clean session
+	if a.Username != "" {
+		flags |= 0x80
+		if a.Password != "" {
+			flags |= 0x40
+		}
+	}
+	connect = append(connect, 4, flags, 0, 30)
+	connect = appendMQTTString(connect, "localsense-"+sellerCfg.SellerID)
+	if a.Username != "" {
+		connect = appendMQTTString(connect, a.Username)
+		if a.Password != "" {
+			connect = appendMQTTString(connect, a.Password)
+		}
+	}
+	if _, err := conn.Write(mqttPacket(0x10, connect)); err != nil {
+		return err
+	}
+	var ack [4]byte
+	if _, err := io.ReadFull(conn, ack[:]); err != nil {
+		return fmt.Errorf("connack: %w", err)
+	}
+	if ack[0] != 0x20 || ack[3] != 0 {
+		return fmt.Errorf("broker refused the connection (code %d)", ack[3])
+	}
+
+	publish := append(appendMQTTString(nil, a.Topic), payload...)
+	header := byte(0x30)
+	if a.Retain {
+		header |= 0x01
+	}
+	if _, err := conn.Write(mqttPacket(header, publish)); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte{0xe0, 0})
+	return err
+}
+
+func appendMQTTString(dst []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint16(dst, uint16(len(s))), s...)
+}
+
+// mqttPacket prefixes body with the fixed header.
+func mqttPacket(header byte, body []byte) []byte {
+	out := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(out, body...)
+}
+
+// GET /admin/rules – edge rules and their state.
+func adminRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if rules == nil {
+		writeJSON(w, http.StatusOK, map[string]any{"rules": []any{}})
+		return
+	}
+	rules.mu.Lock()
+	defer rules.mu.Unlock()
+	out := make([]map[string]any, 0, len(rules.rules))
+	for _, rule := range rules.rules {
+		state := "off"
+		if rule.active {
+			state = "on"
+		}
+		entry := map[string]any{"rule": rule, "state": state}
+		if !rule.changed.IsZero() {
+			entry["changed"] = rule.changed.UTC().Format(time.RFC3339)
+		}
+		if value, ok := rules.values[rule.Kind]; ok {
+			entry["value"] = value
+		}
+		if rule.lastErr != "" {
+			entry["error"] = rule.lastErr
+		}
+		out = append(out, entry)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"rules": out})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The Pi is read in one place. The sampling engine runs the emission
+// schedule, fetches the Pi's metrics once a round (or takes its pushes, or
+// a fresh reading for an on-demand sample) and hands each reading to every
+// subscriber: the Neuron stream loop, each /stream client, and whatever
+// else wants samples. Before, /stream and the stream loop each polled the
+// Pi on their own clocks, doubling its load with every client.
+//
+// A round is fetched only if some subscriber wants it; otherwise the
+// subscribers still get the round, without metrics, so they can keep their
+// own state (schedule announcements) current. Readings are shared and must
+// not be modified. The subscribers are on the readings bus (see bus.go).
+
+// samplerQueue is how many readings wait for a subscriber.
+const samplerQueue = 4
+
+// reading is one round of the sampling engine.
+type reading struct {
+	At      time.Time
+	Metrics *piMetrics // nil when no subscriber wanted the round
+	Due     map[string]bool
+	Pushed  bool // from the Pi's push feed rather than a fetch
+}
+
+type samplingEngine struct {
+	pi       piPoller
+	readings *fanout[reading]
+
+	mu    sync.Mutex
+	wants map[*busSub[reading]]func(now time.Time) bool
+
+	fetches atomic.Int64
+	rounds  atomic.Int64
+}
+
+var sampler *samplingEngine
+
+func startSampler() {
+	if emissions == nil {
+		return
+	}
+	sampler = &samplingEngine{
+		readings: newFanout[reading]("readings"),
+		wants:    make(map[*busSub[reading]]func(now time.Time) bool),
+	}
+	go sampler.run()
+}
+
+// Subscribe starts delivering readings to the named subscriber until
+// Unsubscribe. wants says whether it needs a sample at now; nil means
+// always.
+func (e *samplingEngine) Subscribe(name string, wants func(now time.Time) bool) *busSub[reading] {
+	if e == nil {
+		return nil
+	}
+	sub := e.readings.Subscribe(name, samplerQueue)
+	e.mu.Lock()
+	e.wants[sub] = wants
+	e.mu.Unlock()
+	return sub
+}
+
+func (e *samplingEngine) Unsubscribe(sub *busSub[reading]) {
+	if e == nil || sub == nil {
+		return
+	}
+	e.readings.Unsubscribe(sub)
+	e.mu.Lock()
+	delete(e.wants, sub)
+	e.mu.Unlock()
+}
+
+// wanted reports whether any subscriber needs a sample at now. Nobody
+// does while the node is under maintenance.
+func (e *samplingEngine) wanted(now time.Time) bool {
+	if underMaintenance() {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, wants := range e.wants {
+		if wants == nil || wants(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *samplingEngine) publish(r reading) {
+	e.rounds.Add(1)
+	e.readings.Publish(r)
+}
+
+func (e *samplingEngine) run() {
+	emissions.Start(time.Now())
+	timer := time.NewTimer(emissions.Wait(time.Now()))
+	defer timer.Stop()
+
+	for {
+		select {
+		case tick := <-timer.C:
+			due := emissions.Due(tick)
+			timer.Reset(emissions.Wait(time.Now()))
+			if len(due) == 0 {
+				continue
+			}
+			if !e.wanted(tick) {
+				nodeHealth.Idle(tick)
+				e.publish(reading{At: tick, Due: due})
+				continue
+			}
+			if piFeed.Live() {
+				// Samples come with the Pi's pushes instead.
+				continue
+			}
+
+			metrics, err := e.pi.Fetch()
+			observePi(err == nil || errors.Is(err, errPiUnchanged), err)
+			if errors.Is(err, errPiUnchanged) {
+				continue
+			}
+			if err != nil {
+				log.Printf("sampler: unable to fetch Pi metrics: %v", err)
+				continue
+			}
+			e.fetches.Add(1)
+			e.publish(reading{At: tick, Metrics: metrics, Due: due})
+		case metrics := <-piFeed.Updates():
+			now := time.Now()
+			observePi(true, nil)
+			due := emissions.PushDue(now)
+			if len(due) == 0 || !e.wanted(now) {
+				continue
+			}
+			e.publish(reading{At: now, Metrics: metrics, Due: due, Pushed: true})
+		case metrics := <-pluginSources:
+			now := time.Now()
+			due := emissions.PushDue(now)
+			if len(due) == 0 || !e.wanted(now) {
+				continue
+			}
+			e.publish(reading{At: now, Metrics: metrics, Due: due, Pushed: true})
+		case kind := <-emissions.Demands():
+			now := time.Now()
+			if !e.wanted(now) {
+				continue
+			}
+			// A poller of its own, so the reading is taken even if it
+			// hasn't changed since the last round.
+			var fresh piPoller
+			metrics, err := fresh.Fetch()
+			observePi(err == nil, err)
+			if err != nil {
+				log.Printf("sampler: on-demand sample: unable to fetch Pi metrics: %v", err)
+				continue
+			}
+			e.fetches.Add(1)
+			e.publish(reading{At: now, Metrics: metrics, Due: emissions.Demanded(kind)})
+		}
+	}
+}
+
+func writeSamplerMetrics(w http.ResponseWriter) {
+	if sampler == nil {
+		return
+	}
+	subs := sampler.readings.Len()
+	fmt.Fprintln(w, "# HELP localsense_sampler_subscribers Subscribers to the sampling engine.")
+	fmt.Fprintln(w, "# TYPE localsense_sampler_subscribers gauge")
+	fmt.Fprintf(w, "localsense_sampler_subscribers %d\n", subs)
+	fmt.Fprintln(w, "# HELP localsense_sampler_rounds_total Readings handed to subscribers.")
+	fmt.Fprintln(w, "# TYPE localsense_sampler_rounds_total counter")
+	fmt.Fprintf(w, "localsense_sampler_rounds_total %d\n", sampler.rounds.Load())
+	fmt.Fprintln(w, "# HELP localsense_sampler_fetches_total Pi metrics fetched by the sampling engine.")
+	fmt.Fprintln(w, "# TYPE localsense_sampler_fetches_total counter")
+	fmt.Fprintf(w, "localsense_sampler_fetches_total %d\n", sampler.fetches.Load())
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+)
+
+// dutySchedule decides when the seller broadcasts. Windows ("06:00-22:00")
+// and a cron expression are OR-ed; with neither configured the node is
+// always active.
+type dutySchedule struct {
+	windows  []timeWindow
+	cron     *cronExpr
+	cronSpec string
+	location *time.Location
+}
+
+type timeWindow struct {
+	start, end int // minutes since midnight; end < start wraps past midnight
+	spec       string
+}
+
+type scheduleAnnouncement struct {
+	MessageType string    `json:"messageType"`
+	SellerID    string    `json:"seller_id"`
+	State       string    `json:"state"`
+	NextChange  time.Time `json:"next_change,omitempty"`
+	Windows     []string  `json:"windows,omitempty"`
+	Cron        string    `json:"cron,omitempty"`
+	Version     string    `json:"v"`
+}
+
+var schedule = &dutySchedule{location: time.Local}
+
+func loadSchedule() {
+	loc := time.Local
+	if tz := getEnvOrDefault("SCHEDULE_TZ", ""); tz != "" {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Fatalf("schedule: invalid SCHEDULE_TZ %q: %v", tz, err)
+		}
+		loc = l
+	}
+
+	sched := &dutySchedule{location: loc}
+	for _, spec := range strings.Split(getEnvOrDefault("SCHEDULE_WINDOWS", ""), ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		w, err := parseTimeWindow(spec)
+		if err != nil {
+			log.Fatalf("schedule: %v", err)
+		}
+		sched.windows = append(sched.windows, w)
+	}
+	if spec := getEnvOrDefault("SCHEDULE_CRON", ""); spec != "" {
+		c, err := parseCron(spec)
+		if err != nil {
+			log.Fatalf("schedule: invalid SCHEDULE_CRON %q: %v", spec, err)
+		}
+		sched.cron = c
+		sched.cronSpec = spec
+	}
+
+	schedule = sched
+	if sched.configured() {
+		log.Printf("Schedule  : windows=%v cron=%q tz=%s", sched.windowSpecs(), sched.cronSpec, loc)
+	}
+}
+
+func (d *dutySchedule) configured() bool {
+	return len(d.windows) > 0 || d.cron != nil
+}
+
+func (d *dutySchedule) Active(t time.Time) bool {
+	if !d.configured() {
+		return true
+	}
+	t = t.In(d.location)
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range d.windows {
+		if w.contains(minute) {
+			return true
+		}
+	}
+	return d.cron != nil && d.cron.matches(t)
+}
+
+// NextChange finds the next minute at which Active flips, looking one week
+// ahead. It returns the zero time if the state never changes.
+func (d *dutySchedule) NextChange(from time.Time) time.Time {
+	if !d.configured() {
+		return time.Time{}
+	}
+	current := d.Active(from)
+	t := from.Truncate(time.Minute)
+	for i := 0; i < 7*24*60; i++ {
+		t = t.Add(time.Minute)
+		if d.Active(t) != current {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (d *dutySchedule) windowSpecs() []string {
+	specs := make([]string, 0, len(d.windows))
+	for _, w := range d.windows {
+		specs = append(specs, w.spec)
+	}
+	return specs
+}
+
+func (w timeWindow) contains(minute int) bool {
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+func parseTimeWindow(spec string) (timeWindow, error) {
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return timeWindow{}, fmt.Errorf("window %q must look like HH:MM-HH:MM", spec)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("window %q: %w", spec, err)
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("window %q: %w", spec, err)
+	}
+	return timeWindow{start: start, end: end, spec: spec}, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// cronExpr is a standard 5-field cron expression (minute hour dom month dow)
+// supporting *, lists, ranges and steps.
+type cronExpr struct {
+	minute, hour, dom, month, dow map[int]bool
+	domStar, dowStar              bool
+}
+
+func parseCron(spec string) (*cronExpr, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := make([]map[int]bool, 5)
+	for i, f := range fields {
+		set, err := parseCronField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("field %d (%q): %w", i+1, f, err)
+		}
+		sets[i] = set
+	}
+	if sets[4][7] {
+		sets[4][0] = true // both 0 and 7 mean Sunday
+	}
+	return &cronExpr{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domStar: fields[2] == "*", dowStar: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, lo, hi int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if base, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step %q", s)
+			}
+			step = n
+			part = base
+		}
+
+		from, to := lo, hi
+		if part != "*" {
+			a, b, isRange := strings.Cut(part, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil {
+				return nil, fmt.Errorf("invalid value %q", a)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil {
+					return nil, fmt.Errorf("invalid value %q", b)
+				}
+			} else if step > 1 {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return nil, fmt.Errorf("range %d-%d outside %d-%d", from, to, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (c *cronExpr) matches(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	domOK := c.dom[t.Day()]
+	dowOK := c.dow[int(t.Weekday())]
+	switch {
+	case c.domStar && c.dowStar:
+		return true
+	case c.domStar:
+		return dowOK
+	case c.dowStar:
+		return domOK
+	default:
+		// Cron semantics: when both are restricted either may match.
+		return domOK || dowOK
+	}
+}
+
+// announceSchedule tells every connected buyer that the node is going
+// quiescent or resuming, via their stdin topic.
+func (s *neuronSeller) announceSchedule(buffers *commonlib.NodeBuffers, active bool, now time.Time) {
+	state := "quiescent"
+	if active {
+		state = "active"
+	}
+	msg := scheduleAnnouncement{
+		MessageType: "localsenseSchedule",
+		SellerID:    sellerCfg.SellerID,
+		State:       state,
+		NextChange:  schedule.NextChange(now),
+		Windows:     schedule.windowSpecs(),
+		Cron:        schedule.cronSpec,
+		Version:     "0.1",
+	}
+
+	log.Printf("neuron-seller: schedule now %s (next change %s)", state, msg.NextChange.Format(time.RFC3339))
+	for peerID, bufferInfo := range buffers.GetBufferMap() {
+		if !buyerPaid(bufferInfo) {
+			continue
+		}
+		env := types.TopicPostalEnvelope{
+			Message:         msg,
+			OtherStdInTopic: bufferInfo.RequestOrResponse.OtherStdInTopic,
+		}
+		go func() {
+			if err := sendEnvelope(env, "schedule announcement"); err != nil && !errors.Is(err, errHederaQueued) {
+				log.Printf("neuron-seller: schedule announcement to %s failed: %v", peerID, err)
+			}
+		}()
+	}
+}
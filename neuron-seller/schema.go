@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// Every payload names the JSON Schema it conforms to in schema_id, and
+// GET /schema serves that schema so buyers can validate samples and generate
+// decoders. Operators bump PAYLOAD_SCHEMA_VERSION whenever they change what
+// a payload carries (new kinds, units, fields).
+
+func payloadSchemaVersion() string {
+	return getEnvOrDefault("PAYLOAD_SCHEMA_VERSION", "1")
+}
+
+func payloadSchemaID() string {
+	return "urn:localsense:sample:v" + payloadSchemaVersion()
+}
+
+// payloadSchema describes the sample payload for the configured kinds.
+func payloadSchema() map[string]any {
+	neuron, _ := getNeuronSellerConfig()
+
+	number := map[string]any{"type": "number"}
+	properties := map[string]any{
+		"schema_id":      map[string]any{"const": payloadSchemaID()},
+		"ts":             map[string]any{"type": "integer", "description": "sample time, unix seconds"},
+		"ts_iso":         map[string]any{"type": "string", "format": "date-time"},
+		"seq":            map[string]any{"type": "integer", "minimum": 1, "description": "per-kind sequence number"},
+		"id":             map[string]any{"type": "string", "pattern": "^[0-7][0-9A-HJKMNP-TV-Z]{25}$", "description": "sample ULID, unique across sellers"},
+		"value":          map[string]any{"type": "number", "description": "the reading, in unit"},
+		"seller_id":      map[string]any{"type": "string"},
+		"source":         map[string]any{"type": "string"},
+		"label":          map[string]any{"type": "string"},
+		"lat":            number,
+		"lon":            number,
+		"power_mode":     map[string]any{"enum": []powerMode{powerNormal, powerSaver, powerCritical}},
+		"network":        map[string]any{"enum": []string{"testnet", "previewnet", "mainnet"}, "description": "Hedera network the seller is registered on"},
+		"license_sha256": map[string]any{"type": "string", "pattern": "^[0-9a-f]{64}$"},
+		"ttl":            map[string]any{"type": "integer", "minimum": 1, "description": "seconds the sample stays valid"},
+		"expires_at":     map[string]any{"type": "integer", "description": "unix seconds; drop the sample after this"},
+		"sig":            map[string]any{"type": "string", "pattern": "^[0-9a-f]{128}$", "description": "ed25519 signature, see signing_pubkey on /device"},
+		"provenance": map[string]any{
+			"type":        "object",
+			"description": "present on derived values: the transform applied and the source samples",
+			"properties": map[string]any{
+				"transform": map[string]any{"type": "string"},
+				"params":    map[string]any{"type": "object"},
+				"sources": map[string]any{
+					"type": "array",
+					"items": map[string]any{
+						"type":     "object",
+						"required": []string{"seller_id", "kind"},
+					},
+				},
+			},
+			"required": []string{"transform", "sources"},
+		},
+		"uncertainty": map[string]any{
+			"type":        "object",
+			"description": "standard uncertainty of value, in unit: sigma combines the sensor spec, calibration drift and recent noise",
+			"properties": map[string]any{
+				"sigma":                map[string]any{"type": "number", "minimum": 0},
+				"spec":                 number,
+				"drift":                number,
+				"calibration_age_days": map[string]any{"type": "integer"},
+				"noise":                number,
+			},
+			"required": []string{"sigma"},
+		},
+		"aqi": map[string]any{
+			"type":        "object",
+			"description": "US EPA AQI of a PM2.5 or PM10 reading (indicative: the EPA uses 24-hour averages)",
+			"properties": map[string]any{
+				"value":     map[string]any{"type": "integer", "minimum": 0, "maximum": 500},
+				"category":  map[string]any{"enum": aqiCategories},
+				"pollutant": map[string]any{"enum": []string{"pm2_5", "pm10"}},
+			},
+			"required": []string{"value", "category", "pollutant"},
+		},
+		"solar": map[string]any{
+			"type":        "object",
+			"description": "the sun's geometric position over the seller at ts",
+			"properties": map[string]any{
+				"elevation_deg": map[string]any{"type": "number", "minimum": -90, "maximum": 90},
+				"azimuth_deg":   map[string]any{"type": "number", "minimum": 0, "exclusiveMaximum": 360, "description": "clockwise from true north"},
+			},
+			"required": []string{"elevation_deg", "azimuth_deg"},
+		},
+		"event": map[string]any{
+			"type":        "object",
+			"description": "state change of an event kind (motion, door): value is the new state",
+			"properties": map[string]any{
+				"edge":           map[string]any{"enum": []string{"rise", "fall"}},
+				"count":          map[string]any{"type": "integer", "minimum": 0, "description": "rises so far in the window"},
+				"debounced":      map[string]any{"type": "integer", "description": "changes dropped as bounce in the window"},
+				"window_start":   map[string]any{"type": "integer", "description": "unix seconds"},
+				"window_seconds": map[string]any{"type": "integer", "minimum": 1},
+			},
+			"required": []string{"edge", "count", "window_start", "window_seconds"},
+		},
+		"sound": map[string]any{
+			"type":        "object",
+			"description": "window a sound level sample's LAeq value covers; readings are never sent one by one",
+			"properties": map[string]any{
+				"window_start":   map[string]any{"type": "integer", "description": "unix seconds"},
+				"window_seconds": map[string]any{"type": "integer", "minimum": 1},
+				"readings":       map[string]any{"type": "integer", "minimum": 1},
+				"lamin":          number,
+				"lamax":          number,
+				"bands": map[string]any{
+					"type":        "array",
+					"description": "A-weighted octave band LAeq over the window",
+					"items": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"hz":       number,
+							"laeq":     number,
+							"readings": map[string]any{"type": "integer"},
+						},
+						"required": []string{"hz", "laeq"},
+					},
+				},
+			},
+			"required": []string{"window_start", "window_seconds", "readings"},
+		},
+		"labels": map[string]any{
+			"type":                 "object",
+			"description":          "label by BCP 47 language tag; label is the fallback",
+			"additionalProperties": map[string]any{"type": "string"},
+		},
+		"descriptions": map[string]any{
+			"type":                 "object",
+			"description":          "seller description by BCP 47 language tag",
+			"additionalProperties": map[string]any{"type": "string"},
+		},
+		"derived": map[string]any{
+			"type":        "object",
+			"description": "fields computed by the seller's DERIVED_FIELDS expressions",
+		},
+		"tags": map[string]any{
+			"type":                 "object",
+			"description":          "operator tags (deployment, campaign); filter with ?tag=key:value",
+			"additionalProperties": map[string]any{"type": "string"},
+		},
+		"weather": map[string]any{
+			"type":        "object",
+			"description": "conditions from the seller's weather API at observed_at, for normalising readings",
+			"properties": map[string]any{
+				"cloud_cover_pct":         number,
+				"solar_elevation_deg":     number,
+				"shortwave_radiation_wm2": number,
+				"observed_at":             map[string]any{"type": "integer", "description": "unix seconds"},
+				"source":                  map[string]any{"type": "string"},
+			},
+			"required": []string{"observed_at", "source"},
+		},
+	}
+
+	var kinds, units []string
+	seenUnit := map[unit]bool{}
+	var variants []any
+	for _, k := range neuron.Kinds {
+		kinds = append(kinds, k.Name)
+		if !seenUnit[k.Conversion.To] {
+			seenUnit[k.Conversion.To] = true
+			units = append(units, string(k.Conversion.To))
+		}
+		if _, ok := properties[k.Field]; !ok {
+			properties[k.Field] = number
+		}
+		variant := map[string]any{
+			"kind": map[string]any{"const": k.Name},
+			"unit": map[string]any{"const": k.Conversion.To},
+		}
+		if k.Range != nil {
+			value := map[string]any{"type": "number"}
+			if k.Range.Min != nil {
+				value["minimum"] = *k.Range.Min
+			}
+			if k.Range.Max != nil {
+				value["maximum"] = *k.Range.Max
+			}
+			variant["value"] = value
+		}
+		variants = append(variants, map[string]any{
+			"properties": variant,
+			"required":   []string{k.Field},
+		})
+	}
+	properties["kind"] = map[string]any{"enum": kinds}
+	properties["unit"] = map[string]any{"enum": units}
+
+	return map[string]any{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"$id":                  payloadSchemaID(),
+		"title":                "LocalSense sample payload",
+		"type":                 "object",
+		"properties":           properties,
+		"required":             []string{"schema_id", "ts", "kind", "unit", "value", "seller_id"},
+		"oneOf":                variants,
+		"additionalProperties": true,
+	}
+}
+
+// GET /schema[?format=avro|lorawan] – JSON Schema of the sample payload,
+// the Avro writer schema with its fingerprint, or the LoRaWAN uplink codec
+// with its decoder.
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	var schema any = payloadSchema()
+	switch r.URL.Query().Get("format") {
+	case codecAvro:
+		schema = avroSchemaInfo()
+	case "lorawan":
+		schema = loraSchemaInfo()
+	}
+	data, err := json.Marshal(schema)
+	if err != nil {
+		writeJSONError(w, ErrInternal.Wrap(err))
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// `localsense selftest` checks a fresh install end to end without a real
+// buyer or Hedera: it dials the node's own libp2p host from loopback on
+// selftestProtocol and gets every sample as a buyer would, signed, one
+// JSON line each; `localsense loadtest` opens many such streams at once.
+// Only loopback peers are served, and sampling runs while one is connected
+// even without buyers. /status lists the loopback addresses to dial under
+// "selftest". SELFTEST_ENABLE=false turns it off.
+
+const selftestProtocol protocol.ID = "/localsense/selftest/v1"
+
+var selftests struct {
+	active atomic.Int32
+	mu     sync.Mutex
+	addrs  []string
+}
+
+func startSelftest(p2pHost host.Host) {
+	if !parseEnvBool("SELFTEST_ENABLE", true) {
+		return
+	}
+	p2pHost.SetStreamHandler(selftestProtocol, serveSelftest)
+	var addrs []string
+	for _, a := range p2pHost.Addrs() {
+		if loopbackAddr(a) {
+			addrs = append(addrs, a.String()+"/p2p/"+p2pHost.ID().String())
+		}
+	}
+	selftests.mu.Lock()
+	selftests.addrs = addrs
+	selftests.mu.Unlock()
+}
+
+// selftestActive reports whether a selftest is connected.
+func selftestActive() bool {
+	return selftests.active.Load() > 0
+}
+
+func selftestStatus() map[string]any {
+	selftests.mu.Lock()
+	defer selftests.mu.Unlock()
+	if selftests.addrs == nil {
+		return nil
+	}
+	return map[string]any{"protocol": selftestProtocol, "addrs": selftests.addrs, "active": selftests.active.Load()}
+}
+
+func serveSelftest(s network.Stream) {
+	defer s.Close()
+	if !loopbackAddr(s.Conn().RemoteMultiaddr()) {
+		log.Printf("neuron-seller: selftest from %s refused: not loopback", s.Conn().RemoteMultiaddr())
+		s.Reset()
+		return
+	}
+	selftests.active.Add(1)
+	defer selftests.active.Add(-1)
+	sub := sampleBus.Subscribe("selftest#", 64)
+	defer sampleBus.Unsubscribe(sub)
+	log.Printf("neuron-seller: selftest connected")
+
+	for smp := range sub.C() {
+		s.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		line := append(append(make([]byte, 0, len(smp.Payload)+1), smp.Payload...), '\n')
+		if _, err := s.Write(line); err != nil {
+			log.Printf("neuron-seller: selftest disconnected: %v", err)
+			return
+		}
+	}
+}
+
+// loopbackAddr reports whether a is an IPv4 or IPv6 loopback address.
+func loopbackAddr(a ma.Multiaddr) bool {
+	if a == nil {
+		return false
+	}
+	for _, code := range []int{ma.P_IP4, ma.P_IP6} {
+		if v, err := a.ValueForProtocol(code); err == nil {
+			ip := net.ParseIP(strings.TrimSpace(v))
+			return ip != nil && ip.IsLoopback()
+		}
+	}
+	return false
+}
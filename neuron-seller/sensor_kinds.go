@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// sensorKind maps one reading from the Pi /metrics document to the protocol
+// its buyers subscribe to.
+type sensorKind struct {
+	Name     string      `json:"name"`
+	Field    string      `json:"field"`
+	Protocol protocol.ID `json:"protocol"`
+
+	Conversion unitConversion `json:"conversion"`
+	// TTLSeconds is how long a sample of this kind stays useful; 0 means
+	// samples never expire.
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+	// Range bounds plausible readings; nil accepts any.
+	Range *valueRange `json:"valid_range,omitempty"`
+	// Event kinds are sent when their state changes rather than every
+	// tick (see events.go).
+	Event bool `json:"event,omitempty"`
+	// FusedFrom names our kind that this one fuses with co-located
+	// sellers' readings (see fusion.go); empty for sensor readings.
+	FusedFrom string `json:"fused_from,omitempty"`
+}
+
+// parseSensorKinds reads SENSOR_KINDS, a comma separated list of
+// name:field:protocol triples, e.g.
+//
+//	brightness_sample:brightness:/localsense/brightness/v1,temperature:temperature_c:/localsense/temperature/v1
+func parseSensorKinds(spec string) ([]sensorKind, error) {
+	var kinds []sensorKind
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || !strings.HasPrefix(parts[2], "/") {
+			return nil, fmt.Errorf("sensor kind %q must look like name:field:/protocol/id", entry)
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("sensor kind %q configured twice", parts[0])
+		}
+		seen[parts[0]] = true
+		kinds = append(kinds, sensorKind{Name: parts[0], Field: parts[1], Protocol: protocol.ID(parts[2])})
+	}
+	return kinds, nil
+}
+
+// kindByName returns the configured kind with that name.
+func (c neuronSellerConfig) kindByName(name string) (sensorKind, bool) {
+	for _, k := range c.Kinds {
+		if k.Name == name {
+			return k, true
+		}
+	}
+	return sensorKind{}, false
+}
+
+// buyerWantsKind reports whether a buyer subscribed to kind. Buyers name the
+// protocol (or kind) they want in the service type of their service request;
+// buyers that didn't say get the primary kind only, as before multi-kind.
+// An old protocol of the kind still counts while it is being migrated away
+// from (see migration.go).
+// Options after a "?" in the service type are ignored here.
+func buyerWantsKind(info *commonlib.NodeBufferInfo, kind sensorKind, primary bool) bool {
+	service := requestedServiceType(info)
+	if service == "" {
+		return primary
+	}
+	return service == string(kind.Protocol) || service == kind.Name || migrations.Accepts(service, kind)
+}
+
+// requestedServiceType is the service type without buyer options.
+func requestedServiceType(info *commonlib.NodeBufferInfo) string {
+	service, _, _ := strings.Cut(rawServiceType(info), "?")
+	return service
+}
+
+// requestedServiceOptions parses options a buyer appended to its service
+// type query-string style, e.g. "/localsense/brightness/v1?max_age=30".
+func requestedServiceOptions(info *commonlib.NodeBufferInfo) url.Values {
+	_, query, ok := strings.Cut(rawServiceType(info), "?")
+	if !ok {
+		return nil
+	}
+	opts, _ := url.ParseQuery(query)
+	return opts
+}
+
+func rawServiceType(info *commonlib.NodeBufferInfo) string {
+	switch msg := info.RequestOrResponse.Message.(type) {
+	case *types.NeuronServiceRequestMsg:
+		return msg.ServiceType
+	case types.NeuronServiceRequestMsg:
+		return msg.ServiceType
+	case map[string]any:
+		// Buffers restored from disk come back as plain maps.
+		if t, ok := msg["t"].(string); ok {
+			return t
+		}
+	}
+	return ""
+}
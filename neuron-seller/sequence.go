@@ -0,0 +1,37 @@
+package main
+
+import "sync"
+
+// sampleSequencer hands out per-kind sample sequence numbers. Buyers store
+// samples keyed by (seller, kind, seq) and report gaps from it, so the
+// counters resume from the history log on restart when history is enabled.
+type sampleSequencer struct {
+	mu   sync.Mutex
+	last map[string]uint64
+}
+
+var sequencer = &sampleSequencer{last: make(map[string]uint64)}
+
+// Next returns the next sequence number for kind, starting at 1.
+func (s *sampleSequencer) Next(kind string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last[kind]++
+	return s.last[kind]
+}
+
+// Seed raises kind's counter to at least seq.
+func (s *sampleSequencer) Seed(kind string, seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq > s.last[kind] {
+		s.last[kind] = seq
+	}
+}
+
+// Last returns the most recent sequence number handed out for kind.
+func (s *sampleSequencer) Last(kind string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last[kind]
+}
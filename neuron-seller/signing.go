@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+)
+
+// sampleSigner signs every payload with the node's ed25519 key. The public
+// key is part of the device descriptor anchored on HCS, so buyers and anyone
+// a buyer re-exposes the stream to can check a sample really came from us.
+//
+// The signature covers the payload bytes exactly as marshalled and is spliced
+// in as a final "sig" member: verifiers strip the trailing `,"sig":"<hex>"}`
+// and check the signature over what remains plus the closing brace.
+type sampleSigner struct {
+	key ed25519.PrivateKey
+}
+
+var signer *sampleSigner
+
+func loadSigningKey() {
+	if !parseEnvBool("SAMPLE_SIGNING_ENABLE", true) {
+		return
+	}
+	path := getEnvOrDefault("SAMPLE_SIGNING_KEY_FILE", "signing.key")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, priv, genErr := ed25519.GenerateKey(rand.Reader)
+		if genErr != nil {
+			log.Fatalf("signing: generate key: %v", genErr)
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(priv.Seed())+"\n"), 0o600); err != nil {
+			log.Fatalf("signing: write %s: %v", path, err)
+		}
+		signer = &sampleSigner{key: priv}
+		log.Printf("Signing   : generated new key in %s (pubkey %s)", path, signer.PublicKey())
+		return
+	}
+	if err != nil {
+		log.Fatalf("signing: read %s: %v", path, err)
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		log.Fatalf("signing: %s must hold a hex ed25519 seed", path)
+	}
+	signer = &sampleSigner{key: ed25519.NewKeyFromSeed(seed)}
+	log.Printf("Signing   : pubkey %s", signer.PublicKey())
+}
+
+func (s *sampleSigner) PublicKey() string {
+	return hex.EncodeToString(s.key.Public().(ed25519.PublicKey))
+}
+
+// Sign returns payload with its signature appended as the last member.
+func (s *sampleSigner) Sign(payload []byte) []byte {
+	if len(payload) < 2 || payload[len(payload)-1] != '}' {
+		return payload
+	}
+	sig := ed25519.Sign(s.key, payload)
+	// One spare byte for the newline the stream loop appends.
+	out := make([]byte, 0, len(payload)+len(`,"sig":""`)+2*len(sig)+1)
+	out = append(out, payload[:len(payload)-1]...)
+	out = append(out, `,"sig":"`...)
+	out = hex.AppendEncode(out, sig)
+	out = append(out, `"}`...)
+	return out
+}
+
+func signingPublicKey() string {
+	if signer == nil {
+		return ""
+	}
+	return signer.PublicKey()
+}
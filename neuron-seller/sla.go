@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+)
+
+// The SLA is checked per buyer every invoice period against two targets:
+//
+//   - uptime (SLA_UPTIME_PERCENT): minutes in the period the node was
+//     running and sampling, or quiescent on its duty schedule.
+//   - completeness (SLA_COMPLETENESS_PERCENT): samples delivered to the
+//     buyer out of those expected while it was connected and not paused,
+//     at each kind's interval (or the buyer's own, if longer). Event and
+//     fused kinds aren't counted, and neither is completeness under delta
+//     mode, where skipped samples are the point.
+//
+// For each missed target the buyer is credited SLA_CREDIT_PERCENT of what
+// the period was billed; the credit is taken off its next invoice(s), which
+// also carry the period's SLA report. A target of 0 isn't checked; with
+// both at 0 there is no SLA. Progress, reports and pending credits are on
+// GET /admin/sla and kept in SLA_STATE_FILE.
+
+const slaReportsKept = 500
+
+type slaBuyer struct {
+	Account  string  `json:"account,omitempty"`
+	Minutes  int     `json:"connected_minutes"`
+	Expected float64 `json:"expected_samples"`
+}
+
+type slaReport struct {
+	Buyer            string   `json:"buyer"`
+	Account          string   `json:"account,omitempty"`
+	PeriodStart      int64    `json:"period_start"`
+	PeriodEnd        int64    `json:"period_end"`
+	UptimePercent    float64  `json:"uptime_percent"`
+	ExpectedSamples  int      `json:"expected_samples"`
+	DeliveredSamples int      `json:"delivered_samples"`
+	Completeness     *float64 `json:"completeness_percent,omitempty"`
+	Missed           []string `json:"missed,omitempty"`
+	CreditTinybar    int64    `json:"credit_tinybar,omitempty"`
+}
+
+type slaState struct {
+	PeriodStart int64                `json:"period_start"`
+	UpMinutes   int                  `json:"up_minutes"`
+	Buyers      map[string]*slaBuyer `json:"buyers"`
+	Credits     map[string]int64     `json:"pending_credits_tinybar"`
+	Reports     []slaReport          `json:"reports"`
+}
+
+type slaTracker struct {
+	uptime       float64 // targets, percent
+	completeness float64
+	creditPct    float64
+	path         string
+
+	mu    sync.Mutex
+	state slaState
+}
+
+var sla *slaTracker
+
+func loadSLA() {
+	t := &slaTracker{
+		uptime:       math.Max(parseEnvFloat("SLA_UPTIME_PERCENT", 0), 0),
+		completeness: math.Max(parseEnvFloat("SLA_COMPLETENESS_PERCENT", 0), 0),
+		creditPct:    math.Max(parseEnvFloat("SLA_CREDIT_PERCENT", 10), 0),
+		path:         getEnvOrDefault("SLA_STATE_FILE", "data/sla.json"),
+	}
+	if t.uptime == 0 && t.completeness == 0 {
+		return
+	}
+	if invoices == nil {
+		log.Printf("SLA       : disabled, credits need invoicing (INVOICE_INTERVAL_MINUTES, delivery log, Neuron streaming)")
+		return
+	}
+	if err := t.load(); err != nil {
+		log.Fatalf("sla: %v", err)
+	}
+	if t.state.PeriodStart == 0 {
+		t.state.PeriodStart = time.Now().Unix()
+	}
+	sla = t
+	go t.loop()
+	log.Printf("SLA       : uptime %.2f%%, completeness %.2f%%, %.0f%% credit per missed target", t.uptime, t.completeness, t.creditPct)
+}
+
+func (t *slaTracker) loop() {
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for now := range tick.C {
+		t.observe(now)
+	}
+}
+
+// observe accounts one minute: node uptime, and the samples each connected
+// buyer should have had.
+func (t *slaTracker) observe(now time.Time) {
+	up := nodeHealth.Serving(now)
+	type expectation struct {
+		account  string
+		expected float64
+	}
+	buyers := map[string]*expectation{}
+	if neuronBuffers != nil && up && schedule.Active(now) && !features.Enabled(flagDeltaMode) {
+		neuron, _ := getNeuronSellerConfig()
+		neuron = neuron.ensureDefaults()
+		for _, info := range neuronBuffers.GetBufferMap() {
+			if info.LibP2PState != types.Connected {
+				continue
+			}
+			key, account := buyerIdentity(info)
+			if key == "" || controls.Paused(key) {
+				continue
+			}
+			e := buyers[key]
+			if e == nil {
+				e = &expectation{account: account}
+				buyers[key] = e
+			}
+			for i, kind := range neuron.Kinds {
+				if kind.Event || kind.FusedFrom != "" || !buyerWantsKind(info, kind, i == 0) {
+					continue
+				}
+				e.expected += emissions.PerMinute(kind.Name, controls.Interval(key))
+			}
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if up {
+		t.state.UpMinutes++
+	}
+	for key, e := range buyers {
+		b := t.state.Buyers[key]
+		if b == nil {
+			b = &slaBuyer{}
+			t.state.Buyers[key] = b
+		}
+		b.Account = e.account
+		b.Minutes++
+		b.Expected += e.expected
+	}
+	if err := t.saveLocked(); err != nil {
+		log.Printf("sla: save: %v", err)
+	}
+}
+
+// Close settles the period [start, end) as it is invoiced: pending credits
+// come off msgs, this period's reports are attached to them, and credits
+// for missed targets are kept for the next invoices.
+func (t *slaTracker) Close(start, end time.Time, msgs []*invoiceMsg, recs []deliveryRecord) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	minutes := max(int(end.Sub(start)/time.Minute), 1)
+	uptime := min(100, 100*float64(t.state.UpMinutes)/float64(minutes))
+	delivered := map[string]int{}
+	for _, rec := range recs {
+		if !rec.Backfill {
+			delivered[rec.Buyer]++
+		}
+	}
+	billed := map[string]*invoiceMsg{}
+	for _, msg := range msgs {
+		billed[msg.Buyer] = msg
+	}
+
+	buyers := map[string]string{}
+	for key, b := range t.state.Buyers {
+		buyers[key] = b.Account
+	}
+	for key, msg := range billed {
+		if _, ok := buyers[key]; !ok {
+			buyers[key] = msg.Account
+		}
+	}
+	keys := make([]string, 0, len(buyers))
+	for key := range buyers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	reports := make(map[string]*slaReport, len(keys))
+	for _, key := range keys {
+		r := &slaReport{
+			Buyer:            key,
+			Account:          buyers[key],
+			PeriodStart:      start.Unix(),
+			PeriodEnd:        end.Unix(),
+			UptimePercent:    math.Round(uptime*100) / 100,
+			DeliveredSamples: delivered[key],
+		}
+		if t.uptime > 0 && uptime < t.uptime {
+			r.Missed = append(r.Missed, "uptime")
+		}
+		if b := t.state.Buyers[key]; b != nil && b.Expected >= 1 {
+			r.ExpectedSamples = int(math.Round(b.Expected))
+			pct := math.Round(min(100, 100*float64(r.DeliveredSamples)/b.Expected)*100) / 100
+			r.Completeness = &pct
+			if t.completeness > 0 && pct < t.completeness {
+				r.Missed = append(r.Missed, "completeness")
+			}
+		}
+		reports[key] = r
+	}
+
+	// Earlier credits first, so a period's credit never reduces its own
+	// invoice.
+	for _, msg := range msgs {
+		amount := msg.AmountTinybar
+		if credit := min(t.state.Credits[msg.Buyer], msg.AmountTinybar); credit > 0 {
+			msg.SLACreditTinybar = credit
+			msg.AmountTinybar -= credit
+			t.state.Credits[msg.Buyer] -= credit
+			if t.state.Credits[msg.Buyer] == 0 {
+				delete(t.state.Credits, msg.Buyer)
+			}
+		}
+		r := reports[msg.Buyer]
+		if len(r.Missed) > 0 {
+			r.CreditTinybar = int64(float64(amount) * t.creditPct / 100 * float64(len(r.Missed)))
+			r.CreditTinybar = min(r.CreditTinybar, amount)
+		}
+		msg.SLA = r
+	}
+	for _, key := range keys {
+		r := reports[key]
+		if r.CreditTinybar > 0 {
+			t.state.Credits[key] += r.CreditTinybar
+			audit.Record("billing", "node", "sla_credit", "ok", map[string]any{
+				"buyer":          key,
+				"missed":         r.Missed,
+				"period_end":     r.PeriodEnd,
+				"credit_tinybar": r.CreditTinybar,
+			})
+			log.Printf("sla: %.18s missed %v, %d tinybar credited to the next invoice", key, r.Missed, r.CreditTinybar)
+		}
+		t.state.Reports = append(t.state.Reports, *r)
+	}
+	if n := len(t.state.Reports) - slaReportsKept; n > 0 {
+		t.state.Reports = append([]slaReport(nil), t.state.Reports[n:]...)
+	}
+
+	t.state.PeriodStart = end.Unix()
+	t.state.UpMinutes = 0
+	t.state.Buyers = map[string]*slaBuyer{}
+	if err := t.saveLocked(); err != nil {
+		log.Printf("sla: save: %v", err)
+	}
+}
+
+func (t *slaTracker) load() error {
+	t.state = slaState{Buyers: map[string]*slaBuyer{}, Credits: map[string]int64{}}
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &t.state); err != nil {
+		return fmt.Errorf("decode %s: %w", t.path, err)
+	}
+	if t.state.Buyers == nil {
+		t.state.Buyers = map[string]*slaBuyer{}
+	}
+	if t.state.Credits == nil {
+		t.state.Credits = map[string]int64{}
+	}
+	return nil
+}
+
+func (t *slaTracker) saveLocked() error {
+	data, err := json.Marshal(t.state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o755); err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// GET /admin/sla[?buyer=] – targets, the current period so far, pending
+// credits and past reports, optionally for one buyer.
+func adminSLAHandler(w http.ResponseWriter, r *http.Request) {
+	if sla == nil {
+		writeJSONError(w, ErrDisabled.With("no SLA configured (SLA_UPTIME_PERCENT, SLA_COMPLETENESS_PERCENT)"))
+		return
+	}
+	buyer := r.URL.Query().Get("buyer")
+	sla.mu.Lock()
+	defer sla.mu.Unlock()
+
+	current := map[string]*slaBuyer{}
+	for key, b := range sla.state.Buyers {
+		if buyer == "" || key == rawKey(buyer) || b.Account == buyer {
+			current[key] = b
+		}
+	}
+	credits := map[string]int64{}
+	for key, c := range sla.state.Credits {
+		if buyer == "" || key == rawKey(buyer) {
+			credits[key] = c
+		}
+	}
+	reports := []slaReport{}
+	for _, rep := range sla.state.Reports {
+		if buyer == "" || rep.Buyer == rawKey(buyer) || rep.Account == buyer {
+			reports = append(reports, rep)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"targets": map[string]any{
+			"uptime_percent":       sla.uptime,
+			"completeness_percent": sla.completeness,
+			"credit_percent":       sla.creditPct,
+		},
+		"current": map[string]any{
+			"period_start": sla.state.PeriodStart,
+			"up_minutes":   sla.state.UpMinutes,
+			"buyers":       current,
+		},
+		"pending_credits_tinybar": credits,
+		"reports":                 reports,
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// The sun's position is the most useful covariate for brightness data, so
+// every JSON payload carries it, computed from the seller's lat/lon and the
+// sample time with no external service. The formulas are the low-precision
+// ones from the Astronomical Almanac (good to about 0.01° for 1950-2050):
+// geometric position, no atmospheric refraction, so elevation is slightly
+// low near the horizon. SOLAR_POSITION_ENABLE=false leaves it out.
+
+type solarPosition struct {
+	Elevation float64 `json:"elevation_deg"`
+	Azimuth   float64 `json:"azimuth_deg"` // clockwise from true north
+
+	valid bool
+}
+
+var solarEnabled = true
+
+func loadSolarPosition() {
+	solarEnabled = parseEnvBool("SOLAR_POSITION_ENABLE", true)
+}
+
+// sunPosition is where the sun is seen from lat/lon (degrees) at t.
+func sunPosition(lat, lon float64, t time.Time) solarPosition {
+	const rad = math.Pi / 180
+	// Days since J2000.0.
+	n := float64(t.UnixNano())/float64(24*time.Hour) + 2440587.5 - 2451545.0
+
+	meanLon := math.Mod(280.460+0.9856474*n, 360)
+	anomaly := math.Mod(357.528+0.9856003*n, 360) * rad
+	eclLon := (meanLon + 1.915*math.Sin(anomaly) + 0.020*math.Sin(2*anomaly)) * rad
+	obliquity := (23.439 - 0.0000004*n) * rad
+
+	ra := math.Atan2(math.Cos(obliquity)*math.Sin(eclLon), math.Cos(eclLon))
+	dec := math.Asin(math.Sin(obliquity) * math.Sin(eclLon))
+
+	gmst := math.Mod(18.697374558+24.06570982441908*n, 24)
+	hourAngle := (gmst*15+lon)*rad - ra
+	phi := lat * rad
+
+	elevation := math.Asin(math.Sin(phi)*math.Sin(dec) + math.Cos(phi)*math.Cos(dec)*math.Cos(hourAngle))
+	azimuth := math.Atan2(-math.Sin(hourAngle), math.Tan(dec)*math.Cos(phi)-math.Sin(phi)*math.Cos(hourAngle))
+	azimuth = math.Mod(azimuth/rad+360, 360)
+
+	return solarPosition{
+		Elevation: math.Round(elevation/rad*100) / 100,
+		Azimuth:   math.Round(azimuth*100) / 100,
+		valid:     true,
+	}
+}
+
+// sampleSolarPosition is the sun's position over the seller at t, or an
+// invalid position when disabled.
+func sampleSolarPosition(t time.Time) solarPosition {
+	if !solarEnabled {
+		return solarPosition{}
+	}
+	loc := currentLocation()
+	return sunPosition(loc.Lat, loc.Lon, t)
+}
+
+// appendJSON writes s as encoding/json would.
+func (s solarPosition) appendJSON(dst []byte) []byte {
+	dst = append(dst, `{"elevation_deg":`...)
+	dst, _ = appendJSONFloat(dst, s.Elevation)
+	dst = append(dst, `,"azimuth_deg":`...)
+	dst, _ = appendJSONFloat(dst, s.Azimuth)
+	return append(dst, '}')
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sound level kinds report A-weighted decibels (unit dba). The Pi sends
+// levels from its sound level meter, never audio, and the seller doesn't
+// pass those on either: readings are only aggregated, and one sample goes
+// out per NOISE_WINDOW_SECONDS window (aligned to the clock) carrying the
+// window's LAeq, the energy-equivalent continuous level, as its value.
+// Fields noise, noise_dba, sound_level and laeq default to dba, e.g.
+//
+//	SENSOR_KINDS=noise:noise:/localsense/noise/v1
+//
+// A sound block gives the window, the number of readings and the lowest and
+// highest one. If the Pi also reports octave band levels as <field>_<hz>hz
+// (noise_63hz, noise_31_5hz, ...), each band's LAeq over the window is
+// included. NOISE_BAND_WEIGHTING=z says the bands are unweighted; they are
+// then A-weighted before averaging so they add up like the broadband level.
+
+// octaveBand is one standard octave band: its centre frequency, the suffix
+// of its Pi field and its A-weighting (IEC 61672-1).
+type octaveBand struct {
+	hz      float64
+	suffix  string
+	weightA float64
+}
+
+var octaveBands = [...]octaveBand{
+	{31.5, "_31_5hz", -39.4}, {63, "_63hz", -26.2}, {125, "_125hz", -16.1},
+	{250, "_250hz", -8.6}, {500, "_500hz", -3.2}, {1000, "_1000hz", 0},
+	{2000, "_2000hz", 1.2}, {4000, "_4000hz", 1.0}, {8000, "_8000hz", -1.1},
+	{16000, "_16000hz", -6.6},
+}
+
+// soundLevel summarises one window of a sound level kind.
+type soundLevel struct {
+	WindowStart   int64       `json:"window_start"`
+	WindowSeconds int         `json:"window_seconds"`
+	Readings      int         `json:"readings"`
+	LAMin         float64     `json:"lamin"`
+	LAMax         float64     `json:"lamax"`
+	Bands         []bandLevel `json:"bands,omitempty"`
+}
+
+type bandLevel struct {
+	Hz    float64 `json:"hz"`
+	LAeq  float64 `json:"laeq"`
+	Count int     `json:"readings"`
+}
+
+// soundWindow accumulates the readings of one kind's open window.
+type soundWindow struct {
+	start    time.Time
+	count    int
+	energy   float64 // sum of 10^(L/10)
+	min, max float64
+	bands    [len(octaveBands)]struct {
+		energy float64
+		count  int
+	}
+}
+
+var (
+	noiseWindow   = time.Minute
+	noiseBandsZ   bool
+	soundLevelsMu sync.Mutex
+	soundWindows  = map[string]*soundWindow{}
+	soundClosed   = map[string]*soundLevel{}
+)
+
+func loadSoundLevels() {
+	noiseWindow = time.Duration(max(parseEnvInt("NOISE_WINDOW_SECONDS", 60), 1)) * time.Second
+	noiseBandsZ = getEnvOrDefault("NOISE_BAND_WEIGHTING", "a") == "z"
+	cfg, err := getNeuronSellerConfig()
+	if err != nil {
+		return
+	}
+	for _, k := range cfg.Kinds {
+		if k.Conversion.To == unitDBA {
+			log.Printf("Sound     : %s sent as LAeq over %s windows", k.Name, noiseWindow)
+		}
+	}
+}
+
+// add folds one reading into the window and, when the reading opens a new
+// window, returns the LAeq and summary of the one it closes.
+func (w *soundWindow) add(kind sensorKind, value float64, values map[string]float64, at time.Time) (float64, *soundLevel, bool) {
+	var laeq float64
+	var closed *soundLevel
+	start := at.Truncate(noiseWindow)
+	if w.count > 0 && !start.Equal(w.start) {
+		laeq, closed = w.close()
+	}
+	if w.count == 0 {
+		*w = soundWindow{start: start, min: value, max: value}
+	}
+	w.count++
+	w.energy += math.Pow(10, value/10)
+	w.min, w.max = math.Min(w.min, value), math.Max(w.max, value)
+	for i, band := range octaveBands {
+		level, ok := values[kind.Field+band.suffix]
+		if !ok {
+			continue
+		}
+		if noiseBandsZ {
+			level += band.weightA
+		}
+		w.bands[i].energy += math.Pow(10, level/10)
+		w.bands[i].count++
+	}
+	return laeq, closed, closed != nil
+}
+
+func (w *soundWindow) close() (float64, *soundLevel) {
+	s := &soundLevel{
+		WindowStart:   w.start.Unix(),
+		WindowSeconds: int(noiseWindow / time.Second),
+		Readings:      w.count,
+		LAMin:         w.min,
+		LAMax:         w.max,
+	}
+	for i, band := range w.bands {
+		if band.count > 0 {
+			s.Bands = append(s.Bands, bandLevel{Hz: octaveBands[i].hz, LAeq: leq(band.energy, band.count), Count: band.count})
+		}
+	}
+	laeq := leq(w.energy, w.count)
+	w.count = 0
+	return laeq, s
+}
+
+// leq is the level of the mean energy of count readings.
+func leq(energy float64, count int) float64 {
+	return math.Round(10*math.Log10(energy/float64(count))*100) / 100
+}
+
+// aggregateSoundLevel feeds a sound level reading into the kind's window;
+// ok is true, with the closed window's LAeq, when a sample is due.
+func aggregateSoundLevel(kind sensorKind, value float64, values map[string]float64, at time.Time) (float64, bool) {
+	soundLevelsMu.Lock()
+	defer soundLevelsMu.Unlock()
+	w, ok := soundWindows[kind.Name]
+	if !ok {
+		w = &soundWindow{}
+		soundWindows[kind.Name] = w
+	}
+	laeq, closed, due := w.add(kind, value, values, at)
+	if due {
+		soundClosed[kind.Name] = closed
+	}
+	return laeq, due
+}
+
+// lastSoundLevel is the summary of the kind's last closed window.
+func lastSoundLevel(kind string) *soundLevel {
+	soundLevelsMu.Lock()
+	defer soundLevelsMu.Unlock()
+	return soundClosed[kind]
+}
+
+// appendJSON writes s as encoding/json would.
+func (s *soundLevel) appendJSON(dst []byte) ([]byte, error) {
+	var err error
+	dst = append(dst, `{"window_start":`...)
+	dst = strconv.AppendInt(dst, s.WindowStart, 10)
+	dst = append(dst, `,"window_seconds":`...)
+	dst = strconv.AppendInt(dst, int64(s.WindowSeconds), 10)
+	dst = append(dst, `,"readings":`...)
+	dst = strconv.AppendInt(dst, int64(s.Readings), 10)
+	dst = append(dst, `,"lamin":`...)
+	if dst, err = appendJSONFloat(dst, s.LAMin); err != nil {
+		return nil, err
+	}
+	dst = append(dst, `,"lamax":`...)
+	if dst, err = appendJSONFloat(dst, s.LAMax); err != nil {
+		return nil, err
+	}
+	if len(s.Bands) > 0 {
+		dst = append(dst, `,"bands":[`...)
+		for i, b := range s.Bands {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = append(dst, `{"hz":`...)
+			dst, _ = appendJSONFloat(dst, b.Hz)
+			dst = append(dst, `,"laeq":`...)
+			if dst, err = appendJSONFloat(dst, b.LAeq); err != nil {
+				return nil, err
+			}
+			dst = append(dst, `,"readings":`...)
+			dst = strconv.AppendInt(dst, int64(b.Count), 10)
+			dst = append(dst, '}')
+		}
+		dst = append(dst, ']')
+	}
+	return append(dst, '}'), nil
+}
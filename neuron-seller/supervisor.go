@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const supervisorHistoryLimit = 50
+
+type supervisorConfig struct {
+	Enabled          bool
+	CheckInterval    time.Duration
+	FailureThreshold int
+	Cooldown         time.Duration
+	Mode             string // command, ssh or docker
+	RestartCommand   string
+	SSHTarget        string
+	DockerHost       string
+	DockerContainer  string
+	HistoryFile      string
+}
+
+type restartRecord struct {
+	Time     time.Time `json:"time"`
+	Mode     string    `json:"mode"`
+	Reason   string    `json:"reason"`
+	OK       bool      `json:"ok"`
+	Output   string    `json:"output,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Duration string    `json:"duration"`
+}
+
+// piSupervisor watches the Pi sensor service through its /health endpoint
+// and restarts it when it fails repeatedly.
+type piSupervisor struct {
+	cfg supervisorConfig
+	// client times out within a check interval: a Pi service that takes
+	// the connection and never answers is a failed check, not a hung one.
+	client *http.Client
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	lastError           string
+	lastCheck           time.Time
+	lastRestart         time.Time
+	history             []restartRecord
+}
+
+var supervisor *piSupervisor
+
+func loadSupervisorConfig() supervisorConfig {
+	return supervisorConfig{
+		Enabled:          parseEnvBool("SUPERVISOR_ENABLE", false),
+		CheckInterval:    time.Duration(parseEnvInt("SUPERVISOR_CHECK_INTERVAL_SECONDS", 15)) * time.Second,
+		FailureThreshold: parseEnvInt("SUPERVISOR_FAILURE_THRESHOLD", 3),
+		Cooldown:         time.Duration(parseEnvInt("SUPERVISOR_COOLDOWN_SECONDS", 120)) * time.Second,
+		Mode:             strings.ToLower(getEnvOrDefault("SUPERVISOR_RESTART_MODE", "command")),
+		RestartCommand:   getEnvOrDefault("SUPERVISOR_RESTART_COMMAND", ""),
+		SSHTarget:        getEnvOrDefault("SUPERVISOR_SSH_TARGET", ""),
+		DockerHost:       getEnvOrDefault("SUPERVISOR_DOCKER_HOST", "unix:///var/run/docker.sock"),
+		DockerContainer:  getEnvOrDefault("SUPERVISOR_DOCKER_CONTAINER", ""),
+		HistoryFile:      getEnvOrDefault("SUPERVISOR_HISTORY_FILE", "supervisor-history.json"),
+	}
+}
+
+func (c supervisorConfig) validate() error {
+	switch c.Mode {
+	case "command":
+		if c.RestartCommand == "" {
+			return errors.New("SUPERVISOR_RESTART_COMMAND is required for mode=command")
+		}
+	case "ssh":
+		if c.SSHTarget == "" || c.RestartCommand == "" {
+			return errors.New("SUPERVISOR_SSH_TARGET and SUPERVISOR_RESTART_COMMAND are required for mode=ssh")
+		}
+	case "docker":
+		if c.DockerContainer == "" {
+			return errors.New("SUPERVISOR_DOCKER_CONTAINER is required for mode=docker")
+		}
+	default:
+		return fmt.Errorf("unknown SUPERVISOR_RESTART_MODE %q (command, ssh, docker)", c.Mode)
+	}
+	return nil
+}
+
+func startSupervisor() {
+	cfg := loadSupervisorConfig()
+	if !cfg.Enabled {
+		return
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("supervisor: invalid configuration: %v", err)
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = 15 * time.Second
+	}
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 3
+	}
+
+	supervisor = &piSupervisor{cfg: cfg, client: &http.Client{Timeout: cfg.CheckInterval * 3 / 4}}
+	supervisor.loadHistory()
+
+	log.Printf(
+		"supervisor: watching %s/health every %s (restart via %s after %d failures)",
+		sellerCfg.PiBase, cfg.CheckInterval, cfg.Mode, cfg.FailureThreshold,
+	)
+	go supervisor.run()
+}
+
+func (s *piSupervisor) run() {
+	ticker := time.NewTicker(s.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.check()
+	}
+}
+
+func (s *piSupervisor) check() {
+	health := make(map[string]any)
+	err := fetchJSONWith(s.client, sellerCfg.PiBase+"/health", &health)
+
+	s.mu.Lock()
+	s.lastCheck = time.Now().UTC()
+	if err == nil {
+		if s.consecutiveFailures > 0 {
+			log.Printf("supervisor: Pi healthy again after %d failed checks", s.consecutiveFailures)
+		}
+		s.consecutiveFailures = 0
+		s.lastError = ""
+		s.mu.Unlock()
+		return
+	}
+	s.consecutiveFailures++
+	s.lastError = err.Error()
+	failures := s.consecutiveFailures
+	inCooldown := !s.lastRestart.IsZero() && time.Since(s.lastRestart) < s.cfg.Cooldown
+	s.mu.Unlock()
+
+	log.Printf("supervisor: Pi health check failed (%d/%d): %v", failures, s.cfg.FailureThreshold, err)
+	if failures < s.cfg.FailureThreshold || inCooldown {
+		return
+	}
+
+	reason := fmt.Sprintf("%d consecutive /health failures, last: %v", failures, err)
+	s.restart(reason)
+}
+
+func (s *piSupervisor) restart(reason string) restartRecord {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	var (
+		output string
+		err    error
+	)
+	switch s.cfg.Mode {
+	case "command":
+		output, err = runShell(ctx, "sh", "-c", s.cfg.RestartCommand)
+	case "ssh":
+		output, err = runShell(ctx, "ssh", "-o", "BatchMode=yes", "-o", "ConnectTimeout=10", s.cfg.SSHTarget, s.cfg.RestartCommand)
+	case "docker":
+		output, err = dockerRestart(ctx, s.cfg.DockerHost, s.cfg.DockerContainer)
+	}
+
+	rec := restartRecord{
+		Time:     start.UTC(),
+		Mode:     s.cfg.Mode,
+		Reason:   reason,
+		OK:       err == nil,
+		Output:   strings.TrimSpace(output),
+		Duration: time.Since(start).Round(time.Millisecond).String(),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+		log.Printf("supervisor: restart via %s failed: %v", s.cfg.Mode, err)
+	} else {
+		log.Printf("supervisor: restarted Pi service via %s (%s)", s.cfg.Mode, rec.Duration)
+	}
+
+	s.mu.Lock()
+	s.lastRestart = time.Now()
+	s.consecutiveFailures = 0
+	s.history = append(s.history, rec)
+	if len(s.history) > supervisorHistoryLimit {
+		s.history = s.history[len(s.history)-supervisorHistoryLimit:]
+	}
+	s.mu.Unlock()
+
+	s.saveHistory()
+	return rec
+}
+
+func runShell(ctx context.Context, name string, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if len(out) > 2048 {
+		out = out[len(out)-2048:]
+	}
+	return string(out), err
+}
+
+// dockerRestart calls POST /containers/{id}/restart on the Docker Engine
+// API, over a unix socket or plain TCP depending on host.
+func dockerRestart(ctx context.Context, host, container string) (string, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", fmt.Errorf("parse docker host %q: %w", host, err)
+	}
+
+	client := &http.Client{}
+	base := "http://docker"
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+	case "tcp", "http":
+		base = "http://" + u.Host
+	default:
+		return "", fmt.Errorf("unsupported docker host scheme %q", u.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/containers/"+url.PathEscape(container)+"/restart?t=10", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("docker restart %s: %w", container, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+	if resp.StatusCode != http.StatusNoContent {
+		return string(body), fmt.Errorf("docker restart %s: status %s", container, resp.Status)
+	}
+	return string(body), nil
+}
+
+func (s *piSupervisor) loadHistory() {
+	data, err := os.ReadFile(s.cfg.HistoryFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Printf("supervisor: read history %s: %v", s.cfg.HistoryFile, err)
+		return
+	}
+	if err := json.Unmarshal(data, &s.history); err != nil {
+		log.Printf("supervisor: decode history %s: %v", s.cfg.HistoryFile, err)
+	}
+}
+
+func (s *piSupervisor) saveHistory() {
+	s.mu.Lock()
+	data, err := json.MarshalIndent(s.history, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("supervisor: encode history: %v", err)
+		return
+	}
+	if err := os.WriteFile(s.cfg.HistoryFile, data, 0o644); err != nil {
+		log.Printf("supervisor: write history %s: %v", s.cfg.HistoryFile, err)
+	}
+}
+
+// GET returns the supervisor state and restart history; POST forces a
+// restart right away.
+func adminSupervisorHandler(w http.ResponseWriter, r *http.Request) {
+	if supervisor == nil {
+		writeJSONError(w, ErrDisabled.With("supervisor disabled (SUPERVISOR_ENABLE not set)"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		rec := supervisor.restart("manual restart via /admin/supervisor from " + r.RemoteAddr)
+		writeJSON(w, http.StatusOK, rec)
+		return
+	default:
+		writeJSONError(w, ErrMethodNotAllowed)
+		return
+	}
+
+	supervisor.mu.Lock()
+	defer supervisor.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"mode":                 supervisor.cfg.Mode,
+		"failure_threshold":    supervisor.cfg.FailureThreshold,
+		"consecutive_failures": supervisor.consecutiveFailures,
+		"last_error":           supervisor.lastError,
+		"last_check":           supervisor.lastCheck,
+		"last_restart":         supervisor.lastRestart,
+		"history":              supervisor.history,
+	})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// Tags are operator metadata (deployment=rooftop-3, campaign=winter-test)
+// sent in every payload as "tags". SAMPLE_TAGS holds the static ones, fixed
+// for the process; dynamic tags are set at runtime with POST /admin/tags,
+// survive restarts in TAGS_FILE and override a static tag of the same name.
+//
+// /history?tag=campaign:winter-test and a buyer's service option of the same
+// form (".../v1?tag=campaign:winter-test") only match samples carrying every
+// tag asked for; a buyer subscribed to a campaign gets nothing outside it.
+
+const (
+	maxTags        = 32
+	maxTagValueLen = 128
+)
+
+var tagKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+type tagSet struct {
+	mu      sync.RWMutex
+	path    string
+	static  map[string]string
+	dynamic map[string]string
+	// Current tags and their JSON, rebuilt on every change.
+	current map[string]string
+	encoded []byte
+}
+
+var tags = &tagSet{}
+
+func loadTags() {
+	static, err := parseTags(getEnvOrDefault("SAMPLE_TAGS", ""))
+	if err != nil {
+		log.Fatalf("tags: SAMPLE_TAGS: %v", err)
+	}
+	t := &tagSet{path: getEnvOrDefault("TAGS_FILE", "data/tags.json"), static: static, dynamic: map[string]string{}}
+	data, err := os.ReadFile(t.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		log.Fatalf("tags: read %s: %v", t.path, err)
+	default:
+		if err := json.Unmarshal(data, &t.dynamic); err != nil {
+			log.Fatalf("tags: parse %s: %v", t.path, err)
+		}
+	}
+	t.rebuild()
+	tags = t
+	if len(t.current) > 0 {
+		log.Printf("Tags      : %s", formatTags(t.current))
+	}
+}
+
+// parseTags reads "key=value,key=value".
+func parseTags(spec string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("tag %q must look like key=value", entry)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if err := validTag(key, value); err != nil {
+			return nil, err
+		}
+		out[key] = value
+	}
+	if len(out) > maxTags {
+		return nil, fmt.Errorf("at most %d tags", maxTags)
+	}
+	return out, nil
+}
+
+func validTag(key, value string) error {
+	if !tagKeyPattern.MatchString(key) {
+		return fmt.Errorf("tag key %q must be lowercase letters, digits, '_', '.' or '-' (at most 64)", key)
+	}
+	if len(value) > maxTagValueLen {
+		return fmt.Errorf("tag %s: value longer than %d bytes", key, maxTagValueLen)
+	}
+	return nil
+}
+
+func formatTags(m map[string]string) string {
+	parts := make([]string, 0, len(m))
+	for k, v := range m {
+		parts = append(parts, k+"="+v)
+	}
+	slices.Sort(parts)
+	return strings.Join(parts, ",")
+}
+
+// rebuild recomputes the current tags; called with t.mu held for writing.
+func (t *tagSet) rebuild() {
+	current := maps.Clone(t.static)
+	if current == nil {
+		current = map[string]string{}
+	}
+	maps.Copy(current, t.dynamic)
+	t.current = current
+	t.encoded = nil
+	if len(current) > 0 {
+		// json.Marshal sorts map keys, keeping payloads deterministic.
+		t.encoded, _ = json.Marshal(current)
+	}
+}
+
+// Encoded is the current tags as a JSON object, or nil when there are none.
+func (t *tagSet) Encoded() []byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.encoded
+}
+
+// Current is the current tags. The map is replaced, never modified, on
+// change; callers must not modify it either.
+func (t *tagSet) Current() map[string]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.current
+}
+
+// Set applies changes to the dynamic tags; an empty value removes a tag.
+func (t *tagSet) Set(changes map[string]string) error {
+	for key, value := range changes {
+		if err := validTag(key, value); err != nil {
+			return err
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dynamic := maps.Clone(t.dynamic)
+	for key, value := range changes {
+		if value == "" {
+			delete(dynamic, key)
+		} else {
+			dynamic[key] = value
+		}
+	}
+	if n := len(dynamic) + len(t.static); n > maxTags {
+		return fmt.Errorf("at most %d tags", maxTags)
+	}
+	if err := t.save(dynamic); err != nil {
+		return err
+	}
+	t.dynamic = dynamic
+	t.rebuild()
+	return nil
+}
+
+func (t *tagSet) save(dynamic map[string]string) error {
+	data, err := json.MarshalIndent(dynamic, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o755); err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// tagFilter is the key:value pairs of repeated tag= query parameters.
+func tagFilter(opts url.Values) (map[string]string, error) {
+	var out map[string]string
+	for _, spec := range opts["tag"] {
+		key, value, ok := strings.Cut(spec, ":")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("tag filter %q must look like key:value", spec)
+		}
+		if out == nil {
+			out = map[string]string{}
+		}
+		out[key] = value
+	}
+	return out, nil
+}
+
+// tagsMatch reports whether have carries every tag in want.
+func tagsMatch(have, want map[string]string) bool {
+	for key, value := range want {
+		if v, ok := have[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// buyerWantsTags reports whether the current tags satisfy a buyer's tag
+// options. Malformed options match nothing.
+func buyerWantsTags(info *commonlib.NodeBufferInfo) bool {
+	want, err := tagFilter(requestedServiceOptions(info))
+	if err != nil {
+		return false
+	}
+	if len(want) == 0 {
+		return true
+	}
+	return tagsMatch(tags.Current(), want)
+}
+
+// GET|POST /admin/tags – current tags, or set dynamic ones with
+// {"campaign": "winter-test"} ("" removes a tag).
+func adminTagsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, ErrBadRequest.With("invalid JSON body"))
+			return
+		}
+		if err := tags.Set(req); err != nil {
+			writeJSONError(w, ErrBadRequest.Wrap(err))
+			return
+		}
+		log.Printf("[/admin/tags] set %s by %s", formatTags(req), r.RemoteAddr)
+	default:
+		writeJSONError(w, ErrMethodNotAllowed)
+		return
+	}
+
+	tags.mu.RLock()
+	defer tags.mu.RUnlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"tags":    tags.current,
+		"static":  tags.static,
+		"dynamic": tags.dynamic,
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Commands, purges and buyer requests reach us over our stdin topic, via the
+// SDK's mirror node subscription. When that subscription stalls or falls
+// behind, a pause or purge lands minutes late and nothing says so. Every
+// topic message's lag, from its consensus timestamp to when we handle it, is
+// on /status and /metrics; a message more than TOPIC_LAG_ALERT_SECONDS
+// behind is logged and sends a topic_lag webhook, and the first one back
+// under the threshold sends topic_lag_recovered.
+
+type topicLagTracker struct {
+	alertAfter time.Duration
+
+	mu      sync.Mutex
+	last    time.Duration
+	lastAt  time.Time
+	maxHour [healthWindowMinutes]struct {
+		minute int64
+		max    time.Duration
+	}
+	counts  map[string]uint64 // by message type
+	behind  bool
+	alerted uint64
+}
+
+var topicLag = &topicLagTracker{counts: map[string]uint64{}}
+
+func loadTopicLag() {
+	topicLag.alertAfter = time.Duration(parseEnvInt("TOPIC_LAG_ALERT_SECONDS", 120)) * time.Second
+}
+
+// Observe records a topic message of messageType with consensus timestamp
+// consensus, handled at now.
+func (t *topicLagTracker) Observe(messageType string, consensus, now time.Time) {
+	if consensus.IsZero() {
+		return
+	}
+	lag := max(now.Sub(consensus), 0)
+
+	t.mu.Lock()
+	t.last, t.lastAt = lag, now
+	t.counts[messageType]++
+	m := now.Unix() / 60
+	b := &t.maxHour[m%healthWindowMinutes]
+	if b.minute != m {
+		b.minute, b.max = m, 0
+	}
+	b.max = max(b.max, lag)
+
+	behind := t.alertAfter > 0 && lag > t.alertAfter
+	changed := behind != t.behind
+	t.behind = behind
+	if changed && behind {
+		t.alerted++
+	}
+	t.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	detail := map[string]any{"type": messageType, "lag_seconds": lag.Seconds(), "consensus_ts": consensus.UTC()}
+	if behind {
+		log.Printf("neuron-seller: topic messages are %s behind (%s at %s), control messages arrive late", lag.Round(time.Second), messageType, consensus.UTC().Format(time.RFC3339))
+		webhooks.Emit(webhookTopicLag, detail)
+	} else {
+		log.Printf("neuron-seller: topic messages caught up (%s behind)", lag.Round(time.Second))
+		webhooks.Emit(webhookTopicLagRecovered, detail)
+	}
+}
+
+// maxLag is the largest lag seen in the last hour.
+func (t *topicLagTracker) maxLag(now time.Time) time.Duration {
+	m := now.Unix() / 60
+	var out time.Duration
+	for _, b := range t.maxHour {
+		if m-b.minute < healthWindowMinutes {
+			out = max(out, b.max)
+		}
+	}
+	return out
+}
+
+// Status is the lag for /status.
+func (t *topicLagTracker) Status(now time.Time) map[string]any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := make(map[string]uint64, len(t.counts))
+	for typ, n := range t.counts {
+		counts[typ] = n
+	}
+	out := map[string]any{
+		"behind":           t.behind,
+		"alert_after_s":    t.alertAfter.Seconds(),
+		"max_last_hour_s":  t.maxLag(now).Seconds(),
+		"messages_by_type": counts,
+	}
+	if !t.lastAt.IsZero() {
+		out["last_lag_s"] = t.last.Seconds()
+		out["last_at"] = t.lastAt.UTC()
+	}
+	return out
+}
+
+func writeTopicLagMetrics(w http.ResponseWriter) {
+	t := topicLag
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintln(w, "# HELP localsense_topic_messages_total Messages handled from our stdin topic, by type.")
+	fmt.Fprintln(w, "# TYPE localsense_topic_messages_total counter")
+	types := make([]string, 0, len(t.counts))
+	for typ := range t.counts {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		fmt.Fprintf(w, "localsense_topic_messages_total{type=%q} %d\n", typ, t.counts[typ])
+	}
+	if t.lastAt.IsZero() {
+		return
+	}
+	fmt.Fprintln(w, "# HELP localsense_topic_lag_seconds Consensus-to-handled lag of the last topic message.")
+	fmt.Fprintln(w, "# TYPE localsense_topic_lag_seconds gauge")
+	fmt.Fprintf(w, "localsense_topic_lag_seconds %.3f\n", t.last.Seconds())
+	fmt.Fprintln(w, "# HELP localsense_topic_lag_max_seconds Largest topic message lag in the last hour.")
+	fmt.Fprintln(w, "# TYPE localsense_topic_lag_max_seconds gauge")
+	fmt.Fprintf(w, "localsense_topic_lag_max_seconds %.3f\n", t.maxLag(now).Seconds())
+	fmt.Fprintln(w, "# HELP localsense_topic_lag_alerts_total Times topic messages fell more than TOPIC_LAG_ALERT_SECONDS behind.")
+	fmt.Fprintln(w, "# TYPE localsense_topic_lag_alerts_total counter")
+	fmt.Fprintf(w, "localsense_topic_lag_alerts_total %d\n", t.alerted)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// Buyers the payment backend does not consider paid (see payments.go)
+// normally get nothing. With TRIAL_FREE_SAMPLES or
+// TRIAL_FREE_MINUTES set, a new buyer account may stream for free until it
+// has received that many samples or that many minutes have passed since its
+// first free sample, whichever comes first. A trial is tracked under the
+// buyer's shared account (0.0.N), and only once the SDK has validated that
+// account: keys and addresses in a service request are the buyer's own
+// claim and cost nothing to rotate. Usage is kept in TRIAL_STATE_FILE so
+// reconnecting doesn't start a fresh trial.
+
+type trialConfig struct {
+	FreeSamples int
+	FreeMinutes int
+	StateFile   string
+}
+
+func (c trialConfig) enabled() bool { return c.FreeSamples > 0 || c.FreeMinutes > 0 }
+
+type trialUsage struct {
+	Started  time.Time  `json:"started"`
+	Samples  int        `json:"samples"`
+	EndedAt  *time.Time `json:"ended_at,omitempty"`
+	EndedWhy string     `json:"ended_reason,omitempty"`
+}
+
+type trialTracker struct {
+	cfg trialConfig
+
+	mu       sync.Mutex
+	accounts map[string]*trialUsage
+	dirty    bool
+}
+
+var trials *trialTracker
+
+func loadTrials() {
+	cfg := trialConfig{
+		FreeSamples: parseEnvInt("TRIAL_FREE_SAMPLES", 0),
+		FreeMinutes: parseEnvInt("TRIAL_FREE_MINUTES", 0),
+		StateFile:   getEnvOrDefault("TRIAL_STATE_FILE", "data/trials.json"),
+	}
+	if !cfg.enabled() {
+		return
+	}
+	t := &trialTracker{cfg: cfg, accounts: make(map[string]*trialUsage)}
+	if err := t.load(); err != nil {
+		log.Printf("trial: ignoring state file: %v", err)
+	}
+	trials = t
+	go t.persistLoop()
+	log.Printf("Trial     : %d free samples / %d free minutes per new buyer (%d accounts seen)", cfg.FreeSamples, cfg.FreeMinutes, len(t.accounts))
+}
+
+// trialAccount is the account a trial is tracked under, "" (no trial) for
+// a buyer whose account the SDK has not validated.
+func trialAccount(info *commonlib.NodeBufferInfo) string {
+	if !info.IsOtherSideValidAccount {
+		return ""
+	}
+	return buyerSharedAccount(info)
+}
+
+func normalizeEVM(addr string) string {
+	return "0x" + rawKey(addr)
+}
+
+// Admit reports whether an unpaid buyer account may get one more sample,
+// ending its trial once a limit is reached. A nil tracker (trials off)
+// admits nobody.
+func (t *trialTracker) Admit(account string, now time.Time) bool {
+	if t == nil || account == "" {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u, ok := t.accounts[account]
+	if !ok {
+		u = &trialUsage{Started: now.UTC()}
+		t.accounts[account] = u
+		t.dirty = true
+		log.Printf("trial: started for %.18s", account)
+	}
+	if u.EndedAt != nil {
+		return false
+	}
+	switch {
+	case t.cfg.FreeSamples > 0 && u.Samples >= t.cfg.FreeSamples:
+		t.endLocked(account, u, now, "samples")
+		return false
+	case t.cfg.FreeMinutes > 0 && now.Sub(u.Started) >= time.Duration(t.cfg.FreeMinutes)*time.Minute:
+		t.endLocked(account, u, now, "minutes")
+		return false
+	}
+	return true
+}
+
+func (t *trialTracker) endLocked(account string, u *trialUsage, now time.Time, why string) {
+	ended := now.UTC()
+	u.EndedAt, u.EndedWhy = &ended, why
+	t.dirty = true
+	log.Printf("trial: ended for %.18s after %d samples (%s limit)", account, u.Samples, why)
+	audit.Record("trial", "node", "trial_ended", "ok", map[string]any{"account": account, "samples": u.Samples, "reason": why})
+}
+
+// Delivered counts a free sample written to account.
+func (t *trialTracker) Delivered(account string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if u, ok := t.accounts[account]; ok {
+		u.Samples++
+		t.dirty = true
+	}
+}
+
+// Usage returns account's trial state.
+func (t *trialTracker) Usage(account string) (trialUsage, bool) {
+	if t == nil {
+		return trialUsage{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.accounts[account]
+	if !ok {
+		return trialUsage{}, false
+	}
+	return *u, true
+}
+
+// Reset forgets account, giving it a new trial.
+func (t *trialTracker) Reset(account string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.accounts[account]
+	delete(t.accounts, account)
+	t.dirty = true
+	return ok
+}
+
+func (t *trialTracker) load() error {
+	data, err := os.ReadFile(t.cfg.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var accounts map[string]*trialUsage
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return fmt.Errorf("decode %s: %w", t.cfg.StateFile, err)
+	}
+	if accounts != nil {
+		t.accounts = accounts
+	}
+	return nil
+}
+
+func (t *trialTracker) persistLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := t.save(); err != nil {
+			log.Printf("trial: save state: %v", err)
+		}
+	}
+}
+
+func (t *trialTracker) save() error {
+	t.mu.Lock()
+	if !t.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(t.accounts)
+	t.dirty = false
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(t.cfg.StateFile), 0o755); err != nil {
+		return err
+	}
+	tmp := t.cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.cfg.StateFile)
+}
+
+// GET /admin/trials lists trial accounts; DELETE /admin/trials?account=
+// grants the account a fresh trial.
+func adminTrialsHandler(w http.ResponseWriter, r *http.Request) {
+	if trials == nil {
+		writeJSONError(w, ErrDisabled.With("trial mode disabled (TRIAL_FREE_SAMPLES and TRIAL_FREE_MINUTES are 0)"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		account := r.URL.Query().Get("account")
+		if account == "" {
+			writeJSONError(w, ErrBadRequest.With("account is required"))
+			return
+		}
+		if !trials.Reset(account) {
+			writeJSONError(w, ErrNotFound.With("no trial for "+account))
+			return
+		}
+		if err := trials.save(); err != nil {
+			log.Printf("trial: save state: %v", err)
+		}
+	default:
+		writeJSONError(w, ErrMethodNotAllowed)
+		return
+	}
+
+	trials.mu.Lock()
+	type row struct {
+		Account string `json:"account"`
+		trialUsage
+	}
+	rows := make([]row, 0, len(trials.accounts))
+	for account, u := range trials.accounts {
+		rows = append(rows, row{Account: account, trialUsage: *u})
+	}
+	trials.mu.Unlock()
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Started.Before(rows[j].Started) })
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"free_samples": trials.cfg.FreeSamples,
+		"free_minutes": trials.cfg.FreeMinutes,
+		"accounts":     rows,
+	})
+}
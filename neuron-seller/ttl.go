@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// Every payload carries ttl (seconds) and expires_at (unix seconds, ts+ttl).
+// Buyers drop a sample once their clock passes expires_at, and may ask for a
+// tighter bound with max_age=<seconds> in their service type options (or on
+// /stream). The seller doesn't send what would already be expired.
+
+// loadKindTTLs reads SAMPLE_TTL_SECONDS and per-kind <KIND>_TTL_SECONDS.
+func loadKindTTLs(kinds []sensorKind) []sensorKind {
+	def := parseEnvInt("SAMPLE_TTL_SECONDS", 60)
+	for i := range kinds {
+		ttl := parseEnvInt(strings.ToUpper(kinds[i].Name)+"_TTL_SECONDS", def)
+		kinds[i].TTLSeconds = max(ttl, 0)
+	}
+	return kinds
+}
+
+// sampleExpiry returns expires_at for a sample, or 0 when the kind has no TTL.
+func sampleExpiry(kind sensorKind, ts int64) int64 {
+	if kind.TTLSeconds <= 0 {
+		return 0
+	}
+	return ts + int64(kind.TTLSeconds)
+}
+
+// sampleFresh reports whether a sample taken at ts is still worth sending at
+// now, given its expiry and the receiver's max age (0 for none).
+func sampleFresh(now time.Time, ts, expiresAt int64, maxAge time.Duration) bool {
+	if expiresAt > 0 && now.Unix() >= expiresAt {
+		return false
+	}
+	if maxAge > 0 && now.Sub(time.Unix(ts, 0)) > maxAge {
+		return false
+	}
+	return true
+}
+
+// buyerMaxAge is the max_age option of a buyer's service request.
+func buyerMaxAge(info *commonlib.NodeBufferInfo) time.Duration {
+	return parseMaxAge(requestedServiceOptions(info).Get("max_age"))
+}
+
+func parseMaxAge(s string) time.Duration {
+	secs, err := strconv.Atoi(s)
+	if err != nil || secs <= 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
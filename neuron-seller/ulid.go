@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Every sample gets an ID when it is made: a ULID (26 Crockford base32
+// characters, a 48-bit millisecond timestamp then 80 random bits), so it
+// sorts by creation time and is unique across nodes without coordination.
+// It travels as "id" in JSON and CBOR payloads and in the Avro record, is
+// kept with the sample in history (GET /history?id= looks one up) and in
+// the delivery log, so buyers can deduplicate and join across systems on
+// it. IDs made in the same millisecond increment the random part, keeping
+// them in order.
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var ulids struct {
+	mu      sync.Mutex
+	lastMs  uint64
+	entropy [10]byte
+}
+
+// newSampleID returns a ULID for a sample made at t.
+func newSampleID(t time.Time) string {
+	ms := uint64(max(t.UnixMilli(), 0))
+	ulids.mu.Lock()
+	if ms > ulids.lastMs {
+		ulids.lastMs = ms
+		if _, err := rand.Read(ulids.entropy[:]); err != nil {
+			panic("ulid: " + err.Error())
+		}
+	} else {
+		// Same or earlier millisecond (clock stepped back): stay monotonic.
+		ms = ulids.lastMs
+		for i := len(ulids.entropy) - 1; i >= 0; i-- {
+			ulids.entropy[i]++
+			if ulids.entropy[i] != 0 {
+				break
+			}
+		}
+	}
+	var id [16]byte
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+	copy(id[6:], ulids.entropy[:])
+	ulids.mu.Unlock()
+	return encodeULID(id)
+}
+
+// encodeULID renders 128 bits as 26 base32 characters, the first carrying
+// the top 3 bits.
+func encodeULID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// validULID reports whether s looks like an ID from newSampleID.
+func validULID(s string) bool {
+	if len(s) != 26 || s[0] > '7' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'A' <= c && c <= 'Z' && c != 'I' && c != 'L' && c != 'O' && c != 'U') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// JSON sample payloads (P2P, /poll, history) carry an uncertainty block so
+// buyers doing analytics can weight samples. Its sigma is the root sum of
+// squares of three standard uncertainties, all in the kind's unit:
+//
+//   - spec: the sensor's rated accuracy (accuracy on the kind's entry in
+//     the device metadata sensors list),
+//   - drift: drift_per_year on the same entry times the years since the
+//     sensor's calibration_date (or the device's),
+//   - noise: the standard deviation of the kind's last UNCERTAINTY_WINDOW
+//     readings.
+//
+// A fused kind's sigma is the fusion estimate's. Components that aren't
+// known are left out; a sample with no known component has no block.
+// UNCERTAINTY_WINDOW=0 turns the block off. Avro payloads don't carry it.
+
+type sampleUncertainty struct {
+	Sigma              float64 `json:"sigma"`
+	Spec               float64 `json:"spec,omitempty"`
+	Drift              float64 `json:"drift,omitempty"`
+	CalibrationAgeDays int     `json:"calibration_age_days,omitempty"`
+	Noise              float64 `json:"noise,omitempty"`
+}
+
+type uncertaintyTracker struct {
+	window int
+
+	mu     sync.Mutex
+	recent map[string][]float64 // by kind, oldest first
+}
+
+var uncertainty *uncertaintyTracker
+
+func loadUncertainty() {
+	window := parseEnvInt("UNCERTAINTY_WINDOW", 12)
+	if window <= 0 {
+		return
+	}
+	uncertainty = &uncertaintyTracker{window: max(window, 2), recent: make(map[string][]float64)}
+	log.Printf("Uncertain.: spec, calibration drift and noise over %d samples", uncertainty.window)
+}
+
+// Estimate records value for kind and returns its uncertainty; zero when
+// the tracker is off or nothing is known.
+func (t *uncertaintyTracker) Estimate(kind sensorKind, value float64, now time.Time) sampleUncertainty {
+	if t == nil {
+		return sampleUncertainty{}
+	}
+	if kind.FusedFrom != "" {
+		return sampleUncertainty{Sigma: roundUncertainty(fusion.Sigma())}
+	}
+
+	t.mu.Lock()
+	recent := t.recent[kind.Name]
+	if len(recent) == t.window {
+		copy(recent, recent[1:])
+		recent = recent[:len(recent)-1]
+	}
+	recent = append(recent, value)
+	t.recent[kind.Name] = recent
+	noise := stddev(recent)
+	t.mu.Unlock()
+
+	u := sampleUncertainty{Noise: roundUncertainty(noise)}
+	part, calibrated := kindSensorPart(kind.Name)
+	u.Spec = part.Accuracy
+	if !calibrated.IsZero() && now.After(calibrated) {
+		u.CalibrationAgeDays = int(now.Sub(calibrated).Hours() / 24)
+		u.Drift = roundUncertainty(part.DriftPerYear * now.Sub(calibrated).Hours() / (24 * 365.25))
+	}
+	u.Sigma = roundUncertainty(math.Sqrt(u.Spec*u.Spec + u.Drift*u.Drift + noise*noise))
+	return u
+}
+
+// kindSensorPart is the device metadata entry for kind and when it was last
+// calibrated, falling back to the device's calibration date.
+func kindSensorPart(kind string) (sensorPart, time.Time) {
+	deviceMetaMu.RLock()
+	defer deviceMetaMu.RUnlock()
+	var part sensorPart
+	for _, p := range deviceMeta.Sensors {
+		if p.Kind == kind {
+			part = p
+			break
+		}
+	}
+	date := part.CalibrationDate
+	if date == "" {
+		date = deviceMeta.CalibrationDate
+	}
+	calibrated, _ := time.Parse(time.DateOnly, date)
+	return part, calibrated
+}
+
+func roundUncertainty(v float64) float64 {
+	return math.Round(v*1e4) / 1e4
+}
+
+// appendJSON writes u as encoding/json would.
+func (u sampleUncertainty) appendJSON(dst []byte) []byte {
+	dst = append(dst, `{"sigma":`...)
+	dst, _ = appendJSONFloat(dst, u.Sigma)
+	if u.Spec != 0 {
+		dst = append(dst, `,"spec":`...)
+		dst, _ = appendJSONFloat(dst, u.Spec)
+	}
+	if u.Drift != 0 {
+		dst = append(dst, `,"drift":`...)
+		dst, _ = appendJSONFloat(dst, u.Drift)
+	}
+	if u.CalibrationAgeDays != 0 {
+		dst = append(dst, `,"calibration_age_days":`...)
+		dst = strconv.AppendInt(dst, int64(u.CalibrationAgeDays), 10)
+	}
+	if u.Noise != 0 {
+		dst = append(dst, `,"noise":`...)
+		dst, _ = appendJSONFloat(dst, u.Noise)
+	}
+	return append(dst, '}')
+}
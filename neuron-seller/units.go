@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type unit string
+
+const (
+	unitLux             unit = "lux"
+	unitADCCounts       unit = "adc_counts"
+	unitPercent         unit = "percent"
+	unitBrightnessIndex unit = "brightness_index" // 0-10 score the Pi /metrics computes from camera frames
+	unitCelsius         unit = "celsius"
+	unitFahrenheit      unit = "fahrenheit"
+	unitMicrogramsPerM3 unit = "ug_m3" // particulate matter (PM2.5, PM10)
+	unitPPM             unit = "ppm"   // gas concentration (CO2)
+	unitDBA             unit = "dba"   // A-weighted sound level, sent as LAeq per window
+	unitState           unit = "state" // event kinds: 0 inactive, anything else active
+)
+
+// unitConversion converts one kind's Pi reading from the unit the sensor
+// reports to the unit buyers receive.
+//
+// Light-level units are linear over the sensor's range: every value is first
+// mapped to a 0..1 fraction of full scale (ADC max, 100%, index 10, or the
+// configured lux at full scale) and then scaled into the target unit. That is
+// only as accurate as the lux full-scale calibration, which is why it is set
+// per sensor.
+type unitConversion struct {
+	From         unit    `json:"from"`
+	To           unit    `json:"to"`
+	ADCMax       float64 `json:"adc_max,omitempty"`
+	LuxFullScale float64 `json:"lux_full_scale,omitempty"`
+}
+
+var lightUnits = map[unit]bool{unitLux: true, unitADCCounts: true, unitPercent: true, unitBrightnessIndex: true}
+var temperatureUnits = map[unit]bool{unitCelsius: true, unitFahrenheit: true}
+
+// defaultSourceUnit is what the Pi reports for well-known fields.
+func defaultSourceUnit(field string) unit {
+	switch field {
+	case "brightness":
+		return unitBrightnessIndex
+	case "temperature", "temperature_c":
+		return unitCelsius
+	case "lux":
+		return unitLux
+	case "pm2_5", "pm25", "pm10":
+		return unitMicrogramsPerM3
+	case "co2":
+		return unitPPM
+	case "noise", "noise_dba", "sound_level", "laeq":
+		return unitDBA
+	case "motion", "pir", "occupancy", "door", "door_open":
+		return unitState
+	}
+	return ""
+}
+
+// loadKindUnits reads <KIND>_UNIT_SOURCE, <KIND>_UNIT, <KIND>_ADC_MAX and
+// <KIND>_LUX_FULL_SCALE for each kind (KIND upper-cased).
+func loadKindUnits(kinds []sensorKind) ([]sensorKind, error) {
+	out := make([]sensorKind, len(kinds))
+	for i, k := range kinds {
+		prefix := strings.ToUpper(k.Name) + "_"
+		conv := unitConversion{
+			From:         unit(getEnvOrDefault(prefix+"UNIT_SOURCE", string(defaultSourceUnit(k.Field)))),
+			ADCMax:       parseEnvFloat(prefix+"ADC_MAX", 1023),
+			LuxFullScale: parseEnvFloat(prefix+"LUX_FULL_SCALE", 1000),
+		}
+		conv.To = unit(getEnvOrDefault(prefix+"UNIT", string(conv.From)))
+		if err := conv.validate(); err != nil {
+			return nil, fmt.Errorf("kind %s: %w", k.Name, err)
+		}
+		k.Conversion = conv
+		out[i] = k
+	}
+	return out, nil
+}
+
+func (c unitConversion) validate() error {
+	if c.From == c.To {
+		return nil
+	}
+	if lightUnits[c.From] && lightUnits[c.To] {
+		if c.ADCMax <= 0 || c.LuxFullScale <= 0 {
+			return fmt.Errorf("ADC max and lux full scale must be positive")
+		}
+		return nil
+	}
+	if temperatureUnits[c.From] && temperatureUnits[c.To] {
+		return nil
+	}
+	return fmt.Errorf("cannot convert %q to %q", c.From, c.To)
+}
+
+// Apply converts v and rounds to 4 decimals so payloads stay compact.
+func (c unitConversion) Apply(v float64) float64 {
+	if c.From == c.To {
+		return v
+	}
+	var out float64
+	switch {
+	case temperatureUnits[c.From]:
+		if c.From == unitCelsius {
+			out = v*9/5 + 32
+		} else {
+			out = (v - 32) * 5 / 9
+		}
+	default:
+		out = c.fromFraction(c.toFraction(v))
+	}
+	return math.Round(out*1e4) / 1e4
+}
+
+func (c unitConversion) toFraction(v float64) float64 {
+	switch c.From {
+	case unitADCCounts:
+		return v / c.ADCMax
+	case unitPercent:
+		return v / 100
+	case unitBrightnessIndex:
+		return v / 10
+	case unitLux:
+		return v / c.LuxFullScale
+	}
+	return v
+}
+
+func (c unitConversion) fromFraction(f float64) float64 {
+	switch c.To {
+	case unitADCCounts:
+		return f * c.ADCMax
+	case unitPercent:
+		return f * 100
+	case unitBrightnessIndex:
+		return f * 10
+	case unitLux:
+		return f * c.LuxFullScale
+	}
+	return f
+}
+
+func parseEnvFloat(key string, fallback float64) float64 {
+	val := strings.TrimSpace(getEnvOrDefault(key, ""))
+	if val == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return fallback
+	}
+	return f
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// The operator issues vouchers through POST /admin/vouchers and hands the
+// code to a buyer, who redeems it with a redeem_voucher topic command
+// ({"code": "..."}). A code is "LSV1.<payload>.<sig>": the voucher terms in
+// base64url JSON, signed with the sample signing key so buyers can check a
+// code came from this node before redeeming it. A free voucher lets an
+// unpaid buyer stream a number of samples and/or minutes; a discount voucher
+// takes a percentage off billing until it expires. Redemption is checked and
+// recorded under one lock and saved before the reply goes out, so a code
+// can't be redeemed more often than max_redemptions.
+
+const voucherPrefix = "LSV1"
+
+type voucher struct {
+	ID             string    `json:"id"`
+	Type           string    `json:"type"` // free or discount
+	Samples        int       `json:"samples,omitempty"`
+	Minutes        int       `json:"minutes,omitempty"`
+	Percent        int       `json:"percent,omitempty"`
+	Account        string    `json:"account,omitempty"` // only this account may redeem
+	ExpiresAt      time.Time `json:"expires_at"`
+	MaxRedemptions int       `json:"max_redemptions"`
+}
+
+type voucherRedemption struct {
+	Account string    `json:"account"`
+	At      time.Time `json:"at"`
+	Nonce   string    `json:"nonce"`
+}
+
+type issuedVoucher struct {
+	voucher
+	IssuedAt    time.Time           `json:"issued_at"`
+	Revoked     bool                `json:"revoked,omitempty"`
+	Redemptions []voucherRedemption `json:"redemptions"`
+}
+
+// voucherGrant is what an account holds from redeemed vouchers.
+type voucherGrant struct {
+	FreeSamples   int       `json:"free_samples,omitempty"`
+	FreeUntil     time.Time `json:"free_until,omitempty"`
+	DiscountPct   int       `json:"discount_pct,omitempty"`
+	DiscountUntil time.Time `json:"discount_until,omitempty"`
+}
+
+type voucherState struct {
+	Issued map[string]*issuedVoucher `json:"issued"`
+	Grants map[string]*voucherGrant  `json:"grants"`
+}
+
+type voucherBook struct {
+	path string
+
+	mu    sync.Mutex
+	state voucherState
+}
+
+var vouchers *voucherBook
+
+func loadVouchers() {
+	if !parseEnvBool("VOUCHERS_ENABLE", true) || signer == nil {
+		return
+	}
+	v := &voucherBook{
+		path:  getEnvOrDefault("VOUCHER_STATE_FILE", "data/vouchers.json"),
+		state: voucherState{Issued: map[string]*issuedVoucher{}, Grants: map[string]*voucherGrant{}},
+	}
+	data, err := os.ReadFile(v.path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		log.Fatalf("vouchers: %v", err)
+	default:
+		if err := json.Unmarshal(data, &v.state); err != nil {
+			log.Fatalf("vouchers: decode %s: %v", v.path, err)
+		}
+	}
+	vouchers = v
+}
+
+func (v *voucherBook) saveLocked() error {
+	data, err := json.Marshal(v.state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(v.path), 0o755); err != nil {
+		return err
+	}
+	tmp := v.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, v.path)
+}
+
+func encodeVoucher(vc voucher) (string, error) {
+	payload, err := json.Marshal(vc)
+	if err != nil {
+		return "", err
+	}
+	sig := ed25519.Sign(signer.key, payload)
+	enc := base64.RawURLEncoding
+	return voucherPrefix + "." + enc.EncodeToString(payload) + "." + enc.EncodeToString(sig), nil
+}
+
+func decodeVoucher(code string) (voucher, error) {
+	var vc voucher
+	parts := strings.Split(strings.TrimSpace(code), ".")
+	if len(parts) != 3 || parts[0] != voucherPrefix {
+		return vc, errors.New("not a voucher code")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return vc, errors.New("not a voucher code")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(signer.key.Public().(ed25519.PublicKey), payload, sig) {
+		return vc, errors.New("voucher was not issued by this node")
+	}
+	return vc, json.Unmarshal(payload, &vc)
+}
+
+// Issue records a new voucher and returns its code.
+func (v *voucherBook) Issue(vc voucher, now time.Time) (string, error) {
+	switch vc.Type {
+	case "free":
+		if vc.Samples <= 0 && vc.Minutes <= 0 {
+			return "", errors.New("a free voucher needs samples or minutes")
+		}
+	case "discount":
+		if vc.Percent <= 0 || vc.Percent > 100 {
+			return "", errors.New("percent must be between 1 and 100")
+		}
+	default:
+		return "", fmt.Errorf("unknown voucher type %q (free, discount)", vc.Type)
+	}
+	if vc.MaxRedemptions <= 0 {
+		vc.MaxRedemptions = 1
+	}
+	if vc.ExpiresAt.IsZero() {
+		vc.ExpiresAt = now.AddDate(0, 0, 30)
+	}
+	vc.ExpiresAt = vc.ExpiresAt.UTC().Truncate(time.Second)
+	id := make([]byte, 8)
+	rand.Read(id)
+	vc.ID = hex.EncodeToString(id)
+	if vc.Account != "" {
+		vc.Account = voucherAccount(vc.Account)
+	}
+
+	code, err := encodeVoucher(vc)
+	if err != nil {
+		return "", err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.state.Issued[vc.ID] = &issuedVoucher{voucher: vc, IssuedAt: now.UTC(), Redemptions: []voucherRedemption{}}
+	return code, v.saveLocked()
+}
+
+// voucherAccount is how vouchers name an account: a 0x EVM address, or a raw
+// public key.
+func voucherAccount(s string) string {
+	if strings.HasPrefix(strings.ToLower(s), "0x") && len(s) == 42 {
+		return normalizeEVM(s)
+	}
+	return rawKey(s)
+}
+
+// Redeem validates code for account and applies it.
+func (v *voucherBook) Redeem(code, account, nonce string, now time.Time) (voucher, voucherGrant, error) {
+	vc, err := decodeVoucher(code)
+	if err != nil {
+		return vc, voucherGrant{}, err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	iv, ok := v.state.Issued[vc.ID]
+	switch {
+	case !ok:
+		return vc, voucherGrant{}, errors.New("unknown voucher")
+	case iv.Revoked:
+		return vc, voucherGrant{}, errors.New("voucher was revoked")
+	case !now.Before(iv.ExpiresAt):
+		return vc, voucherGrant{}, fmt.Errorf("voucher expired at %s", iv.ExpiresAt.Format(time.RFC3339))
+	case iv.Account != "" && iv.Account != account:
+		return vc, voucherGrant{}, errors.New("voucher is for another account")
+	case len(iv.Redemptions) >= iv.MaxRedemptions:
+		return vc, voucherGrant{}, errors.New("voucher already redeemed")
+	}
+	for _, r := range iv.Redemptions {
+		if r.Account == account {
+			return vc, voucherGrant{}, errors.New("voucher already redeemed by this account")
+		}
+	}
+
+	g := v.state.Grants[account]
+	if g == nil {
+		g = &voucherGrant{}
+	}
+	prev := *g
+	switch iv.Type {
+	case "free":
+		g.FreeSamples += iv.Samples
+		if iv.Minutes > 0 {
+			g.FreeUntil = later(g.FreeUntil, now.Add(time.Duration(iv.Minutes)*time.Minute)).UTC()
+		}
+	case "discount":
+		if iv.Percent >= g.DiscountPct || !now.Before(g.DiscountUntil) {
+			g.DiscountPct = iv.Percent
+			g.DiscountUntil = iv.ExpiresAt
+		}
+	}
+	v.state.Grants[account] = g
+	iv.Redemptions = append(iv.Redemptions, voucherRedemption{Account: account, At: now.UTC(), Nonce: nonce})
+	if err := v.saveLocked(); err != nil {
+		// Roll back so the code is still redeemable once the disk is fixed.
+		*g = prev
+		iv.Redemptions = iv.Redemptions[:len(iv.Redemptions)-1]
+		return vc, voucherGrant{}, fmt.Errorf("persist redemption: %w", err)
+	}
+	return iv.voucher, *g, nil
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// grantFor finds the grant held under the buyer's EVM address or key.
+func (v *voucherBook) grantFor(key, evm string) *voucherGrant {
+	if evm != "" {
+		if g := v.state.Grants[normalizeEVM(evm)]; g != nil {
+			return g
+		}
+	}
+	return v.state.Grants[key]
+}
+
+// Admit reports whether an unpaid buyer has free voucher access left. Free
+// samples are only spent by Delivered, and only outside a free time window.
+// The key and EVM address a buyer names only count once the SDK has
+// validated its account; otherwise anyone could stream on another buyer's
+// grant.
+func (v *voucherBook) Admit(info *commonlib.NodeBufferInfo, now time.Time) bool {
+	if v == nil || !info.IsOtherSideValidAccount {
+		return false
+	}
+	key, evm := buyerIdentity(info)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	g := v.grantFor(key, evm)
+	return g != nil && (now.Before(g.FreeUntil) || g.FreeSamples > 0)
+}
+
+// Delivered spends one free sample unless a free time window covers it.
+func (v *voucherBook) Delivered(key, evm string, now time.Time) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if g := v.grantFor(key, evm); g != nil && !now.Before(g.FreeUntil) && g.FreeSamples > 0 {
+		g.FreeSamples--
+		if g.FreeSamples%50 == 0 {
+			if err := v.saveLocked(); err != nil {
+				log.Printf("vouchers: save: %v", err)
+			}
+		}
+	}
+}
+
+// Discount returns the percentage off billing the buyer holds now.
+func (v *voucherBook) Discount(key, evm string, now time.Time) int {
+	if v == nil {
+		return 0
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if g := v.grantFor(key, evm); g != nil && now.Before(g.DiscountUntil) {
+		return g.DiscountPct
+	}
+	return 0
+}
+
+func redeemVoucherCommand(cmd commandEnvelope) (any, error) {
+	if vouchers == nil {
+		return nil, ErrDisabled.With("vouchers disabled on this node")
+	}
+	var p struct {
+		Code string `json:"code"`
+	}
+	if err := decodeParams(cmd, &p); err != nil {
+		return nil, err
+	}
+	if p.Code == "" {
+		return nil, commandErrorf(commandErrInvalidParams, "code is required")
+	}
+	account := rawKey(cmd.Issuer)
+	if cmd.Account != "" {
+		account = voucherAccount(cmd.Account)
+	}
+	vc, grant, err := vouchers.Redeem(p.Code, account, cmd.Nonce, time.Now())
+	if err != nil {
+		return nil, commandErrorf(commandErrFailed, "%v", err)
+	}
+	log.Printf("vouchers: %s voucher %s redeemed by %.18s", vc.Type, vc.ID, account)
+	return map[string]any{"voucher": vc.ID, "type": vc.Type, "account": account, "grant": grant}, nil
+}
+
+// GET /admin/vouchers lists issued vouchers and grants; POST issues one
+// from {"type", "samples", "minutes", "percent", "account", "expires_at",
+// "max_redemptions"} and returns its code; DELETE ?id= revokes one.
+func adminVouchersHandler(w http.ResponseWriter, r *http.Request) {
+	if vouchers == nil {
+		writeJSONError(w, ErrDisabled.With("vouchers disabled (VOUCHERS_ENABLE=false or no signing key)"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var vc voucher
+		if err := json.NewDecoder(r.Body).Decode(&vc); err != nil {
+			writeJSONError(w, ErrBadRequest.With("invalid JSON body"))
+			return
+		}
+		code, err := vouchers.Issue(vc, time.Now())
+		if err != nil {
+			writeJSONError(w, ErrBadRequest.Wrap(err))
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]any{"code": code})
+		return
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		vouchers.mu.Lock()
+		iv, ok := vouchers.state.Issued[id]
+		if ok {
+			iv.Revoked = true
+			if err := vouchers.saveLocked(); err != nil {
+				log.Printf("vouchers: save: %v", err)
+			}
+		}
+		vouchers.mu.Unlock()
+		if !ok {
+			writeJSONError(w, ErrNotFound.With("unknown voucher "+id))
+			return
+		}
+	default:
+		writeJSONError(w, ErrMethodNotAllowed)
+		return
+	}
+
+	vouchers.mu.Lock()
+	issued := make([]issuedVoucher, 0, len(vouchers.state.Issued))
+	for _, iv := range vouchers.state.Issued {
+		issued = append(issued, *iv)
+	}
+	data, err := json.Marshal(vouchers.state.Grants)
+	vouchers.mu.Unlock()
+	if err != nil {
+		writeJSONError(w, ErrInternal.Wrap(err))
+		return
+	}
+	sort.Slice(issued, func(i, j int) bool { return issued[i].IssuedAt.Before(issued[j].IssuedAt) })
+	writeJSON(w, http.StatusOK, map[string]any{"vouchers": issued, "grants": json.RawMessage(data)})
+}
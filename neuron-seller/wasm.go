@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// Operators can transform each sample before it goes out with a small
+// WASM module (TinyGo, AssemblyScript, Rust, ... built for WASI): convert
+// units, redact fields, add derived ones. WASM_TRANSFORMS lists the
+// modules; each becomes the pipeline stage wasm:<file name without .wasm>,
+// running between encode and sign. The module reads the sample's JSON
+// payload on stdin and writes the payload to send on stdout: a JSON
+// object, or nothing to drop the sample.
+//
+// Modules run in-process on one wazero runtime and are compiled once at
+// startup. Every sample gets a fresh instance, so no state leaks between
+// samples, with WASM_MEMORY_MB of linear memory and WASM_TIMEOUT_MS of
+// wall time; output past 64 KiB is cut off. A module that traps, runs out
+// or writes anything but a JSON object drops the sample (WASM_ON_ERROR=drop,
+// the default) or leaves it as it was (pass).
+
+const wasmMaxOutput = 64 << 10
+
+// wasmRuntime is shared by every transform; nil until one is loaded.
+var wasmRuntime wazero.Runtime
+
+type wasmTransform struct {
+	name     string
+	module   string
+	compiled wazero.CompiledModule
+	timeout  time.Duration
+	drop     bool
+}
+
+func loadWASMTransforms() {
+	list := getEnvOrDefault("WASM_TRANSFORMS", "")
+	if list == "" {
+		return
+	}
+	memory := max(parseEnvInt("WASM_MEMORY_MB", 16), 1)
+	timeout := time.Duration(max(parseEnvInt("WASM_TIMEOUT_MS", 500), 1)) * time.Millisecond
+	onError := strings.ToLower(getEnvOrDefault("WASM_ON_ERROR", "drop"))
+	if onError != "pass" && onError != "drop" {
+		log.Fatalf("wasm: WASM_ON_ERROR must be pass or drop, got %q", onError)
+	}
+
+	ctx := context.Background()
+	wasmRuntime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(memory<<20/65536)).
+		WithCloseOnContextDone(true))
+	wasi_snapshot_preview1.MustInstantiate(ctx, wasmRuntime)
+
+	for _, module := range strings.Split(list, ",") {
+		module = strings.TrimSpace(module)
+		if module == "" {
+			continue
+		}
+		code, err := os.ReadFile(module)
+		if err != nil {
+			log.Fatalf("wasm: %v", err)
+		}
+		compiled, err := wasmRuntime.CompileModule(ctx, code)
+		if err != nil {
+			log.Fatalf("wasm: compile %s: %v", module, err)
+		}
+		t := &wasmTransform{
+			name:     "wasm:" + strings.TrimSuffix(filepath.Base(module), ".wasm"),
+			module:   module,
+			compiled: compiled,
+			timeout:  timeout,
+			drop:     onError == "drop",
+		}
+		registerPayloadStage(t)
+		log.Printf("WASM      : %s from %s (%d MB, %s, on error %s)", t.name, module, memory, timeout, onError)
+	}
+}
+
+func (t *wasmTransform) Name() string { return t.name }
+
+func (t *wasmTransform) Process(smp *pipelineSample) (bool, error) {
+	out, err := t.run(smp.Data)
+	if err != nil {
+		if t.drop {
+			log.Printf("neuron-seller: %s: %v, sample dropped", t.name, err)
+			return false, nil
+		}
+		log.Printf("neuron-seller: %s: %v, sample sent as it was", t.name, err)
+		return true, nil
+	}
+	if out == nil {
+		return false, nil
+	}
+	smp.Data = out
+	return true, nil
+}
+
+// run feeds payload to a fresh instance of the module and returns what it
+// wrote, nil for nothing.
+func (t *wasmTransform) run(payload []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	stdout := &limitedWriter{max: wasmMaxOutput}
+	stderr := &limitedWriter{max: 4 << 10}
+	cfg := wazero.NewModuleConfig().
+		WithName(""). // anonymous, so instances don't clash
+		WithArgs(filepath.Base(t.module)).
+		WithStdin(bytes.NewReader(payload)).
+		WithStdout(stdout).
+		WithStderr(stderr)
+	mod, err := wasmRuntime.InstantiateModule(ctx, t.compiled, cfg)
+	if mod != nil {
+		mod.Close(ctx)
+	}
+	var exit *sys.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return nil, fmt.Errorf("no result within %s", t.timeout)
+	case errors.As(err, &exit) && exit.ExitCode() == 0:
+	case err != nil:
+		if msg := strings.TrimSpace(stderr.buf.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, firstLine(msg))
+		}
+		return nil, err
+	}
+	if stdout.over {
+		return nil, fmt.Errorf("output over %d bytes", wasmMaxOutput)
+	}
+	out := bytes.TrimSpace(stdout.buf.Bytes())
+	switch {
+	case len(out) == 0:
+		return nil, nil
+	case out[0] != '{' || !json.Valid(out):
+		return nil, fmt.Errorf("output is not a JSON object")
+	}
+	// Room for the newline the stream loop appends.
+	return append(make([]byte, 0, len(out)+1), out...), nil
+}
+
+var errOutputLimit = errors.New("output limit reached")
+
+// limitedWriter keeps the first max bytes written to it and fails writes
+// past that, so a module can't grow the buffer without bound.
+type limitedWriter struct {
+	buf  bytes.Buffer
+	max  int
+	over bool
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	room := w.max - w.buf.Len()
+	if len(p) > room {
+		w.buf.Write(p[:max(room, 0)])
+		w.over = true
+		return max(room, 0), errOutputLimit
+	}
+	return w.buf.Write(p)
+}
+
+// firstLine is s up to its first newline.
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With WEATHER_ENABLE, JSON payloads carry a weather block (cloud cover,
+// solar elevation, shortwave radiation) from a weather API so buyers can
+// normalise brightness against the expected conditions. WEATHER_API_URL is
+// fetched with {lat} and {lon} replaced by the seller's position; the
+// default is Open-Meteo's current conditions, which need no key. Each value
+// is read from a dotted path in the response (WEATHER_*_FIELD); an empty
+// path leaves that value out.
+//
+// Samples never wait on the API: a background loop refreshes the
+// conditions every WEATHER_REFRESH_MINUTES, spends at most
+// WEATHER_MAX_CALLS_PER_DAY calls (UTC day), backs off on errors, and
+// payloads carry the last good reading until it is older than
+// WEATHER_MAX_AGE_MINUTES.
+
+const defaultWeatherURL = "https://api.open-meteo.com/v1/forecast?latitude={lat}&longitude={lon}&current=cloud_cover,shortwave_radiation"
+
+// weatherSnapshot is one API reading as sent in payloads.
+type weatherSnapshot struct {
+	CloudCover     *float64 `json:"cloud_cover_pct,omitempty"`
+	SolarElevation *float64 `json:"solar_elevation_deg,omitempty"`
+	Radiation      *float64 `json:"shortwave_radiation_wm2,omitempty"`
+	ObservedAt     int64    `json:"observed_at"`
+	Source         string   `json:"source"`
+
+	encoded []byte // the JSON above, computed once per reading
+}
+
+type weatherConfig struct {
+	URL            string
+	CloudField     string
+	ElevationField string
+	RadiationField string
+	Refresh        time.Duration
+	MaxAge         time.Duration
+	MaxCallsPerDay int
+}
+
+type weatherCache struct {
+	cfg weatherConfig
+
+	mu       sync.Mutex
+	current  *weatherSnapshot
+	lastErr  string
+	day      string
+	calls    int
+	failures int
+}
+
+var weather *weatherCache
+
+func loadWeather() {
+	if !parseEnvBool("WEATHER_ENABLE", false) {
+		return
+	}
+	cfg := weatherConfig{
+		URL:            getEnvOrDefault("WEATHER_API_URL", defaultWeatherURL),
+		CloudField:     getEnvOrDefault("WEATHER_CLOUD_FIELD", "current.cloud_cover"),
+		ElevationField: getEnvOrDefault("WEATHER_SOLAR_ELEVATION_FIELD", ""),
+		RadiationField: getEnvOrDefault("WEATHER_RADIATION_FIELD", "current.shortwave_radiation"),
+		Refresh:        time.Duration(max(parseEnvInt("WEATHER_REFRESH_MINUTES", 15), 1)) * time.Minute,
+		MaxAge:         time.Duration(max(parseEnvInt("WEATHER_MAX_AGE_MINUTES", 60), 1)) * time.Minute,
+		MaxCallsPerDay: parseEnvInt("WEATHER_MAX_CALLS_PER_DAY", 500),
+	}
+	weather = &weatherCache{cfg: cfg}
+	go weather.run()
+	log.Printf("Weather   : %s every %s (max %d calls/day)", weatherHost(cfg.URL), cfg.Refresh, cfg.MaxCallsPerDay)
+}
+
+// Current is the last reading if it is recent enough, else nil.
+func (c *weatherCache) Current(now time.Time) *weatherSnapshot {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current == nil || now.Sub(time.Unix(c.current.ObservedAt, 0)) > c.cfg.MaxAge {
+		return nil
+	}
+	return c.current
+}
+
+func (c *weatherCache) run() {
+	for {
+		wait := c.cfg.Refresh
+		if err := c.refresh(time.Now()); err != nil {
+			c.mu.Lock()
+			c.failures++
+			c.lastErr = err.Error()
+			// Retry sooner than the refresh interval, backing off.
+			wait = min(time.Duration(1<<min(c.failures, 6))*time.Minute, c.cfg.Refresh)
+			c.mu.Unlock()
+			log.Printf("weather: %v", err)
+		}
+		time.Sleep(wait)
+	}
+}
+
+func (c *weatherCache) refresh(now time.Time) error {
+	c.mu.Lock()
+	if day := now.UTC().Format(time.DateOnly); day != c.day {
+		c.day, c.calls = day, 0
+	}
+	if c.cfg.MaxCallsPerDay > 0 && c.calls >= c.cfg.MaxCallsPerDay {
+		c.mu.Unlock()
+		return fmt.Errorf("daily budget of %d calls spent", c.cfg.MaxCallsPerDay)
+	}
+	c.calls++
+	c.mu.Unlock()
+
+	// {lat} and {lon} are filled in per call; the sensor may have moved.
+	loc := currentLocation()
+	u := strings.NewReplacer(
+		"{lat}", strconv.FormatFloat(loc.Lat, 'f', 4, 64),
+		"{lon}", strconv.FormatFloat(loc.Lon, 'f', 4, 64),
+	).Replace(c.cfg.URL)
+	var body any
+	if err := getJSON(u, &body); err != nil {
+		return err
+	}
+	snap := &weatherSnapshot{ObservedAt: now.Unix(), Source: weatherHost(c.cfg.URL)}
+	field := func(path string) *float64 {
+		if path == "" {
+			return nil
+		}
+		v, ok := jsonPathNumber(body, path)
+		if !ok {
+			return nil
+		}
+		return &v
+	}
+	snap.CloudCover = field(c.cfg.CloudField)
+	snap.SolarElevation = field(c.cfg.ElevationField)
+	snap.Radiation = field(c.cfg.RadiationField)
+	encoded, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	snap.encoded = encoded
+
+	c.mu.Lock()
+	c.current = snap
+	c.failures = 0
+	c.lastErr = ""
+	c.mu.Unlock()
+	return nil
+}
+
+// Status is the cache state for /status.
+func (c *weatherCache) Status() map[string]any {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := map[string]any{
+		"source":      weatherHost(c.cfg.URL),
+		"calls_today": c.calls,
+		"max_calls":   c.cfg.MaxCallsPerDay,
+	}
+	if c.current != nil {
+		out["current"] = c.current
+	}
+	if c.lastErr != "" {
+		out["error"] = c.lastErr
+	}
+	return out
+}
+
+func weatherHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
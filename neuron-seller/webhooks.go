@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+)
+
+// Operators who want to hear about lifecycle transitions without polling
+// /status list receivers in WEBHOOK_URLS (comma separated). Each event is
+// POSTed as
+//
+//	{"event": "pi_lost", "seller_id": "...", "time": "...", "detail": {...}}
+//
+// to every receiver, with X-Localsense-Event naming the event and, when
+// WEBHOOK_SECRET is set, X-Localsense-Signature: sha256=<hex HMAC of the
+// body>. WEBHOOK_EVENTS limits which events are sent (default all).
+// Deliveries run in the background, in order, and are retried with backoff
+// WEBHOOK_RETRIES times; events beyond a queue of 64 are dropped and
+// counted, so a dead receiver never holds the node up.
+//
+// Events:
+//
+//   - started: the node is up and serving.
+//   - first_buyer_connected: a buyer connected while none were.
+//   - buyer_disconnected: a connected buyer went away.
+//   - pi_lost: WEBHOOK_PI_FAILURES Pi reads in a row failed.
+//   - pi_recovered: the Pi answered again after pi_lost.
+//   - budget_exceeded, budget_recovered: the node went over its memory
+//     budget (MEMORY_BUDGET_MB) and started shedding buyers, or came back.
+//   - maintenance_started, maintenance_ended: see maintenance.go.
+//   - topic_lag, topic_lag_recovered: topic messages arrive more than
+//     TOPIC_LAG_ALERT_SECONDS after consensus, or are back under it.
+
+const (
+	webhookStarted             = "started"
+	webhookFirstBuyerConnected = "first_buyer_connected"
+	webhookBuyerDisconnected   = "buyer_disconnected"
+	webhookPiLost              = "pi_lost"
+	webhookPiRecovered         = "pi_recovered"
+	webhookBudgetExceeded      = "budget_exceeded"
+	webhookBudgetRecovered     = "budget_recovered"
+	webhookMaintenanceStarted  = "maintenance_started"
+	webhookMaintenanceEnded    = "maintenance_ended"
+	webhookTopicLag            = "topic_lag"
+	webhookTopicLagRecovered   = "topic_lag_recovered"
+)
+
+var webhookEvents = []string{
+	webhookStarted,
+	webhookFirstBuyerConnected,
+	webhookBuyerDisconnected,
+	webhookPiLost,
+	webhookPiRecovered,
+	webhookBudgetExceeded,
+	webhookBudgetRecovered,
+	webhookMaintenanceStarted,
+	webhookMaintenanceEnded,
+	webhookTopicLag,
+	webhookTopicLagRecovered,
+}
+
+const webhookQueue = 64
+
+type webhookEvent struct {
+	Event    string         `json:"event"`
+	SellerID string         `json:"seller_id"`
+	Time     time.Time      `json:"time"`
+	Detail   map[string]any `json:"detail,omitempty"`
+}
+
+type webhookNotifier struct {
+	urls    []string
+	events  map[string]bool
+	secret  []byte
+	retries int
+	timeout time.Duration
+	queue   chan webhookEvent
+
+	sent    atomic.Int64
+	failed  atomic.Int64
+	dropped atomic.Int64
+}
+
+var webhooks *webhookNotifier
+
+func loadWebhooks() {
+	var urls []string
+	for _, u := range strings.Split(getEnvOrDefault("WEBHOOK_URLS", ""), ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			log.Fatalf("webhooks: %q in WEBHOOK_URLS is not an http(s) URL", u)
+		}
+		urls = append(urls, u)
+	}
+	piLostAfter = max(parseEnvInt("WEBHOOK_PI_FAILURES", 3), 1)
+	if len(urls) == 0 {
+		return
+	}
+
+	n := &webhookNotifier{
+		urls:    urls,
+		events:  map[string]bool{},
+		secret:  []byte(getEnvOrDefault("WEBHOOK_SECRET", "")),
+		retries: max(parseEnvInt("WEBHOOK_RETRIES", 3), 0),
+		timeout: time.Duration(max(parseEnvInt("WEBHOOK_TIMEOUT_SECONDS", 10), 1)) * time.Second,
+		queue:   make(chan webhookEvent, webhookQueue),
+	}
+	filter := getEnvOrDefault("WEBHOOK_EVENTS", "")
+	for _, e := range webhookEvents {
+		n.events[e] = filter == ""
+	}
+	for _, e := range strings.Split(filter, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		if _, ok := n.events[e]; !ok {
+			log.Fatalf("webhooks: unknown event %q in WEBHOOK_EVENTS (known: %s)", e, strings.Join(webhookEvents, ", "))
+		}
+		n.events[e] = true
+	}
+	webhooks = n
+	go n.run()
+	log.Printf("Webhooks  : %d receiver(s), events %s", len(urls), n.enabled())
+}
+
+func (n *webhookNotifier) enabled() string {
+	var on []string
+	for _, e := range webhookEvents {
+		if n.events[e] {
+			on = append(on, e)
+		}
+	}
+	return strings.Join(on, ", ")
+}
+
+// Emit queues event for delivery; it never blocks.
+func (n *webhookNotifier) Emit(event string, detail map[string]any) {
+	if n == nil || !n.events[event] {
+		return
+	}
+	ev := webhookEvent{Event: event, SellerID: sellerCfg.SellerID, Time: time.Now().UTC(), Detail: detail}
+	select {
+	case n.queue <- ev:
+	default:
+		n.dropped.Add(1)
+		log.Printf("webhooks: queue full, dropping %s", event)
+	}
+}
+
+func (n *webhookNotifier) run() {
+	for ev := range n.queue {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			log.Printf("webhooks: encode %s: %v", ev.Event, err)
+			continue
+		}
+		for _, url := range n.urls {
+			if err := n.deliver(url, ev.Event, body); err != nil {
+				n.failed.Add(1)
+				log.Printf("webhooks: %s to %s failed: %v", ev.Event, url, err)
+				continue
+			}
+			n.sent.Add(1)
+		}
+	}
+}
+
+// deliver posts body to url, retrying failures after 1s, 2s, 4s...
+func (n *webhookNotifier) deliver(url, event string, body []byte) error {
+	var err error
+	for attempt := 0; attempt <= n.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second << (attempt - 1))
+		}
+		if err = n.post(url, event, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (n *webhookNotifier) post(url, event string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Localsense-Event", event)
+	if len(n.secret) > 0 {
+		mac := hmac.New(sha256.New, n.secret)
+		mac.Write(body)
+		req.Header.Set("X-Localsense-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// piLostAfter is how many Pi reads in a row must fail for pi_lost.
+var (
+	piLostAfter    = 3
+	piFailStreak   atomic.Int64
+	piLostNotified atomic.Bool
+)
+
+// observePi records the outcome of one Pi read for the health score and
+// the pi_lost/pi_recovered webhooks.
+func observePi(ok bool, err error) {
+	nodeHealth.Observe(healthPi, ok)
+	if ok {
+		failed := piFailStreak.Swap(0)
+		if piLostNotified.CompareAndSwap(true, false) {
+			webhooks.Emit(webhookPiRecovered, map[string]any{"failed_reads": failed})
+		}
+		return
+	}
+	if piFailStreak.Add(1) >= int64(piLostAfter) && piLostNotified.CompareAndSwap(false, true) {
+		detail := map[string]any{"failed_reads": piFailStreak.Load()}
+		if err != nil {
+			detail["error"] = err.Error()
+		}
+		webhooks.Emit(webhookPiLost, detail)
+	}
+}
+
+// watchBuyers compares the connected buyers with the last call's, for the
+// buyer webhooks. It runs on the stream loop goroutine.
+func (s *neuronSeller) watchBuyers(buffers *commonlib.NodeBuffers) {
+	connected := map[string]bool{}
+	for peerID, info := range buffers.GetBufferMap() {
+		if info.LibP2PState == types.Connected {
+			connected[peerID.String()] = true
+		}
+	}
+	if len(s.connected) == 0 && len(connected) > 0 {
+		for peerID := range connected {
+			webhooks.Emit(webhookFirstBuyerConnected, map[string]any{"peer": peerID})
+			break
+		}
+	}
+	for peerID := range s.connected {
+		if !connected[peerID] {
+			webhooks.Emit(webhookBuyerDisconnected, map[string]any{"peer": peerID, "connected": len(connected)})
+		}
+	}
+	s.connected = connected
+}
+
+func writeWebhookMetrics(w http.ResponseWriter) {
+	if webhooks == nil {
+		return
+	}
+	fmt.Fprintln(w, "# HELP localsense_webhooks_total Webhook deliveries, by result.")
+	fmt.Fprintln(w, "# TYPE localsense_webhooks_total counter")
+	fmt.Fprintf(w, "localsense_webhooks_total{result=%q} %d\n", "sent", webhooks.sent.Load())
+	fmt.Fprintf(w, "localsense_webhooks_total{result=%q} %d\n", "failed", webhooks.failed.Load())
+	fmt.Fprintf(w, "localsense_webhooks_total{result=%q} %d\n", "dropped", webhooks.dropped.Load())
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	hedera_helper "github.com/NeuronInnovations/neuron-go-hedera-sdk/hedera"
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+)
+
+// A failed write to a buyer stream used to send the buyer a peerError
+// asking for a fresh Hedera service request every time: a topic message
+// per failure, and a full renegotiation for what was often a slow reader
+// or a blip. Failures are now classified and reported by class:
+//
+//   - buffer_full: the write timed out, the buyer isn't reading fast
+//     enough. Nothing is sent on Hedera; the link quality backoff and its
+//     in-band link_quality frame slow the stream down instead.
+//   - transient: the stream was reset or couldn't be opened on a live
+//     connection. Retried on the next sample; only after
+//     WRITE_ERROR_TRANSIENT_LIMIT failures in a row is the buyer asked for
+//     a fresh request (StreamError, SendFreshHederaRequest).
+//   - peer_gone: no connection to the buyer is left. The buyer is asked
+//     once to reconnect (DisconnectedError, PunchMe), which is cheaper
+//     than a fresh request, and not again until a write succeeds.
+//   - unknown: reported as before (WriteError, SendFreshHederaRequest).
+//
+// Reports to a peer are at most one per WRITE_ERROR_REPORT_COOLDOWN_SECONDS.
+// Failures and reports are counted on /metrics.
+
+type writeErrorClass string
+
+const (
+	writeErrBufferFull writeErrorClass = "buffer_full"
+	writeErrTransient  writeErrorClass = "transient"
+	writeErrPeerGone   writeErrorClass = "peer_gone"
+	writeErrUnknown    writeErrorClass = "unknown"
+)
+
+var writeErrorClasses = []writeErrorClass{writeErrBufferFull, writeErrTransient, writeErrPeerGone, writeErrUnknown}
+
+// classifyWriteError sorts an error from writeBuyerStream. The SDK wraps
+// most causes with %w but tags them only in the message, so both are
+// looked at.
+func classifyWriteError(err error) writeErrorClass {
+	var netErr net.Error
+	msg := err.Error()
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout(), errors.Is(err, os.ErrDeadlineExceeded):
+		return writeErrBufferFull
+	case strings.Contains(msg, "peer is not connected"), strings.Contains(msg, "stream handler is nil"):
+		return writeErrPeerGone
+	case strings.HasPrefix(msg, string(types.CanNotConnectStreamError)),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrClosedPipe),
+		strings.Contains(msg, "stream reset"), strings.Contains(msg, "connection reset"):
+		return writeErrTransient
+	}
+	return writeErrUnknown
+}
+
+type peerWriteErrors struct {
+	consecutive int
+	reported    time.Time
+	goneNotice  bool // told to reconnect since the last good write
+}
+
+type writeErrorTracker struct {
+	transientLimit int
+	cooldown       time.Duration
+
+	mu    sync.Mutex
+	peers map[string]*peerWriteErrors
+
+	failures map[writeErrorClass]*atomic.Int64
+	reports  map[writeErrorClass]*atomic.Int64
+}
+
+var writeErrors = newWriteErrorTracker()
+
+func newWriteErrorTracker() *writeErrorTracker {
+	t := &writeErrorTracker{
+		transientLimit: 3,
+		cooldown:       5 * time.Minute,
+		peers:          make(map[string]*peerWriteErrors),
+		failures:       make(map[writeErrorClass]*atomic.Int64),
+		reports:        make(map[writeErrorClass]*atomic.Int64),
+	}
+	for _, c := range writeErrorClasses {
+		t.failures[c] = new(atomic.Int64)
+		t.reports[c] = new(atomic.Int64)
+	}
+	return t
+}
+
+func loadWriteErrors() {
+	writeErrors.transientLimit = max(parseEnvInt("WRITE_ERROR_TRANSIENT_LIMIT", 3), 1)
+	writeErrors.cooldown = time.Duration(max(parseEnvInt("WRITE_ERROR_REPORT_COOLDOWN_SECONDS", 300), 0)) * time.Second
+}
+
+// peerErrorReport is what, if anything, to tell the buyer on Hedera.
+type peerErrorReport struct {
+	ErrorType types.ErrorType
+	Action    types.RecoverAction
+}
+
+// Failed records a failed write to peer and decides whether to report it.
+func (t *writeErrorTracker) Failed(peer string, err error, now time.Time) (writeErrorClass, *peerErrorReport) {
+	class := classifyWriteError(err)
+	t.failures[class].Add(1)
+	nodeHealth.Observe(healthPeerWrites, false)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.peers[peer]
+	if !ok {
+		st = &peerWriteErrors{}
+		t.peers[peer] = st
+	}
+	st.consecutive++
+
+	var report *peerErrorReport
+	switch class {
+	case writeErrBufferFull:
+	case writeErrTransient:
+		if st.consecutive >= t.transientLimit {
+			report = &peerErrorReport{types.StreamError, types.SendFreshHederaRequest}
+		}
+	case writeErrPeerGone:
+		if !st.goneNotice {
+			report = &peerErrorReport{types.DisconnectedError, types.PunchMe}
+		}
+	default:
+		report = &peerErrorReport{types.WriteError, types.SendFreshHederaRequest}
+	}
+	if report == nil || (!st.reported.IsZero() && now.Sub(st.reported) < t.cooldown) {
+		return class, nil
+	}
+	st.reported = now
+	if class == writeErrPeerGone {
+		st.goneNotice = true
+	}
+	t.reports[class].Add(1)
+	return class, report
+}
+
+// Succeeded clears peer's failure streak.
+func (t *writeErrorTracker) Succeeded(peer string) {
+	nodeHealth.Observe(healthPeerWrites, true)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if st, ok := t.peers[peer]; ok {
+		st.consecutive = 0
+		st.goneNotice = false
+	}
+}
+
+// Forget drops a peer's state.
+func (t *writeErrorTracker) Forget(peer string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.peers, peer)
+}
+
+// reportWriteError handles a failed write to a buyer stream: classify,
+// log, and send the buyer a peerError if its class calls for one.
+func reportWriteError(peerID string, bufferInfo *commonlib.NodeBufferInfo, err error) {
+	class, report := writeErrors.Failed(peerID, err, time.Now())
+	log.Printf("neuron-seller: stream write to %s failed (%s): %v", peerID, class, err)
+	if report == nil {
+		return
+	}
+	log.Printf("neuron-seller: asking %s to recover with %s", peerID, report.Action)
+	hedera_helper.PeerSendErrorMessage(
+		bufferInfo.RequestOrResponse.OtherStdInTopic,
+		report.ErrorType,
+		fmt.Sprintf("localsense node %s unavailable: %v", sellerCfg.SellerID, err),
+		report.Action,
+	)
+}
+
+func writeWriteErrorMetrics(w http.ResponseWriter) {
+	fmt.Fprintln(w, "# HELP localsense_stream_write_errors_total Failed writes to buyer streams, by class.")
+	fmt.Fprintln(w, "# TYPE localsense_stream_write_errors_total counter")
+	for _, c := range writeErrorClasses {
+		fmt.Fprintf(w, "localsense_stream_write_errors_total{class=%q} %d\n", c, writeErrors.failures[c].Load())
+	}
+	fmt.Fprintln(w, "# HELP localsense_peer_error_reports_total peerError messages sent to buyers on Hedera, by write error class.")
+	fmt.Fprintln(w, "# TYPE localsense_peer_error_reports_total counter")
+	for _, c := range writeErrorClasses {
+		fmt.Fprintf(w, "localsense_peer_error_reports_total{class=%q} %d\n", c, writeErrors.reports[c].Load())
+	}
+}